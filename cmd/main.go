@@ -1,30 +1,148 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/ben/transcription-proxy/internal/api"
+	"github.com/ben/transcription-proxy/internal/batch"
 	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/grpcapi"
+	"github.com/ben/transcription-proxy/internal/procs"
 	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/ben/transcription-proxy/internal/stdoutsink"
+	"github.com/ben/transcription-proxy/internal/streaming"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/ben/transcription-proxy/internal/upload"
+	"github.com/ben/transcription-proxy/internal/version"
+	"github.com/sirupsen/logrus"
 )
 
+// captionsBuffer is how many captions stdout may fall behind before the
+// oldest are lost
+const captionsBuffer = 100
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		cfg := config.New()
+		setProcessLimits(cfg)
+		os.Exit(runBatch(cfg, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		os.Exit(runUpload(config.New(), os.Args[2:]))
+	}
+
+	checkTargets := flag.Bool("check-targets", false, "Validate the configured target URLs and exit")
+	withTestPublish := flag.Bool("with-test-publish", false, "With --check-targets, publish a 2 second test clip to every target (goes live!)")
+	captionsStdout := flag.Bool("captions-stdout", false, "Write finalized captions to stdout; logs stay on stderr")
+	captionsFormat := flag.String("captions-format", stdoutsink.FormatJSON, "Format of --captions-stdout: json (one event per line), srt, or vtt")
+	captionsLang := flag.String("captions-lang", "", "Language of --captions-stdout: a language code, or original for the text before translation; all languages if empty")
+	flag.Parse()
+
+	// Logs never go to stdout, which may carry captions
+	log.SetOutput(os.Stderr)
+
 	cfg := config.New()
+	setProcessLimits(cfg)
+
+	if *checkTargets {
+		os.Exit(runTargetCheck(cfg, *withTestPublish))
+	}
 
+	log.Printf("Starting transcription-proxy %s", version.Build())
+	for _, tool := range version.Tools() {
+		if tool.Error != "" {
+			log.Printf("%s: version unknown (%s)", tool.Name, tool.Error)
+		} else {
+			log.Printf("%s: %s", tool.Name, tool.Version)
+		}
+	}
 	log.Printf("Starting transcription RTMP server with configuration:")
+	log.Printf("Mode: %s", cfg.Mode)
 	log.Printf("RTMP port: %s", cfg.RTMPPort)
 	log.Printf("CUDA enabled: %v", cfg.CUDAEnabled)
 	log.Printf("Model path: %s", cfg.WhisperModelPath)
 	log.Printf("Model size: %s", cfg.WhisperModelSize)
+	if modelDir, err := transcriber.ResolveModelDir(cfg); err != nil {
+		log.Printf("Model directory: %v", err)
+	} else {
+		log.Printf("Model directory: %s", modelDir)
+	}
 	log.Printf("Output directory: %s", cfg.OutputDir)
-	log.Printf("Default target URL: %s", cfg.DefaultTargetURL)
+	if cfg.WorkDir != "" {
+		log.Printf("Work directory: %s", cfg.WorkDir)
+	}
+	log.Printf("Minimum free disk space: %d MB", cfg.MinFreeDiskMB)
+	if cfg.FFmpegThreads > 0 || cfg.ProcessNice != 0 {
+		log.Printf("FFmpeg limits: %d threads, niceness %d", cfg.FFmpegThreads, cfg.ProcessNice)
+	}
+	if cfg.MaxChildProcesses > 0 {
+		log.Printf("Child processes capped at %d", cfg.MaxChildProcesses)
+	}
+	log.Printf("Control API address: %s", cfg.ListenAddress)
+	if cfg.TranscribeOnly() && !cfg.Passthrough() {
+		log.Printf("Transcribe-only mode: incoming stream will not be restreamed")
+	} else {
+		log.Printf("Default target URL: %s", cfg.DefaultTargetURL)
+	}
+	if cfg.AudioOnly {
+		log.Printf("Audio-only mode: streams are expected without video")
+	}
 	log.Printf("Log level: %s", cfg.LogLevel)
+	log.Printf("Shutdown timeout: %s", cfg.ShutdownTimeout)
 
 	// Initialize and start the RTMP server
 	proxyServer := proxy.New(cfg)
 
+	if *captionsStdout {
+		sink, err := stdoutsink.New(os.Stdout, *captionsFormat, strings.ToLower(*captionsLang), proxyServer.VTTOptions(), proxyServer.Logger())
+		if err != nil {
+			log.Fatalf("Invalid caption output: %v", err)
+		}
+		// A reader going away fails the write with EPIPE instead of killing
+		// the process
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+		go sink.Run(proxyServer.Events().Subscribe(captionsBuffer))
+	}
+
+	// SIGUSR1 writes the transcripts of the running stream to disk
+	flushCh := make(chan os.Signal, 1)
+	signal.Notify(flushCh, syscall.SIGUSR1)
+	go func() {
+		for range flushCh {
+			if _, err := proxyServer.FlushTranscripts(); err != nil {
+				log.Printf("Failed to flush transcripts: %v", err)
+			}
+		}
+	}()
+
+	// Serve the health and control endpoints first so readiness can be
+	// observed while models warm up
+	apiServer := api.New(cfg, proxyServer)
+	if err := apiServer.Start(); err != nil {
+		log.Fatalf("Failed to start HTTP control server: %v", err)
+	}
+
+	// Serve ad-hoc transcription next to the RTMP stream if enabled
+	var grpcServer *grpcapi.Server
+	if cfg.GRPCEnabled {
+		grpcServer = grpcapi.New(cfg, proxyServer)
+		if err := grpcServer.Start(); err != nil {
+			log.Fatalf("Failed to start gRPC transcription server: %v", err)
+		}
+	}
+
 	// Start the server in a non-blocking way
 	if err := proxyServer.Start(); err != nil {
 		log.Fatalf("Failed to start RTMP server: %v", err)
@@ -36,14 +154,258 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	// Wait for termination signal
-	sig := <-sigCh
-	log.Printf("Received signal %v, shutting down...", sig)
+	// Wait for a termination signal, or for the listener to take no more
+	// streams, which leaves nothing to do but to be restarted
+	var sig os.Signal
+	select {
+	case sig = <-sigCh:
+		log.Printf("Received signal %v, shutting down...", sig)
+	case <-proxyServer.Done():
+		log.Println("No more streams are taken, shutting down...")
+	}
+
+	// Clean shutdown of the RTMP server, draining in-flight chunks until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+
+	if err := apiServer.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping HTTP control server: %v", err)
+	}
+
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(ctx); err != nil {
+			log.Printf("Error stopping gRPC transcription server: %v", err)
+		}
+	}
+
+	if err := proxyServer.Close(ctx); err != nil {
+		if errors.Is(err, proxy.ErrShutdownForced) {
+			log.Printf("Shutdown forced after %s: in-flight chunks were abandoned", cfg.ShutdownTimeout)
+		} else {
+			log.Printf("Error stopping RTMP server: %v", err)
+		}
+	}
+	cancel()
+
+	report := proxyServer.Report()
+	logShutdownReport(proxyServer.Logger(), report, sig)
+	os.Exit(exitCode(report))
+}
+
+// Exit codes of the proxy: an unrecoverable failure exits with exitFailure,
+// so restart policies that only act on failures restart it
+const (
+	exitOK      = 0
+	exitFailure = 1
+)
+
+// exitCode returns the exit code of the process for its shutdown report
+func exitCode(report proxy.ShutdownReport) int {
+	if report.Fatal() {
+		return exitFailure
+	}
+	return exitOK
+}
 
-	// Clean shutdown of the RTMP server
-	if err := proxyServer.Stop(); err != nil {
-		log.Printf("Error stopping RTMP server: %v", err)
+// logShutdownReport logs the shutdown report as a single entry; sig is the
+// signal that stopped the proxy, if any
+func logShutdownReport(logger *logrus.Logger, report proxy.ShutdownReport, sig os.Signal) {
+	fields := logrus.Fields{
+		"reason":           report.Reason,
+		"uptime":           report.Uptime.Round(time.Second),
+		"sessions":         report.Sessions,
+		"chunks_processed": report.Chunks.Processed,
+		"chunks_failed":    report.Chunks.Failed,
+		"chunks_dropped":   report.Chunks.Dropped,
+		"drained":          report.Drained,
+		"exit_code":        exitCode(report),
+	}
+	if sig != nil {
+		fields["signal"] = sig.String()
+	}
+	if report.Error != "" {
+		fields["error"] = report.Error
 	}
 
-	log.Println("Server shutdown complete")
+	entry := logger.WithFields(fields)
+	switch {
+	case report.Fatal():
+		entry.Error("Shutdown report")
+	case !report.Drained:
+		entry.Warn("Shutdown report")
+	default:
+		entry.Info("Shutdown report")
+	}
+}
+
+// setProcessLimits applies the configured CPU limits to the FFmpeg
+// processes started from now on, and the cap on child processes
+func setProcessLimits(cfg *config.Config) {
+	procs.SetLimits(procs.Limits{Threads: cfg.FFmpegThreads, Nice: cfg.ProcessNice, MaxProcesses: cfg.MaxChildProcesses})
+}
+
+// runTargetCheck validates the configured targets, prints the results as a
+// table, and returns the process exit code
+func runTargetCheck(cfg *config.Config, testPublish bool) int {
+	targets, err := streaming.ParseStreamURLs(cfg.DefaultTargetURL, streaming.Ingests{Twitch: cfg.TwitchIngest, YouTube: cfg.YouTubeIngest}, cfg.SecretsDir)
+	if err != nil {
+		log.Printf("Invalid target configuration: %v", err)
+		return 1
+	}
+
+	checks := streaming.ValidateTargets(context.Background(), targets, testPublish)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tRESULT\tERROR")
+	exitCode := 0
+	for _, check := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Target, check.Result, check.Error)
+		if check.Result != streaming.CheckOK {
+			exitCode = 1
+		}
+	}
+	w.Flush()
+
+	return exitCode
+}
+
+// runBatch captions the media files of a directory or glob with the offline
+// pipeline, prints a summary, and returns the process exit code. The first
+// interrupt finishes the files being transcribed, a second one aborts them.
+func runBatch(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	outDir := flags.String("out", "", "Write the outputs to a tree mirroring the input in this directory instead of next to each file")
+	jobs := flags.Int("jobs", 1, "Number of files transcribed in parallel")
+	format := flags.String("format", "srt", "Subtitle format, srt or vtt")
+	sourceLang := flags.String("src-lang", cfg.DefaultSourceLang, "Language spoken in the files")
+	targetLang := flags.String("lang", cfg.DefaultTargetLang, "Language of the captions")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s batch [flags] <directory or glob>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// Batch jobs are the only users of the models, so each gets a slot
+	cfg.AdhocMaxJobs = max(*jobs, 1)
+	proxyServer := proxy.New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Printf("Interrupted, finishing the files being transcribed; interrupt again to abort them")
+		close(stop)
+		<-sigCh
+		log.Printf("Aborting")
+		cancel()
+	}()
+
+	summary, err := batch.Run(ctx, stop, proxyServer, batch.Options{
+		Input:  flags.Arg(0),
+		OutDir: *outDir,
+		Jobs:   *jobs,
+		Langs:  proxy.Languages{Source: *sourceLang, Target: *targetLang},
+		Format: subtitles.SubtitleFormat(*format),
+	})
+	if err != nil {
+		log.Printf("Batch failed: %v", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Processed:\t%d\n", summary.Processed)
+	fmt.Fprintf(w, "Skipped (up to date):\t%d\n", summary.Skipped)
+	fmt.Fprintf(w, "Failed:\t%d\n", summary.Failed)
+	if summary.Remaining > 0 {
+		fmt.Fprintf(w, "Remaining (interrupted):\t%d\n", summary.Remaining)
+	}
+	fmt.Fprintf(w, "Audio:\t%.2f hours\n", summary.Audio.Hours())
+	fmt.Fprintf(w, "Wall time:\t%s\n", summary.Wall.Round(time.Second))
+	w.Flush()
+
+	if summary.Failed > 0 || summary.Remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runUpload finishes the uploads of sessions left pending, or uploads the
+// sessions given by ID, and returns the process exit code
+func runUpload(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	all := flags.Bool("all", false, "Also upload the sessions that were never uploaded")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s upload [flags] [session ID...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if cfg.UploadBucket == "" {
+		log.Printf("UPLOAD_BUCKET is not set")
+		return 2
+	}
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	uploader, err := upload.New(cfg, logger)
+	if err != nil {
+		log.Printf("Invalid upload settings: %v", err)
+		return 2
+	}
+
+	entries, err := session.List(cfg.OutputDir)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	ids := make(map[string]bool, flags.NArg())
+	for _, id := range flags.Args() {
+		ids[id] = true
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	uploaded, failed := 0, 0
+	for _, entry := range entries {
+		switch {
+		case len(ids) > 0:
+			if !ids[entry.ID] {
+				continue
+			}
+			delete(ids, entry.ID)
+		case entry.EndedAt == nil:
+			// Still running, or the proxy died while it ran
+			continue
+		case entry.Upload == nil && !*all:
+			continue
+		case entry.Upload != nil && entry.Upload.Status == session.UploadDone:
+			continue
+		}
+
+		if err := uploader.Finish(ctx, session.Open(entry)); err != nil {
+			log.Printf("Failed to upload %s: %v", entry.ID, err)
+			failed++
+		} else {
+			uploaded++
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	for id := range ids {
+		log.Printf("Session %s not found", id)
+		failed++
+	}
+
+	log.Printf("Uploaded %d sessions, %d failed", uploaded, failed)
+	if failed > 0 || ctx.Err() != nil {
+		return 1
+	}
+	return 0
 }
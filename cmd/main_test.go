@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		report proxy.ShutdownReport
+		want   int
+	}{
+		{"requested", proxy.ShutdownReport{Reason: proxy.StopRequested, Drained: true}, exitOK},
+		{"stream ended", proxy.ShutdownReport{Reason: proxy.StopStreamEnded, Drained: true}, exitOK},
+		{"max duration", proxy.ShutdownReport{Reason: proxy.StopMaxDuration, Drained: true}, exitOK},
+		{"idle", proxy.ShutdownReport{Reason: proxy.StopIdle, Drained: true}, exitOK},
+		// A forced shutdown still stopped as asked
+		{"not drained", proxy.ShutdownReport{Reason: proxy.StopRequested}, exitOK},
+		{"failed", proxy.ShutdownReport{Reason: proxy.StopFailed, Error: "listener failed", Drained: true}, exitFailure},
+		{"failed and not drained", proxy.ShutdownReport{Reason: proxy.StopFailed}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.report); got != tt.want {
+				t.Errorf("exitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogShutdownReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		report proxy.ShutdownReport
+		sig    os.Signal
+		level  string
+		fields map[string]any // Expected among the fields of the entry
+	}{
+		{
+			"signal",
+			proxy.ShutdownReport{Reason: proxy.StopRequested, Sessions: 2, Drained: true},
+			syscall.SIGTERM, "info",
+			map[string]any{"reason": proxy.StopRequested, "signal": "terminated", "sessions": 2.0, "exit_code": 0.0},
+		},
+		{
+			"not drained",
+			proxy.ShutdownReport{Reason: proxy.StopRequested},
+			syscall.SIGINT, "warning",
+			map[string]any{"drained": false, "exit_code": 0.0},
+		},
+		{
+			"failed",
+			proxy.ShutdownReport{Reason: proxy.StopFailed, Error: "listener failed", Drained: true},
+			nil, "error",
+			map[string]any{"reason": proxy.StopFailed, "error": "listener failed", "exit_code": 1.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&buf)
+			logger.SetFormatter(&logrus.JSONFormatter{})
+
+			logShutdownReport(logger, tt.report, tt.sig)
+
+			var entry map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("logged %q, want a single entry: %v", buf.String(), err)
+			}
+			if entry["msg"] != "Shutdown report" || entry["level"] != tt.level {
+				t.Errorf("logged %v at %v, want the report at %s", entry["msg"], entry["level"], tt.level)
+			}
+			for key, want := range tt.fields {
+				if entry[key] != want {
+					t.Errorf("%s = %v, want %v", key, entry[key], want)
+				}
+			}
+			if _, ok := entry["signal"]; ok != (tt.sig != nil) {
+				t.Errorf("signal logged %v, want it only if a signal stopped the proxy", entry["signal"])
+			}
+		})
+	}
+}
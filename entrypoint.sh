@@ -1,10 +1,17 @@
 #!/bin/bash
 
-# Check if we need to download the whisper model
-if [ ! -d "/app/models/whisper/${WHISPER_MODEL_SIZE}" ]; then
-  echo "Model directory: ${WHISPER_MODEL_PATH}"
-  echo "Downloading and optimizing ${WHISPER_MODEL_SIZE} model..."
-  /app/download_model.sh "${WHISPER_MODEL_SIZE}" "${WHISPER_MODEL_PATH}" "${COMPUTE_PRECISION}" "${CUDA_ENABLED}"
+# Check if we need to download the whisper model (skipped when a custom WHISPER_MODEL_DIR is used)
+if [ -z "${WHISPER_MODEL_DIR}" ]; then
+  case "${WHISPER_MODEL_SIZE}" in
+    "large-v3-turbo") MODEL_DIR_NAME="faster-whisper-large-v3-turbo-ct2" ;;
+    *) MODEL_DIR_NAME="faster-whisper-${WHISPER_MODEL_SIZE}" ;;
+  esac
+
+  if [ ! -f "${WHISPER_MODEL_PATH}/${MODEL_DIR_NAME}/model.bin" ]; then
+    echo "Model directory: ${WHISPER_MODEL_PATH}/${MODEL_DIR_NAME}"
+    echo "Downloading ${WHISPER_MODEL_SIZE} model..."
+    /app/download_model.sh "${WHISPER_MODEL_SIZE}" "${WHISPER_MODEL_PATH}" "${COMPUTE_PRECISION}" "${CUDA_ENABLED}"
+  fi
 fi
 
 # Download Argos models for supported languages
@@ -0,0 +1,130 @@
+// Command grpc-client is an example client of the gRPC transcription service.
+// It sends an audio file to TranscribeFile and prints the segments:
+//
+//	go run ./examples/grpc-client -addr localhost:9090 -lang de -target en talk.mp3
+//
+// With -stream, the file is decoded to PCM with FFmpeg and streamed to
+// Transcribe in one second chunks instead.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/ben/transcription-proxy/internal/grpcapi/transcriptionpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// sampleRate is the rate the file is decoded to with -stream
+const sampleRate = 16000
+
+func main() {
+	addr := flag.String("addr", "localhost:9090", "Address of the gRPC transcription service")
+	token := flag.String("token", os.Getenv("API_TOKEN"), "API token of the proxy, if it requires one")
+	lang := flag.String("lang", "", "Language spoken in the audio, the proxy's default if empty")
+	target := flag.String("target", "", "Language to translate into, none if empty")
+	stream := flag.Bool("stream", false, "Stream raw PCM instead of sending the file")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal("usage: grpc-client [flags] <audio-file>")
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := transcriptionpb.NewTranscriptionClient(conn)
+
+	ctx := context.Background()
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+	}
+	opts := &transcriptionpb.Options{SourceLang: *lang, TargetLang: *target}
+
+	if *stream {
+		err = transcribeStream(ctx, client, flag.Arg(0), opts)
+	} else {
+		err = transcribeFile(ctx, client, flag.Arg(0), opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// transcribeFile sends the whole file in one request
+func transcribeFile(ctx context.Context, client transcriptionpb.TranscriptionClient, path string, opts *transcriptionpb.Options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.TranscribeFile(ctx, &transcriptionpb.TranscribeFileRequest{Options: opts, Audio: data})
+	if err != nil {
+		return fmt.Errorf("transcription failed: %w", err)
+	}
+	for _, segment := range resp.GetSegments() {
+		printSegment(segment)
+	}
+	return nil
+}
+
+// transcribeStream decodes the file to PCM and streams it, printing segments
+// as they arrive
+func transcribeStream(ctx context.Context, client transcriptionpb.TranscriptionClient, path string, opts *transcriptionpb.Options) error {
+	var pcm bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", path, "-vn",
+		"-f", "s16le", "-ar", fmt.Sprint(sampleRate), "-ac", "1", "pipe:1")
+	cmd.Stdout = &pcm
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	stream, err := client.Transcribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Receive while sending, since segments arrive before the upload ends
+	done := make(chan error, 1)
+	go func() {
+		for {
+			segment, err := stream.Recv()
+			if err == io.EOF {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- fmt.Errorf("transcription failed: %w", err)
+				return
+			}
+			printSegment(segment)
+		}
+	}()
+
+	chunk := &transcriptionpb.AudioChunk{Options: opts, SampleRate: sampleRate}
+	for pcm.Len() > 0 {
+		chunk.Pcm = pcm.Next(2 * sampleRate)
+		if err := stream.Send(chunk); err != nil {
+			break // The receiving side reports the error
+		}
+		chunk = &transcriptionpb.AudioChunk{}
+	}
+	stream.CloseSend()
+
+	return <-done
+}
+
+func printSegment(segment *transcriptionpb.Segment) {
+	fmt.Printf("[%7.2f - %7.2f] (%s) %s\n", segment.GetStart(), segment.GetEnd(), segment.GetLang(), segment.GetText())
+}
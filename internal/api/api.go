@@ -0,0 +1,1252 @@
+// Package api serves the HTTP control and status endpoints of the proxy.
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/events"
+	"github.com/ben/transcription-proxy/internal/preview"
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/searchindex"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/ben/transcription-proxy/internal/streaming"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/ben/transcription-proxy/internal/transcript"
+	"github.com/ben/transcription-proxy/internal/translator"
+	"github.com/ben/transcription-proxy/internal/version"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// indexHTML is the single-page web UI
+//
+//go:embed ui/index.html
+var indexHTML []byte
+
+// Server is the HTTP control server
+type Server struct {
+	config     *config.Config
+	proxy      *proxy.Proxy
+	logger     *logrus.Logger
+	router     *mux.Router
+	httpServer *http.Server
+
+	// jobs holds background transcriptions started by POST /transcribe;
+	// jobsCtx is cancelled on shutdown to abort them
+	jobsMu     sync.Mutex
+	jobs       map[string]*transcribeJob
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+}
+
+// New creates a control server for the given proxy
+func New(cfg *config.Config, p *proxy.Proxy) *Server {
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+
+	s := &Server{
+		config:     cfg,
+		proxy:      p,
+		logger:     p.Logger(),
+		router:     mux.NewRouter(),
+		jobs:       make(map[string]*transcribeJob),
+		jobsCtx:    jobsCtx,
+		cancelJobs: cancelJobs,
+	}
+
+	s.routes()
+
+	s.httpServer = &http.Server{
+		Addr:              cfg.ListenAddress,
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// routes registers all endpoints
+func (s *Server) routes() {
+	s.router.HandleFunc("/", s.handleIndex).Methods(http.MethodGet)
+
+	// Probes stay open so orchestrators don't need the token
+	s.router.HandleFunc("/healthz", s.handleHealth).Methods(http.MethodGet)
+	s.router.HandleFunc("/readyz", s.handleReady).Methods(http.MethodGet)
+
+	s.router.Handle("/status", s.readOnly(s.handleStatus)).Methods(http.MethodGet)
+	s.router.Handle("/version", s.readOnly(s.handleVersion)).Methods(http.MethodGet)
+	// Process arguments and output are never served without the token
+	s.router.Handle("/debug/processes", s.requireToken(http.HandlerFunc(s.handleProcesses))).Methods(http.MethodGet)
+
+	s.router.Handle("/stream/languages", s.mutating(s.handleSetLanguages)).Methods(http.MethodPut)
+	s.router.Handle("/stream/dump", s.mutating(s.handleDumpStream)).Methods(http.MethodPost)
+	s.router.Handle("/stream/flush", s.mutating(s.handleFlushStream)).Methods(http.MethodPost)
+	s.router.Handle("/stream/stop", s.mutating(s.handleStopStream)).Methods(http.MethodPost)
+	s.router.Handle("/targets", s.mutating(s.handleAddTarget)).Methods(http.MethodPost)
+	s.router.Handle("/targets/validate", s.mutating(s.handleValidateTargets)).Methods(http.MethodPost)
+	s.router.Handle("/targets/{id}/reset", s.mutating(s.handleResetTarget)).Methods(http.MethodPost)
+
+	s.router.Handle("/translation/pairs", s.readOnly(s.handleTranslationPairs)).Methods(http.MethodGet)
+	s.router.Handle("/translation/languages", s.mutating(s.handleChangeExtraLanguages)).Methods(http.MethodPost)
+
+	s.router.Handle("/captions/live.vtt", s.readOnly(s.handleLiveCaptions)).Methods(http.MethodGet)
+	s.router.Handle("/captions/recent", s.readOnly(s.handleRecentCaptions)).Methods(http.MethodGet)
+	s.router.Handle("/captions/ws", s.readOnly(s.handleCaptionSocket)).Methods(http.MethodGet)
+
+	s.router.Handle("/preview/stream.flv", s.readOnly(s.handlePreviewStream)).Methods(http.MethodGet)
+
+	s.router.Handle("/transcribe", s.mutating(s.handleTranscribe)).Methods(http.MethodPost)
+	s.router.Handle("/transcribe/{id}", s.readOnly(s.handleTranscribeJob)).Methods(http.MethodGet)
+
+	s.router.Handle("/sessions", s.readOnly(s.handleListSessions)).Methods(http.MethodGet)
+	s.router.Handle("/sessions/{id}/transcript", s.readOnly(s.handleSessionTranscript)).Methods(http.MethodGet)
+	s.router.Handle("/sessions/{id}/subtitles", s.readOnly(s.handleSessionSubtitles)).Methods(http.MethodGet)
+	s.router.Handle("/sessions/{id}/summary", s.readOnly(s.handleSessionSummary)).Methods(http.MethodGet)
+	s.router.Handle("/sessions/{id}/reprocess", s.mutating(s.handleReprocessSession)).Methods(http.MethodPost)
+
+	s.router.Handle("/search", s.readOnly(s.handleSearch)).Methods(http.MethodGet)
+}
+
+// mutating wraps a handler that changes state, which always requires the API
+// token when one is configured
+func (s *Server) mutating(next http.HandlerFunc) http.Handler {
+	return s.requireToken(next)
+}
+
+// readOnly wraps a handler that only reads state, which requires the API
+// token unless API_READONLY_OPEN is set
+func (s *Server) readOnly(next http.HandlerFunc) http.Handler {
+	if s.config.APIReadOnlyOpen {
+		return next
+	}
+	return s.requireToken(next)
+}
+
+// requireToken rejects requests without a matching bearer token. Without a
+// configured token every request is allowed.
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.APIToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.APIToken)) != 1 {
+			s.logger.WithFields(logrus.Fields{
+				"remote_addr": r.RemoteAddr,
+				"method":      r.Method,
+				"path":        r.URL.Path,
+			}).Warn("Rejected control API request with missing or invalid token")
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transcription-proxy"`)
+			s.writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// socketTokenProtocol prefixes the API token, base64url-encoded, offered as
+// a WebSocket subprotocol by browsers, which can't set the Authorization
+// header of a WebSocket
+const socketTokenProtocol = "bearer."
+
+// bearerToken returns the API token of r, from the Authorization header or
+// for WebSockets from the subprotocols
+func bearerToken(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, true
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		return "", false
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if encoded, ok := strings.CutPrefix(protocol, socketTokenProtocol); ok {
+			token, err := base64.RawURLEncoding.DecodeString(encoded)
+			return string(token), err == nil
+		}
+	}
+	return "", false
+}
+
+// Start begins serving in the background
+func (s *Server) Start() error {
+	// Listen before returning so a bad or busy address is reported
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.ListenAddress, err)
+	}
+
+	logger := s.logger.WithField("address", listener.Addr().String())
+	if s.config.APIToken == "" && !isLoopback(listener.Addr()) {
+		logger.Warn("Control API has no API_TOKEN and is reachable from the network")
+	}
+	logger.Info("Starting HTTP control server")
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.WithError(err).Error("HTTP control server failed")
+		}
+	}()
+
+	return nil
+}
+
+// isLoopback reports whether addr only accepts local connections
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// Shutdown stops the server, waiting for active requests until ctx is done.
+// Background transcriptions are aborted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancelJobs()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down HTTP control server: %w", err)
+	}
+	return nil
+}
+
+// handleHealth reports proxy health, answering 503 while degraded
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := s.proxy.Health()
+
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	s.writeJSON(w, status, health)
+}
+
+// handleReady answers 200 once the proxy is ready for streams and 503 before
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := s.proxy.Ready()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	s.writeJSON(w, status, map[string]bool{"ready": ready})
+}
+
+// handleStatus reports the current configuration and state of the proxy
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.proxy.Status())
+}
+
+// handleVersion reports the build of the proxy and the versions of the
+// external tools it runs
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, version.Get())
+}
+
+// handleProcesses lists the child processes that are running and those that
+// exited last, and what they take of the limits of the container
+func (s *Server) handleProcesses(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]any{"processes": s.proxy.Processes(), "usage": s.proxy.ResourceUsage()})
+}
+
+// handleIndex serves the web UI
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
+
+// handleSetLanguages switches the source and/or target language of the
+// active stream, starting with the next chunk
+func (s *Server) handleSetLanguages(w http.ResponseWriter, r *http.Request) {
+	var languages proxy.Languages
+	if err := json.NewDecoder(r.Body).Decode(&languages); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	updated, err := s.proxy.SetLanguages(languages)
+	switch {
+	case errors.Is(err, proxy.ErrNoActiveStream):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, translator.ErrPairUnavailable):
+		s.writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, updated)
+	}
+}
+
+// extraLanguagesRequest adds and removes extra caption languages
+type extraLanguagesRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// handleChangeExtraLanguages adds and removes extra languages the captions of
+// the active stream are translated into
+func (s *Server) handleChangeExtraLanguages(w http.ResponseWriter, r *http.Request) {
+	var request extraLanguagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	updated, err := s.proxy.ChangeExtraLanguages(request.Add, request.Remove)
+	switch {
+	case errors.Is(err, proxy.ErrNoActiveStream):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, translator.ErrPairUnavailable):
+		s.writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, updated)
+	}
+}
+
+// handleDumpStream drops the delayed output of the active stream that hasn't
+// gone out yet
+func (s *Server) handleDumpStream(w http.ResponseWriter, r *http.Request) {
+	until, err := s.proxy.DumpDelayed()
+	switch {
+	case errors.Is(err, proxy.ErrNoDelay), errors.Is(err, proxy.ErrNoActiveStream):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, map[string]any{
+			"dumped_until_seconds": until.Seconds(),
+		})
+	}
+}
+
+// handleFlushStream writes the transcripts of the active stream to disk right
+// away, like SIGUSR1
+func (s *Server) handleFlushStream(w http.ResponseWriter, r *http.Request) {
+	paths, err := s.proxy.FlushTranscripts()
+	switch {
+	case errors.Is(err, proxy.ErrNoActiveStream), errors.Is(err, proxy.ErrNoTranscript):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, map[string]any{"files": paths})
+	}
+}
+
+// handleStopStream stops the proxy like SIGTERM: the stream is cut off,
+// queued chunks get until SHUTDOWN_TIMEOUT to reach the targets, and the
+// process exits once no more streams are taken
+func (s *Server) handleStopStream(w http.ResponseWriter, r *http.Request) {
+	// The stop goes on if the client gives up waiting
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.config.ShutdownTimeout)
+	defer cancel()
+
+	err := s.proxy.Stop(ctx)
+	switch {
+	case errors.Is(err, proxy.ErrStarting), errors.Is(err, proxy.ErrStopping):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, proxy.ErrShutdownForced):
+		s.writeJSON(w, http.StatusOK, map[string]any{"stopped": true, "forced": true})
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, map[string]any{"stopped": true, "forced": false})
+	}
+}
+
+// handleValidateTargets checks that the configured targets resolve and accept
+// connections. With ?test_publish=true a short test clip is published to
+// every target.
+func (s *Server) handleValidateTargets(w http.ResponseWriter, r *http.Request) {
+	testPublish, _ := strconv.ParseBool(r.URL.Query().Get("test_publish"))
+
+	targets, err := streaming.ParseStreamURLs(s.config.DefaultTargetURL, streaming.Ingests{Twitch: s.config.TwitchIngest, YouTube: s.config.YouTubeIngest}, s.config.SecretsDir)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, streaming.ValidateTargets(r.Context(), targets, testPublish))
+}
+
+// addTargetRequest adds a target to the active stream
+type addTargetRequest struct {
+	URL string `json:"url"` // Like an entry of TARGET_URL, ${NAME} secrets included
+}
+
+// handleAddTarget adds a target to the active stream until it ends. The URL
+// is validated like TARGET_URL, and its secrets are resolved and redacted in
+// the returned status.
+func (s *Server) handleAddTarget(w http.ResponseWriter, r *http.Request) {
+	var request addTargetRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.URL == "" {
+		s.writeError(w, http.StatusBadRequest, "invalid request body, expected a target url")
+		return
+	}
+
+	status, err := s.proxy.AddTarget(request.URL)
+	switch {
+	case errors.Is(err, proxy.ErrInvalidTarget):
+		s.writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, proxy.ErrNoActiveStream), errors.Is(err, streaming.ErrDuplicateTarget):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusCreated, status)
+	}
+}
+
+// handleResetTarget closes the circuit breaker of a target of the active
+// stream, so a target that kept failing, e.g. with a wrong stream key, is
+// retried right away
+func (s *Server) handleResetTarget(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "id must be the index of a target")
+		return
+	}
+
+	status, err := s.proxy.ResetTarget(id)
+	switch {
+	case errors.Is(err, streaming.ErrUnknownTarget):
+		s.writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, proxy.ErrNoActiveStream):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// handleTranslationPairs lists the installed translation language pairs
+func (s *Server) handleTranslationPairs(w http.ResponseWriter, r *http.Request) {
+	pairs, err := s.proxy.TranslationPairs()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"enabled": s.config.EnableTranslation,
+		"pairs":   pairs,
+	})
+}
+
+// handleLiveCaptions serves the recent cues of the active session as a WebVTT
+// document for polling players. Cue timestamps are relative to the start of
+// the stream. With ?since=<cue-id> only newer cues are returned.
+func (s *Server) handleLiveCaptions(w http.ResponseWriter, r *http.Request) {
+	since := 0
+	if value := r.URL.Query().Get("since"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 0 {
+			s.writeError(w, http.StatusBadRequest, "since must be a cue id")
+			return
+		}
+		since = id
+	}
+
+	// Without an active session the document is valid but empty
+	cues, _ := s.proxy.LiveCues(since)
+
+	var buf bytes.Buffer
+	options := s.proxy.VTTOptions()
+	subtitles.WriteVTTHeader(&buf, options)
+	for _, cue := range cues {
+		if err := subtitles.WriteVTTCue(&buf, cue.ID, cue.Segment, options); err != nil {
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handlePreviewStream serves what is sent to the targets as HTTP-FLV for a
+// player to open, until the stream ends
+func (s *Server) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
+	p := s.proxy.Preview()
+	if p == nil {
+		s.writeError(w, http.StatusNotFound, "stream preview is disabled")
+		return
+	}
+
+	err := p.Serve(w, r)
+	switch {
+	case errors.Is(err, preview.ErrNoStream):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, preview.ErrTooManyViewers):
+		s.writeError(w, http.StatusServiceUnavailable, err.Error())
+	}
+}
+
+// defaultRecentCaptions is how many captions /captions/recent returns without
+// a limit
+const defaultRecentCaptions = 50
+
+// recentCaption is a caption returned by /captions/recent. Times are relative
+// to the start of the stream.
+type recentCaption struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// handleRecentCaptions serves the newest captions of the active session as
+// JSON, oldest first, for clients that join mid-stream. ?limit=<n> sets how
+// many are returned.
+func (s *Server) handleRecentCaptions(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRecentCaptions
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.writeError(w, http.StatusBadRequest, "limit must be a non-negative number")
+			return
+		}
+		limit = n
+	}
+
+	// Without an active session the list is empty
+	cues, _ := s.proxy.RecentCues(limit)
+
+	captions := make([]recentCaption, 0, len(cues))
+	for _, cue := range cues {
+		captions = append(captions, recentCaption{
+			ID:    cue.ID,
+			Start: cue.Segment.Start,
+			End:   cue.Segment.End,
+			Text:  cue.Segment.Text,
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	s.writeJSON(w, http.StatusOK, map[string]any{"captions": captions})
+}
+
+// WebSocket caption stream settings
+const (
+	// captionSocketBuffer is how many captions a WebSocket client may fall
+	// behind before it loses the oldest
+	captionSocketBuffer = 100
+	// captionSocketWriteTimeout bounds writing a single message
+	captionSocketWriteTimeout = 10 * time.Second
+	// captionSocketPingInterval is how often idle connections are checked
+	captionSocketPingInterval = 30 * time.Second
+)
+
+// captionSocketProtocol is the subprotocol the web UI offers next to its
+// token, as browsers drop connections that accept none they offered
+const captionSocketProtocol = "captions"
+
+// captionUpgrader accepts WebSocket connections from pages on the same host
+var captionUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{captionSocketProtocol},
+}
+
+// socketCaption is a caption sent to WebSocket clients. Replay is set on the
+// captions from before the client connected.
+type socketCaption struct {
+	*events.Caption
+	Session string `json:"session"`
+	Replay  bool   `json:"replay,omitempty"`
+}
+
+// handleCaptionSocket streams captions to a WebSocket client as JSON
+// messages as they are finalized. With ?replay=true the recent captions of
+// the stream are sent first, marked with "replay": true.
+func (s *Server) handleCaptionSocket(w http.ResponseWriter, r *http.Request) {
+	replay := false
+	if value := r.URL.Query().Get("replay"); value != "" {
+		var err error
+		if replay, err = strconv.ParseBool(value); err != nil {
+			s.writeError(w, http.StatusBadRequest, "replay must be true or false")
+			return
+		}
+	}
+
+	conn, err := captionUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		return
+	}
+	defer conn.Close()
+
+	var sub *events.Subscription
+	var history []events.Event
+	if replay {
+		sub, history = s.proxy.Events().SubscribeReplay(captionSocketBuffer)
+	} else {
+		sub = s.proxy.Events().Subscribe(captionSocketBuffer)
+	}
+	defer sub.Close()
+
+	// Read to handle control frames and notice the client going away;
+	// messages from the client are ignored
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event events.Event, replayed bool) error {
+		conn.SetWriteDeadline(time.Now().Add(captionSocketWriteTimeout))
+		return conn.WriteJSON(socketCaption{Caption: event.Caption, Session: event.Session, Replay: replayed})
+	}
+
+	for _, event := range history {
+		if err := send(event, true); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(captionSocketPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(captionSocketWriteTimeout))
+				return
+			}
+			if event.Kind != events.KindCaption {
+				continue
+			}
+			if err := send(event, false); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(captionSocketWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Output formats of POST /transcribe
+const (
+	transcribeFormatJSON = "json"
+	transcribeFormatSRT  = "srt"
+	transcribeFormatVTT  = "vtt"
+	transcribeFormatTXT  = "txt"
+
+	transcribeFormatVerboseJSON = "verbose_json"
+)
+
+// jobRetention is how long finished background transcriptions are kept
+const jobRetention = time.Hour
+
+// Background transcription states
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// transcribeJob is a transcription running in the background
+type transcribeJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Duration   float64    `json:"duration_seconds"` // Of the audio
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	format string
+	result transcription
+}
+
+// transcription is the result of an ad-hoc transcription
+type transcription struct {
+	segments  []transcriber.Segment
+	originals []transcriber.Segment // Before translation, nil if not translated
+	langs     proxy.Languages
+	duration  time.Duration // Of the audio
+}
+
+// transcribeRequest is the JSON body of POST /transcribe for a server-local
+// file
+type transcribeRequest struct {
+	Path string `json:"path"`
+}
+
+// handleTranscribe transcribes an uploaded file, sent as the file field of a
+// multipart form, or a server-local file below TRANSCRIBE_LOCAL_DIR, named by
+// a JSON body. ?source= and ?target= select the languages and ?format= the
+// output: json, srt, vtt, txt, or verbose_json. Audio up to TRANSCRIBE_SYNC_MAX long is
+// answered right away; longer audio, or any with ?async=true, becomes a job
+// to poll with GET /transcribe/{id}.
+func (s *Server) handleTranscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = transcribeFormatJSON
+	case transcribeFormatJSON, transcribeFormatSRT, transcribeFormatVTT, transcribeFormatTXT, transcribeFormatVerboseJSON:
+	default:
+		s.writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format %q", format))
+		return
+	}
+	async, _ := strconv.ParseBool(query.Get("async"))
+	langs := proxy.Languages{
+		Source: strings.TrimSpace(query.Get("source")),
+		Target: strings.TrimSpace(query.Get("target")),
+	}
+
+	if !s.proxy.Ready() {
+		s.writeError(w, http.StatusServiceUnavailable, "models are still loading")
+		return
+	}
+
+	pcm, status, err := s.readTranscribeAudio(w, r)
+	if err != nil {
+		s.writeError(w, status, err.Error())
+		return
+	}
+	duration := time.Duration(len(pcm)) * time.Second / time.Duration(audio.Expected.BytesPerSecond())
+
+	if !async && duration <= s.config.TranscribeSyncMax {
+		result, err := s.transcribe(r.Context(), pcm, langs)
+		if err != nil {
+			s.writeError(w, transcribeErrorStatus(err), err.Error())
+			return
+		}
+		s.writeTranscription(w, format, result)
+		return
+	}
+
+	job := s.startTranscribeJob(pcm, duration, langs, format)
+	w.Header().Set("Location", "transcribe/"+job.ID)
+	s.writeJSON(w, http.StatusAccepted, job)
+}
+
+// readTranscribeAudio reads the audio of a POST /transcribe request and
+// decodes it. On failure it returns the HTTP status to answer with.
+func (s *Server) readTranscribeAudio(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.TranscribeMaxBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var req transcribeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, http.StatusBadRequest, errors.New("invalid request body")
+		}
+		path, err := s.localTranscribePath(req.Path)
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+		pcm, err := audio.DecodeFile(path)
+		if err != nil {
+			return nil, http.StatusUnprocessableEntity, err
+		}
+		return pcm, 0, nil
+
+	case "multipart/form-data":
+		// Spool the upload to disk instead of holding it in memory
+		dir, err := os.MkdirTemp(s.proxy.TempDir(), "upload-")
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "upload")
+		if err := saveUpload(r, path); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("upload larger than %d MB", s.config.TranscribeMaxBytes>>20)
+			}
+			return nil, http.StatusBadRequest, err
+		}
+		pcm, err := audio.DecodeFile(path)
+		if err != nil {
+			return nil, http.StatusUnprocessableEntity, err
+		}
+		return pcm, 0, nil
+
+	default:
+		return nil, http.StatusUnsupportedMediaType, errors.New("send the file as multipart/form-data or a JSON body with a path")
+	}
+}
+
+// saveUpload writes the file field of a multipart request to path
+func saveUpload(r *http.Request, path string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return fmt.Errorf("invalid multipart body: %w", err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return errors.New("no file field in the form")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
+		if _, err := io.Copy(file, part); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+}
+
+// localTranscribePath resolves a server-local path, which must be below
+// TRANSCRIBE_LOCAL_DIR
+func (s *Server) localTranscribePath(path string) (string, error) {
+	if s.config.TranscribeLocalDir == "" {
+		return "", errors.New("server-local files are disabled, set TRANSCRIBE_LOCAL_DIR")
+	}
+
+	root, err := filepath.EvalSymlinks(s.config.TranscribeLocalDir)
+	if err != nil {
+		return "", fmt.Errorf("local directory unavailable: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.New("file not found")
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("file is outside TRANSCRIBE_LOCAL_DIR")
+	}
+	return resolved, nil
+}
+
+// transcribe runs the ad-hoc transcription of pcm
+func (s *Server) transcribe(ctx context.Context, pcm []byte, langs proxy.Languages) (transcription, error) {
+	if langs.Source == "" {
+		langs.Source = s.config.DefaultSourceLang
+	}
+
+	segments, originals, err := s.proxy.Transcribe(ctx, pcm, audio.Expected, langs)
+	if err != nil {
+		s.logger.WithError(err).Warn("Ad-hoc transcription failed")
+		return transcription{}, err
+	}
+	duration := time.Duration(len(pcm)) * time.Second / time.Duration(audio.Expected.BytesPerSecond())
+	return transcription{segments: segments, originals: originals, langs: langs, duration: duration}, nil
+}
+
+// startTranscribeJob transcribes pcm in the background
+func (s *Server) startTranscribeJob(pcm []byte, duration time.Duration, langs proxy.Languages, format string) *transcribeJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	job := &transcribeJob{
+		ID:        hex.EncodeToString(id),
+		Status:    jobRunning,
+		Duration:  duration.Seconds(),
+		CreatedAt: time.Now(),
+		format:    format,
+	}
+
+	s.jobsMu.Lock()
+	s.pruneJobs()
+	s.jobs[job.ID] = job
+	snapshot := *job
+	s.jobsMu.Unlock()
+
+	go func() {
+		result, err := s.transcribe(s.jobsCtx, pcm, langs)
+
+		s.jobsMu.Lock()
+		defer s.jobsMu.Unlock()
+		finished := time.Now()
+		job.FinishedAt = &finished
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = jobDone
+		job.result = result
+	}()
+
+	return &snapshot
+}
+
+// pruneJobs forgets jobs that finished more than jobRetention ago; the caller
+// must hold s.jobsMu
+func (s *Server) pruneJobs() {
+	cutoff := time.Now().Add(-jobRetention)
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// handleTranscribeJob reports a background transcription, answering with the
+// result in the requested format once it is done
+func (s *Server) handleTranscribeJob(w http.ResponseWriter, r *http.Request) {
+	s.jobsMu.Lock()
+	s.pruneJobs()
+	job, ok := s.jobs[mux.Vars(r)["id"]]
+	var snapshot transcribeJob
+	if ok {
+		snapshot = *job
+	}
+	s.jobsMu.Unlock()
+
+	switch {
+	case !ok:
+		s.writeError(w, http.StatusNotFound, "job not found")
+	case snapshot.Status == jobRunning:
+		s.writeJSON(w, http.StatusAccepted, snapshot)
+	case snapshot.Status == jobFailed:
+		s.writeJSON(w, http.StatusOK, snapshot)
+	default:
+		s.writeTranscription(w, snapshot.format, snapshot.result)
+	}
+}
+
+// transcribeSegment is a segment in the JSON output of POST /transcribe
+type transcribeSegment struct {
+	Start        float64 `json:"start"`
+	End          float64 `json:"end"`
+	Text         string  `json:"text"`
+	OriginalText string  `json:"original_text,omitempty"`
+}
+
+// writeTranscription writes the result of a transcription in format
+func (s *Server) writeTranscription(w http.ResponseWriter, format string, result transcription) {
+	lang := result.langs.Source
+	if result.originals != nil {
+		lang = result.langs.Target
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case transcribeFormatSRT, transcribeFormatVTT:
+		subtitleFormat, contentType := subtitles.FormatSRT, "application/x-subrip; charset=utf-8"
+		if format == transcribeFormatVTT {
+			subtitleFormat, contentType = subtitles.FormatVTT, "text/vtt; charset=utf-8"
+		}
+		if err := subtitles.GenerateTo(&buf, subtitleFormat, result.segments); err != nil {
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+	case transcribeFormatTXT:
+		for _, segment := range result.segments {
+			fmt.Fprintln(&buf, strings.TrimSpace(segment.Text))
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case transcribeFormatVerboseJSON:
+		s.writeJSON(w, http.StatusOK, transcript.ToVerboseJSON(lang, result.duration.Seconds(), result.segments))
+		return
+	default:
+		segments := make([]transcribeSegment, 0, len(result.segments))
+		for i, segment := range result.segments {
+			out := transcribeSegment{Start: segment.Start, End: segment.End, Text: segment.Text}
+			if result.originals != nil {
+				out.OriginalText = result.originals[i].Text
+			}
+			segments = append(segments, out)
+		}
+		s.writeJSON(w, http.StatusOK, map[string]any{
+			"lang":     lang,
+			"segments": segments,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// transcribeErrorStatus maps an ad-hoc transcription error to an HTTP status
+func transcribeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, transcriber.ErrCorruptAudio):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, transcriber.ErrModelMissing):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleListSessions lists the sessions in the output directory, newest first
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	entries, err := session.List(s.config.OutputDir)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, entries)
+}
+
+// handleSessionTranscript serves the plain-text transcript of a session
+func (s *Server) handleSessionTranscript(w http.ResponseWriter, r *http.Request) {
+	s.serveSessionFile(w, r, ".txt", "text/plain; charset=utf-8")
+}
+
+// subtitleTypes are the content types of the subtitle files by extension
+var subtitleTypes = map[string]string{
+	".srt": "application/x-subrip; charset=utf-8",
+	".vtt": "text/vtt; charset=utf-8",
+}
+
+// handleSessionSubtitles serves the sidecar subtitles of a session in the
+// format given by the format query parameter, or its subtitle track in the
+// language given by the lang query parameter. Without a format the srt file
+// is served, or the vtt one if the session was written in vtt.
+func (s *Server) handleSessionSubtitles(w http.ResponseWriter, r *http.Request) {
+	var exts []string
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+		exts = []string{".srt", ".vtt"}
+	case "srt", "vtt":
+		exts = []string{"." + format}
+	default:
+		s.writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported subtitle format %q", format))
+		return
+	}
+
+	entry, ok := s.findSession(w, r)
+	if !ok {
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	for _, ext := range exts {
+		var path string
+		if lang == "" {
+			path, ok = entry.File(ext)
+		} else {
+			path, ok = entry.Track(lang, ext)
+		}
+		if ok {
+			s.serveFile(w, r, path, subtitleTypes[ext])
+			return
+		}
+	}
+
+	if lang == "" {
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("session has no %s file", strings.Join(exts, " or ")))
+	} else {
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("session has no %s subtitles in %q", strings.Join(exts, " or "), lang))
+	}
+}
+
+// handleSessionSummary serves the summary JSON of a session
+func (s *Server) handleSessionSummary(w http.ResponseWriter, r *http.Request) {
+	entry, ok := s.findSession(w, r)
+	if !ok {
+		return
+	}
+
+	s.serveFile(w, r, filepath.Join(entry.Dir, session.SummaryFile), "application/json")
+}
+
+// handleReprocessSession reruns the pipeline over the recording of a session
+// with the settings in the optional JSON body overridden. The rerun runs in
+// the background; its progress is reported in the session summary.
+func (s *Server) handleReprocessSession(w http.ResponseWriter, r *http.Request) {
+	var options session.ReprocessOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+		s.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	reprocess, err := s.proxy.Reprocess(id, options)
+	switch {
+	case errors.Is(err, session.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, proxy.ErrSessionBusy), errors.Is(err, proxy.ErrNoRecording):
+		s.writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, proxy.ErrInvalidOptions):
+		s.writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, proxy.ErrOutputDisabled):
+		s.writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, translator.ErrPairUnavailable), errors.Is(err, transcriber.ErrModelMissing):
+		s.writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		w.Header().Set("Location", "summary")
+		s.writeJSON(w, http.StatusAccepted, reprocess)
+	}
+}
+
+// serveSessionFile serves the session file with the given extension
+func (s *Server) serveSessionFile(w http.ResponseWriter, r *http.Request, ext, contentType string) {
+	entry, ok := s.findSession(w, r)
+	if !ok {
+		return
+	}
+
+	path, ok := entry.File(ext)
+	if !ok {
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("session has no %s file", ext))
+		return
+	}
+
+	s.serveFile(w, r, path, contentType)
+}
+
+// findSession looks up the session named by the id route variable, writing
+// an error response if there is none
+func (s *Server) findSession(w http.ResponseWriter, r *http.Request) (session.Entry, bool) {
+	entry, err := session.Find(s.config.OutputDir, mux.Vars(r)["id"])
+	if errors.Is(err, session.ErrNotFound) {
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return session.Entry{}, false
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return session.Entry{}, false
+	}
+
+	return entry, true
+}
+
+// serveFile serves a file with http.ServeContent so range requests and
+// conditional requests work for large files
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path, contentType string) {
+	file, err := os.Open(path)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+// handleSearch searches the transcripts of all indexed sessions.
+// ?q=<words> matches segments containing all of them, ?from= and ?to= limit
+// when the segments started, as RFC 3339 times or dates, and ?limit=<n> sets
+// how many are returned.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := searchindex.Query{Text: r.URL.Query().Get("q")}
+	for _, param := range []struct {
+		name string
+		time *time.Time
+	}{
+		{"from", &query.From},
+		{"to", &query.To},
+	} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := parseSearchTime(value)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, param.name+" must be an RFC 3339 time or a date")
+			return
+		}
+		*param.time = t
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.writeError(w, http.StatusBadRequest, "limit must be a non-negative number")
+			return
+		}
+		query.Limit = n
+	}
+
+	segments, err := s.proxy.SearchTranscripts(r.Context(), query)
+	switch {
+	case errors.Is(err, proxy.ErrSearchDisabled):
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, searchindex.ErrEmptyQuery):
+		s.writeError(w, http.StatusBadRequest, "q must contain a word to search for")
+		return
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]any{"segments": segments})
+}
+
+// parseSearchTime parses an RFC 3339 time or a date, which stands for its
+// start in UTC
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// writeError writes a JSON error response
+func (s *Server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.WithError(err).Warn("Failed to write JSON response")
+	}
+}
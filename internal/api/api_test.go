@@ -0,0 +1,372 @@
+package api
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/events"
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// testServer returns a server with just enough set up to run middleware
+func testServer(cfg *config.Config) *Server {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &Server{config: cfg, logger: logger}
+}
+
+func TestTokenMiddleware(t *testing.T) {
+	const token = "s3cret"
+
+	tests := []struct {
+		name          string
+		token         string
+		readOnlyOpen  bool
+		readOnly      bool
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", false, false, "", http.StatusOK},
+		{"missing token", token, false, false, "", http.StatusUnauthorized},
+		{"wrong token", token, false, false, "Bearer nope", http.StatusUnauthorized},
+		{"token prefix", token, false, false, "Bearer s3", http.StatusUnauthorized},
+		{"not a bearer token", token, false, false, "Basic " + token, http.StatusUnauthorized},
+		{"valid token", token, false, false, "Bearer " + token, http.StatusOK},
+		{"read-only without token", token, false, true, "", http.StatusUnauthorized},
+		{"read-only with token", token, false, true, "Bearer " + token, http.StatusOK},
+		{"read-only open", token, true, true, "", http.StatusOK},
+		{"mutating while read-only open", token, true, false, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(&config.Config{APIToken: tt.token, APIReadOnlyOpen: tt.readOnlyOpen})
+			called := false
+			next := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+			handler := s.mutating(next)
+			if tt.readOnly {
+				handler = s.readOnly(next)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/stream/flush", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("handler called = %v with status %d", called, rec.Code)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestCaptionSocketReplay(t *testing.T) {
+	cfg := config.New()
+	cfg.LiveCaptionHistory = 2
+	p := proxy.New(cfg)
+	s := testServer(cfg)
+	s.proxy = p
+	server := httptest.NewServer(http.HandlerFunc(s.handleCaptionSocket))
+	defer server.Close()
+
+	bus := p.Events()
+	for chunk := 1; chunk <= 3; chunk++ {
+		bus.Publish(events.Event{Kind: events.KindCaption, Session: "s", Caption: &events.Caption{Chunk: chunk}})
+	}
+
+	tests := []struct {
+		query string
+		want  []socketCaption
+	}{
+		{"?replay=true", []socketCaption{
+			{Caption: &events.Caption{Chunk: 2}, Session: "s", Replay: true},
+			{Caption: &events.Caption{Chunk: 3}, Session: "s", Replay: true},
+			{Caption: &events.Caption{Chunk: 4}, Session: "s"},
+		}},
+		{"", []socketCaption{
+			{Caption: &events.Caption{Chunk: 4}, Session: "s"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + tt.query
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			read := func(i int, want socketCaption) {
+				var got socketCaption
+				if err := conn.ReadJSON(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Chunk != want.Chunk || got.Session != want.Session || got.Replay != want.Replay {
+					t.Errorf("message %d = chunk %d, session %q, replay %v, want chunk %d, session %q, replay %v",
+						i, got.Chunk, got.Session, got.Replay, want.Chunk, want.Session, want.Replay)
+				}
+			}
+			replayed, live := tt.want[:len(tt.want)-1], tt.want[len(tt.want)-1]
+			for i, want := range replayed {
+				read(i, want)
+			}
+
+			// Without a replay there is no telling when the handler has
+			// subscribed, so publish until the live caption arrives
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					bus.Publish(events.Event{Kind: events.KindCaption, Session: "s", Caption: &events.Caption{Chunk: live.Chunk}})
+					select {
+					case <-done:
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+			}()
+			read(len(replayed), live)
+		})
+	}
+}
+
+func TestCaptionSocketRejectsInvalidReplay(t *testing.T) {
+	s := testServer(&config.Config{})
+	rec := httptest.NewRecorder()
+	s.handleCaptionSocket(rec, httptest.NewRequest(http.MethodGet, "/captions/ws?replay=maybe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCaptionSocketToken(t *testing.T) {
+	const token = "s3cret"
+	cfg := config.New()
+	cfg.APIToken = token
+	s := testServer(cfg)
+	s.proxy = proxy.New(cfg)
+	server := httptest.NewServer(s.readOnly(s.handleCaptionSocket))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name      string
+		protocols []string // Offered like the web UI does
+		ok        bool
+	}{
+		{"token as subprotocol", []string{captionSocketProtocol, socketTokenProtocol + base64.RawURLEncoding.EncodeToString([]byte(token))}, true},
+		{"wrong token", []string{captionSocketProtocol, socketTokenProtocol + base64.RawURLEncoding.EncodeToString([]byte("nope"))}, false},
+		{"token not encoded", []string{captionSocketProtocol, socketTokenProtocol + token + "!"}, false},
+		{"no token", []string{captionSocketProtocol}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.protocols}
+			conn, resp, err := dialer.Dial(url, nil)
+			if !tt.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected without a valid token")
+				}
+				if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("response = %v, want %d", resp, http.StatusUnauthorized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// Never the token, which browsers would otherwise see echoed
+			if got := conn.Subprotocol(); got != captionSocketProtocol {
+				t.Errorf("subprotocol = %q, want %q", got, captionSocketProtocol)
+			}
+		})
+	}
+}
+
+func TestFlushStreamWithoutStream(t *testing.T) {
+	cfg := config.New()
+	s := testServer(cfg)
+	s.proxy = proxy.New(cfg)
+
+	rec := httptest.NewRecorder()
+	s.handleFlushStream(rec, httptest.NewRequest(http.MethodPost, "/stream/flush", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestStopStream(t *testing.T) {
+	cfg := config.New()
+	s := testServer(cfg)
+	s.proxy = proxy.New(cfg)
+
+	// Stopping a proxy that isn't running does nothing, however often
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.handleStopStream(rec, httptest.NewRequest(http.MethodPost, "/stream/stop", nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"stopped":true`) {
+			t.Errorf("stop %d: status = %d: %s, want it stopped", i, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestAddTarget(t *testing.T) {
+	t.Setenv("ADDED_KEY", "added-key")
+	cfg := config.New()
+	s := testServer(cfg)
+	s.proxy = proxy.New(cfg)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid body", `{"url":`, http.StatusBadRequest},
+		{"no URL", `{}`, http.StatusBadRequest},
+		{"invalid URL", `{"url":"rtmp://host/live"}`, http.StatusBadRequest},
+		{"missing secret", `{"url":"rtmp://host/live/${MISSING_KEY}"}`, http.StatusBadRequest},
+		{"nested secret", `{"url":"rtmp://host/live/${A${ADDED_KEY}}"}`, http.StatusBadRequest},
+		// Valid, but there is no stream to add it to
+		{"no stream", `{"url":"rtmp://host/live/${ADDED_KEY}"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleAddTarget(rec, httptest.NewRequest(http.MethodPost, "/targets", strings.NewReader(tt.body)))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "added-key") {
+				t.Errorf("response shows the secret: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestLiveCaptions(t *testing.T) {
+	cfg := config.New()
+	cfg.VTTCueSettings = "line:85% align:center"
+	cfg.VTTMPEGTS = 900000
+	s := testServer(cfg)
+	s.proxy = proxy.New(cfg)
+
+	rec := httptest.NewRecorder()
+	s.handleLiveCaptions(rec, httptest.NewRequest(http.MethodGet, "/captions/live.vtt", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/vtt; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want WebVTT", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+	// Without a stream the document is valid but has no cues
+	if want := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body, want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleLiveCaptions(rec, httptest.NewRequest(http.MethodGet, "/captions/live.vtt?since=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status with a negative cue id = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSessionSubtitles(t *testing.T) {
+	cfg := config.New()
+	cfg.OutputDir = t.TempDir()
+	s := testServer(cfg)
+
+	// One session written in srt and vtt, with a German track in vtt, and
+	// one written in vtt only
+	newSession := func(key string, files map[string]string, tracks map[string]string) string {
+		t.Helper()
+		sess, err := session.New(cfg.OutputDir, key, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(sess.Dir(), name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := tracks[name]; !ok {
+				sess.AddFile(name)
+			}
+		}
+		sess.Update(func(summary *session.Summary) {
+			summary.SubtitleTracks = make(map[string]string)
+			for name, lang := range tracks {
+				summary.SubtitleTracks[lang] = name
+			}
+		})
+		if err := sess.WriteSummary(); err != nil {
+			t.Fatal(err)
+		}
+		return sess.ID()
+	}
+	both := newSession("both", map[string]string{"stream.srt": "srt", "stream.vtt": "vtt", "stream.de.vtt": "de vtt"}, map[string]string{"stream.de.vtt": "de"})
+	vtt := newSession("vtt", map[string]string{"stream.vtt": "vtt"}, nil)
+
+	tests := []struct {
+		name        string
+		id          string
+		query       string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"srt by default", both, "", http.StatusOK, "application/x-subrip; charset=utf-8", "srt"},
+		{"vtt without srt", vtt, "", http.StatusOK, "text/vtt; charset=utf-8", "vtt"},
+		{"vtt asked for", both, "?format=vtt", http.StatusOK, "text/vtt; charset=utf-8", "vtt"},
+		{"srt missing", vtt, "?format=srt", http.StatusNotFound, "", ""},
+		{"track", both, "?lang=DE", http.StatusOK, "text/vtt; charset=utf-8", "de vtt"},
+		{"track in another format", both, "?lang=de&format=srt", http.StatusNotFound, "", ""},
+		{"unsupported format", both, "?format=ass", http.StatusBadRequest, "", ""},
+		{"unknown session", "nope", "", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/sessions/"+tt.id+"/subtitles"+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.id})
+			rec := httptest.NewRecorder()
+			s.handleSessionSubtitles(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("served %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+// Package audio defines the PCM audio format exchanged between the FFmpeg
+// listener and the transcriber, parses the WAV stream the listener emits, and
+// encodes chunks for upload to remote transcription backends.
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/procs"
+)
+
+// ErrUnsupportedFormat is returned for WAV streams that aren't 16-bit PCM
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// ErrTruncated is returned for audio that was cut off, mid-sample or before
+// the length its header declares
+var ErrTruncated = errors.New("truncated audio")
+
+// wavFormatPCM is the WAVE format tag of integer PCM
+const wavFormatPCM = 1
+
+// wavFormatExtensible is the WAVE format tag of WAVE_FORMAT_EXTENSIBLE, which
+// FFmpeg uses for more than two channels
+const wavFormatExtensible = 0xFFFE
+
+// maxFmtSize is the largest fmt chunk read, well above the 40 bytes of
+// WAVE_FORMAT_EXTENSIBLE, so a corrupt size can't allocate gigabytes
+const maxFmtSize = 64
+
+// Format describes interleaved little-endian PCM audio
+type Format struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// Expected is the format requested from the listener and assumed by the
+// transcriber: 16kHz mono 16-bit PCM
+var Expected = Format{SampleRate: 16000, Channels: 1, BitsPerSample: 16}
+
+// FrameSize returns the size in bytes of one sample for all channels
+func (f Format) FrameSize() int {
+	return f.Channels * f.BitsPerSample / 8
+}
+
+// BytesPerSecond returns the size in bytes of one second of audio
+func (f Format) BytesPerSecond() int {
+	return f.SampleRate * f.FrameSize()
+}
+
+// FFmpegArgs returns the FFmpeg input options describing raw audio in format f
+func (f Format) FFmpegArgs() []string {
+	return []string{
+		"-f", fmt.Sprintf("s%dle", f.BitsPerSample),
+		"-ar", fmt.Sprint(f.SampleRate),
+		"-ac", fmt.Sprint(f.Channels),
+	}
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%dHz %dch %d-bit", f.SampleRate, f.Channels, f.BitsPerSample)
+}
+
+// Level returns the RMS level of 16-bit PCM samples in dBFS, -Inf for
+// digital silence
+func Level(pcm []byte) float64 {
+	samples := len(pcm) / 2
+	if samples == 0 {
+		return math.Inf(-1)
+	}
+
+	var sum float64
+	for i := 0; i < samples; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+		sum += sample * sample
+	}
+	return 20 * math.Log10(math.Sqrt(sum/float64(samples))/math.MaxInt16)
+}
+
+// MinDBFS is the quietest level 16-bit PCM can represent; levels in Loudness
+// don't go below it, so digital silence has one
+const MinDBFS = -96
+
+// Loudness describes the level of 16-bit PCM audio
+type Loudness struct {
+	PeakDBFS       float64 `json:"peak_dbfs"`
+	RMSDBFS        float64 `json:"rms_dbfs"`
+	ClippedPercent float64 `json:"clipped_percent"` // Share of samples at full scale
+}
+
+// MeasureLoudness returns the peak and RMS level of 16-bit PCM samples and
+// how many of them are clipped
+func MeasureLoudness(pcm []byte) Loudness {
+	samples := len(pcm) / 2
+	if samples == 0 {
+		return Loudness{PeakDBFS: MinDBFS, RMSDBFS: MinDBFS}
+	}
+
+	var sum, peak float64
+	clipped := 0
+	for i := 0; i < samples; i++ {
+		sample := math.Abs(float64(int16(binary.LittleEndian.Uint16(pcm[2*i:]))))
+		sum += sample * sample
+		peak = max(peak, sample)
+		if sample >= math.MaxInt16 {
+			clipped++
+		}
+	}
+	return Loudness{
+		PeakDBFS:       dbfs(peak),
+		RMSDBFS:        dbfs(math.Sqrt(sum / float64(samples))),
+		ClippedPercent: 100 * float64(clipped) / float64(samples),
+	}
+}
+
+// dbfs converts a sample magnitude to dBFS, between MinDBFS and 0
+func dbfs(magnitude float64) float64 {
+	if magnitude == 0 {
+		return MinDBFS
+	}
+	return min(max(20*math.Log10(magnitude/math.MaxInt16), MinDBFS), 0)
+}
+
+// silenceWindow is the stretch of audio SilenceRatio measures the level of
+const silenceWindow = 100 * time.Millisecond
+
+// SilenceRatio returns the share of 16-bit PCM audio in format whose level is
+// below thresholdDB dBFS, measured in windows of 100ms
+func SilenceRatio(pcm []byte, format Format, thresholdDB float64) float64 {
+	window := int(silenceWindow.Seconds()*float64(format.BytesPerSecond())) / format.FrameSize() * format.FrameSize()
+	if window == 0 || len(pcm) == 0 {
+		return 0
+	}
+
+	var windows, silent int
+	for start := 0; start < len(pcm); start += window {
+		end := min(start+window, len(pcm))
+		windows++
+		if Level(pcm[start:end]) < thresholdDB {
+			silent++
+		}
+	}
+	return float64(silent) / float64(windows)
+}
+
+// Decode converts audio in any format FFmpeg can read into PCM in the
+// Expected format
+func Decode(data []byte) ([]byte, error) {
+	return decode("pipe:0", bytes.NewReader(data))
+}
+
+// DecodeFile is like Decode for the audio of a file, which may also be a
+// video
+func DecodeFile(path string) ([]byte, error) {
+	return decode(path, nil)
+}
+
+// decode runs FFmpeg on input, reading stdin if it is a pipe
+func decode(input string, stdin io.Reader) ([]byte, error) {
+	args := []string{"-loglevel", "error", "-i", input, "-vn"}
+	args = append(args, Expected.FFmpegArgs()...)
+	args = append(args, "pipe:1")
+
+	cmd := procs.FFmpeg(args...)
+	cmd.Stdin = stdin
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := procs.Run(cmd, procs.RoleDecoder); err != nil {
+		return nil, fmt.Errorf("%w: ffmpeg failed: %v, stderr: %s", ErrUnsupportedFormat, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Decoder streams the audio of a file as PCM in the Expected format, so long
+// recordings needn't be held in memory
+type Decoder struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+// NewDecoder starts decoding the audio of the file at path, which may also be
+// a video. track selects the audio track of files with several, counting
+// from 0, or FFmpeg's choice if negative. FFmpeg is killed when ctx is done.
+func NewDecoder(ctx context.Context, path string, track int) (*Decoder, error) {
+	args := []string{"-loglevel", "error", "-i", path, "-vn"}
+	if track >= 0 {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", track))
+	}
+	args = append(args, Expected.FFmpegArgs()...)
+	args = append(args, "pipe:1")
+
+	d := &Decoder{cmd: procs.FFmpegContext(ctx, args...)}
+	d.cmd.Stderr = &d.stderr
+
+	stdout, err := d.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := procs.Launch(d.cmd, procs.RoleDecoder); err != nil {
+		return nil, fmt.Errorf("failed to start FFmpeg: %w", err)
+	}
+	d.stdout = stdout
+
+	return d, nil
+}
+
+// Read reads decoded PCM
+func (d *Decoder) Read(p []byte) (int, error) {
+	return d.stdout.Read(p)
+}
+
+// Close stops FFmpeg. After all audio has been read, it reports whether
+// decoding failed.
+func (d *Decoder) Close() error {
+	d.stdout.Close()
+	if err := procs.Wait(d.cmd); err != nil {
+		return fmt.Errorf("%w: ffmpeg failed: %v, stderr: %s", ErrUnsupportedFormat, err, strings.TrimSpace(d.stderr.String()))
+	}
+	return nil
+}
+
+// NewPCMReader returns a reader yielding only the PCM samples of r, and their
+// format. If r starts with a WAV header it is parsed and stripped; otherwise r
+// is assumed to be raw PCM in the Expected format.
+func NewPCMReader(r io.Reader) (io.Reader, Format, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(4)
+	if err != nil && len(magic) == 0 {
+		return nil, Format{}, fmt.Errorf("failed to read audio stream: %w", err)
+	}
+	if !bytes.Equal(magic, []byte("RIFF")) {
+		return br, Expected, nil
+	}
+
+	format, err := readWAVHeader(br)
+	if err != nil {
+		return nil, Format{}, err
+	}
+	return br, format, nil
+}
+
+// readWAVHeader reads a WAV header up to the start of the data chunk. The
+// sizes in the header are ignored, since a streamed WAV doesn't know them.
+func readWAVHeader(r io.Reader) (Format, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return Format{}, fmt.Errorf("failed to read WAV header: %w", err)
+	}
+	if string(riff[8:12]) != "WAVE" {
+		return Format{}, fmt.Errorf("%w: RIFF stream is not WAVE", ErrUnsupportedFormat)
+	}
+
+	var format Format
+	haveFormat := false
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return Format{}, fmt.Errorf("failed to read WAV chunk header: %w", err)
+		}
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		if id == "data" {
+			if !haveFormat {
+				return Format{}, fmt.Errorf("%w: WAV data before fmt chunk", ErrUnsupportedFormat)
+			}
+			return format, nil
+		}
+
+		if id != "fmt " {
+			// Skip LIST and other metadata chunks, which are padded to an
+			// even size
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return Format{}, fmt.Errorf("failed to skip WAV %q chunk: %w", id, err)
+			}
+			continue
+		}
+
+		if size < 16 {
+			return Format{}, fmt.Errorf("%w: WAV fmt chunk too short", ErrUnsupportedFormat)
+		}
+		if size > maxFmtSize {
+			return Format{}, fmt.Errorf("%w: WAV fmt chunk of %d bytes", ErrUnsupportedFormat, size)
+		}
+		body := make([]byte, size+size%2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return Format{}, fmt.Errorf("failed to read WAV fmt chunk: %w", err)
+		}
+
+		tag := binary.LittleEndian.Uint16(body[0:2])
+		format = Format{
+			Channels:      int(binary.LittleEndian.Uint16(body[2:4])),
+			SampleRate:    int(binary.LittleEndian.Uint32(body[4:8])),
+			BitsPerSample: int(binary.LittleEndian.Uint16(body[14:16])),
+		}
+		if (tag != wavFormatPCM && tag != wavFormatExtensible) || format.BitsPerSample != 16 || format.Channels < 1 || format.SampleRate < 1 {
+			return Format{}, fmt.Errorf("%w: WAV format tag %#x, %s", ErrUnsupportedFormat, tag, format)
+		}
+		haveFormat = true
+	}
+}
+
+// wavHeaderSize is the size of the header EncodeWAV writes
+const wavHeaderSize = 44
+
+// EncodeWAV returns pcm, interleaved little-endian samples, as a WAV file
+func EncodeWAV(pcm []byte, sampleRate, channels, bitsPerSample int) []byte {
+	format := Format{SampleRate: sampleRate, Channels: channels, BitsPerSample: bitsPerSample}
+	// The data chunk is padded to an even size, the pad byte not counted
+	pad := len(pcm) % 2
+
+	wav := make([]byte, wavHeaderSize, wavHeaderSize+len(pcm)+pad)
+	copy(wav[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(wav[4:8], uint32(wavHeaderSize-8+len(pcm)+pad))
+	copy(wav[8:12], "WAVE")
+	copy(wav[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(wav[16:20], 16)
+	binary.LittleEndian.PutUint16(wav[20:22], wavFormatPCM)
+	binary.LittleEndian.PutUint16(wav[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(wav[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(wav[28:32], uint32(format.BytesPerSecond()))
+	binary.LittleEndian.PutUint16(wav[32:34], uint16(format.FrameSize()))
+	binary.LittleEndian.PutUint16(wav[34:36], uint16(bitsPerSample))
+	copy(wav[36:40], "data")
+	binary.LittleEndian.PutUint32(wav[40:44], uint32(len(pcm)))
+
+	wav = append(wav, pcm...)
+	if pad == 1 {
+		wav = append(wav, 0)
+	}
+	return wav
+}
+
+// CheckWAV checks that a complete WAV file holds as much audio as its header
+// declares, and returns its format and duration
+func CheckWAV(wav []byte) (Format, time.Duration, error) {
+	if len(wav) < 12 || string(wav[0:4]) != "RIFF" {
+		return Format{}, 0, fmt.Errorf("%w: not a WAV file", ErrUnsupportedFormat)
+	}
+	if riffSize := int64(binary.LittleEndian.Uint32(wav[4:8])); riffSize+8 > int64(len(wav)) {
+		return Format{}, 0, fmt.Errorf("%w: WAV declares %d bytes, got %d", ErrTruncated, riffSize+8, len(wav))
+	}
+
+	r := bytes.NewReader(wav)
+	format, err := readWAVHeader(r)
+	if err != nil {
+		return Format{}, 0, err
+	}
+	// readWAVHeader stops right after the header of the data chunk
+	dataStart := len(wav) - r.Len()
+	dataSize := int(binary.LittleEndian.Uint32(wav[dataStart-4 : dataStart]))
+	if dataSize > r.Len() {
+		return Format{}, 0, fmt.Errorf("%w: WAV data chunk declares %d bytes, got %d", ErrTruncated, dataSize, r.Len())
+	}
+	if err := CheckChunk(wav[dataStart:dataStart+dataSize], format, 0); err != nil {
+		return Format{}, 0, err
+	}
+	return format, Duration(dataSize, format), nil
+}
+
+// Duration returns how long size bytes of audio in format play
+func Duration(size int, format Format) time.Duration {
+	if format.BytesPerSecond() == 0 {
+		return 0
+	}
+	return time.Duration(size) * time.Second / time.Duration(format.BytesPerSecond())
+}
+
+// CheckChunk rejects a chunk of PCM that is obviously truncated before it is
+// uploaded: one that ends mid-sample or is shorter than minDuration
+func CheckChunk(pcm []byte, format Format, minDuration time.Duration) error {
+	if format.FrameSize() == 0 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+	}
+	if len(pcm)%format.FrameSize() != 0 {
+		return fmt.Errorf("%w: %d bytes is not a whole number of %d-byte samples", ErrTruncated, len(pcm), format.FrameSize())
+	}
+	if duration := Duration(len(pcm), format); duration < minDuration {
+		return fmt.Errorf("%w: %s of audio, expected at least %s", ErrTruncated, duration, minDuration)
+	}
+	return nil
+}
+
+// Encoding is how a chunk is encoded for a transcription backend
+type Encoding string
+
+// Encodings of chunks. WAV needs no encoder; FLAC halves the upload
+// losslessly and Ogg Opus shrinks it further, both through FFmpeg.
+const (
+	EncodingWAV  Encoding = "wav"
+	EncodingFLAC Encoding = "flac"
+	EncodingOgg  Encoding = "ogg"
+)
+
+// encodings are the known encodings by content type, WAV first as the one
+// every backend takes
+var encodings = []struct {
+	encoding    Encoding
+	contentType string
+	aliases     []string
+}{
+	{EncodingWAV, "audio/wav", []string{"audio/wave", "audio/x-wav", "audio/vnd.wave"}},
+	{EncodingFLAC, "audio/flac", []string{"audio/x-flac"}},
+	{EncodingOgg, "audio/ogg", []string{"audio/opus"}},
+}
+
+// ContentType returns the MIME type of the encoding
+func (e Encoding) ContentType() string {
+	for _, known := range encodings {
+		if known.encoding == e {
+			return known.contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// NegotiateEncoding picks the encoding for a backend accepting the content
+// types in accepted, e.g. from its configuration; parameters are ignored and
+// audio/* accepts any. compress prefers the smallest lossless encoding the
+// backend takes over WAV, for backends behind a slow link. A backend that
+// declares no content types gets WAV.
+func NegotiateEncoding(accepted []string, compress bool) (Encoding, error) {
+	if len(accepted) == 0 {
+		return EncodingWAV, nil
+	}
+	accepts := func(encoding Encoding) bool {
+		for _, contentType := range accepted {
+			contentType, _, _ = strings.Cut(contentType, ";")
+			contentType = strings.ToLower(strings.TrimSpace(contentType))
+			if contentType == "audio/*" || contentType == "*/*" {
+				return true
+			}
+			for _, known := range encodings {
+				if known.encoding == encoding && (contentType == known.contentType || slices.Contains(known.aliases, contentType)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	preference := []Encoding{EncodingWAV, EncodingFLAC, EncodingOgg}
+	if compress {
+		preference = []Encoding{EncodingFLAC, EncodingWAV, EncodingOgg}
+	}
+	for _, encoding := range preference {
+		if accepts(encoding) {
+			return encoding, nil
+		}
+	}
+	return "", fmt.Errorf("%w: backend accepts none of WAV, FLAC, or Ogg (%s)", ErrUnsupportedFormat, strings.Join(accepted, ", "))
+}
+
+// Encode encodes pcm in format for upload. Chunks that are obviously
+// truncated are rejected first. FFmpeg is killed when ctx is done.
+func Encode(ctx context.Context, pcm []byte, format Format, encoding Encoding) ([]byte, error) {
+	if err := CheckChunk(pcm, format, 0); err != nil {
+		return nil, err
+	}
+
+	var codecArgs []string
+	switch encoding {
+	case EncodingWAV:
+		return EncodeWAV(pcm, format.SampleRate, format.Channels, format.BitsPerSample), nil
+	case EncodingFLAC:
+		codecArgs = []string{"-c:a", "flac", "-f", "flac"}
+	case EncodingOgg:
+		codecArgs = []string{"-c:a", "libopus", "-f", "ogg"}
+	default:
+		return nil, fmt.Errorf("%w: encoding %q", ErrUnsupportedFormat, encoding)
+	}
+
+	args := []string{"-loglevel", "error"}
+	args = append(args, format.FFmpegArgs()...)
+	args = append(args, "-i", "pipe:0")
+	args = append(args, codecArgs...)
+	args = append(args, "pipe:1")
+
+	cmd := procs.FFmpegContext(ctx, args...)
+	cmd.Stdin = bytes.NewReader(pcm)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := procs.Run(cmd, procs.RoleDecoder); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: ffmpeg failed: %w, stderr: %s", encoding, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
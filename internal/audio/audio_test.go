@@ -0,0 +1,442 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// streamedWAV returns a WAV header the way FFmpeg writes it to a pipe: with
+// unknown sizes, a LIST chunk before the format, and the data chunk last
+func streamedWAV(format Format, tag uint16) []byte {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+
+	b.WriteString("RIFF")
+	le(uint32(0xFFFFFFFF))
+	b.WriteString("WAVE")
+
+	// An odd-sized metadata chunk, padded to an even size
+	info := []byte("INFOISFT\x0d\x00\x00\x00Lavf60.16.100")
+	b.WriteString("LIST")
+	le(uint32(len(info)))
+	b.Write(info)
+	if len(info)%2 == 1 {
+		b.WriteByte(0)
+	}
+
+	b.WriteString("fmt ")
+	le(uint32(16))
+	le(tag)
+	le(uint16(format.Channels))
+	le(uint32(format.SampleRate))
+	le(uint32(format.BytesPerSecond()))
+	le(uint16(format.FrameSize()))
+	le(uint16(format.BitsPerSample))
+
+	b.WriteString("data")
+	le(uint32(0xFFFFFFFF))
+	return b.Bytes()
+}
+
+// samples returns n frames of distinct 16-bit samples in format
+func samples(n int, format Format) []byte {
+	pcm := make([]byte, n*format.FrameSize())
+	for i := 0; i < len(pcm)/2; i++ {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(i))
+	}
+	return pcm
+}
+
+func TestNewPCMReader(t *testing.T) {
+	stereo48k := Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16}
+
+	tests := []struct {
+		name   string
+		header []byte
+		format Format
+	}{
+		{"raw PCM", nil, Expected},
+		{"WAV in the expected format", streamedWAV(Expected, wavFormatPCM), Expected},
+		{"WAV in another format", streamedWAV(stereo48k, wavFormatPCM), stereo48k},
+		{"extensible WAV", streamedWAV(stereo48k, wavFormatExtensible), stereo48k},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm := samples(4800, tt.format)
+			r, format, err := NewPCMReader(bytes.NewReader(append(tt.header, pcm...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Errorf("format = %s, want %s", format, tt.format)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Nothing of the header may end up among the samples, or every
+			// chunk would be off by its size
+			if !bytes.Equal(got, pcm) {
+				t.Errorf("got %d bytes of PCM, want the %d bytes of samples", len(got), len(pcm))
+			}
+		})
+	}
+}
+
+func TestNewPCMReaderRejects(t *testing.T) {
+	float32WAV := streamedWAV(Format{SampleRate: 16000, Channels: 1, BitsPerSample: 32}, 3)
+	noFormat := append([]byte("RIFF\xff\xff\xff\xffWAVE"), []byte("data\xff\xff\xff\xff")...)
+	// A corrupt fmt size must not be allocated
+	hugeFormat := append([]byte("RIFF\xff\xff\xff\xffWAVE"), []byte("fmt \xf0\xff\xff\xff")...)
+	longFormat := append([]byte("RIFF\xff\xff\xff\xffWAVE"), []byte("fmt \x42\x00\x00\x00")...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"float samples", float32WAV, ErrUnsupportedFormat},
+		{"data before fmt", noFormat, ErrUnsupportedFormat},
+		{"huge fmt chunk", hugeFormat, ErrUnsupportedFormat},
+		{"fmt chunk over 64 bytes", longFormat, ErrUnsupportedFormat},
+		{"RIFF but not WAVE", []byte("RIFF\x00\x00\x00\x00AVI LIST"), ErrUnsupportedFormat},
+		{"header cut off", streamedWAV(Expected, wavFormatPCM)[:60], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := NewPCMReader(bytes.NewReader(tt.data)); !errors.Is(err, tt.want) {
+				t.Errorf("NewPCMReader() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeWAV(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		frames int
+	}{
+		{"expected format", Expected, 16000},
+		{"stereo 48kHz", Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16}, 4800},
+		{"six channels", Format{SampleRate: 44100, Channels: 6, BitsPerSample: 16}, 441},
+		{"no samples", Expected, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm := samples(tt.frames, tt.format)
+			wav := EncodeWAV(pcm, tt.format.SampleRate, tt.format.Channels, tt.format.BitsPerSample)
+
+			// The sizes and derived fields of the header are those of pcm
+			le := binary.LittleEndian
+			fields := []struct {
+				name      string
+				got, want uint32
+			}{
+				{"RIFF size", le.Uint32(wav[4:8]), uint32(len(wav) - 8)},
+				{"fmt size", le.Uint32(wav[16:20]), 16},
+				{"format tag", uint32(le.Uint16(wav[20:22])), wavFormatPCM},
+				{"byte rate", le.Uint32(wav[28:32]), uint32(tt.format.BytesPerSecond())},
+				{"block align", uint32(le.Uint16(wav[32:34])), uint32(tt.format.FrameSize())},
+				{"data size", le.Uint32(wav[40:44]), uint32(len(pcm))},
+			}
+			for _, field := range fields {
+				if field.got != field.want {
+					t.Errorf("%s = %d, want %d", field.name, field.got, field.want)
+				}
+			}
+
+			// Decoding it gives back the format and the samples
+			r, format, err := NewPCMReader(bytes.NewReader(wav))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Errorf("format = %s, want %s", format, tt.format)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pcm) {
+				t.Errorf("decoded %d bytes of PCM, want the %d bytes encoded", len(got), len(pcm))
+			}
+			if duration := Duration(len(got), format); duration != time.Duration(tt.frames)*time.Second/time.Duration(tt.format.SampleRate) {
+				t.Errorf("duration = %s for %d frames at %dHz", duration, tt.frames, tt.format.SampleRate)
+			}
+		})
+	}
+}
+
+func TestEncodeWAVPadsOddData(t *testing.T) {
+	wav := EncodeWAV([]byte{1, 2, 3}, 8000, 1, 8)
+	if len(wav) != wavHeaderSize+4 || wav[len(wav)-1] != 0 {
+		t.Errorf("got %d bytes ending in %d, want the data padded with a zero to an even size", len(wav), wav[len(wav)-1])
+	}
+	// The pad byte counts for the RIFF chunk but not for the data
+	if riff, data := binary.LittleEndian.Uint32(wav[4:8]), binary.LittleEndian.Uint32(wav[40:44]); riff != wavHeaderSize-8+4 || data != 3 {
+		t.Errorf("RIFF size %d, data size %d, want %d and 3", riff, data, wavHeaderSize-8+4)
+	}
+}
+
+func TestCheckChunk(t *testing.T) {
+	stereo := Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16}
+	tests := []struct {
+		name        string
+		pcm         []byte
+		format      Format
+		minDuration time.Duration
+		err         error
+	}{
+		{"whole chunk", samples(16000, Expected), Expected, time.Second, nil},
+		{"no minimum", samples(1, Expected), Expected, 0, nil},
+		{"cut mid-sample", samples(16000, Expected)[:31999], Expected, 0, ErrTruncated},
+		{"cut mid-frame", samples(480, stereo)[:1918], stereo, 0, ErrTruncated},
+		{"too short", samples(800, Expected), Expected, 100 * time.Millisecond, ErrTruncated},
+		{"no format", samples(10, Expected), Format{}, 0, ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckChunk(tt.pcm, tt.format, tt.minDuration); !errors.Is(err, tt.err) {
+				t.Errorf("CheckChunk() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckWAV(t *testing.T) {
+	pcm := samples(1600, Expected)
+	wav := EncodeWAV(pcm, Expected.SampleRate, Expected.Channels, Expected.BitsPerSample)
+	tests := []struct {
+		name string
+		wav  []byte
+		err  error
+	}{
+		{"complete", wav, nil},
+		{"cut off", wav[:len(wav)-100], ErrTruncated},
+		{"header only", wav[:wavHeaderSize], ErrTruncated},
+		{"not a WAV file", []byte("fLaC\x00\x00\x00\x22"), ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, duration, err := CheckWAV(tt.wav)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("CheckWAV() = %v, want %v", err, tt.err)
+			}
+			if err == nil && (format != Expected || duration != 100*time.Millisecond) {
+				t.Errorf("CheckWAV() = %s, %s, want %s and 100ms", format, duration, Expected)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []string
+		compress bool
+		want     Encoding
+		wantErr  bool
+	}{
+		{"nothing declared", nil, false, EncodingWAV, false},
+		{"nothing declared, compressed", nil, true, EncodingWAV, false},
+		{"WAV preferred", []string{"audio/flac", "audio/wav"}, false, EncodingWAV, false},
+		{"FLAC preferred when compressing", []string{"audio/wav", "audio/flac"}, true, EncodingFLAC, false},
+		{"compressing without FLAC", []string{"audio/wav"}, true, EncodingWAV, false},
+		{"aliases and parameters", []string{" Audio/X-FLAC; level=5"}, false, EncodingFLAC, false},
+		{"only Ogg", []string{"audio/opus"}, false, EncodingOgg, false},
+		{"any audio", []string{"audio/*"}, true, EncodingFLAC, false},
+		{"nothing known", []string{"audio/mpeg", "text/plain"}, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateEncoding(tt.accepted, tt.compress)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("NegotiateEncoding() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodingContentType(t *testing.T) {
+	for encoding, want := range map[Encoding]string{
+		EncodingWAV:  "audio/wav",
+		EncodingFLAC: "audio/flac",
+		EncodingOgg:  "audio/ogg",
+		"mp3":        "application/octet-stream",
+	} {
+		if got := encoding.ContentType(); got != want {
+			t.Errorf("%s.ContentType() = %q, want %q", encoding, got, want)
+		}
+	}
+}
+
+// skipUnlessFFmpeg skips the test unless TEST_FFMPEG=1 is set and ffmpeg is
+// installed, like testutil.SkipUnlessFFmpeg, which imports this package
+func skipUnlessFFmpeg(t *testing.T) {
+	t.Helper()
+	if os.Getenv("TEST_FFMPEG") != "1" {
+		t.Skip("set TEST_FFMPEG=1 to run tests using FFmpeg")
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	pcm := sine(0.5)
+	tests := []struct {
+		encoding Encoding
+		ffmpeg   bool
+		lossless bool
+	}{
+		{EncodingWAV, false, true},
+		{EncodingFLAC, true, true},
+		{EncodingOgg, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.encoding), func(t *testing.T) {
+			if tt.ffmpeg {
+				skipUnlessFFmpeg(t)
+			}
+			data, err := Encode(context.Background(), pcm, Expected, tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.encoding == EncodingFLAC && !bytes.HasPrefix(data, []byte("fLaC")) {
+				t.Errorf("FLAC output starts with %q", data[:min(len(data), 4)])
+			}
+			if tt.encoding == EncodingOgg && !bytes.HasPrefix(data, []byte("OggS")) {
+				t.Errorf("Ogg output starts with %q", data[:min(len(data), 4)])
+			}
+
+			var decoded []byte
+			if tt.encoding == EncodingWAV {
+				format, duration, err := CheckWAV(data)
+				if err != nil || format != Expected || duration != time.Second {
+					t.Fatalf("CheckWAV() = %s, %s, %v, want a second in %s", format, duration, err, Expected)
+				}
+				r, _, err := NewPCMReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err = io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if decoded, err = Decode(data); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.lossless && !bytes.Equal(decoded, pcm) {
+				t.Errorf("decoded %d bytes differing from the %d encoded", len(decoded), len(pcm))
+			}
+			// The lossy codec may pad its frames, but keeps the length
+			if duration := Duration(len(decoded), Expected); duration < 900*time.Millisecond || duration > 1100*time.Millisecond {
+				t.Errorf("decoded %s of audio, want about a second", duration)
+			}
+		})
+	}
+}
+
+func TestEncodeRejectsTruncated(t *testing.T) {
+	// Rejected before FFmpeg would run
+	for _, encoding := range []Encoding{EncodingWAV, EncodingFLAC, EncodingOgg} {
+		if _, err := Encode(context.Background(), []byte{1, 2, 3}, Expected, encoding); !errors.Is(err, ErrTruncated) {
+			t.Errorf("Encode(%s) of a sample and a half = %v, want %v", encoding, err, ErrTruncated)
+		}
+	}
+}
+
+func TestNewPCMReaderEmpty(t *testing.T) {
+	if _, _, err := NewPCMReader(bytes.NewReader(nil)); err == nil {
+		t.Error("NewPCMReader() of an empty stream succeeded")
+	}
+}
+
+// sine returns a second of a 440Hz sine in the Expected format, with a peak
+// of gain times full scale, clipped at full scale like an overdriven input
+func sine(gain float64) []byte {
+	pcm := make([]byte, Expected.BytesPerSecond())
+	for i := 0; i < len(pcm)/2; i++ {
+		sample := gain * math.MaxInt16 * math.Sin(2*math.Pi*440*float64(i)/float64(Expected.SampleRate))
+		sample = math.Round(min(max(sample, -math.MaxInt16), math.MaxInt16))
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(int16(sample)))
+	}
+	return pcm
+}
+
+func TestMeasureLoudness(t *testing.T) {
+	// The RMS of a sine is 3dB below its peak
+	sineRMS := 20 * math.Log10(1/math.Sqrt2)
+
+	tests := []struct {
+		name    string
+		pcm     []byte
+		want    Loudness
+		epsilon float64
+	}{
+		{"no samples", nil, Loudness{PeakDBFS: MinDBFS, RMSDBFS: MinDBFS}, 0},
+		{"digital silence", make([]byte, 3200), Loudness{PeakDBFS: MinDBFS, RMSDBFS: MinDBFS}, 0},
+		{"loud sine", sine(0.99), Loudness{PeakDBFS: -0.09, RMSDBFS: -0.09 + sineRMS}, 0.05},
+		{"half-scale sine", sine(0.5), Loudness{PeakDBFS: -6.02, RMSDBFS: -6.02 + sineRMS}, 0.05},
+		{"very quiet sine", sine(0.01), Loudness{PeakDBFS: -40, RMSDBFS: -40 + sineRMS}, 0.05},
+		// Overdriven twice over, a sine is at full scale two thirds of the
+		// time
+		{"clipped sine", sine(2), Loudness{PeakDBFS: 0, RMSDBFS: -1.07, ClippedPercent: 66.7}, 0.25},
+		// All but the samples at the zero crossings are clipped
+		{"square wave", sine(1000), Loudness{PeakDBFS: 0, RMSDBFS: 0, ClippedPercent: 99.5}, 0.05},
+		{"negative full scale", []byte{0x00, 0x80, 0x00, 0x80}, Loudness{PeakDBFS: 0, RMSDBFS: 0, ClippedPercent: 100}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MeasureLoudness(tt.pcm)
+			for _, field := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"peak", got.PeakDBFS, tt.want.PeakDBFS},
+				{"RMS", got.RMSDBFS, tt.want.RMSDBFS},
+				{"clipped", got.ClippedPercent, tt.want.ClippedPercent},
+			} {
+				if math.Abs(field.got-field.want) > tt.epsilon {
+					t.Errorf("%s = %.3f, want %.3f", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSilenceRatio(t *testing.T) {
+	// Half a second of speech, then half a second of silence
+	half := len(sine(1)) / 2
+	pcm := append(sine(0.1)[:half], make([]byte, half)...)
+
+	tests := []struct {
+		name      string
+		pcm       []byte
+		threshold float64
+		want      float64
+	}{
+		{"no audio", nil, -50, 0},
+		{"all silent", make([]byte, len(pcm)), -50, 1},
+		{"half silent", pcm, -50, 0.5},
+		{"quiet speech under the threshold", pcm, -10, 1},
+		{"loud", sine(1), -50, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SilenceRatio(tt.pcm, Expected, tt.threshold); math.Abs(got-tt.want) > 0.001 {
+				t.Errorf("SilenceRatio() = %.3f, want %.3f", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+// Package batch captions a backlog of recorded media files, such as VODs,
+// with the offline pipeline. Outputs appear next to each file or in a tree
+// mirroring the input, files with up-to-date outputs are skipped, and the
+// files done are recorded in a state file so an interrupted run resumes
+// where it left off.
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcript"
+	"github.com/sirupsen/logrus"
+)
+
+// StateFile is the name of the file recording the files a run has done, in
+// the root of the output tree
+const StateFile = ".transcription-batch.json"
+
+// progressInterval is how often the progress of a file is logged
+const progressInterval = time.Minute
+
+// mediaExtensions are the extensions of the files picked from a directory.
+// Files matched by a glob are taken whatever their extension.
+var mediaExtensions = map[string]bool{
+	".aac": true, ".avi": true, ".flac": true, ".flv": true, ".m4a": true,
+	".m4v": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true,
+	".ogg": true, ".opus": true, ".ts": true, ".wav": true, ".webm": true,
+}
+
+// Options of a batch run
+type Options struct {
+	Input  string // Directory searched recursively, or a glob
+	OutDir string // Root of the mirror output tree, empty to write next to the files
+	Jobs   int    // Files transcribed at once
+	Langs  proxy.Languages
+	Format subtitles.SubtitleFormat
+}
+
+// Summary of a batch run
+type Summary struct {
+	Processed int
+	Skipped   int // Up to date
+	Failed    int
+	Remaining int // Not started because the run was interrupted
+	Audio     time.Duration
+	Wall      time.Duration
+}
+
+// fileState is a file recorded as done in the state file
+type fileState struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	Outputs    []string  `json:"outputs"`
+	Duration   float64   `json:"duration"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// state is the content of the state file, files are keyed by their path
+// relative to the input root
+type state struct {
+	Files map[string]fileState `json:"files"`
+}
+
+// Run transcribes the files of options.Input with p. Closing stop lets the
+// files being transcribed finish but starts no new ones, while ctx being
+// done aborts them.
+func Run(ctx context.Context, stop <-chan struct{}, p *proxy.Proxy, options Options) (Summary, error) {
+	startedAt := time.Now()
+	logger := p.Logger().WithField("component", "batch")
+
+	if options.Format != subtitles.FormatSRT && options.Format != subtitles.FormatVTT {
+		return Summary{}, fmt.Errorf("subtitle format must be srt or vtt, got %q", options.Format)
+	}
+	if err := p.CheckOffline(options.Langs); err != nil {
+		return Summary{}, err
+	}
+
+	root, files, err := findFiles(options.Input)
+	if err != nil {
+		return Summary{}, err
+	}
+	outRoot := root
+	if options.OutDir != "" {
+		outRoot = options.OutDir
+	}
+	if err := os.MkdirAll(outRoot, 0755); err != nil {
+		return Summary{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	r := &runner{
+		proxy:     p,
+		options:   options,
+		root:      root,
+		outRoot:   outRoot,
+		statePath: filepath.Join(outRoot, StateFile),
+		logger:    logger,
+	}
+	if err := r.loadState(); err != nil {
+		return Summary{}, err
+	}
+	logger.WithFields(logrus.Fields{
+		"input": options.Input,
+		"files": len(files),
+		"jobs":  max(options.Jobs, 1),
+	}).Info("Starting batch")
+
+	queue := make(chan string)
+	var workers sync.WaitGroup
+	for range max(options.Jobs, 1) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range queue {
+				r.process(ctx, path)
+			}
+		}()
+	}
+
+	queued := 0
+feed:
+	for _, path := range files {
+		select {
+		case queue <- path:
+			queued++
+		case <-stop:
+			break feed
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	workers.Wait()
+
+	r.mu.Lock()
+	summary := r.summary
+	r.mu.Unlock()
+	summary.Remaining = len(files) - queued
+	summary.Wall = time.Since(startedAt)
+	return summary, nil
+}
+
+// runner holds the state of a batch run
+type runner struct {
+	proxy     *proxy.Proxy
+	options   Options
+	root      string // Directory the files are found in
+	outRoot   string
+	statePath string
+	logger    *logrus.Entry
+
+	mu      sync.Mutex
+	state   state
+	summary Summary
+}
+
+// process transcribes the file at path unless its outputs are up to date
+func (r *runner) process(ctx context.Context, path string) {
+	logger := r.logger.WithField("file", path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		r.fail(logger, err)
+		return
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		r.fail(logger, err)
+		return
+	}
+	outDir := filepath.Join(r.outRoot, filepath.Dir(rel))
+	baseName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	if r.upToDate(rel, info, outDir, baseName) {
+		logger.Debug("Outputs are up to date, skipping")
+		r.mu.Lock()
+		r.summary.Skipped++
+		r.mu.Unlock()
+		return
+	}
+
+	logger.Info("Transcribing file")
+	startedAt := time.Now()
+	lastLog := startedAt
+	progress := func(processed time.Duration) {
+		if time.Since(lastLog) < progressInterval {
+			return
+		}
+		lastLog = time.Now()
+		logger.WithField("progress", processed.Round(time.Second)).Info("Transcribing file")
+	}
+
+	result, err := r.transcribe(ctx, path, outDir, baseName, progress)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = errors.New("aborted")
+		}
+		r.fail(logger, err)
+		return
+	}
+
+	r.mu.Lock()
+	r.summary.Processed++
+	r.summary.Audio += result.Duration
+	r.state.Files[rel] = fileState{
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Outputs:    result.Files,
+		Duration:   result.Duration.Seconds(),
+		FinishedAt: time.Now(),
+	}
+	err = r.saveState()
+	r.mu.Unlock()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to record batch progress")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"dir":      outDir,
+		"duration": result.Duration.Round(time.Second),
+		"took":     time.Since(startedAt).Round(time.Second),
+	}).Info("File transcribed")
+}
+
+// transcribe transcribes the file into a temp directory and moves the
+// outputs to outDir once all of them are written, so an aborted file never
+// leaves outputs that look complete
+func (r *runner) transcribe(ctx context.Context, path, outDir, baseName string, progress func(time.Duration)) (proxy.FileResult, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return proxy.FileResult{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	// Hidden, so a later run searching the directory doesn't pick it up
+	tempDir, err := os.MkdirTemp(outDir, ".batch-")
+	if err != nil {
+		return proxy.FileResult{}, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	result, err := r.proxy.TranscribeFile(ctx, path, tempDir, proxy.FileOptions{
+		Langs:    r.options.Langs,
+		Format:   r.options.Format,
+		BaseName: baseName,
+	}, progress)
+	if err != nil {
+		return proxy.FileResult{}, err
+	}
+
+	for _, name := range result.Files {
+		if err := os.Rename(filepath.Join(tempDir, name), filepath.Join(outDir, name)); err != nil {
+			return proxy.FileResult{}, fmt.Errorf("failed to move %s: %w", name, err)
+		}
+	}
+	return result, nil
+}
+
+// upToDate reports whether the file at rel already has its outputs: either
+// the state file records it as done, unchanged since, with all outputs still
+// there, or its subtitles and full transcript are newer than the file
+func (r *runner) upToDate(rel string, info os.FileInfo, outDir, baseName string) bool {
+	r.mu.Lock()
+	done, ok := r.state.Files[rel]
+	r.mu.Unlock()
+
+	if ok {
+		if done.Size != info.Size() || !done.ModTime.Equal(info.ModTime()) {
+			return false
+		}
+		for _, name := range done.Outputs {
+			if _, err := os.Stat(filepath.Join(outDir, name)); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, name := range []string{baseName + "." + string(r.options.Format), baseName + transcript.FullSuffix} {
+		output, err := os.Stat(filepath.Join(outDir, name))
+		if err != nil || output.ModTime().Before(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// fail counts a file that couldn't be transcribed
+func (r *runner) fail(logger *logrus.Entry, err error) {
+	logger.WithError(err).Error("Failed to transcribe file")
+	r.mu.Lock()
+	r.summary.Failed++
+	r.mu.Unlock()
+}
+
+// loadState reads the state file of an earlier run, if there is one
+func (r *runner) loadState() error {
+	r.state = state{Files: make(map[string]fileState)}
+	data, err := os.ReadFile(r.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read batch state: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		return fmt.Errorf("failed to parse batch state %s: %w", r.statePath, err)
+	}
+	if r.state.Files == nil {
+		r.state.Files = make(map[string]fileState)
+	}
+	return nil
+}
+
+// saveState replaces the state file; the caller must hold r.mu
+func (r *runner) saveState() error {
+	data, err := json.MarshalIndent(r.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode batch state: %w", err)
+	}
+	temp := r.statePath + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write batch state: %w", err)
+	}
+	if err := os.Rename(temp, r.statePath); err != nil {
+		return fmt.Errorf("failed to write batch state: %w", err)
+	}
+	return nil
+}
+
+// findFiles returns the files input names, sorted, and the directory they
+// are found in. A directory is searched recursively for media files,
+// skipping hidden directories, and a glob is taken relative to its longest
+// directory without wildcards.
+func findFiles(input string) (root string, files []string, err error) {
+	if hasMeta(input) {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid glob %q: %w", input, err)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+		}
+		root = filepath.Dir(input)
+		for hasMeta(root) {
+			root = filepath.Dir(root)
+		}
+	} else {
+		info, err := os.Stat(input)
+		if err != nil {
+			return "", nil, err
+		}
+		if !info.IsDir() {
+			return filepath.Dir(input), []string{input}, nil
+		}
+		root = input
+		err = filepath.WalkDir(input, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if path != input && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.Type().IsRegular() && mediaExtensions[strings.ToLower(filepath.Ext(path))] {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to search %s: %w", input, err)
+		}
+	}
+
+	if len(files) == 0 {
+		return "", nil, fmt.Errorf("no media files found in %s", input)
+	}
+	slices.Sort(files)
+	return root, files, nil
+}
+
+// hasMeta reports whether path contains glob wildcards
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
+}
@@ -0,0 +1,44 @@
+// Package bufpool recycles the large byte slices allocated for every chunk of
+// a stream, its audio and its video on the way to the targets, so the garbage
+// collector doesn't have to reclaim megabytes per chunk. A slice may only be
+// put back by its last user, once nothing refers to it any more.
+package bufpool
+
+import "sync"
+
+// minSize is the smallest slice worth keeping, smaller ones are cheap to
+// allocate and would only be too small for the next chunk
+const minSize = 64 * 1024
+
+// Pool holds byte slices for reuse. The zero value is ready to use, and it is
+// safe for concurrent use.
+type Pool struct {
+	pool sync.Pool
+}
+
+// Shared pools, by what their slices hold
+var (
+	// Audio holds the PCM of chunks
+	Audio Pool
+	// Video holds FLV fragments
+	Video Pool
+)
+
+// Get returns a slice of length n, reusing one that was put back if it is
+// large enough. Its contents are undefined.
+func (p *Pool) Get(n int) []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok && cap(*b) >= n {
+		return (*b)[:n]
+	}
+	return make([]byte, n, max(n, minSize))
+}
+
+// Put puts b back for reuse. Neither b nor anything sharing its memory may be
+// used afterwards.
+func (p *Pool) Put(b []byte) {
+	if cap(b) < minSize {
+		return
+	}
+	b = b[:0]
+	p.pool.Put(&b)
+}
@@ -0,0 +1,114 @@
+package bufpool
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		minCap int
+	}{
+		{"empty", 0, minSize},
+		{"small", 100, minSize},
+		{"minimum", minSize, minSize},
+		{"chunk of audio", 320_000, 320_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Pool
+			b := p.Get(tt.n)
+			if len(b) != tt.n || cap(b) < tt.minCap {
+				t.Errorf("Get(%d) has length %d and capacity %d, want capacity at least %d", tt.n, len(b), cap(b), tt.minCap)
+			}
+		})
+	}
+}
+
+func TestGetReuses(t *testing.T) {
+	var p Pool
+	// The pool may drop what was put back, so it is only expected to reuse a
+	// slice at some point
+	b := p.Get(minSize)
+	for i := 0; i < 100; i++ {
+		p.Put(b)
+		got := p.Get(minSize / 2)
+		if &got[0] == &b[0] {
+			if len(got) != minSize/2 {
+				t.Errorf("reused slice has length %d, want %d", len(got), minSize/2)
+			}
+			return
+		}
+		b = got
+	}
+	t.Error("no slice put back was ever reused")
+}
+
+func TestGetSkipsSmallSlices(t *testing.T) {
+	var p Pool
+	for i := 0; i < 10; i++ {
+		p.Put(make([]byte, minSize))
+		if b := p.Get(4 * minSize); len(b) != 4*minSize {
+			t.Fatalf("Get(%d) has length %d, a slice too small was reused", 4*minSize, len(b))
+		}
+	}
+}
+
+func TestPutDropsSmallSlices(t *testing.T) {
+	var p Pool
+	small := make([]byte, 10, minSize-1)
+	p.Put(small)
+	if b := p.Get(10); &b[0] == &small[0] {
+		t.Error("slice below the minimum size kept for reuse")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	// Every goroutine fills its slices with a byte of its own, any other
+	// byte found means a slice was handed out twice. The race detector
+	// catches it too.
+	var p Pool
+	var wg sync.WaitGroup
+	for g := 1; g <= 8; g++ {
+		wg.Add(1)
+		go func(fill byte) {
+			defer wg.Done()
+			pattern := bytes.Repeat([]byte{fill}, 2*minSize)
+			for i := 0; i < 200; i++ {
+				b := p.Get(minSize + i*100)
+				copy(b, pattern)
+				runtime.Gosched()
+				if !bytes.Equal(b, pattern[:len(b)]) {
+					t.Errorf("slice of goroutine %d written by another", fill)
+					return
+				}
+				p.Put(b)
+			}
+		}(byte(g))
+	}
+	wg.Wait()
+}
+
+func BenchmarkPool(b *testing.B) {
+	const size = 320_000 // 10s of 16kHz mono PCM
+	b.Run("pooled", func(b *testing.B) {
+		var p Pool
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.Put(p.Get(size))
+		}
+	})
+	b.Run("allocated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sink = make([]byte, size)
+		}
+	})
+}
+
+// sink keeps the allocations of the benchmark from being optimized away
+var sink []byte
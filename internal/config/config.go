@@ -1,68 +1,642 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+)
+
+// Processing modes selectable via the MODE environment variable
+const (
+	ModeRestream       = "restream"
+	ModeTranscribeOnly = "transcribe-only"
+	ModePassthrough    = "passthrough"
+)
+
+// Video sent with audio-only streams, selectable via AUDIO_ONLY_VIDEO
+const (
+	AudioOnlyVideoNone  = "none"
+	AudioOnlyVideoBlack = "black"
+)
+
+// Handling of video codecs a target doesn't accept, selectable via
+// CODEC_POLICY
+const (
+	CodecPolicyTranscode = "transcode" // Transcode the session to H.264
+	CodecPolicyReject    = "reject"    // Stop streaming to the target
+)
+
+// Handling of too little free GPU memory before a transcription, selectable
+// via VRAM_POLICY
+const (
+	VRAMPolicyOff    = "off"    // Don't check
+	VRAMPolicyWait   = "wait"   // Wait up to VRAM_WAIT for memory to be freed
+	VRAMPolicyReduce = "reduce" // Step down to cheaper settings that fit
+	VRAMPolicyCPU    = "cpu"    // Transcribe on the CPU
 )
 
 type Config struct {
 	// Server settings
-	ListenAddress string
-	OutputDir     string
-	LogLevel      string
+	ListenAddress    string // Control API address, e.g. 127.0.0.1:8080 for local access only
+	APIToken         string // Bearer token required by the control API, open if empty
+	APIReadOnlyOpen  bool   // Allow read-only control API requests without the token
+	OutputDir        string // Session artifacts; optional, they are disabled if it isn't writable
+	WorkDir          string // Scratch files go in a transcription-proxy directory in it, must be writable; OutputDir/.temp if empty
+	FilenameTemplate string
+	LogLevel         string
+	LogFormat        string // text or json
+	Mode             string
+
+	// LogDedupWindow collapses identical warnings and errors logged within it
+	// into one entry, zero to log every one
+	LogDedupWindow time.Duration
+	// ChunkReportEvery logs the processing report of every n-th chunk at info
+	// level; the others, or all if zero, are logged at debug level
+	ChunkReportEvery int
+	// MinChunkAudio and MinChunkVideoTags are the least audio and the fewest
+	// video tags a chunk needs to be transcribed. After TooSmallChunksDegraded
+	// smaller chunks in a row the pipeline is reported degraded, zero to never.
+	MinChunkAudio          time.Duration
+	MinChunkVideoTags      int
+	TooSmallChunksDegraded int
+	// SessionLog also writes each session's log lines to session.log in its
+	// directory, rotated once it grows beyond SessionLogMaxSize and keeping
+	// SessionLogMaxFiles rotated files
+	SessionLog         bool
+	SessionLogMaxSize  int64
+	SessionLogMaxFiles int
+
+	// ShutdownTimeout bounds how long in-flight chunks may take to drain on shutdown
+	ShutdownTimeout time.Duration
+
+	// MaxStreamDuration ends a stream that has run this long, and IdleTimeout
+	// one that has been idle this long: no audio louder than IdleSilenceDB
+	// dBFS and no change in the video keyframes. Zero disables either.
+	MaxStreamDuration time.Duration
+	IdleTimeout       time.Duration
+	IdleSilenceDB     int
+
+	// SessionResumeWindow is how long a publisher that disconnected may take
+	// to reconnect and continue its session, which otherwise ends. Zero ends
+	// the session as soon as the publisher disconnects.
+	SessionResumeWindow time.Duration
+
+	// QuietInputDB and ClippedInputPercent are the RMS level in dBFS below
+	// which and the share of clipped samples above which the input is
+	// warned about, once per session when sustained. Zero disables either.
+	QuietInputDB        int
+	ClippedInputPercent int
+
+	// Caption settings
+	Reflow       bool          // Merge sentences split across chunk boundaries
+	ReflowMaxGap time.Duration // Largest gap between segments that are merged
+	MaxCueChars  int
+
+	// Segment timing corrections before captioning: how long a cue may still
+	// be shown once the next started, and whether overlapping segments are
+	// merged rather than the earlier one ended
+	CueMaxOverlap   time.Duration
+	CueOverlapMerge bool
+
+	// Caption line wrapping, in display columns where CJK characters count as
+	// two. CaptionColumnsByLang overrides the width per language.
+	CaptionMaxColumns    int
+	CaptionColumnsByLang map[string]int
+
+	// Unicode clean-up of the transcription before it is translated and
+	// captioned, see textnorm. CaptionEmoji is keep, strip or shortcode.
+	CaptionNFC              bool
+	CaptionEmoji            string
+	CaptionStripInvisible   bool
+	CaptionStraightenQuotes bool
+
+	// SpeakerChangeDetection labels the segments S1, S2, ... by comparing
+	// the voice of each with that of the current speaker; one that differs by
+	// more than SpeakerChangeThresholdDB counts as another speaker, up to
+	// SpeakerMaxSpeakers. SpeakerCaptionPrefix is put in front of the
+	// captions where the speaker changes, with {speaker} standing for the
+	// label, or empty to only record the labels in the transcript.
+	SpeakerChangeDetection   bool
+	SpeakerChangeThresholdDB int
+	SpeakerMaxSpeakers       int
+	SpeakerCaptionPrefix     string
+
+	// RecordInput records the incoming stream into the session directory;
+	// PostSessionMux then remuxes it with the session subtitles once the
+	// stream ends
+	RecordInput    bool
+	PostSessionMux bool
+
+	// SubtitleFormat is how captions are embedded into the restream: as an
+	// srt, vtt, or ass track, burned into the picture, or none at all.
+	// Targets can select another with ?subtitles=. The session's sidecar
+	// subtitles are vtt if that is selected, srt otherwise.
+	SubtitleFormat string
+	// VTTCueSettings place every WebVTT cue, e.g. "line:85% align:center",
+	// and VTTMPEGTS maps cue time 0 to that MPEG-TS timestamp for HLS, 0 to
+	// leave out the map
+	VTTCueSettings string
+	VTTMPEGTS      int64
+	// SubtitleDelay shifts embedded captions to compensate for encoder
+	// latency, negative to show them earlier
+	SubtitleDelay time.Duration
+	// StreamDelay holds the restream and caption outputs back so a moderator
+	// can dump them before they go out, zero to disable. Held chunks beyond
+	// StreamDelayMemory bytes are spilled to disk. RealtimeCaptions sends
+	// captions to the publishers without the delay, for moderators.
+	StreamDelay       time.Duration
+	StreamDelayMemory int64
+	RealtimeCaptions  bool
+
+	// SpoolMemory is how many bytes of queued video chunks are held in
+	// memory before further chunks are spooled to disk, zero to never spool.
+	// SpoolMax caps the spool; beyond it the oldest spooled chunks are
+	// dropped.
+	SpoolMemory int64
+	SpoolMax    int64
+
+	// DriftThreshold is how far the audio and video clocks may drift apart
+	// before embedded captions are corrected for it
+	DriftThreshold time.Duration
+
+	// LiveCaptionWindow is how far back the live caption endpoints reach;
+	// LiveCaptionHistory bounds how many cues are kept for them, and how many
+	// are replayed to WebSocket clients joining mid-stream
+	LiveCaptionWindow  time.Duration
+	LiveCaptionHistory int
+
+	// TranscriptVerboseJSON also writes session transcripts in Whisper's
+	// verbose_json format
+	TranscriptVerboseJSON bool
+
+	// SaveFailedChunks writes the audio, video, subtitles, and commands of
+	// chunks that failed transcription or embedding to the session
+	// directory, at most MaxFailedChunks per session
+	SaveFailedChunks bool
+	MaxFailedChunks  int
+
+	// StatusFile is where the state of the proxy is written for external
+	// tools, empty to disable
+	StatusFile string
+
+	// TranscriptDBPath is the SQLite database indexing the transcripts of
+	// all sessions for search, empty to disable
+	TranscriptDBPath string
+
+	// Temp file and disk space settings
+	TempMaxAge        time.Duration
+	MinFreeDiskMB     int
+	DiskCheckInterval time.Duration
+
+	// FFmpeg CPU limits, so FFmpeg leaves room for Whisper on shared hosts:
+	// FFmpegThreads threads per input and output, 0 for FFmpeg's choice, and
+	// ProcessNice the niceness of its processes, 0 to keep the proxy's
+	FFmpegThreads int
+	ProcessNice   int
+
+	// MaxChildProcesses caps the child processes running at once, 0 for no
+	// cap; further starts wait. ResourceCheckInterval is how often open files
+	// and processes are checked against the limits of the container.
+	MaxChildProcesses     int
+	ResourceCheckInterval time.Duration
+
+	// Audio-only streams
+	AudioOnly      bool   // Expect streams without video instead of detecting them
+	AudioOnlyVideo string // Video sent with audio-only streams: none or black
+
+	// Audio tracks of publishers sending several, like OBS
+	AudioTrackIndex   int    // Audio track that is transcribed, counting from 0
+	OutputAudioTracks string // Audio tracks restreamed, comma-separated indexes, empty for all
+
+	// Incoming codecs
+	CodecPolicy string // Handling of video codecs a target doesn't accept: transcode or reject
 
 	// RTMP settings
 	RTMPPort          string
+	RTMPBindAddress   string // IP address the listener binds to, 0.0.0.0 or :: for all interfaces
+	RTMPAppPath       string // Application path publishers push to, e.g. live
 	DefaultTargetURL  string
+	TwitchIngest      string // Ingest twitch targets publish to, e.g. rtmps://fra05.contribute.live-video.net/app
+	YouTubeIngest     string // Ingest youtube targets publish to
+	SecretsDir        string // Directory ${NAME} placeholders in target URLs are read from before the environment
 	DefaultSourceLang string
 	DefaultTargetLang string
 
+	// ExtraTargetLangs are further languages the captions are translated
+	// into. With any set, every language, the source and target included,
+	// gets its own subtitle file in the session.
+	ExtraTargetLangs []string
+
+	// StreamProfiles defines named encoding profiles that targets select
+	// with ?profile=name to be sent transcoded video, in the form
+	// name:key=value,...;name:key=value,...
+	StreamProfiles string
+
+	// A target whose FFmpeg process fails TargetBreakerFailures times in a
+	// row, each within TargetBreakerWindow of the last, or whose key is
+	// rejected, isn't retried for TargetBreakerCooldown or until it is reset
+	TargetBreakerFailures int // 0 never stops retrying
+	TargetBreakerWindow   time.Duration
+	TargetBreakerCooldown time.Duration // 0 waits for a reset
+
+	// PreviewMaxViewers is how many players may watch the stream sent to
+	// the targets at GET /preview/stream.flv at a time, 0 disables it
+	PreviewMaxViewers int
+
 	// Whisper model settings
 	WhisperModelPath string
 	WhisperModelSize string
+	WhisperModelDir  string // Overrides the directory derived from WhisperModelSize
 	CUDAEnabled      bool
-	MaxVRAMUsageMB   int
+	MaxVRAMUsageMB   int           // Free VRAM a transcription at the configured settings needs
+	VRAMPolicy       string        // What to do when less is free: off, wait, reduce, or cpu
+	VRAMWait         time.Duration // Longest wait of the wait policy
 	ComputePrecision string
 	BatchSize        int
 	BeamSize         int
 	GPUThreads       int
 
+	// Model evaluation: ABComparePercent of the live chunks are transcribed
+	// again with the model in ABCompareModelDir, in the background, and both
+	// results written to the session's evaluation file. Disabled if empty.
+	ABCompareModelDir string
+	ABComparePercent  int
+
+	// Whisper decoding parameters, as given; empty values keep the
+	// whisper-ctranslate2 defaults. The transcriber parses and checks them.
+	WhisperTemperature               string
+	WhisperBestOf                    string
+	WhisperConditionOnPreviousText   string
+	WhisperNoSpeechThreshold         string
+	WhisperCompressionRatioThreshold string
+	WhisperVADMinSilence             string // Duration, e.g. 500ms
+	WhisperVADSpeechPad              string // Duration
+
+	// WhisperURL is an OpenAI-compatible transcription endpoint chunks are
+	// uploaded to instead of running whisper-ctranslate2, e.g.
+	// http://whisper:8000/v1/audio/transcriptions. Empty transcribes locally.
+	WhisperURL      string
+	WhisperAPIKey   string
+	WhisperAccept   []string // Content types the endpoint takes, WAV if empty
+	WhisperCompress bool     // Upload FLAC rather than WAV if the endpoint takes it
+	WhisperTimeout  time.Duration
+
+	// RetranscribeOtherLanguages transcribes segments Whisper detected in
+	// another language than the source language again in that language.
+	// It costs another transcription per such segment.
+	RetranscribeOtherLanguages bool
+
+	// Model download settings
+	AutoDownloadModels bool
+	HuggingFaceURL     string
+	Warmup             bool
+
 	// Argos Translate settings
 	ArgosModelsPath   string
 	EnableTranslation bool
 	ArgosVRAMUsageMB  int
+
+	// ArgosWorker keeps a translation process running instead of starting
+	// argos-translate for every segment
+	ArgosWorker        bool
+	TranslationTimeout time.Duration
+
+	// TranslationMaxFailures is how many segments in a row may fail to
+	// translate before translation is skipped for the rest of the session,
+	// 0 to never give up
+	TranslationMaxFailures int
+
+	// AutoInstallLangPairs installs a missing language pair when a stream
+	// asks for it, captions staying untranslated until it is ready
+	AutoInstallLangPairs   bool
+	LangPairInstallTimeout time.Duration
+
+	// Profanity filter settings
+	ProfanityList               string // Wordlist path, {lang} selects a per-language list
+	ProfanityPlaceholder        string // Replacement for masked words, asterisks if empty
+	ProfanityFilterTranslations bool
+
+	// Twitch extension captions, published when TwitchExtensionClientID is
+	// set. The secret is the base64 extension secret.
+	TwitchExtensionClientID string
+	TwitchExtensionSecret   string
+	TwitchExtensionOwnerID  string
+	TwitchBroadcasterID     string
+	TwitchExtensionEndpoint string
+
+	// YouTube captions, posted to YouTubeCaptionsURL, the caption ingestion
+	// URL from YouTube Studio, when set. YouTubeCaptionsOffset is added to
+	// the caption times to line them up with the restreamed video.
+	YouTubeCaptionsURL    string
+	YouTubeCaptionsOffset time.Duration
+
+	// MaxSinkFailures is how often in a row a caption output, such
+	// as the sidecar subtitles or a platform, may fail before it is disabled
+	// for the rest of the stream; 0 never disables it
+	MaxSinkFailures int
+
+	// Upload of the session files to an S3-compatible bucket, enabled when
+	// UploadBucket is set. Running sessions are uploaded every
+	// UploadInterval, 0 uploads them only once they ended. UploadPathStyle
+	// puts the bucket in the path rather than the host name, as most
+	// S3-compatible stores expect.
+	UploadEndpoint    string
+	UploadBucket      string
+	UploadPrefix      string
+	UploadRegion      string
+	UploadAccessKey   string
+	UploadSecretKey   string
+	UploadPathStyle   bool
+	UploadInterval    time.Duration
+	UploadDeleteLocal bool // Delete the uploaded files, keeping the session summary
+
+	// MQTT publishing, enabled when MQTTBroker is set, e.g. tcp://host:1883
+	// or ssl://host:8883
+	MQTTBroker      string
+	MQTTClientID    string
+	MQTTTopicPrefix string
+	MQTTQoS         int
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTTLSCA       string // CA certificate file for TLS brokers, system roots if empty
+
+	// gRPC service for ad-hoc transcription
+	GRPCEnabled bool
+	GRPCAddress string
+
+	// Ad-hoc transcription over gRPC and POST /transcribe. AdhocMaxJobs
+	// bounds how many jobs run at once; they also wait for live chunks so
+	// they can't starve the stream.
+	AdhocMaxJobs       int
+	TranscribeMaxBytes int64         // Largest upload accepted by POST /transcribe
+	TranscribeSyncMax  time.Duration // Longer audio is transcribed as a background job
+	TranscribeLocalDir string        // Directory server-local files may be read from, none if empty
+
+	// ReprocessMaxJobs bounds how many session recordings are reprocessed at
+	// once; further requests are queued
+	ReprocessMaxJobs int
+
+	// Transcription scheduling. TranscribeSlots bounds how many chunks are
+	// transcribed at once, 0 for no limit. Ad-hoc jobs and reprocessing only
+	// run while no live chunk is waiting or in transcription, unless
+	// BatchSharePercent gives them a share of the slots.
+	TranscribeSlots   int
+	BatchSharePercent int
 }
 
 func New() *Config {
 	return &Config{
 		// Server settings
-		ListenAddress: getEnvOrDefault("LISTEN_ADDRESS", ":8080"),
-		OutputDir:     getEnvOrDefault("OUTPUT_DIR", "/app/transcripts"),
-		LogLevel:      getEnvOrDefault("LOG_LEVEL", "info"),
+		ListenAddress:    getEnvOrDefault("LISTEN_ADDRESS", ":8080"),
+		APIToken:         getEnvOrDefault("API_TOKEN", ""),
+		APIReadOnlyOpen:  getEnvBoolOrDefault("API_READONLY_OPEN", false),
+		OutputDir:        getEnvOrDefault("OUTPUT_DIR", "/app/transcripts"),
+		WorkDir:          getEnvOrDefault("WORK_DIR", ""),
+		FilenameTemplate: getEnvOrDefault("FILENAME_TEMPLATE", "{key}-{date}-{lang}"),
+		LogLevel:         getEnvOrDefault("LOG_LEVEL", "info"),
+		LogFormat:        getEnvOrDefault("LOG_FORMAT", "text"),
+		Mode:             getEnvOrDefault("MODE", ModeRestream),
+		LogDedupWindow:   getEnvDurationOrDefault("LOG_DEDUP_WINDOW", time.Minute),
+		ChunkReportEvery: getEnvIntOrDefault("CHUNK_REPORT_EVERY_N", 0),
+
+		MinChunkAudio:          time.Duration(getEnvIntOrDefault("MIN_CHUNK_AUDIO_MS", 500)) * time.Millisecond,
+		MinChunkVideoTags:      getEnvIntOrDefault("MIN_CHUNK_VIDEO_TAGS", 1),
+		TooSmallChunksDegraded: getEnvIntOrDefault("TOO_SMALL_CHUNKS_DEGRADED", 3),
+
+		SessionLog:         getEnvBoolOrDefault("SESSION_LOG", true),
+		SessionLogMaxSize:  int64(getEnvIntOrDefault("SESSION_LOG_MAX_MB", 50)) << 20,
+		SessionLogMaxFiles: getEnvIntOrDefault("SESSION_LOG_MAX_FILES", 3),
+
+		ShutdownTimeout:    getEnvDurationOrDefault("SHUTDOWN_TIMEOUT", 30*time.Second),
+		LiveCaptionWindow:  getEnvDurationOrDefault("LIVE_CAPTION_WINDOW", 5*time.Minute),
+		LiveCaptionHistory: getEnvIntOrDefault("LIVE_CAPTION_HISTORY", 200),
+
+		TranscriptVerboseJSON: getEnvBoolOrDefault("TRANSCRIPT_VERBOSE_JSON", false),
+		SaveFailedChunks:      getEnvBoolOrDefault("SAVE_FAILED_CHUNKS", false),
+		MaxFailedChunks:       getEnvIntOrDefault("MAX_FAILED_CHUNKS", 10),
+		StatusFile:            getEnvOrDefault("STATUS_FILE", ""),
+		TranscriptDBPath:      getEnvOrDefault("TRANSCRIPT_DB_PATH", ""),
+
+		MaxStreamDuration: getEnvDurationOrDefault("MAX_STREAM_DURATION", 0),
+		IdleTimeout:       getEnvDurationOrDefault("IDLE_TIMEOUT", 0),
+		IdleSilenceDB:     getEnvIntOrDefault("IDLE_SILENCE_DB", -50),
+
+		SessionResumeWindow: getEnvDurationOrDefault("SESSION_RESUME_WINDOW", 0),
+
+		QuietInputDB:        getEnvIntOrDefault("QUIET_INPUT_DB", -35),
+		ClippedInputPercent: getEnvIntOrDefault("CLIPPED_INPUT_PERCENT", 1),
+
+		SubtitleFormat: getEnvOrDefault("SUBTITLE_FORMAT", "srt"),
+		VTTCueSettings: getEnvOrDefault("VTT_CUE_SETTINGS", ""),
+		VTTMPEGTS:      int64(getEnvIntOrDefault("VTT_MPEGTS", 0)),
+		SubtitleDelay:  time.Duration(getEnvIntOrDefault("SUBTITLE_DELAY_MS", 0)) * time.Millisecond,
+		DriftThreshold: getEnvDurationOrDefault("DRIFT_THRESHOLD", 200*time.Millisecond),
+
+		SpoolMemory: int64(getEnvIntOrDefault("SPOOL_MEMORY_MB", 0)) << 20,
+		SpoolMax:    int64(getEnvIntOrDefault("SPOOL_MAX_MB", 2048)) << 20,
+
+		StreamDelay:       getEnvDurationOrDefault("STREAM_DELAY", 0),
+		StreamDelayMemory: int64(getEnvIntOrDefault("STREAM_DELAY_MEMORY_MB", 256)) << 20,
+		RealtimeCaptions:  getEnvBoolOrDefault("REALTIME_CAPTIONS", false),
+
+		RecordInput:    getEnvBoolOrDefault("RECORD_INPUT", false),
+		PostSessionMux: getEnvBoolOrDefault("POST_SESSION_MUX", false),
+
+		// Caption settings
+		Reflow:       getEnvBoolOrDefault("REFLOW", true),
+		ReflowMaxGap: getEnvDurationOrDefault("REFLOW_MAX_GAP", time.Second),
+		MaxCueChars:  getEnvIntOrDefault("MAX_CUE_CHARS", 84),
+
+		CueMaxOverlap:   getEnvDurationOrDefault("CUE_MAX_OVERLAP", 0),
+		CueOverlapMerge: getEnvBoolOrDefault("CUE_OVERLAP_MERGE", false),
+
+		CaptionMaxColumns:    getEnvIntOrDefault("CAPTION_MAX_COLUMNS", 42),
+		CaptionColumnsByLang: getEnvIntMapOrDefault("CAPTION_COLUMNS_BY_LANG", "ja=26,zh=32,ko=32"),
+
+		CaptionNFC:              getEnvBoolOrDefault("CAPTION_NFC", true),
+		CaptionEmoji:            getEnvOrDefault("CAPTION_EMOJI", "keep"),
+		CaptionStripInvisible:   getEnvBoolOrDefault("CAPTION_STRIP_INVISIBLE", true),
+		CaptionStraightenQuotes: getEnvBoolOrDefault("CAPTION_STRAIGHTEN_QUOTES", false),
+
+		SpeakerChangeDetection:   getEnvBoolOrDefault("SPEAKER_CHANGE_DETECTION", false),
+		SpeakerChangeThresholdDB: getEnvIntOrDefault("SPEAKER_CHANGE_THRESHOLD_DB", 5),
+		SpeakerMaxSpeakers:       getEnvIntOrDefault("SPEAKER_MAX_SPEAKERS", 2),
+		SpeakerCaptionPrefix:     getEnvOrDefault("SPEAKER_CAPTION_PREFIX", "–"),
+
+		// Temp file and disk space settings
+		TempMaxAge:        getEnvDurationOrDefault("TEMP_MAX_AGE", 24*time.Hour),
+		MinFreeDiskMB:     getEnvIntOrDefault("MIN_FREE_DISK_MB", 1024),
+		DiskCheckInterval: getEnvDurationOrDefault("DISK_CHECK_INTERVAL", 30*time.Second),
+
+		FFmpegThreads: getEnvIntOrDefault("FFMPEG_THREADS", 0),
+		ProcessNice:   getEnvIntOrDefault("PROCESS_NICE", 0),
+
+		MaxChildProcesses:     getEnvIntOrDefault("MAX_CHILD_PROCESSES", 0),
+		ResourceCheckInterval: getEnvDurationOrDefault("RESOURCE_CHECK_INTERVAL", 30*time.Second),
+
+		// Audio-only streams
+		AudioOnly:      getEnvBoolOrDefault("AUDIO_ONLY", false),
+		AudioOnlyVideo: getEnvOrDefault("AUDIO_ONLY_VIDEO", AudioOnlyVideoNone),
+
+		// Audio tracks
+		AudioTrackIndex:   getEnvIntOrDefault("AUDIO_TRACK_INDEX", 0),
+		OutputAudioTracks: getEnvOrDefault("OUTPUT_AUDIO_TRACKS", ""),
+
+		// Incoming codecs
+		CodecPolicy: getEnvOrDefault("CODEC_POLICY", CodecPolicyTranscode),
 
 		// RTMP settings
 		RTMPPort:          getEnvOrDefault("RTMP_PORT", "1935"),
+		RTMPBindAddress:   getEnvOrDefault("RTMP_BIND_ADDRESS", "0.0.0.0"),
+		RTMPAppPath:       getEnvOrDefault("RTMP_APP_PATH", "live"),
 		DefaultTargetURL:  getEnvOrDefault("TARGET_URL", "rtmp://localhost:1936/out"),
+		TwitchIngest:      getEnvOrDefault("TWITCH_INGEST", "rtmp://ingest.global-contribute.live-video.net/app"),
+		YouTubeIngest:     getEnvOrDefault("YOUTUBE_INGEST", "rtmp://a.rtmp.youtube.com/live2"),
+		SecretsDir:        getEnvOrDefault("SECRETS_DIR", "/run/secrets"),
 		DefaultSourceLang: getEnvOrDefault("SRC_LANG", "en"),
 		DefaultTargetLang: getEnvOrDefault("LANG", "en"),
+		ExtraTargetLangs:  getEnvListOrDefault("EXTRA_TARGET_LANGS", ""),
+		StreamProfiles:    getEnvOrDefault("STREAM_PROFILES", ""),
+
+		TargetBreakerFailures: getEnvIntOrDefault("TARGET_BREAKER_FAILURES", 5),
+		TargetBreakerWindow:   getEnvDurationOrDefault("TARGET_BREAKER_WINDOW", 2*time.Minute),
+		TargetBreakerCooldown: getEnvDurationOrDefault("TARGET_BREAKER_COOLDOWN", 15*time.Minute),
+
+		PreviewMaxViewers: getEnvIntOrDefault("PREVIEW_MAX_VIEWERS", 2),
 
 		// Whisper model settings
 		WhisperModelPath: getEnvOrDefault("WHISPER_MODEL_PATH", "/app/models/whisper"),
-		WhisperModelSize: getEnvOrDefault("WHISPER_MODEL_SIZE", "large-v3"),
+		WhisperModelSize: getEnvOrDefault("WHISPER_MODEL_SIZE", "large-v3-turbo"),
+		WhisperModelDir:  getEnvOrDefault("WHISPER_MODEL_DIR", ""),
 		CUDAEnabled:      getEnvBoolOrDefault("CUDA_ENABLED", true),
 		MaxVRAMUsageMB:   getEnvIntOrDefault("MAX_VRAM_USAGE_MB", 8000),
+		VRAMPolicy:       getEnvOrDefault("VRAM_POLICY", VRAMPolicyOff),
+		VRAMWait:         getEnvDurationOrDefault("VRAM_WAIT", 10*time.Second),
 		ComputePrecision: getEnvOrDefault("COMPUTE_PRECISION", "float16"),
 		BatchSize:        getEnvIntOrDefault("BATCH_SIZE", 16),
 		BeamSize:         getEnvIntOrDefault("BEAM_SIZE", 5),
 		GPUThreads:       getEnvIntOrDefault("GPU_THREADS", 4),
 
+		ABCompareModelDir: getEnvOrDefault("AB_COMPARE_MODEL_DIR", ""),
+		ABComparePercent:  getEnvIntOrDefault("AB_COMPARE_PERCENT", 10),
+
+		WhisperTemperature:               getEnvOrDefault("WHISPER_TEMPERATURE", ""),
+		WhisperBestOf:                    getEnvOrDefault("WHISPER_BEST_OF", ""),
+		WhisperConditionOnPreviousText:   getEnvOrDefault("WHISPER_CONDITION_ON_PREVIOUS_TEXT", ""),
+		WhisperNoSpeechThreshold:         getEnvOrDefault("WHISPER_NO_SPEECH_THRESHOLD", ""),
+		WhisperCompressionRatioThreshold: getEnvOrDefault("WHISPER_COMPRESSION_RATIO_THRESHOLD", ""),
+		WhisperVADMinSilence:             getEnvOrDefault("WHISPER_VAD_MIN_SILENCE", ""),
+		WhisperVADSpeechPad:              getEnvOrDefault("WHISPER_VAD_SPEECH_PAD", ""),
+		RetranscribeOtherLanguages:       getEnvBoolOrDefault("RETRANSCRIBE_OTHER_LANGUAGES", false),
+
+		WhisperURL:      getEnvOrDefault("WHISPER_URL", ""),
+		WhisperAPIKey:   getEnvOrDefault("WHISPER_API_KEY", ""),
+		WhisperAccept:   getEnvListOrDefault("WHISPER_ACCEPT", ""),
+		WhisperCompress: getEnvBoolOrDefault("WHISPER_COMPRESS", false),
+		WhisperTimeout:  getEnvDurationOrDefault("WHISPER_TIMEOUT", 2*time.Minute),
+
+		// Model download settings
+		AutoDownloadModels: getEnvBoolOrDefault("AUTO_DOWNLOAD_MODELS", false),
+		HuggingFaceURL:     getEnvOrDefault("HF_ENDPOINT", "https://huggingface.co"),
+		Warmup:             getEnvBoolOrDefault("WARMUP", false),
+
 		// Argos Translate settings
 		ArgosModelsPath:   getEnvOrDefault("ARGOS_MODELS_PATH", "/app/models/argos"),
 		EnableTranslation: getEnvBoolOrDefault("ENABLE_TRANSLATION", true),
 		ArgosVRAMUsageMB:  getEnvIntOrDefault("ARGOS_VRAM_USAGE_MB", 4000),
+
+		ArgosWorker:        getEnvBoolOrDefault("ARGOS_WORKER", true),
+		TranslationTimeout: getEnvDurationOrDefault("TRANSLATION_TIMEOUT", 10*time.Second),
+
+		TranslationMaxFailures: getEnvIntOrDefault("TRANSLATION_MAX_FAILURES", 10),
+
+		AutoInstallLangPairs:   getEnvBoolOrDefault("AUTO_INSTALL_LANG_PAIRS", false),
+		LangPairInstallTimeout: getEnvDurationOrDefault("LANG_PAIR_INSTALL_TIMEOUT", 10*time.Minute),
+
+		// Profanity filter settings
+		ProfanityList:               getEnvOrDefault("PROFANITY_LIST", ""),
+		ProfanityPlaceholder:        getEnvOrDefault("PROFANITY_PLACEHOLDER", ""),
+		ProfanityFilterTranslations: getEnvBoolOrDefault("PROFANITY_FILTER_TRANSLATIONS", true),
+
+		// Twitch extension captions
+		TwitchExtensionClientID: getEnvOrDefault("TWITCH_EXTENSION_CLIENT_ID", ""),
+		TwitchExtensionSecret:   getEnvOrDefault("TWITCH_EXTENSION_SECRET", ""),
+		TwitchExtensionOwnerID:  getEnvOrDefault("TWITCH_EXTENSION_OWNER_ID", ""),
+		TwitchBroadcasterID:     getEnvOrDefault("TWITCH_BROADCASTER_ID", ""),
+		TwitchExtensionEndpoint: getEnvOrDefault("TWITCH_EXTENSION_ENDPOINT", "https://api.twitch.tv/helix/extensions/pubsub"),
+
+		// YouTube captions
+		YouTubeCaptionsURL:    getEnvOrDefault("YOUTUBE_CAPTIONS_URL", ""),
+		YouTubeCaptionsOffset: getEnvDurationOrDefault("YOUTUBE_CAPTIONS_OFFSET", 0),
+
+		MaxSinkFailures: getEnvIntOrDefault("SUBTITLE_SINK_MAX_FAILURES", 5),
+
+		// Session upload
+		UploadEndpoint:    getEnvOrDefault("UPLOAD_ENDPOINT", "https://s3.amazonaws.com"),
+		UploadBucket:      getEnvOrDefault("UPLOAD_BUCKET", ""),
+		UploadPrefix:      getEnvOrDefault("UPLOAD_PREFIX", ""),
+		UploadRegion:      getEnvOrDefault("UPLOAD_REGION", "us-east-1"),
+		UploadAccessKey:   getEnvOrDefault("UPLOAD_ACCESS_KEY", ""),
+		UploadSecretKey:   getEnvOrDefault("UPLOAD_SECRET_KEY", ""),
+		UploadPathStyle:   getEnvBoolOrDefault("UPLOAD_PATH_STYLE", true),
+		UploadInterval:    getEnvDurationOrDefault("UPLOAD_INTERVAL", 15*time.Minute),
+		UploadDeleteLocal: getEnvBoolOrDefault("UPLOAD_DELETE_LOCAL", false),
+
+		// MQTT publishing
+		MQTTBroker:      getEnvOrDefault("MQTT_BROKER", ""),
+		MQTTClientID:    getEnvOrDefault("MQTT_CLIENT_ID", "transcription-proxy"),
+		MQTTTopicPrefix: getEnvOrDefault("MQTT_TOPIC_PREFIX", ""),
+		MQTTQoS:         getEnvIntOrDefault("MQTT_QOS", 1),
+		MQTTUsername:    getEnvOrDefault("MQTT_USERNAME", ""),
+		MQTTPassword:    getEnvOrDefault("MQTT_PASSWORD", ""),
+		MQTTTLSCA:       getEnvOrDefault("MQTT_TLS_CA", ""),
+
+		// gRPC service
+		GRPCEnabled: getEnvBoolOrDefault("GRPC_ENABLED", false),
+		GRPCAddress: getEnvOrDefault("GRPC_ADDRESS", ":9090"),
+
+		// Ad-hoc transcription
+		AdhocMaxJobs:       getEnvIntOrDefault("ADHOC_MAX_JOBS", 1),
+		TranscribeMaxBytes: int64(getEnvIntOrDefault("TRANSCRIBE_MAX_UPLOAD_MB", 512)) << 20,
+		TranscribeSyncMax:  getEnvDurationOrDefault("TRANSCRIBE_SYNC_MAX", 2*time.Minute),
+		TranscribeLocalDir: getEnvOrDefault("TRANSCRIBE_LOCAL_DIR", ""),
+		ReprocessMaxJobs:   getEnvIntOrDefault("REPROCESS_MAX_JOBS", 1),
+
+		// Transcription scheduling
+		TranscribeSlots:   getEnvIntOrDefault("TRANSCRIBE_SLOTS", 0),
+		BatchSharePercent: getEnvIntOrDefault("BATCH_SHARE_PERCENT", 0),
 	}
 }
 
+// TranscribeOnly reports whether the proxy should only transcribe the incoming
+// stream without restreaming it, either because it was requested explicitly or
+// because no target URL is configured
+func (c *Config) TranscribeOnly() bool {
+	return c.Mode == ModeTranscribeOnly || strings.TrimSpace(c.DefaultTargetURL) == ""
+}
+
+// Modes are the values MODE accepts
+var Modes = []string{ModeRestream, ModeTranscribeOnly, ModePassthrough}
+
+// Validate checks the settings that must hold one of a fixed set of values,
+// so a typo is reported instead of silently falling back to the default
+func (c *Config) Validate() error {
+	for _, mode := range Modes {
+		if c.Mode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid MODE %q, expected one of %s", c.Mode, strings.Join(Modes, ", "))
+}
+
+// Passthrough reports whether the incoming stream should be relayed to the
+// targets as-is, without transcription, translation, or subtitles
+func (c *Config) Passthrough() bool {
+	return c.Mode == ModePassthrough
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -87,3 +661,41 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvListOrDefault parses a comma-separated list, skipping empty entries
+func getEnvListOrDefault(key, defaultValue string) []string {
+	var values []string
+	for _, entry := range strings.Split(getEnvOrDefault(key, defaultValue), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	return values
+}
+
+// getEnvIntMapOrDefault parses a comma-separated list of key=value pairs with
+// integer values, skipping malformed entries
+func getEnvIntMapOrDefault(key, defaultValue string) map[string]int {
+	values := make(map[string]int)
+	for _, entry := range strings.Split(getEnvOrDefault(key, defaultValue), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		intValue, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		values[strings.ToLower(strings.TrimSpace(name))] = intValue
+	}
+	return values
+}
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
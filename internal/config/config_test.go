@@ -0,0 +1,36 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{ModeRestream, false},
+		{ModeTranscribeOnly, false},
+		{ModePassthrough, false},
+		{"", true},
+		{"transcribe_only", true},
+		{"Restream", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := &Config{Mode: tt.mode}
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				for _, mode := range Modes {
+					if !strings.Contains(err.Error(), mode) {
+						t.Errorf("error %q doesn't list %q", err, mode)
+					}
+				}
+			}
+		})
+	}
+}
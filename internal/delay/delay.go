@@ -0,0 +1,203 @@
+// Package delay holds stream output back for a fixed time before releasing
+// it, so a moderator can intervene before anything goes out. Payloads beyond
+// a memory limit are spilled to disk until they are due.
+package delay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned when pushing to a closed buffer
+var ErrClosed = errors.New("delay buffer closed")
+
+// Buffer releases pushed entries in order once they have been held for the
+// delay. Entries are released one at a time from a single goroutine.
+type Buffer[T any] struct {
+	delay       time.Duration
+	memoryLimit int64
+	dir         string
+	release     func(value T, data []byte)
+	logger      *logrus.Entry
+
+	mu       sync.Mutex
+	entries  []*entry[T]
+	inMemory int64 // Bytes of payload held in memory
+	spilled  int   // Number of payloads written to disk so far, names them
+	closed   bool
+
+	wake      chan struct{}
+	abort     chan struct{}
+	abortOnce sync.Once
+	done      chan struct{}
+}
+
+// entry is a held value and its payload, which is either in data or in the
+// file at path
+type entry[T any] struct {
+	value T
+	data  []byte
+	path  string
+	size  int64
+	due   time.Time
+}
+
+// New creates a buffer calling release for every entry once it has been held
+// for delay. Payloads that would take the memory held above memoryLimit bytes
+// are written to dir instead.
+func New[T any](delay time.Duration, memoryLimit int64, dir string, release func(value T, data []byte), logger *logrus.Entry) *Buffer[T] {
+	b := &Buffer[T]{
+		delay:       delay,
+		memoryLimit: memoryLimit,
+		dir:         dir,
+		release:     release,
+		logger:      logger,
+		wake:        make(chan struct{}, 1),
+		abort:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Push holds value and its payload, which may be nil, for the delay
+func (b *Buffer[T]) Push(value T, data []byte) error {
+	e := &entry[T]{value: value, data: data, size: int64(len(data)), due: time.Now().Add(b.delay)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	if e.size > 0 && b.inMemory+e.size > b.memoryLimit {
+		b.spilled++
+		path := filepath.Join(b.dir, fmt.Sprintf("delayed-%06d.bin", b.spilled))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			// Holding the payload in memory beats losing it
+			b.logger.WithError(err).Warn("Failed to spill delayed data to disk, keeping it in memory")
+		} else {
+			e.data, e.path = nil, path
+		}
+	}
+	if e.path == "" {
+		b.inMemory += e.size
+	}
+
+	b.entries = append(b.entries, e)
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of entries held
+func (b *Buffer[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Close stops accepting entries. The entries still held are released when
+// they are due, after which Done is closed.
+func (b *Buffer[T]) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Abort drops all held entries without releasing them and stops the buffer
+func (b *Buffer[T]) Abort() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	b.abortOnce.Do(func() { close(b.abort) })
+}
+
+// Done is closed once the buffer has stopped
+func (b *Buffer[T]) Done() <-chan struct{} {
+	return b.done
+}
+
+// run releases the entries as they become due
+func (b *Buffer[T]) run() {
+	defer close(b.done)
+	defer b.drop()
+
+	for {
+		b.mu.Lock()
+		if len(b.entries) == 0 {
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return
+			}
+
+			select {
+			case <-b.wake:
+			case <-b.abort:
+				return
+			}
+			continue
+		}
+		head := b.entries[0]
+		b.mu.Unlock()
+
+		if wait := time.Until(head.due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-b.abort:
+				timer.Stop()
+				return
+			}
+		}
+
+		b.mu.Lock()
+		b.entries = b.entries[1:]
+		if head.path == "" {
+			b.inMemory -= head.size
+		}
+		b.mu.Unlock()
+
+		data := head.data
+		if head.path != "" {
+			var err error
+			data, err = os.ReadFile(head.path)
+			os.Remove(head.path)
+			if err != nil {
+				b.logger.WithError(err).Error("Failed to read spilled delayed data, dropping it")
+				continue
+			}
+		}
+		b.release(head.value, data)
+	}
+}
+
+// drop forgets the entries still held, removing their spilled payloads
+func (b *Buffer[T]) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range b.entries {
+		if e.path != "" {
+			os.Remove(e.path)
+		}
+	}
+	b.entries = nil
+	b.inMemory = 0
+}
@@ -0,0 +1,132 @@
+// Package diskspace watches the free space of the filesystem holding the
+// proxy's output so writes can be paused before the disk fills up.
+package diskspace
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Status is a snapshot of the monitored filesystem
+type Status struct {
+	Path         string    `json:"path"`
+	FreeBytes    uint64    `json:"free_bytes"`
+	MinFreeBytes uint64    `json:"min_free_bytes"`
+	Low          bool      `json:"low"`
+	CheckedAt    time.Time `json:"checked_at"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Monitor periodically checks free space and reports when it drops below
+// the configured minimum
+type Monitor struct {
+	path         string
+	minFreeBytes uint64
+	interval     time.Duration
+	logger       *logrus.Logger
+
+	mu     sync.RWMutex
+	status Status
+}
+
+// NewMonitor creates a monitor for the filesystem containing path
+func NewMonitor(path string, minFreeMB int, interval time.Duration, logger *logrus.Logger) *Monitor {
+	minFreeBytes := uint64(0)
+	if minFreeMB > 0 {
+		minFreeBytes = uint64(minFreeMB) * 1024 * 1024
+	}
+
+	return &Monitor{
+		path:         path,
+		minFreeBytes: minFreeBytes,
+		interval:     interval,
+		logger:       logger,
+		status: Status{
+			Path:         path,
+			MinFreeBytes: minFreeBytes,
+		},
+	}
+}
+
+// Run checks free space every interval until stop is closed
+func (m *Monitor) Run(stop <-chan struct{}) {
+	m.Check()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// Check measures free space now and updates the status
+func (m *Monitor) Check() Status {
+	free, err := FreeBytes(m.path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wasLow := m.status.Low
+	m.status.CheckedAt = time.Now()
+
+	if err != nil {
+		// Keep the previous low flag; a failed check says nothing about space
+		m.status.Error = err.Error()
+		m.logger.WithError(err).WithField("path", m.path).Warn("Failed to check free disk space")
+		return m.status
+	}
+
+	m.status.Error = ""
+	m.status.FreeBytes = free
+	m.status.Low = m.minFreeBytes > 0 && free < m.minFreeBytes
+
+	fields := logrus.Fields{
+		"path":        m.path,
+		"free_mb":     free / 1024 / 1024,
+		"min_free_mb": m.minFreeBytes / 1024 / 1024,
+	}
+
+	switch {
+	case m.status.Low:
+		// Repeat the warning on every check while space stays low
+		m.logger.WithFields(fields).Error("LOW DISK SPACE: transcript and recording writes are paused until space is freed")
+	case wasLow:
+		m.logger.WithFields(fields).Warn("Disk space recovered, resuming transcript and recording writes")
+	}
+
+	return m.status
+}
+
+// Low reports whether free space was below the minimum at the last check
+func (m *Monitor) Low() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status.Low
+}
+
+// Status returns the result of the last check
+func (m *Monitor) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// FreeBytes returns the space available to unprivileged users on the
+// filesystem containing path
+func FreeBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem at %s: %w", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
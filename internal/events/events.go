@@ -0,0 +1,278 @@
+// Package events distributes captions and stream lifecycle events from the
+// pipeline to publishers outside the media path. Publishing never blocks: a
+// subscriber that falls behind loses its oldest events.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event kinds
+const (
+	KindCaption       = "caption"
+	KindStreamStarted = "stream_started"
+	KindStreamEnded   = "stream_ended"
+	// KindPipelineDegraded is published once per session when the stream
+	// keeps arriving in chunks too small to transcribe
+	KindPipelineDegraded = "pipeline_degraded"
+	// KindProcessExited is published when a child process like FFmpeg exits
+	// without being asked to
+	KindProcessExited = "process_exited"
+	// KindTargetFailed is published when a restream target fails to start
+	// often enough, or rejects its key, that it isn't retried for a while
+	KindTargetFailed = "target_failed"
+)
+
+// ProcessExit describes a child process that exited unexpectedly
+type ProcessExit struct {
+	Role     string `json:"role"`
+	PID      int    `json:"pid"`
+	ExitCode int    `json:"exit_code"`        // -1 if killed by a signal
+	Stderr   string `json:"stderr,omitempty"` // The end of its output, if captured
+}
+
+// TargetFailure describes a restream target whose circuit breaker opened
+type TargetFailure struct {
+	ID       int    `json:"id"`
+	Target   string `json:"target"` // Credentials are redacted
+	Failures int    `json:"failures"`
+	Error    string `json:"error"`
+}
+
+// Caption is a finalized caption. Times are relative to the start of the
+// stream, in seconds.
+type Caption struct {
+	Chunk int     `json:"chunk"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+	Lang  string  `json:"lang"`
+	// DetectedLang is the language Whisper detected the speech in, which may
+	// differ from the source language when the speaker switches languages
+	DetectedLang string `json:"detected_lang,omitempty"`
+	// Speaker labels who is speaking, e.g. S1, if speaker changes are
+	// detected
+	Speaker string `json:"speaker,omitempty"`
+	// Translations holds the caption in the other languages of the stream,
+	// if it is translated into several, by language
+	Translations map[string]string `json:"translations,omitempty"`
+	// Original is the caption before translation in OriginalLang, both empty
+	// if it wasn't translated
+	Original     string `json:"original,omitempty"`
+	OriginalLang string `json:"original_lang,omitempty"`
+}
+
+// LangOriginal selects the text of a caption before translation, whatever
+// language it is in
+const LangOriginal = "original"
+
+// In returns the text of the caption in lang, or before translation for
+// LangOriginal, and whether the caption has it
+func (c *Caption) In(lang string) (string, bool) {
+	switch {
+	case lang == LangOriginal && c.OriginalLang != "":
+		return c.Original, true
+	case lang == LangOriginal || lang == c.Lang:
+		return c.Text, true
+	case lang == c.OriginalLang:
+		return c.Original, true
+	}
+	text, ok := c.Translations[lang]
+	return text, ok
+}
+
+// Only returns a copy of the caption with nothing but its text in lang, or
+// before translation for LangOriginal, and whether the caption has it
+func (c *Caption) Only(lang string) (*Caption, bool) {
+	text, ok := c.In(lang)
+	if !ok {
+		return nil, false
+	}
+	only := *c
+	only.Text = text
+	switch {
+	case lang != LangOriginal:
+		only.Lang = lang
+	case c.OriginalLang != "":
+		only.Lang = c.OriginalLang
+	}
+	only.Translations = nil
+	only.Original = ""
+	only.OriginalLang = ""
+	return &only, true
+}
+
+// Event is a single caption or lifecycle event of a stream session
+type Event struct {
+	Kind      string         `json:"kind"`
+	Session   string         `json:"session"`
+	StreamKey string         `json:"stream_key"`
+	Time      time.Time      `json:"time"`
+	Caption   *Caption       `json:"caption,omitempty"` // Set for KindCaption
+	Process   *ProcessExit   `json:"process,omitempty"` // Set for KindProcessExited
+	Target    *TargetFailure `json:"target,omitempty"`  // Set for KindTargetFailed
+	Reason    string         `json:"reason,omitempty"`  // Why the proxy ended the stream, for KindStreamEnded, or why it is degraded
+}
+
+// Bus hands published events to every subscriber, and keeps the latest
+// captions of the current stream for subscribers that join late
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+
+	// history is a ring of the last captions, oldest at next once full
+	history     []Event
+	historySize int
+	next        int
+}
+
+// NewBus creates a bus without subscribers that keeps up to history captions
+// for SubscribeReplay
+func NewBus(history int) *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]struct{}),
+		historySize: max(history, 0),
+	}
+}
+
+// Subscription receives the events published after it was created on C,
+// which is closed when the subscription or the bus is closed
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	done    chan struct{}
+	bus     *Bus
+	dropped atomic.Int64
+}
+
+// Subscribe creates a subscription buffering up to buffer events
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(buffer)
+}
+
+// SubscribeReplay creates a subscription like Subscribe, and returns the
+// captions of the current stream kept from before it, oldest first. No
+// caption is missed or returned twice between the two.
+func (b *Bus) SubscribeReplay(buffer int) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := make([]Event, 0, len(b.history))
+	history = append(history, b.history[b.next:]...)
+	history = append(history, b.history[:b.next]...)
+	return b.subscribe(buffer), history
+}
+
+// subscribe creates a subscription; the caller must hold the bus lock
+func (b *Bus) subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, done: make(chan struct{}), bus: b}
+
+	if b.closed {
+		sub.close()
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// remember keeps captions in the history, which starts over with every
+// stream; the caller must hold the bus lock
+func (b *Bus) remember(event Event) {
+	switch {
+	case event.Kind == KindStreamStarted:
+		b.history, b.next = b.history[:0], 0
+	case event.Kind != KindCaption || b.historySize == 0:
+	case len(b.history) < b.historySize:
+		b.history = append(b.history, event)
+	default:
+		b.history[b.next] = event
+		b.next = (b.next + 1) % b.historySize
+	}
+}
+
+// Publish hands event to every subscriber, dropping the oldest buffered event
+// of subscribers whose buffer is full
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remember(event)
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+			continue
+		default:
+		}
+
+		// Make room by dropping the oldest event, unless the subscriber
+		// just took it
+		select {
+		case <-sub.ch:
+			sub.dropped.Add(1)
+		default:
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Close closes all subscriptions; later subscriptions are closed right away
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subscribers {
+		sub.close()
+		delete(b.subscribers, sub)
+	}
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		s.close()
+		delete(s.bus.subscribers, s)
+	}
+}
+
+// close closes the channels of the subscription; the caller must hold the
+// bus lock
+func (s *Subscription) close() {
+	close(s.ch)
+	close(s.done)
+}
+
+// Closed returns a channel that is closed along with the subscription, for
+// subscribers that need to notice it while not receiving events
+func (s *Subscription) Closed() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns how many events the subscriber lost by falling behind
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+)
+
+// caption returns a caption event for chunk
+func caption(chunk int) Event {
+	return Event{Kind: KindCaption, Caption: &Caption{Chunk: chunk}}
+}
+
+// chunks returns the chunks of caption events
+func chunks(events []Event) []int {
+	out := []int{}
+	for _, event := range events {
+		out = append(out, event.Caption.Chunk)
+	}
+	return out
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		history int
+		publish []Event
+		want    []int
+	}{
+		{"nothing published", 3, nil, []int{}},
+		{"fewer than kept", 3, []Event{caption(1), caption(2)}, []int{1, 2}},
+		{"oldest dropped", 3, []Event{caption(1), caption(2), caption(3), caption(4), caption(5)}, []int{3, 4, 5}},
+		{"only captions kept", 3, []Event{caption(1), {Kind: KindProcessExited}, caption(2)}, []int{1, 2}},
+		{"new stream starts over", 3, []Event{caption(1), caption(2), {Kind: KindStreamStarted}, caption(3)}, []int{3}},
+		{"history disabled", 0, []Event{caption(1)}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewBus(tt.history)
+			for _, event := range tt.publish {
+				bus.Publish(event)
+			}
+			sub, history := bus.SubscribeReplay(10)
+			defer sub.Close()
+			if got := chunks(history); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("history = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeReplayContinuesLive(t *testing.T) {
+	bus := NewBus(2)
+	bus.Publish(caption(1))
+	bus.Publish(caption(2))
+
+	sub, history := bus.SubscribeReplay(10)
+	defer sub.Close()
+	bus.Publish(caption(3))
+
+	// The live captions pick up where the history ends
+	got := append(chunks(history), (<-sub.C).Caption.Chunk)
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	select {
+	case event := <-sub.C:
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestPublishDropsOldest(t *testing.T) {
+	bus := NewBus(0)
+	sub := bus.Subscribe(2)
+	defer sub.Close()
+
+	for chunk := 1; chunk <= 4; chunk++ {
+		bus.Publish(caption(chunk))
+	}
+	got := chunks([]Event{<-sub.C, <-sub.C})
+	if want := []int{3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", sub.Dropped())
+	}
+}
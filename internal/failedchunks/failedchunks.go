@@ -0,0 +1,112 @@
+// Package failedchunks keeps the chunks that failed transcription or
+// embedding after all retries, so the failure can be reproduced. Every chunk
+// gets a directory failed/chunk-<n>/ in the session directory with its audio
+// as WAV, its video fragment, the captions and subtitles that were embedded,
+// and the arguments and output of the command that failed.
+package failedchunks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/procs"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// Dir is the directory of the failed chunks in the session directory
+const Dir = "failed"
+
+// Stages a chunk can fail in
+const (
+	StageTranscription = "transcription"
+	StageEmbedding     = "embedding"
+)
+
+// ErrLimit is returned by Save once the most chunks have been saved
+var ErrLimit = errors.New("too many failed chunks saved")
+
+// Chunk is a chunk that failed
+type Chunk struct {
+	Index  int
+	Stage  string
+	Err    error
+	Audio  []byte // PCM
+	Format audio.Format
+	Video  []byte // FLV fragment, nil without video
+	// Captions are the chunk-relative captions given to the embedder
+	Captions []transcriber.Segment
+}
+
+// Saver saves the failed chunks of a session
+type Saver struct {
+	dir string
+	max int
+
+	mu    sync.Mutex
+	saved int
+}
+
+// New creates a saver writing to the session directory dir, at most max
+// chunks
+func New(dir string, max int) *Saver {
+	return &Saver{dir: dir, max: max}
+}
+
+// Save writes chunk to its directory and returns the directory relative to
+// the session directory
+func (s *Saver) Save(chunk Chunk) (string, error) {
+	s.mu.Lock()
+	if s.saved >= s.max {
+		s.mu.Unlock()
+		return "", ErrLimit
+	}
+	s.saved++
+	s.mu.Unlock()
+
+	name := filepath.Join(Dir, "chunk-"+strconv.Itoa(chunk.Index))
+	dir := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create failed chunk directory: %w", err)
+	}
+
+	files := map[string][]byte{
+		"error.txt": []byte(chunk.Stage + ": " + chunk.Err.Error() + "\n"),
+		"audio.wav": audio.EncodeWAV(chunk.Audio, chunk.Format.SampleRate, chunk.Format.Channels, chunk.Format.BitsPerSample),
+	}
+	if len(chunk.Video) > 0 {
+		files["video.flv"] = chunk.Video
+	}
+	if len(chunk.Captions) > 0 {
+		captions, err := json.MarshalIndent(chunk.Captions, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to encode captions: %w", err)
+		}
+		files["captions.json"] = captions
+	}
+
+	var command *procs.CommandError
+	if errors.As(chunk.Err, &command) {
+		args, err := json.MarshalIndent(command.Args, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to encode command: %w", err)
+		}
+		files["args.json"] = args
+		files["stderr.txt"] = []byte(command.Stderr)
+		for input, data := range command.Inputs {
+			files[filepath.Base(input)] = data
+		}
+	}
+
+	for file, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	return name, nil
+}
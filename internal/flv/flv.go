@@ -0,0 +1,907 @@
+// Package flv reads and writes the FLV container used between the FFmpeg
+// listener, the subtitle embedder, and the streaming targets. It only
+// understands as much of FLV as needed to cut a stream into fragments that
+// start with a keyframe: the file header, tag headers, timestamps, the
+// keyframe and sequence header flags of audio and video tags, and the AMF0
+// values of the stream metadata.
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/bufpool"
+)
+
+// Tag types
+const (
+	TagAudio  byte = 8
+	TagVideo  byte = 9
+	TagScript byte = 18
+)
+
+// Codec IDs with sequence headers
+const (
+	soundFormatAAC = 10
+	videoCodecAVC  = 7
+	videoCodecHEVC = 12 // As used by FFmpeg's legacy FLV HEVC extension
+)
+
+// Codec names returned by Tag.Codec, as FFmpeg names them
+const (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+	CodecVP9  = "vp9"
+	CodecAAC  = "aac"
+	CodecMP3  = "mp3"
+	CodecOpus = "opus"
+)
+
+// videoCodecNames and soundFormatNames name the legacy FLV codec IDs
+var (
+	videoCodecNames = map[byte]string{
+		2:              "flv1",
+		4:              "vp6f",
+		5:              "vp6a",
+		videoCodecAVC:  CodecH264,
+		videoCodecHEVC: CodecHEVC,
+	}
+	soundFormatNames = map[byte]string{
+		0:              "pcm",
+		2:              CodecMP3,
+		3:              "pcm",
+		7:              "pcm_alaw",
+		8:              "pcm_mulaw",
+		soundFormatAAC: CodecAAC,
+		11:             "speex",
+		14:             CodecMP3,
+	}
+)
+
+// fourCCNames names the codecs of enhanced RTMP tags
+var fourCCNames = map[string]string{
+	"avc1": CodecH264,
+	"hvc1": CodecHEVC,
+	"av01": CodecAV1,
+	"vp09": CodecVP9,
+	"mp4a": CodecAAC,
+	".mp3": CodecMP3,
+	"Opus": CodecOpus,
+	"fLaC": "flac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+}
+
+// soundFormatExHeader marks enhanced RTMP audio tags, which carry a FourCC
+const soundFormatExHeader = 9
+
+// enhancedVideoFlag marks enhanced RTMP video tags, whose packet type is in
+// the low nibble of the first byte
+const enhancedVideoFlag = 0x80
+
+// headerSize is the size of the FLV file header
+const headerSize = 9
+
+// FileHeaderSize is the size of what WriteHeader writes: the file header
+// and the first previous tag size
+const FileHeaderSize = headerSize + 4
+
+// tagHeaderSize is the size of the header before the data of each tag
+const tagHeaderSize = 11
+
+// tagSize is the size of a written tag, including its previous tag size
+func tagSize(tag Tag) int {
+	return tagHeaderSize + len(tag.Data) + 4
+}
+
+// maxTagDataSize bounds the data size read from a tag header
+const maxTagDataSize = 1<<24 - 1
+
+// ErrInvalidHeader is returned when a stream doesn't start with an FLV header
+var ErrInvalidHeader = errors.New("invalid FLV header")
+
+// ErrInvalidMetadata is returned for script tags that aren't AMF0 onMetaData
+var ErrInvalidMetadata = errors.New("invalid FLV metadata")
+
+// AMF0 type markers of the values in script tags
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+)
+
+// maxAMFDepth bounds how deeply AMF0 objects may nest
+const maxAMFDepth = 16
+
+// Header is the FLV file header
+type Header struct {
+	HasAudio bool
+	HasVideo bool
+}
+
+// Tag is a single FLV tag
+type Tag struct {
+	Type      byte
+	Timestamp uint32 // Milliseconds
+	StreamID  uint32
+	Data      []byte
+}
+
+// Time returns the timestamp of the tag
+func (t Tag) Time() time.Duration {
+	return time.Duration(t.Timestamp) * time.Millisecond
+}
+
+// IsKeyframe reports whether the tag is a video keyframe
+func (t Tag) IsKeyframe() bool {
+	return t.Type == TagVideo && len(t.Data) > 0 && (t.Data[0]>>4)&0x07 == 1
+}
+
+// IsSequenceHeader reports whether the tag carries the decoder configuration
+// of an AVC/HEVC video or AAC audio stream
+func (t Tag) IsSequenceHeader() bool {
+	if len(t.Data) < 2 {
+		return false
+	}
+
+	switch t.Type {
+	case TagVideo:
+		if t.Data[0]&enhancedVideoFlag != 0 {
+			return t.Data[0]&0x0F == 0
+		}
+		codec := t.Data[0] & 0x0F
+		return (codec == videoCodecAVC || codec == videoCodecHEVC) && t.Data[1] == 0
+	case TagAudio:
+		return t.Data[0]>>4 == soundFormatAAC && t.Data[1] == 0
+	default:
+		return false
+	}
+}
+
+// Codec returns the name of the codec of an audio or video tag, or an empty
+// string if the tag doesn't say
+func (t Tag) Codec() string {
+	if len(t.Data) == 0 {
+		return ""
+	}
+
+	switch t.Type {
+	case TagVideo:
+		if t.Data[0]&enhancedVideoFlag != 0 {
+			return fourCCName(t.Data[1:])
+		}
+		codec := t.Data[0] & 0x0F
+		if name, ok := videoCodecNames[codec]; ok {
+			return name
+		}
+		return fmt.Sprintf("video codec %d", codec)
+	case TagAudio:
+		format := t.Data[0] >> 4
+		if format == soundFormatExHeader {
+			return fourCCName(t.Data[1:])
+		}
+		if name, ok := soundFormatNames[format]; ok {
+			return name
+		}
+		return fmt.Sprintf("sound format %d", format)
+	default:
+		return ""
+	}
+}
+
+// fourCCName names the codec of the FourCC at the start of data
+func fourCCName(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	fourCC := string(data[:4])
+	if name, ok := fourCCNames[fourCC]; ok {
+		return name
+	}
+	return fmt.Sprintf("%q", fourCC)
+}
+
+// Reader reads the tags of an FLV stream
+type Reader struct {
+	r      io.Reader
+	Header Header
+}
+
+// NewReader reads the FLV header of r and returns a reader for its tags
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read FLV header: %w", err)
+	}
+	if string(header[0:3]) != "FLV" {
+		return nil, ErrInvalidHeader
+	}
+
+	// Skip any header extension and the first previous tag size
+	dataOffset := binary.BigEndian.Uint32(header[5:9])
+	if dataOffset < headerSize {
+		return nil, ErrInvalidHeader
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(dataOffset-headerSize)+4); err != nil {
+		return nil, fmt.Errorf("failed to read FLV header: %w", err)
+	}
+
+	return &Reader{
+		r: r,
+		Header: Header{
+			HasAudio: header[4]&0x04 != 0,
+			HasVideo: header[4]&0x01 != 0,
+		},
+	}, nil
+}
+
+// ReadTag reads the next tag. It returns io.EOF at the end of the stream.
+func (r *Reader) ReadTag() (Tag, error) {
+	var header [tagHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Tag{}, fmt.Errorf("truncated FLV tag header: %w", err)
+		}
+		return Tag{}, err
+	}
+
+	size := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+	if size > maxTagDataSize {
+		return Tag{}, fmt.Errorf("FLV tag too large: %d bytes", size)
+	}
+
+	tag := Tag{
+		Type:      header[0] & 0x1F,
+		Timestamp: uint32(header[7])<<24 | uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6]),
+		StreamID:  uint32(header[8])<<16 | uint32(header[9])<<8 | uint32(header[10]),
+		Data:      make([]byte, size),
+	}
+
+	// Read the data and the previous tag size that follows it
+	if _, err := io.ReadFull(r.r, tag.Data); err != nil {
+		return Tag{}, fmt.Errorf("truncated FLV tag: %w", err)
+	}
+	var prevSize [4]byte
+	if _, err := io.ReadFull(r.r, prevSize[:]); err != nil && !errors.Is(err, io.EOF) {
+		return Tag{}, fmt.Errorf("truncated FLV tag: %w", err)
+	}
+
+	return tag, nil
+}
+
+// Duration reads an FLV stream to its end and returns the time between its
+// first and last audio or video tag
+func Duration(r io.Reader) (time.Duration, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var first, last time.Duration
+	seen := false
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if tag.Type != TagAudio && tag.Type != TagVideo {
+			continue
+		}
+		if !seen {
+			first, seen = tag.Time(), true
+		}
+		last = max(last, tag.Time())
+	}
+
+	return last - first, nil
+}
+
+// WriteHeader writes an FLV file header and the first previous tag size
+func WriteHeader(w io.Writer, header Header) error {
+	flags := byte(0)
+	if header.HasAudio {
+		flags |= 0x04
+	}
+	if header.HasVideo {
+		flags |= 0x01
+	}
+
+	_, err := w.Write([]byte{'F', 'L', 'V', 1, flags, 0, 0, 0, headerSize, 0, 0, 0, 0})
+	return err
+}
+
+// WriteTag writes a tag followed by its previous tag size
+func WriteTag(w io.Writer, tag Tag) error {
+	size := len(tag.Data)
+	header := []byte{
+		tag.Type,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(tag.Timestamp >> 16), byte(tag.Timestamp >> 8), byte(tag.Timestamp), byte(tag.Timestamp >> 24),
+		byte(tag.StreamID >> 16), byte(tag.StreamID >> 8), byte(tag.StreamID),
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(tag.Data); err != nil {
+		return err
+	}
+
+	var prevSize [4]byte
+	binary.BigEndian.PutUint32(prevSize[:], uint32(tagHeaderSize+size))
+	_, err := w.Write(prevSize[:])
+	return err
+}
+
+// Fragment is a self-contained piece of an FLV stream: a file header, the
+// stream metadata and sequence headers, and tags starting with a keyframe
+type Fragment struct {
+	Data      []byte
+	Start     time.Duration // Timestamp of the first tag after the sequence headers
+	VideoTags int           // Video tags in the fragment, not counting the repeated sequence header
+}
+
+// Segmenter collects the tags of a stream and cuts them into fragments at
+// keyframes. It is safe for concurrent use.
+type Segmenter struct {
+	mu     sync.Mutex
+	header Header
+
+	// metadata and the sequence headers are repeated at the start of every
+	// fragment so each can be decoded on its own
+	metadata       *Tag
+	videoSeqHeader *Tag
+	audioSeqHeader *Tag
+
+	// pending holds the tags since the last cut, starting with a keyframe.
+	// Tags before the first keyframe can't be decoded and are dropped.
+	pending []Tag
+
+	// lastTime is the latest timestamp added, if any tag has been
+	lastTime time.Duration
+	hasTime  bool
+}
+
+// NewSegmenter creates a segmenter for a stream with the given header
+func NewSegmenter(header Header) *Segmenter {
+	return &Segmenter{header: header}
+}
+
+// SetHeader sets the header written at the start of every fragment
+func (s *Segmenter) SetHeader(header Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = header
+}
+
+// Add adds the next tag of the stream
+func (s *Segmenter) Add(tag Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tag.Type != TagScript && (!s.hasTime || tag.Time() > s.lastTime) {
+		s.lastTime = tag.Time()
+		s.hasTime = true
+	}
+
+	switch {
+	case tag.Type == TagScript:
+		s.metadata = &tag
+	case tag.IsSequenceHeader() && tag.Type == TagVideo:
+		s.videoSeqHeader = &tag
+	case tag.IsSequenceHeader() && tag.Type == TagAudio:
+		s.audioSeqHeader = &tag
+	case len(s.pending) == 0 && !s.isCutPoint(tag):
+		// Wait for the first keyframe
+	default:
+		s.pending = append(s.pending, tag)
+	}
+}
+
+// Metadata returns the latest metadata tag of the stream, and false if it
+// had none so far
+func (s *Segmenter) Metadata() (Tag, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.metadata == nil {
+		return Tag{}, false
+	}
+	return *s.metadata, true
+}
+
+// LastTime returns the latest timestamp of the stream added so far, and false
+// if no audio or video tag has been added yet
+func (s *Segmenter) LastTime() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastTime, s.hasTime
+}
+
+// Cut returns a fragment with the pending tags before the last keyframe at or
+// before until, keeping that keyframe and everything after it for the next
+// fragment. It returns an empty fragment if there is no such keyframe. In a
+// stream without video, the fragment is cut at the last audio tag instead.
+func (s *Segmenter) Cut(until time.Duration) Fragment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cut := 0
+	for i := 1; i < len(s.pending); i++ {
+		if s.pending[i].Time() > until {
+			break
+		}
+		if s.isCutPoint(s.pending[i]) {
+			cut = i
+		}
+	}
+
+	return s.take(cut)
+}
+
+// isCutPoint reports whether a fragment can start with tag: a video keyframe
+// or, in a stream without video, any audio tag. It expects s.mu to be held.
+func (s *Segmenter) isCutPoint(tag Tag) bool {
+	if !s.header.HasVideo {
+		return tag.Type == TagAudio
+	}
+	return tag.IsKeyframe()
+}
+
+// Flush returns a fragment with all pending tags
+func (s *Segmenter) Flush() Fragment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.take(len(s.pending))
+}
+
+// take removes the first n pending tags and returns them as a fragment. It
+// expects s.mu to be held.
+func (s *Segmenter) take(n int) Fragment {
+	if n == 0 {
+		return Fragment{}
+	}
+
+	tags := s.pending[:n]
+	s.pending = append([]Tag(nil), s.pending[n:]...)
+
+	headers := []*Tag{s.metadata, s.videoSeqHeader, s.audioSeqHeader}
+	size := FileHeaderSize
+	for _, tag := range headers {
+		if tag != nil {
+			size += tagSize(*tag)
+		}
+	}
+	for _, tag := range tags {
+		size += tagSize(tag)
+	}
+
+	buf := bytes.NewBuffer(bufpool.Video.Get(size)[:0])
+	WriteHeader(buf, s.header)
+	for _, tag := range headers {
+		if tag != nil {
+			header := *tag
+			header.Timestamp = tags[0].Timestamp
+			WriteTag(buf, header)
+		}
+	}
+	videoTags := 0
+	for _, tag := range tags {
+		WriteTag(buf, tag)
+		if tag.Type == TagVideo {
+			videoTags++
+		}
+	}
+
+	return Fragment{Data: buf.Bytes(), Start: tags[0].Time(), VideoTags: videoTags}
+}
+
+// Concatenator joins independently muxed FLV fragments into one continuous
+// stream. The file header, metadata, and sequence headers are only sent once,
+// in the preamble; sequence headers are re-sent inline only when the codec
+// configuration changes. Tag timestamps are rewritten to continue
+// monotonically from the previous fragment.
+type Concatenator struct {
+	header     Header
+	metadata   *Tag
+	seqHeaders map[byte]*Tag
+	started    bool
+	lastTime   uint32
+}
+
+// NewConcatenator creates an empty concatenator
+func NewConcatenator() *Concatenator {
+	return &Concatenator{seqHeaders: make(map[byte]*Tag)}
+}
+
+// Next rewrites a complete FLV fragment that starts at start on the stream
+// timeline so it continues the stream. The result has no file header and
+// must follow the preamble.
+func (c *Concatenator) Next(fragment []byte, start time.Duration) ([]byte, error) {
+	reader, err := NewReader(bytes.NewReader(fragment))
+	if err != nil {
+		return nil, err
+	}
+	if !c.started {
+		c.header = reader.Header
+	}
+
+	// The rewritten tags are never larger than the fragment
+	out := bytes.NewBuffer(bufpool.Video.Get(len(fragment))[:0])
+	var base int64 = -1
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if tag.Type == TagScript {
+			if c.metadata == nil {
+				c.metadata = &tag
+			}
+			continue
+		}
+
+		// Timestamps are relative to the first tag of the fragment
+		if base < 0 {
+			base = int64(tag.Timestamp)
+		}
+		timestamp := start.Milliseconds() + int64(tag.Timestamp) - base
+		if timestamp < int64(c.lastTime) {
+			timestamp = int64(c.lastTime)
+		}
+		tag.Timestamp = uint32(timestamp)
+		c.lastTime = tag.Timestamp
+
+		if tag.IsSequenceHeader() {
+			previous := c.seqHeaders[tag.Type]
+			if previous != nil && bytes.Equal(previous.Data, tag.Data) {
+				continue
+			}
+			stored := tag
+			c.seqHeaders[tag.Type] = &stored
+
+			// The first sequence headers go out with the preamble
+			if !c.started {
+				continue
+			}
+		}
+
+		if err := WriteTag(out, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	c.started = true
+	return out.Bytes(), nil
+}
+
+// SetMetadata sets the metadata tag sent in the preamble, instead of the
+// first one found in the fragments
+func (c *Concatenator) SetMetadata(tag Tag) {
+	c.metadata = &tag
+}
+
+// Preamble returns the file header, metadata, and current sequence headers
+// a receiver needs before the output of Next
+func (c *Concatenator) Preamble() []byte {
+	return preamble(c.header, c.metadata, c.seqHeaders)
+}
+
+// StreamHeaders keeps what a receiver joining a stream part way through needs
+// before its tags: the file header, the latest metadata, and the current
+// sequence headers of the stream
+type StreamHeaders struct {
+	header     Header
+	metadata   *Tag
+	seqHeaders map[byte]*Tag
+}
+
+// NewStreamHeaders creates the headers of a stream with the given file header
+func NewStreamHeaders(header Header) *StreamHeaders {
+	return &StreamHeaders{header: header, seqHeaders: make(map[byte]*Tag)}
+}
+
+// Add keeps tag if it is metadata or a sequence header, reporting whether it
+// changed the preamble
+func (h *StreamHeaders) Add(tag Tag) bool {
+	switch {
+	case tag.Type == TagScript:
+		if h.metadata != nil && bytes.Equal(h.metadata.Data, tag.Data) {
+			return false
+		}
+		h.metadata = &tag
+	case tag.IsSequenceHeader():
+		if previous := h.seqHeaders[tag.Type]; previous != nil && bytes.Equal(previous.Data, tag.Data) {
+			return false
+		}
+		h.seqHeaders[tag.Type] = &tag
+	default:
+		return false
+	}
+	return true
+}
+
+// Joinable reports whether a receiver that got the preamble can start
+// decoding at tag: a video keyframe or, in a stream without video, any audio
+// tag
+func (h *StreamHeaders) Joinable(tag Tag) bool {
+	if !h.header.HasVideo {
+		return tag.Type == TagAudio
+	}
+	return tag.IsKeyframe()
+}
+
+// Preamble returns the file header, metadata, and sequence headers kept so
+// far
+func (h *StreamHeaders) Preamble() []byte {
+	return preamble(h.header, h.metadata, h.seqHeaders)
+}
+
+// preamble writes the file header, the metadata at time 0, and the sequence
+// headers
+func preamble(header Header, metadata *Tag, seqHeaders map[byte]*Tag) []byte {
+	var out bytes.Buffer
+	WriteHeader(&out, header)
+
+	if metadata != nil {
+		metadata := *metadata
+		metadata.Timestamp = 0
+		WriteTag(&out, metadata)
+	}
+	for _, tagType := range []byte{TagVideo, TagAudio} {
+		if tag := seqHeaders[tagType]; tag != nil {
+			WriteTag(&out, *tag)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// Splicer joins FLV streams read one after another into a single stream: the
+// file header is only written for the first, and the tags of every later
+// stream are shifted to continue after those written before
+type Splicer struct {
+	w       io.Writer
+	buf     bytes.Buffer
+	started bool  // File header written
+	next    int64 // Timestamp after the last audio or video tag written
+}
+
+// NewSplicer creates a splicer writing the joined stream to w
+func NewSplicer(w io.Writer) *Splicer {
+	return &Splicer{w: w}
+}
+
+// Append copies the stream read from r until it ends. The first stream keeps
+// its timestamps, every later one starts at start, or right after the last
+// tag written if that is later. A stream ending before its file header adds
+// nothing and doesn't count as the first.
+func (s *Splicer) Append(r io.Reader, start time.Duration) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	first := !s.started
+	if first {
+		if err := WriteHeader(s.w, reader.Header); err != nil {
+			return err
+		}
+		s.started = true
+	}
+
+	// The shift is known from the first audio or video tag, metadata before
+	// it goes out at the start of the stream
+	base := max(start.Milliseconds(), s.next)
+	var shift int64
+	shifted := first
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		timestamp := int64(tag.Timestamp)
+		switch {
+		case shifted:
+			timestamp += shift
+		case tag.Type == TagScript:
+			timestamp = base
+		default:
+			shift, shifted = base-timestamp, true
+			timestamp = base
+		}
+		tag.Timestamp = uint32(max(timestamp, 0))
+		if tag.Type != TagScript {
+			s.next = max(s.next, int64(tag.Timestamp)+1)
+		}
+
+		s.buf.Reset()
+		WriteTag(&s.buf, tag)
+		if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// ParseMetadata decodes the onMetaData script tag of a stream into its
+// properties, such as width, framerate, and encoder. Numbers are float64,
+// dates time.Time, and nested objects maps; NaN and infinities are nil.
+func ParseMetadata(tag Tag) (map[string]any, error) {
+	if tag.Type != TagScript {
+		return nil, fmt.Errorf("%w: tag type %d", ErrInvalidMetadata, tag.Type)
+	}
+
+	r := bytes.NewReader(tag.Data)
+	name, err := readAMFValue(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Publishers send @setDataFrame ahead of the name, which FFmpeg strips
+	if name == "@setDataFrame" {
+		if name, err = readAMFValue(r, 0); err != nil {
+			return nil, err
+		}
+	}
+	if name != "onMetaData" {
+		return nil, fmt.Errorf("%w: script tag %v", ErrInvalidMetadata, name)
+	}
+
+	value, err := readAMFValue(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	properties, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: onMetaData is not an object", ErrInvalidMetadata)
+	}
+	return properties, nil
+}
+
+// readAMFValue reads one AMF0 value
+func readAMFValue(r *bytes.Reader, depth int) (any, error) {
+	if depth > maxAMFDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrInvalidMetadata)
+	}
+
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		// NaN and infinities can't be stored as JSON
+		number := math.Float64frombits(bits)
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, nil
+		}
+		return number, nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		return b != 0, nil
+	case amfString:
+		return readAMFString(r, 2)
+	case amfLongString:
+		return readAMFString(r, 4)
+	case amfNull, amfUndefined:
+		return nil, nil
+	case amfECMAArray:
+		// The count is only a hint, the properties end like an object's
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		return readAMFObject(r, depth)
+	case amfObject:
+		return readAMFObject(r, depth)
+	case amfStrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		if int64(count) > int64(r.Len()) {
+			return nil, fmt.Errorf("%w: array longer than the tag", ErrInvalidMetadata)
+		}
+		values := make([]any, 0, count)
+		for i := uint32(0); i < count; i++ {
+			value, err := readAMFValue(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case amfDate:
+		var date struct {
+			Millis   uint64
+			TimeZone int16 // Unused, dates are UTC
+		}
+		if err := binary.Read(r, binary.BigEndian, &date); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		return time.UnixMilli(int64(math.Float64frombits(date.Millis))).UTC(), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported AMF0 type %#x", ErrInvalidMetadata, marker)
+	}
+}
+
+// readAMFString reads an AMF0 string with a length of lengthSize bytes
+func readAMFString(r *bytes.Reader, lengthSize int) (string, error) {
+	var length uint32
+	if lengthSize == 2 {
+		var short uint16
+		if err := binary.Read(r, binary.BigEndian, &short); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+		}
+		length = uint32(short)
+	} else if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+
+	if int64(length) > int64(r.Len()) {
+		return "", fmt.Errorf("%w: string longer than the tag", ErrInvalidMetadata)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	return string(buf), nil
+}
+
+// readAMFObject reads the properties of an AMF0 object up to its end marker
+func readAMFObject(r *bytes.Reader, depth int) (map[string]any, error) {
+	properties := make(map[string]any)
+	for {
+		key, err := readAMFString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+			}
+			if marker == amfObjectEnd {
+				return properties, nil
+			}
+			r.UnreadByte()
+		}
+
+		value, err := readAMFValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		properties[key] = value
+	}
+}
@@ -0,0 +1,258 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/bufpool"
+)
+
+// Tags of a synthetic H.264/AAC stream
+func avcSequenceHeader(config byte) Tag {
+	return Tag{Type: TagVideo, Data: []byte{0x17, 0, 0, 0, 0, 1, config}}
+}
+
+func keyframe(ms uint32) Tag {
+	return Tag{Type: TagVideo, Timestamp: ms, Data: []byte{0x17, 1, 0, 0, 0, 0xAA}}
+}
+
+func interframe(ms uint32) Tag {
+	return Tag{Type: TagVideo, Timestamp: ms, Data: []byte{0x27, 1, 0, 0, 0, 0xBB}}
+}
+
+func aacSequenceHeader() Tag {
+	return Tag{Type: TagAudio, Data: []byte{0xAF, 0, 0x12, 0x10}}
+}
+
+func aacFrame(ms uint32) Tag {
+	return Tag{Type: TagAudio, Timestamp: ms, Data: []byte{0xAF, 1, 0xCC}}
+}
+
+func metadata() Tag {
+	return Tag{Type: TagScript, Data: []byte{amfString, 0, 10, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}}
+}
+
+// remuxed returns an FLV fragment like the embedding FFmpeg writes it: with
+// its own file header, metadata, and sequence headers, and timestamps
+// starting at zero
+func remuxed(t *testing.T, videoConfig byte, tags ...Tag) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	WriteHeader(&buf, Header{HasAudio: true, HasVideo: true})
+	for _, tag := range []Tag{metadata(), avcSequenceHeader(videoConfig), aacSequenceHeader()} {
+		if err := WriteTag(&buf, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tag := range tags {
+		if err := WriteTag(&buf, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// readAll reads every tag of an FLV stream
+func readAll(t *testing.T, stream []byte) (Header, []Tag) {
+	t.Helper()
+	reader, err := NewReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []Tag
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			return reader.Header, tags
+		}
+		if err != nil {
+			t.Fatalf("invalid FLV after %d tags: %v", len(tags), err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestConcatenatorContinuesTimestamps(t *testing.T) {
+	fragment := func(config byte) []byte {
+		return remuxed(t, config, keyframe(0), aacFrame(10), interframe(33), aacFrame(43), interframe(66))
+	}
+	starts := []time.Duration{0, 2 * time.Second, 4 * time.Second}
+
+	c := NewConcatenator()
+	var body bytes.Buffer
+	for _, start := range starts {
+		out, err := c.Next(fragment(1), start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Write(out)
+	}
+	stream := append(c.Preamble(), body.Bytes()...)
+
+	// One FLV with a single file header
+	if n := bytes.Count(stream, []byte("FLV\x01")); n != 1 {
+		t.Errorf("stream has %d file headers, want 1", n)
+	}
+	header, tags := readAll(t, stream)
+	if !header.HasAudio || !header.HasVideo {
+		t.Errorf("header = %+v", header)
+	}
+
+	var last uint32
+	sequenceHeaders, metadataTags, frames := 0, 0, 0
+	for i, tag := range tags {
+		if tag.Timestamp < last {
+			t.Errorf("tag %d at %dms goes back from %dms", i, tag.Timestamp, last)
+		}
+		last = tag.Timestamp
+		switch {
+		case tag.Type == TagScript:
+			metadataTags++
+		case tag.IsSequenceHeader():
+			sequenceHeaders++
+		default:
+			frames++
+		}
+	}
+	if metadataTags != 1 || sequenceHeaders != 2 {
+		t.Errorf("got %d metadata tags and %d sequence headers, want them once in the preamble", metadataTags, sequenceHeaders)
+	}
+	if frames != 15 {
+		t.Errorf("got %d frames, want 15", frames)
+	}
+	// The last fragment starts 4s into the stream
+	if want := uint32(4066); last != want {
+		t.Errorf("last tag at %dms, want %dms", last, want)
+	}
+}
+
+func TestConcatenatorResendsChangedSequenceHeaders(t *testing.T) {
+	c := NewConcatenator()
+	var body bytes.Buffer
+	for i, config := range []byte{1, 1, 2} {
+		out, err := c.Next(remuxed(t, config, keyframe(0), aacFrame(10)), time.Duration(i)*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Write(out)
+	}
+
+	_, tags := readAll(t, append(c.Preamble(), body.Bytes()...))
+	var videoHeaders []byte
+	for _, tag := range tags {
+		if tag.Type == TagVideo && tag.IsSequenceHeader() {
+			videoHeaders = append(videoHeaders, tag.Data[len(tag.Data)-1])
+		}
+	}
+	// Once in the preamble, which has the latest, and once inline where the
+	// configuration changed
+	if !bytes.Equal(videoHeaders, []byte{2, 2}) {
+		t.Errorf("video sequence headers with configs %v, want [2 2]", videoHeaders)
+	}
+}
+
+func TestConcatenatorNeverGoesBack(t *testing.T) {
+	c := NewConcatenator()
+	c.Next(remuxed(t, 1, keyframe(0), interframe(900)), 0)
+	// The next fragment claims to start before the previous one ended
+	out, err := c.Next(remuxed(t, 1, keyframe(0), interframe(40)), 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	WriteHeader(&body, Header{HasVideo: true})
+	body.Write(out)
+	_, tags := readAll(t, body.Bytes())
+	for _, tag := range tags {
+		if tag.Timestamp < 900 {
+			t.Errorf("tag at %dms, before the previous fragment ended", tag.Timestamp)
+		}
+	}
+}
+
+func TestSegmenterCutsAtKeyframes(t *testing.T) {
+	s := NewSegmenter(Header{HasAudio: true, HasVideo: true})
+	for _, tag := range []Tag{
+		metadata(), avcSequenceHeader(1), aacSequenceHeader(),
+		interframe(0), // Before the first keyframe, dropped
+		keyframe(40), aacFrame(50), interframe(80),
+		keyframe(2000), aacFrame(2010),
+	} {
+		s.Add(tag)
+	}
+
+	fragment := s.Cut(2500 * time.Millisecond)
+	if fragment.Start != 40*time.Millisecond || fragment.VideoTags != 2 {
+		t.Errorf("fragment starts at %s with %d video tags, want 40ms and 2", fragment.Start, fragment.VideoTags)
+	}
+	// Every fragment can be decoded on its own
+	_, tags := readAll(t, fragment.Data)
+	if len(tags) < 3 || tags[0].Type != TagScript || !tags[1].IsSequenceHeader() || !tags[2].IsSequenceHeader() {
+		t.Errorf("fragment doesn't start with the metadata and sequence headers")
+	}
+
+	rest := s.Flush()
+	if rest.Start != 2*time.Second || rest.VideoTags != 1 {
+		t.Errorf("rest starts at %s with %d video tags, want 2s and 1", rest.Start, rest.VideoTags)
+	}
+	if empty := s.Flush(); empty.Data != nil {
+		t.Error("flushing twice returned tags again")
+	}
+}
+
+// BenchmarkChunking cuts 10s chunks of a 3 Mbit/s stream and rewrites them
+// for the targets, like the pipeline does, with the buffers put back once
+// streamed or left to the garbage collector
+func BenchmarkChunking(b *testing.B) {
+	const chunk = 10_000 // ms
+	video := bytes.Repeat([]byte{0x27, 1, 0, 0, 0}, 2500)
+	var tags []Tag
+	for ms := uint32(0); ms < chunk; ms += 33 {
+		data := bytes.Clone(video)
+		if ms%2000 < 33 {
+			data[0] = 0x17 // A keyframe every 2s
+		}
+		tags = append(tags, Tag{Type: TagVideo, Timestamp: ms, Data: data})
+		tags = append(tags, aacFrame(ms+10))
+	}
+
+	for _, pooled := range []bool{true, false} {
+		name := "pooled"
+		if !pooled {
+			name = "not pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := NewSegmenter(Header{HasAudio: true, HasVideo: true})
+			for _, tag := range []Tag{metadata(), avcSequenceHeader(1), aacSequenceHeader()} {
+				s.Add(tag)
+			}
+			c := NewConcatenator()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Each chunk is cut once the keyframe starting the next one
+				// came in
+				start := uint32(i) * chunk
+				for _, tag := range tags {
+					tag.Timestamp += start
+					s.Add(tag)
+				}
+				fragment := s.Cut(time.Duration(start) * time.Millisecond)
+				if fragment.Data == nil {
+					continue
+				}
+				out, err := c.Next(fragment.Data, fragment.Start)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if pooled {
+					bufpool.Video.Put(fragment.Data)
+					bufpool.Video.Put(out)
+				}
+			}
+		})
+	}
+}
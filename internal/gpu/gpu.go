@@ -0,0 +1,49 @@
+// Package gpu queries the NVIDIA GPU whisper transcribes on, so a
+// transcription can be held back or moved off the GPU before it runs out of
+// memory instead of after.
+package gpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryTimeout bounds a single nvidia-smi run
+const queryTimeout = 5 * time.Second
+
+// ErrUnavailable means nvidia-smi isn't installed, so there is no GPU to
+// query
+var ErrUnavailable = errors.New("nvidia-smi not found")
+
+// FreeMemoryMB returns the free memory of the first GPU, the one whisper
+// uses, in MiB
+func FreeMemoryMB() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=memory.free", "--format=csv,noheader,nounits").Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return 0, ErrUnavailable
+	}
+	if err != nil {
+		return 0, fmt.Errorf("nvidia-smi: %w", err)
+	}
+	return parseFreeMemory(string(output))
+}
+
+// parseFreeMemory parses the free memory of the first GPU from the output of
+// nvidia-smi, one line per GPU, with or without the unit
+func parseFreeMemory(output string) (int, error) {
+	line, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), "MiB"))
+	free, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected nvidia-smi output %q", line)
+	}
+	return free, nil
+}
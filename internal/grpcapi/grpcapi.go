@@ -0,0 +1,297 @@
+// Package grpcapi serves ad-hoc transcription over gRPC, for services that
+// want to use the proxy's models without publishing an RTMP stream.
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/grpcapi/transcriptionpb"
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// chunkDuration is how much streamed audio is transcribed at once
+const chunkDuration = 10 * time.Second
+
+// minAudioBytes is the least audio the transcriber accepts; a shorter end of
+// a stream is ignored
+const minAudioBytes = 1024
+
+// maxMessageBytes bounds the size of a request, which for TranscribeFile is
+// the whole file
+const maxMessageBytes = 64 << 20
+
+// Server is the gRPC transcription server
+type Server struct {
+	transcriptionpb.UnimplementedTranscriptionServer
+
+	config     *config.Config
+	proxy      transcriptionProxy
+	logger     *logrus.Entry
+	grpcServer *grpc.Server
+}
+
+// transcriptionProxy is what the server uses of the proxy
+type transcriptionProxy interface {
+	Ready() bool
+	Transcribe(ctx context.Context, pcm []byte, format audio.Format, langs proxy.Languages) (segments, originals []transcriber.Segment, err error)
+}
+
+// New creates a gRPC server for the given proxy
+func New(cfg *config.Config, p *proxy.Proxy) *Server {
+	return newServer(cfg, p, p.Logger())
+}
+
+// newServer creates a gRPC server transcribing with p
+func newServer(cfg *config.Config, p transcriptionProxy, logger *logrus.Logger) *Server {
+	s := &Server{
+		config: cfg,
+		proxy:  p,
+		logger: logger.WithField("server", "grpc"),
+	}
+
+	s.grpcServer = grpc.NewServer(
+		grpc.MaxRecvMsgSize(maxMessageBytes),
+		grpc.UnaryInterceptor(s.authorizeUnary),
+		grpc.StreamInterceptor(s.authorizeStream),
+	)
+	transcriptionpb.RegisterTranscriptionServer(s.grpcServer, s)
+
+	return s
+}
+
+// Start listens on the configured address and serves in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.config.GRPCAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.GRPCAddress, err)
+	}
+
+	s.logger.WithField("address", listener.Addr().String()).Info("gRPC transcription server listening")
+
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil {
+			s.logger.WithError(err).Error("gRPC transcription server failed")
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown lets running jobs finish until ctx is done, then cancels them
+func (s *Server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+// TranscribeFile transcribes a complete audio file
+func (s *Server) TranscribeFile(ctx context.Context, req *transcriptionpb.TranscribeFileRequest) (*transcriptionpb.TranscribeFileResponse, error) {
+	if err := s.checkReady(); err != nil {
+		return nil, err
+	}
+
+	pcm, err := audio.Decode(req.GetAudio())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	langs := languages(req.GetOptions())
+	segments, originals, err := s.proxy.Transcribe(ctx, pcm, audio.Expected, langs)
+	if err != nil {
+		s.logger.WithError(err).Warn("Ad-hoc transcription failed")
+		return nil, statusError(err)
+	}
+
+	return &transcriptionpb.TranscribeFileResponse{
+		Segments: toProto(segments, originals, 0, langs),
+	}, nil
+}
+
+// Transcribe transcribes audio streamed in chunks, sending the segments of
+// every chunkDuration of audio as soon as it is transcribed
+func (s *Server) Transcribe(stream transcriptionpb.Transcription_TranscribeServer) error {
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	format := audio.Expected
+	if rate := first.GetSampleRate(); rate != 0 {
+		if rate < 8000 || rate > 192000 {
+			return status.Errorf(codes.InvalidArgument, "sample rate %d out of range", rate)
+		}
+		format.SampleRate = int(rate)
+	}
+	langs := languages(first.GetOptions())
+
+	chunkSize := int(chunkDuration.Seconds()) * format.BytesPerSecond()
+
+	if err := s.checkReady(); err != nil {
+		return err
+	}
+
+	var offset time.Duration
+	transcribe := func(pcm []byte) error {
+		// Whole frames only
+		pcm = pcm[:len(pcm)-len(pcm)%format.FrameSize()]
+		if len(pcm) < minAudioBytes {
+			return nil
+		}
+
+		segments, originals, err := s.proxy.Transcribe(stream.Context(), pcm, format, langs)
+		if err != nil {
+			s.logger.WithError(err).Warn("Ad-hoc transcription failed")
+			return statusError(err)
+		}
+
+		for _, segment := range toProto(segments, originals, offset.Seconds(), langs) {
+			if err := stream.Send(segment); err != nil {
+				return err
+			}
+		}
+		offset += time.Duration(len(pcm)) * time.Second / time.Duration(format.BytesPerSecond())
+		return nil
+	}
+
+	buf := append([]byte(nil), first.GetPcm()...)
+	for {
+		for len(buf) >= chunkSize {
+			if err := transcribe(buf[:chunkSize]); err != nil {
+				return err
+			}
+			buf = buf[chunkSize:]
+		}
+
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return transcribe(buf)
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, chunk.GetPcm()...)
+	}
+}
+
+// checkReady fails calls while the models are still loading
+func (s *Server) checkReady() error {
+	if !s.proxy.Ready() {
+		return status.Error(codes.Unavailable, "models are still loading")
+	}
+	return nil
+}
+
+// authorizeUnary rejects unary calls without the API token
+func (s *Server) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeStream rejects streaming calls without the API token
+func (s *Server) authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize checks the bearer token in the authorization metadata, like the
+// control API does. Without a configured token every call is allowed.
+func (s *Server) authorize(ctx context.Context, method string) error {
+	if s.config.APIToken == "" {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.APIToken)) == 1 {
+			return nil
+		}
+	}
+
+	s.logger.WithField("method", method).Warn("Rejected gRPC call with missing or invalid token")
+	return status.Error(codes.Unauthenticated, "missing or invalid API token")
+}
+
+// languages returns the languages selected by opts
+func languages(opts *transcriptionpb.Options) proxy.Languages {
+	return proxy.Languages{
+		Source: strings.TrimSpace(opts.GetSourceLang()),
+		Target: strings.TrimSpace(opts.GetTargetLang()),
+	}
+}
+
+// toProto converts segments to their protobuf form, shifting them by offset
+// seconds. originals are the untranslated segments, or nil.
+func toProto(segments, originals []transcriber.Segment, offset float64, langs proxy.Languages) []*transcriptionpb.Segment {
+	lang := langs.Source
+	if originals != nil {
+		lang = langs.Target
+	}
+
+	result := make([]*transcriptionpb.Segment, 0, len(segments))
+	for i, segment := range segments {
+		pb := &transcriptionpb.Segment{
+			Start:      segment.Start + offset,
+			End:        segment.End + offset,
+			Text:       segment.Text,
+			Lang:       lang,
+			AvgLogprob: segment.AvgLogProb,
+		}
+		if originals != nil {
+			pb.OriginalText = originals[i].Text
+		}
+		if pb.Lang == "" {
+			pb.Lang = segment.DetectedLanguage
+		}
+		result = append(result, pb)
+	}
+	return result
+}
+
+// statusError maps a transcription error to a gRPC status
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, transcriber.ErrModelMissing):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, transcriber.ErrCorruptAudio):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, transcriber.ErrOutOfMemory):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,223 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/grpcapi/transcriptionpb"
+	"github.com/ben/transcription-proxy/internal/proxy"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeProxy transcribes every chunk to a single segment naming its length
+type fakeProxy struct {
+	notReady bool
+	err      error
+
+	mu    sync.Mutex
+	langs []proxy.Languages
+}
+
+func (f *fakeProxy) Ready() bool {
+	return !f.notReady
+}
+
+func (f *fakeProxy) Transcribe(ctx context.Context, pcm []byte, format audio.Format, langs proxy.Languages) (segments, originals []transcriber.Segment, err error) {
+	f.mu.Lock()
+	f.langs = append(f.langs, langs)
+	f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	seconds := float64(len(pcm)) / float64(format.BytesPerSecond())
+	segments = []transcriber.Segment{{Start: 0, End: seconds, Text: fmt.Sprintf("%gs of audio", seconds)}}
+	if langs.Target == "" {
+		return segments, nil, nil
+	}
+	translated := []transcriber.Segment{{Start: 0, End: seconds, Text: fmt.Sprintf("%gs translated", seconds)}}
+	return translated, segments, nil
+}
+
+// serve starts a server transcribing with p on an in-memory listener and
+// returns a client connected to it, and a function stopping both
+func serve(cfg *config.Config, p transcriptionProxy) (transcriptionpb.TranscriptionClient, func()) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := newServer(cfg, p, logger)
+
+	listener := bufconn.Listen(1 << 20)
+	go s.grpcServer.Serve(listener)
+
+	// Only fails for an invalid target or options
+	conn, _ := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	return transcriptionpb.NewTranscriptionClient(conn), func() {
+		conn.Close()
+		s.grpcServer.Stop()
+	}
+}
+
+// streamPCM sends seconds of silence in one second chunks and returns the
+// segments received
+func streamPCM(ctx context.Context, client transcriptionpb.TranscriptionClient, seconds int, opts *transcriptionpb.Options) ([]*transcriptionpb.Segment, error) {
+	stream, err := client.Transcribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	second := make([]byte, audio.Expected.BytesPerSecond())
+	for i := 0; i < seconds; i++ {
+		chunk := &transcriptionpb.AudioChunk{Pcm: second}
+		if i == 0 {
+			chunk.Options = opts
+		}
+		if err := stream.Send(chunk); err != nil {
+			break // Recv reports the error
+		}
+	}
+	stream.CloseSend()
+
+	var segments []*transcriptionpb.Segment
+	for {
+		segment, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return segments, nil
+		}
+		if err != nil {
+			return segments, err
+		}
+		segments = append(segments, segment)
+	}
+}
+
+// Example_streamingClient streams raw PCM to Transcribe and prints the
+// segments as they arrive, like a client of the service would
+func Example_streamingClient() {
+	client, stop := serve(&config.Config{APIToken: "secret"}, &fakeProxy{})
+	defer stop()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	segments, err := streamPCM(ctx, client, 25, &transcriptionpb.Options{SourceLang: "de", TargetLang: "en"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, segment := range segments {
+		fmt.Printf("[%5.2f - %5.2f] (%s) %s / %s\n", segment.GetStart(), segment.GetEnd(), segment.GetLang(), segment.GetText(), segment.GetOriginalText())
+	}
+	// Output:
+	// [ 0.00 - 10.00] (en) 10s translated / 10s of audio
+	// [10.00 - 20.00] (en) 10s translated / 10s of audio
+	// [20.00 - 25.00] (en) 5s translated / 5s of audio
+}
+
+func TestTranscribeStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds int
+		opts    *transcriptionpb.Options
+		want    []string
+		lang    string
+	}{
+		{"nothing sent", 0, nil, nil, ""},
+		{"shorter than a chunk", 3, &transcriptionpb.Options{SourceLang: "fr"}, []string{"3s of audio"}, "fr"},
+		{"whole chunks", 20, &transcriptionpb.Options{SourceLang: "fr"}, []string{"10s of audio", "10s of audio"}, "fr"},
+		{"translated", 12, &transcriptionpb.Options{SourceLang: "fr", TargetLang: "en"}, []string{"10s translated", "2s translated"}, "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProxy{}
+			client, stop := serve(&config.Config{}, p)
+			defer stop()
+			segments, err := streamPCM(context.Background(), client, tt.seconds, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != len(tt.want) {
+				t.Fatalf("got %d segments, want %d", len(segments), len(tt.want))
+			}
+			offset := 0.0
+			for i, segment := range segments {
+				if segment.GetText() != tt.want[i] || segment.GetLang() != tt.lang {
+					t.Errorf("segment %d = %q in %q, want %q in %q", i, segment.GetText(), segment.GetLang(), tt.want[i], tt.lang)
+				}
+				// Segments are timed from the start of the stream
+				if segment.GetStart() != offset {
+					t.Errorf("segment %d starts at %g, want %g", i, segment.GetStart(), offset)
+				}
+				offset = segment.GetEnd()
+			}
+			for _, langs := range p.langs {
+				if langs.Source != tt.opts.GetSourceLang() || langs.Target != tt.opts.GetTargetLang() {
+					t.Errorf("transcribed with %+v, want the languages of the first chunk", langs)
+				}
+			}
+		})
+	}
+}
+
+func TestTranscribeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    *config.Config
+		proxy  *fakeProxy
+		token  string
+		sample int32
+		want   codes.Code
+	}{
+		{"token not required", &config.Config{}, &fakeProxy{}, "", 0, codes.OK},
+		{"valid token", &config.Config{APIToken: "secret"}, &fakeProxy{}, "secret", 0, codes.OK},
+		{"missing token", &config.Config{APIToken: "secret"}, &fakeProxy{}, "", 0, codes.Unauthenticated},
+		{"wrong token", &config.Config{APIToken: "secret"}, &fakeProxy{}, "guess", 0, codes.Unauthenticated},
+		{"models loading", &config.Config{}, &fakeProxy{notReady: true}, "", 0, codes.Unavailable},
+		{"sample rate too low", &config.Config{}, &fakeProxy{}, "", 4000, codes.InvalidArgument},
+		{"model missing", &config.Config{}, &fakeProxy{err: fmt.Errorf("whisper: %w", transcriber.ErrModelMissing)}, "", 0, codes.FailedPrecondition},
+		{"out of memory", &config.Config{}, &fakeProxy{err: transcriber.ErrOutOfMemory}, "", 0, codes.ResourceExhausted},
+		{"other failure", &config.Config{}, &fakeProxy{err: errors.New("boom")}, "", 0, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, stop := serve(tt.cfg, tt.proxy)
+			defer stop()
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token)
+			}
+
+			stream, err := client.Transcribe(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Send(&transcriptionpb.AudioChunk{SampleRate: tt.sample, Pcm: make([]byte, audio.Expected.BytesPerSecond())})
+			stream.CloseSend()
+			for err == nil {
+				_, err = stream.Recv()
+			}
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
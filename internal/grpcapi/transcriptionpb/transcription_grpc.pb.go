@@ -0,0 +1,174 @@
+// Ad-hoc transcription of audio outside the RTMP stream, served by the proxy
+// when GRPC_ENABLED is set. Regenerate the Go code with:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative transcription.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.0
+// source: transcription.proto
+
+package transcriptionpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Transcription_Transcribe_FullMethodName     = "/transcription.v1.Transcription/Transcribe"
+	Transcription_TranscribeFile_FullMethodName = "/transcription.v1.Transcription/TranscribeFile"
+)
+
+// TranscriptionClient is the client API for Transcription service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Transcription transcribes audio with the models of the proxy. Jobs share the
+// models with the live stream and are limited in how many run at once.
+type TranscriptionClient interface {
+	// Transcribe transcribes audio streamed in chunks. Segments are returned
+	// as soon as enough audio has arrived to transcribe them.
+	Transcribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AudioChunk, Segment], error)
+	// TranscribeFile transcribes a complete audio file in any format FFmpeg
+	// can decode.
+	TranscribeFile(ctx context.Context, in *TranscribeFileRequest, opts ...grpc.CallOption) (*TranscribeFileResponse, error)
+}
+
+type transcriptionClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTranscriptionClient(cc grpc.ClientConnInterface) TranscriptionClient {
+	return &transcriptionClient{cc}
+}
+
+func (c *transcriptionClient) Transcribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AudioChunk, Segment], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Transcription_ServiceDesc.Streams[0], Transcription_Transcribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AudioChunk, Segment]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Transcription_TranscribeClient = grpc.BidiStreamingClient[AudioChunk, Segment]
+
+func (c *transcriptionClient) TranscribeFile(ctx context.Context, in *TranscribeFileRequest, opts ...grpc.CallOption) (*TranscribeFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TranscribeFileResponse)
+	err := c.cc.Invoke(ctx, Transcription_TranscribeFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TranscriptionServer is the server API for Transcription service.
+// All implementations must embed UnimplementedTranscriptionServer
+// for forward compatibility.
+//
+// Transcription transcribes audio with the models of the proxy. Jobs share the
+// models with the live stream and are limited in how many run at once.
+type TranscriptionServer interface {
+	// Transcribe transcribes audio streamed in chunks. Segments are returned
+	// as soon as enough audio has arrived to transcribe them.
+	Transcribe(grpc.BidiStreamingServer[AudioChunk, Segment]) error
+	// TranscribeFile transcribes a complete audio file in any format FFmpeg
+	// can decode.
+	TranscribeFile(context.Context, *TranscribeFileRequest) (*TranscribeFileResponse, error)
+	mustEmbedUnimplementedTranscriptionServer()
+}
+
+// UnimplementedTranscriptionServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTranscriptionServer struct{}
+
+func (UnimplementedTranscriptionServer) Transcribe(grpc.BidiStreamingServer[AudioChunk, Segment]) error {
+	return status.Errorf(codes.Unimplemented, "method Transcribe not implemented")
+}
+func (UnimplementedTranscriptionServer) TranscribeFile(context.Context, *TranscribeFileRequest) (*TranscribeFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TranscribeFile not implemented")
+}
+func (UnimplementedTranscriptionServer) mustEmbedUnimplementedTranscriptionServer() {}
+func (UnimplementedTranscriptionServer) testEmbeddedByValue()                       {}
+
+// UnsafeTranscriptionServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TranscriptionServer will
+// result in compilation errors.
+type UnsafeTranscriptionServer interface {
+	mustEmbedUnimplementedTranscriptionServer()
+}
+
+func RegisterTranscriptionServer(s grpc.ServiceRegistrar, srv TranscriptionServer) {
+	// If the following call pancis, it indicates UnimplementedTranscriptionServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Transcription_ServiceDesc, srv)
+}
+
+func _Transcription_Transcribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TranscriptionServer).Transcribe(&grpc.GenericServerStream[AudioChunk, Segment]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Transcription_TranscribeServer = grpc.BidiStreamingServer[AudioChunk, Segment]
+
+func _Transcription_TranscribeFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TranscribeFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TranscriptionServer).TranscribeFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Transcription_TranscribeFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TranscriptionServer).TranscribeFile(ctx, req.(*TranscribeFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Transcription_ServiceDesc is the grpc.ServiceDesc for Transcription service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Transcription_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "transcription.v1.Transcription",
+	HandlerType: (*TranscriptionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TranscribeFile",
+			Handler:    _Transcription_TranscribeFile_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Transcribe",
+			Handler:       _Transcription_Transcribe_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "transcription.proto",
+}
@@ -0,0 +1,119 @@
+// Package logdedup collapses repeated warnings and errors, so a target that
+// stays down doesn't drown everything else in identical retry messages.
+package logdedup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RepeatedKey is the field holding how often a collapsed entry was repeated
+const RepeatedKey = "repeated"
+
+// Formatter wraps the formatter of a logger. The first warning or error with
+// a message is logged as usual, and the same message logged again within the
+// window is dropped. Once the window expires, the last of the dropped entries
+// is logged with a "repeated N times" suffix. Nothing is collapsed while the
+// logger is at debug level or below.
+type Formatter struct {
+	inner  logrus.Formatter
+	window time.Duration
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	pending map[key]*repeat
+}
+
+// key identifies entries that are collapsed. Fields other than the error and
+// target, like the chunk index, don't tell entries apart.
+type key struct {
+	level   logrus.Level
+	message string
+	err     string
+	target  string
+}
+
+// repeat counts the entries dropped within a window
+type repeat struct {
+	count int
+	data  logrus.Fields // Fields of the last dropped entry
+}
+
+// New wraps inner, the formatter of logger, collapsing repeats within window
+func New(inner logrus.Formatter, window time.Duration, logger *logrus.Logger) *Formatter {
+	return &Formatter{
+		inner:   inner,
+		window:  window,
+		logger:  logger,
+		pending: make(map[key]*repeat),
+	}
+}
+
+// Format formats entry with the wrapped formatter, or returns nothing if it
+// repeats an entry logged within the window
+func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if f.window <= 0 || entry.Level > logrus.WarnLevel || entry.Level < logrus.ErrorLevel {
+		return f.inner.Format(entry)
+	}
+	if _, ok := entry.Data[RepeatedKey]; ok {
+		return f.inner.Format(entry)
+	}
+	if entry.Logger != nil && entry.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return f.inner.Format(entry)
+	}
+
+	k := key{
+		level:   entry.Level,
+		message: entry.Message,
+		err:     fieldString(entry.Data[logrus.ErrorKey]),
+		target:  fieldString(entry.Data["target"]),
+	}
+
+	f.mu.Lock()
+	if r, ok := f.pending[k]; ok {
+		r.count++
+		r.data = make(logrus.Fields, len(entry.Data))
+		for name, value := range entry.Data {
+			r.data[name] = value
+		}
+		f.mu.Unlock()
+		return nil, nil
+	}
+	f.pending[k] = &repeat{}
+	f.mu.Unlock()
+
+	time.AfterFunc(f.window, func() {
+		f.expire(k)
+	})
+	return f.inner.Format(entry)
+}
+
+// expire ends the window of k, logging its repeats if there were any
+func (f *Formatter) expire(k key) {
+	f.mu.Lock()
+	r := f.pending[k]
+	delete(f.pending, k)
+	f.mu.Unlock()
+
+	if r == nil || r.count == 0 {
+		return
+	}
+	f.logger.WithFields(r.data).
+		WithField(RepeatedKey, r.count).
+		Log(k.level, fmt.Sprintf("%s (repeated %d times)", k.message, r.count))
+}
+
+// fieldString returns the text of a field value, empty if it is missing
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
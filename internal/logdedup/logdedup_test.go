@@ -0,0 +1,209 @@
+package logdedup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// testWindow is the window of the tests, short so they expire quickly
+const testWindow = 50 * time.Millisecond
+
+// output collects what a logger writes, which repeats do from a timer
+type output struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+// lines returns the lines written so far
+func (o *output) lines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Split(strings.TrimSpace(o.buf.String()), "\n")
+}
+
+// newLogger returns a logger at level collapsing repeats within testWindow
+func newLogger(level logrus.Level) (*logrus.Logger, *output) {
+	out := &output{}
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetLevel(level)
+	logger.SetFormatter(New(&logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}, testWindow, logger))
+	return logger, out
+}
+
+// waitForLines waits until out has n lines, or a few windows have passed
+func waitForLines(out *output, n int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*testWindow)
+	defer cancel()
+	testutil.WaitFor(ctx, testWindow/5, func() bool { return len(out.lines()) >= n })
+	return out.lines()
+}
+
+func TestFormatter(t *testing.T) {
+	down := errors.New("connection refused")
+	reset := errors.New("connection reset")
+
+	tests := []struct {
+		name  string
+		level logrus.Level
+		log   func(logger *logrus.Logger)
+		want  []string
+	}{
+		{
+			"single entry",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				logger.Warn("Streaming failed")
+			},
+			[]string{`level=warning msg="Streaming failed"`},
+		},
+		{
+			"repeats collapsed",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				for i := 0; i < 3; i++ {
+					logger.WithError(down).Error("Streaming failed")
+				}
+			},
+			[]string{
+				`level=error msg="Streaming failed" error="connection refused"`,
+				`level=error msg="Streaming failed (repeated 2 times)" error="connection refused" repeated=2`,
+			},
+		},
+		{
+			"last repeat kept",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				for chunk := 1; chunk <= 3; chunk++ {
+					logger.WithField("chunk", chunk).Warn("Streaming failed")
+				}
+			},
+			[]string{
+				`level=warning msg="Streaming failed" chunk=1`,
+				`level=warning msg="Streaming failed (repeated 2 times)" chunk=3 repeated=2`,
+			},
+		},
+		{
+			"errors kept apart",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				logger.WithError(down).Warn("Streaming failed")
+				logger.WithError(reset).Warn("Streaming failed")
+			},
+			[]string{
+				`level=warning msg="Streaming failed" error="connection refused"`,
+				`level=warning msg="Streaming failed" error="connection reset"`,
+			},
+		},
+		{
+			"targets kept apart",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				logger.WithField("target", "a").Warn("Streaming failed")
+				logger.WithField("target", "b").Warn("Streaming failed")
+			},
+			[]string{
+				`level=warning msg="Streaming failed" target=a`,
+				`level=warning msg="Streaming failed" target=b`,
+			},
+		},
+		{
+			"levels kept apart",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				logger.Warn("Streaming failed")
+				logger.Error("Streaming failed")
+			},
+			[]string{
+				`level=warning msg="Streaming failed"`,
+				`level=error msg="Streaming failed"`,
+			},
+		},
+		{
+			"info not collapsed",
+			logrus.InfoLevel,
+			func(logger *logrus.Logger) {
+				logger.Info("Chunk processed")
+				logger.Info("Chunk processed")
+			},
+			[]string{
+				`level=info msg="Chunk processed"`,
+				`level=info msg="Chunk processed"`,
+			},
+		},
+		{
+			"nothing collapsed at debug level",
+			logrus.DebugLevel,
+			func(logger *logrus.Logger) {
+				logger.Warn("Streaming failed")
+				logger.Warn("Streaming failed")
+			},
+			[]string{
+				`level=warning msg="Streaming failed"`,
+				`level=warning msg="Streaming failed"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, out := newLogger(tt.level)
+			tt.log(logger)
+			waitForLines(out, len(tt.want))
+			// Nothing else turns up once the window has expired
+			time.Sleep(2 * testWindow)
+			if got := out.lines(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestFormatterStartsNewWindow(t *testing.T) {
+	logger, out := newLogger(logrus.InfoLevel)
+
+	// A message logged again after its window expired opens a new one
+	logger.Warn("Streaming failed")
+	logger.Warn("Streaming failed")
+	waitForLines(out, 2)
+	logger.Warn("Streaming failed")
+	logger.Warn("Streaming failed")
+	logger.Warn("Streaming failed")
+
+	want := []string{
+		`level=warning msg="Streaming failed"`,
+		`level=warning msg="Streaming failed (repeated 1 times)" repeated=1`,
+		`level=warning msg="Streaming failed"`,
+		`level=warning msg="Streaming failed (repeated 2 times)" repeated=2`,
+	}
+	if got := waitForLines(out, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFormatterDisabled(t *testing.T) {
+	out := &output{}
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetFormatter(New(&logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}, 0, logger))
+
+	logger.Warn("Streaming failed")
+	logger.Warn("Streaming failed")
+	if got := out.lines(); len(got) != 2 {
+		t.Errorf("logged %q, want both entries without a window", got)
+	}
+}
@@ -0,0 +1,399 @@
+// Package models downloads the Whisper and Argos Translate models the proxy
+// needs when they are missing, so a fresh node is usable on first start.
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/procs"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrModelMissing is returned when a required model is not installed and
+// could not be downloaded
+var ErrModelMissing = errors.New("model missing")
+
+const (
+	// lockTimeout bounds how long a start waits for another one to finish downloading
+	lockTimeout = 30 * time.Minute
+	// staleLockAge is how old an untouched lock file must be to be considered
+	// left behind by a crashed start
+	staleLockAge = 5 * time.Minute
+	// lockPollInterval is how often a held lock is rechecked
+	lockPollInterval = 2 * time.Second
+	// progressInterval is how often download progress is logged
+	progressInterval = 5 * time.Second
+)
+
+// Manager downloads missing models
+type Manager struct {
+	config *config.Config
+	logger *logrus.Logger
+	client *http.Client
+}
+
+// New creates a model manager
+func New(cfg *config.Config, logger *logrus.Logger) *Manager {
+	return &Manager{
+		config: cfg,
+		logger: logger,
+		client: &http.Client{},
+	}
+}
+
+// hfTreeEntry is a file entry of the Hugging Face repository tree API
+type hfTreeEntry struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	LFS  *struct {
+		SHA256 string `json:"oid"`
+		Size   int64  `json:"size"`
+	} `json:"lfs"`
+}
+
+// EnsureWhisperModel downloads the configured Whisper model from Hugging Face
+// unless it is already installed. The download goes to a temporary directory
+// that is only renamed into place once every file has been verified.
+func (m *Manager) EnsureWhisperModel() error {
+	modelDir, err := transcriber.ResolveModelDir(m.config)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+
+	if whisperModelInstalled(modelDir) {
+		return nil
+	}
+
+	if m.config.WhisperModelDir != "" {
+		return fmt.Errorf("%w: custom model directory %s has no model.bin and cannot be downloaded", ErrModelMissing, modelDir)
+	}
+
+	repo, ok := transcriber.ModelRepository(m.config.WhisperModelSize)
+	if !ok {
+		return fmt.Errorf("%w: no download source for model size %q", ErrModelMissing, m.config.WhisperModelSize)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(modelDir), 0755); err != nil {
+		return fmt.Errorf("%w: failed to create model directory: %v", ErrModelMissing, err)
+	}
+
+	lockPath := modelDir + ".lock"
+	release, err := m.acquireLock(lockPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+	defer release()
+
+	// Another start may have finished the download while we waited
+	if whisperModelInstalled(modelDir) {
+		return nil
+	}
+
+	logger := m.logger.WithFields(logrus.Fields{
+		"repository": repo,
+		"model_dir":  modelDir,
+	})
+	logger.Info("Whisper model missing, downloading from Hugging Face")
+	start := time.Now()
+
+	entries, err := m.listRepository(repo)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+
+	partialDir := modelDir + ".partial"
+	if err := os.RemoveAll(partialDir); err != nil {
+		return fmt.Errorf("%w: failed to clear partial download: %v", ErrModelMissing, err)
+	}
+	defer os.RemoveAll(partialDir)
+
+	for _, entry := range entries {
+		if entry.Type != "file" {
+			continue
+		}
+
+		if err := m.downloadFile(repo, entry, partialDir, lockPath, logger); err != nil {
+			return fmt.Errorf("%w: failed to download %s: %v", ErrModelMissing, entry.Path, err)
+		}
+	}
+
+	if !whisperModelInstalled(partialDir) {
+		return fmt.Errorf("%w: repository %s does not contain model.bin", ErrModelMissing, repo)
+	}
+
+	if err := os.Rename(partialDir, modelDir); err != nil {
+		return fmt.Errorf("%w: failed to move downloaded model into place: %v", ErrModelMissing, err)
+	}
+
+	logger.WithField("duration", time.Since(start).Round(time.Second)).Info("Whisper model downloaded")
+	return nil
+}
+
+// listRepository returns the files of a Hugging Face model repository
+func (m *Manager) listRepository(repo string) ([]hfTreeEntry, error) {
+	treeURL := fmt.Sprintf("%s/api/models/%s/tree/main?recursive=true", strings.TrimRight(m.config.HuggingFaceURL, "/"), repo)
+
+	resp, err := m.client.Get(treeURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository %s: %w", repo, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list repository %s: %s", repo, resp.Status)
+	}
+
+	var entries []hfTreeEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to parse repository listing: %w", err)
+	}
+
+	return entries, nil
+}
+
+// downloadFile downloads a repository file into dir, verifying its size and,
+// for LFS files, its SHA-256 checksum
+func (m *Manager) downloadFile(repo string, entry hfTreeEntry, dir, lockPath string, logger *logrus.Entry) error {
+	fileURL := fmt.Sprintf("%s/%s/resolve/main/%s", strings.TrimRight(m.config.HuggingFaceURL, "/"), repo, escapePath(entry.Path))
+
+	dest := filepath.Join(dir, filepath.FromSlash(entry.Path))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	resp, err := m.client.Get(fileURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size := entry.Size
+	var hasher hash.Hash
+	if entry.LFS != nil {
+		size = entry.LFS.Size
+		hasher = sha256.New()
+	}
+
+	progress := &progressWriter{
+		name:     entry.Path,
+		total:    size,
+		lockPath: lockPath,
+		logger:   logger,
+		lastLog:  time.Now(),
+	}
+
+	writers := []io.Writer{file, progress}
+	if hasher != nil {
+		writers = append(writers, hasher)
+	}
+
+	written, err := io.Copy(io.MultiWriter(writers...), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if size > 0 && written != size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", size, written)
+	}
+
+	if hasher != nil {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(sum, entry.LFS.SHA256) {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", entry.LFS.SHA256, sum)
+		}
+	}
+
+	return file.Close()
+}
+
+// EnsureArgosPackages installs the Argos Translate package needed to
+// translate from sourceLang to targetLang. When there is no direct package and
+// neither language is English, the packages for pivoting through English are
+// installed instead. The argospm commands are killed once ctx is done.
+func (m *Manager) EnsureArgosPackages(ctx context.Context, sourceLang, targetLang string) error {
+	if sourceLang == "" || targetLang == "" || sourceLang == targetLang {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.config.ArgosModelsPath, 0755); err != nil {
+		return fmt.Errorf("%w: failed to create argos models directory: %v", ErrModelMissing, err)
+	}
+
+	release, err := m.acquireLock(filepath.Join(m.config.ArgosModelsPath, ".install.lock"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+	defer release()
+
+	installed, err := m.argospm(ctx, "list")
+	if err != nil {
+		return fmt.Errorf("%w: failed to list argos packages: %v", ErrModelMissing, err)
+	}
+
+	updated := false
+	install := func(from, to string) error {
+		packageName := fmt.Sprintf("translate-%s_%s", from, to)
+		if strings.Contains(installed, packageName) {
+			return nil
+		}
+
+		// Refresh the package index once before the first install
+		if !updated {
+			if _, err := m.argospm(ctx, "update"); err != nil {
+				return fmt.Errorf("failed to update argos package index: %w", err)
+			}
+			updated = true
+		}
+
+		m.logger.WithField("package", packageName).Info("Installing Argos Translate package")
+		if _, err := m.argospm(ctx, "install", packageName); err != nil {
+			return err
+		}
+		m.logger.WithField("package", packageName).Info("Argos Translate package installed")
+		return nil
+	}
+
+	directErr := install(sourceLang, targetLang)
+	if directErr == nil {
+		return nil
+	}
+
+	if sourceLang == "en" || targetLang == "en" {
+		return fmt.Errorf("%w: %v", ErrModelMissing, directErr)
+	}
+
+	m.logger.WithError(directErr).Warn("No direct Argos Translate package, installing packages to pivot through English")
+	if err := install(sourceLang, "en"); err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+	if err := install("en", targetLang); err != nil {
+		return fmt.Errorf("%w: %v", ErrModelMissing, err)
+	}
+
+	return nil
+}
+
+// argospm runs argospm with the configured packages directory
+func (m *Manager) argospm(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "argospm", args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ARGOS_PACKAGES_DIR=%s", m.config.ArgosModelsPath))
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := procs.Run(cmd, procs.RoleTranslator); err != nil {
+		return "", fmt.Errorf("argospm %s failed: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+
+	return output.String(), nil
+}
+
+// acquireLock creates the lock file at path, waiting while another process
+// holds it. Locks not touched for staleLockAge are treated as abandoned.
+func (m *Manager) acquireLock(path string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	waiting := false
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file %s: %w", path, err)
+		}
+
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			m.logger.WithField("lock", path).Warn("Removing stale model download lock")
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", path)
+		}
+
+		if !waiting {
+			m.logger.WithField("lock", path).Info("Another process is downloading models, waiting")
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// whisperModelInstalled reports whether dir holds a CTranslate2 model
+func whisperModelInstalled(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "model.bin"))
+	return err == nil
+}
+
+// escapePath escapes each element of a slash-separated repository path
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// progressWriter logs download progress and keeps the lock file fresh so
+// long downloads aren't mistaken for abandoned ones
+type progressWriter struct {
+	name     string
+	total    int64
+	written  int64
+	lockPath string
+	logger   *logrus.Entry
+	lastLog  time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+
+	if time.Since(w.lastLog) >= progressInterval {
+		w.lastLog = time.Now()
+		os.Chtimes(w.lockPath, w.lastLog, w.lastLog)
+
+		fields := logrus.Fields{
+			"file":          w.name,
+			"downloaded_mb": w.written / 1024 / 1024,
+		}
+		if w.total > 0 {
+			fields["percent"] = w.written * 100 / w.total
+		}
+		w.logger.WithFields(fields).Info("Downloading model")
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,225 @@
+// Package mqtt publishes captions and stream lifecycle events to an MQTT
+// broker. Captions go to <prefix>captions/<stream-key> with all their
+// languages, and to <prefix>captions/<stream-key>/<lang> and
+// <prefix>captions/<stream-key>/original in a single language each. Lifecycle
+// events go to <prefix>events/<stream-key>, and a retained online/offline
+// message to <prefix>status/<stream-key> for dashboards.
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/events"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// publishTimeout bounds how long a publish waits for the broker
+	publishTimeout = 10 * time.Second
+	// connectPollInterval is how often a publisher waiting for the broker
+	// checks the connection
+	connectPollInterval = time.Second
+	// maxReconnectInterval caps the backoff between reconnect attempts
+	maxReconnectInterval = 30 * time.Second
+)
+
+// Stream states published on the status topic
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// status is the retained message on the status topic
+type status struct {
+	Status  string    `json:"status"`
+	Session string    `json:"session,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Publisher sends events to an MQTT broker
+type Publisher struct {
+	client paho.Client
+	qos    byte
+	logger *logrus.Entry
+
+	captionTopic string
+	eventTopic   string
+	statusTopic  string
+
+	// mu guards current, the state republished after every reconnect
+	mu      sync.Mutex
+	current status
+}
+
+// New creates a publisher for the stream with the given key from the MQTT
+// settings. It connects in the background and keeps reconnecting.
+func New(cfg *config.Config, streamKey string, logger *logrus.Logger) (*Publisher, error) {
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return nil, fmt.Errorf("QoS must be 0, 1, or 2, got %d", cfg.MQTTQoS)
+	}
+
+	p := &Publisher{
+		qos:          byte(cfg.MQTTQoS),
+		logger:       logger.WithField("publisher", "mqtt"),
+		captionTopic: cfg.MQTTTopicPrefix + "captions/" + streamKey,
+		eventTopic:   cfg.MQTTTopicPrefix + "events/" + streamKey,
+		statusTopic:  cfg.MQTTTopicPrefix + "status/" + streamKey,
+		current:      status{Status: statusOffline, Time: time.Now()},
+	}
+
+	// The broker marks the stream offline if the proxy disappears
+	will, err := json.Marshal(status{Status: statusOffline})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode last will: %w", err)
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetBinaryWill(p.statusTopic, will, p.qos, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetWriteTimeout(publishTimeout).
+		SetOnConnectHandler(func(paho.Client) {
+			p.logger.WithField("broker", cfg.MQTTBroker).Info("Connected to MQTT broker")
+			p.publishStatus()
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			p.logger.WithError(err).Warn("Lost connection to MQTT broker, reconnecting")
+		})
+
+	if cfg.MQTTTLSCA != "" {
+		pem, err := os.ReadFile(cfg.MQTTTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", cfg.MQTTTLSCA)
+		}
+		opts.SetTLSConfig(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	}
+
+	p.client = paho.NewClient(opts)
+	// With connect retry the token only completes once connected, so it
+	// isn't waited for
+	p.client.Connect()
+
+	return p, nil
+}
+
+// Run publishes the events received on sub until it is closed, then marks the
+// stream offline and disconnects. While the broker is unreachable, events
+// queue up in the subscription, which drops the oldest once full.
+func (p *Publisher) Run(sub *events.Subscription) {
+	defer p.client.Disconnect(250)
+
+	for event := range sub.C {
+		if !p.waitConnected(sub) {
+			break
+		}
+
+		switch event.Kind {
+		case events.KindCaption:
+			p.publish(p.captionTopic, event, false)
+			p.publishLangs(event)
+		case events.KindStreamStarted, events.KindStreamEnded:
+			p.publish(p.eventTopic, event, false)
+
+			state := statusOnline
+			if event.Kind == events.KindStreamEnded {
+				state = statusOffline
+			}
+			p.mu.Lock()
+			p.current = status{Status: state, Session: event.Session, Time: event.Time}
+			p.mu.Unlock()
+			p.publishStatus()
+		case events.KindPipelineDegraded, events.KindProcessExited, events.KindTargetFailed:
+			p.publish(p.eventTopic, event, false)
+		}
+	}
+
+	if dropped := sub.Dropped(); dropped > 0 {
+		p.logger.WithField("dropped", dropped).Warn("Events were dropped while the MQTT broker was unreachable")
+	}
+}
+
+// waitConnected waits until the broker is connected. It returns false if sub
+// is closed in the meantime.
+func (p *Publisher) waitConnected(sub *events.Subscription) bool {
+	ticker := time.NewTicker(connectPollInterval)
+	defer ticker.Stop()
+
+	for !p.client.IsConnectionOpen() {
+		select {
+		case <-ticker.C:
+		case <-sub.Closed():
+			return false
+		}
+	}
+	return true
+}
+
+// publishLangs publishes a caption event to the topic of each of its
+// languages, with only the text in that language
+func (p *Publisher) publishLangs(event events.Event) {
+	caption := event.Caption
+	if caption == nil {
+		return
+	}
+
+	langs := []string{events.LangOriginal, caption.Lang}
+	if caption.OriginalLang != "" {
+		langs = append(langs, caption.OriginalLang)
+	}
+	for lang := range caption.Translations {
+		if !slices.Contains(langs, lang) {
+			langs = append(langs, lang)
+		}
+	}
+
+	for _, lang := range langs {
+		if event.Caption, _ = caption.Only(lang); event.Caption != nil {
+			p.publish(p.captionTopic+"/"+lang, event, false)
+		}
+	}
+}
+
+// publishStatus publishes the current stream state as a retained message
+func (p *Publisher) publishStatus() {
+	p.mu.Lock()
+	current := p.current
+	p.mu.Unlock()
+
+	p.publish(p.statusTopic, current, true)
+}
+
+// publish sends v as JSON to topic, logging failures
+func (p *Publisher) publish(topic string, v any, retained bool) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		p.logger.WithError(err).Error("Failed to encode MQTT message")
+		return
+	}
+
+	token := p.client.Publish(topic, p.qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		p.logger.WithField("topic", topic).Warn("Timed out publishing to MQTT broker")
+		return
+	}
+	if err := token.Error(); err != nil {
+		p.logger.WithError(err).WithField("topic", topic).Warn("Failed to publish to MQTT broker")
+	}
+}
@@ -0,0 +1,151 @@
+// Package netstat lists the TCP connections of the host from /proc, to learn
+// about connections accepted by processes the proxy only runs, such as the
+// FFmpeg listener.
+package netstat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcpTables are the kernel's TCP socket tables for IPv4 and IPv6
+var tcpTables = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// Socket states in the tables
+const (
+	stateEstablished = "01"
+	stateListen      = "0A"
+)
+
+// Peers returns the remote addresses of the established TCP connections to
+// local port
+func Peers(port int) ([]netip.AddrPort, error) {
+	var peers []netip.AddrPort
+	var errs []error
+	for _, table := range tcpTables {
+		found, err := readPeers(table, port)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		peers = append(peers, found...)
+	}
+
+	// Either table may be missing, e.g. without IPv6
+	if len(errs) == len(tcpTables) {
+		return nil, errors.Join(errs...)
+	}
+	return peers, nil
+}
+
+// Listening reports whether a socket listens on local TCP port
+func Listening(port int) (bool, error) {
+	var errs []error
+	for _, table := range tcpTables {
+		found, err := readListening(table, port)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if found {
+			return true, nil
+		}
+	}
+
+	if len(errs) == len(tcpTables) {
+		return false, errors.Join(errs...)
+	}
+	return false, nil
+}
+
+// readListening reports whether one table has a socket listening on local
+// port
+func readListening(table string, port int) (bool, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return false, fmt.Errorf("failed to read sockets: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Column headers
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != stateListen {
+			continue
+		}
+		if local, err := parseAddress(fields[1]); err == nil && int(local.Port()) == port {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read sockets: %w", err)
+	}
+	return false, nil
+}
+
+// readPeers reads the peers connected to local port from one table
+func readPeers(table string, port int) ([]netip.AddrPort, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connections: %w", err)
+	}
+	defer f.Close()
+
+	var peers []netip.AddrPort
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Column headers
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != stateEstablished {
+			continue
+		}
+
+		local, err := parseAddress(fields[1])
+		if err != nil || int(local.Port()) != port {
+			continue
+		}
+		remote, err := parseAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		peers = append(peers, remote)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read connections: %w", err)
+	}
+	return peers, nil
+}
+
+// parseAddress parses an address of the tables, the IP as 32-bit words in host
+// byte order and the port, both in hex, e.g. 0100007F:0CEA
+func parseAddress(s string) (netip.AddrPort, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	// The kernel prints each word in host byte order, little-endian on every
+	// platform the proxy runs on
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	ip, _ := netip.AddrFromSlice(raw)
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+}
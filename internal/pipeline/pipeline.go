@@ -0,0 +1,2068 @@
+// Package pipeline cuts a live stream into chunks, transcribes and captions
+// the audio of each, embeds the captions into its video, and streams the
+// chunks to a sink in order. It reads the audio as WAV or raw PCM and the
+// video as FLV, so it can run behind any ingest; the stages are interfaces so
+// they can be replaced.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/bufpool"
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/delay"
+	"github.com/ben/transcription-proxy/internal/failedchunks"
+	"github.com/ben/transcription-proxy/internal/flv"
+	"github.com/ben/transcription-proxy/internal/gpu"
+	"github.com/ben/transcription-proxy/internal/procs"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/ben/transcription-proxy/internal/spool"
+	"github.com/ben/transcription-proxy/internal/streaming"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/supervisor"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+// Languages are the source and target language of the captions, and the
+// extra languages they are also translated into
+type Languages struct {
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Extra  []string `json:"extra,omitempty"`
+}
+
+// Transcriber turns the audio of a chunk into segments relative to the chunk
+type Transcriber interface {
+	TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error)
+}
+
+// Translator turns the transcribed segments of each chunk into its captions,
+// translating them and whatever else the captions need. Chunks are captioned
+// as they finish, which isn't necessarily in order.
+type Translator interface {
+	// Caption returns the captions of chunk index from its stream-relative
+	// segments, which are nil if the chunk couldn't be transcribed. The
+	// captions are stream-relative as well. If it waits for earlier chunks,
+	// it gives up once stop is closed.
+	Caption(index int, segments []transcriber.Segment, langs Languages, stop <-chan struct{}) []transcriber.Segment
+	// Flush is called once every chunk has been captioned, with the index
+	// after the last chunk, and returns the captions it still held back
+	Flush(index int, langs Languages) []transcriber.Segment
+}
+
+// SpeakerLabeler labels the speakers of the segments of each chunk from its
+// audio, like *speaker.Tracker. Chunks are labeled as they finish, which
+// isn't necessarily in order.
+type SpeakerLabeler interface {
+	// Label returns the stream-relative segments of chunk index labeled from
+	// pcm, the audio of the chunk, which starts offset seconds into the
+	// stream. The segments are nil if the chunk couldn't be transcribed. It
+	// returns the segments unlabeled once stop is closed.
+	Label(index int, segments []transcriber.Segment, pcm []byte, format audio.Format, offset float64, stop <-chan struct{}) []transcriber.Segment
+}
+
+// Embedder is a subtitle sink that embeds the captions written for a chunk
+// into its video, an FLV fragment, like *subtitles.SubtitleEmbedder
+type Embedder interface {
+	SubtitleSink
+	// Embed returns the video of the chunk starting streamTime with its
+	// captions. The video starts videoStart into the stream, on the clock
+	// of the captions.
+	Embed(video []byte, streamTime, videoStart time.Duration) ([]byte, error)
+}
+
+// Sink receives the processed stream, like *streaming.Streamer. The preamble
+// is what a receiver needs before the streamed data, and may change.
+type Sink interface {
+	SetPreamble(preamble []byte)
+	// Stream must not keep data after it returns, it is reused for later
+	// chunks
+	Stream(data []byte) error
+}
+
+// SubtitleSink receives the captions of every chunk apart from the video,
+// like a sidecar file or a caption service. Sinks run concurrently and
+// isolated from each other and from the stream: one that fails, panics, or
+// falls behind holds up neither.
+type SubtitleSink interface {
+	// WriteCues writes the captions of the chunk starting streamTime into
+	// the stream. The segments are stream-relative, empty if the chunk has
+	// none, and must not be modified. Chunks are written as they are
+	// captioned, which isn't necessarily in order.
+	WriteCues(streamTime time.Duration, segments []transcriber.Segment) error
+	// Close is called once the stream has ended and every chunk has been
+	// written
+	Close() error
+}
+
+// Hooks let the caller follow the stream as it is read. They are optional
+// and called from the goroutines reading the stream.
+type Hooks struct {
+	// Started is called once the audio format is known
+	Started func(format audio.Format)
+	// Ended is called once the audio has ended, whether or not it started
+	Ended func()
+	// AudioChunk is called with the PCM of every complete audio chunk
+	AudioChunk func(pcm []byte)
+	// VideoTag is called with every tag read from the video
+	VideoTag func(tag flv.Tag)
+	// Codecs is called once the codecs of the stream are known, and reports
+	// whether its video must be transcoded to H.264 for the sink
+	Codecs func(codecs session.Codecs) (transcode bool)
+	// Degraded is called once when too many chunks in a row were too small
+	// to be transcribed, which almost always means the ingest is broken
+	Degraded func(reason string)
+	// ChunkFailed is called with a chunk whose transcription or embedding
+	// failed after all retries. Its audio and video are reused once it
+	// returns.
+	ChunkFailed func(chunk failedchunks.Chunk)
+}
+
+// Config configures a pipeline
+type Config struct {
+	// TempDir holds the chunks queued in the spool and held by the delay, and
+	// the transcriber's files
+	TempDir       string
+	ChunkDuration time.Duration
+
+	// AudioOnly expects a stream without video instead of detecting it, and
+	// BlackVideo gives such streams a black picture to carry the captions
+	AudioOnly  bool
+	BlackVideo bool
+
+	// SubtitleDelay shifts embedded captions for encoder latency, and
+	// DriftThreshold is how far the audio and video clocks may drift apart
+	// before captions are corrected for it
+	SubtitleDelay  time.Duration
+	DriftThreshold time.Duration
+
+	// StreamDelay holds the output back for moderation, spilling what is
+	// beyond StreamDelayMemory bytes to disk
+	StreamDelay       time.Duration
+	StreamDelayMemory int64
+
+	// SpoolMemory and SpoolMax bound the queued video held in memory and
+	// spooled to disk
+	SpoolMemory int64
+	SpoolMax    int64
+
+	// Languages returns the current languages; each chunk keeps those active
+	// when it started
+	Languages func() Languages
+	// Fallback steps down to cheaper transcription settings after GPU
+	// out-of-memory errors, nil to only retry
+	Fallback *FallbackTracker
+	// VRAM checks the free GPU memory before every transcription on the
+	// GPU, nil to not check it
+	VRAM *VRAMGuard
+
+	// SilenceDB is the level in dBFS below which audio counts as silent in
+	// the chunk reports
+	SilenceDB float64
+	// QuietDB and ClippedPercent are the RMS level in dBFS below which the
+	// input counts as too quiet and the share of clipped samples above which
+	// it counts as too loud, once sustained over recent chunks; zero to never
+	QuietDB        float64
+	ClippedPercent float64
+	// ReportEvery logs the report of every ReportEvery-th chunk at info
+	// level; the others, or all if zero, are logged at debug level
+	ReportEvery int
+
+	// MinChunkAudio and MinChunkVideoTags are the least audio and the fewest
+	// video tags a chunk needs to be transcribed; smaller chunks are
+	// forwarded as they are. After DegradedAfter of them in a row the
+	// pipeline counts as degraded, zero to never.
+	MinChunkAudio     time.Duration
+	MinChunkVideoTags int
+	DegradedAfter     int
+
+	// RetranscribeOtherLanguages transcribes the segments of a chunk
+	// detected in another language than the source language again in the
+	// detected language
+	RetranscribeOtherLanguages bool
+
+	// Timing selects how segments with overlapping or invalid times are
+	// corrected before they are captioned
+	Timing subtitles.TimingOptions
+
+	// Speakers labels the speakers of the segments before they are
+	// captioned, nil to leave them unlabeled
+	Speakers SpeakerLabeler
+
+	// SubtitleSinks receive the captions of every chunk. A sink failing
+	// MaxSinkFailures times in a row is disabled for the rest of the stream,
+	// zero to keep it however often it fails. The first sink that is an
+	// Embedder embeds them into the video instead: it is written as part of
+	// each chunk, and without it the video is forwarded without captions.
+	SubtitleSinks   []SubtitleSink
+	MaxSinkFailures int
+
+	Hooks  Hooks
+	Logger *logrus.Entry
+}
+
+// maxRetries is how often transcribing, embedding, and streaming a chunk are
+// attempted
+const maxRetries = 3
+
+// retryDelay is the pause between attempts
+const retryDelay = 100 * time.Millisecond
+
+// oomRetryDelay is the base backoff before retrying a chunk whose
+// transcription ran out of memory
+const oomRetryDelay = 2 * time.Second
+
+// Pipeline processes one stream
+type Pipeline struct {
+	cfg         Config
+	transcriber Transcriber
+	translator  Translator
+	embedder    Embedder
+	sink        Sink
+	logger      *logrus.Entry
+
+	// spool holds the video of chunks until they are streamed
+	spool *spool.Spool
+	// drift tracks the audio/video clock drift of the stream
+	drift *driftTracker
+	// mod tracks what a moderator dumped from the delayed output
+	mod moderation
+	// small counts the chunks too small to be transcribed
+	small smallChunks
+	// rtf tracks the real-time factor of recent chunks
+	rtf realTimeFactor
+	// level tracks the loudness of recent chunks
+	level inputLevel
+	// started is set once the audio format of the stream is known
+	started atomic.Bool
+	// processed, failed, and dropped count the chunks, see ChunkStats
+	processed atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// New creates a pipeline for one stream. The sink may be nil if the stream
+// is only transcribed.
+func New(cfg Config, t Transcriber, tr Translator, sink Sink) (*Pipeline, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+	if cfg.Languages == nil {
+		cfg.Languages = func() Languages { return Languages{} }
+	}
+
+	// Video chunks waiting for transcription or streaming go to disk once
+	// too much is queued in memory
+	chunkSpool, err := spool.New(filepath.Join(cfg.TempDir, "spool"), cfg.SpoolMemory, cfg.SpoolMax, cfg.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chunk spool: %w", err)
+	}
+
+	var embedder Embedder
+	for _, subtitleSink := range cfg.SubtitleSinks {
+		if e, ok := subtitleSink.(Embedder); ok {
+			embedder = e
+			break
+		}
+	}
+
+	return &Pipeline{
+		cfg:         cfg,
+		transcriber: t,
+		translator:  tr,
+		embedder:    embedder,
+		sink:        sink,
+		logger:      cfg.Logger,
+		spool:       chunkSpool,
+		// Captions are timed by the audio samples, which can drift from the
+		// video timestamps over a long stream
+		drift: newDriftTracker(cfg.DriftThreshold, cfg.Logger),
+	}, nil
+}
+
+// Drift returns how far the video clock runs ahead of the audio clock
+func (p *Pipeline) Drift() time.Duration {
+	return p.drift.Drift()
+}
+
+// Started reports whether a stream arrived, that is whether its audio format
+// was read
+func (p *Pipeline) Started() bool {
+	return p.started.Load()
+}
+
+// Queue returns the counts of the video chunks queued in memory and spooled
+// to disk
+func (p *Pipeline) Queue() spool.Stats {
+	return p.spool.Stats()
+}
+
+// ChunkStats counts the chunks of a stream
+type ChunkStats struct {
+	Processed int `json:"processed"` // Cut from the stream and processed
+	Failed    int `json:"failed"`    // Transcription or embedding failed
+	Dropped   int `json:"dropped"`   // Never reached the sink
+}
+
+// Add adds the counts of other to s
+func (s *ChunkStats) Add(other ChunkStats) {
+	s.Processed += other.Processed
+	s.Failed += other.Failed
+	s.Dropped += other.Dropped
+}
+
+// ChunkStats returns the counts of the chunks processed so far
+func (p *Pipeline) ChunkStats() ChunkStats {
+	return ChunkStats{
+		Processed: int(p.processed.Load()),
+		Failed:    int(p.failed.Load()),
+		Dropped:   int(p.dropped.Load()),
+	}
+}
+
+// TooSmallChunks returns how many chunks were too small to be transcribed
+func (p *Pipeline) TooSmallChunks() int {
+	total, _ := p.small.status()
+	return total
+}
+
+// Degraded reports whether too many chunks in a row were too small to be
+// transcribed
+func (p *Pipeline) Degraded() bool {
+	_, degraded := p.small.status()
+	return degraded
+}
+
+// RealTimeFactor returns the real-time factor averaged over recent chunks, 0
+// until a chunk has been transcribed
+func (p *Pipeline) RealTimeFactor() float64 {
+	return p.rtf.average()
+}
+
+// InputLoudness returns the loudness of the input averaged over recent
+// chunks, and false until a chunk has been measured
+func (p *Pipeline) InputLoudness() (audio.Loudness, bool) {
+	return p.level.average()
+}
+
+// Dump marks everything received so far as dumped, so it goes out blanked
+// once the stream delay is over, and returns up to where on the stream
+// timeline
+func (p *Pipeline) Dump() time.Duration {
+	return p.mod.dump()
+}
+
+// DumpedUntil returns up to where on the stream timeline a moderator dumped
+// the output
+func (p *Pipeline) DumpedUntil() time.Duration {
+	return time.Duration(p.mod.dumpedUntil.Load())
+}
+
+// Dumped reports whether output starting at start on the stream timeline was
+// dumped
+func (p *Pipeline) Dumped(start time.Duration) bool {
+	return p.mod.dumped(start)
+}
+
+// Run processes the stream until its audio ends and every chunk has been
+// streamed, or until ctx is done, which abandons the chunks in flight and
+// returns ctx.Err(). Without a video reader, the stream is only transcribed.
+//
+// Every goroutine of the stream is a task of a supervisor. A panic in any of
+// them stops the stream as if ctx were done, closing the readers if they are
+// io.Closers, and is returned as an error wrapping supervisor.ErrPanic. Run
+// only returns once all of them have.
+func (p *Pipeline) Run(ctx context.Context, audioReader, videoReader io.Reader) error {
+	defer p.spool.Close()
+
+	transcribeOnly := videoReader == nil
+	if !transcribeOnly && p.sink == nil {
+		return errors.New("streaming video needs a sink")
+	}
+	logger := p.logger
+
+	// The subtitle sinks are closed once every chunk has been captioned,
+	// after the tasks below have returned. Delayed sinks drop what they
+	// still hold back once ctx is done.
+	sinks := p.startSubtitleSinks(ctx.Done())
+	defer sinks.close()
+	if p.embedder != nil {
+		defer func() {
+			if err := p.embedder.Close(); err != nil {
+				logger.WithError(err).Warn("Failed to close subtitle embedder")
+			}
+		}()
+	}
+
+	parent := ctx
+	tasks, ctx := supervisor.New(parent, logger)
+
+	// Video is collected tag by tag and cut into chunks at keyframes, so every
+	// chunk can be decoded on its own
+	segmenter := flv.NewSegmenter(flv.Header{HasVideo: !p.cfg.AudioOnly, HasAudio: true})
+	// audioOnly is set once the stream turns out to have no video track, in
+	// which case chunks are forwarded without subtitles
+	var audioOnly atomic.Bool
+	audioOnly.Store(p.cfg.AudioOnly)
+	// transcodeVideo is set once the sink turns out not to accept the
+	// incoming video codec
+	var transcodeVideo atomic.Bool
+	// videoDone is closed once all video has been read
+	videoDone := make(chan struct{})
+
+	// Channel carrying complete audio chunks, closed once the audio ends
+	audioChunks := make(chan pcmChunk)
+
+	// Create a buffer pool for processed video chunks
+	processedChunks := make(chan outgoingChunk, 3) // Buffer up to 3 processed chunks
+
+	// processed is closed once every audio chunk has been processed
+	processed := make(chan struct{})
+
+	// Reading blocks until the ingest delivers more, so the readers are
+	// closed to stop it once the stream is stopped early
+	tasks.Go("close-readers", func() error {
+		select {
+		case <-ctx.Done():
+		case <-processed:
+		}
+		if ctx.Err() == nil {
+			return nil
+		}
+		for _, reader := range []io.Reader{audioReader, videoReader} {
+			if closer, ok := reader.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		return nil
+	})
+
+	// Start goroutine to continuously collect video data
+	if !transcribeOnly {
+		tasks.Go("read-video", func() error {
+			defer close(videoDone)
+
+			flvReader, err := flv.NewReader(videoReader)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					logger.WithError(err).Error("Error reading video header")
+				}
+				return nil
+			}
+			segmenter.SetHeader(flvReader.Header)
+			if !flvReader.Header.HasVideo {
+				audioOnly.Store(true)
+				logger.Info("Incoming stream has no video, forwarding audio without subtitles")
+			}
+
+			// The codecs are known from the first audio and video tags
+			var codecs session.Codecs
+			codecsKnown := false
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				default:
+					tag, err := flvReader.ReadTag()
+					if err != nil {
+						if err != io.EOF {
+							logger.WithError(err).Error("Error reading video data")
+						}
+						return nil
+					}
+
+					if !codecsKnown {
+						switch {
+						case tag.Type == flv.TagVideo && codecs.Video == "":
+							codecs.Video = tag.Codec()
+						case tag.Type == flv.TagAudio && codecs.Audio == "":
+							codecs.Audio = tag.Codec()
+						}
+						if codecs.Audio != "" && (codecs.Video != "" || !flvReader.Header.HasVideo) {
+							codecsKnown = true
+							if p.cfg.Hooks.Codecs != nil {
+								transcodeVideo.Store(p.cfg.Hooks.Codecs(codecs))
+							}
+						}
+					}
+
+					if p.cfg.Hooks.VideoTag != nil {
+						p.cfg.Hooks.VideoTag(tag)
+					}
+					p.mod.receive(tag.Time())
+					segmenter.Add(tag)
+				}
+			}
+		})
+	}
+
+	// Start goroutine to read audio data in chunks. It runs until the audio
+	// ends, which is how the caller stops accepting new chunks.
+	tasks.Go("read-audio", func() error {
+		defer close(audioChunks)
+		if p.cfg.Hooks.Ended != nil {
+			defer p.cfg.Hooks.Ended()
+		}
+
+		// Strip the WAV header so chunks only count samples, and size the
+		// chunks by the format actually delivered
+		pcmReader, format, err := audio.NewPCMReader(audioReader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.WithError(err).Error("Failed to read audio format")
+			}
+			return nil
+		}
+		if format != audio.Expected {
+			logger.WithFields(logrus.Fields{
+				"expected": audio.Expected.String(),
+				"actual":   format.String(),
+			}).Warn("Audio format differs from what was expected, adapting")
+		}
+		p.started.Store(true)
+		if p.cfg.Hooks.Started != nil {
+			p.cfg.Hooks.Started(format)
+		}
+
+		// Calculate buffer size for audio (bytes for a chunk duration), whole frames only
+		audioChunkSize := int(p.cfg.ChunkDuration.Seconds()) * format.BytesPerSecond()
+		audioChunkSize -= audioChunkSize % format.FrameSize()
+
+		// Buffer for collecting audio chunks
+		audioChunk := make([]byte, audioChunkSize)
+
+		// Track audio bytes read
+		var totalAudioBytesRead int
+		var streamBytesRead int64
+
+		for {
+			n, err := pcmReader.Read(audioChunk[totalAudioBytesRead:])
+			totalAudioBytesRead += n
+			streamBytesRead += int64(n)
+			p.mod.receive(time.Duration(streamBytesRead) * time.Second / time.Duration(format.BytesPerSecond()))
+
+			// If we've read a full chunk, hand it over for processing
+			if totalAudioBytesRead >= audioChunkSize {
+				if p.cfg.Hooks.AudioChunk != nil {
+					p.cfg.Hooks.AudioChunk(audioChunk)
+				}
+				data := bufpool.Audio.Get(len(audioChunk))
+				copy(data, audioChunk)
+				select {
+				case audioChunks <- pcmChunk{data: data, format: format}:
+				case <-ctx.Done():
+					return nil
+				}
+
+				// Reset counter for next chunk
+				totalAudioBytesRead = 0
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					logger.WithError(err).Error("Error reading audio data")
+				}
+
+				// Process the final partial chunk so the end of the stream is
+				// transcribed as well
+				partial := totalAudioBytesRead - totalAudioBytesRead%format.FrameSize()
+				if partial > 0 {
+					data := bufpool.Audio.Get(partial)
+					copy(data, audioChunk)
+					select {
+					case audioChunks <- pcmChunk{data: data, format: format}:
+					case <-ctx.Done():
+					}
+				}
+				return nil
+			}
+		}
+	})
+
+	// queueChunk hands a video chunk to the streaming goroutine. There is
+	// nothing to queue in transcribe-only mode.
+	// Every chunk index must be queued, even with empty data, since chunks are
+	// streamed in order.
+	queueChunk := func(report *chunkReport, data []byte, start time.Duration) {
+		if transcribeOnly {
+			return
+		}
+
+		report.queued = time.Now()
+		chunk := outgoingChunk{index: report.index, video: p.spool.Put(data), start: start, report: report}
+		if metadata, ok := segmenter.Metadata(); ok {
+			chunk.metadata = &metadata
+		}
+
+		select {
+		case processedChunks <- chunk:
+			// Chunk queued for streaming
+		case <-ctx.Done():
+		}
+	}
+
+	// convertVideo transcodes a video chunk to H.264 if the sink needs it,
+	// falling back to the original video
+	convertVideo := func(video []byte, chunkLogger *logrus.Entry) []byte {
+		if !transcodeVideo.Load() || len(video) == 0 {
+			return video
+		}
+
+		transcoded, err := transcodeToH264(video)
+		if err != nil {
+			chunkLogger.WithError(err).Error("Failed to transcode video chunk to H.264, forwarding it as is")
+			return video
+		}
+		return transcoded
+	}
+
+	// Start goroutine to process audio chunks and video data
+	tasks.Go("process-chunks", func() error {
+		defer close(processed)
+
+		// WaitGroup for the chunks currently being processed
+		var chunkWG sync.WaitGroup
+		var chunkIndex int
+		var audioEnd time.Duration
+
+		for chunk := range audioChunks {
+			// Cut the video at the last keyframe before the end of this
+			// audio chunk, on the video clock. Its data waits in the spool
+			// while the audio is transcribed.
+			var videoChunk flv.Fragment
+			var spooledVideo *spool.Chunk
+			if !transcribeOnly {
+				audioEnd += time.Duration(len(chunk.data)) * time.Second / time.Duration(chunk.format.BytesPerSecond())
+				if videoTime, ok := segmenter.LastTime(); ok {
+					p.drift.Observe(videoTime, audioEnd)
+				}
+				videoChunk = segmenter.Cut(audioEnd + p.drift.Correction())
+				spooledVideo = p.spool.Put(videoChunk.Data)
+				videoChunk.Data = nil
+			}
+
+			// Process this chunk in a separate task
+			chunkWG.Add(1)
+			processChunk := func(index int, pcm []byte, format audio.Format, fragment flv.Fragment, spooledVideo *spool.Chunk) {
+				defer chunkWG.Done()
+				// Nothing the chunk is handed to keeps its audio once the
+				// chunk is done
+				defer bufpool.Audio.Put(pcm)
+				p.processed.Add(1)
+
+				chunkLogger := logger.WithFields(logrus.Fields{
+					"chunk":            index,
+					"chunk_size_bytes": len(pcm),
+				})
+				chunkLogger.Info("Processing audio/video chunk")
+
+				// The report of a streamed chunk is logged once it has been
+				// streamed
+				report := &chunkReport{
+					index:         index,
+					audioBytes:    len(pcm),
+					audioDuration: time.Duration(len(pcm)) * time.Second / time.Duration(format.BytesPerSecond()),
+					silenceRatio:  audio.SilenceRatio(pcm, format, p.cfg.SilenceDB),
+					loudness:      audio.MeasureLoudness(pcm),
+				}
+				p.observeLevel(report)
+				if transcribeOnly {
+					defer p.logReport(report)
+				} else {
+					report.videoBytes = spooledVideo.Len()
+				}
+
+				// takeVideo reads the video back from the spool once it is
+				// needed
+				takeVideo := func() []byte {
+					data, err := spooledVideo.Take()
+					if err != nil {
+						chunkLogger.WithError(err).Error("Video of the chunk lost")
+						return nil
+					}
+					return convertVideo(data, chunkLogger)
+				}
+
+				offset := time.Duration(index) * p.cfg.ChunkDuration
+
+				// Use the languages active when the chunk started, even if
+				// they are switched while it is processed
+				langs := p.cfg.Languages()
+
+				caption := func(segments []transcriber.Segment) []transcriber.Segment {
+					if p.cfg.Speakers != nil {
+						segments = p.cfg.Speakers.Label(index, segments, pcm, format, offset.Seconds(), ctx.Done())
+					}
+					started := time.Now()
+					captions := p.translator.Caption(index, segments, langs, ctx.Done())
+					report.translationTime += time.Since(started)
+					sinks.write(offset, captions)
+					return captions
+				}
+
+				// If the audio or video chunk is too small, skip processing
+				audioLength := report.audioDuration
+				checkVideo := !transcribeOnly && !audioOnly.Load()
+				tooSmall := audioLength < p.cfg.MinChunkAudio || (checkVideo && fragment.VideoTags < p.cfg.MinChunkVideoTags)
+				if p.small.observe(tooSmall, p.cfg.DegradedAfter) {
+					reason := fmt.Sprintf("%d chunks in a row were too small to transcribe", p.cfg.DegradedAfter)
+					chunkLogger.WithField("reason", reason).Error("Pipeline degraded, the ingest is probably broken")
+					if p.cfg.Hooks.Degraded != nil {
+						p.cfg.Hooks.Degraded(reason)
+					}
+				}
+				if tooSmall {
+					fields := logrus.Fields{
+						"audio_ms":     audioLength.Milliseconds(),
+						"min_audio_ms": p.cfg.MinChunkAudio.Milliseconds(),
+					}
+					if checkVideo {
+						fields["video_tags"] = fragment.VideoTags
+						fields["min_video_tags"] = p.cfg.MinChunkVideoTags
+					}
+					chunkLogger.WithFields(fields).Warn("Chunk too small, skipping transcription")
+					// Still caption the chunk so captions held back from the
+					// previous chunk are written out
+					caption(nil)
+					// Still forward the video for continuity
+					queueChunk(report, takeVideo(), fragment.Start)
+					return
+				}
+
+				segments, err := p.transcribe(pcm, format, langs.Source, report, chunkLogger)
+				if err != nil {
+					chunkLogger.WithError(err).Error("Chunk transcription failed after retries")
+					p.failed.Add(1)
+					caption(nil)
+					// Forward original video chunk if transcription fails
+					video := takeVideo()
+					if p.cfg.Hooks.ChunkFailed != nil {
+						p.cfg.Hooks.ChunkFailed(failedchunks.Chunk{Index: index, Stage: failedchunks.StageTranscription, Err: err, Audio: pcm, Format: format, Video: video})
+					}
+					queueChunk(report, video, fragment.Start)
+					return
+				}
+
+				segments = p.checkLanguages(pcm, format, langs.Source, segments, report, chunkLogger)
+				segments = NormalizeTiming(segments, p.cfg.Timing, chunkLogger)
+				captions := caption(ShiftSegments(segments, offset.Seconds()))
+
+				if transcribeOnly {
+					chunkLogger.Info("Chunk transcribed")
+					return
+				}
+
+				video := takeVideo()
+
+				if audioOnly.Load() {
+					if !p.cfg.BlackVideo {
+						queueChunk(report, video, fragment.Start)
+						chunkLogger.Info("Audio-only chunk queued for streaming")
+						return
+					}
+
+					// Sinks that require video get a black picture, which can
+					// carry the subtitles like any other video
+					withVideo, err := addBlackVideo(video)
+					if err != nil {
+						chunkLogger.WithError(err).Error("Failed to add video to audio-only chunk, forwarding audio only")
+						queueChunk(report, video, fragment.Start)
+						return
+					}
+					video = withVideo
+				}
+
+				// Without an embedder the captions only go to the
+				// translator's outputs
+				if p.embedder == nil {
+					queueChunk(report, video, fragment.Start)
+					chunkLogger.Info("Chunk queued for streaming without subtitles")
+					return
+				}
+
+				// Embed subtitles into video chunk with retries. The video
+				// starts at the keyframe it was cut at, and captions held back
+				// from the previous chunk may start before it. Captions move
+				// from the audio to the video clock, plus the configured delay.
+				shift := p.drift.Correction() + p.cfg.SubtitleDelay
+				videoStart := fragment.Start - shift
+				var processedVideo []byte
+				embedStarted := time.Now()
+				for i := 0; i < maxRetries; i++ {
+					// The embedder takes the captions of a chunk with its
+					// video, so every attempt writes them again
+					if err = p.embedder.WriteCues(offset, captions); err == nil {
+						processedVideo, err = p.embedder.Embed(video, offset, videoStart)
+					}
+					if err == nil {
+						break
+					}
+
+					report.embeddingRetries++
+					chunkLogger.WithError(err).Warnf("Subtitle embedding attempt %d failed, retrying...", i+1)
+					time.Sleep(retryDelay)
+				}
+				report.embeddingTime = time.Since(embedStarted)
+
+				if err != nil {
+					chunkLogger.WithError(err).Error("Failed to embed subtitles after retries, using original video")
+					p.failed.Add(1)
+					if p.cfg.Hooks.ChunkFailed != nil {
+						p.cfg.Hooks.ChunkFailed(failedchunks.Chunk{Index: index, Stage: failedchunks.StageEmbedding, Err: err, Audio: pcm, Format: format, Video: video, Captions: subtitles.ChunkRelative(captions, videoStart)})
+					}
+					queueChunk(report, video, fragment.Start)
+					return
+				}
+
+				// Queue the processed chunk for streaming
+				queueChunk(report, processedVideo, fragment.Start)
+				chunkLogger.Info("Chunk processed and queued for streaming")
+			}
+			index, data, format := chunkIndex, chunk.data, chunk.format
+			tasks.Go(fmt.Sprintf("chunk-%d", index), func() error {
+				processChunk(index, data, format, videoChunk, spooledVideo)
+				return nil
+			})
+			chunkIndex++
+		}
+
+		// No more audio will arrive; once the in-flight chunks are done,
+		// let the streaming goroutine drain the queue and finish
+		chunksDone := make(chan struct{})
+		tasks.Go("wait-chunks", func() error {
+			chunkWG.Wait()
+			close(chunksDone)
+			return nil
+		})
+
+		select {
+		case <-chunksDone:
+			// Forward the video after the last cut, which no audio chunk
+			// covers, once it has been read completely
+			if !transcribeOnly {
+				select {
+				case <-videoDone:
+					rest := segmenter.Flush()
+					queueChunk(&chunkReport{index: chunkIndex, videoBytes: len(rest.Data)}, convertVideo(rest.Data, logger), rest.Start)
+				case <-ctx.Done():
+				}
+			}
+
+			// The captions held back from the last chunk have no video left
+			// to go into, only the other sinks get them
+			if held := p.translator.Flush(chunkIndex, p.cfg.Languages()); len(held) > 0 {
+				sinks.write(time.Duration(chunkIndex)*p.cfg.ChunkDuration, held)
+			}
+			close(processedChunks)
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	// Start goroutine to stream processed chunks
+	if !transcribeOnly {
+		tasks.Go("stream-chunks", func() error {
+			p.streamChunks(ctx, processedChunks)
+			return nil
+		})
+	}
+
+	// Wait for the stream to end and all queued chunks to be handled
+	err := tasks.Wait()
+	logger.Info("Stream processing stopped")
+	if err != nil {
+		return err
+	}
+	return parent.Err()
+}
+
+// transcribe transcribes the audio of a chunk with retries. After a GPU
+// out-of-memory error it steps down to cheaper settings without using up a
+// retry.
+func (p *Pipeline) transcribe(pcm []byte, format audio.Format, lang string, report *chunkReport, chunkLogger *logrus.Entry) ([]transcriber.Segment, error) {
+	// Chunks start at the settings the last out-of-memory error left, or
+	// probe the configured ones again after a while
+	level := transcriber.FallbackNone
+	if p.cfg.Fallback != nil {
+		level = p.cfg.Fallback.start()
+	}
+
+	// With too little free VRAM the chunk may wait or start cheaper still
+	if p.cfg.VRAM != nil {
+		level, report.freeVRAMMB, report.vramMeasured = p.cfg.VRAM.check(level, chunkLogger)
+	}
+
+	started := time.Now()
+	defer func() {
+		report.transcriptionTime = time.Since(started)
+		report.fallback = level
+	}()
+
+	var segments []transcriber.Segment
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		segments, err = p.transcriber.TranscribeAudioFallback(p.cfg.TempDir, pcm, format, lang, level)
+		if err == nil {
+			if p.cfg.Fallback != nil {
+				p.cfg.Fallback.succeeded(level, chunkLogger)
+			}
+			report.segments = len(segments)
+			return segments, nil
+		}
+
+		// Out of GPU memory, step down to cheaper settings without using
+		// up a retry
+		if errors.Is(err, transcriber.ErrOutOfMemory) && p.cfg.Fallback != nil {
+			if next, ok := p.cfg.Fallback.step(level); ok {
+				chunkLogger.WithError(err).WithFields(logrus.Fields{
+					"from": level,
+					"to":   next,
+				}).Warn("GPU out of memory, retrying with cheaper settings")
+				level = next
+				i--
+				continue
+			}
+		}
+
+		// A missing model or undecodable audio won't get better
+		if errors.Is(err, transcriber.ErrModelMissing) || errors.Is(err, transcriber.ErrCorruptAudio) {
+			chunkLogger.WithError(err).Error("Unrecoverable transcription error, not retrying")
+			return nil, err
+		}
+
+		delay := retryDelay
+		if errors.Is(err, transcriber.ErrOutOfMemory) {
+			// Give other chunks time to release memory
+			delay = oomRetryDelay * time.Duration(i+1)
+		}
+
+		report.transcriptionRetries++
+		chunkLogger.WithError(err).Warnf("Transcription attempt %d failed, retrying in %s...", i+1, delay)
+		time.Sleep(delay)
+	}
+	return nil, err
+}
+
+// streamChunks forwards processed chunks to the sink in order until the
+// queue is closed or ctx is done. With a stream delay the chunks are held
+// back first, spilling to the temp directory, and those a moderator dumped
+// meanwhile go out blanked.
+func (p *Pipeline) streamChunks(ctx context.Context, processedChunks <-chan outgoingChunk) {
+	logger := p.logger
+
+	// Chunks finish processing out of order; hold them back until all
+	// earlier chunks have been streamed
+	pending := make(map[int]outgoingChunk)
+	next := 0
+
+	// Every chunk is a complete FLV file; join them into one stream
+	concat := flv.NewConcatenator()
+
+	send := func(chunk outgoingChunk) {
+		p.streamChunk(concat, chunk)
+	}
+	if p.cfg.StreamDelay > 0 {
+		streamDelay := delay.New(p.cfg.StreamDelay, p.cfg.StreamDelayMemory, p.cfg.TempDir, func(chunk outgoingChunk, data []byte) {
+			chunk.data = data
+			if p.mod.dumped(chunk.start) {
+				blanked, err := blankFragment(chunk.data)
+				if err != nil {
+					logger.WithError(err).WithField("chunk", chunk.index).Error("Failed to blank dumped chunk, dropping it")
+					p.dropped.Add(1)
+					p.logReport(chunk.report)
+					return
+				}
+				logger.WithField("chunk", chunk.index).Info("Streaming dumped chunk blanked")
+				chunk.data = blanked
+			}
+			p.streamChunk(concat, chunk)
+		}, logger.WithField("buffer", "stream"))
+		defer func() {
+			streamDelay.Close()
+			select {
+			case <-streamDelay.Done():
+			case <-ctx.Done():
+				streamDelay.Abort()
+				<-streamDelay.Done()
+			}
+		}()
+
+		send = func(chunk outgoingChunk) {
+			data := chunk.data
+			chunk.data = nil
+			if err := streamDelay.Push(chunk, data); err != nil {
+				logger.WithError(err).WithField("chunk", chunk.index).Error("Failed to delay chunk")
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case chunk, ok := <-processedChunks:
+			if !ok {
+				return
+			}
+
+			pending[chunk.index] = chunk
+			for {
+				chunk, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+
+				data, err := chunk.video.Take()
+				if err != nil {
+					logger.WithError(err).WithField("chunk", chunk.index).Error("Skipping chunk")
+					p.logReport(chunk.report)
+					continue
+				}
+				if len(data) == 0 {
+					p.logReport(chunk.report)
+					continue
+				}
+				chunk.data = data
+				send(chunk)
+			}
+		}
+	}
+}
+
+// streamChunk sends a single chunk to the sink, continuing the timestamps of
+// the previous chunk
+func (p *Pipeline) streamChunk(concat *flv.Concatenator, chunk outgoingChunk) {
+	chunkLogger := p.logger.WithFields(logrus.Fields{
+		"chunk":      chunk.index,
+		"chunk_size": len(chunk.data),
+	})
+	chunkLogger.Info("Streaming processed chunk")
+
+	chunk.report.queueWait = time.Since(chunk.report.queued)
+	defer p.logReport(chunk.report)
+
+	// The sink gets the metadata of the incoming stream rather than what
+	// re-muxing the chunk made of it
+	if chunk.metadata != nil {
+		concat.SetMetadata(*chunk.metadata)
+	}
+	// The chunk is the last user of its video, which goes back to the pool
+	// once rewritten, and so does the rewritten video once streamed
+	data, err := concat.Next(chunk.data, chunk.start)
+	bufpool.Video.Put(chunk.data)
+	if err != nil {
+		chunkLogger.WithError(err).Error("Invalid FLV chunk, dropping it")
+		p.dropped.Add(1)
+		return
+	}
+	defer bufpool.Video.Put(data)
+	p.sink.SetPreamble(concat.Preamble())
+	chunk.report.outputBytes = len(data)
+
+	// Try multiple times to stream the chunk
+	for i := 0; i < maxRetries; i++ {
+		err = p.sink.Stream(data)
+		if err == nil {
+			break
+		}
+
+		// Targets that rejected authentication or the codec have been
+		// dropped and retrying the chunk won't bring them back
+		if errors.Is(err, streaming.ErrAuthRejected) || errors.Is(err, streaming.ErrUnsupportedCodec) {
+			break
+		}
+
+		chunk.report.streamingRetries++
+		chunkLogger.WithError(err).Warnf("Streaming attempt %d failed, retrying...", i+1)
+		time.Sleep(retryDelay)
+	}
+
+	if err != nil {
+		chunkLogger.WithError(err).Error("Error streaming chunk after retries")
+		p.dropped.Add(1)
+	}
+}
+
+// sinkBuffer is how many chunks a subtitle sink may fall behind before it
+// loses the captions of later ones
+const sinkBuffer = 16
+
+// Delayed returns sink delayed like the stream: it gets the captions of each
+// chunk StreamDelay after they were made, leaving out those a moderator
+// dumped in the meantime. Without a stream delay the sink is not delayed.
+func Delayed(sink SubtitleSink) SubtitleSink {
+	return delayedSink{sink}
+}
+
+// delayedSink marks a subtitle sink delayed like the stream
+type delayedSink struct {
+	SubtitleSink
+}
+
+// cueBatch is the captions of one chunk on the way to a subtitle sink
+type cueBatch struct {
+	streamTime time.Duration
+	segments   []transcriber.Segment
+	// due is when a delayed sink gets the batch
+	due time.Time
+}
+
+// subtitleSink runs a SubtitleSink in its own goroutine, fed through a
+// buffered channel so a slow sink never holds up the chunks
+type subtitleSink struct {
+	sink        SubtitleSink
+	cues        chan cueBatch
+	maxFailures int
+	logger      *logrus.Entry
+
+	// delay holds the captions back for a delayed sink until they are due,
+	// or until stop is closed, which drops them. dumped reports whether a
+	// caption starting at start was dumped by a moderator.
+	delay  time.Duration
+	stop   <-chan struct{}
+	dumped func(start time.Duration) bool
+
+	dropped atomic.Int64
+	done    chan struct{}
+}
+
+// subtitleSinks are the subtitle sinks of one stream
+type subtitleSinks []*subtitleSink
+
+// startSubtitleSinks starts the configured subtitle sinks for a stream apart
+// from the embedder. Delayed sinks drop the captions they hold back once stop
+// is closed.
+func (p *Pipeline) startSubtitleSinks(stop <-chan struct{}) subtitleSinks {
+	sinks := make(subtitleSinks, 0, len(p.cfg.SubtitleSinks))
+	embedder := p.embedder
+	for _, sink := range p.cfg.SubtitleSinks {
+		// The embedder is the first sink that embeds, see New
+		if _, ok := sink.(Embedder); ok && embedder != nil {
+			embedder = nil
+			continue
+		}
+		s := &subtitleSink{
+			sink:        sink,
+			cues:        make(chan cueBatch, sinkBuffer),
+			maxFailures: p.cfg.MaxSinkFailures,
+			stop:        stop,
+			dumped:      p.mod.dumped,
+			done:        make(chan struct{}),
+		}
+		if delayed, ok := sink.(delayedSink); ok {
+			s.sink = delayed.SubtitleSink
+			s.delay = p.cfg.StreamDelay
+			// The captions of every chunk within the delay are held back
+			// on top of what the sink may fall behind
+			if s.delay > 0 && p.cfg.ChunkDuration > 0 {
+				s.cues = make(chan cueBatch, sinkBuffer+int(s.delay/p.cfg.ChunkDuration)+1)
+			}
+		}
+		s.logger = p.logger.WithField("subtitle_sink", fmt.Sprintf("%T", s.sink))
+		go s.run()
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// write hands the captions of the chunk starting streamTime to every sink,
+// dropping them for the sinks that fell too far behind
+func (sinks subtitleSinks) write(streamTime time.Duration, segments []transcriber.Segment) {
+	now := time.Now()
+	for _, s := range sinks {
+		select {
+		case s.cues <- cueBatch{streamTime: streamTime, segments: segments, due: now.Add(s.delay)}:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// close waits for every sink to write what it was handed and closes it
+func (sinks subtitleSinks) close() {
+	for _, s := range sinks {
+		close(s.cues)
+	}
+	for _, s := range sinks {
+		<-s.done
+		if dropped := s.dropped.Load(); dropped > 0 {
+			s.logger.WithField("dropped", dropped).Warn("Captions of chunks were dropped because the subtitle sink fell behind")
+		}
+		if err := s.sink.Close(); err != nil {
+			s.logger.WithError(err).Warn("Failed to close subtitle sink")
+		}
+	}
+}
+
+// run writes the captions handed to the sink until its channel is closed.
+// After maxFailures failures in a row the sink is disabled and the rest is
+// discarded.
+func (s *subtitleSink) run() {
+	defer close(s.done)
+
+	failures := 0
+	for batch := range s.cues {
+		if s.maxFailures > 0 && failures >= s.maxFailures {
+			continue
+		}
+		if s.delay > 0 {
+			var ok bool
+			if batch, ok = s.release(batch); !ok {
+				continue
+			}
+		}
+		err := s.writeCues(batch)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		logger := s.logger.WithError(err).WithField("stream_time", batch.streamTime)
+		if s.maxFailures > 0 && failures >= s.maxFailures {
+			logger.WithField("failures", failures).Error("Subtitle sink failed too often in a row, disabling it for the stream")
+		} else {
+			logger.Warn("Subtitle sink failed to write captions")
+		}
+	}
+}
+
+// release waits until a batch for a delayed sink is due and leaves out the
+// captions dumped in the meantime. It reports false if the sink was stopped
+// first.
+func (s *subtitleSink) release(batch cueBatch) (cueBatch, bool) {
+	timer := time.NewTimer(time.Until(batch.due))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.stop:
+		return batch, false
+	}
+
+	kept := make([]transcriber.Segment, 0, len(batch.segments))
+	for _, segment := range batch.segments {
+		if !s.dumped(time.Duration(segment.Start * float64(time.Second))) {
+			kept = append(kept, segment)
+		}
+	}
+	batch.segments = kept
+	return batch, true
+}
+
+// writeCues writes a batch to the sink, turning a panic into an error so the
+// stream carries on without it
+func (s *subtitleSink) writeCues(batch cueBatch) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.WithField("stack", string(debug.Stack())).Error("Subtitle sink panicked")
+			err = fmt.Errorf("subtitle sink panicked: %v", r)
+		}
+	}()
+	return s.sink.WriteCues(batch.streamTime, batch.segments)
+}
+
+// outgoingChunk is a processed chunk waiting to be streamed
+type outgoingChunk struct {
+	index int
+	video *spool.Chunk
+	data  []byte
+	start time.Duration // Position of the chunk on the stream timeline
+
+	// metadata is the onMetaData tag of the incoming stream, if it sent one
+	metadata *flv.Tag
+	// report is logged once the chunk has been streamed
+	report *chunkReport
+}
+
+// chunkReport collects the sizes, stage timings, and retries of one chunk,
+// logged in one entry once the chunk is done. It is filled in by one
+// goroutine at a time, as the chunk is handed on.
+type chunkReport struct {
+	index         int
+	audioBytes    int
+	audioDuration time.Duration
+	videoBytes    int
+	silenceRatio  float64 // Share of the audio below the silence threshold
+	loudness      audio.Loudness
+
+	transcriptionTime    time.Duration
+	transcriptionRetries int
+	fallback             transcriber.Fallback // Settings the chunk was last transcribed with
+	freeVRAMMB           int                  // Free GPU memory before transcribing, if vramMeasured
+	vramMeasured         bool
+	segments             int
+	translationTime      time.Duration // Time spent captioning, translation included
+	embeddingTime        time.Duration
+	embeddingRetries     int
+
+	queued           time.Time
+	queueWait        time.Duration // From queueing until streaming, the stream delay included
+	outputBytes      int
+	streamingRetries int
+}
+
+// realTimeFactor returns the time the chunk took to transcribe, caption,
+// and embed relative to its audio duration, leaving out the time it was
+// queued for streaming. Chunks that weren't transcribed have none.
+func (r *chunkReport) realTimeFactor() (float64, bool) {
+	if r.transcriptionTime == 0 || r.audioDuration == 0 {
+		return 0, false
+	}
+	processing := r.transcriptionTime + r.translationTime + r.embeddingTime
+	return processing.Seconds() / r.audioDuration.Seconds(), true
+}
+
+// logReport logs the report of a chunk at debug level, or at info level for
+// every ReportEvery-th chunk, and records its real-time factor
+func (p *Pipeline) logReport(report *chunkReport) {
+	rtf, measured := report.realTimeFactor()
+	if measured {
+		p.observeRTF(rtf)
+	}
+
+	level := logrus.DebugLevel
+	if p.cfg.ReportEvery > 0 && report.index%p.cfg.ReportEvery == 0 {
+		level = logrus.InfoLevel
+	}
+	if !p.logger.Logger.IsLevelEnabled(level) {
+		return
+	}
+
+	fields := logrus.Fields{
+		"chunk":                 report.index,
+		"audio_bytes":           report.audioBytes,
+		"video_bytes":           report.videoBytes,
+		"silence_ratio":         report.silenceRatio,
+		"peak_dbfs":             math.Round(report.loudness.PeakDBFS*10) / 10,
+		"rms_dbfs":              math.Round(report.loudness.RMSDBFS*10) / 10,
+		"clipped_percent":       math.Round(report.loudness.ClippedPercent*100) / 100,
+		"rtf":                   math.Round(rtf*100) / 100,
+		"transcription_ms":      report.transcriptionTime.Milliseconds(),
+		"transcription_retries": report.transcriptionRetries,
+		"fallback":              report.fallback.String(),
+		"segments":              report.segments,
+		"translation_ms":        report.translationTime.Milliseconds(),
+		"embedding_ms":          report.embeddingTime.Milliseconds(),
+		"embedding_retries":     report.embeddingRetries,
+		"queue_wait_ms":         report.queueWait.Milliseconds(),
+		"output_bytes":          report.outputBytes,
+		"streaming_retries":     report.streamingRetries,
+	}
+	if report.vramMeasured {
+		fields["free_vram_mb"] = report.freeVRAMMB
+	}
+	p.logger.WithFields(fields).Log(level, "Chunk report")
+}
+
+// pcmChunk is a chunk of raw PCM audio
+type pcmChunk struct {
+	data   []byte
+	format audio.Format
+}
+
+// blackVideoSize is the frame size of the video added to audio-only streams
+const blackVideoSize = "640x360"
+
+// addBlackVideo adds a black video track to an audio-only FLV fragment
+func addBlackVideo(fragment []byte) ([]byte, error) {
+	cmd := procs.FFmpeg(
+		"-loglevel", "error",
+		"-i", "pipe:0",
+		"-f", "lavfi", "-i", "color=c=black:s="+blackVideoSize+":r=25",
+		"-map", "1:v", "-map", "0:a",
+		"-shortest",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "stillimage", "-pix_fmt", "yuv420p",
+		"-c:a", "copy",
+		"-f", "flv",
+		"pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(fragment)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := procs.Run(cmd, procs.RoleVideo); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// blankFragment replaces the picture of an FLV fragment with black and its
+// sound with silence, keeping its timing and frame size
+func blankFragment(fragment []byte) ([]byte, error) {
+	cmd := procs.FFmpeg(
+		"-loglevel", "error",
+		"-i", "pipe:0",
+		"-vf", "drawbox=color=black:t=fill",
+		"-af", "volume=0",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-f", "flv",
+		"pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(fragment)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := procs.Run(cmd, procs.RoleVideo); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// transcodeToH264 re-encodes the video of an FLV fragment to H.264 for
+// sinks that don't accept the incoming codec
+func transcodeToH264(fragment []byte) ([]byte, error) {
+	cmd := procs.FFmpeg(
+		"-loglevel", "error",
+		"-i", "pipe:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "copy",
+		"-f", "flv",
+		"pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(fragment)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := procs.Run(cmd, procs.RoleVideo); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// FallbackStatus describes the transcription settings degraded after GPU
+// out-of-memory errors
+type FallbackStatus struct {
+	Level string `json:"level"` // Settings new chunks start with
+	// Steps counts the steps down taken, by the fallback stepped to
+	Steps    map[string]uint64 `json:"steps"`
+	Restored uint64            `json:"restored"` // Times the configured settings were restored
+}
+
+// FallbackTracker keeps the fallback chunks start at, across streams. It is
+// safe for concurrent use.
+type FallbackTracker struct {
+	cfg           *config.Config
+	probeInterval time.Duration
+
+	mu       sync.Mutex
+	level    transcriber.Fallback
+	lastOOM  time.Time
+	steps    map[transcriber.Fallback]uint64
+	restored uint64
+}
+
+// NewFallbackTracker creates a tracker stepping down from the settings of
+// cfg, which probes them again probeInterval after the last out-of-memory
+// error
+func NewFallbackTracker(cfg *config.Config, probeInterval time.Duration) *FallbackTracker {
+	return &FallbackTracker{cfg: cfg, probeInterval: probeInterval, steps: make(map[transcriber.Fallback]uint64)}
+}
+
+// start returns the fallback a chunk starts with
+func (f *FallbackTracker) start() transcriber.Fallback {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.level != transcriber.FallbackNone && time.Since(f.lastOOM) >= f.probeInterval {
+		return transcriber.FallbackNone
+	}
+	return f.level
+}
+
+// step returns the fallback after level for a chunk that ran out of memory
+// at it, and false if there is none
+func (f *FallbackTracker) step(level transcriber.Fallback) (transcriber.Fallback, bool) {
+	next, ok := level.Next(f.cfg)
+	if !ok {
+		return level, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.steps[next]++
+	f.lastOOM = time.Now()
+	if next > f.level {
+		f.level = next
+	}
+	return next, true
+}
+
+// succeeded records a chunk transcribed at level. Success at the configured
+// settings restores them for the following chunks.
+func (f *FallbackTracker) succeeded(level transcriber.Fallback, logger *logrus.Entry) {
+	if level != transcriber.FallbackNone {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.level == transcriber.FallbackNone {
+		return
+	}
+	logger.WithField("fallback", f.level).Info("Transcribed at the configured settings again, restoring them")
+	f.level = transcriber.FallbackNone
+	f.restored++
+}
+
+// Status returns the current fallback and the steps taken so far
+func (f *FallbackTracker) Status() FallbackStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := FallbackStatus{Level: f.level.String(), Steps: make(map[string]uint64, len(f.steps)), Restored: f.restored}
+	for level, count := range f.steps {
+		status.Steps[level.String()] = count
+	}
+	return status
+}
+
+// vramPollInterval is how often the wait policy measures the free VRAM again
+const vramPollInterval = time.Second
+
+// VRAMStatus describes the free GPU memory measured before the latest
+// transcription on the GPU
+type VRAMStatus struct {
+	Policy     string     `json:"policy"`
+	RequiredMB int        `json:"required_mb"`       // At the configured settings
+	FreeMB     *int       `json:"free_mb,omitempty"` // Unset until measured
+	CheckedAt  *time.Time `json:"checked_at,omitempty"`
+	Short      uint64     `json:"short"` // Transcriptions that found too little free
+	Error      string     `json:"error,omitempty"`
+}
+
+// VRAMGuard measures the free GPU memory before every transcription on the
+// GPU. When there is less than MaxVRAMUsageMB it waits for more, or steps
+// down to cheaper settings, as VRAMPolicy says. It is safe for concurrent
+// use.
+type VRAMGuard struct {
+	cfg  *config.Config
+	free func() (int, error)
+
+	mu          sync.Mutex
+	status      VRAMStatus
+	unavailable bool // No GPU to measure, it isn't tried again
+}
+
+// NewVRAMGuard creates a guard for transcriptions with the settings of cfg
+func NewVRAMGuard(cfg *config.Config) *VRAMGuard {
+	return &VRAMGuard{
+		cfg:    cfg,
+		free:   gpu.FreeMemoryMB,
+		status: VRAMStatus{Policy: cfg.VRAMPolicy, RequiredMB: cfg.MaxVRAMUsageMB},
+	}
+}
+
+// check measures the free VRAM before a transcription at level and returns
+// the level to transcribe at, with the free VRAM and whether it was measured
+func (g *VRAMGuard) check(level transcriber.Fallback, chunkLogger *logrus.Entry) (transcriber.Fallback, int, bool) {
+	cfg := level.Apply(*g.cfg)
+	if !cfg.CUDAEnabled {
+		return level, 0, false
+	}
+	free, ok := g.measure(chunkLogger)
+	if !ok {
+		return level, 0, false
+	}
+	required := g.required(level)
+	if free >= required || g.cfg.VRAMPolicy == config.VRAMPolicyOff {
+		return level, free, true
+	}
+
+	g.mu.Lock()
+	g.status.Short++
+	g.mu.Unlock()
+
+	logger := chunkLogger.WithFields(logrus.Fields{
+		"free_vram_mb":     free,
+		"required_vram_mb": required,
+		"policy":           g.cfg.VRAMPolicy,
+	})
+	switch g.cfg.VRAMPolicy {
+	case config.VRAMPolicyWait:
+		logger.Info("Not enough free VRAM, waiting for it")
+		deadline := time.Now().Add(g.cfg.VRAMWait)
+		for free < required && time.Now().Before(deadline) {
+			time.Sleep(vramPollInterval)
+			if free, ok = g.measure(chunkLogger); !ok {
+				return level, 0, false
+			}
+		}
+		if free < required {
+			logger.WithField("free_vram_mb", free).Warn("Still not enough free VRAM, transcribing anyway")
+		}
+	case config.VRAMPolicyReduce:
+		for g.required(level) > free {
+			next, ok := level.Next(g.cfg)
+			if !ok {
+				break
+			}
+			level = next
+		}
+		logger.WithField("fallback", level).Warn("Not enough free VRAM, transcribing with cheaper settings")
+	case config.VRAMPolicyCPU:
+		level = transcriber.FallbackCPU
+		logger.Warn("Not enough free VRAM, transcribing on the CPU")
+	}
+	return level, free, true
+}
+
+// required estimates the free VRAM a transcription at level needs: all of
+// MaxVRAMUsageMB at the configured settings, half as much for every step
+// down that changes them, and none on the CPU
+func (g *VRAMGuard) required(level transcriber.Fallback) int {
+	if !level.Apply(*g.cfg).CUDAEnabled {
+		return 0
+	}
+	required := g.cfg.MaxVRAMUsageMB
+	for current := transcriber.FallbackNone; ; {
+		next, ok := current.Next(g.cfg)
+		if !ok || next > level {
+			break
+		}
+		required /= 2
+		current = next
+	}
+	return required
+}
+
+// measure returns the free VRAM now, and false if it can't be measured
+func (g *VRAMGuard) measure(chunkLogger *logrus.Entry) (int, bool) {
+	g.mu.Lock()
+	unavailable := g.unavailable
+	g.mu.Unlock()
+	if unavailable {
+		return 0, false
+	}
+
+	free, err := g.free()
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.status.CheckedAt = &now
+	if err != nil {
+		g.status.Error = err.Error()
+		if errors.Is(err, gpu.ErrUnavailable) {
+			if !g.unavailable {
+				chunkLogger.WithError(err).Warn("Can't measure the free VRAM, not checking it before transcriptions")
+			}
+			g.unavailable = true
+		} else {
+			chunkLogger.WithError(err).Warn("Failed to measure the free VRAM")
+		}
+		return 0, false
+	}
+	g.status.Error = ""
+	g.status.FreeMB = &free
+	return free, true
+}
+
+// Status returns the latest measurement
+func (g *VRAMGuard) Status() VRAMStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
+
+// ShiftSegments returns copies of segments moved by seconds
+func ShiftSegments(segments []transcriber.Segment, seconds float64) []transcriber.Segment {
+	shifted := make([]transcriber.Segment, len(segments))
+	for i, segment := range segments {
+		segment.Start += seconds
+		segment.End += seconds
+		segment.Seek += int(math.Round(seconds * transcriber.SeekFramesPerSecond))
+		shifted[i] = segment
+	}
+	return shifted
+}
+
+// NormalizeTiming corrects the times of the segments of a chunk, logging what
+// was corrected
+func NormalizeTiming(segments []transcriber.Segment, opts subtitles.TimingOptions, chunkLogger *logrus.Entry) []transcriber.Segment {
+	normalized, corrections := subtitles.NormalizeTiming(segments, opts)
+	if corrections.Any() {
+		chunkLogger.WithFields(logrus.Fields{
+			"clamped":   corrections.Clamped,
+			"swapped":   corrections.Swapped,
+			"reordered": corrections.Reordered,
+			"trimmed":   corrections.Trimmed,
+			"merged":    corrections.Merged,
+			"dropped":   corrections.Dropped,
+		}).Info("Corrected segment timing")
+	}
+	return normalized
+}
+
+// driftAlpha is the weight of a new measurement in the smoothed drift, low
+// enough to average out how far the two pipes happen to be apart
+const driftAlpha = 0.1
+
+// driftLogInterval is how often the measured drift is logged
+const driftLogInterval = time.Minute
+
+// driftTracker estimates how far the video clock, the FLV timestamps, runs
+// ahead of the audio clock, the number of samples received. It is safe for
+// concurrent use.
+type driftTracker struct {
+	threshold time.Duration
+	logger    *logrus.Entry
+
+	mu      sync.Mutex
+	drift   time.Duration
+	lastLog time.Time
+}
+
+func newDriftTracker(threshold time.Duration, logger *logrus.Entry) *driftTracker {
+	return &driftTracker{
+		threshold: threshold,
+		logger:    logger,
+		lastLog:   time.Now(),
+	}
+}
+
+// Observe records the video timestamp read when the audio reached audioTime
+func (d *driftTracker) Observe(videoTime, audioTime time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	measured := videoTime - audioTime
+	d.drift += time.Duration(driftAlpha * float64(measured-d.drift))
+
+	if time.Since(d.lastLog) >= driftLogInterval {
+		d.lastLog = time.Now()
+		d.logger.WithFields(logrus.Fields{
+			"drift_ms":   d.drift.Milliseconds(),
+			"correcting": d.drift.Abs() > d.threshold,
+		}).Info("Audio/video clock drift")
+	}
+}
+
+// Drift returns the smoothed drift
+func (d *driftTracker) Drift() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.drift
+}
+
+// Correction returns the drift to add to audio times to get video times, zero
+// while the drift is within the threshold
+func (d *driftTracker) Correction() time.Duration {
+	drift := d.Drift()
+	if drift.Abs() <= d.threshold {
+		return 0
+	}
+	return drift
+}
+
+// smallChunks counts the chunks too small to be transcribed
+type smallChunks struct {
+	mu       sync.Mutex
+	total    int
+	run      int // Too small chunks in a row
+	degraded bool
+}
+
+// observe records whether a chunk was too small, and reports whether that
+// made limit of them in a row for the first time
+func (s *smallChunks) observe(tooSmall bool, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !tooSmall {
+		s.run = 0
+		return false
+	}
+	s.total++
+	s.run++
+	if limit <= 0 || s.run < limit || s.degraded {
+		return false
+	}
+	s.degraded = true
+	return true
+}
+
+// status returns the number of too small chunks, and whether there were too
+// many in a row
+func (s *smallChunks) status() (total int, degraded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total, s.degraded
+}
+
+// checkLanguages logs the segments of a chunk that Whisper detected in
+// another language than lang, which happens when the speaker switches
+// languages, and transcribes them again in their language if enabled. The
+// segments keep their detected language, so they aren't translated from
+// the wrong one. Segment times are relative to the chunk.
+func (p *Pipeline) checkLanguages(pcm []byte, format audio.Format, lang string, segments []transcriber.Segment, report *chunkReport, chunkLogger *logrus.Entry) []transcriber.Segment {
+	var others []string
+	for _, segment := range segments {
+		if segment.OtherLanguage(lang) && !slices.Contains(others, segment.DetectedLanguage) {
+			others = append(others, segment.DetectedLanguage)
+		}
+	}
+	if len(others) == 0 {
+		return segments
+	}
+	chunkLogger = chunkLogger.WithFields(logrus.Fields{
+		"source_lang":     lang,
+		"other_languages": strings.Join(others, ","),
+	})
+	if !p.cfg.RetranscribeOtherLanguages {
+		chunkLogger.Info("Chunk has segments in another language")
+		return segments
+	}
+
+	started := time.Now()
+	defer func() { report.transcriptionTime += time.Since(started) }()
+
+	frameSize := format.FrameSize()
+	result := slices.Clone(segments)
+	for i, segment := range segments {
+		if !segment.OtherLanguage(lang) {
+			continue
+		}
+
+		from := int(segment.Start*float64(format.BytesPerSecond())) / frameSize * frameSize
+		to := int(segment.End*float64(format.BytesPerSecond())) / frameSize * frameSize
+		from, to = max(from, 0), min(to, len(pcm))
+		if to <= from {
+			continue
+		}
+
+		retranscribed, err := p.transcriber.TranscribeAudioFallback(p.cfg.TempDir, pcm[from:to], format, segment.DetectedLanguage, transcriber.FallbackNone)
+		if err != nil {
+			chunkLogger.WithError(err).WithField("segment", segment.ID).Warn("Failed to transcribe segment in its language, keeping it")
+			continue
+		}
+		var texts []string
+		for _, s := range retranscribed {
+			texts = append(texts, s.Text)
+		}
+		if len(texts) > 0 {
+			result[i].Text = strings.Join(texts, " ")
+		}
+	}
+
+	chunkLogger.Info("Transcribed segments in another language again")
+	return result
+}
+
+// levelWindow is the number of recent chunks the input level is averaged
+// over; it must be off for that many before it is warned about
+const levelWindow = 10
+
+// mostlySilent is the silence ratio above which a chunk is a pause rather
+// than quiet speech, and is left out of the input level
+const mostlySilent = 0.5
+
+// inputLevel keeps the loudness of the most recent chunks with speech
+type inputLevel struct {
+	mu            sync.Mutex
+	samples       []audio.Loudness
+	warnedQuiet   bool
+	warnedClipped bool
+}
+
+// observe records the loudness of a chunk and returns the average, and
+// whether the input was first found too quiet or clipping
+func (l *inputLevel) observe(loudness audio.Loudness, quietDB, clippedPercent float64) (avg audio.Loudness, quiet, clipped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples = append(l.samples, loudness)
+	if excess := len(l.samples) - levelWindow; excess > 0 {
+		l.samples = append(l.samples[:0:0], l.samples[excess:]...)
+	}
+	avg = l.averageLocked()
+	if len(l.samples) < levelWindow {
+		return avg, false, false
+	}
+
+	if quietDB != 0 && avg.RMSDBFS < quietDB && !l.warnedQuiet {
+		l.warnedQuiet = true
+		quiet = true
+	}
+	if clippedPercent > 0 && avg.ClippedPercent > clippedPercent && !l.warnedClipped {
+		l.warnedClipped = true
+		clipped = true
+	}
+	return avg, quiet, clipped
+}
+
+// average returns the average over the recorded chunks, and false if there
+// are none
+func (l *inputLevel) average() (audio.Loudness, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.averageLocked(), len(l.samples) > 0
+}
+
+// averageLocked does the work of average; the caller must hold l.mu. The
+// peak is the highest of the chunks.
+func (l *inputLevel) averageLocked() audio.Loudness {
+	if len(l.samples) == 0 {
+		return audio.Loudness{}
+	}
+	avg := audio.Loudness{PeakDBFS: audio.MinDBFS}
+	for _, sample := range l.samples {
+		avg.PeakDBFS = max(avg.PeakDBFS, sample.PeakDBFS)
+		avg.RMSDBFS += sample.RMSDBFS
+		avg.ClippedPercent += sample.ClippedPercent
+	}
+	avg.RMSDBFS /= float64(len(l.samples))
+	avg.ClippedPercent /= float64(len(l.samples))
+	return avg
+}
+
+// observeLevel records the loudness of a chunk and warns, once per stream,
+// when the input has been too quiet or clipping for levelWindow chunks
+func (p *Pipeline) observeLevel(report *chunkReport) {
+	if report.silenceRatio > mostlySilent {
+		return
+	}
+
+	avg, quiet, clipped := p.level.observe(report.loudness, p.cfg.QuietDB, p.cfg.ClippedPercent)
+	if quiet {
+		p.logger.WithFields(logrus.Fields{
+			"rms_dbfs": math.Round(avg.RMSDBFS*10) / 10,
+			"chunks":   levelWindow,
+		}).Warnf("Input audio very quiet (%.0f dBFS RMS), transcription quality may suffer", avg.RMSDBFS)
+	}
+	if clipped {
+		p.logger.WithFields(logrus.Fields{
+			"clipped_percent": math.Round(avg.ClippedPercent*100) / 100,
+			"peak_dbfs":       math.Round(avg.PeakDBFS*10) / 10,
+			"chunks":          levelWindow,
+		}).Warnf("Input audio clipping (%.1f%% of samples), transcription quality may suffer", avg.ClippedPercent)
+	}
+}
+
+// RTFWarning is the real-time factor above which processing is close to
+// falling behind the stream
+const RTFWarning = 0.8
+
+// rtfWindow is the number of recent chunks the real-time factor is averaged
+// over, and rtfLogInterval how often the average is logged
+const (
+	rtfWindow      = 30
+	rtfLogInterval = time.Minute
+)
+
+// realTimeFactor keeps the real-time factors of the most recent chunks
+type realTimeFactor struct {
+	mu      sync.Mutex
+	samples []float64
+	logged  time.Time
+}
+
+// observe records the real-time factor of a chunk and returns the average,
+// the number of chunks averaged, and whether it is due to be logged
+func (r *realTimeFactor) observe(rtf float64) (avg float64, chunks int, due bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, rtf)
+	if excess := len(r.samples) - rtfWindow; excess > 0 {
+		r.samples = append(r.samples[:0:0], r.samples[excess:]...)
+	}
+	if time.Since(r.logged) >= rtfLogInterval {
+		r.logged = time.Now()
+		due = true
+	}
+	return r.averageLocked(), len(r.samples), due
+}
+
+// average returns the average over the recorded chunks
+func (r *realTimeFactor) average() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.averageLocked()
+}
+
+// averageLocked does the work of average; the caller must hold r.mu
+func (r *realTimeFactor) averageLocked() float64 {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, sample := range r.samples {
+		sum += sample
+	}
+	return sum / float64(len(r.samples))
+}
+
+// observeRTF records the real-time factor of a chunk and logs the average
+// every rtfLogInterval, as a warning once it exceeds RTFWarning
+func (p *Pipeline) observeRTF(rtf float64) {
+	avg, chunks, due := p.rtf.observe(rtf)
+	if !due {
+		return
+	}
+	logger := p.logger.WithFields(logrus.Fields{
+		"rtf_avg": math.Round(avg*100) / 100,
+		"chunks":  chunks,
+	})
+	if avg > RTFWarning {
+		logger.Warn("Real-time factor is high, processing may fall behind the stream")
+		return
+	}
+	logger.Info("Real-time factor")
+}
+
+// moderation tracks how far a stream has been received and up to where a
+// moderator dumped its delayed output, both on the stream timeline
+type moderation struct {
+	received    atomic.Int64
+	dumpedUntil atomic.Int64
+}
+
+// receive records that the stream has been read up to t
+func (m *moderation) receive(t time.Duration) {
+	for {
+		current := m.received.Load()
+		if int64(t) <= current || m.received.CompareAndSwap(current, int64(t)) {
+			return
+		}
+	}
+}
+
+// dump marks everything received so far as dumped and returns up to where
+func (m *moderation) dump() time.Duration {
+	until := m.received.Load()
+	for {
+		current := m.dumpedUntil.Load()
+		if until <= current || m.dumpedUntil.CompareAndSwap(current, until) {
+			return time.Duration(max(until, current))
+		}
+	}
+}
+
+// dumped reports whether output starting at start was dumped
+func (m *moderation) dumped(start time.Duration) bool {
+	return int64(start) < m.dumpedUntil.Load()
+}
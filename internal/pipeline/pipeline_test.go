@@ -0,0 +1,728 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/failedchunks"
+	"github.com/ben/transcription-proxy/internal/flv"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+// testChunk is the chunk duration of the tests, the shortest there is
+const testChunk = time.Second
+
+// pcmStream returns seconds of audio in the expected format whose samples
+// are the number of the second they are in, counted from 1, so every chunk
+// can tell its index
+func pcmStream(seconds float64) []byte {
+	samples := int(seconds * float64(audio.Expected.SampleRate))
+	pcm := make([]byte, 2*samples)
+	for i := 0; i < samples; i++ {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(i/audio.Expected.SampleRate+1))
+	}
+	return pcm
+}
+
+// wavStream returns pcmStream as a WAV file, like the listener writes it
+func wavStream(seconds float64) io.Reader {
+	wav := audio.EncodeWAV(pcmStream(seconds), audio.Expected.SampleRate, audio.Expected.Channels, audio.Expected.BitsPerSample)
+	return bytes.NewReader(wav)
+}
+
+// chunkOf returns the index of the chunk of pcmStream that pcm starts
+func chunkOf(pcm []byte) int {
+	return int(binary.LittleEndian.Uint16(pcm)) - 1
+}
+
+// flvStream returns seconds of a synthetic H.264/AAC stream with a video and
+// an audio tag every 100ms and a keyframe every 500ms
+func flvStream(t *testing.T, seconds float64) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	flv.WriteHeader(&buf, flv.Header{HasAudio: true, HasVideo: true})
+	tags := []flv.Tag{
+		{Type: flv.TagVideo, Data: []byte{0x17, 0, 0, 0, 0, 1, 0x64}},
+		{Type: flv.TagAudio, Data: []byte{0xAF, 0, 0x12, 0x10}},
+	}
+	for ms := uint32(0); ms < uint32(seconds*1000); ms += 100 {
+		frame := byte(0x27)
+		if ms%500 == 0 {
+			frame = 0x17
+		}
+		tags = append(tags,
+			flv.Tag{Type: flv.TagVideo, Timestamp: ms, Data: []byte{frame, 1, 0, 0, 0, 0xAA}},
+			flv.Tag{Type: flv.TagAudio, Timestamp: ms, Data: []byte{0xAF, 1, 0xCC}},
+		)
+	}
+	for _, tag := range tags {
+		if err := flv.WriteTag(&buf, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+// fakeTranscriber transcribes every chunk to one segment naming it
+type fakeTranscriber struct {
+	// failures is how often each chunk fails before it is transcribed,
+	// negative to always fail
+	failures map[int]int
+	// delay is how long each chunk takes, to finish them out of order
+	delay func(index int) time.Duration
+
+	mu       sync.Mutex
+	attempts map[int]int
+}
+
+func (f *fakeTranscriber) TranscribeAudioFallback(tempDir string, pcm []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error) {
+	index := chunkOf(pcm)
+	f.mu.Lock()
+	if f.attempts == nil {
+		f.attempts = map[int]int{}
+	}
+	f.attempts[index]++
+	attempt := f.attempts[index]
+	f.mu.Unlock()
+
+	if f.delay != nil {
+		time.Sleep(f.delay(index))
+	}
+	if failures := f.failures[index]; failures < 0 || attempt <= failures {
+		return nil, fmt.Errorf("chunk %d attempt %d failed", index, attempt)
+	}
+	return []transcriber.Segment{{Start: 0.25, End: 0.75, Text: fmt.Sprintf("chunk %d", index)}}, nil
+}
+
+// fakeTranslator captions the segments as they are and records them. Flush
+// returns held.
+type fakeTranslator struct {
+	held []transcriber.Segment
+
+	mu       sync.Mutex
+	captions map[int][]transcriber.Segment
+	flushed  int
+}
+
+func (f *fakeTranslator) Caption(index int, segments []transcriber.Segment, langs Languages, stop <-chan struct{}) []transcriber.Segment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.captions == nil {
+		f.captions = map[int][]transcriber.Segment{}
+	}
+	f.captions[index] = segments
+	return segments
+}
+
+func (f *fakeTranslator) Flush(index int, langs Languages) []transcriber.Segment {
+	f.flushed = index
+	return f.held
+}
+
+// fakeEmbedder leaves the video as it is and records the captions embedded
+// into it, relative to the video
+type fakeEmbedder struct {
+	mu       sync.Mutex
+	cues     map[time.Duration][]transcriber.Segment
+	captions []transcriber.Segment
+}
+
+func (f *fakeEmbedder) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cues == nil {
+		f.cues = map[time.Duration][]transcriber.Segment{}
+	}
+	f.cues[streamTime] = segments
+	return nil
+}
+
+func (f *fakeEmbedder) Embed(video []byte, streamTime, videoStart time.Duration) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.captions = append(f.captions, subtitles.ChunkRelative(f.cues[streamTime], videoStart)...)
+	delete(f.cues, streamTime)
+	return video, nil
+}
+
+func (f *fakeEmbedder) Close() error {
+	return nil
+}
+
+// fakeSubtitleSink records the captions written to it. Every write fails
+// with err if it is set, and blocks until release is closed if that is set.
+type fakeSubtitleSink struct {
+	err     error
+	release chan struct{}
+
+	mu      sync.Mutex
+	writes  int
+	texts   []string
+	written []time.Time
+	closed  int
+}
+
+func (f *fakeSubtitleSink) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	if f.release != nil {
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes++
+	if f.err != nil {
+		return f.err
+	}
+	for _, segment := range segments {
+		f.texts = append(f.texts, segment.Text)
+	}
+	f.written = append(f.written, time.Now())
+	return nil
+}
+
+func (f *fakeSubtitleSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed++
+	return nil
+}
+
+// fakeSink keeps what is streamed to it
+type fakeSink struct {
+	preamble []byte
+	streamed bytes.Buffer
+}
+
+func (f *fakeSink) SetPreamble(preamble []byte) {
+	f.preamble = bytes.Clone(preamble)
+}
+
+func (f *fakeSink) Stream(data []byte) error {
+	f.streamed.Write(data)
+	return nil
+}
+
+// videoTimes returns the timestamps of the video frames the sink received
+func (f *fakeSink) videoTimes(t *testing.T) []time.Duration {
+	t.Helper()
+	reader, err := flv.NewReader(io.MultiReader(bytes.NewReader(f.preamble), &f.streamed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Duration
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			return times
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Type == flv.TagVideo && !tag.IsSequenceHeader() {
+			times = append(times, tag.Time())
+		}
+	}
+}
+
+// testConfig returns the configuration of a pipeline under test
+func testConfig(t *testing.T) Config {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return Config{
+		TempDir:        t.TempDir(),
+		ChunkDuration:  testChunk,
+		DriftThreshold: time.Hour,
+		Logger:         logrus.NewEntry(logger),
+	}
+}
+
+func TestRunTranscribeOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds float64
+		want    []int
+	}{
+		{"no audio", 0, nil},
+		{"shorter than a chunk", 0.5, []int{0}},
+		{"whole chunks", 3, []int{0, 1, 2}},
+		{"partial last chunk", 3.5, []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			translator := &fakeTranslator{}
+			p, err := New(testConfig(t), &fakeTranscriber{}, translator, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Run(context.Background(), wavStream(tt.seconds), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if !p.Started() {
+				t.Error("Started() = false after the audio format was read")
+			}
+			if translator.flushed != len(tt.want) {
+				t.Errorf("flushed at chunk %d, want %d", translator.flushed, len(tt.want))
+			}
+			if got := p.ChunkStats().Processed; got != len(tt.want) {
+				t.Errorf("processed %d chunks, want %d", got, len(tt.want))
+			}
+			for _, index := range tt.want {
+				captions := translator.captions[index]
+				// The captions are moved onto the stream timeline
+				offset := (time.Duration(index) * testChunk).Seconds()
+				text := fmt.Sprintf("chunk %d", index)
+				if len(captions) != 1 || captions[0].Start != offset+0.25 || captions[0].End != offset+0.75 || captions[0].Text != text {
+					t.Errorf("captions of chunk %d = %+v, want %q from %gs to %gs", index, captions, text, offset+0.25, offset+0.75)
+				}
+			}
+		})
+	}
+}
+
+func TestRunStreamsChunksInOrder(t *testing.T) {
+	const seconds = 4
+	// Later chunks finish first
+	transcriber := &fakeTranscriber{delay: func(index int) time.Duration {
+		return time.Duration(seconds-index) * 20 * time.Millisecond
+	}}
+	embedder := &fakeEmbedder{}
+	sink := &fakeSink{}
+	cfg := testConfig(t)
+	cfg.SubtitleSinks = []SubtitleSink{embedder}
+	p, err := New(cfg, transcriber, &fakeTranslator{}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background(), wavStream(seconds), flvStream(t, seconds)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every frame went out once, in order
+	times := sink.videoTimes(t)
+	if len(times) != seconds*10 {
+		t.Errorf("sink got %d video frames, want %d", len(times), seconds*10)
+	}
+	if !slices.IsSorted(times) {
+		t.Errorf("sink got the frames out of order: %v", times)
+	}
+	if stats := p.ChunkStats(); stats.Failed != 0 || stats.Dropped != 0 {
+		t.Errorf("ChunkStats() = %+v, want no failed or dropped chunks", stats)
+	}
+
+	// Every chunk got its captions embedded, relative to its video, which
+	// starts with the keyframe at the start of its audio
+	if len(embedder.captions) != seconds {
+		t.Fatalf("embedded %d captions, want %d", len(embedder.captions), seconds)
+	}
+	for _, caption := range embedder.captions {
+		if caption.Start != 0.25 {
+			t.Errorf("caption %q starts at %gs into its chunk, want 0.25s", caption.Text, caption.Start)
+		}
+	}
+}
+
+func TestRunRetriesTranscription(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures map[int]int
+		failed   []int
+	}{
+		{"no failures", nil, nil},
+		{"retried until it works", map[int]int{1: maxRetries - 1}, nil},
+		{"fails every attempt", map[int]int{1: -1}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var failed []int
+			cfg := testConfig(t)
+			cfg.Hooks.ChunkFailed = func(chunk failedchunks.Chunk) {
+				if chunk.Stage != failedchunks.StageTranscription || len(chunk.Video) == 0 {
+					t.Errorf("chunk %d failed in %s with %d bytes of video", chunk.Index, chunk.Stage, len(chunk.Video))
+				}
+				mu.Lock()
+				failed = append(failed, chunk.Index)
+				mu.Unlock()
+			}
+			transcriber := &fakeTranscriber{failures: tt.failures}
+			translator := &fakeTranslator{}
+			sink := &fakeSink{}
+			cfg.SubtitleSinks = []SubtitleSink{&fakeEmbedder{}}
+			p, err := New(cfg, transcriber, translator, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Run(context.Background(), wavStream(3), flvStream(t, 3)); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(failed, tt.failed) {
+				t.Errorf("failed chunks = %v, want %v", failed, tt.failed)
+			}
+			if got := p.ChunkStats().Failed; got != len(tt.failed) {
+				t.Errorf("ChunkStats().Failed = %d, want %d", got, len(tt.failed))
+			}
+			for _, index := range tt.failed {
+				if attempts := transcriber.attempts[index]; attempts != maxRetries {
+					t.Errorf("chunk %d was attempted %d times, want %d", index, attempts, maxRetries)
+				}
+				// Failed chunks are still captioned, to flush what earlier
+				// chunks held back, and their video still goes out
+				if captions, ok := translator.captions[index]; !ok || captions != nil {
+					t.Errorf("failed chunk %d captioned with %v, want nil segments", index, captions)
+				}
+			}
+			if frames := len(sink.videoTimes(t)); frames != 30 {
+				t.Errorf("sink got %d video frames, want 30", frames)
+			}
+		})
+	}
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	testutil.CheckGoroutines(t)
+
+	// Readers that never deliver anything, like an ingest waiting for a
+	// publisher
+	audioReader, audioWriter := io.Pipe()
+	videoReader, videoWriter := io.Pipe()
+	p, err := New(testConfig(t), &fakeTranscriber{}, &fakeTranslator{}, &fakeSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := p.Run(ctx, audioReader, videoReader); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+	if p.Started() {
+		t.Error("Started() = true without audio")
+	}
+	// The readers were closed to unblock them
+	for _, w := range []*io.PipeWriter{audioWriter, videoWriter} {
+		if _, err := w.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("writing to a pipe after Run: %v, want io.ErrClosedPipe", err)
+		}
+	}
+}
+
+func TestRunDrainsQueuedChunks(t *testing.T) {
+	testutil.CheckGoroutines(t)
+	const seconds = 3
+
+	// The first chunk is held in transcription until the stream stopped, so
+	// the others are still queued behind it
+	started, release := make(chan struct{}), make(chan struct{})
+	transcriber := &fakeTranscriber{delay: func(index int) time.Duration {
+		if index == 0 {
+			close(started)
+			<-release
+		}
+		return 0
+	}}
+	cfg := testConfig(t)
+	cfg.SubtitleSinks = []SubtitleSink{&fakeEmbedder{}}
+	sink := &fakeSink{}
+	p, err := New(cfg, transcriber, &fakeTranslator{}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ingest delivers the whole stream and stops, as the listener does
+	// once it is interrupted on Stop
+	audioReader, audioWriter := io.Pipe()
+	videoReader, videoWriter := io.Pipe()
+	streams := map[*io.PipeWriter]io.Reader{audioWriter: wavStream(seconds), videoWriter: flvStream(t, seconds)}
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for w, r := range streams {
+			wg.Add(1)
+			go func(w *io.PipeWriter, r io.Reader) {
+				defer wg.Done()
+				_, err := io.Copy(w, r)
+				w.CloseWithError(err)
+			}(w, r)
+		}
+		wg.Wait()
+		close(stopped)
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- p.Run(context.Background(), audioReader, videoReader) }()
+	for _, ch := range []chan struct{}{started, stopped} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("stream not read up to its end while the first chunk was transcribed")
+		}
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want the queued chunks drained", err)
+	}
+	if got := p.ChunkStats().Processed; got != seconds {
+		t.Errorf("processed %d chunks, want %d", got, seconds)
+	}
+	if frames := len(sink.videoTimes(t)); frames != seconds*10 {
+		t.Errorf("sink got %d video frames, want every frame of the %d chunks", frames, seconds)
+	}
+}
+
+func TestRunNeedsSinkForVideo(t *testing.T) {
+	p, err := New(testConfig(t), &fakeTranscriber{}, &fakeTranslator{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background(), wavStream(1), flvStream(t, 1)); err == nil {
+		t.Error("Run() with video and no sink succeeded")
+	}
+}
+
+func TestSubtitleSinkDisabled(t *testing.T) {
+	const seconds = 4
+	tests := []struct {
+		name        string
+		maxFailures int
+		wantWrites  int
+	}{
+		{"disabled after max failures", 2, 2},
+		{"kept without a limit", 0, seconds + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := &fakeSubtitleSink{err: errors.New("unreachable")}
+			healthy := &fakeSubtitleSink{}
+			embedder := &fakeEmbedder{}
+			cfg := testConfig(t)
+			cfg.MaxSinkFailures = tt.maxFailures
+			cfg.SubtitleSinks = []SubtitleSink{failing, embedder, healthy}
+			// The held-back captions are written once more after the last
+			// chunk
+			translator := &fakeTranslator{held: []transcriber.Segment{{Start: 4.25, End: 4.75, Text: "held"}}}
+			sink := &fakeSink{}
+			p, err := New(cfg, &fakeTranscriber{}, translator, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Run(context.Background(), wavStream(seconds), flvStream(t, seconds)); err != nil {
+				t.Fatal(err)
+			}
+
+			if failing.writes != tt.wantWrites {
+				t.Errorf("failing sink was written %d times, want %d", failing.writes, tt.wantWrites)
+			}
+			// The failing sink holds up neither the others nor the stream
+			if len(healthy.texts) != seconds+1 {
+				t.Errorf("healthy sink got %q, want the captions of every chunk and the held ones", healthy.texts)
+			}
+			if len(embedder.captions) != seconds {
+				t.Errorf("embedded %d captions, want %d", len(embedder.captions), seconds)
+			}
+			if frames := len(sink.videoTimes(t)); frames != seconds*10 {
+				t.Errorf("sink got %d video frames, want %d", frames, seconds*10)
+			}
+			if stats := p.ChunkStats(); stats.Failed != 0 {
+				t.Errorf("ChunkStats() = %+v, want no failed chunks", stats)
+			}
+			// Disabled sinks are still closed
+			if failing.closed != 1 || healthy.closed != 1 {
+				t.Errorf("sinks closed %d and %d times, want once", failing.closed, healthy.closed)
+			}
+		})
+	}
+}
+
+func TestSlowSubtitleSink(t *testing.T) {
+	const chunks = 2 * sinkBuffer
+	slow := &fakeSubtitleSink{release: make(chan struct{})}
+	cfg := testConfig(t)
+	cfg.SubtitleSinks = []SubtitleSink{slow}
+	translator := &fakeTranslator{}
+	p, err := New(cfg, &fakeTranscriber{}, translator, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.Run(context.Background(), wavStream(chunks), nil)
+	}()
+
+	// Every chunk is captioned while the sink is stuck on the first
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.WaitFor(ctx, 10*time.Millisecond, func() bool {
+		translator.mu.Lock()
+		defer translator.mu.Unlock()
+		return len(translator.captions) == chunks
+	})
+	if ctx.Err() != nil {
+		t.Fatal("chunks weren't captioned while the subtitle sink was stuck")
+	}
+
+	// Once it gets going, the sink gets what it didn't fall too far behind
+	// on, and the stream ends once it has
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(slow.texts) < sinkBuffer || len(slow.texts) >= chunks {
+		t.Errorf("slow sink got %d captions, want at least %d with the rest dropped", len(slow.texts), sinkBuffer)
+	}
+	if slow.closed != 1 {
+		t.Errorf("slow sink closed %d times, want once", slow.closed)
+	}
+}
+
+func TestDelayedSubtitleSink(t *testing.T) {
+	const seconds = 4
+	const streamDelay = 200 * time.Millisecond
+	tests := []struct {
+		name        string
+		streamDelay time.Duration
+		dumpedUntil time.Duration
+		delayed     bool
+		want        []string
+	}{
+		{"no stream delay", 0, 0, false, []string{"chunk 0", "chunk 1", "chunk 2", "chunk 3"}},
+		{"delayed", streamDelay, 0, true, []string{"chunk 0", "chunk 1", "chunk 2", "chunk 3"}},
+		{"dumped left out", streamDelay, 2 * time.Second, true, []string{"chunk 2", "chunk 3"}},
+		// Only what is delayed can still be dumped
+		{"dumped without stream delay", 0, 2 * time.Second, false, []string{"chunk 0", "chunk 1", "chunk 2", "chunk 3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delayed := &fakeSubtitleSink{}
+			cfg := testConfig(t)
+			cfg.StreamDelay = tt.streamDelay
+			cfg.SubtitleSinks = []SubtitleSink{Delayed(delayed)}
+			p, err := New(cfg, &fakeTranscriber{}, &fakeTranslator{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.mod.dumpedUntil.Store(int64(tt.dumpedUntil))
+
+			started := time.Now()
+			if err := p.Run(context.Background(), wavStream(seconds), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			slices.Sort(delayed.texts)
+			if !slices.Equal(delayed.texts, tt.want) {
+				t.Errorf("delayed sink got %q, want %q", delayed.texts, tt.want)
+			}
+			for _, written := range delayed.written {
+				if early := written.Sub(started) < tt.streamDelay; early && tt.delayed {
+					t.Errorf("captions written %v after the start, before the stream delay", written.Sub(started))
+				}
+			}
+		})
+	}
+}
+
+func TestDelayedSubtitleSinkStopped(t *testing.T) {
+	testutil.CheckGoroutines(t)
+
+	// Captions still held back when the stream is stopped are dropped
+	// rather than waited for
+	delayed := &fakeSubtitleSink{}
+	cfg := testConfig(t)
+	cfg.StreamDelay = time.Hour
+	cfg.SubtitleSinks = []SubtitleSink{Delayed(delayed)}
+	translator := &fakeTranslator{}
+	p, err := New(cfg, &fakeTranscriber{}, translator, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	audioReader, audioWriter := io.Pipe()
+	go func() {
+		io.Copy(audioWriter, wavStream(2))
+		testutil.WaitFor(ctx, 10*time.Millisecond, func() bool {
+			translator.mu.Lock()
+			defer translator.mu.Unlock()
+			return len(translator.captions) == 2
+		})
+		cancel()
+	}()
+	if err := p.Run(ctx, audioReader, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+	if len(delayed.texts) != 0 || delayed.closed != 1 {
+		t.Errorf("delayed sink got %q and was closed %d times, want nothing and closed once", delayed.texts, delayed.closed)
+	}
+}
+
+func TestInputLevel(t *testing.T) {
+	quiet := audio.Loudness{PeakDBFS: -30, RMSDBFS: -40}
+	normal := audio.Loudness{PeakDBFS: -3, RMSDBFS: -18}
+	clipping := audio.Loudness{PeakDBFS: 0, RMSDBFS: -6, ClippedPercent: 5}
+
+	tests := []struct {
+		name string
+		// chunks are the loudness of the chunks in order
+		chunks []audio.Loudness
+		// quietDB and clippedPercent are the thresholds, 0 to disable
+		quietDB, clippedPercent float64
+		// wantQuiet and wantClipped are the chunks warned at, -1 for none
+		wantQuiet, wantClipped int
+	}{
+		{"normal", repeat(normal, 2*levelWindow), -35, 1, -1, -1},
+		{"quiet warned once after the window", repeat(quiet, 3*levelWindow), -35, 1, levelWindow - 1, -1},
+		{"clipping warned once after the window", repeat(clipping, 3*levelWindow), -35, 1, -1, levelWindow - 1},
+		{"too short to warn", repeat(quiet, levelWindow-1), -35, 1, -1, -1},
+		{"quiet stretch averaged out", append(repeat(normal, levelWindow), repeat(quiet, levelWindow/2)...), -35, 1, -1, -1},
+		{"sustained quiet after normal", append(repeat(normal, levelWindow), repeat(quiet, 2*levelWindow)...), -35, 1, 2*levelWindow - 3, -1},
+		{"thresholds disabled", append(repeat(quiet, levelWindow), repeat(clipping, 2*levelWindow)...), 0, 0, -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var level inputLevel
+			gotQuiet, gotClipped := -1, -1
+			for i, chunk := range tt.chunks {
+				_, quiet, clipped := level.observe(chunk, tt.quietDB, tt.clippedPercent)
+				if quiet {
+					if gotQuiet >= 0 {
+						t.Errorf("quiet warned again at chunk %d", i)
+					}
+					gotQuiet = i
+				}
+				if clipped {
+					if gotClipped >= 0 {
+						t.Errorf("clipping warned again at chunk %d", i)
+					}
+					gotClipped = i
+				}
+			}
+			if gotQuiet != tt.wantQuiet || gotClipped != tt.wantClipped {
+				t.Errorf("warned quiet at %d and clipping at %d, want %d and %d", gotQuiet, gotClipped, tt.wantQuiet, tt.wantClipped)
+			}
+		})
+	}
+}
+
+// repeat returns n copies of loudness
+func repeat(loudness audio.Loudness, n int) []audio.Loudness {
+	chunks := make([]audio.Loudness, n)
+	for i := range chunks {
+		chunks[i] = loudness
+	}
+	return chunks
+}
@@ -0,0 +1,179 @@
+// Package preview serves the stream sent to the targets as HTTP-FLV, so what
+// goes out, captions included, can be watched locally with a player such as
+// VLC or flv.js. It is fed in-process by the streamer and never holds up the
+// targets: viewers that fall behind are disconnected.
+package preview
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// viewerBuffer is how many writes of the streamer a viewer may fall
+	// behind before it is disconnected
+	viewerBuffer = 4
+
+	// writeTimeout bounds a single write to a viewer, so one that stopped
+	// reading doesn't keep its connection open
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNoStream means no stream is being sent to the targets
+	ErrNoStream = errors.New("no stream to preview")
+	// ErrTooManyViewers means the most viewers allowed are watching
+	ErrTooManyViewers = errors.New("too many preview viewers")
+)
+
+// Preview fans the stream out to the connected viewers. It is safe for
+// concurrent use.
+type Preview struct {
+	maxViewers int
+	logger     *logrus.Entry
+
+	mu       sync.Mutex
+	preamble []byte // FLV header and sequence headers, nil without a stream
+	viewers  map[*viewer]struct{}
+}
+
+// viewer is a connected player
+type viewer struct {
+	data chan []byte
+	gone chan struct{} // Closed once the preview disconnects the viewer
+	slow bool          // Disconnected for falling behind
+}
+
+// New creates a preview allowing maxViewers viewers at a time
+func New(maxViewers int, logger *logrus.Logger) *Preview {
+	return &Preview{
+		maxViewers: maxViewers,
+		logger:     logger.WithField("component", "preview"),
+		viewers:    make(map[*viewer]struct{}),
+	}
+}
+
+// SetPreamble sets what viewers get first when they connect, the FLV header
+// and sequence headers of the stream
+func (p *Preview) SetPreamble(preamble []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !bytes.Equal(p.preamble, preamble) {
+		p.preamble = append([]byte(nil), preamble...)
+	}
+}
+
+// Write sends data, which follows the preamble, to every viewer. Viewers
+// that fell behind are disconnected instead of waited for.
+func (p *Preview) Write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.viewers) == 0 {
+		return
+	}
+
+	// The viewers share one copy
+	data = append([]byte(nil), data...)
+	for v := range p.viewers {
+		select {
+		case v.data <- data:
+		default:
+			v.slow = true
+			p.disconnect(v)
+		}
+	}
+}
+
+// End disconnects all viewers once the stream ended
+func (p *Preview) End() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.preamble = nil
+	for v := range p.viewers {
+		p.disconnect(v)
+	}
+}
+
+// disconnect removes a viewer; the caller must hold p.mu
+func (p *Preview) disconnect(v *viewer) {
+	delete(p.viewers, v)
+	close(v.gone)
+}
+
+// join adds a viewer, returning it with the preamble to send first
+func (p *Preview) join() (*viewer, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.preamble == nil {
+		return nil, nil, ErrNoStream
+	}
+	if len(p.viewers) >= p.maxViewers {
+		return nil, nil, ErrTooManyViewers
+	}
+
+	v := &viewer{data: make(chan []byte, viewerBuffer), gone: make(chan struct{})}
+	p.viewers[v] = struct{}{}
+	return v, p.preamble, nil
+}
+
+// leave removes a viewer that went away, reporting whether the preview
+// disconnected it for falling behind
+func (p *Preview) leave(v *viewer) (slow bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.viewers[v]; ok {
+		p.disconnect(v)
+	}
+	return v.slow
+}
+
+// Serve streams the preview to w until the viewer goes away, the stream ends,
+// or the viewer falls behind. ErrNoStream and ErrTooManyViewers are returned
+// before anything is written.
+func (p *Preview) Serve(w http.ResponseWriter, r *http.Request) error {
+	v, preamble, err := p.join()
+	if err != nil {
+		return err
+	}
+
+	logger := p.logger.WithField("remote_addr", r.RemoteAddr)
+	logger.Info("Preview viewer connected")
+
+	controller := http.NewResponseController(w)
+	write := func(data []byte) error {
+		// Not every writer supports deadlines, those write without one
+		controller.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	err = write(preamble)
+	for err == nil {
+		select {
+		case data := <-v.data:
+			err = write(data)
+		case <-v.gone:
+			err = ErrNoStream
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		}
+	}
+
+	if p.leave(v) {
+		logger.Warn("Disconnected preview viewer that fell behind")
+	} else {
+		logger.Info("Preview viewer disconnected")
+	}
+	return nil
+}
@@ -0,0 +1,561 @@
+// Package procs keeps track of the child processes the proxy starts, like
+// the FFmpeg listener, embedders, and target processes, so one that silently
+// dies can be seen: every process is recorded with its role, pid, and
+// arguments, and exits nobody asked for are reported with its last output.
+// Every child process is counted by role, and starts wait while the
+// configured number of them is running.
+package procs
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// stderrTailSize is how much recent output of a process is kept for the
+// report of an unexpected exit
+const stderrTailSize = 2048
+
+// historySize is how many exited processes are kept in the registry
+const historySize = 32
+
+// Roles of the processes
+const (
+	RoleListener    = "listener"
+	RoleEmbedder    = "embedder"
+	RoleTarget      = "target"
+	RoleTranscriber = "transcriber" // Whisper and the conversion of its input
+	RoleTranslator  = "translator"  // argos-translate and its worker
+	RoleDecoder     = "decoder"     // Decoding and encoding audio
+	RoleVideo       = "video"       // Rewriting the video of stream chunks
+	RoleMuxer       = "muxer"       // Remuxing recordings
+)
+
+// Info describes a process in the registry
+type Info struct {
+	ID        int       `json:"id"`
+	Role      string    `json:"role"`
+	PID       int       `json:"pid"`
+	Args      []string  `json:"args"` // Secrets and URL credentials are redacted
+	StartedAt time.Time `json:"started_at"`
+
+	// Set once the process has exited. Unexpected marks exits with a nonzero
+	// code that weren't asked for, and Stderr holds the end of their output if it
+	// was captured.
+	ExitedAt   *time.Time `json:"exited_at,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Unexpected bool       `json:"unexpected,omitempty"`
+	Stderr     string     `json:"stderr,omitempty"`
+}
+
+// Options describe a process to start
+type Options struct {
+	Role string
+	// Secrets are replaced by **** in the recorded arguments and output
+	Secrets []string
+	// Stderr keeps the end of the process output for the report of an
+	// unexpected exit. It must stay off for processes whose stderr carries
+	// data rather than messages.
+	Stderr bool
+}
+
+// Process is a child process started through the registry. Its exit is
+// waited for by the registry, so callers wait with Wait rather than on the
+// command.
+type Process struct {
+	Cmd *exec.Cmd
+
+	secrets []string
+	tail    *TailBuffer
+	done    chan struct{}
+	err     error
+
+	mu       sync.Mutex
+	info     Info
+	expected bool
+}
+
+// Wait waits for the process to exit and returns the error of cmd.Wait
+func (p *Process) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// Done returns a channel closed once the process has exited
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// ExpectExit marks the exit of the process as asked for, e.g. before its
+// stdin is closed, so it isn't reported whatever its exit code
+func (p *Process) ExpectExit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expected = true
+}
+
+// Signal sends sig to the process, which is expected to exit
+func (p *Process) Signal(sig os.Signal) error {
+	p.ExpectExit()
+	return p.Cmd.Process.Signal(sig)
+}
+
+// Kill kills the process
+func (p *Process) Kill() error {
+	p.ExpectExit()
+	return p.Cmd.Process.Kill()
+}
+
+// Info returns what is known about the process
+func (p *Process) Info() Info {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info
+}
+
+// Limits bound the CPU taken by FFmpeg processes, which compete with Whisper
+// on shared hosts, and how many child processes run at once
+type Limits struct {
+	Threads int // Threads per input and output, 0 for FFmpeg's choice
+	Nice    int // Niceness, 0 to keep the proxy's
+	// MaxProcesses is how many child processes of any role may run at once,
+	// 0 for no cap. Starts beyond it wait for a process to exit, so it must
+	// leave room for the listener and the target processes, which keep
+	// running.
+	MaxProcesses int
+}
+
+var limits atomic.Pointer[Limits]
+
+// SetLimits sets the limits of the FFmpeg commands built from now on
+func SetLimits(l Limits) {
+	limits.Store(&l)
+}
+
+// currentLimits returns the limits set, if any
+func currentLimits() Limits {
+	if l := limits.Load(); l != nil {
+		return *l
+	}
+	return Limits{}
+}
+
+// flagOptions are the FFmpeg options the proxy uses that take no value
+var flagOptions = map[string]bool{
+	"-y": true, "-n": true, "-re": true, "-vn": true, "-an": true, "-sn": true,
+	"-shortest": true, "-nostats": true, "-nostdin": true, "-hide_banner": true,
+}
+
+// FFmpeg returns a command running FFmpeg with args, limited to the
+// configured threads. It runs in its own process group, which Start, Launch,
+// and Run give the configured niceness once it has started.
+func FFmpeg(args ...string) *exec.Cmd {
+	return FFmpegContext(context.Background(), args...)
+}
+
+// FFmpegContext is FFmpeg with a context that kills the process once done
+func FFmpegContext(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "ffmpeg", threadArgs(args, currentLimits().Threads)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// threadArgs returns FFmpeg args with -threads before every input and
+// output, or args as they are if threads is 0
+func threadArgs(args []string, threads int) []string {
+	if threads <= 0 {
+		return args
+	}
+	n := strconv.Itoa(threads)
+
+	limited := make([]string, 0, len(args)+6)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-i":
+			limited = append(limited, "-threads", n, arg)
+			if i+1 < len(args) {
+				i++
+				limited = append(limited, args[i])
+			}
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+			limited = append(limited, arg)
+			if !flagOptions[arg] && i+1 < len(args) {
+				i++
+				limited = append(limited, args[i])
+			}
+		default:
+			// Anything else is an output
+			limited = append(limited, "-threads", n, arg)
+		}
+	}
+	return limited
+}
+
+// Launch starts cmd like cmd.Start without recording it, applying the
+// limits if it was built by FFmpeg. It waits while MaxProcesses are running.
+// The process counts as running until it is waited for with Wait.
+func Launch(cmd *exec.Cmd, role string) error {
+	running.acquire(cmd, role)
+	if err := cmd.Start(); err != nil {
+		running.release(cmd)
+		return err
+	}
+	applyLimits(cmd)
+	return nil
+}
+
+// Wait waits for cmd, started by Launch, like cmd.Wait
+func Wait(cmd *exec.Cmd) error {
+	defer running.release(cmd)
+	return cmd.Wait()
+}
+
+// Run runs cmd like cmd.Run without recording it, applying the limits if it
+// was built by FFmpeg
+func Run(cmd *exec.Cmd, role string) error {
+	if err := Launch(cmd, role); err != nil {
+		return err
+	}
+	return Wait(cmd)
+}
+
+// counter counts the running child processes by role and holds back starts
+// beyond the cap
+type counter struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	roles   map[*exec.Cmd]string
+	waiting int
+}
+
+// running counts the child processes of the proxy
+var running = newCounter()
+
+// newCounter creates a counter without processes
+func newCounter() *counter {
+	c := &counter{roles: make(map[*exec.Cmd]string)}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire counts cmd as running, first waiting for it to fit under the cap
+func (c *counter) acquire(cmd *exec.Cmd, role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		limit := currentLimits().MaxProcesses
+		if limit <= 0 || len(c.roles) < limit {
+			break
+		}
+		c.waiting++
+		c.changed.Wait()
+		c.waiting--
+	}
+	c.roles[cmd] = role
+}
+
+// release stops counting cmd
+func (c *counter) release(cmd *exec.Cmd) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.roles[cmd]; ok {
+		delete(c.roles, cmd)
+		c.changed.Broadcast()
+	}
+}
+
+// Usage is what the proxy and its child processes take of their limits
+type Usage struct {
+	Processes    int            `json:"processes"` // Running child processes
+	ByRole       map[string]int `json:"by_role,omitempty"`
+	Waiting      int            `json:"waiting,omitempty"`       // Starts held back by MaxProcesses
+	MaxProcesses int            `json:"max_processes,omitempty"` // 0 for no cap
+	// ProcessLimit is the limit on processes of the user, which the threads
+	// of the proxy count towards, 0 if unlimited
+	ProcessLimit uint64 `json:"process_limit,omitempty"`
+	OpenFiles    int    `json:"open_files"`           // Of the proxy, -1 if unknown
+	FileLimit    uint64 `json:"file_limit,omitempty"` // 0 if unlimited
+}
+
+// rlimitNproc is RLIMIT_NPROC on Linux, which package syscall doesn't name
+const rlimitNproc = 6
+
+// CurrentUsage returns the usage of the limits now
+func CurrentUsage() Usage {
+	usage := Usage{
+		ByRole:       make(map[string]int),
+		MaxProcesses: max(currentLimits().MaxProcesses, 0),
+		OpenFiles:    -1,
+	}
+
+	running.mu.Lock()
+	usage.Processes = len(running.roles)
+	usage.Waiting = running.waiting
+	for _, role := range running.roles {
+		usage.ByRole[role]++
+	}
+	running.mu.Unlock()
+
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		usage.OpenFiles = len(fds)
+	}
+	usage.FileLimit = rlimit(syscall.RLIMIT_NOFILE)
+	usage.ProcessLimit = rlimit(rlimitNproc)
+	return usage
+}
+
+// rlimit returns the soft limit on resource, 0 if unlimited or unknown
+func rlimit(resource int) uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &limit); err != nil || limit.Cur == ^uint64(0) {
+		return 0
+	}
+	return limit.Cur
+}
+
+// TopRoles returns the roles with the most running processes, most first,
+// as role=count
+func (u Usage) TopRoles(n int) []string {
+	roles := make([]string, 0, len(u.ByRole))
+	for role := range u.ByRole {
+		roles = append(roles, role)
+	}
+	slices.SortFunc(roles, func(a, b string) int {
+		if u.ByRole[a] != u.ByRole[b] {
+			return u.ByRole[b] - u.ByRole[a]
+		}
+		return strings.Compare(a, b)
+	})
+
+	top := make([]string, 0, min(n, len(roles)))
+	for _, role := range roles[:min(n, len(roles))] {
+		top = append(top, role+"="+strconv.Itoa(u.ByRole[role]))
+	}
+	return top
+}
+
+// applyLimits gives a started process in its own group the configured
+// niceness. It is best effort: the process may already have exited, and
+// lowering the niceness takes privileges.
+func applyLimits(cmd *exec.Cmd) {
+	nice := currentLimits().Nice
+	if nice == 0 || cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setpgid {
+		return
+	}
+	_ = syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, nice)
+}
+
+// CommandError is the error of a command that failed, with what it takes to
+// run it again
+type CommandError struct {
+	Args   []string // The command and its arguments
+	Stderr string
+	// Inputs holds data the command read from pipes or temporary files,
+	// by file name, e.g. "subtitles.srt"
+	Inputs map[string][]byte
+	Err    error
+}
+
+// CommandFailed wraps err, the error of cmd, in a CommandError
+func CommandFailed(cmd *exec.Cmd, stderr string, inputs map[string][]byte, err error) *CommandError {
+	return &CommandError{Args: cmd.Args, Stderr: stderr, Inputs: inputs, Err: err}
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Registry records the child processes started through it
+type Registry struct {
+	mu      sync.Mutex
+	nextID  int
+	running []*Process
+	exited  []Info // Oldest first, at most historySize
+	onExit  func(Info)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry of the proxy
+var Default = NewRegistry()
+
+// Start starts cmd and records it in the default registry
+func Start(cmd *exec.Cmd, opts Options) (*Process, error) {
+	return Default.Start(cmd, opts)
+}
+
+// List returns the processes of the default registry
+func List() []Info {
+	return Default.List()
+}
+
+// OnUnexpectedExit sets the function called with every process of the
+// default registry that exits unexpectedly
+func OnUnexpectedExit(fn func(Info)) {
+	Default.OnUnexpectedExit(fn)
+}
+
+// OnUnexpectedExit sets the function called with every process that exits
+// unexpectedly. It is called from the goroutine waiting for the process.
+func (r *Registry) OnUnexpectedExit(fn func(Info)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onExit = fn
+}
+
+// Start starts cmd and records it until it exits
+func (r *Registry) Start(cmd *exec.Cmd, opts Options) (*Process, error) {
+	p := &Process{
+		Cmd:     cmd,
+		secrets: opts.Secrets,
+		done:    make(chan struct{}),
+	}
+	if opts.Stderr {
+		p.tail = NewTailBuffer(stderrTailSize)
+		if cmd.Stderr != nil {
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, p.tail)
+		} else {
+			cmd.Stderr = p.tail
+		}
+	}
+
+	if err := Launch(cmd, opts.Role); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.nextID++
+	p.info = Info{
+		ID:        r.nextID,
+		Role:      opts.Role,
+		PID:       cmd.Process.Pid,
+		Args:      redactArgs(cmd.Args, opts.Secrets),
+		StartedAt: time.Now(),
+	}
+	r.running = append(r.running, p)
+	r.mu.Unlock()
+
+	go r.wait(p)
+	return p, nil
+}
+
+// wait waits for p to exit and moves it to the history
+func (r *Registry) wait(p *Process) {
+	p.err = Wait(p.Cmd)
+
+	exitedAt := time.Now()
+	exitCode := -1
+	if p.Cmd.ProcessState != nil {
+		exitCode = p.Cmd.ProcessState.ExitCode()
+	}
+
+	p.mu.Lock()
+	p.info.ExitedAt = &exitedAt
+	p.info.ExitCode = &exitCode
+	p.info.Unexpected = exitCode != 0 && !p.expected
+	if p.info.Unexpected && p.tail != nil {
+		p.info.Stderr = Redact(p.tail.String(), p.secrets)
+	}
+	info := p.info
+	p.mu.Unlock()
+
+	r.mu.Lock()
+	r.running = slices.DeleteFunc(r.running, func(running *Process) bool { return running == p })
+	r.exited = append(r.exited, info)
+	if excess := len(r.exited) - historySize; excess > 0 {
+		r.exited = append(r.exited[:0:0], r.exited[excess:]...)
+	}
+	onExit := r.onExit
+	r.mu.Unlock()
+
+	close(p.done)
+
+	if info.Unexpected && onExit != nil {
+		onExit(info)
+	}
+}
+
+// List returns the running processes and the last ones that exited, in the
+// order they were started
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	running := slices.Clone(r.running)
+	infos := slices.Clone(r.exited)
+	r.mu.Unlock()
+
+	for _, p := range running {
+		infos = append(infos, p.Info())
+	}
+	slices.SortFunc(infos, func(a, b Info) int { return a.ID - b.ID })
+	return infos
+}
+
+// redactArgs returns args with secrets and the credentials of URLs replaced
+func redactArgs(args, secrets []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if u, err := url.Parse(arg); err == nil && u.Scheme != "" && u.User != nil {
+			arg = strings.Replace(arg, u.User.String()+"@", "****@", 1)
+		}
+		redacted[i] = Redact(arg, secrets)
+	}
+	return redacted
+}
+
+// Redact replaces secrets in s with ****
+func Redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "****")
+		}
+	}
+	return s
+}
+
+// TailBuffer keeps the last bytes written to it, like the end of the output
+// of a process
+type TailBuffer struct {
+	size int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewTailBuffer creates a buffer keeping the last size bytes written to it
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{size: size}
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if excess := len(t.buf) - t.size; excess > 0 {
+		t.buf = append(t.buf[:0:0], t.buf[excess:]...)
+	}
+	return len(p), nil
+}
+
+func (t *TailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
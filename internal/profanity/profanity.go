@@ -0,0 +1,172 @@
+// Package profanity masks words from configurable wordlists in caption text.
+// Matching is whole-word and case-insensitive, with simple leetspeak
+// normalization so "sh1t" matches "shit".
+package profanity
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+// langPlaceholder in the wordlist path is replaced with the caption language
+const langPlaceholder = "{lang}"
+
+// wordPattern matches the words of a caption, including leetspeak characters
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}@$!]+`)
+
+// leetReplacer undoes common leetspeak substitutions
+var leetReplacer = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"@", "a",
+	"$", "s",
+	"!", "i",
+)
+
+// Filter masks profanity in segments
+type Filter struct {
+	pathTemplate string
+	placeholder  string
+	logger       *logrus.Logger
+
+	mu    sync.Mutex
+	lists map[string]map[string]struct{}
+}
+
+// New creates a filter reading wordlists from pathTemplate, in which {lang} is
+// replaced with the language being filtered. Matches are replaced with
+// placeholder, or with one asterisk per character if placeholder is empty.
+// An empty pathTemplate disables the filter.
+func New(pathTemplate, placeholder string, logger *logrus.Logger) *Filter {
+	return &Filter{
+		pathTemplate: pathTemplate,
+		placeholder:  placeholder,
+		logger:       logger,
+		lists:        make(map[string]map[string]struct{}),
+	}
+}
+
+// Enabled reports whether a wordlist is configured
+func (f *Filter) Enabled() bool {
+	return f.pathTemplate != ""
+}
+
+// MaskSegments returns copies of segments with profanity from the wordlist of
+// lang masked, and whether anything was masked
+func (f *Filter) MaskSegments(segments []transcriber.Segment, lang string) ([]transcriber.Segment, bool) {
+	if !f.Enabled() {
+		return segments, false
+	}
+
+	words := f.wordlist(lang)
+	if len(words) == 0 {
+		return segments, false
+	}
+
+	masked := make([]transcriber.Segment, len(segments))
+	anyMasked := false
+	for i, segment := range segments {
+		masked[i] = segment
+		text, changed := f.mask(segment.Text, words)
+		if changed {
+			masked[i].Text = text
+			anyMasked = true
+		}
+	}
+
+	return masked, anyMasked
+}
+
+// mask replaces every word of text found in words
+func (f *Filter) mask(text string, words map[string]struct{}) (string, bool) {
+	changed := false
+	result := wordPattern.ReplaceAllStringFunc(text, func(word string) string {
+		// Trailing exclamation marks are punctuation, not leetspeak
+		core := strings.TrimRight(word, "!")
+		if core == "" {
+			return word
+		}
+
+		if _, found := words[normalize(core)]; !found {
+			return word
+		}
+
+		changed = true
+		replacement := f.placeholder
+		if replacement == "" {
+			replacement = strings.Repeat("*", utf8.RuneCountInString(core))
+		}
+		return replacement + word[len(core):]
+	})
+
+	return result, changed
+}
+
+// wordlist returns the words for lang, loading the list on first use
+func (f *Filter) wordlist(lang string) map[string]struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if words, loaded := f.lists[lang]; loaded {
+		return words
+	}
+
+	path := strings.ReplaceAll(f.pathTemplate, langPlaceholder, lang)
+	words, err := load(path)
+	if err != nil {
+		// Without a list for this language nothing is masked; remember that so
+		// the file isn't looked up for every chunk
+		f.logger.WithError(err).WithField("lang", lang).Warn("No profanity wordlist loaded")
+	} else {
+		f.logger.WithFields(logrus.Fields{
+			"lang":  lang,
+			"path":  path,
+			"words": len(words),
+		}).Info("Loaded profanity wordlist")
+	}
+
+	f.lists[lang] = words
+	return words
+}
+
+// load reads a wordlist with one word per line. Blank lines and lines
+// starting with # are ignored.
+func load(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profanity wordlist: %w", err)
+	}
+	defer file.Close()
+
+	words := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words[normalize(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profanity wordlist: %w", err)
+	}
+
+	return words, nil
+}
+
+// normalize lowercases a word and undoes leetspeak substitutions
+func normalize(word string) string {
+	return leetReplacer.Replace(strings.ToLower(word))
+}
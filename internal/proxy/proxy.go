@@ -2,466 +2,4748 @@
 // This implementation is designed to handle a single stream at a time,
 // transcribe the audio using Whisper, optionally translate the transcription,
 // embed subtitles into the video, and forward the processed stream to target URLs.
+// In passthrough mode the stream is relayed to the targets without any processing.
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ben/transcription-proxy/internal/audio"
 	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/delay"
+	"github.com/ben/transcription-proxy/internal/diskspace"
+	"github.com/ben/transcription-proxy/internal/events"
+	"github.com/ben/transcription-proxy/internal/failedchunks"
+	"github.com/ben/transcription-proxy/internal/flv"
+	"github.com/ben/transcription-proxy/internal/logdedup"
+	"github.com/ben/transcription-proxy/internal/models"
+	"github.com/ben/transcription-proxy/internal/mqtt"
+	"github.com/ben/transcription-proxy/internal/netstat"
+	"github.com/ben/transcription-proxy/internal/pipeline"
+	"github.com/ben/transcription-proxy/internal/preview"
+	"github.com/ben/transcription-proxy/internal/procs"
+	"github.com/ben/transcription-proxy/internal/profanity"
+	"github.com/ben/transcription-proxy/internal/reflow"
+	"github.com/ben/transcription-proxy/internal/scheduler"
+	"github.com/ben/transcription-proxy/internal/searchindex"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/ben/transcription-proxy/internal/sessionlog"
+	"github.com/ben/transcription-proxy/internal/speaker"
+	"github.com/ben/transcription-proxy/internal/spool"
+	"github.com/ben/transcription-proxy/internal/statusfile"
 	"github.com/ben/transcription-proxy/internal/streaming"
 	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/textnorm"
 	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/ben/transcription-proxy/internal/transcript"
 	"github.com/ben/transcription-proxy/internal/translator"
+	"github.com/ben/transcription-proxy/internal/twitch"
+	"github.com/ben/transcription-proxy/internal/upload"
+	"github.com/ben/transcription-proxy/internal/version"
+	"github.com/ben/transcription-proxy/internal/youtube"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrShutdownForced is returned by Stop when in-flight chunks could not be
+// drained before the shutdown deadline and had to be abandoned
+var ErrShutdownForced = errors.New("shutdown deadline exceeded, in-flight chunks abandoned")
+
+// ErrNoActiveStream is returned by operations that need a running stream
+var ErrNoActiveStream = errors.New("no active stream")
+
+// ErrNoTranscript is returned when flushing the transcript of a stream whose
+// transcript files couldn't be created
+var ErrNoTranscript = errors.New("active stream has no transcript files")
+
+// ErrNoDelay is returned when dumping output without STREAM_DELAY
+var ErrNoDelay = errors.New("stream delay is disabled")
+
+// ErrSessionBusy is returned when a session can't be reprocessed yet because
+// it is still streaming or its recording is being remuxed
+var ErrSessionBusy = errors.New("session is still being processed")
+
+// ErrNoRecording is returned when reprocessing a session that wasn't recorded
+var ErrNoRecording = errors.New("session has no recording")
+
+// ErrInvalidOptions is returned for reprocess options that can't be applied
+var ErrInvalidOptions = errors.New("invalid reprocess options")
+
+// ErrInvalidTarget is returned for a target that can't be added to the
+// active stream
+var ErrInvalidTarget = errors.New("invalid target")
+
+// ErrOutputDisabled is returned when writing session artifacts while
+// OUTPUT_DIR isn't writable
+var ErrOutputDisabled = errors.New("output directory is not writable, session artifacts are disabled")
+
+// Formats of the process and session logs
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// chunkDuration is the length of the audio chunks transcribed at once
+const chunkDuration = 10 * time.Second
+
+// Transcriber turns audio into segments. It is implemented by
+// *transcriber.Transcriber, and by fakes in tests.
+type Transcriber interface {
+	TranscribeAudio(tempDir string, audioBytes []byte, format audio.Format, lang string) ([]transcriber.Segment, error)
+	TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error)
+	CheckDecodingOptions() error
+	VerifyModel() error
+	ModelDir() string
+}
+
 // Proxy represents an RTMP server that handles incoming streams
 type Proxy struct {
 	Config      *config.Config `json:"config"`
-	transcriber *transcriber.Transcriber
+	transcriber Transcriber
 	translator  *translator.Translator
-	embedder    *subtitles.SubtitleEmbedder
+	wrapper     *subtitles.Wrapper
+	profanity   *profanity.Filter
+	normalizer  *textnorm.Normalizer
 	logger      *logrus.Logger
-	ffmpegCmd   *exec.Cmd
-	stopChan    chan struct{}
+	diskMonitor *diskspace.Monitor
+	models      *models.Manager
+	listener    atomic.Pointer[procs.Process]
+
+	// events carries captions and lifecycle events to publishers outside
+	// the media path
+	events *events.Bus
+
+	// profiles are the encoding profiles targets can select
+	profiles map[string]*streaming.Profile
+
+	// activeMu guards active, the stream currently being processed, and
+	// relay, the streamer of passthrough mode
+	activeMu sync.Mutex
+	active   *activeSession
+	relay    *streaming.Streamer
+
+	// languagesMu serializes changes to the languages of the active stream
+	languagesMu sync.Mutex
+
+	// scheduler runs every transcription, live chunks ahead of ad-hoc jobs
+	// and reprocessing
+	scheduler *scheduler.Scheduler
+
+	// confidence tracks the recent transcription confidence
+	confidence *confidenceTracker
+
+	// fallback tracks the cheaper settings used after GPU out-of-memory
+	// errors
+	fallback *pipeline.FallbackTracker
+	// vram checks the free GPU memory before transcriptions
+	vram *pipeline.VRAMGuard
+
+	// audioTrack is the audio track of the stream being transcribed, which
+	// falls back to 0 if the configured one doesn't exist
+	audioTrack atomic.Int64
+
+	// status writes the state of the proxy to STATUS_FILE, nil if disabled
+	status *statusfile.Writer
+
+	// index is the transcript search index at TRANSCRIPT_DB_PATH, nil if
+	// disabled
+	index *searchindex.Index
+
+	// uploader uploads the session files to UPLOAD_BUCKET, nil if disabled
+	uploader *upload.Uploader
+
+	// preview serves the stream sent to the targets at /preview/stream.flv,
+	// nil if disabled
+	preview *preview.Preview
+
+	// abTranscriber transcribes a sample of the live chunks with the model
+	// of AB_COMPARE_MODEL_DIR for comparison, nil if disabled
+	abTranscriber Transcriber
+
+	// ready is set once the listener is up and any warm-up has completed
+	ready atomic.Bool
+	// outputDisabled is set at startup if OUTPUT_DIR isn't writable, which
+	// turns off transcripts, recordings, and session summaries
+	outputDisabled atomic.Bool
+	// warmupRTF holds the bits of the real-time factor measured after
+	// warm-up, 0 if it wasn't
+	warmupRTF atomic.Uint64
+
+	// recordingPath is where the listener records the incoming stream, empty
+	// if recording is disabled
+	recordingPath string
+
+	// postSessionJobs tracks work that runs in the background once a session
+	// has ended, aborted by cancelling the jobs context of its run
+	postSessionJobs sync.WaitGroup
+
+	// reprocessJobs tracks reruns of session recordings, which are aborted
+	// on shutdown by cancelling reprocessCtx. reprocessSlots bounds how many
+	// run at once, and reprocessing holds the sessions being reprocessed so
+	// their summaries are only written through one Session.
+	reprocessJobs   sync.WaitGroup
+	reprocessCtx    context.Context
+	cancelReprocess context.CancelFunc
+	reprocessSlots  chan struct{}
+	reprocessMu     sync.Mutex
+	reprocessing    map[string]*reprocessedSession
+
+	// stateMu guards state, which Start and Stop move the proxy through, and
+	// closed, set once Close released what the runs share
+	stateMu sync.Mutex
+	state   string
+	closed  bool
+
+	// run is the current or last run of the proxy, replaced by Start
+	run atomic.Pointer[run]
+
+	// createdAt, and the sessions and chunks of all runs counted under
+	// totalsMu, go into the shutdown report along with what Close returned
+	createdAt time.Time
+	totalsMu  sync.Mutex
+	sessions  int
+	chunks    pipeline.ChunkStats
+	closeErr  error
+}
+
+// States of the proxy. Start moves it from stateStopped through
+// stateStarting to stateRunning, Stop through stateStopping back.
+const (
+	stateStopped  = "stopped"
+	stateStarting = "starting"
+	stateRunning  = "running"
+	stateStopping = "stopping"
+)
+
+// Errors of Start and Stop called while the proxy is between states
+var (
+	ErrStarting = errors.New("proxy is starting")
+	ErrStopping = errors.New("proxy is stopping")
+	ErrClosed   = errors.New("proxy is closed")
+)
+
+// run is one run of the proxy, from Start to Stop. Every run gets its own,
+// so a stopped proxy can be started again.
+type run struct {
+	// stop aborts all processing immediately when closed
+	stop chan struct{}
+	// listenerDone is closed once the FFmpeg listener has exited
+	listenerDone chan struct{}
+	// pipelineDone is closed once all queued chunks have been processed and
+	// streamed, and the targets have been closed
+	pipelineDone chan struct{}
+	// ending is set once the proxy ends the stream, so a publisher leaving
+	// isn't waited for to reconnect
+	ending atomic.Bool
+
+	// jobsCtx is cancelled to abort the post-session jobs of the run
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+
+	// publishers are the subscriptions of the caption publishers, closed
+	// when the run ends
+	publishers []*events.Subscription
+	// youtube and twitch publish the captions of the streams of the run as
+	// subtitle sinks of their pipelines, nil if not configured
+	youtube *youtube.Publisher
+	twitch  *twitch.Publisher
+
+	// endMu guards why the run ended, the first reason given to ended
+	endMu     sync.Mutex
+	endReason string
+	endErr    error
+}
+
+// ended records why run r ended, unless a reason was recorded before
+func (r *run) ended(reason string, err error) {
+	r.endMu.Lock()
+	defer r.endMu.Unlock()
+	if r.endReason == "" {
+		r.endReason, r.endErr = reason, err
+	}
+}
+
+// outcome returns why run r ended, an empty reason if it still runs
+func (r *run) outcome() (string, error) {
+	r.endMu.Lock()
+	defer r.endMu.Unlock()
+	return r.endReason, r.endErr
+}
+
+// newRun creates the state of a run
+func newRun() *run {
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	return &run{
+		stop:         make(chan struct{}),
+		listenerDone: make(chan struct{}),
+		pipelineDone: make(chan struct{}),
+		jobsCtx:      jobsCtx,
+		cancelJobs:   cancelJobs,
+	}
+}
+
+// currentRun returns the current or last run
+func (p *Proxy) currentRun() *run {
+	return p.run.Load()
 }
 
 // New creates a new RTMP server
 func New(cfg *config.Config) *Proxy {
 	logger := logrus.New()
+	// Stdout is kept for captions, see --captions-stdout
+	logger.SetOutput(os.Stderr)
 
 	level, err := logrus.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		level = logrus.InfoLevel
 	}
 	logger.SetLevel(level)
+	if cfg.LogFormat == logFormatJSON {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+	if cfg.LogDedupWindow > 0 {
+		logger.SetFormatter(logdedup.New(logger.Formatter, cfg.LogDedupWindow, logger))
+	}
+
+	reprocessCtx, cancelReprocess := context.WithCancel(context.Background())
 
 	server := &Proxy{
 		Config:      cfg,
+		createdAt:   time.Now(),
 		transcriber: transcriber.New(cfg),
-		translator:  translator.New(cfg),
-		embedder:    subtitles.New(subtitles.FormatSRT),
+		translator:  translator.New(cfg, logger),
+		wrapper:     subtitles.NewWrapper(cfg.CaptionMaxColumns, cfg.CaptionColumnsByLang),
+		profanity:   profanity.New(cfg.ProfanityList, cfg.ProfanityPlaceholder, logger),
+		normalizer: textnorm.New(textnorm.Options{
+			NFC:              cfg.CaptionNFC,
+			Emoji:            cfg.CaptionEmoji,
+			StripInvisible:   cfg.CaptionStripInvisible,
+			StraightenQuotes: cfg.CaptionStraightenQuotes,
+		}),
+		scheduler: scheduler.New(scheduler.Options{
+			Slots:             cfg.TranscribeSlots,
+			BatchSlots:        cfg.AdhocMaxJobs,
+			BatchSharePercent: cfg.BatchSharePercent,
+		}),
+		confidence:  newConfidenceTracker(confidenceWindow),
+		fallback:    pipeline.NewFallbackTracker(cfg, fallbackProbeInterval),
+		vram:        pipeline.NewVRAMGuard(cfg),
+		events:      events.NewBus(cfg.LiveCaptionHistory),
 		logger:      logger,
-		stopChan:    make(chan struct{}),
-	}
-
-	return server
-}
+		diskMonitor: diskspace.NewMonitor(cfg.OutputDir, cfg.MinFreeDiskMB, cfg.DiskCheckInterval, logger),
+		models:      models.New(cfg, logger),
 
-// Start starts the RTMP server using FFmpeg as the listener
-func (p *Proxy) Start() error {
-	p.logger.WithField("port", p.Config.RTMPPort).Info("Starting FFmpeg-based RTMP server")
+		reprocessCtx:    reprocessCtx,
+		cancelReprocess: cancelReprocess,
+		reprocessSlots:  make(chan struct{}, max(cfg.ReprocessMaxJobs, 1)),
+		reprocessing:    make(map[string]*reprocessedSession),
 
-	// Create temp directory for FFmpeg temporary files if needed
-	tempDir := fmt.Sprintf("%s/ffmpeg_temp", p.Config.OutputDir)
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+		state: stateStopped,
 	}
+	server.run.Store(newRun())
 
-	// Create pipes for audio and video
-	audioPipeReader, audioPipeWriter := io.Pipe()
-	videoPipeReader, videoPipeWriter := io.Pipe()
-
-	// Start FFmpeg as an RTMP server
-	args := []string{
-		"-y", // Force overwrite output files
-		"-listen", "1",
-		"-f", "flv",
-		"-i", fmt.Sprintf("rtmp://0.0.0.0:%s/live/stream", p.Config.RTMPPort),
+	if cfg.StatusFile != "" {
+		server.status = statusfile.New(cfg.StatusFile, logrus.NewEntry(logger))
+	}
 
-		// Audio output for transcription
-		"-map", "0:a",
-		"-c:a", "pcm_s16le",
-		"-ar", "16000",
-		"-ac", "1",
-		"-f", "wav",
-		"pipe:1", // Output to stdout for audio
+	if cfg.TranscriptDBPath != "" {
+		index, err := searchindex.Open(cfg.TranscriptDBPath)
+		if err != nil {
+			logger.WithError(err).Error("Failed to open transcript index, transcripts will not be searchable")
+		} else {
+			server.index = index
+		}
+	}
 
-		// Video output (preserved for later subtitle embedding)
-		"-map", "0:v",
-		"-c:v", "copy",
-		"-f", "flv", // Using FLV format for video output
-		"pipe:2", // Output to stderr for video
+	if cfg.ABCompareModelDir != "" && cfg.ABComparePercent > 0 {
+		compareCfg := *cfg
+		compareCfg.WhisperModelDir = cfg.ABCompareModelDir
+		compare := transcriber.New(&compareCfg)
+		if err := compare.VerifyModel(); err != nil {
+			logger.WithError(err).Error("Comparison model is unusable, chunks will not be compared")
+		} else {
+			server.abTranscriber = compare
+		}
 	}
 
-	p.logger.WithField("args", args).Debug("Starting FFmpeg command")
-	cmd := exec.Command("ffmpeg", args...)
+	if cfg.PreviewMaxViewers > 0 {
+		server.preview = preview.New(cfg.PreviewMaxViewers, logger)
+	}
 
-	// Set up pipe for FFmpeg's stdout (audio data)
-	cmd.Stdout = audioPipeWriter
+	if cfg.UploadBucket != "" {
+		uploader, err := upload.New(cfg, logger)
+		if err != nil {
+			logger.WithError(err).Error("Invalid upload settings, sessions will not be uploaded")
+		} else {
+			server.uploader = uploader
+		}
+	}
 
-	// Set up pipe for FFmpeg's stderr (video data and logs)
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create FFmpeg stderr pipe: %w", err)
+	if cfg.AutoInstallLangPairs {
+		server.translator.SetInstaller(server.models.EnsureArgosPackages, cfg.LangPairInstallTimeout)
 	}
 
-	// Only sending stderr to the video pipe writer, not to os.Stderr to avoid printing error logs
-	// This redirects all FFmpeg error logs away from the terminal
-	videoWriter := videoPipeWriter
+	// A child process dying on its own is reported, with its last output
+	procs.OnUnexpectedExit(server.reportProcessExit)
 
-	// Start a goroutine to read from stderr pipe and write to the video pipe only
-	go func() {
-		defer videoPipeWriter.Close()
-		if _, err := io.Copy(videoWriter, stderrPipe); err != nil {
-			p.logger.WithError(err).Error("Failed to copy from stderr pipe")
-		}
-	}()
+	return server
+}
 
-	// Start FFmpeg
-	if err := cmd.Start(); err != nil {
-		audioPipeWriter.Close()
-		videoPipeWriter.Close()
-		audioPipeReader.Close()
-		videoPipeReader.Close()
-		return fmt.Errorf("failed to start FFmpeg: %w", err)
+// reportProcessExit logs a child process that exited unexpectedly and
+// publishes the exit
+func (p *Proxy) reportProcessExit(info procs.Info) {
+	exitCode := -1
+	if info.ExitCode != nil {
+		exitCode = *info.ExitCode
 	}
-	p.ffmpegCmd = cmd
+	p.logger.WithFields(logrus.Fields{
+		"role":      info.Role,
+		"pid":       info.PID,
+		"exit_code": exitCode,
+		"stderr":    info.Stderr,
+	}).Error("Child process exited unexpectedly")
 
-	p.logger.Info("FFmpeg RTMP server started successfully")
+	event := events.Event{
+		Kind:      events.KindProcessExited,
+		StreamKey: streamKey,
+		Process: &events.ProcessExit{
+			Role:     info.Role,
+			PID:      info.PID,
+			ExitCode: exitCode,
+			Stderr:   info.Stderr,
+		},
+	}
+	if active := p.activeSession(); active != nil {
+		event.Session = active.session.ID()
+	}
+	p.events.Publish(event)
+}
 
-	// Start processing the pipes in a goroutine
-	go p.processFFmpegOutput(audioPipeReader, videoPipeReader)
+// Processes lists the child processes that are running and those that
+// exited last
+func (p *Proxy) Processes() []procs.Info {
+	return procs.List()
+}
 
-	return nil
+// Preview returns the preview of the stream sent to the targets, nil if it
+// is disabled
+func (p *Proxy) Preview() *preview.Preview {
+	return p.preview
 }
 
-// Stop stops the RTMP server
-func (p *Proxy) Stop() error {
-	if p.ffmpegCmd != nil && p.ffmpegCmd.Process != nil {
-		close(p.stopChan)
+// ResourceUsage reports the child processes by role and the open files,
+// against the limits of the container
+func (p *Proxy) ResourceUsage() procs.Usage {
+	return procs.CurrentUsage()
+}
 
-		p.logger.Info("Stopping FFmpeg RTMP server")
-		if err := p.ffmpegCmd.Process.Signal(os.Interrupt); err != nil {
-			p.logger.WithError(err).Warning("Failed to send interrupt to FFmpeg, forcing kill")
-			if err := p.ffmpegCmd.Process.Kill(); err != nil {
-				return fmt.Errorf("failed to kill FFmpeg process: %w", err)
-			}
-		}
+// Resource use is warned about once it reaches resourceWarnShare of a limit,
+// and again after it fell below resourceClearShare
+const (
+	resourceWarnShare  = 0.8
+	resourceClearShare = 0.7
+)
 
-		// Wait for process to exit
-		p.ffmpegCmd.Wait()
-		p.logger.Info("FFmpeg RTMP server stopped")
+// watchResources checks the open files and child processes against the
+// limits of the container until stop is closed, warning as they run short
+// with the roles holding the most processes, so the feature to tune is
+// known before starts fail with EMFILE or EAGAIN
+func (p *Proxy) watchResources(stop <-chan struct{}) {
+	interval := p.Config.ResourceCheckInterval
+	if interval <= 0 {
+		return
 	}
-	return nil
-}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-// processFFmpegOutput handles the audio and video data from FFmpeg pipes
-func (p *Proxy) processFFmpegOutput(audioReader, videoReader io.ReadCloser) {
-	defer audioReader.Close()
-	defer videoReader.Close()
+	var filesWarned, processesWarned, capWarned bool
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
 
-	logger := p.logger.WithFields(logrus.Fields{
-		"processor": "ffmpeg-output",
-	})
+		usage := procs.CurrentUsage()
+		logger := p.logger.WithFields(logrus.Fields{
+			"processes":     usage.Processes,
+			"open_files":    usage.OpenFiles,
+			"top_consumers": strings.Join(usage.TopRoles(3), ", "),
+		})
+		logger.Debug("Resource usage")
 
-	logger.Info("Waiting for incoming RTMP stream")
+		if usage.FileLimit > 0 && usage.OpenFiles >= 0 {
+			share := float64(usage.OpenFiles) / float64(usage.FileLimit)
+			if share >= resourceWarnShare && !filesWarned {
+				logger.WithField("limit", usage.FileLimit).Warn("Open files are close to the limit, new processes and pipes will fail with EMFILE; raise the nofile ulimit or reduce the busiest roles")
+			}
+			filesWarned = rearm(filesWarned, share)
+		}
 
-	// Create a stream connection object
-	streamKey := fmt.Sprintf("stream-%d", time.Now().UnixNano())
-	streamConn := &rtmpConnection{
-		streamName:   streamKey,
-		sourceURL:    fmt.Sprintf("rtmp://localhost:%s/live/stream", p.Config.RTMPPort),
-		targetURL:    p.Config.DefaultTargetURL,
-		sourceLang:   p.Config.DefaultSourceLang,
-		targetLang:   p.Config.DefaultTargetLang,
-		subtitleType: subtitles.FormatSRT,
+		if usage.ProcessLimit > 0 {
+			share := float64(usage.Processes) / float64(usage.ProcessLimit)
+			if share >= resourceWarnShare && !processesWarned {
+				logger.WithField("limit", usage.ProcessLimit).Warn("Child processes are close to the process limit, new ones will fail to start; raise the nproc ulimit or reduce the busiest roles")
+			}
+			processesWarned = rearm(processesWarned, share)
+		}
+
+		if usage.Waiting > 0 && !capWarned {
+			logger.WithFields(logrus.Fields{
+				"waiting": usage.Waiting,
+				"cap":     usage.MaxProcesses,
+			}).Warn("Child processes reached MAX_CHILD_PROCESSES, new ones are waiting")
+		}
+		capWarned = usage.Waiting > 0
 	}
+}
 
-	// Parse target URLs once at the beginning
-	streamTargets, err := parseTargetURLs(p.Config.DefaultTargetURL)
-	if err != nil {
-		logger.WithError(err).Error("Invalid target URL")
-		return
+// rearm returns whether a limit at share stays warned about, from when it
+// reached resourceWarnShare until it fell below resourceClearShare
+func rearm(warned bool, share float64) bool {
+	if share >= resourceWarnShare {
+		return true
+	}
+	return warned && share >= resourceClearShare
+}
+
+// processesSince lists the child processes that were still running at start
+func processesSince(start time.Time) []procs.Info {
+	var infos []procs.Info
+	for _, info := range procs.List() {
+		if info.ExitedAt == nil || !info.ExitedAt.Before(start) {
+			infos = append(infos, info)
+		}
 	}
+	return infos
+}
 
-	// Create the streaming client
-	streamer := streaming.New(streamTargets)
+// SetTranscriber replaces the Whisper transcriber of the live stream, for
+// tests. It must be called before Start.
+func (p *Proxy) SetTranscriber(t Transcriber) {
+	p.transcriber = t
+}
 
-	// Create buffers for audio and video
-	const chunkDuration = 10 * time.Second // Process in 10-second chunks
-	const audioSampleRate = 16000          // 16kHz sample rate
-	const bytesPerSample = 2               // 16-bit audio = 2 bytes per sample
-	const channels = 1                     // Mono audio
+// Start starts the RTMP server using FFmpeg as the listener. Starting a
+// running proxy does nothing, and a stopped one starts a new run.
+func (p *Proxy) Start() error {
+	p.stateMu.Lock()
+	switch {
+	case p.closed:
+		p.stateMu.Unlock()
+		return ErrClosed
+	case p.state != stateStopped:
+		state := p.state
+		p.stateMu.Unlock()
+		if state == stateRunning {
+			return nil
+		}
+		return stateErr(state)
+	}
+	p.state = stateStarting
+	p.stateMu.Unlock()
 
-	// Calculate buffer size for audio (bytes for a chunk duration at given sample rate)
-	audioChunkSize := int(chunkDuration.Seconds() * float64(audioSampleRate) * float64(bytesPerSample) * float64(channels))
+	r := newRun()
+	p.run.Store(r)
+	p.listener.Store(nil)
 
-	// Buffer for video (will be variable size but need to store it)
-	var videoBuffer bytes.Buffer
+	if err := p.start(r); err != nil {
+		close(r.stop)
+		p.endRun(r)
+		p.setState(stateStopped)
+		return err
+	}
+	p.setState(stateRunning)
+	return nil
+}
 
-	// Buffer for collecting audio chunks
-	audioChunk := make([]byte, audioChunkSize)
+// stateErr returns the error of Start or Stop called in state
+func stateErr(state string) error {
+	if state == stateStarting {
+		return ErrStarting
+	}
+	return ErrStopping
+}
 
-	// Track audio bytes read
-	var totalAudioBytesRead int
+// setState moves the proxy to state
+func (p *Proxy) setState(state string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	p.state = state
+}
 
-	// Channel to signal when audio chunk is ready for processing
-	audioChunkReady := make(chan struct{})
+// endRun releases what run r holds once it is over
+func (p *Proxy) endRun(r *run) {
+	r.cancelJobs()
+	for _, sub := range r.publishers {
+		sub.Close()
+	}
+	p.translator.Close()
+}
 
-	// Create a buffer pool for processed video chunks
-	processedChunks := make(chan []byte, 3) // Buffer up to 3 processed chunks
+// start starts run r
+func (p *Proxy) start(r *run) error {
+	if err := p.Config.Validate(); err != nil {
+		return err
+	}
+	if err := p.checkListenAddress(); err != nil {
+		return err
+	}
+	p.logger.WithFields(logrus.Fields{
+		"port":       p.Config.RTMPPort,
+		"ingest_url": p.ingestURL("****"),
+	}).Info("Starting FFmpeg-based RTMP server")
 
-	// WaitGroup to wait for all goroutines to finish when shutting down
-	var wg sync.WaitGroup
+	if err := p.checkDirs(); err != nil {
+		return err
+	}
+	// Remove whatever crashed sessions left behind
+	p.sweepTempDirs()
 
-	// Start goroutine to continuously collect video data
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	profiles, err := streaming.ParseProfiles(p.Config.StreamProfiles, p.Config.CUDAEnabled)
+	if err != nil {
+		return fmt.Errorf("invalid stream profiles: %w", err)
+	}
+	subtitleFormat, err := subtitles.ParseFormat(p.Config.SubtitleFormat)
+	if err != nil {
+		return fmt.Errorf("invalid SUBTITLE_FORMAT: %w", err)
+	}
+	if err := p.VTTOptions().Validate(); err != nil {
+		return fmt.Errorf("invalid VTT_CUE_SETTINGS or VTT_MPEGTS: %w", err)
+	}
+	// Warn about a format the chunks can't carry right away rather than
+	// once a stream arrives
+	if !p.Config.TranscribeOnly() {
+		p.embeddedFormat(subtitleFormat, logrus.NewEntry(p.logger))
+	}
+	if p.Config.LogFormat != logFormatText && p.Config.LogFormat != logFormatJSON {
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected %s or %s", p.Config.LogFormat, logFormatText, logFormatJSON)
+	}
+	p.profiles = profiles
+	// Targets are parsed for every stream, so a missing secret would only
+	// show once a publisher connects
+	if !p.Config.TranscribeOnly() {
+		if _, _, err := streaming.ExpandSecrets(p.Config.DefaultTargetURL, p.Config.SecretsDir); err != nil {
+			return fmt.Errorf("invalid TARGET_URL: %w", err)
+		}
+	}
 
-		buffer := make([]byte, 64*1024) // 64KB read buffer
-		for {
-			select {
-			case <-p.stopChan:
-				return
-			default:
-				n, err := videoReader.Read(buffer)
-				if err != nil {
-					if err != io.EOF {
-						logger.WithError(err).Error("Error reading video data")
-					}
-					return
-				}
+	// Watch free space so writes pause before the disk fills up
+	go p.diskMonitor.Run(r.stop)
+	go p.watchResources(r.stop)
 
-				if n > 0 {
-					videoBuffer.Write(buffer[:n])
-				}
+	if p.Config.Passthrough() {
+		if err := p.startPassthrough(); err != nil {
+			return err
+		}
+		p.ready.Store(true)
+		return nil
+	}
+
+	// Fetch missing models before checking for them
+	if p.Config.AutoDownloadModels {
+		// A remote endpoint brings its own model
+		if p.Config.WhisperURL == "" {
+			if err := p.models.EnsureWhisperModel(); err != nil {
+				return fmt.Errorf("failed to download whisper model: %w", err)
 			}
 		}
-	}()
 
-	// Start goroutine to read audio data in chunks
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+		if p.Config.EnableTranslation {
+			if err := p.models.EnsureArgosPackages(context.Background(), p.Config.DefaultSourceLang, p.Config.DefaultTargetLang); err != nil {
+				p.logger.WithError(err).Error("Translation models unavailable, captions will not be translated")
+			}
+		}
+	}
 
-		for {
-			select {
-			case <-p.stopChan:
-				return
-			default:
-				n, err := audioReader.Read(audioChunk[totalAudioBytesRead:])
-				if err != nil {
-					if err != io.EOF {
-						logger.WithError(err).Error("Error reading audio data")
-					}
-					return
-				}
+	if err := p.transcriber.CheckDecodingOptions(); err != nil {
+		return fmt.Errorf("invalid whisper decoding options: %w", err)
+	}
 
-				if n > 0 {
-					totalAudioBytesRead += n
+	// Fail early rather than on the first chunk if the model isn't there
+	if err := p.transcriber.VerifyModel(); err != nil {
+		return fmt.Errorf("whisper model check failed: %w", err)
+	}
+	if p.Config.WhisperURL != "" {
+		p.logger.WithFields(logrus.Fields{
+			"model":    p.Config.WhisperModelSize,
+			"endpoint": p.Config.WhisperURL,
+		}).Info("Uploading chunks to a remote Whisper endpoint")
+	} else {
+		p.logger.WithFields(logrus.Fields{
+			"model_size": p.Config.WhisperModelSize,
+			"model_dir":  p.transcriber.ModelDir(),
+		}).Info("Using Whisper model")
+	}
 
-					// If we've read a full chunk, signal it's ready for processing
-					if totalAudioBytesRead >= audioChunkSize {
-						select {
-						case audioChunkReady <- struct{}{}:
-							// Signal sent
-						case <-p.stopChan:
-							return
-						}
+	if p.Config.EnableTranslation {
+		p.logTranslationPairs()
+	}
 
-						// Reset counter for next chunk
-						totalAudioBytesRead = 0
-					}
-				}
-			}
+	if p.Config.EnableTranslation && p.Config.ArgosWorker {
+		if err := p.translator.StartWorker(); err != nil {
+			p.logger.WithError(err).Warn("Translation worker unavailable, running argos-translate per segment")
 		}
-	}()
+	}
 
-	// Start goroutine to process audio chunks and video data
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	p.startPublishers(r)
 
-		var videoChunk []byte
+	if p.Config.Warmup {
+		p.warmup()
+	}
 
-		for {
-			select {
-			case <-p.stopChan:
-				return
+	// In transcribe-only mode there is nothing to restream, so FFmpeg only
+	// needs to produce the audio track
+	transcribeOnly := p.Config.TranscribeOnly()
 
-			case <-audioChunkReady:
-				// Copy the current video buffer for this audio chunk
-				videoChunk = make([]byte, videoBuffer.Len())
-				copy(videoChunk, videoBuffer.Bytes())
-
-				// Reset video buffer for next chunk
-				videoBuffer.Reset()
-
-				// Process this chunk in a separate goroutine
-				wg.Add(1)
-				go func(audio []byte, video []byte) {
-					defer wg.Done()
-
-					chunkLogger := logger.WithField("chunk_size_bytes", len(audio))
-					chunkLogger.Info("Processing audio/video chunk")
-
-					// If the audio or video chunk is too small, skip processing
-					if len(audio) < 1000 || len(video) < 1000 {
-						chunkLogger.Warn("Chunk too small, skipping processing")
-						// Still forward the video for continuity
-						select {
-						case processedChunks <- video:
-							// Chunk queued for streaming
-						case <-p.stopChan:
-							return
-						}
-						return
-					}
+	// Create pipe for audio
+	audioPipeReader, audioPipeWriter := io.Pipe()
 
-					// Transcribe the audio chunk with retries
-					var segments []transcriber.Segment
-					var err error
-					maxRetries := 3
+	if p.Config.RecordInput && p.outputDisabled.Load() {
+		p.logger.Warn("RECORD_INPUT needs a writable OUTPUT_DIR, the stream will not be recorded")
+	} else if p.Config.RecordInput {
+		// Record everything as received; the file moves into the session
+		// directory once the stream ends
+		p.recordingPath = filepath.Join(p.tempRoot(), fmt.Sprintf("recording-%d.flv", time.Now().Unix()))
+	} else if p.Config.PostSessionMux {
+		p.logger.Warn("POST_SESSION_MUX needs RECORD_INPUT, no final file will be produced")
+	}
 
-					for i := 0; i < maxRetries; i++ {
-						segments, err = p.transcriber.TranscribeAudio(audio, streamConn.sourceLang)
-						if err == nil {
-							break
-						}
+	audioTrack := p.Config.AudioTrackIndex
+	outputTracks, err := parseAudioTracks(p.Config.OutputAudioTracks)
+	if err != nil {
+		return fmt.Errorf("invalid OUTPUT_AUDIO_TRACKS: %w", err)
+	}
+	if audioTrack < 0 {
+		return fmt.Errorf("invalid AUDIO_TRACK_INDEX %d: tracks are counted from 0", audioTrack)
+	}
+	p.audioTrack.Store(int64(audioTrack))
 
-						chunkLogger.WithError(err).Warnf("Transcription attempt %d failed, retrying...", i+1)
-						time.Sleep(100 * time.Millisecond) // Small delay between retries
-					}
+	cmd := procs.FFmpeg(p.listenerArgs(transcribeOnly, audioTrack, outputTracks, p.recordingPath)...)
+	p.logger.WithField("args", cmd.Args[1:]).Debug("Starting FFmpeg command")
 
-					if err != nil {
-						chunkLogger.WithError(err).Error("Chunk transcription failed after retries")
-						// Forward original video chunk if transcription fails
-						select {
-						case processedChunks <- video:
-							// Chunk queued for streaming
-						case <-p.stopChan:
-							return
-						}
-						return
-					}
+	// FFmpeg's stdout carries the audio data
+	pipeWriters := []io.Closer{audioPipeWriter}
 
-					// Translate if needed
-					if streamConn.targetLang != "" && streamConn.targetLang != streamConn.sourceLang {
-						translatedSegments, err := p.translator.TranslateSegments(segments, streamConn.sourceLang, streamConn.targetLang)
-						if err != nil {
-							chunkLogger.WithError(err).Error("Translation failed, using original transcription")
-						} else {
-							segments = translatedSegments
-						}
-					}
+	var videoPipeReader *io.PipeReader
+	var videoPipeWriter *io.PipeWriter
+	var mapErrors *mapErrorDetector
+	if !transcribeOnly {
+		videoPipeReader, videoPipeWriter = io.Pipe()
 
-					// Embed subtitles into video chunk with retries
-					var processedVideo []byte
-					for i := 0; i < maxRetries; i++ {
-						processedVideo, err = p.embedder.EmbedSubtitles(video, segments)
-						if err == nil {
-							break
-						}
+		// Only sending stderr to the video pipe writer, not to os.Stderr to avoid printing error logs
+		// This redirects all FFmpeg error logs away from the terminal
+		mapErrors = &mapErrorDetector{}
+		pipeWriters = append(pipeWriters, videoPipeWriter)
+	}
 
-						chunkLogger.WithError(err).Warnf("Subtitle embedding attempt %d failed, retrying...", i+1)
-						time.Sleep(100 * time.Millisecond) // Small delay between retries
-					}
+	// Every listener of a session that resumes writes to pipes of its own,
+	// spliced into those of the pipeline
+	var resume *resumer
+	if p.Config.SessionResumeWindow > 0 {
+		resume = newResumer(p.Config.SessionResumeWindow, audioPipeWriter, videoPipeWriter, &p.listener, p.logger)
+		pipeWriters = []io.Closer{resume}
+	}
+	wire := func(cmd *exec.Cmd) {
+		var audioOut, videoOut io.Writer = audioPipeWriter, videoPipeWriter
+		if resume != nil {
+			audioOut, videoOut = resume.attach(cmd)
+		}
+		cmd.Stdout = audioOut
+		if mapErrors != nil {
+			mapErrors.reset()
+			mapErrors.w = videoOut
+			cmd.Stderr = mapErrors
+		}
+	}
+	wire(cmd)
 
-					if err != nil {
-						chunkLogger.WithError(err).Error("Failed to embed subtitles after retries, using original video")
-						select {
-						case processedChunks <- video:
-							// Chunk queued for streaming
-						case <-p.stopChan:
-							return
-						}
-						return
-					}
+	// FFmpeg only finds out which tracks there are once the publisher
+	// connects, and exits if a selected one doesn't exist. It is started
+	// again with the first audio track and all tracks restreamed, and the
+	// publisher's reconnect is picked up by that. A publisher that
+	// disconnected gets a new listener to reconnect to if sessions resume.
+	retry := func(exited procs.Info) *exec.Cmd {
+		waiting := resume != nil && resume.disconnected(r.ending.Load())
 
-					// Queue the processed chunk for streaming
-					select {
-					case processedChunks <- processedVideo:
-						chunkLogger.Info("Chunk processed and queued for streaming")
-					case <-p.stopChan:
-						return
-					}
-				}(append([]byte{}, audioChunk[:audioChunkSize]...), videoChunk)
-			}
-		}
-	}()
+		var cmd *exec.Cmd
+		switch {
+		case (audioTrack != 0 || outputTracks != nil) && exited.Unexpected &&
+			(strings.Contains(exited.Stderr, mapErrorPattern) || mapErrors.found()):
+			p.logger.WithFields(logrus.Fields{
+				"audio_track":   audioTrack,
+				"output_tracks": p.Config.OutputAudioTracks,
+			}).Warn("The stream has no such audio track, falling back to the first audio track; the publisher has to reconnect")
 
-	// Start goroutine to stream processed chunks
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+			audioTrack, outputTracks = 0, nil
+			p.audioTrack.Store(0)
+			cmd = procs.FFmpeg(p.listenerArgs(transcribeOnly, audioTrack, outputTracks, p.recordingPath)...)
+		case waiting:
+			// Every reconnect is recorded into a part of its own, so the
+			// recording so far isn't overwritten
+			recording := p.recordingPart(resume.publishers())
+			cmd = procs.FFmpeg(p.listenerArgs(transcribeOnly, audioTrack, outputTracks, recording)...)
+		default:
+			return nil
+		}
+		wire(cmd)
+		return cmd
+	}
 
-		for {
-			select {
-			case <-p.stopChan:
-				return
+	// Start FFmpeg
+	if err := p.startListener(cmd, retry, pipeWriters...); err != nil {
+		audioPipeReader.Close()
+		if videoPipeReader != nil {
+			videoPipeReader.Close()
+		}
+		return err
+	}
 
-			case chunk := <-processedChunks:
-				chunkLogger := logger.WithField("chunk_size", len(chunk))
-				chunkLogger.Info("Streaming processed chunk")
+	p.logger.Info("FFmpeg RTMP server started successfully")
 
-				// Try multiple times to stream the chunk
-				var err error
-				maxRetries := 3
+	// Start processing the pipes in a goroutine
+	if videoPipeReader != nil {
+		go p.processFFmpegOutput(audioPipeReader, videoPipeReader, resume)
+	} else {
+		go p.processFFmpegOutput(audioPipeReader, nil, resume)
+	}
 
-				for i := 0; i < maxRetries; i++ {
-					err = streamer.Stream(chunk)
-					if err == nil {
-						break
-					}
+	p.ready.Store(true)
+	return nil
+}
 
-					chunkLogger.WithError(err).Warnf("Streaming attempt %d failed, retrying...", i+1)
-					time.Sleep(100 * time.Millisecond) // Small delay between retries
-				}
+// logTranslationPairs logs the installed translation pairs and warns if the
+// default languages can't be translated, which would otherwise only show as
+// captions silently staying untranslated
+func (p *Proxy) logTranslationPairs() {
+	pairs, err := p.translator.AvailablePairs()
+	if err != nil {
+		p.logger.WithError(err).Warn("Failed to list installed translation pairs")
+		return
+	}
 
-				if err != nil {
-					chunkLogger.WithError(err).Error("Error streaming chunk after retries")
-				}
-			}
-		}
-	}()
+	names := make([]string, len(pairs))
+	for i, pair := range pairs {
+		names[i] = pair.String()
+	}
+	p.logger.WithField("pairs", strings.Join(names, ", ")).Infof("%d translation pairs installed", len(pairs))
 
-	// Wait for all goroutines to complete when stop is called
-	<-p.stopChan
-	logger.Info("Stopping all stream processing goroutines")
-	wg.Wait()
-	logger.Info("Stream processing stopped")
+	if err := p.translator.RequestLanguagePair(p.Config.DefaultSourceLang, p.Config.DefaultTargetLang); err != nil {
+		p.logger.WithError(err).WithFields(logrus.Fields{
+			"source": p.Config.DefaultSourceLang,
+			"target": p.Config.DefaultTargetLang,
+		}).Error("Default language pair is not installed, captions will not be translated")
+	}
 }
 
-// rtmpConnection represents an active RTMP connection
-type rtmpConnection struct {
-	streamName   string
-	sourceURL    string
-	targetURL    string
-	sourceLang   string
-	targetLang   string
-	subtitleType subtitles.SubtitleFormat
+// TranslationPairs lists the language pairs of the installed translation
+// packages
+func (p *Proxy) TranslationPairs() ([]translator.LangPair, error) {
+	return p.translator.AvailablePairs()
 }
 
-// parseTargetURLs parses a comma-separated list of target URLs
-func parseTargetURLs(targetURLs string) ([]*streaming.StreamTarget, error) {
-	urls := bytes.Split([]byte(targetURLs), []byte(","))
-	targets := make([]*streaming.StreamTarget, 0, len(urls))
-
-	for _, urlBytes := range urls {
-		urlStr := string(bytes.TrimSpace(urlBytes))
-		if urlStr == "" {
-			continue
-		}
+// Transcribe transcribes PCM audio outside the stream pipeline with the same
+// models, translating it if langs has a target. An empty source language
+// selects the default. Segment times are relative to the start of pcm.
+// originals holds the segments before translation, or nil if they weren't
+// translated. The job waits until ctx is done for a slot and for live chunks
+// to be transcribed first.
+func (p *Proxy) Transcribe(ctx context.Context, pcm []byte, format audio.Format, langs Languages) (segments, originals []transcriber.Segment, err error) {
+	if langs.Source == "" {
+		langs.Source = p.Config.DefaultSourceLang
+	}
 
-		target, err := streaming.ParseStreamURL(urlStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid target URL %q: %w", urlStr, err)
-		}
+	tempDir, err := os.MkdirTemp(p.tempRoot(), "adhoc-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
 
-		targets = append(targets, target)
+	segments, err = p.scheduler.Transcribe(ctx, scheduler.Batch, p.transcriber, tempDir, pcm, format, langs.Source, transcriber.FallbackNone)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if len(targets) == 0 {
-		return nil, fmt.Errorf("no valid target URLs provided")
+	if langs.Target == "" || langs.Target == langs.Source || len(segments) == 0 {
+		return segments, nil, nil
 	}
+	translated, err := p.translator.TranslateSegments(segments, langs.Source, langs.Target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("translation failed: %w", err)
+	}
+	return translated, segments, nil
+}
 
-	return targets, nil
+// warmupAudioDuration is the length of the silent clip used for warm-up
+const warmupAudioDuration = time.Second
+
+// warmup runs a short silent clip through the transcriber and, when
+// translation is enabled, a dummy sentence through the translator, so the
+// first real chunk doesn't pay for cold model loading. Failures are logged
+// but don't prevent the proxy from starting.
+func (p *Proxy) warmup() {
+	logger := p.logger.WithField("stage", "warmup")
+	logger.Info("Warming up models")
+	start := time.Now()
+
+	tempDir := filepath.Join(p.tempRoot(), "warmup")
+	defer os.RemoveAll(tempDir)
+
+	silence := make([]byte, int(warmupAudioDuration.Seconds())*audio.Expected.BytesPerSecond())
+
+	transcribeStart := time.Now()
+	if _, err := p.scheduler.Transcribe(context.Background(), scheduler.Live, p.transcriber, tempDir, silence, audio.Expected, p.Config.DefaultSourceLang, transcriber.FallbackNone); err != nil {
+		logger.WithError(err).Warn("Transcriber warm-up failed, the first chunk may be slow or fail")
+	} else {
+		logger.WithField("duration", time.Since(transcribeStart)).Info("Transcriber warmed up")
+		p.measureRealTimeFactor(tempDir, logger)
+	}
+
+	if p.Config.EnableTranslation && p.Config.DefaultTargetLang != "" && p.Config.DefaultTargetLang != p.Config.DefaultSourceLang {
+		translateStart := time.Now()
+		dummy := []transcriber.Segment{{Text: "Hello, this is a warm-up sentence."}}
+		if _, err := p.translator.TranslateSegments(dummy, p.Config.DefaultSourceLang, p.Config.DefaultTargetLang); err != nil {
+			logger.WithError(err).Warn("Translator warm-up failed")
+		} else {
+			logger.WithField("duration", time.Since(translateStart)).Info("Translator warmed up")
+		}
+	}
+
+	logger.WithField("duration", time.Since(start)).Info("Warm-up complete")
+}
+
+// measureRealTimeFactor times the transcription of a whole chunk with the
+// warmed-up models and warns if the hardware is unlikely to keep up. Silence
+// decodes faster than speech, so the real streams come out somewhat higher.
+func (p *Proxy) measureRealTimeFactor(tempDir string, logger *logrus.Entry) {
+	silence := make([]byte, int(chunkDuration.Seconds())*audio.Expected.BytesPerSecond())
+
+	start := time.Now()
+	if _, err := p.scheduler.Transcribe(context.Background(), scheduler.Live, p.transcriber, tempDir, silence, audio.Expected, p.Config.DefaultSourceLang, transcriber.FallbackNone); err != nil {
+		logger.WithError(err).Warn("Failed to measure the real-time factor")
+		return
+	}
+	rtf := time.Since(start).Seconds() / chunkDuration.Seconds()
+	p.warmupRTF.Store(math.Float64bits(rtf))
+
+	logger = logger.WithField("rtf", math.Round(rtf*100)/100)
+	if rtf > pipeline.RTFWarning {
+		logger.WithFields(logrus.Fields{
+			"model":     p.Config.WhisperModelSize,
+			"beam_size": p.Config.BeamSize,
+		}).Warnf("Transcription takes more than %.0f%% of real time and may fall behind the stream, consider a smaller WHISPER_MODEL_SIZE or a lower BEAM_SIZE", pipeline.RTFWarning*100)
+		return
+	}
+	logger.Info("Real-time factor measured")
+}
+
+// Ready reports whether the proxy is accepting streams, which when warm-up is
+// enabled is only after it has completed
+func (p *Proxy) Ready() bool {
+	return p.ready.Load()
+}
+
+// startPassthrough starts an FFmpeg listener that keeps audio and video muxed
+// together and relays the resulting FLV stream to the targets untouched,
+// bypassing transcription, translation, and subtitle embedding entirely
+func (p *Proxy) startPassthrough() error {
+	streamTargets, err := p.parseTargets()
+	if err != nil {
+		return fmt.Errorf("passthrough mode requires a valid target URL: %w", err)
+	}
+
+	args := []string{
+		"-y", // Force overwrite output files
+		"-listen", "1",
+		"-f", "flv",
+		"-i", p.listenURL(),
+
+		// Remux all streams without touching them
+		"-map", "0",
+		"-c", "copy",
+		"-flush_packets", "1", // Hand packets over as soon as they arrive
+		"-f", "flv",
+		"pipe:1",
+	}
+
+	p.logger.WithField("args", args).Debug("Starting FFmpeg passthrough command")
+	cmd := procs.FFmpeg(args...)
+
+	streamReader, streamWriter := io.Pipe()
+	cmd.Stdout = streamWriter
+
+	if err := p.startListener(cmd, nil, streamWriter); err != nil {
+		streamReader.Close()
+		return err
+	}
+
+	p.logger.Info("FFmpeg RTMP server started in passthrough mode")
+
+	streamer := p.newStreamer(streamTargets)
+	p.activeMu.Lock()
+	p.relay = streamer
+	p.activeMu.Unlock()
+	go p.relayStream(streamReader, streamer)
+
+	return nil
+}
+
+// parseTargets parses the configured target URLs and looks up the encoding
+// profiles they select
+func (p *Proxy) parseTargets() ([]*streaming.StreamTarget, error) {
+	targets, err := streaming.ParseStreamURLs(p.Config.DefaultTargetURL, streaming.Ingests{Twitch: p.Config.TwitchIngest, YouTube: p.Config.YouTubeIngest}, p.Config.SecretsDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := streaming.ResolveProfiles(targets, p.profiles); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// newStreamer creates a streamer for targets with the configured circuit
+// breaker
+func (p *Proxy) newStreamer(targets []*streaming.StreamTarget) *streaming.Streamer {
+	streamer := streaming.New(targets)
+	streamer.SetBreaker(streaming.BreakerOptions{
+		Failures: p.Config.TargetBreakerFailures,
+		Window:   p.Config.TargetBreakerWindow,
+		Cooldown: p.Config.TargetBreakerCooldown,
+	}, p.reportTargetFailure)
+	return streamer
+}
+
+// trackLangs returns the languages that get a subtitle track of their own
+// while a stream has langs: the source, the target, and the extra targets,
+// as long as there are any or tracked is set
+func trackLangs(langs Languages, tracked bool) []string {
+	if len(langs.Extra) == 0 && !tracked {
+		return nil
+	}
+	var trackLangs []string
+	for _, lang := range append([]string{langs.Source, langs.Target}, langs.Extra...) {
+		if lang != "" && !slices.Contains(trackLangs, lang) {
+			trackLangs = append(trackLangs, lang)
+		}
+	}
+	return trackLangs
+}
+
+// extraLangs returns the configured extra target languages, none if
+// translation is disabled
+func (p *Proxy) extraLangs() []string {
+	if !p.Config.EnableTranslation {
+		return nil
+	}
+	var langs []string
+	for _, lang := range p.Config.ExtraTargetLangs {
+		langs = append(langs, strings.ToLower(lang))
+	}
+	return langs
+}
+
+// timingOptions returns how the segment times are corrected before they are
+// captioned
+func (p *Proxy) timingOptions() subtitles.TimingOptions {
+	return subtitles.TimingOptions{
+		MaxOverlap: p.Config.CueMaxOverlap.Seconds(),
+		Merge:      p.Config.CueOverlapMerge,
+	}
+}
+
+// newSpeakerTracker creates a tracker labeling the speakers of one stream or
+// recording, or nil if speaker changes aren't detected
+func (p *Proxy) newSpeakerTracker() *speaker.Tracker {
+	if !p.Config.SpeakerChangeDetection {
+		return nil
+	}
+	return speaker.NewTracker(nil, speaker.Options{
+		Threshold:   float64(p.Config.SpeakerChangeThresholdDB),
+		MaxSpeakers: p.Config.SpeakerMaxSpeakers,
+		Prefix:      p.Config.SpeakerCaptionPrefix,
+	})
+}
+
+// reportTargetFailure logs a target whose circuit breaker opened and
+// publishes the failure
+func (p *Proxy) reportTargetFailure(status streaming.TargetStatus) {
+	logger := p.logger.WithFields(logrus.Fields{
+		"target":   status.Target,
+		"id":       status.ID,
+		"failures": status.Failures,
+		"error":    status.LastError,
+	})
+	if status.BreakerRetryAt != nil {
+		logger = logger.WithField("retry_at", status.BreakerRetryAt.Format(time.RFC3339))
+	}
+	logger.Error("Target keeps failing, no longer retrying it")
+
+	event := events.Event{
+		Kind:      events.KindTargetFailed,
+		StreamKey: streamKey,
+		Target: &events.TargetFailure{
+			ID:       status.ID,
+			Target:   status.Target,
+			Failures: status.Failures,
+			Error:    status.LastError,
+		},
+	}
+	if active := p.activeSession(); active != nil {
+		event.Session = active.session.ID()
+	}
+	p.events.Publish(event)
+}
+
+// ResetTarget closes the circuit breaker of the target with id, its index in
+// TARGET_URL, so it is started again right away
+func (p *Proxy) ResetTarget(id int) (streaming.TargetStatus, error) {
+	p.activeMu.Lock()
+	streamer := p.relay
+	if p.active != nil {
+		streamer = p.active.streamer
+	}
+	p.activeMu.Unlock()
+
+	if streamer == nil {
+		return streaming.TargetStatus{}, ErrNoActiveStream
+	}
+	status, err := streamer.ResetTarget(id)
+	if err != nil {
+		return streaming.TargetStatus{}, err
+	}
+	p.logger.WithFields(logrus.Fields{"target": status.Target, "id": id}).Info("Target reset")
+	return status, nil
+}
+
+// AddTarget parses targetURL like TARGET_URL, ${NAME} secrets included, and
+// adds it to the targets of the active stream until the stream ends. It is
+// started with the next chunk.
+func (p *Proxy) AddTarget(targetURL string) (streaming.TargetStatus, error) {
+	target, err := streaming.ParseStreamURL(targetURL, streaming.Ingests{Twitch: p.Config.TwitchIngest, YouTube: p.Config.YouTubeIngest}, p.Config.SecretsDir)
+	if err != nil {
+		return streaming.TargetStatus{}, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+	}
+	if err := streaming.ResolveProfiles([]*streaming.StreamTarget{target}, p.profiles); err != nil {
+		return streaming.TargetStatus{}, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+	}
+
+	p.activeMu.Lock()
+	active, streamer := p.active, p.relay
+	if active != nil {
+		streamer = active.streamer
+	}
+	p.activeMu.Unlock()
+	if streamer == nil {
+		return streaming.TargetStatus{}, ErrNoActiveStream
+	}
+
+	if active != nil {
+		if err := p.checkAddedTarget(target, streamer, active.session.Summary().Codecs); err != nil {
+			return streaming.TargetStatus{}, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+		}
+	}
+
+	status, err := streamer.AddTarget(target)
+	if err != nil {
+		return streaming.TargetStatus{}, err
+	}
+	p.logger.WithFields(logrus.Fields{"target": status.Target, "id": status.ID}).Info("Target added")
+	return status, nil
+}
+
+// checkAddedTarget checks that target takes the stream as it is already
+// processed for the targets of streamer: with their subtitle format, and
+// in the codec of its video, transcoded or not
+func (p *Proxy) checkAddedTarget(target *streaming.StreamTarget, streamer *streaming.Streamer, codecs session.Codecs) error {
+	current, err := p.subtitleFormat(streamer.Targets())
+	if err != nil {
+		return err
+	}
+	if format, err := p.subtitleFormat(append(streamer.Targets(), target)); err != nil || format != current {
+		return fmt.Errorf("the stream has %s subtitles", current)
+	}
+
+	codec := codecs.Video
+	if codecs.Transcoded {
+		codec = flv.CodecH264
+	}
+	if codec != "" && !target.SupportsVideoCodec(codec) {
+		return fmt.Errorf("%w: %s", streaming.ErrUnsupportedCodec, codec)
+	}
+	return nil
+}
+
+// subtitleFormat returns the subtitle format of a stream to targets: the one
+// they select, or the configured one. Targets share the processed stream, so
+// they can't select different formats.
+func (p *Proxy) subtitleFormat(targets []*streaming.StreamTarget) (subtitles.SubtitleFormat, error) {
+	name := p.Config.SubtitleFormat
+	selected := ""
+	for _, target := range targets {
+		if target.SubtitleFormat == "" {
+			continue
+		}
+		if selected != "" && !strings.EqualFold(target.SubtitleFormat, selected) {
+			return "", fmt.Errorf("targets select different subtitle formats, %s and %s", selected, target.SubtitleFormat)
+		}
+		selected = target.SubtitleFormat
+		name = selected
+	}
+
+	format, err := subtitles.ParseFormat(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid subtitles parameter: %w", err)
+	}
+	return format, nil
+}
+
+// sidecarFormat returns the format of the subtitle file written next to the
+// transcript for the selected format, VTT if it is VTT and SRT otherwise
+func sidecarFormat(format subtitles.SubtitleFormat) subtitles.SubtitleFormat {
+	if format == subtitles.FormatVTT {
+		return subtitles.FormatVTT
+	}
+	return subtitles.FormatSRT
+}
+
+// VTTOptions returns the configured cue settings and timestamp map of VTT
+// files and live captions
+func (p *Proxy) VTTOptions() subtitles.VTTOptions {
+	return subtitles.VTTOptions{
+		CueSettings: p.Config.VTTCueSettings,
+		MPEGTS:      p.Config.VTTMPEGTS,
+	}
+}
+
+// embeddedFormat returns format if the chunks, which are FLV, can carry it,
+// and FormatNone with a warning if they can't
+func (p *Proxy) embeddedFormat(format subtitles.SubtitleFormat, logger *logrus.Entry) subtitles.SubtitleFormat {
+	if _, err := subtitles.SubtitleCodec(format, subtitles.ContainerFLV); err != nil {
+		logger.WithError(err).WithField("subtitle_format", format).Warn("The restream can't carry a subtitle track, captions will not be embedded; use the burned subtitle format to render them into the picture")
+		return subtitles.FormatNone
+	}
+	return format
+}
+
+// ErrListenerFailed is returned by Start when the FFmpeg listener doesn't come
+// up, most often because another process holds the RTMP port
+var ErrListenerFailed = errors.New("RTMP listener failed to start")
+
+// listenerStartTimeout bounds how long FFmpeg may take to listen on the RTMP
+// port, checked every listenerPollInterval. Without the kernel's socket
+// tables, FFmpeg is only given listenerExitGrace to fail.
+const (
+	listenerStartTimeout = 10 * time.Second
+	listenerPollInterval = 50 * time.Millisecond
+	listenerExitGrace    = time.Second
+)
+
+// startListener starts the FFmpeg listener and closes the given pipe writers
+// once it exits, so readers see EOF when the incoming stream ends. If retry
+// is set, it is asked for a command to run in place of a listener that
+// exited, writing to the same pipes. It returns once FFmpeg listens on the
+// RTMP port, or an error wrapping ErrListenerFailed if it doesn't.
+func (p *Proxy) startListener(cmd *exec.Cmd, retry func(exited procs.Info) *exec.Cmd, pipeWriters ...io.Closer) error {
+	r := p.currentRun()
+	closeWriters := func() {
+		for _, w := range pipeWriters {
+			w.Close()
+		}
+	}
+
+	// FFmpeg only reports a taken port by exiting, after it started
+	if err := p.checkPortFree(); err != nil {
+		closeWriters()
+		return err
+	}
+
+	// Without a video pipe, stderr only carries FFmpeg's messages
+	options := procs.Options{Role: procs.RoleListener, Stderr: cmd.Stderr == nil}
+	listener, err := procs.Start(cmd, options)
+	if err != nil {
+		closeWriters()
+		return fmt.Errorf("failed to start FFmpeg: %w", err)
+	}
+	p.listener.Store(listener)
+
+	// exited gets the first exit, which fails the start if it comes before
+	// FFmpeg listens
+	exited := make(chan procs.Info, 1)
+	go func() {
+		defer close(r.listenerDone)
+		defer closeWriters()
+		// The proxy takes no more streams once the listener is gone
+		defer p.ready.Store(false)
+		for {
+			if err := listener.Wait(); err != nil {
+				p.logger.WithError(err).Debug("FFmpeg listener exited")
+			}
+			select {
+			case exited <- listener.Info():
+			default:
+			}
+			if retry == nil {
+				return
+			}
+			cmd := retry(listener.Info())
+			if cmd == nil {
+				return
+			}
+			if listener, err = procs.Start(cmd, options); err != nil {
+				p.logger.WithError(err).Error("Failed to start FFmpeg again")
+				return
+			}
+			p.listener.Store(listener)
+		}
+	}()
+
+	if err := p.waitListening(exited); err != nil {
+		if err := listener.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			p.logger.WithError(err).Warn("Failed to kill the FFmpeg listener")
+		}
+		<-r.listenerDone
+		return err
+	}
+	return nil
+}
+
+// checkPortFree fails if another process already listens on the RTMP port
+func (p *Proxy) checkPortFree() error {
+	address := net.JoinHostPort(strings.Trim(p.Config.RTMPBindAddress, "[]"), p.Config.RTMPPort)
+	probe, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("%w: cannot listen on %s, is another process using the port? %v", ErrListenerFailed, address, err)
+	}
+	return probe.Close()
+}
+
+// waitListening waits until the listener accepts connections on the RTMP
+// port. It fails if FFmpeg exits first, sending its exit on exited, or takes
+// longer than listenerStartTimeout.
+func (p *Proxy) waitListening(exited <-chan procs.Info) error {
+	exitErr := func(info procs.Info) error {
+		err := fmt.Errorf("%w: FFmpeg exited before listening on port %s", ErrListenerFailed, p.Config.RTMPPort)
+		if stderr := strings.TrimSpace(info.Stderr); stderr != "" {
+			lines := strings.Split(stderr, "\n")
+			err = fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return err
+	}
+
+	port, err := strconv.Atoi(p.Config.RTMPPort)
+	if err != nil {
+		return fmt.Errorf("%w: invalid RTMP port %q", ErrListenerFailed, p.Config.RTMPPort)
+	}
+
+	deadline := time.After(listenerStartTimeout)
+	ticker := time.NewTicker(listenerPollInterval)
+	defer ticker.Stop()
+	for {
+		listening, err := netstat.Listening(port)
+		if err != nil {
+			p.logger.WithError(err).Debug("Cannot see the listener socket, only checking that FFmpeg keeps running")
+			select {
+			case info := <-exited:
+				return exitErr(info)
+			case <-time.After(listenerExitGrace):
+				return nil
+			}
+		}
+		if listening {
+			return nil
+		}
+
+		select {
+		case info := <-exited:
+			return exitErr(info)
+		case <-deadline:
+			return fmt.Errorf("%w: FFmpeg not listening on port %s after %s", ErrListenerFailed, p.Config.RTMPPort, listenerStartTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// listenerArgs returns the arguments of the FFmpeg listener, transcribing
+// audioTrack and restreaming outputTracks, or every audio track if nil, and
+// recording into recording unless it is empty
+func (p *Proxy) listenerArgs(transcribeOnly bool, audioTrack int, outputTracks []int, recording string) []string {
+	args := []string{
+		"-y", // Force overwrite output files
+		"-listen", "1",
+		"-f", "flv",
+		"-i", p.listenURL(),
+
+		// Audio output for transcription
+		"-map", fmt.Sprintf("0:a:%d", audioTrack),
+		"-c:a", "pcm_s16le",
+		"-ar", "16000",
+		"-ac", "1",
+		"-f", "wav",
+		"pipe:1", // Output to stdout for audio
+	}
+
+	if !transcribeOnly {
+		// Video output (preserved for later subtitle embedding) with the
+		// original audio. The video is optional so publishers without it,
+		// like podcasters, don't make FFmpeg fail; the FLV header tells the
+		// pipeline whether there is any.
+		if !p.Config.AudioOnly {
+			args = append(args, "-map", "0:v?")
+		}
+		if outputTracks == nil {
+			args = append(args, "-map", "0:a")
+		}
+		for _, track := range outputTracks {
+			args = append(args, "-map", fmt.Sprintf("0:a:%d", track))
+		}
+		args = append(args,
+			"-c:v", "copy",
+			"-c:a", "copy",
+			"-f", "flv", // Using FLV format for video output
+			"pipe:2", // Output to stderr for video
+		)
+	}
+
+	if recording != "" {
+		args = append(args,
+			"-map", "0",
+			"-c", "copy",
+			"-f", "flv",
+			recording,
+		)
+	}
+
+	return args
+}
+
+// parseAudioTracks parses a comma-separated list of audio track indexes. An
+// empty list selects every track and is returned as nil.
+func parseAudioTracks(spec string) ([]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var tracks []int
+	for _, field := range strings.Split(spec, ",") {
+		track, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || track < 0 {
+			return nil, fmt.Errorf("%q is not an audio track index", field)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// mapErrorPattern is in FFmpeg's output when a -map selects a track the
+// input doesn't have
+const mapErrorPattern = "matches no streams"
+
+// mapErrorScanSize is how much of FFmpeg's output is searched for
+// mapErrorPattern. Maps are resolved before any output is written, so the
+// error can't come after the video data starts.
+const mapErrorScanSize = 16 * 1024
+
+// mapErrorDetector passes FFmpeg's stderr through to w and notes whether
+// the messages before the output started report a map that matched nothing
+type mapErrorDetector struct {
+	w    io.Writer
+	head []byte
+}
+
+func (d *mapErrorDetector) Write(data []byte) (int, error) {
+	if room := mapErrorScanSize - len(d.head); room > 0 {
+		d.head = append(d.head, data[:min(room, len(data))]...)
+	}
+	return d.w.Write(data)
+}
+
+// found reports whether a map error was seen; it is nil-safe and must only
+// be called once FFmpeg has exited
+func (d *mapErrorDetector) found() bool {
+	return d != nil && bytes.Contains(d.head, []byte(mapErrorPattern))
+}
+
+// reset forgets the output seen, before the detector is reused
+func (d *mapErrorDetector) reset() {
+	d.head = d.head[:0]
+}
+
+// resumer keeps a session going while its publisher reconnects within
+// SESSION_RESUME_WINDOW. Every listener started for the session writes to
+// pipes of its own, which resumer splices into the pipes of the pipeline as
+// if a single connection had written them: the audio without the WAV headers
+// of later connections, and the video with its timestamps continuing where
+// the previous connection ended, so chunk indices and caption times go on.
+type resumer struct {
+	window   time.Duration
+	audio    *io.PipeWriter // Audio pipe of the pipeline
+	video    *io.PipeWriter // Video pipe of the pipeline, nil in transcribe-only mode
+	splicer  *flv.Splicer   // Writes to video
+	listener *atomic.Pointer[procs.Process]
+	logger   *logrus.Entry
+
+	// conn is the connection of the running listener, and disconnectedAt
+	// when the publisher left the one before. pcmBytes is the audio spliced
+	// so far, in format. They are only used by the goroutine running the
+	// listeners and the copies of the connection it waits for.
+	conn           *publisherConn
+	disconnectedAt time.Time
+	pcmBytes       int64
+	format         audio.Format
+
+	mu sync.Mutex
+	// connections counts the connections of the publisher so far
+	connections int
+	// resumed is called once the publisher is back, with the stream time at
+	// which it left and how long it was away
+	resumed func(at, gap time.Duration)
+}
+
+// publisherConn is a listener started by resumer and the publisher
+// connecting to it
+type publisherConn struct {
+	cmd    *exec.Cmd
+	audio  *io.PipeWriter // Written by the listener
+	video  *io.PipeWriter // Written by the listener, nil in transcribe-only mode
+	copies sync.WaitGroup // Copying the pipes into those of the pipeline
+	// expiry ends the session if the publisher doesn't reconnect in time,
+	// nil for a listener no publisher connected to before
+	expiry *time.Timer
+
+	// connected is set once the publisher is connected, detached once the
+	// listener exited; both are guarded by resumer.mu
+	connected bool
+	detached  bool
+}
+
+// newResumer creates a resumer splicing into the audio and video pipes of
+// the pipeline, with video nil in transcribe-only mode. listener holds the
+// running listener.
+func newResumer(window time.Duration, audio, video *io.PipeWriter, listener *atomic.Pointer[procs.Process], logger *logrus.Logger) *resumer {
+	r := &resumer{
+		window:   window,
+		audio:    audio,
+		video:    video,
+		listener: listener,
+		logger:   logger.WithField("processor", "resume"),
+	}
+	if video != nil {
+		r.splicer = flv.NewSplicer(video)
+	}
+	return r
+}
+
+// onResume sets the function called once the publisher is back, with the
+// stream time at which it left and how long it was away
+func (r *resumer) onResume(resumed func(at, gap time.Duration)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resumed = resumed
+}
+
+// publishers returns how many connections the publisher made so far
+func (r *resumer) publishers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connections
+}
+
+// position returns the stream time of the audio spliced so far
+func (r *resumer) position() time.Duration {
+	if r.format.BytesPerSecond() == 0 {
+		return 0
+	}
+	return audio.Duration(int(r.pcmBytes), r.format)
+}
+
+// attach gives the listener cmd pipes of its own and starts splicing them,
+// returning the writers for its audio and video output. The listener of a
+// publisher that disconnected is interrupted if nobody connects to it within
+// the window.
+func (r *resumer) attach(cmd *exec.Cmd) (io.Writer, io.Writer) {
+	audioReader, audioWriter := io.Pipe()
+	conn := &publisherConn{cmd: cmd, audio: audioWriter}
+	r.mu.Lock()
+	if r.connections > 0 {
+		conn.expiry = time.AfterFunc(r.window, func() { r.expire(conn) })
+	}
+	r.mu.Unlock()
+	r.conn = conn
+
+	conn.copies.Add(1)
+	go r.copyAudio(conn, audioReader)
+	if r.video == nil {
+		return audioWriter, nil
+	}
+	videoReader, videoWriter := io.Pipe()
+	conn.video = videoWriter
+	conn.copies.Add(1)
+	go r.copyVideo(conn, videoReader, r.position())
+	return audioWriter, videoWriter
+}
+
+// copyAudio splices the audio of conn, starting with its WAV header, into
+// the audio pipe of the pipeline. The first connection's header goes into
+// the pipe as the header of the whole stream.
+func (r *resumer) copyAudio(conn *publisherConn, reader io.Reader) {
+	defer conn.copies.Done()
+	// What isn't spliced is still read, so the listener never blocks
+	defer io.Copy(io.Discard, reader)
+
+	pcm, format, err := audio.NewPCMReader(reader)
+	if err != nil {
+		// Nobody connected to the listener
+		return
+	}
+
+	r.mu.Lock()
+	conn.connected = true
+	r.connections++
+	reconnects := r.connections - 1
+	resumed := r.resumed
+	r.mu.Unlock()
+	if conn.expiry != nil {
+		conn.expiry.Stop()
+	}
+
+	if reconnects == 0 {
+		// The listener always writes the same format, so later
+		// connections can do without a header
+		r.format = format
+		if _, err := r.audio.Write(audio.EncodeWAV(nil, format.SampleRate, format.Channels, format.BitsPerSample)); err != nil {
+			return
+		}
+	} else {
+		at, gap := r.position(), time.Since(r.disconnectedAt)
+		r.logger.WithFields(logrus.Fields{
+			"gap":        gap.Round(time.Millisecond),
+			"reconnects": reconnects,
+		}).Info("Publisher reconnected, continuing the session")
+		if resumed != nil {
+			resumed(at, gap)
+		}
+	}
+
+	n, _ := io.Copy(r.audio, pcm)
+	r.pcmBytes += n
+}
+
+// copyVideo splices the video of conn into the video pipe of the pipeline,
+// starting at the stream time start
+func (r *resumer) copyVideo(conn *publisherConn, reader io.Reader, start time.Duration) {
+	defer conn.copies.Done()
+	// What isn't spliced is still read, so the listener never blocks
+	defer io.Copy(io.Discard, reader)
+
+	err := r.splicer.Append(reader, start)
+	// Without a publisher, or once the pipeline stopped reading, there is
+	// nothing to splice
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, flv.ErrInvalidHeader) {
+		r.logger.WithError(err).Warn("Failed to splice the video of the publisher's connection")
+	}
+}
+
+// expire interrupts the listener of conn if the publisher hasn't reconnected
+// to it, which ends the session
+func (r *resumer) expire(conn *publisherConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn.connected || conn.detached {
+		return
+	}
+
+	listener := r.listener.Load()
+	if listener == nil || listener.Cmd != conn.cmd {
+		// The listener is only just being started
+		conn.expiry.Reset(listenerPollInterval)
+		return
+	}
+	r.logger.WithField("window", r.window).Info("The publisher did not reconnect in time, ending the session")
+	if err := listener.Signal(os.Interrupt); err != nil {
+		r.logger.WithError(err).Warn("Failed to stop the listener")
+	}
+}
+
+// detach waits until what the exited listener wrote has been spliced,
+// returning its connection, or nil if there was none
+func (r *resumer) detach() *publisherConn {
+	conn := r.conn
+	if conn == nil {
+		return nil
+	}
+	r.conn = nil
+
+	r.mu.Lock()
+	conn.detached = true
+	r.mu.Unlock()
+	if conn.expiry != nil {
+		conn.expiry.Stop()
+	}
+	conn.audio.Close()
+	if conn.video != nil {
+		conn.video.Close()
+	}
+	conn.copies.Wait()
+	return conn
+}
+
+// disconnected is called once the listener exited. It reports whether a new
+// listener is to be started for the publisher to reconnect to: if the
+// publisher was connected, unless the stream is ending.
+func (r *resumer) disconnected(ending bool) bool {
+	conn := r.detach()
+	if conn == nil || ending {
+		return false
+	}
+	r.mu.Lock()
+	connected := conn.connected
+	r.mu.Unlock()
+	if !connected {
+		return false
+	}
+
+	r.disconnectedAt = time.Now()
+	r.logger.WithField("window", r.window).Info("Publisher disconnected, waiting for it to reconnect")
+	return true
+}
+
+// Close closes the pipes of the pipeline once no listener is left
+func (r *resumer) Close() error {
+	r.detach()
+	if r.video != nil {
+		r.video.Close()
+	}
+	return r.audio.Close()
+}
+
+// recordingPart returns where the listener for the nth connection of the
+// publisher records, counted from 0: the recording path for the first, and a
+// part next to it for every reconnect, which is joined to the recording once
+// the stream ends
+func (p *Proxy) recordingPart(n int) string {
+	if n == 0 || p.recordingPath == "" {
+		return p.recordingPath
+	}
+	return fmt.Sprintf("%s.%d", p.recordingPath, n)
+}
+
+// joinRecordingParts appends the parts recorded after reconnects of the
+// publisher to the recording, in order, and removes them
+func (p *Proxy) joinRecordingParts() error {
+	var parts []string
+	for n := 1; ; n++ {
+		part := p.recordingPart(n)
+		if _, err := os.Stat(part); err != nil {
+			break
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	defer func() {
+		for _, part := range parts {
+			os.Remove(part)
+		}
+	}()
+
+	joined := p.recordingPath + ".joined"
+	out, err := os.Create(joined)
+	if err != nil {
+		return fmt.Errorf("failed to create joined recording: %w", err)
+	}
+	defer os.Remove(joined)
+	w := bufio.NewWriter(out)
+	splicer := flv.NewSplicer(w)
+	for _, path := range append([]string{p.recordingPath}, parts...) {
+		in, err := os.Open(path)
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to open recording part: %w", err)
+		}
+		err = splicer.Append(bufio.NewReader(in), 0)
+		in.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			out.Close()
+			return fmt.Errorf("failed to join recording part %s: %w", filepath.Base(path), err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write joined recording: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write joined recording: %w", err)
+	}
+	return os.Rename(joined, p.recordingPath)
+}
+
+// relayStream forwards FLV data to the targets as soon as it is read, with no
+// buffering beyond a single read
+func (p *Proxy) relayStream(reader io.ReadCloser, streamer *streaming.Streamer) {
+	defer close(p.currentRun().pipelineDone)
+	defer reader.Close()
+	defer streamer.Cleanup()
+
+	logger := p.logger.WithField("processor", "passthrough")
+	logger.Info("Waiting for incoming RTMP stream")
+	p.setStatusState(statusfile.StateWaiting)
+	defer p.setStatusState(statusfile.StateOffline)
+
+	// The stream is relayed tag by tag, so targets that start part way
+	// through get the headers of the stream first and join at a keyframe
+	flvReader, err := flv.NewReader(reader)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			logger.WithError(err).Error("Error reading stream header")
+			p.currentRun().ended(StopFailed, err)
+		}
+		p.currentRun().ended(StopStreamEnded, nil)
+		logger.Info("Passthrough relay stopped")
+		return
+	}
+
+	p.countSession()
+	startedAt := time.Now()
+	p.updateStatus(func(status *statusfile.Status) {
+		*status = statusfile.Status{State: statusfile.StateLive, StreamKey: streamKey, StartedAt: &startedAt}
+	})
+
+	headers := flv.NewStreamHeaders(flvReader.Header)
+	streamer.SetPreamble(headers.Preamble())
+	relaying := false
+	var buf bytes.Buffer
+	for {
+		tag, err := flvReader.ReadTag()
+		if err != nil {
+			if err != io.EOF {
+				logger.WithError(err).Error("Error reading stream data")
+				p.currentRun().ended(StopFailed, err)
+			}
+			p.currentRun().ended(StopStreamEnded, nil)
+			logger.Info("Passthrough relay stopped")
+			return
+		}
+
+		if headers.Add(tag) {
+			streamer.SetPreamble(headers.Preamble())
+		}
+		// Headers sent before any other tag only go out in the preamble
+		if !relaying && (tag.Type == flv.TagScript || tag.IsSequenceHeader()) {
+			continue
+		}
+
+		buf.Reset()
+		flv.WriteTag(&buf, tag)
+		stream := streamer.StreamPart
+		if headers.Joinable(tag) {
+			stream = streamer.Stream
+		}
+		if err := stream(buf.Bytes()); err != nil {
+			logger.WithError(err).Warn("Failed to relay stream data")
+		}
+		relaying = true
+	}
+}
+
+// streamKey is the stream name publishers push to under the application path
+const streamKey = "stream"
+
+// workDirName is the directory of the proxy in WORK_DIR, which may be shared
+// with other programs, e.g. /tmp
+const workDirName = "transcription-proxy"
+
+// tempRoot returns the directory holding the temp directories of all
+// sessions: a directory of its own in WORK_DIR, whose other entries are left
+// alone, or else a hidden directory in the output directory, so it can never
+// collide with a session directory
+func (p *Proxy) tempRoot() string {
+	if p.Config.WorkDir != "" {
+		return filepath.Join(p.Config.WorkDir, workDirName)
+	}
+	return filepath.Join(p.Config.OutputDir, ".temp")
+}
+
+// checkDirs checks the work directory, which holds the temp directories of
+// the sessions and must be writable, and the output directory, whose
+// artifacts are disabled if it isn't
+func (p *Proxy) checkDirs() error {
+	if err := checkWritable(p.tempRoot()); err != nil {
+		if p.Config.WorkDir == "" {
+			return fmt.Errorf("work directory %s is not writable, set WORK_DIR to a writable directory such as /tmp: %w", p.tempRoot(), err)
+		}
+		return fmt.Errorf("WORK_DIR %s is not writable: %w", p.Config.WorkDir, err)
+	}
+	if err := checkWritable(p.Config.OutputDir); err != nil {
+		p.outputDisabled.Store(true)
+		p.logger.WithError(err).WithField("dir", p.Config.OutputDir).Warn("OUTPUT_DIR is not writable, transcripts, recordings, and session summaries are disabled")
+	}
+	return nil
+}
+
+// checkWritable creates dir if needed and a file in it, so a read-only
+// filesystem or missing permissions are reported up front
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".write-check-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// OutputDisabled reports whether session artifacts are disabled because
+// OUTPUT_DIR isn't writable
+func (p *Proxy) OutputDisabled() bool {
+	return p.outputDisabled.Load()
+}
+
+// TempDir returns the directory for temporary files. Directories created in
+// it are removed on startup once they are older than TEMP_MAX_AGE.
+func (p *Proxy) TempDir() string {
+	return p.tempRoot()
+}
+
+// sweepTempDirs removes session temp directories older than the configured
+// maximum age, as well as the shared temp directories of earlier versions
+func (p *Proxy) sweepTempDirs() {
+	cutoff := time.Now().Add(-p.Config.TempMaxAge)
+
+	var stale []string
+	if entries, err := os.ReadDir(p.tempRoot()); err != nil {
+		p.logger.WithError(err).Warn("Failed to list temp directories")
+	} else {
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			stale = append(stale, filepath.Join(p.tempRoot(), entry.Name()))
+		}
+	}
+
+	for _, legacy := range []string{"ffmpeg_temp", "transcription_temp"} {
+		stale = append(stale, filepath.Join(p.Config.OutputDir, legacy))
+	}
+
+	for _, dir := range stale {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			p.logger.WithError(err).WithField("dir", dir).Warn("Failed to remove stale temp directory")
+			continue
+		}
+		p.logger.WithField("dir", dir).Info("Removed stale temp directory")
+	}
+}
+
+// HealthStatus describes the current health of the proxy
+type HealthStatus struct {
+	Status         string           `json:"status"`
+	Listener       string           `json:"listener"`
+	Disk           diskspace.Status `json:"disk"`
+	OutputDisabled bool             `json:"output_disabled,omitempty"` // OUTPUT_DIR isn't writable
+}
+
+// States of the FFmpeg listener in HealthStatus
+const (
+	ListenerStarting  = "starting"  // Not started yet, e.g. while models warm up
+	ListenerListening = "listening" // Running, waiting for or receiving the stream
+	ListenerStopped   = "stopped"   // Exited; no more streams are taken
+)
+
+// Health reports whether the proxy is healthy, including the state of the
+// listener and free disk space. A listener that stopped makes it degraded, as
+// it takes no more streams. Disabled artifacts are reported but don't make it
+// unhealthy, as a read-only OUTPUT_DIR may be deliberate.
+func (p *Proxy) Health() HealthStatus {
+	health := HealthStatus{
+		Status:         "ok",
+		Listener:       p.listenerState(),
+		Disk:           p.diskMonitor.Status(),
+		OutputDisabled: p.outputDisabled.Load(),
+	}
+
+	if health.Disk.Low || health.Listener == ListenerStopped {
+		health.Status = "degraded"
+	}
+
+	return health
+}
+
+// listenerState returns the state of the FFmpeg listener
+func (p *Proxy) listenerState() string {
+	if p.listener.Load() == nil {
+		return ListenerStarting
+	}
+	select {
+	case <-p.currentRun().listenerDone:
+		return ListenerStopped
+	default:
+		return ListenerListening
+	}
+}
+
+// ModelStatus describes the Whisper model in use
+type ModelStatus struct {
+	Size      string `json:"size"`
+	Directory string `json:"directory"`
+}
+
+// StreamStatus describes the stream currently being processed
+type StreamStatus struct {
+	Session             string                   `json:"session"`
+	Languages           Languages                `json:"languages"`
+	TranslationDegraded bool                     `json:"translation_degraded"`
+	ClockDriftMs        int64                    `json:"clock_drift_ms"` // Video clock ahead of the audio clock
+	Codecs              session.Codecs           `json:"codecs"`
+	Publisher           *session.Publisher       `json:"publisher,omitempty"`
+	Targets             []streaming.TargetStatus `json:"targets,omitempty"`
+
+	// DelaySeconds is how far the output lags behind the input, and
+	// DumpedUntilSeconds up to where a moderator dumped it
+	DelaySeconds       float64 `json:"delay_seconds"`
+	DumpedUntilSeconds float64 `json:"dumped_until_seconds,omitempty"`
+
+	// Queue counts the video chunks queued in memory and spooled to disk
+	Queue spool.Stats `json:"queue"`
+
+	// TooSmallChunks counts the chunks too small to be transcribed, and
+	// PipelineDegraded is set once too many in a row were
+	TooSmallChunks   int  `json:"too_small_chunks"`
+	PipelineDegraded bool `json:"pipeline_degraded"`
+
+	// RealTimeFactor is the time recent chunks took to transcribe, caption,
+	// and embed relative to their duration; above 1 the stream falls behind
+	RealTimeFactor float64 `json:"real_time_factor"`
+
+	// InputLoudness is the level of the input averaged over recent chunks
+	// with speech
+	InputLoudness *audio.Loudness `json:"input_loudness,omitempty"`
+}
+
+// StatusReport describes the current configuration and state of the proxy
+type StatusReport struct {
+	Mode                 string                  `json:"mode"`
+	Ready                bool                    `json:"ready"`
+	WhisperModel         ModelStatus             `json:"whisper_model"`
+	WarmupRealTimeFactor float64                 `json:"warmup_real_time_factor,omitempty"` // Measured after warm-up
+	Confidence           ConfidenceStatus        `json:"confidence"`
+	GPUFallback          pipeline.FallbackStatus `json:"gpu_fallback"`
+	VRAM                 *pipeline.VRAMStatus    `json:"vram,omitempty"` // Free GPU memory, with CUDA
+	Scheduler            scheduler.Status        `json:"scheduler"`      // Transcriptions queued and running per priority
+	Stream               *StreamStatus           `json:"stream,omitempty"`
+}
+
+// Status returns the current status of the proxy
+func (p *Proxy) Status() StatusReport {
+	report := StatusReport{
+		Mode:  p.Config.Mode,
+		Ready: p.Ready(),
+		WhisperModel: ModelStatus{
+			Size:      p.Config.WhisperModelSize,
+			Directory: p.transcriber.ModelDir(),
+		},
+		Confidence:           p.confidence.Status(),
+		GPUFallback:          p.fallback.Status(),
+		WarmupRealTimeFactor: math.Float64frombits(p.warmupRTF.Load()),
+		Scheduler:            p.scheduler.Status(),
+		Stream:               p.streamStatus(),
+	}
+	if p.Config.CUDAEnabled {
+		vram := p.vram.Status()
+		report.VRAM = &vram
+	}
+	return report
+}
+
+// streamStatus returns the status of the active stream, or nil
+func (p *Proxy) streamStatus() *StreamStatus {
+	active := p.activeSession()
+	if active == nil {
+		return nil
+	}
+
+	summary := active.session.Summary()
+	status := &StreamStatus{
+		Session:             active.session.ID(),
+		Languages:           active.conn.languages(),
+		TranslationDegraded: p.translator.Degraded(),
+		ClockDriftMs:        active.pipeline.Drift().Milliseconds(),
+		Codecs:              summary.Codecs,
+		Publisher:           summary.Publisher,
+		DelaySeconds:        p.Config.StreamDelay.Seconds(),
+		DumpedUntilSeconds:  active.pipeline.DumpedUntil().Seconds(),
+		Queue:               active.pipeline.Queue(),
+		TooSmallChunks:      active.pipeline.TooSmallChunks(),
+		PipelineDegraded:    active.pipeline.Degraded(),
+		RealTimeFactor:      math.Round(active.pipeline.RealTimeFactor()*100) / 100,
+	}
+	if loudness, ok := active.pipeline.InputLoudness(); ok {
+		status.InputLoudness = &loudness
+	}
+	if active.streamer != nil {
+		status.Targets = active.streamer.TargetStatuses()
+	}
+	return status
+}
+
+// LiveCues returns the cues of the active session newer than since. The
+// second result is false when no session is active.
+func (p *Proxy) LiveCues(since int) ([]transcript.Cue, bool) {
+	active := p.activeSession()
+	if active == nil || active.store == nil {
+		return nil, false
+	}
+	return active.store.Cues(since), true
+}
+
+// RecentCues returns up to limit of the newest cues of the active session. The
+// second result is false when no session is active.
+func (p *Proxy) RecentCues(limit int) ([]transcript.Cue, bool) {
+	active := p.activeSession()
+	if active == nil || active.store == nil {
+		return nil, false
+	}
+	return active.store.Recent(limit), true
+}
+
+// Languages are the source, target, and extra languages of a stream
+type Languages = pipeline.Languages
+
+// SetLanguages switches the languages of the active stream. Empty values keep
+// the current language. The pair is checked before anything changes; chunks
+// already being processed finish with the old languages.
+func (p *Proxy) SetLanguages(languages Languages) (Languages, error) {
+	p.languagesMu.Lock()
+	defer p.languagesMu.Unlock()
+
+	active := p.activeSession()
+	if active == nil {
+		return Languages{}, ErrNoActiveStream
+	}
+
+	current := active.conn.languages()
+	if languages.Source == "" {
+		languages.Source = current.Source
+	}
+	if languages.Target == "" {
+		languages.Target = current.Target
+	}
+	// The extra languages are changed with ChangeExtraLanguages
+	languages.Extra = current.Extra
+
+	if err := p.translator.RequestLanguagePair(languages.Source, languages.Target); err != nil {
+		return current, err
+	}
+
+	// A session with subtitle tracks gets them in the new languages too
+	if active.store != nil && active.store.TrackFiles() != nil {
+		if err := active.store.AddTracks(trackLangs(languages, true)); err != nil {
+			p.logger.WithError(err).Warn("Failed to create subtitle tracks for the new languages")
+		}
+	}
+	active.conn.setLanguages(languages)
+
+	active.session.Update(func(summary *session.Summary) {
+		if active.store != nil {
+			summary.SubtitleTracks = active.store.TrackFiles()
+		}
+		summary.LanguageChanges = append(summary.LanguageChanges, session.LanguageChange{
+			At:         time.Now(),
+			SourceLang: languages.Source,
+			TargetLang: languages.Target,
+			ExtraLangs: languages.Extra,
+		})
+	})
+	if err := active.session.WriteSummary(); err != nil {
+		p.logger.WithError(err).Warn("Failed to write session summary")
+	}
+
+	p.setStatusLanguages(languages)
+
+	p.logger.WithFields(logrus.Fields{
+		"session":     active.session.ID(),
+		"source_lang": languages.Source,
+		"target_lang": languages.Target,
+	}).Info("Stream languages changed")
+
+	return languages, nil
+}
+
+// ChangeExtraLanguages adds and removes extra languages the captions of the
+// active stream are translated into. Each added language gets a subtitle
+// track from now on, as do the source and target language if they have none
+// yet, and caption events carry its translation; earlier captions are left
+// to reprocessing. The pairs are checked before anything changes, and chunks
+// already being processed finish with the old languages.
+func (p *Proxy) ChangeExtraLanguages(add, remove []string) (Languages, error) {
+	p.languagesMu.Lock()
+	defer p.languagesMu.Unlock()
+
+	active := p.activeSession()
+	if active == nil {
+		return Languages{}, ErrNoActiveStream
+	}
+	current := active.conn.languages()
+	languages := current
+	removed := make(map[string]bool, len(remove))
+	for _, lang := range remove {
+		removed[strings.ToLower(strings.TrimSpace(lang))] = true
+	}
+	languages.Extra = nil
+	for _, lang := range current.Extra {
+		if !removed[lang] {
+			languages.Extra = append(languages.Extra, lang)
+		}
+	}
+	for _, lang := range add {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" || slices.Contains(languages.Extra, lang) {
+			continue
+		}
+		if err := p.translator.RequestLanguagePair(languages.Source, lang); err != nil {
+			return current, err
+		}
+		languages.Extra = append(languages.Extra, lang)
+	}
+
+	// The tracks exist before any chunk is captioned into them
+	if active.store != nil {
+		if err := active.store.AddTracks(trackLangs(languages, false)); err != nil {
+			return current, fmt.Errorf("failed to create subtitle tracks: %w", err)
+		}
+	}
+	active.conn.setLanguages(languages)
+
+	active.session.Update(func(summary *session.Summary) {
+		if active.store != nil {
+			summary.SubtitleTracks = active.store.TrackFiles()
+		}
+		summary.LanguageChanges = append(summary.LanguageChanges, session.LanguageChange{
+			At:         time.Now(),
+			SourceLang: languages.Source,
+			TargetLang: languages.Target,
+			ExtraLangs: languages.Extra,
+		})
+	})
+	if err := active.session.WriteSummary(); err != nil {
+		p.logger.WithError(err).Warn("Failed to write session summary")
+	}
+
+	p.setStatusLanguages(languages)
+
+	p.logger.WithFields(logrus.Fields{
+		"session":     active.session.ID(),
+		"extra_langs": strings.Join(languages.Extra, ","),
+	}).Info("Stream extra languages changed")
+
+	return languages, nil
+}
+
+// DumpDelayed drops everything of the active stream that has been received
+// but not sent yet: delayed chunks go out blanked, with black video and
+// silence, and delayed captions are not published. It returns the stream
+// time up to which output was dumped.
+func (p *Proxy) DumpDelayed() (time.Duration, error) {
+	if p.Config.StreamDelay <= 0 {
+		return 0, ErrNoDelay
+	}
+	active := p.activeSession()
+	if active == nil {
+		return 0, ErrNoActiveStream
+	}
+
+	until := active.pipeline.Dump()
+	p.logger.WithFields(logrus.Fields{
+		"session":      active.session.ID(),
+		"dumped_until": until,
+	}).Warn("Delayed output dumped")
+	return until, nil
+}
+
+// FlushTranscripts writes the transcript, subtitles, and full transcript of
+// the active stream to disk right away, complete up to the last captioned
+// chunk, and returns their paths. The stream goes on unaffected.
+func (p *Proxy) FlushTranscripts() ([]string, error) {
+	active := p.activeSession()
+	if active == nil {
+		return nil, ErrNoActiveStream
+	}
+	if active.store == nil {
+		return nil, ErrNoTranscript
+	}
+
+	paths, err := active.store.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to flush transcripts: %w", err)
+	}
+	if active.sidecar != nil {
+		path, err := active.sidecar.Sync()
+		if err != nil {
+			return nil, fmt.Errorf("failed to flush subtitles: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	p.logger.WithFields(logrus.Fields{
+		"session": active.session.ID(),
+		"files":   paths,
+	}).Info("Transcripts flushed to disk")
+	return paths, nil
+}
+
+// activeSession returns the stream currently being processed, or nil
+func (p *Proxy) activeSession() *activeSession {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	return p.active
+}
+
+// setActiveSession sets the stream currently being processed
+func (p *Proxy) setActiveSession(active *activeSession) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	p.active = active
+}
+
+// Events returns the bus carrying captions and stream lifecycle events
+func (p *Proxy) Events() *events.Bus {
+	return p.events
+}
+
+// publisherBuffer is how many events a publisher may fall behind before it
+// loses the oldest
+const publisherBuffer = 100
+
+// subscribe subscribes a publisher of run r to bus
+func (r *run) subscribe(bus *events.Bus) *events.Subscription {
+	sub := bus.Subscribe(publisherBuffer)
+	r.publishers = append(r.publishers, sub)
+	return sub
+}
+
+// startPublishers sets up the configured caption publishers for run r. The
+// event publishers run until it ends, the platform publishers get the
+// captions of each stream as subtitle sinks. A publisher that can't be set
+// up is logged and left out.
+func (p *Proxy) startPublishers(r *run) {
+	if p.Config.TwitchExtensionClientID != "" {
+		publisher, err := twitch.New(p.Config, p.logger)
+		if err != nil {
+			p.logger.WithError(err).Error("Twitch extension captions disabled")
+		} else {
+			r.twitch = publisher
+		}
+	}
+
+	if p.Config.YouTubeCaptionsURL != "" {
+		publisher, err := youtube.New(p.Config, p.logger)
+		if err != nil {
+			p.logger.WithError(err).Error("YouTube captions disabled")
+		} else {
+			r.youtube = publisher
+		}
+	}
+
+	if p.Config.MQTTBroker != "" {
+		publisher, err := mqtt.New(p.Config, streamKey, p.logger)
+		if err != nil {
+			p.logger.WithError(err).Error("MQTT publishing disabled")
+		} else {
+			go publisher.Run(r.subscribe(p.events))
+		}
+	}
+}
+
+// Logger returns the logger used by the proxy
+func (p *Proxy) Logger() *logrus.Logger {
+	return p.logger
+}
+
+// listenURL returns the RTMP URL FFmpeg listens on for the incoming stream
+func (p *Proxy) listenURL() string {
+	return p.ingestURL(streamKey)
+}
+
+// ingestURL returns the RTMP URL of the listener with key as the stream name
+func (p *Proxy) ingestURL(key string) string {
+	// JoinHostPort brackets IPv6 addresses
+	host := net.JoinHostPort(strings.Trim(p.Config.RTMPBindAddress, "[]"), p.Config.RTMPPort)
+	return fmt.Sprintf("rtmp://%s/%s/%s", host, strings.Trim(p.Config.RTMPAppPath, "/"), key)
+}
+
+// checkListenAddress checks the bind address and application path of the
+// listener
+func (p *Proxy) checkListenAddress() error {
+	if _, err := netip.ParseAddr(strings.Trim(p.Config.RTMPBindAddress, "[]")); err != nil {
+		return fmt.Errorf("invalid RTMP bind address %q: %w", p.Config.RTMPBindAddress, err)
+	}
+
+	app := strings.Trim(p.Config.RTMPAppPath, "/")
+	if app == "" {
+		return errors.New("RTMP application path is empty")
+	}
+	for _, r := range app {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/._-", r)
+		if !valid {
+			return fmt.Errorf("invalid RTMP application path %q: unexpected character %q", p.Config.RTMPAppPath, r)
+		}
+	}
+	return nil
+}
+
+// Stop stops the RTMP server in two phases. FFmpeg is first told to stop
+// accepting the incoming stream, then chunks that are already queued or in
+// flight are given until ctx is done to finish processing and reach the
+// targets, whose pipes are closed cleanly afterwards, and post-session jobs
+// are given the same time to complete. If ctx expires first, the remaining
+// work is abandoned and ErrShutdownForced is returned. Stopping a stopped
+// proxy does nothing; it can be started again once stopped.
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.stateMu.Lock()
+	if p.state != stateRunning {
+		state := p.state
+		p.stateMu.Unlock()
+		if state == stateStopped {
+			return nil
+		}
+		return stateErr(state)
+	}
+	p.state = stateStopping
+	p.stateMu.Unlock()
+
+	r := p.currentRun()
+	r.ended(StopRequested, nil)
+	err := p.stop(ctx, r)
+	p.endRun(r)
+
+	select {
+	case <-r.pipelineDone:
+		p.setState(stateStopped)
+	default:
+		// The next run can't start while this one still streams
+		go func() {
+			<-r.pipelineDone
+			p.setState(stateStopped)
+		}()
+	}
+	return err
+}
+
+// stop stops run r, see Stop
+func (p *Proxy) stop(ctx context.Context, r *run) error {
+	listener := p.listener.Load()
+	if listener == nil {
+		return nil
+	}
+
+	p.logger.Info("Stopping FFmpeg RTMP server")
+	p.ready.Store(false)
+	r.ending.Store(true)
+
+	select {
+	case <-r.listenerDone:
+		// The stream already ended on its own
+	default:
+		if err := listener.Signal(os.Interrupt); err != nil {
+			p.logger.WithError(err).Warning("Failed to send interrupt to FFmpeg, forcing kill")
+			if err := listener.Kill(); err != nil {
+				return fmt.Errorf("failed to kill FFmpeg process: %w", err)
+			}
+		}
+	}
+
+	p.logger.Info("Draining in-flight chunks")
+
+	select {
+	case <-r.pipelineDone:
+		close(r.stop)
+		<-r.listenerDone
+		p.logger.Info("FFmpeg RTMP server stopped")
+		return p.waitPostSessionJobs(ctx)
+
+	case <-ctx.Done():
+		p.logger.Warn("Shutdown deadline reached, abandoning in-flight chunks")
+		close(r.stop)
+		p.listener.Load().Kill()
+		<-r.listenerDone
+
+		// Give the pipeline a moment to close the target pipes now that
+		// everything has been told to abort
+		select {
+		case <-r.pipelineDone:
+		case <-time.After(forcedCleanupTimeout):
+			p.logger.Warn("Stream processing did not stop in time")
+		}
+		r.cancelJobs()
+		return ErrShutdownForced
+	}
+}
+
+// Close stops the proxy like Stop, then releases what its runs share: the
+// event bus, the transcript index, the status file, and the reprocessing
+// jobs. The proxy can't be started again.
+func (p *Proxy) Close(ctx context.Context) error {
+	err := p.Stop(ctx)
+
+	p.stateMu.Lock()
+	closed := p.closed
+	p.closed = true
+	p.stateMu.Unlock()
+	if closed {
+		return err
+	}
+
+	p.totalsMu.Lock()
+	p.closeErr = err
+	p.totalsMu.Unlock()
+
+	p.stopReprocessing()
+	p.events.Close()
+	p.closeIndex()
+	p.closeStatus()
+	return err
+}
+
+// Reasons the proxy stopped, in ShutdownReport
+const (
+	StopRequested   = "requested"            // Stop or Close was called, e.g. on a signal
+	StopStreamEnded = "stream_ended"         // The publisher ended the stream
+	StopMaxDuration = session.EndMaxDuration // The stream ran for MAX_STREAM_DURATION
+	StopIdle        = session.EndIdle        // The stream was idle for IDLE_TIMEOUT
+	StopFailed      = session.EndFailed      // Processing failed and can't recover
+)
+
+// ShutdownReport sums up what the proxy did until it was closed
+type ShutdownReport struct {
+	Reason   string              `json:"reason"`
+	Error    string              `json:"error,omitempty"` // Why processing failed, for StopFailed
+	Uptime   time.Duration       `json:"uptime"`
+	Sessions int                 `json:"sessions"` // Streams received
+	Chunks   pipeline.ChunkStats `json:"chunks"`
+	// Drained is set if the in-flight chunks and post-session jobs
+	// completed before the shutdown deadline
+	Drained bool `json:"drained"`
+}
+
+// Fatal reports whether the proxy stopped on an error it can't recover from
+// by itself
+func (r ShutdownReport) Fatal() bool {
+	return r.Reason == StopFailed
+}
+
+// Done returns a channel closed once the current run is over: its stream was
+// processed, or it was stopped, and no more streams are taken. It must only
+// be called once the proxy was started.
+func (p *Proxy) Done() <-chan struct{} {
+	return p.currentRun().pipelineDone
+}
+
+// Report returns the shutdown report of the proxy, complete once it was
+// closed
+func (p *Proxy) Report() ShutdownReport {
+	p.totalsMu.Lock()
+	report := ShutdownReport{
+		Reason:   StopRequested,
+		Uptime:   time.Since(p.createdAt),
+		Sessions: p.sessions,
+		Chunks:   p.chunks,
+	}
+	closeErr := p.closeErr
+	p.totalsMu.Unlock()
+
+	if r := p.currentRun(); r != nil {
+		if reason, err := r.outcome(); reason != "" {
+			report.Reason = reason
+			if err != nil {
+				report.Error = err.Error()
+			}
+		}
+	}
+
+	p.stateMu.Lock()
+	report.Drained = p.closed && closeErr == nil
+	p.stateMu.Unlock()
+	return report
+}
+
+// countSession counts a stream that was received
+func (p *Proxy) countSession() {
+	p.totalsMu.Lock()
+	defer p.totalsMu.Unlock()
+	p.sessions++
+}
+
+// countChunks adds the chunks of a stream to the totals
+func (p *Proxy) countChunks(stats pipeline.ChunkStats) {
+	p.totalsMu.Lock()
+	defer p.totalsMu.Unlock()
+	p.chunks.Add(stats)
+}
+
+// updateStatus changes the status file, if any
+func (p *Proxy) updateStatus(fn func(*statusfile.Status)) {
+	if p.status != nil {
+		p.status.Update(fn)
+	}
+}
+
+// setStatusState sets the state of the status file, forgetting the stream
+func (p *Proxy) setStatusState(state string) {
+	p.updateStatus(func(status *statusfile.Status) {
+		*status = statusfile.Status{State: state}
+	})
+}
+
+// setStatusLanguages sets the languages of the stream in the status file
+func (p *Proxy) setStatusLanguages(languages Languages) {
+	p.updateStatus(func(status *statusfile.Status) {
+		status.SourceLang = languages.Source
+		status.TargetLang = languages.Target
+		status.ExtraLangs = languages.Extra
+	})
+}
+
+// setStatusDegraded marks the stream in the status file degraded for
+// reason, or no longer
+func (p *Proxy) setStatusDegraded(reason string, degraded bool) {
+	p.updateStatus(func(status *statusfile.Status) {
+		status.SetDegraded(reason, degraded)
+	})
+}
+
+// closeStatus marks the proxy offline in the status file, if any
+func (p *Proxy) closeStatus() {
+	if p.status == nil {
+		return
+	}
+	if err := p.status.Close(); err != nil {
+		p.logger.WithError(err).Error("Failed to write status file")
+	}
+}
+
+// closeIndex closes the transcript search index, if any
+func (p *Proxy) closeIndex() {
+	if p.index == nil {
+		return
+	}
+	if err := p.index.Close(); err != nil {
+		p.logger.WithError(err).Error("Failed to close transcript index")
+	}
+}
+
+// ErrSearchDisabled is returned by SearchTranscripts without a transcript
+// index
+var ErrSearchDisabled = errors.New("transcript search is disabled, set TRANSCRIPT_DB_PATH to enable it")
+
+// SearchTranscripts searches the segments of all indexed sessions
+func (p *Proxy) SearchTranscripts(ctx context.Context, query searchindex.Query) ([]searchindex.Segment, error) {
+	if p.index == nil {
+		return nil, ErrSearchDisabled
+	}
+	return p.index.Search(ctx, query)
+}
+
+// waitPostSessionJobs waits for background post-session work until ctx is
+// done, then aborts it
+func (p *Proxy) waitPostSessionJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.postSessionJobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.logger.Warn("Shutdown deadline reached, aborting post-session jobs")
+		p.currentRun().cancelJobs()
+		<-done
+		return ErrShutdownForced
+	}
+}
+
+// recordPublisher records the address of the client publishing to the
+// listener, which connected at connectedAt, in the session summary
+func (p *Proxy) recordPublisher(sess *session.Session, connectedAt time.Time, logger *logrus.Entry) {
+	// FFmpeg accepted the connection, so it is looked up in the kernel's
+	// connection table
+	var address string
+	if port, err := strconv.Atoi(p.Config.RTMPPort); err == nil {
+		peers, err := netstat.Peers(port)
+		switch {
+		case err != nil:
+			logger.WithError(err).Warn("Failed to look up the publisher address")
+		case len(peers) == 1:
+			address = peers[0].String()
+		case len(peers) > 1:
+			logger.WithField("peers", len(peers)).Warn("Several clients connected to the listener, publisher address unknown")
+		}
+	}
+
+	logger.WithField("address", address).Info("Publisher connected")
+	sess.Update(func(summary *session.Summary) {
+		if summary.Publisher == nil {
+			summary.Publisher = &session.Publisher{}
+		}
+		summary.Publisher.Address = address
+		summary.Publisher.ConnectedAt = connectedAt
+	})
+	if err := sess.WriteSummary(); err != nil {
+		logger.WithError(err).Warn("Failed to write session summary")
+	}
+}
+
+// recordMetadata records the onMetaData properties of the incoming stream in
+// the session summary
+func (p *Proxy) recordMetadata(sess *session.Session, tag flv.Tag, logger *logrus.Entry) {
+	metadata, err := flv.ParseMetadata(tag)
+	if err != nil {
+		logger.WithError(err).Debug("Ignoring script tag")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"width":     metadata["width"],
+		"height":    metadata["height"],
+		"framerate": metadata["framerate"],
+		"encoder":   metadata["encoder"],
+	}).Info("Received stream metadata")
+	sess.Update(func(summary *session.Summary) {
+		if summary.Publisher == nil {
+			summary.Publisher = &session.Publisher{}
+		}
+		summary.Publisher.Metadata = metadata
+	})
+	if err := sess.WriteSummary(); err != nil {
+		logger.WithError(err).Warn("Failed to write session summary")
+	}
+}
+
+// enforceLimits ends the stream once it exceeds limits, until done is closed.
+// The listener is stopped like on shutdown, so the session is finalized like
+// one the publisher ended.
+func (p *Proxy) enforceLimits(limits *streamLimits, sess *session.Session, done <-chan struct{}, logger *logrus.Entry) {
+	ticker := time.NewTicker(limitCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-p.currentRun().stop:
+			return
+		case now := <-ticker.C:
+			reason := limits.exceeded(now)
+			if reason == "" {
+				continue
+			}
+
+			logger.WithFields(logrus.Fields{
+				"reason":   reason,
+				"duration": now.Sub(limits.started).Round(time.Second),
+			}).Warn("Stream limit reached, ending the stream")
+			sess.Update(func(summary *session.Summary) {
+				summary.EndReason = reason
+			})
+
+			p.currentRun().ending.Store(true)
+			select {
+			case <-p.currentRun().listenerDone:
+			default:
+				if err := p.listener.Load().Signal(os.Interrupt); err != nil {
+					logger.WithError(err).Error("Failed to stop the listener")
+				}
+			}
+			return
+		}
+	}
+}
+
+// forcedCleanupTimeout bounds how long a forced shutdown waits for the
+// pipeline to release the streaming targets
+const forcedCleanupTimeout = 5 * time.Second
+
+// openSessionLog starts copying the entries logged for sess to its
+// session.log, in the format of the process log
+func (p *Proxy) openSessionLog(sess *session.Session) (*sessionlog.Hook, error) {
+	var formatter logrus.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	if p.Config.LogFormat == logFormatJSON {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	hook, err := sessionlog.Open(sess.Dir(), "session", sess.ID(), formatter, p.Config.SessionLogMaxSize, p.Config.SessionLogMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	hook.Attach(p.logger)
+	sess.AddFile(sessionlog.FileName)
+	return hook, nil
+}
+
+// processFFmpegOutput runs the chunk pipeline on the audio and video FFmpeg
+// writes to its pipes. videoReader is nil in transcribe-only mode, in which
+// case no video is buffered and nothing is restreamed. resume splices
+// reconnects of the publisher into the pipes, nil if sessions don't resume.
+func (p *Proxy) processFFmpegOutput(audioReader, videoReader io.ReadCloser, resume *resumer) {
+	defer close(p.currentRun().pipelineDone)
+	// Processing that can't even start ends the run as failed
+	stopReason, stopErr := StopFailed, error(nil)
+	defer func() { p.currentRun().ended(stopReason, stopErr) }()
+	defer audioReader.Close()
+	if videoReader != nil {
+		defer videoReader.Close()
+	}
+
+	logger := p.logger.WithFields(logrus.Fields{
+		"processor": "ffmpeg-output",
+	})
+
+	logger.Info("Waiting for incoming RTMP stream")
+	p.setStatusState(statusfile.StateWaiting)
+	defer p.setStatusState(statusfile.StateOffline)
+
+	stream, err := p.newLiveStream(videoReader == nil, resume, logger)
+	defer stream.close()
+	if err != nil {
+		stopErr = err
+		return
+	}
+
+	// The pipeline stops at once when the proxy is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.currentRun().stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = stream.pipeline.Run(ctx, audioReader, videoReader)
+	p.countChunks(stream.pipeline.ChunkStats())
+	stopReason, stopErr = stream.outcome(err)
+}
+
+// liveStream is what processFFmpegOutput sets up around the pipeline of a
+// stream: its session, outputs, and transcripts. Every step of the setup
+// registers how it is undone, and close undoes them in reverse.
+type liveStream struct {
+	p              *Proxy
+	logger         *logrus.Entry
+	transcribeOnly bool
+
+	sess *session.Session
+	conn *rtmpConnection
+	// tempDir is the session's own temp directory, removed when it ends
+	tempDir string
+	// limits ends the stream once it runs too long or goes idle
+	limits *streamLimits
+	// audioDone is closed once all audio has been read
+	audioDone chan struct{}
+	// captioner captions the chunks and stores the captions
+	captioner *liveCaptioner
+	// publish publishes the lifecycle events of the stream, lagging like the
+	// captions if they have to
+	publish func(events.Event)
+	// streamer is nil in transcribe-only mode
+	streamer *streaming.Streamer
+	// sidecar is the format of the sidecar subtitles, if there are any
+	sidecar subtitles.SubtitleFormat
+	// sidecarFile is nil if the sidecar subtitles are not saved
+	sidecarFile *transcript.Sidecar
+	// store is nil if the transcripts are not saved
+	store    *transcript.Store
+	pipeline *pipeline.Pipeline
+
+	// subtitleFile is the session SRT or VTT, empty if there is none
+	subtitleFile string
+	// recordingDone is closed once the recording is final, after the
+	// post-session remux if there is one; nil if there is no recording
+	recordingDone chan struct{}
+
+	// teardown undoes the steps of the setup so far
+	teardown []func()
+}
+
+// newLiveStream sets up everything around the pipeline of a stream. The
+// stream is returned even if the setup fails, to close what was set up.
+func (p *Proxy) newLiveStream(transcribeOnly bool, resume *resumer, logger *logrus.Entry) (*liveStream, error) {
+	s := &liveStream{p: p, logger: logger, transcribeOnly: transcribeOnly}
+	if err := s.openSession(); err != nil {
+		return s, err
+	}
+	s.startPublishing()
+	if p.recordingPath != "" {
+		// Runs after the transcript files are closed
+		s.recordingDone = make(chan struct{})
+		s.onClose(func() {
+			p.finishRecording(s.sess, s.subtitleFile, s.recordingDone, s.logger)
+		})
+	}
+	if err := s.openOutputs(); err != nil {
+		return s, err
+	}
+	if err := s.newPipeline(); err != nil {
+		return s, err
+	}
+	s.openTranscripts()
+	s.watchReconnects(resume)
+
+	p.setActiveSession(&activeSession{session: s.sess, conn: s.conn, store: s.store, sidecar: s.sidecarFile, streamer: s.streamer, pipeline: s.pipeline})
+	s.onClose(func() { p.setActiveSession(nil) })
+	return s, nil
+}
+
+// onClose registers f to run when the stream is closed, before what was
+// registered earlier
+func (s *liveStream) onClose(f func()) {
+	s.teardown = append(s.teardown, f)
+}
+
+// close undoes the setup of the stream in reverse
+func (s *liveStream) close() {
+	for i := len(s.teardown) - 1; i >= 0; i-- {
+		s.teardown[i]()
+	}
+}
+
+// openSession creates the session of the stream, with its output and temp
+// directories, and keeps its summary and uploads up to date until it ends
+func (s *liveStream) openSession() error {
+	p := s.p
+
+	// Every session gets its own output directory, unless artifacts are
+	// disabled
+	outputDir := p.Config.OutputDir
+	if p.outputDisabled.Load() {
+		outputDir = ""
+	}
+	sess, err := session.New(outputDir, streamKey, time.Now())
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to create session directory")
+		return err
+	}
+	s.sess = sess
+
+	// Create a stream connection object
+	s.conn = &rtmpConnection{
+		streamName:   sess.ID(),
+		sourceURL:    fmt.Sprintf("rtmp://localhost:%s/live/%s", p.Config.RTMPPort, streamKey),
+		targetURL:    p.Config.DefaultTargetURL,
+		subtitleType: subtitles.FormatNone, // Set once the targets are known
+	}
+	s.conn.setLanguages(Languages{
+		Source: p.Config.DefaultSourceLang,
+		Target: p.Config.DefaultTargetLang,
+		Extra:  p.extraLangs(),
+	})
+	initialLangs := s.conn.languages()
+
+	s.logger = s.logger.WithField("session", sess.ID())
+
+	// Copy the session's log lines into its directory until it ends
+	if p.Config.SessionLog && sess.Dir() != "" {
+		if hook, err := p.openSessionLog(sess); err != nil {
+			s.logger.WithError(err).Warn("Failed to open session log")
+		} else {
+			s.onClose(func() {
+				if err := hook.Detach(p.logger); err != nil {
+					p.logger.WithError(err).Warn("Failed to close session log")
+				}
+			})
+		}
+	}
+
+	// Give translation another chance if the last session gave up on it
+	p.translator.ResetFailures()
+
+	sess.Update(func(summary *session.Summary) {
+		summary.Mode = p.Config.Mode
+		summary.SourceLang = initialLangs.Source
+		summary.TargetLang = initialLangs.Target
+		build := version.Get()
+		summary.Build = &build
+	})
+	if err := sess.WriteSummary(); err != nil {
+		s.logger.WithError(err).Warn("Failed to write session summary")
+	}
+
+	if p.uploader != nil && sess.Dir() != "" {
+		syncCtx, stopSync := context.WithCancel(p.currentRun().jobsCtx)
+		syncDone := make(chan struct{})
+		go func() {
+			defer close(syncDone)
+			p.syncSession(syncCtx, sess, s.logger)
+		}()
+		// Runs once the final summary is written
+		s.onClose(func() {
+			stopSync()
+			<-syncDone
+			p.finishUpload(sess, s.recordingDone, s.logger)
+		})
+	}
+
+	s.onClose(func() {
+		sess.Update(func(summary *session.Summary) {
+			summary.Processes = processesSince(summary.StartedAt)
+			summary.AudioTrack = int(p.audioTrack.Load())
+		})
+		if err := sess.End(time.Now()); err != nil {
+			s.logger.WithError(err).Warn("Failed to write final session summary")
+		}
+	})
+
+	// Give the session its own temp directory, removed in full when it ends
+	s.tempDir = filepath.Join(p.tempRoot(), s.conn.streamName)
+	if err := os.MkdirAll(s.tempDir, 0755); err != nil {
+		s.logger.WithError(err).Error("Failed to create session temp directory")
+		return err
+	}
+	s.onClose(func() { os.RemoveAll(s.tempDir) })
+	return nil
+}
+
+// startPublishing sets up the captioner and the publishing of the events of
+// the stream, and announces that it started. The events lag like the caption
+// outputs, see subtitleSinks.
+func (s *liveStream) startPublishing() {
+	p := s.p
+
+	s.audioDone = make(chan struct{})
+	s.limits = &streamLimits{
+		maxDuration: p.Config.MaxStreamDuration,
+		idleTimeout: p.Config.IdleTimeout,
+		silenceDB:   float64(p.Config.IdleSilenceDB),
+	}
+
+	// The captioner stores the captions once the transcripts are open
+	s.captioner = &liveCaptioner{p: p, sess: s.sess, logger: s.logger}
+	if p.Config.Reflow {
+		s.captioner.reflower = reflow.New(p.Config.ReflowMaxGap.Seconds(), p.Config.MaxCueChars)
+	}
+
+	s.publish = p.events.Publish
+	if p.Config.StreamDelay > 0 && !p.Config.RealtimeCaptions {
+		// The pipeline is set up before any caption is published
+		captionDelay := delay.New(p.Config.StreamDelay, 0, "", func(event events.Event, _ []byte) {
+			p.events.Publish(event)
+		}, s.logger.WithField("buffer", "captions"))
+		s.onClose(func() {
+			captionDelay.Close()
+			select {
+			case <-captionDelay.Done():
+			case <-p.currentRun().stop:
+				captionDelay.Abort()
+			}
+		})
+		s.publish = func(event events.Event) {
+			captionDelay.Push(event, nil)
+		}
+	}
+
+	s.publish(events.Event{Kind: events.KindStreamStarted, Session: s.sess.ID(), StreamKey: streamKey})
+	s.onClose(func() {
+		s.publish(events.Event{Kind: events.KindStreamEnded, Session: s.sess.ID(), StreamKey: streamKey, Reason: s.sess.Summary().EndReason})
+	})
+}
+
+// openOutputs connects to the targets unless there is nothing to restream,
+// and picks the subtitle formats embedded and written alongside
+func (s *liveStream) openOutputs() error {
+	p := s.p
+
+	if s.transcribeOnly {
+		s.logger.Info("Transcribe-only mode, incoming stream will not be restreamed")
+		// Validated at startup
+		subtitleFormat, _ := p.subtitleFormat(nil)
+		s.sidecar = sidecarFormat(subtitleFormat)
+		return nil
+	}
+
+	// Parse target URLs once at the beginning
+	streamTargets, err := p.parseTargets()
+	if err != nil {
+		s.logger.WithError(err).Error("Invalid target URL")
+		return err
+	}
+
+	subtitleFormat, err := p.subtitleFormat(streamTargets)
+	if err != nil {
+		s.logger.WithError(err).Error("Invalid target URL")
+		return err
+	}
+	s.conn.subtitleType = p.embeddedFormat(subtitleFormat, s.logger)
+	s.sidecar = sidecarFormat(subtitleFormat)
+	s.logger.WithField("subtitle_format", s.conn.subtitleType).Info("Embedding captions")
+
+	s.streamer = p.newStreamer(streamTargets)
+	// What goes out is previewed after the captions were embedded
+	if p.preview != nil {
+		s.streamer.SetTee(p.preview)
+	}
+	s.onClose(s.streamer.Cleanup)
+	return nil
+}
+
+// newPipeline creates the pipeline of the stream with its stages
+func (s *liveStream) newPipeline() error {
+	p := s.p
+
+	// A nil streamer must not become a non-nil Sink
+	var sink pipeline.Sink
+	if s.streamer != nil {
+		sink = s.streamer
+	}
+
+	cfg := s.pipelineConfig()
+	sinks, err := s.subtitleSinks()
+	if err != nil {
+		return err
+	}
+	cfg.SubtitleSinks = sinks
+
+	live := &liveTranscriber{p: p}
+	if p.abTranscriber != nil && s.sess.Dir() != "" {
+		compare, err := p.newABComparer(s.sess, s.logger)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to create the model evaluation file, chunks will not be compared")
+		} else {
+			// Runs before the session temp directory is removed
+			s.onClose(compare.close)
+			live.compare = compare
+		}
+	}
+
+	pl, err := pipeline.New(cfg, live, s.captioner, sink)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to set up the chunk pipeline")
+		return err
+	}
+	s.pipeline = pl
+	return nil
+}
+
+// subtitleSinks sets up where the captions of the stream go besides the
+// transcript: into the video, the sidecar subtitles, the caption events, and
+// the platforms. The outputs people watch lag like the restream, unless
+// moderators need them in real time.
+func (s *liveStream) subtitleSinks() ([]pipeline.SubtitleSink, error) {
+	p := s.p
+	var sinks []pipeline.SubtitleSink
+
+	// Without subtitles the chunks skip the embedding FFmpeg entirely
+	if s.conn.subtitleType != subtitles.FormatNone {
+		// embeddedFormat only leaves formats the container carries
+		embedder, err := subtitles.New(s.conn.subtitleType, subtitles.ContainerFLV)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to set up subtitle embedding")
+			return nil, err
+		}
+		sinks = append(sinks, embedder)
+	}
+
+	if s.sess.Dir() != "" {
+		sidecar, err := transcript.NewSidecar(s.sess.Dir(), s.transcriptName(), s.sidecar, p.VTTOptions())
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to create subtitle file, subtitles will not be saved")
+		} else {
+			// The pipeline closes it once the stream has ended, unless it
+			// never runs
+			s.onClose(func() { sidecar.Close() })
+			s.sess.AddFile(sidecar.Name())
+			s.subtitleFile = sidecar.Name()
+			s.sidecarFile = sidecar
+			sinks = append(sinks, diskGuard{SubtitleSink: sidecar, p: p})
+		}
+	}
+
+	lag := p.Config.StreamDelay > 0 && !p.Config.RealtimeCaptions
+	delayed := func(sink pipeline.SubtitleSink) pipeline.SubtitleSink {
+		if lag {
+			return pipeline.Delayed(sink)
+		}
+		return sink
+	}
+	sinks = append(sinks, delayed(captionBus{p: p, sess: s.sess}))
+
+	r := p.currentRun()
+	if r.youtube != nil {
+		start := time.Now()
+		if lag {
+			start = start.Add(p.Config.StreamDelay)
+		}
+		r.youtube.StartStream(start)
+		sinks = append(sinks, delayed(r.youtube))
+	}
+	if r.twitch != nil {
+		sinks = append(sinks, delayed(r.twitch))
+	}
+	return sinks, nil
+}
+
+// pipelineConfig configures the pipeline of the stream, with hooks keeping
+// the session, the status, and the limits up to date as the stream is read
+func (s *liveStream) pipelineConfig() pipeline.Config {
+	p, sess, logger := s.p, s.sess, s.logger
+
+	cfg := pipeline.Config{
+		TempDir:           s.tempDir,
+		ChunkDuration:     chunkDuration,
+		AudioOnly:         p.Config.AudioOnly,
+		BlackVideo:        p.Config.AudioOnlyVideo == config.AudioOnlyVideoBlack,
+		SubtitleDelay:     p.Config.SubtitleDelay,
+		DriftThreshold:    p.Config.DriftThreshold,
+		StreamDelay:       p.Config.StreamDelay,
+		StreamDelayMemory: p.Config.StreamDelayMemory,
+		SpoolMemory:       p.Config.SpoolMemory,
+		SpoolMax:          p.Config.SpoolMax,
+		Languages:         s.conn.languages,
+		Fallback:          p.fallback,
+		VRAM:              p.vram,
+		SilenceDB:         float64(p.Config.IdleSilenceDB),
+		QuietDB:           float64(p.Config.QuietInputDB),
+		ClippedPercent:    float64(p.Config.ClippedInputPercent),
+		ReportEvery:       p.Config.ChunkReportEvery,
+		MinChunkAudio:     p.Config.MinChunkAudio,
+		MinChunkVideoTags: p.Config.MinChunkVideoTags,
+		DegradedAfter:     p.Config.TooSmallChunksDegraded,
+		MaxSinkFailures:   p.Config.MaxSinkFailures,
+
+		RetranscribeOtherLanguages: p.Config.RetranscribeOtherLanguages,
+		Timing:                     p.timingOptions(),
+		Hooks: pipeline.Hooks{
+			Started: func(format audio.Format) {
+				startedAt := time.Now()
+				p.countSession()
+				p.recordPublisher(sess, startedAt, logger)
+				languages := s.conn.languages()
+				p.updateStatus(func(status *statusfile.Status) {
+					*status = statusfile.Status{
+						State:      statusfile.StateLive,
+						StreamKey:  streamKey,
+						Session:    sess.ID(),
+						StartedAt:  &startedAt,
+						SourceLang: languages.Source,
+						TargetLang: languages.Target,
+						ExtraLangs: languages.Extra,
+					}
+				})
+
+				// The stream has started, so its limits apply from now on
+				if s.limits.enabled() {
+					s.limits.start(time.Now())
+					go p.enforceLimits(s.limits, sess, s.audioDone, logger)
+				}
+			},
+			Ended: func() {
+				close(s.audioDone)
+			},
+			AudioChunk: s.limits.addAudio,
+			VideoTag: func(tag flv.Tag) {
+				if tag.Type == flv.TagScript {
+					p.recordMetadata(sess, tag, logger)
+				}
+				if tag.IsKeyframe() && !tag.IsSequenceHeader() {
+					s.limits.addKeyframe(tag.Data)
+				}
+			},
+			Codecs: func(codecs session.Codecs) bool {
+				codecs.Transcoded = p.applyCodecPolicy(codecs, s.streamer, logger)
+				sess.Update(func(summary *session.Summary) {
+					summary.Codecs = codecs
+				})
+				return codecs.Transcoded
+			},
+			Degraded: func(reason string) {
+				// Operators need to know now, not after the stream delay
+				p.events.Publish(events.Event{Kind: events.KindPipelineDegraded, Session: sess.ID(), StreamKey: streamKey, Reason: reason})
+				p.setStatusDegraded(statusfile.ReasonPipelineDegraded, true)
+			},
+		},
+		Logger: logger,
+	}
+	if speakers := p.newSpeakerTracker(); speakers != nil {
+		cfg.Speakers = speakers
+	}
+
+	var saver *failedchunks.Saver
+	if p.Config.SaveFailedChunks && sess.Dir() != "" {
+		saver = failedchunks.New(sess.Dir(), p.Config.MaxFailedChunks)
+	}
+	cfg.Hooks.ChunkFailed = func(chunk failedchunks.Chunk) {
+		if chunk.Stage == failedchunks.StageTranscription {
+			p.setStatusDegraded(statusfile.ReasonTranscriptionFailing, true)
+		}
+		if saver != nil {
+			p.saveFailedChunk(saver, sess, chunk, logger)
+		}
+	}
+	return cfg
+}
+
+// transcriptName is the name of the transcript and subtitle files of the
+// stream, without extension
+func (s *liveStream) transcriptName() string {
+	return s.sess.FileName(s.p.Config.FilenameTemplate, captionsLang(s.conn.languages()))
+}
+
+// captionsLang is the language of the captions in langs
+func captionsLang(langs Languages) string {
+	if langs.Target == "" {
+		return langs.Source
+	}
+	return langs.Target
+}
+
+// openTranscripts persists the transcripts of the stream while it runs,
+// unless output is disabled
+func (s *liveStream) openTranscripts() {
+	p, sess := s.p, s.sess
+	if sess.Dir() == "" {
+		s.logger.Debug("Output disabled, transcripts will not be saved")
+		return
+	}
+
+	langs := s.conn.languages()
+	captionLang := captionsLang(langs)
+	store, err := transcript.New(sess.Dir(), s.transcriptName(), s.sidecar, p.VTTOptions(), p.Config.LiveCaptionWindow, p.Config.LiveCaptionHistory)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to create transcript files, transcripts will not be saved")
+		return
+	}
+
+	if p.Config.TranscriptVerboseJSON {
+		store.EnableVerboseJSON(captionLang)
+	}
+	if p.index != nil {
+		store.IndexInto(p.index, sess.ID(), sess.Summary().StartedAt)
+	}
+	if tracks := trackLangs(langs, false); len(tracks) > 0 {
+		if err := store.AddTracks(tracks); err != nil {
+			s.logger.WithError(err).Error("Failed to create subtitle tracks, only the captions will be saved")
+		}
+		sess.Update(func(summary *session.Summary) {
+			summary.SubtitleTracks = store.TrackFiles()
+		})
+	}
+	files := store.Files()
+	for _, name := range files {
+		sess.AddFile(name)
+	}
+	s.onClose(func() {
+		store.Close()
+		// The source-language transcript only exists once something was
+		// translated, and languages may have been added
+		for _, name := range store.Files() {
+			if !slices.Contains(files, name) {
+				sess.AddFile(name)
+			}
+		}
+	})
+
+	s.store = store
+	s.captioner.store = store
+}
+
+// watchReconnects continues the session when the publisher reconnects, with
+// the time it was away marked in the transcripts
+func (s *liveStream) watchReconnects(resume *resumer) {
+	if resume == nil {
+		return
+	}
+	sess := s.sess
+	resume.onResume(func(at, gap time.Duration) {
+		sess.Update(func(summary *session.Summary) {
+			if summary.Publisher == nil {
+				summary.Publisher = &session.Publisher{}
+			}
+			summary.Publisher.Reconnects++
+		})
+		if err := sess.WriteSummary(); err != nil {
+			s.logger.WithError(err).Warn("Failed to write session summary")
+		}
+		if s.store != nil {
+			if err := s.store.MarkGap(at.Seconds(), gap); err != nil {
+				s.logger.WithError(err).Warn("Failed to mark the reconnect in the transcripts")
+			}
+		}
+	})
+	s.onClose(func() { resume.onResume(nil) })
+}
+
+// outcome returns why the run ends with the stream, given what the pipeline
+// returned
+func (s *liveStream) outcome(err error) (string, error) {
+	switch listener := s.p.listener.Load(); {
+	case err != nil && !errors.Is(err, context.Canceled):
+		s.logger.WithError(err).Error("Stream processing failed")
+		s.sess.Update(func(summary *session.Summary) {
+			summary.EndReason = session.EndFailed
+		})
+		return StopFailed, err
+	case !s.pipeline.Started() && listener != nil && listener.Info().Unexpected:
+		return StopFailed, fmt.Errorf("%w: FFmpeg exited before a stream arrived", ErrListenerFailed)
+	case s.sess.Summary().EndReason != "":
+		// Ended by a limit
+		return s.sess.Summary().EndReason, nil
+	}
+	return StopStreamEnded, nil
+}
+
+// saveFailedChunk saves a chunk that failed and records it in the summary,
+// until the most failed chunks of a session have been saved
+func (p *Proxy) saveFailedChunk(saver *failedchunks.Saver, sess *session.Session, chunk failedchunks.Chunk, logger *logrus.Entry) {
+	chunkLogger := logger.WithField("chunk", chunk.Index)
+	dir, err := saver.Save(chunk)
+	if errors.Is(err, failedchunks.ErrLimit) {
+		chunkLogger.Debug("Not saving failed chunk, too many were saved already")
+		return
+	}
+	if err != nil {
+		chunkLogger.WithError(err).Error("Failed to save failed chunk")
+		return
+	}
+
+	sess.Update(func(summary *session.Summary) {
+		summary.FailedChunks = append(summary.FailedChunks, dir)
+	})
+	chunkLogger.WithField("dir", dir).Info("Saved failed chunk for debugging")
+}
+
+// liveTranscriber transcribes the chunks of the live stream, ahead of ad-hoc
+// jobs, and tracks the confidence of the results
+type liveTranscriber struct {
+	p *Proxy
+	// compare transcribes a sample of the chunks with the comparison model,
+	// nil if disabled
+	compare *abComparer
+}
+
+// TranscribeAudioFallback transcribes a chunk ahead of queued ad-hoc jobs
+func (t *liveTranscriber) TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error) {
+	release, err := t.p.scheduler.Acquire(context.Background(), scheduler.Live)
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	segments, err := t.p.transcriber.TranscribeAudioFallback(tempDir, audioBytes, format, lang, fallback)
+	took := time.Since(started)
+	release()
+
+	if err == nil {
+		t.p.confidence.Add(segments)
+		t.p.setStatusDegraded(statusfile.ReasonTranscriptionFailing, false)
+		// A fallback means the GPU is short of memory, a second model
+		// would only make that worse
+		if t.compare != nil && fallback == transcriber.FallbackNone {
+			t.compare.sample(tempDir, audioBytes, format, lang, segments, took)
+		}
+	}
+	return segments, err
+}
+
+// abEvaluationFile is the file in the session directory with the results of
+// the comparison model next to the live ones, one chunk per line
+const abEvaluationFile = "ab-compare.jsonl"
+
+// abMaxPending bounds the comparisons waiting or running at once. Chunks
+// sampled beyond it are skipped, so audio doesn't pile up while the
+// transcriber is busy with the stream.
+const abMaxPending = 4
+
+// abComparer transcribes a sample of the live chunks again with the
+// comparison model, at background priority, and writes both results to the
+// evaluation file
+type abComparer struct {
+	p      *Proxy
+	logger *logrus.Entry
+
+	// ctx is cancelled on close, dropping the comparisons still waiting
+	ctx     context.Context
+	cancel  context.CancelFunc
+	jobs    sync.WaitGroup
+	pending atomic.Int32
+
+	mu     sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+// abRecord is a line of the evaluation file. Segment times are relative to
+// the chunk.
+type abRecord struct {
+	Chunk   string    `json:"chunk"` // transcriber.ChunkID of the audio
+	At      time.Time `json:"at"`    // When the chunk was transcribed live
+	Audio   float64   `json:"audio_seconds"`
+	Lang    string    `json:"lang"`
+	Live    abResult  `json:"live"`
+	Compare abResult  `json:"compare"`
+}
+
+// abResult is the transcription of a chunk with one of the models
+type abResult struct {
+	Model   string  `json:"model"`
+	Seconds float64 `json:"seconds"` // Transcription time, without waiting for a slot
+	Text    string  `json:"text"`
+	Error   string  `json:"error,omitempty"`
+
+	// Mean confidence over the segments
+	AvgLogProb   float64 `json:"avg_logprob"`
+	NoSpeechProb float64 `json:"no_speech_prob"`
+
+	Segments []abSegment `json:"segments"`
+}
+
+// abSegment is a segment of an abResult
+type abSegment struct {
+	Start        float64 `json:"start"`
+	End          float64 `json:"end"`
+	Text         string  `json:"text"`
+	AvgLogProb   float64 `json:"avg_logprob"`
+	NoSpeechProb float64 `json:"no_speech_prob"`
+}
+
+// newABComparer creates the evaluation file of sess
+func (p *Proxy) newABComparer(sess *session.Session, logger *logrus.Entry) (*abComparer, error) {
+	file, err := os.OpenFile(filepath.Join(sess.Dir(), abEvaluationFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sess.AddFile(abEvaluationFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &abComparer{
+		p:      p,
+		logger: logger.WithField("component", "ab-compare"),
+		ctx:    ctx,
+		cancel: cancel,
+		file:   file,
+	}, nil
+}
+
+// sample queues the chunk for comparison with the live result segments,
+// which took took, if it is among the sampled ones
+func (c *abComparer) sample(tempDir string, audioBytes []byte, format audio.Format, lang string, segments []transcriber.Segment, took time.Duration) {
+	if rand.IntN(100) >= c.p.Config.ABComparePercent {
+		return
+	}
+	if c.pending.Add(1) > abMaxPending {
+		c.pending.Add(-1)
+		c.logger.Debug("Comparisons are behind, skipping chunk")
+		return
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		c.pending.Add(-1)
+		return
+	}
+	c.jobs.Add(1)
+	c.mu.Unlock()
+
+	record := abRecord{
+		Chunk: transcriber.ChunkID(audioBytes, format, lang),
+		At:    time.Now(),
+		Audio: float64(len(audioBytes)) / float64(format.BytesPerSecond()),
+		Lang:  lang,
+		Live:  newABResult(c.p.transcriber, segments, took, nil),
+	}
+	// The pipeline may reuse the buffer, and the comparison gets its own
+	// directory, the transcribers would share the names of their files
+	audioBytes = bytes.Clone(audioBytes)
+	tempDir = filepath.Join(tempDir, "ab-compare")
+
+	go func() {
+		defer c.jobs.Done()
+		defer c.pending.Add(-1)
+
+		release, err := c.p.scheduler.Acquire(c.ctx, scheduler.Background)
+		if err != nil {
+			// The session ended first
+			return
+		}
+		started := time.Now()
+		segments, err := c.p.abTranscriber.TranscribeAudioFallback(tempDir, audioBytes, format, lang, transcriber.FallbackNone)
+		record.Compare = newABResult(c.p.abTranscriber, segments, time.Since(started), err)
+		release()
+
+		if err := c.write(record); err != nil {
+			c.logger.WithError(err).Warn("Failed to write comparison")
+		}
+	}()
+}
+
+// newABResult describes the transcription of a chunk with t
+func newABResult(t Transcriber, segments []transcriber.Segment, took time.Duration, err error) abResult {
+	result := abResult{
+		Model:    filepath.Base(t.ModelDir()),
+		Seconds:  took.Seconds(),
+		Segments: make([]abSegment, 0, len(segments)),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	texts := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		texts = append(texts, segment.Text)
+		result.AvgLogProb += segment.AvgLogProb
+		result.NoSpeechProb += segment.NoSpeechProb
+		result.Segments = append(result.Segments, abSegment{
+			Start:        segment.Start,
+			End:          segment.End,
+			Text:         segment.Text,
+			AvgLogProb:   segment.AvgLogProb,
+			NoSpeechProb: segment.NoSpeechProb,
+		})
+	}
+	if len(segments) > 0 {
+		result.AvgLogProb /= float64(len(segments))
+		result.NoSpeechProb /= float64(len(segments))
+	}
+	result.Text = strings.Join(texts, " ")
+	return result
+}
+
+// write appends a record to the evaluation file
+func (c *abComparer) write(record abRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// close drops the comparisons still waiting for a slot, waits for the
+// running ones, and closes the evaluation file
+func (c *abComparer) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.cancel()
+	c.jobs.Wait()
+	if err := c.file.Close(); err != nil {
+		c.logger.WithError(err).Warn("Failed to close the model evaluation file")
+	}
+}
+
+// liveCaptioner turns the segments of the live stream into captions: it
+// reflows, translates, masks, and line-wraps them, publishes them, and writes
+// them to the transcript
+type liveCaptioner struct {
+	p      *Proxy
+	sess   *session.Session
+	logger *logrus.Entry
+
+	// reflower merges sentences split across chunk boundaries by holding back
+	// the last segment of each chunk for the next one, nil if disabled
+	reflower *reflow.Reflower
+	// store is nil if the transcript files could not be created
+	store *transcript.Store
+
+	// markTranslationDegraded records in the summary, once, that translation
+	// was given up on
+	markTranslationDegraded sync.Once
+}
+
+// Caption captions the stream-relative segments of a chunk
+func (c *liveCaptioner) Caption(index int, segments []transcriber.Segment, langs Languages, stop <-chan struct{}) []transcriber.Segment {
+	chunkLogger := c.logger.WithField("chunk", index)
+
+	if c.reflower != nil {
+		segments = c.reflower.Process(index, segments, stop)
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	result, err := c.p.captionSegments(segments, langs, c.p.wrapper)
+	switch {
+	case errors.Is(err, translator.ErrDegraded):
+		chunkLogger.Debug("Translation degraded, using original transcription")
+	case errors.Is(err, translator.ErrWarmingUp):
+		chunkLogger.WithError(err).Info("Translation warming up, using original transcription")
+	case err != nil:
+		chunkLogger.WithError(err).Error("Translation failed, using original transcription")
+	}
+	if result.originals != nil {
+		chunkLogger.Debug("Masked profanity in captions")
+	}
+
+	if langs.Target != "" && langs.Target != langs.Source && c.p.translator.Degraded() {
+		c.markTranslationDegraded.Do(func() {
+			c.sess.Update(func(summary *session.Summary) {
+				summary.TranslationDegraded = true
+			})
+			c.p.setStatusDegraded(statusfile.ReasonTranslationDegraded, true)
+			if err := c.sess.WriteSummary(); err != nil {
+				chunkLogger.WithError(err).Warn("Failed to write session summary")
+			}
+		})
+	}
+
+	// Once the session has subtitle tracks, they go on even without extra
+	// languages
+	tracked := c.store != nil && c.store.TrackFiles() != nil
+	tracks := c.captionTracks(segments, langs, result, trackLangs(langs, tracked), chunkLogger)
+
+	// The subtitle sinks get the captions with their languages, source, and
+	// translations
+	captions := slices.Clone(result.captions)
+	for i := range captions {
+		captions[i].Lang = result.lang
+		for _, track := range tracks {
+			if track.Lang != result.lang {
+				if captions[i].Translations == nil {
+					captions[i].Translations = make(map[string]string, len(tracks))
+				}
+				captions[i].Translations[track.Lang] = subtitles.Unwrap(track.Segments[i].Text)
+			}
+		}
+		if result.sources != nil {
+			// Moderators follow the stream in the language it is spoken in
+			source := result.sources[i]
+			captions[i].Source = source.SpeakerPrefix + source.Text
+			captions[i].SourceLang = langs.Source
+		}
+	}
+
+	if c.store != nil && c.p.diskMonitor.Low() {
+		chunkLogger.Warn("Disk space low, skipping transcript write")
+	} else if c.store != nil {
+		if err := c.store.Append(index, result.lang, result.captions, result.originals, result.sources, tracks...); errors.Is(err, transcript.ErrDuplicateSegments) {
+			chunkLogger.WithError(err).Warn("Left duplicate segments out of the transcript")
+		} else if err != nil {
+			chunkLogger.WithError(err).Error("Failed to write transcript")
+		}
+	}
+
+	return captions
+}
+
+// captionTracks captions the segments of a chunk in trackLangs, reusing the
+// captions already made in their language. Captions whose translation fails
+// keep the original text.
+func (c *liveCaptioner) captionTracks(segments []transcriber.Segment, langs Languages, captions captioned, trackLangs []string, chunkLogger *logrus.Entry) []transcript.Track {
+	tracks := make([]transcript.Track, 0, len(trackLangs))
+	for _, lang := range trackLangs {
+		if lang == captions.lang {
+			tracks = append(tracks, transcript.Track{Lang: lang, Segments: captions.captions, Fallback: captions.fallback})
+			continue
+		}
+		result, err := c.p.captionSegments(segments, Languages{Source: langs.Source, Target: lang}, c.p.wrapper)
+		if err != nil {
+			chunkLogger.WithError(err).WithField("lang", lang).Debug("Translation of subtitle track failed, using original transcription")
+		}
+		tracks = append(tracks, transcript.Track{Lang: lang, Segments: result.captions, Fallback: result.fallback})
+	}
+	return tracks
+}
+
+// Flush captions the last held-back segment, which has no chunk left to ride
+// along with, so it only goes into the transcript and the subtitle sinks
+// apart from the video
+func (c *liveCaptioner) Flush(index int, langs Languages) []transcriber.Segment {
+	if c.reflower == nil {
+		return nil
+	}
+	held := c.reflower.Flush()
+	c.reflower = nil
+	if len(held) == 0 {
+		return nil
+	}
+	return c.Caption(index, held, langs, nil)
+}
+
+// captionBus publishes the captions of a session as caption events, as a
+// subtitle sink of its pipeline
+type captionBus struct {
+	p    *Proxy
+	sess *session.Session
+}
+
+func (b captionBus) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	for _, segment := range segments {
+		b.p.events.Publish(events.Event{
+			Kind:      events.KindCaption,
+			Session:   b.sess.ID(),
+			StreamKey: streamKey,
+			Caption: &events.Caption{
+				Chunk: int(streamTime / chunkDuration),
+				Start: segment.Start,
+				End:   segment.End,
+				Text:  subtitles.Unwrap(segment.Text),
+				Lang:  segment.Lang,
+
+				DetectedLang: segment.DetectedLanguage,
+				Speaker:      segment.Speaker,
+				Translations: segment.Translations,
+				Original:     segment.Source,
+				OriginalLang: segment.SourceLang,
+			},
+		})
+	}
+	return nil
+}
+
+func (b captionBus) Close() error {
+	return nil
+}
+
+// diskGuard leaves the captions out of a subtitle file while disk space is
+// low, like the transcript
+type diskGuard struct {
+	pipeline.SubtitleSink
+	p *Proxy
+}
+
+func (g diskGuard) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	if g.p.diskMonitor.Low() {
+		return nil
+	}
+	return g.SubtitleSink.WriteCues(streamTime, segments)
+}
+
+// applyCodecPolicy checks the video codec of the incoming stream against the
+// codecs the targets accept. Depending on the codec policy, the video is
+// transcoded to H.264 for the session, which is reported by the result, or
+// the targets that don't accept it are disabled.
+func (p *Proxy) applyCodecPolicy(codecs session.Codecs, streamer *streaming.Streamer, logger *logrus.Entry) bool {
+	logger = logger.WithFields(logrus.Fields{
+		"video_codec": codecs.Video,
+		"audio_codec": codecs.Audio,
+	})
+	logger.Info("Detected incoming stream codecs")
+
+	if codecs.Video == "" {
+		return false
+	}
+
+	unsupported := false
+	for _, target := range streamer.Targets() {
+		if !target.SupportsVideoCodec(codecs.Video) {
+			unsupported = true
+		}
+	}
+	if !unsupported {
+		return false
+	}
+
+	transcode := p.Config.CodecPolicy == config.CodecPolicyTranscode && codecs.Video != flv.CodecH264
+	codec := codecs.Video
+	if transcode {
+		logger.Warn("Not every target accepts the incoming video codec, transcoding the session to H.264")
+		codec = flv.CodecH264
+	}
+
+	for _, target := range streamer.Targets() {
+		if target.SupportsVideoCodec(codec) {
+			continue
+		}
+		logger.WithField("target", target.RedactedURL()).Error("Target doesn't accept the video codec, not streaming to it")
+		streamer.Disable(target, fmt.Errorf("%w: %s", streaming.ErrUnsupportedCodec, codec))
+	}
+	return transcode
+}
+
+// captioned are the captions of the segments of a chunk in one language
+type captioned struct {
+	// captions are masked, prefixed with speaker changes, and line-wrapped
+	captions []transcriber.Segment
+	// originals are the captions before masking for the JSONL transcript,
+	// nil if nothing was masked
+	originals []transcriber.Segment
+	// sources are the segments before translation, nil if they weren't
+	// translated
+	sources []transcriber.Segment
+	lang    string
+	// fallback marks the captions that kept the source text because their
+	// translation failed, nil if none did
+	fallback []bool
+}
+
+// captionSegments turns transcribed segments into captions: it translates
+// them if needed, masks profanity, and breaks them into lines with wrapper,
+// adding directional marks for right-to-left languages. When translation
+// fails the captions stay in the source language and the error is returned
+// with them.
+func (p *Proxy) captionSegments(segments []transcriber.Segment, langs Languages, wrapper *subtitles.Wrapper) (captioned, error) {
+	result := captioned{lang: langs.Source}
+
+	// Argos chokes on some emoji, and the subtitle encoders on more
+	segments = p.normalizer.NormalizeSegments(segments)
+
+	var err error
+	translated := false
+	if langs.Target != "" && langs.Target != langs.Source {
+		var translatedSegments []transcriber.Segment
+		translatedSegments, result.fallback, err = p.translator.TranslateSegmentsFallback(segments, langs.Source, langs.Target)
+		if err == nil {
+			result.sources = segments
+			segments = p.normalizer.NormalizeSegments(translatedSegments)
+			result.lang = langs.Target
+			translated = true
+		} else {
+			result.fallback = make([]bool, len(segments))
+			for i := range result.fallback {
+				result.fallback[i] = true
+			}
+		}
+	}
+
+	if !translated || p.Config.ProfanityFilterTranslations {
+		if masked, changed := p.profanity.MaskSegments(segments, result.lang); changed {
+			result.originals = segments
+			segments = masked
+		}
+	}
+
+	result.captions = wrapper.WrapSegments(speaker.Prefixed(segments), result.lang)
+	return result, err
+}
+
+// muxProgressInterval is how often the post-session remux reports progress
+const muxProgressInterval = 10 * time.Second
+
+// finishRecording moves the recording of the ended stream into the session
+// directory and, if enabled, remuxes it with the session subtitles in the
+// background. done is closed once the recording is final.
+func (p *Proxy) finishRecording(sess *session.Session, subtitleFile string, done chan<- struct{}, logger *logrus.Entry) {
+	muxing := false
+	defer func() {
+		if !muxing {
+			close(done)
+		}
+	}()
+
+	// The recording is complete once the listener has exited
+	<-p.currentRun().listenerDone
+
+	// Every reconnect of the publisher was recorded by a listener of its own
+	if err := p.joinRecordingParts(); err != nil {
+		logger.WithError(err).Warn("Failed to join the recordings of the publisher's reconnects, only the first connection is kept")
+	}
+
+	if info, err := os.Stat(p.recordingPath); err != nil || info.Size() == 0 {
+		logger.Warn("No recording of the stream was written")
+		return
+	}
+
+	recording := filepath.Join(sess.Dir(), session.RecordingFile)
+	if err := os.Rename(p.recordingPath, recording); err != nil {
+		logger.WithError(err).Error("Failed to move the recording into the session directory")
+		return
+	}
+	sess.AddFile(session.RecordingFile)
+	if err := sess.WriteSummary(); err != nil {
+		logger.WithError(err).Warn("Failed to write session summary")
+	}
+	logger.WithField("file", recording).Info("Stream recording saved")
+
+	if !p.Config.PostSessionMux {
+		return
+	}
+
+	// Without captions the recording is remuxed on its own
+	var subtitlePath string
+	if subtitleFile != "" {
+		path := filepath.Join(sess.Dir(), subtitleFile)
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			subtitlePath = path
+		}
+	}
+
+	muxing = true
+	p.postSessionJobs.Add(1)
+	go func() {
+		defer p.postSessionJobs.Done()
+		defer close(done)
+		p.muxSession(sess, recording, subtitlePath, logger.WithField("job", "final-mux"))
+	}()
+}
+
+// syncSession uploads the files of the running session sess every
+// UPLOAD_INTERVAL until ctx is cancelled
+func (p *Proxy) syncSession(ctx context.Context, sess *session.Session, logger *logrus.Entry) {
+	if p.Config.UploadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.Config.UploadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.uploader.Sync(ctx, sess); err != nil && ctx.Err() == nil {
+			logger.WithError(err).Warn("Failed to upload the files of the running session")
+		}
+	}
+}
+
+// finishUpload uploads the files of the ended session sess in the background
+// once recordingDone, if not nil, is closed. A failed upload is left pending in the
+// session summary for the upload command.
+func (p *Proxy) finishUpload(sess *session.Session, recordingDone <-chan struct{}, logger *logrus.Entry) {
+	r := p.currentRun()
+	p.postSessionJobs.Add(1)
+	go func() {
+		defer p.postSessionJobs.Done()
+		if recordingDone != nil {
+			<-recordingDone
+		}
+		if err := p.uploader.Finish(r.jobsCtx, sess); err != nil {
+			logger.WithError(err).Error("Failed to upload the session, run the upload command to finish it")
+		}
+	}()
+}
+
+// muxSession remuxes the recording and the session subtitles into FinalFile
+// with a single FFmpeg run, reporting progress in the log and the session
+// summary
+func (p *Proxy) muxSession(sess *session.Session, recording, subtitlePath string, logger *logrus.Entry) {
+	status := session.MuxStatus{Status: session.MuxRunning, StartedAt: time.Now()}
+	report := func() {
+		current := status
+		sess.Update(func(summary *session.Summary) {
+			summary.FinalMux = &current
+		})
+		if err := sess.WriteSummary(); err != nil {
+			logger.WithError(err).Warn("Failed to write session summary")
+		}
+	}
+	report()
+	logger.Info("Remuxing recording with session subtitles")
+
+	final := filepath.Join(sess.Dir(), session.FinalFile)
+	partial := final + ".part"
+
+	// The subtitle file is named after its format
+	var subtitleCodec string
+	if subtitlePath != "" {
+		format, err := subtitles.ParseFormat(strings.TrimPrefix(filepath.Ext(subtitlePath), "."))
+		if err == nil {
+			subtitleCodec, err = subtitles.SubtitleCodec(format, subtitles.ContainerMP4)
+		}
+		if err != nil || subtitleCodec == "" {
+			logger.WithError(err).WithField("file", subtitlePath).Warn("Session subtitles can't be muxed, remuxing the recording without them")
+			subtitlePath = ""
+		}
+	}
+
+	args := []string{"-y", "-loglevel", "error", "-nostats", "-progress", "pipe:1", "-i", recording}
+	if subtitlePath != "" {
+		args = append(args, "-i", subtitlePath)
+	}
+	args = append(args, "-map", "0:v?", "-map", "0:a?", "-c:v", "copy", "-c:a", "copy")
+	if subtitlePath != "" {
+		args = append(args, "-map", "1:s", "-c:s", subtitleCodec)
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", partial)
+
+	err := func() error {
+		cmd := procs.FFmpegContext(p.currentRun().jobsCtx, args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("failed to create stdout pipe: %w", err)
+		}
+		if err := procs.Launch(cmd, procs.RoleMuxer); err != nil {
+			return fmt.Errorf("failed to start FFmpeg: %w", err)
+		}
+
+		// -progress writes blocks of key=value lines
+		lastReport := time.Now()
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			if key != "out_time_us" {
+				continue
+			}
+			microseconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			status.Progress = float64(microseconds) / 1e6
+			if time.Since(lastReport) >= muxProgressInterval {
+				lastReport = time.Now()
+				logger.WithField("progress_seconds", status.Progress).Info("Remuxing recording")
+				report()
+			}
+		}
+
+		if err := procs.Wait(cmd); err != nil {
+			return fmt.Errorf("FFmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return os.Rename(partial, final)
+	}()
+
+	finishedAt := time.Now()
+	status.FinishedAt = &finishedAt
+
+	if err != nil {
+		os.Remove(partial)
+		status.Status = session.MuxFailed
+		status.Error = err.Error()
+		report()
+		logger.WithError(err).Error("Post-session remux failed")
+		return
+	}
+
+	status.Status = session.MuxDone
+	sess.AddFile(session.FinalFile)
+	report()
+	logger.WithFields(logrus.Fields{
+		"file":     final,
+		"duration": finishedAt.Sub(status.StartedAt),
+	}).Info("Final recording with subtitles written")
+}
+
+// reprocessedSession is a session with reruns queued or running
+type reprocessedSession struct {
+	session *session.Session
+	jobs    int
+}
+
+// Reprocess reruns the offline pipeline over the recording of an ended
+// session with options overriding its settings. The new transcript and
+// subtitles are written to a subdirectory of the session, leaving the
+// originals untouched. The rerun is queued behind REPROCESS_MAX_JOBS others
+// and only transcribes while no live chunk is waiting for the models; its
+// progress is recorded in the session summary.
+func (p *Proxy) Reprocess(id string, options session.ReprocessOptions) (session.Reprocess, error) {
+	if p.outputDisabled.Load() {
+		return session.Reprocess{}, ErrOutputDisabled
+	}
+	entry, err := session.Find(p.Config.OutputDir, id)
+	if err != nil {
+		return session.Reprocess{}, err
+	}
+
+	if active := p.activeSession(); active != nil && active.session.ID() == entry.ID {
+		return session.Reprocess{}, ErrSessionBusy
+	}
+	if entry.FinalMux != nil && entry.FinalMux.Status == session.MuxRunning {
+		return session.Reprocess{}, ErrSessionBusy
+	}
+	recording, ok := entry.File(filepath.Ext(session.RecordingFile))
+	if !ok {
+		return session.Reprocess{}, ErrNoRecording
+	}
+
+	// Unset options keep the settings of the session
+	if options.SourceLang == "" {
+		options.SourceLang = entry.SourceLang
+	}
+	if options.TargetLang == "" {
+		options.TargetLang = entry.TargetLang
+	}
+	if options.SubtitleFormat == "" {
+		options.SubtitleFormat = string(subtitles.FormatSRT)
+	}
+	if options.ModelSize == "" {
+		options.ModelSize = p.Config.WhisperModelSize
+	}
+	if options.AudioTrack == nil {
+		options.AudioTrack = &entry.AudioTrack
+	}
+
+	format := subtitles.SubtitleFormat(options.SubtitleFormat)
+	if format != subtitles.FormatSRT && format != subtitles.FormatVTT {
+		return session.Reprocess{}, fmt.Errorf("%w: subtitle format must be srt or vtt", ErrInvalidOptions)
+	}
+	if options.MaxColumns < 0 {
+		return session.Reprocess{}, fmt.Errorf("%w: max columns must not be negative", ErrInvalidOptions)
+	}
+	if *options.AudioTrack < 0 {
+		return session.Reprocess{}, fmt.Errorf("%w: audio track must not be negative", ErrInvalidOptions)
+	}
+
+	t := p.transcriber
+	if options.ModelSize != p.Config.WhisperModelSize {
+		if _, ok := transcriber.ModelRepository(options.ModelSize); !ok {
+			return session.Reprocess{}, fmt.Errorf("%w: unknown model size %q", ErrInvalidOptions, options.ModelSize)
+		}
+		cfg := *p.Config
+		cfg.WhisperModelSize = options.ModelSize
+		cfg.WhisperModelDir = ""
+		t = transcriber.New(&cfg)
+	}
+	if err := t.VerifyModel(); err != nil {
+		return session.Reprocess{}, err
+	}
+
+	langs := Languages{Source: options.SourceLang, Target: options.TargetLang}
+	if err := p.translator.CheckLanguagePair(langs.Source, langs.Target); err != nil {
+		return session.Reprocess{}, err
+	}
+
+	wrapper := p.wrapper
+	if options.MaxColumns > 0 {
+		wrapper = subtitles.NewWrapper(options.MaxColumns, nil)
+	}
+
+	sess := p.openReprocessSession(entry)
+	reprocess, dir, err := sess.AddReprocess(options)
+	if err != nil {
+		p.closeReprocessSession(entry.ID)
+		return session.Reprocess{}, err
+	}
+	if err := sess.WriteSummary(); err != nil {
+		p.logger.WithError(err).Warn("Failed to write session summary")
+	}
+
+	p.reprocessJobs.Add(1)
+	go func() {
+		defer p.reprocessJobs.Done()
+		defer p.closeReprocessSession(entry.ID)
+
+		captionLang := langs.Target
+		if captionLang == "" {
+			captionLang = langs.Source
+		}
+		job := reprocessJob{
+			session:    sess,
+			id:         reprocess.ID,
+			dir:        dir,
+			baseName:   sess.FileName(p.Config.FilenameTemplate, captionLang),
+			recording:  recording,
+			audioTrack: *options.AudioTrack,
+			langs:      langs,
+			format:     format,
+			t:          t,
+			wrapper:    wrapper,
+			logger: p.logger.WithFields(logrus.Fields{
+				"session": entry.ID,
+				"job":     reprocess.ID,
+			}),
+		}
+		p.runReprocess(job)
+	}()
+
+	return reprocess, nil
+}
+
+// openReprocessSession returns the session of entry for a new rerun, sharing
+// it with the reruns already queued for the session
+func (p *Proxy) openReprocessSession(entry session.Entry) *session.Session {
+	p.reprocessMu.Lock()
+	defer p.reprocessMu.Unlock()
+
+	reprocessed, ok := p.reprocessing[entry.ID]
+	if !ok {
+		reprocessed = &reprocessedSession{session: session.Open(entry)}
+		p.reprocessing[entry.ID] = reprocessed
+	}
+	reprocessed.jobs++
+	return reprocessed.session
+}
+
+// closeReprocessSession releases the session once a rerun has finished
+func (p *Proxy) closeReprocessSession(id string) {
+	p.reprocessMu.Lock()
+	defer p.reprocessMu.Unlock()
+
+	if reprocessed, ok := p.reprocessing[id]; ok {
+		reprocessed.jobs--
+		if reprocessed.jobs == 0 {
+			delete(p.reprocessing, id)
+		}
+	}
+}
+
+// stopReprocessing aborts all reruns and waits for them to record that they
+// were interrupted
+func (p *Proxy) stopReprocessing() {
+	p.cancelReprocess()
+	p.reprocessJobs.Wait()
+}
+
+// reprocessJob is a rerun of a session recording, or a file transcribed by
+// TranscribeFile without a session
+type reprocessJob struct {
+	session   *session.Session
+	id        string
+	dir       string // Output directory of the rerun
+	baseName  string // Name of the output files without extension
+	recording string
+	// audioTrack is the audio track transcribed, or FFmpeg's choice if
+	// negative
+	audioTrack int
+	langs      Languages
+	format     subtitles.SubtitleFormat
+	t          Transcriber
+	wrapper    *subtitles.Wrapper
+	logger     *logrus.Entry
+}
+
+// runReprocess waits for a free slot and runs job, recording its progress
+// in the session summary
+func (p *Proxy) runReprocess(job reprocessJob) {
+	report := func(fn func(*session.Reprocess)) {
+		job.session.UpdateReprocess(job.id, fn)
+		if err := job.session.WriteSummary(); err != nil {
+			job.logger.WithError(err).Warn("Failed to write session summary")
+		}
+	}
+	fail := func(err error) {
+		finishedAt := time.Now()
+		report(func(reprocess *session.Reprocess) {
+			reprocess.Status = session.ReprocessFailed
+			reprocess.Error = err.Error()
+			reprocess.ETA = 0
+			reprocess.FinishedAt = &finishedAt
+		})
+		job.logger.WithError(err).Error("Reprocessing failed")
+	}
+
+	select {
+	case p.reprocessSlots <- struct{}{}:
+		defer func() { <-p.reprocessSlots }()
+	case <-p.reprocessCtx.Done():
+		fail(errors.New("aborted by shutdown"))
+		return
+	}
+
+	// The duration is only needed for the ETA
+	var duration time.Duration
+	if file, err := os.Open(job.recording); err == nil {
+		duration, err = flv.Duration(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			job.logger.WithError(err).Warn("Failed to read the recording duration, no ETA will be reported")
+			duration = 0
+		}
+	}
+
+	startedAt := time.Now()
+	report(func(reprocess *session.Reprocess) {
+		reprocess.Status = session.ReprocessRunning
+		reprocess.StartedAt = &startedAt
+		reprocess.Duration = duration.Seconds()
+	})
+	job.logger.WithFields(logrus.Fields{
+		"model":       job.t.ModelDir(),
+		"source_lang": job.langs.Source,
+		"target_lang": job.langs.Target,
+		"duration":    duration,
+	}).Info("Reprocessing session recording")
+
+	lastReport := time.Now()
+	progress := func(processed time.Duration) {
+		if time.Since(lastReport) < muxProgressInterval {
+			return
+		}
+		lastReport = time.Now()
+
+		var eta time.Duration
+		if processed > 0 && duration > processed {
+			eta = time.Duration(float64(time.Since(startedAt)) * float64(duration-processed) / float64(processed))
+		}
+		report(func(reprocess *session.Reprocess) {
+			reprocess.Progress = processed.Seconds()
+			reprocess.ETA = eta.Seconds()
+		})
+		job.logger.WithFields(logrus.Fields{
+			"progress": processed,
+			"eta":      eta.Round(time.Second),
+		}).Info("Reprocessing session recording")
+	}
+
+	files, translationFailed, processed, err := p.transcribeRecording(p.reprocessCtx, job, progress)
+	if err != nil {
+		if p.reprocessCtx.Err() != nil {
+			err = errors.New("aborted by shutdown")
+		}
+		fail(err)
+		return
+	}
+
+	finishedAt := time.Now()
+	report(func(reprocess *session.Reprocess) {
+		reprocess.Status = session.ReprocessDone
+		reprocess.Progress = processed.Seconds()
+		reprocess.ETA = 0
+		reprocess.Files = files
+		reprocess.TranslationFailed = translationFailed
+		reprocess.FinishedAt = &finishedAt
+	})
+	job.logger.WithFields(logrus.Fields{
+		"dir":      job.dir,
+		"duration": finishedAt.Sub(startedAt),
+	}).Info("Session recording reprocessed")
+}
+
+// transcribeRecording decodes the recording chunk by chunk and runs every
+// chunk through transcription and captioning into a new transcript, calling
+// progress with the recording time processed so far. It returns the files
+// written and whether translation failed for any captions. Decoding and
+// transcription stop once ctx is done.
+func (p *Proxy) transcribeRecording(ctx context.Context, job reprocessJob, progress func(time.Duration)) (files []string, translationFailed bool, processed time.Duration, err error) {
+	decoder, err := audio.NewDecoder(ctx, job.recording, job.audioTrack)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	decoding := true
+	defer func() {
+		if decoding {
+			decoder.Close()
+		}
+	}()
+
+	tempDir, err := os.MkdirTemp(p.tempRoot(), "reprocess-")
+	if err != nil {
+		return nil, false, 0, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	captionLang := captionsLang(job.langs)
+	store, err := transcript.New(job.dir, job.baseName, job.format, p.VTTOptions(), p.Config.LiveCaptionWindow, p.Config.LiveCaptionHistory)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	defer store.Close()
+	if p.Config.TranscriptVerboseJSON {
+		store.EnableVerboseJSON(captionLang)
+	}
+	sidecar, err := transcript.NewSidecar(job.dir, job.baseName, job.format, p.VTTOptions())
+	if err != nil {
+		return nil, false, 0, err
+	}
+	defer sidecar.Close()
+
+	var reflower *reflow.Reflower
+	if p.Config.Reflow {
+		reflower = reflow.New(p.Config.ReflowMaxGap.Seconds(), p.Config.MaxCueChars)
+	}
+	speakers := p.newSpeakerTracker()
+
+	appendCaptions := func(index int, segments []transcriber.Segment) error {
+		if len(segments) == 0 {
+			return nil
+		}
+		result, err := p.captionSegments(segments, job.langs, job.wrapper)
+		if err != nil {
+			if !translationFailed {
+				job.logger.WithError(err).Warn("Translation failed, using original transcription")
+			}
+			translationFailed = true
+		}
+		if err := store.Append(index, result.lang, result.captions, result.originals, result.sources); err != nil {
+			return err
+		}
+		return sidecar.WriteCues(time.Duration(index)*chunkDuration, result.captions)
+	}
+
+	bytesPerSecond := audio.Expected.BytesPerSecond()
+	chunk := make([]byte, int(chunkDuration.Seconds())*bytesPerSecond)
+	index := 0
+	for ; ; index++ {
+		n, readErr := io.ReadFull(decoder, chunk)
+		if n == 0 && (errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF)) {
+			break
+		}
+		if readErr != nil && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return nil, false, processed, fmt.Errorf("failed to decode recording: %w", readErr)
+		}
+
+		// Live chunks keep priority on the models
+		segments, err := p.scheduler.Transcribe(ctx, scheduler.Batch, job.t, tempDir, chunk[:n], audio.Expected, job.langs.Source, transcriber.FallbackNone)
+		if errors.Is(err, transcriber.ErrCorruptAudio) {
+			// A silent or too short chunk, such as the end of the recording
+			job.logger.WithError(err).WithField("chunk", index).Debug("Skipping chunk")
+			segments = nil
+		} else if err != nil {
+			return nil, false, processed, err
+		}
+
+		segments = pipeline.NormalizeTiming(segments, p.timingOptions(), job.logger.WithField("chunk", index))
+		segments = pipeline.ShiftSegments(segments, processed.Seconds())
+		if speakers != nil {
+			segments = speakers.Label(index, segments, chunk[:n], audio.Expected, processed.Seconds(), ctx.Done())
+		}
+		if reflower != nil {
+			segments = reflower.Process(index, segments, ctx.Done())
+		}
+		if err := appendCaptions(index, segments); err != nil {
+			return nil, false, processed, err
+		}
+
+		processed += time.Duration(n) * time.Second / time.Duration(bytesPerSecond)
+		progress(processed)
+		if readErr != nil {
+			break
+		}
+	}
+
+	decoding = false
+	if err := decoder.Close(); err != nil {
+		return nil, false, processed, err
+	}
+
+	if reflower != nil {
+		if err := appendCaptions(index, reflower.Flush()); err != nil {
+			return nil, false, processed, err
+		}
+	}
+	if err := store.Close(); err != nil {
+		return nil, false, processed, fmt.Errorf("failed to close transcript: %w", err)
+	}
+	if err := sidecar.Close(); err != nil {
+		return nil, false, processed, fmt.Errorf("failed to close subtitles: %w", err)
+	}
+
+	return append(store.Files(), sidecar.Name()), translationFailed, processed, nil
+}
+
+// FileOptions select how TranscribeFile transcribes a media file
+type FileOptions struct {
+	Langs    Languages
+	Format   subtitles.SubtitleFormat // srt or vtt
+	BaseName string                   // Name of the output files without extension
+}
+
+// FileResult describes a file transcribed by TranscribeFile
+type FileResult struct {
+	Files             []string // Names of the files written
+	Duration          time.Duration
+	TranslationFailed bool
+}
+
+// CheckOffline reports whether files can be transcribed with the configured
+// model into langs
+func (p *Proxy) CheckOffline(langs Languages) error {
+	if err := p.transcriber.VerifyModel(); err != nil {
+		return err
+	}
+	return p.translator.CheckLanguagePair(langs.Source, langs.Target)
+}
+
+// TranscribeFile runs the offline pipeline that reprocesses session
+// recordings over the media file at path, writing its transcript and
+// subtitles to dir. progress is called with the audio time processed so
+// far. It stops once ctx is done.
+func (p *Proxy) TranscribeFile(ctx context.Context, path, dir string, options FileOptions, progress func(time.Duration)) (FileResult, error) {
+	if options.Format != subtitles.FormatSRT && options.Format != subtitles.FormatVTT {
+		return FileResult{}, fmt.Errorf("%w: subtitle format must be srt or vtt", ErrInvalidOptions)
+	}
+	if err := os.MkdirAll(p.tempRoot(), 0755); err != nil {
+		return FileResult{}, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	job := reprocessJob{
+		dir:        dir,
+		baseName:   options.BaseName,
+		recording:  path,
+		audioTrack: -1,
+		langs:      options.Langs,
+		format:     options.Format,
+		t:          p.transcriber,
+		wrapper:    p.wrapper,
+		logger:     p.logger.WithField("file", path),
+	}
+	files, translationFailed, processed, err := p.transcribeRecording(ctx, job, progress)
+	if err != nil {
+		return FileResult{}, err
+	}
+	return FileResult{Files: files, Duration: processed, TranslationFailed: translationFailed}, nil
+}
+
+// fallbackProbeInterval is how long after the last out-of-memory error chunks
+// try the configured transcription settings again
+const fallbackProbeInterval = 30 * time.Second
+
+// confidenceWindow is the number of recent segments the rolling confidence
+// averages over
+const confidenceWindow = 50
+
+// ConfidenceStatus is the rolling average confidence of recent segments
+type ConfidenceStatus struct {
+	Segments     int     `json:"segments"`
+	AvgLogProb   float64 `json:"avg_logprob"`
+	NoSpeechProb float64 `json:"no_speech_prob"`
+}
+
+// confidenceTracker keeps the confidence of the most recent segments
+type confidenceTracker struct {
+	mu      sync.Mutex
+	window  int
+	samples []transcriber.Segment
+}
+
+// newConfidenceTracker creates a tracker averaging over window segments
+func newConfidenceTracker(window int) *confidenceTracker {
+	return &confidenceTracker{window: window}
+}
+
+// Add records the confidence of newly transcribed segments
+func (c *confidenceTracker) Add(segments []transcriber.Segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.samples = append(c.samples, segments...)
+	if excess := len(c.samples) - c.window; excess > 0 {
+		c.samples = append(c.samples[:0:0], c.samples[excess:]...)
+	}
+}
+
+// Status returns the averages over the recorded segments
+func (c *confidenceTracker) Status() ConfidenceStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ConfidenceStatus{Segments: len(c.samples)}
+	if len(c.samples) == 0 {
+		return status
+	}
+
+	for _, segment := range c.samples {
+		status.AvgLogProb += segment.AvgLogProb
+		status.NoSpeechProb += segment.NoSpeechProb
+	}
+	status.AvgLogProb /= float64(len(c.samples))
+	status.NoSpeechProb /= float64(len(c.samples))
+
+	return status
+}
+
+// rtmpConnection represents an active RTMP connection
+type rtmpConnection struct {
+	streamName   string
+	sourceURL    string
+	targetURL    string
+	subtitleType subtitles.SubtitleFormat
+
+	// langMu guards the languages, which can be switched mid-stream
+	langMu     sync.RWMutex
+	sourceLang string
+	targetLang string
+	extraLangs []string // Replaced, never changed in place
+}
+
+// languages returns the current languages
+func (c *rtmpConnection) languages() Languages {
+	c.langMu.RLock()
+	defer c.langMu.RUnlock()
+	return Languages{Source: c.sourceLang, Target: c.targetLang, Extra: c.extraLangs}
+}
+
+// setLanguages switches all languages at once, so a chunk never sees only
+// some of them switched
+func (c *rtmpConnection) setLanguages(languages Languages) {
+	c.langMu.Lock()
+	defer c.langMu.Unlock()
+	c.sourceLang = languages.Source
+	c.targetLang = languages.Target
+	c.extraLangs = slices.Clone(languages.Extra)
+}
+
+// activeSession is the state of the stream currently being processed
+type activeSession struct {
+	session *session.Session
+	conn    *rtmpConnection
+	// store is nil if the transcript files could not be created, and
+	// sidecar if the subtitle file could not
+	store   *transcript.Store
+	sidecar *transcript.Sidecar
+	// streamer is nil in transcribe-only mode
+	streamer *streaming.Streamer
+	// pipeline processes the chunks of the stream
+	pipeline *pipeline.Pipeline
+}
+
+// limitCheckInterval is how often a stream is checked against its limits
+const limitCheckInterval = time.Second
+
+// streamLimits tracks how long a stream has run and when it last showed
+// activity: audio above the silence threshold, or a keyframe that differs
+// from the one before, which a frozen picture doesn't produce
+type streamLimits struct {
+	maxDuration time.Duration // Zero for no limit
+	idleTimeout time.Duration // Zero for no limit
+	silenceDB   float64
+
+	started      time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds
+	lastKeyframe uint64       // Hash of the last keyframe, only used by the video reader
+}
+
+// enabled reports whether any limit is set
+func (l *streamLimits) enabled() bool {
+	return l.maxDuration > 0 || l.idleTimeout > 0
+}
+
+// start starts the clocks of the limits at now
+func (l *streamLimits) start(now time.Time) {
+	l.started = now
+	l.lastActivity.Store(now.UnixNano())
+}
+
+// addAudio records a chunk of PCM audio, which is activity unless it is
+// quieter than the silence threshold
+func (l *streamLimits) addAudio(pcm []byte) {
+	if audio.Level(pcm) > l.silenceDB {
+		l.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// addKeyframe records a video keyframe, which is activity if it differs from
+// the one before
+func (l *streamLimits) addKeyframe(data []byte) {
+	h := fnv.New64a()
+	h.Write(data)
+	if sum := h.Sum64(); sum != l.lastKeyframe {
+		l.lastKeyframe = sum
+		l.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// exceeded returns the reason to end the stream at now, or an empty string
+// if it is within its limits
+func (l *streamLimits) exceeded(now time.Time) string {
+	switch {
+	case l.maxDuration > 0 && now.Sub(l.started) >= l.maxDuration:
+		return session.EndMaxDuration
+	case l.idleTimeout > 0 && now.Sub(time.Unix(0, l.lastActivity.Load())) >= l.idleTimeout:
+		return session.EndIdle
+	default:
+		return ""
+	}
 }
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// integrationClip is how long the published clip is: a full chunk, and a
+// partial one flushed when the stream ends
+const integrationClip = 14 * time.Second
+
+func TestIntegrationRestream(t *testing.T) {
+	testutil.SkipUnlessFFmpeg(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	const caption = "Hello from the fake whisper."
+	modelDir := testutil.FakeWhisper(t, "en", []transcriber.Segment{{Start: 1, End: 3, Text: caption}})
+	testutil.FakeArgos(t, "en_de")
+
+	port, err := testutil.FreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.flv")
+
+	cfg := config.New()
+	cfg.RTMPBindAddress = "127.0.0.1"
+	cfg.RTMPPort = strconv.Itoa(port)
+	cfg.DefaultTargetURL = "file://" + target
+	cfg.OutputDir = filepath.Join(dir, "output")
+	cfg.WorkDir = filepath.Join(dir, "work")
+	cfg.WhisperModelDir = modelDir
+	cfg.CUDAEnabled = false
+	cfg.DefaultSourceLang = "en"
+	cfg.DefaultTargetLang = "de"
+	cfg.EnableTranslation = true
+	cfg.ArgosWorker = false
+	cfg.SessionResumeWindow = 0
+	for _, d := range []string{cfg.OutputDir, cfg.WorkDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := New(cfg)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close(context.Background())
+	if err := testutil.WaitForPort(ctx, port); err != nil {
+		t.Fatalf("listener didn't come up: %v", err)
+	}
+
+	clip := filepath.Join(dir, "clip.flv")
+	if err := testutil.GenerateClip(ctx, clip, integrationClip); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.Publish(ctx, clip, p.listenURL()); err != nil {
+		t.Fatal(err)
+	}
+	// Stopping lets the queued chunks finish and closes the targets
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target got a playable stream with both tracks
+	probe, err := testutil.ProbeFile(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codecType := range []string{"video", "audio"} {
+		if _, ok := probe.Stream(codecType); !ok {
+			t.Errorf("target has no %s stream: %+v", codecType, probe.Streams)
+		}
+	}
+	if duration, err := probe.Duration(); err != nil || duration < integrationClip/2 {
+		t.Errorf("target is %s long (%v), want most of the %s clip", duration, err, integrationClip)
+	}
+
+	// The session has the translated captions as transcript and subtitles
+	translated := "[de] " + caption
+	found := map[string]bool{}
+	filepath.WalkDir(cfg.OutputDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err == nil && strings.Contains(string(data), translated) {
+			found[filepath.Ext(path)] = true
+		}
+		return nil
+	})
+	for _, ext := range []string{".txt", ".srt"} {
+		if !found[ext] {
+			t.Errorf("no %s file in %s has %q", ext, cfg.OutputDir, translated)
+		}
+	}
+}
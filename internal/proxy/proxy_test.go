@@ -0,0 +1,443 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/flv"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/ben/transcription-proxy/internal/streaming"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/ben/transcription-proxy/internal/transcript"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	testutil.FakeFFmpegMain()
+	os.Exit(m.Run())
+}
+
+// testProxy returns a proxy that logs nothing, for tests that don't start it
+func testProxy(cfg *config.Config) *Proxy {
+	p := New(cfg)
+	p.logger.SetOutput(io.Discard)
+	return p
+}
+
+func TestFlushTranscripts(t *testing.T) {
+	dir := t.TempDir()
+	sess, err := session.New(dir, streamKey, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := transcript.New(sess.Dir(), "stream", subtitles.FormatSRT, subtitles.VTTOptions{}, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sidecar, err := transcript.NewSidecar(sess.Dir(), "stream", subtitles.FormatSRT, subtitles.VTTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sidecar.Close()
+	captions := []transcriber.Segment{{Start: 1, End: 2, Text: "finalized"}}
+	if err := store.Append(0, "en", captions, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sidecar.WriteCues(0, captions); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		active *activeSession
+		err    error
+		files  int
+	}{
+		{"no stream", nil, ErrNoActiveStream, 0},
+		{"output disabled", &activeSession{session: sess}, ErrNoTranscript, 0},
+		{"flushed", &activeSession{session: sess, store: store}, nil, len(store.Files())},
+		{"flushed with subtitles", &activeSession{session: sess, store: store, sidecar: sidecar}, nil, len(store.Files()) + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProxy(config.New())
+			p.setActiveSession(tt.active)
+
+			paths, err := p.FlushTranscripts()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("FlushTranscripts() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			// The files are complete up to the last captioned chunk, the full
+			// transcript included, while the stream goes on
+			if len(paths) != tt.files {
+				t.Errorf("flushed %v, want every file of the store and the subtitles", paths)
+			}
+			for _, path := range paths {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(data), "finalized") {
+					t.Errorf("%s misses the last chunk:\n%s", path, data)
+				}
+			}
+		})
+	}
+}
+
+// dirs are the kinds of directories the checks of the work and output
+// directories are tried with
+var dirs = map[string]func(t *testing.T) string{
+	"writable": func(t *testing.T) string { return t.TempDir() },
+	"missing":  func(t *testing.T) string { return filepath.Join(t.TempDir(), "a", "b") },
+	"read-only": func(t *testing.T) string {
+		return testutil.ReadOnlyDir(t)
+	},
+	// Unwritable even for root
+	"not a directory": func(t *testing.T) string {
+		file := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(file, "dir")
+	},
+}
+
+func TestCheckWritable(t *testing.T) {
+	tests := []struct {
+		dir     string
+		wantErr bool
+	}{
+		{"writable", false},
+		{"missing", false},
+		{"read-only", true},
+		{"not a directory", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			dir := dirs[tt.dir](t)
+			err := checkWritable(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkWritable() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// The check leaves nothing behind
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("directory has %v (%v), want it empty", entries, err)
+			}
+		})
+	}
+}
+
+func TestCheckDirs(t *testing.T) {
+	tests := []struct {
+		name     string
+		workDir  string // Empty for the default in the output directory
+		output   string
+		err      string // Expected in the error, empty for none
+		disabled bool
+	}{
+		{"both writable", "writable", "writable", "", false},
+		{"default work directory", "", "writable", "", false},
+		{"read-only output", "writable", "read-only", "", true},
+		{"output not a directory", "writable", "not a directory", "", true},
+		{"read-only work directory", "read-only", "writable", "WORK_DIR", false},
+		{"work directory not a directory", "not a directory", "writable", "WORK_DIR", false},
+		{"default work directory in an output that is not a directory", "", "not a directory", "set WORK_DIR", false},
+		{"default work directory in a read-only output", "", "read-only", "set WORK_DIR", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.New()
+			cfg.OutputDir = dirs[tt.output](t)
+			if tt.workDir != "" {
+				cfg.WorkDir = dirs[tt.workDir](t)
+			}
+			p := testProxy(cfg)
+
+			err := p.checkDirs()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("checkDirs() = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("checkDirs() = %v, want an error naming %s", err, tt.err)
+			}
+			if p.OutputDisabled() != tt.disabled {
+				t.Errorf("OutputDisabled() = %v, want %v", p.OutputDisabled(), tt.disabled)
+			}
+		})
+	}
+}
+
+func TestSweepTempDirs(t *testing.T) {
+	cfg := config.New()
+	cfg.OutputDir = t.TempDir()
+	cfg.WorkDir = t.TempDir()
+	cfg.TempMaxAge = time.Hour
+	p := testProxy(cfg)
+	if err := p.checkDirs(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	paths := map[string]bool{ // Whether the sweep keeps the path
+		filepath.Join(cfg.WorkDir, "other-program"):   true, // Not the proxy's
+		filepath.Join(p.tempRoot(), "stale-session"):  false,
+		filepath.Join(p.tempRoot(), "recent-session"): true,
+	}
+	for path := range paths {
+		if err := os.Mkdir(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "file"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(filepath.Base(path), "recent") {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	p.sweepTempDirs()
+	for path, kept := range paths {
+		if _, err := os.Stat(path); (err == nil) != kept {
+			t.Errorf("%s exists: %v, want %v", path, err == nil, kept)
+		}
+	}
+}
+
+func TestAddTarget(t *testing.T) {
+	t.Setenv("ADDED_KEY", "added-key")
+
+	tests := []struct {
+		name   string
+		active bool
+		codecs session.Codecs
+		url    string
+		err    error
+	}{
+		{"added", true, session.Codecs{}, "rtmp://other/live/${ADDED_KEY}", nil},
+		{"no stream", false, session.Codecs{}, "rtmp://other/live/key", ErrNoActiveStream},
+		{"invalid URL", true, session.Codecs{}, "rtmp://other/live", ErrInvalidTarget},
+		{"missing secret", true, session.Codecs{}, "rtmp://other/live/${MISSING_KEY}", ErrInvalidTarget},
+		{"nested secret", true, session.Codecs{}, "rtmp://other/live/${A${ADDED_KEY}}", ErrInvalidTarget},
+		{"unknown profile", true, session.Codecs{}, "rtmp://other/live/key?profile=nope", ErrInvalidTarget},
+		{"duplicate", true, session.Codecs{}, "rtmp://host/live/first", streaming.ErrDuplicateTarget},
+		{"other subtitle format", true, session.Codecs{}, "rtmp://other/live/key?subtitles=vtt", ErrInvalidTarget},
+		{"same subtitle format", true, session.Codecs{}, "rtmp://other/live/key?subtitles=srt", nil},
+		{"codec taken", true, session.Codecs{Video: flv.CodecHEVC}, "rtmp://other/live/key?codecs=h264,hevc", nil},
+		{"codec not taken", true, session.Codecs{Video: flv.CodecHEVC}, "rtmp://other/live/key?codecs=h264", streaming.ErrUnsupportedCodec},
+		{"transcoded codec taken", true, session.Codecs{Video: flv.CodecHEVC, Transcoded: true}, "rtmp://other/live/key?codecs=h264", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProxy(config.New())
+			first, err := streaming.ParseStreamURL("rtmp://host/live/first", streaming.Ingests{}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamer := streaming.New([]*streaming.StreamTarget{first})
+			if tt.active {
+				sess, err := session.New("", streamKey, time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+				sess.Update(func(summary *session.Summary) { summary.Codecs = tt.codecs })
+				p.setActiveSession(&activeSession{session: sess, streamer: streamer})
+			}
+
+			status, err := p.AddTarget(tt.url)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("AddTarget() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if len(streamer.Targets()) != 1 {
+					t.Error("target added though it was rejected")
+				}
+				return
+			}
+			if status.ID != 1 || strings.Contains(status.Target, "added-key") {
+				t.Errorf("status = %+v, want target 1 with its secrets hidden", status)
+			}
+			if targets := streamer.Targets(); len(targets) != 2 {
+				t.Errorf("streamer has %d targets, want the added one too", len(targets))
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	errListener := errors.New("listener failed")
+	tests := []struct {
+		name   string
+		ends   []string // Reasons the run ended for, in order
+		closed bool
+		reason string
+		fatal  bool
+	}{
+		{"still running", nil, false, StopRequested, false},
+		{"requested", []string{StopRequested}, true, StopRequested, false},
+		{"stream ended", []string{StopStreamEnded}, true, StopStreamEnded, false},
+		{"max duration", []string{StopMaxDuration}, true, StopMaxDuration, false},
+		{"idle", []string{StopIdle}, true, StopIdle, false},
+		{"failed", []string{StopFailed}, true, StopFailed, true},
+		// The stop the failure caused doesn't hide it
+		{"first reason kept", []string{StopFailed, StopRequested}, true, StopFailed, true},
+		{"later failure ignored", []string{StopStreamEnded, StopFailed}, true, StopStreamEnded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProxy(config.New())
+			r := newRun()
+			p.run.Store(r)
+			for _, reason := range tt.ends {
+				var err error
+				if reason == StopFailed {
+					err = errListener
+				}
+				r.ended(reason, err)
+			}
+			p.stateMu.Lock()
+			p.closed = tt.closed
+			p.stateMu.Unlock()
+
+			report := p.Report()
+			if report.Reason != tt.reason || report.Fatal() != tt.fatal {
+				t.Errorf("report = %+v (fatal %v), want reason %s (fatal %v)", report, report.Fatal(), tt.reason, tt.fatal)
+			}
+			if (report.Error != "") != tt.fatal {
+				t.Errorf("error = %q, want one only for a failure", report.Error)
+			}
+			if report.Drained != tt.closed {
+				t.Errorf("drained = %v, want %v", report.Drained, tt.closed)
+			}
+		})
+	}
+}
+
+func TestEmbeddedFormat(t *testing.T) {
+	tests := []struct {
+		format subtitles.SubtitleFormat
+		want   subtitles.SubtitleFormat
+	}{
+		// The restream is FLV, which carries no subtitle track
+		{subtitles.FormatSRT, subtitles.FormatNone},
+		{subtitles.FormatVTT, subtitles.FormatNone},
+		{subtitles.FormatASS, subtitles.FormatNone},
+		{subtitles.FormatBurned, subtitles.FormatBurned},
+		{subtitles.FormatNone, subtitles.FormatNone},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			p := testProxy(config.New())
+			if got := p.embeddedFormat(tt.format, logrus.NewEntry(p.logger)); got != tt.want {
+				t.Errorf("embeddedFormat() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// startableProxy returns a proxy that logs nothing and transcribes without
+// a model, listening with the fake FFmpeg on a free port
+func startableProxy(t *testing.T) *Proxy {
+	t.Helper()
+	testutil.FakeFFmpeg(t)
+	port, err := testutil.FreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New()
+	cfg.RTMPBindAddress = "127.0.0.1"
+	cfg.RTMPPort = strconv.Itoa(port)
+	cfg.DefaultTargetURL = ""
+	cfg.OutputDir = t.TempDir()
+	cfg.WorkDir = t.TempDir()
+	cfg.CUDAEnabled = false
+	cfg.EnableTranslation = false
+	cfg.AutoDownloadModels = false
+	cfg.SessionResumeWindow = 0
+	p := testProxy(cfg)
+	p.SetTranscriber(&testutil.FakeTranscriber{})
+	return p
+}
+
+func TestStartStop(t *testing.T) {
+	type step struct {
+		call string // start, stop or close
+		err  error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"stop before start", []step{{"stop", nil}}},
+		{"start and stop", []step{{"start", nil}, {"stop", nil}}},
+		{"double start", []step{{"start", nil}, {"start", nil}, {"stop", nil}}},
+		{"double stop", []step{{"start", nil}, {"stop", nil}, {"stop", nil}}},
+		{"restart after stop", []step{{"start", nil}, {"stop", nil}, {"start", nil}, {"stop", nil}}},
+		{"start after close", []step{{"start", nil}, {"close", nil}, {"start", ErrClosed}, {"stop", nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			p := startableProxy(t)
+			defer p.Close(context.Background())
+			port, _ := strconv.Atoi(p.Config.RTMPPort)
+
+			for i, s := range tt.steps {
+				var err error
+				switch s.call {
+				case "start":
+					err = p.Start()
+				case "stop":
+					err = p.Stop(ctx)
+				case "close":
+					err = p.Close(ctx)
+				}
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d: %s = %v, want %v", i, s.call, err, s.err)
+				}
+				// A started proxy takes streams
+				if s.call == "start" && err == nil {
+					if err := testutil.WaitForPort(ctx, port); err != nil {
+						t.Fatalf("step %d: listener didn't come up: %v", i, err)
+					}
+				}
+			}
+
+			// The pipeline may end after Stop returns
+			var state string
+			err := testutil.WaitFor(ctx, 10*time.Millisecond, func() bool {
+				p.stateMu.Lock()
+				defer p.stateMu.Unlock()
+				state = p.state
+				return state == stateStopped
+			})
+			if err != nil {
+				t.Fatalf("state = %s, want %s", state, stateStopped)
+			}
+			if err := p.checkPortFree(); err != nil {
+				t.Errorf("listener still running: %v", err)
+			}
+		})
+	}
+}
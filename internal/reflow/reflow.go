@@ -0,0 +1,163 @@
+// Package reflow merges sentences that were split across chunk boundaries.
+// Chunks are transcribed independently, so a sentence spanning a boundary
+// comes out as two cues. The reflower holds back the last segment of each
+// chunk and merges it into the first segment of the next chunk when the
+// sentence continues there.
+package reflow
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// sentenceEnders are the characters that end a sentence
+const sentenceEnders = ".!?…。！？"
+
+// Reflower reflows the segments of consecutive chunks. Segment times passed
+// to and returned from it are relative to the start of the stream.
+type Reflower struct {
+	maxGap   float64
+	maxChars int
+
+	mu    sync.Mutex
+	turns map[int]chan struct{}
+	held  *transcriber.Segment
+}
+
+// New creates a reflower that merges segments at most maxGap seconds apart
+// as long as the merged text is no longer than maxChars
+func New(maxGap float64, maxChars int) *Reflower {
+	r := &Reflower{
+		maxGap:   maxGap,
+		maxChars: maxChars,
+		turns:    make(map[int]chan struct{}),
+	}
+	close(r.turn(0))
+	return r
+}
+
+// Process reflows the segments of chunk index, which may be processed
+// concurrently with other chunks: it blocks until all earlier chunks have
+// been processed, or until stop is closed, in which case segments are
+// returned unchanged. Every chunk index must be processed exactly once, with
+// nil segments for chunks that produced none.
+//
+// The returned segments may start with a segment held back from the previous
+// chunk and may lack the last segment of this chunk, which is held back for
+// the next one.
+func (r *Reflower) Process(index int, segments []transcriber.Segment, stop <-chan struct{}) []transcriber.Segment {
+	select {
+	case <-r.turn(index):
+	case <-stop:
+		return segments
+	}
+
+	r.mu.Lock()
+	result := r.reflow(segments)
+	delete(r.turns, index)
+	close(r.turnLocked(index + 1))
+	r.mu.Unlock()
+
+	return result
+}
+
+// Flush returns the segment still held back, if any. Call it once the last
+// chunk has been processed.
+func (r *Reflower) Flush() []transcriber.Segment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.held == nil {
+		return nil
+	}
+	held := *r.held
+	r.held = nil
+	return []transcriber.Segment{held}
+}
+
+// reflow merges the held segment into segments and holds back the new last
+// segment. It expects r.mu to be held.
+func (r *Reflower) reflow(segments []transcriber.Segment) []transcriber.Segment {
+	result := make([]transcriber.Segment, 0, len(segments)+1)
+
+	if r.held != nil {
+		held := *r.held
+		r.held = nil
+
+		if len(segments) > 0 && r.canMerge(held, segments[0]) {
+			merged := segments[0]
+			merged.Start = held.Start
+			merged.Text = strings.TrimSpace(held.Text) + " " + strings.TrimSpace(merged.Text)
+			merged.AvgLogProb = (held.AvgLogProb + merged.AvgLogProb) / 2
+			merged.NoSpeechProb = (held.NoSpeechProb + merged.NoSpeechProb) / 2
+			merged.Seek = held.Seek
+			merged.Temperature = max(held.Temperature, merged.Temperature)
+			merged.CompressionRatio = (held.CompressionRatio + merged.CompressionRatio) / 2
+			merged.SpeakerPrefix = held.SpeakerPrefix
+			segments = append([]transcriber.Segment{merged}, segments[1:]...)
+		} else {
+			result = append(result, held)
+		}
+	}
+
+	result = append(result, segments...)
+
+	// Hold back the last segment if its sentence may continue in the next chunk
+	if n := len(result); n > 0 && !endsSentence(result[n-1].Text) {
+		held := result[n-1]
+		r.held = &held
+		result = result[:n-1]
+	}
+
+	return result
+}
+
+// canMerge reports whether next continues the sentence of held
+func (r *Reflower) canMerge(held, next transcriber.Segment) bool {
+	if endsSentence(held.Text) {
+		return false
+	}
+	if next.Start-held.End > r.maxGap {
+		return false
+	}
+	// A sentence doesn't continue in another language
+	if held.OtherLanguage(next.DetectedLanguage) {
+		return false
+	}
+	// Nor with another speaker
+	if held.Speaker != next.Speaker {
+		return false
+	}
+	length := len([]rune(strings.TrimSpace(held.Text))) + 1 + len([]rune(strings.TrimSpace(next.Text)))
+	return length <= r.maxChars
+}
+
+// turn returns the channel closed once chunk index may be processed
+func (r *Reflower) turn(index int) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.turnLocked(index)
+}
+
+// turnLocked is turn for callers holding r.mu
+func (r *Reflower) turnLocked(index int) chan struct{} {
+	ch, ok := r.turns[index]
+	if !ok {
+		ch = make(chan struct{})
+		r.turns[index] = ch
+	}
+	return ch
+}
+
+// endsSentence reports whether text ends with sentence-final punctuation,
+// ignoring closing quotes and brackets
+func endsSentence(text string) bool {
+	text = strings.TrimRight(strings.TrimSpace(text), `"'”’»)]`)
+	if text == "" {
+		return true
+	}
+	last := []rune(text)[len([]rune(text))-1]
+	return strings.ContainsRune(sentenceEnders, last)
+}
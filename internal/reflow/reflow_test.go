@@ -0,0 +1,204 @@
+package reflow
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// seg is a segment with just the fields the reflower looks at
+func seg(start, end float64, text string) transcriber.Segment {
+	return transcriber.Segment{Start: start, End: end, Text: text}
+}
+
+// cue is a segment reduced to its times and text
+type cue struct {
+	Start, End float64
+	Text       string
+}
+
+// cues reduces segments to their times and text
+func cues(segments []transcriber.Segment) []cue {
+	out := make([]cue, 0, len(segments))
+	for _, s := range segments {
+		out = append(out, cue{s.Start, s.End, s.Text})
+	}
+	return out
+}
+
+func TestReflow(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]transcriber.Segment
+		// want holds the output of every chunk, then of Flush
+		want [][]cue
+	}{
+		{
+			name: "sentence split across a boundary is merged",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 4, "We arrived early."), seg(5, 9.8, "and then we went to")},
+				{seg(10, 12, "the store yesterday."), seg(13, 15, "It was closed.")},
+			},
+			want: [][]cue{
+				{{0, 4, "We arrived early."}},
+				{{5, 12, "and then we went to the store yesterday."}, {13, 15, "It was closed."}},
+				nil,
+			},
+		},
+		{
+			name: "finished sentence is not held back",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 9, "All done.")},
+				{seg(10, 12, "Next one!")},
+			},
+			want: [][]cue{
+				{{0, 9, "All done."}},
+				{{10, 12, "Next one!"}},
+				nil,
+			},
+		},
+		{
+			name: "closing quote after the punctuation ends a sentence",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 9, `He said "stop."`)},
+			},
+			want: [][]cue{
+				{{0, 9, `He said "stop."`}},
+				nil,
+			},
+		},
+		{
+			name: "gap too long keeps both",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 5, "and then")},
+				{seg(9, 12, "something else.")},
+			},
+			want: [][]cue{
+				nil,
+				{{0, 5, "and then"}, {9, 12, "something else."}},
+				nil,
+			},
+		},
+		{
+			name: "merge longer than the cue limit keeps both",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 9.9, "a rather long beginning of a sentence")},
+				{seg(10, 12, "with an even longer ending to it.")},
+			},
+			want: [][]cue{
+				nil,
+				{{0, 9.9, "a rather long beginning of a sentence"}, {10, 12, "with an even longer ending to it."}},
+				nil,
+			},
+		},
+		{
+			name: "held segment is carried over an empty chunk and flushed",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 9.9, "trailing off")},
+				nil,
+			},
+			want: [][]cue{
+				nil,
+				nil,
+				{{0, 9.9, "trailing off"}},
+			},
+		},
+		{
+			name: "CJK sentence enders",
+			chunks: [][]transcriber.Segment{
+				{seg(0, 9.9, "こんにちは。")},
+			},
+			want: [][]cue{
+				{{0, 9.9, "こんにちは。"}},
+				nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(1, 42)
+			var got [][]cue
+			for i, chunk := range tt.chunks {
+				out := r.Process(i, chunk, nil)
+				if len(out) == 0 {
+					got = append(got, nil)
+				} else {
+					got = append(got, cues(out))
+				}
+			}
+			if flushed := r.Flush(); len(flushed) == 0 {
+				got = append(got, nil)
+			} else {
+				got = append(got, cues(flushed))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReflowKeepsLanguagesAndSpeakersApart(t *testing.T) {
+	tests := []struct {
+		name       string
+		held, next transcriber.Segment
+	}{
+		{
+			name: "other language",
+			held: transcriber.Segment{Start: 0, End: 9.9, Text: "and so", DetectedLanguage: "en"},
+			next: transcriber.Segment{Start: 10, End: 11, Text: "bueno.", DetectedLanguage: "es"},
+		},
+		{
+			name: "other speaker",
+			held: transcriber.Segment{Start: 0, End: 9.9, Text: "and so", Speaker: "S1"},
+			next: transcriber.Segment{Start: 10, End: 11, Text: "right.", Speaker: "S2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(1, 100)
+			r.Process(0, []transcriber.Segment{tt.held}, nil)
+			out := r.Process(1, []transcriber.Segment{tt.next}, nil)
+			if len(out) != 2 {
+				t.Fatalf("got %v, want the segments kept apart", cues(out))
+			}
+		})
+	}
+}
+
+func TestProcessWaitsForEarlierChunks(t *testing.T) {
+	r := New(1, 100)
+
+	// Chunk 1 finishes first, but is only reflowed after chunk 0
+	done := make(chan []transcriber.Segment)
+	go func() {
+		done <- r.Process(1, []transcriber.Segment{seg(10, 12, "the end.")}, nil)
+	}()
+	select {
+	case <-done:
+		t.Fatal("chunk 1 was processed before chunk 0")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.Process(0, []transcriber.Segment{seg(0, 9.9, "this is")}, nil)
+	want := []cue{{0, 12, "this is the end."}}
+	if got := cues(<-done); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProcessGivesUpOnStop(t *testing.T) {
+	r := New(1, 100)
+	stop := make(chan struct{})
+	close(stop)
+
+	segments := []transcriber.Segment{seg(10, 12, "unfinished")}
+	// Chunk 0 never comes, so chunk 1 returns its segments unchanged
+	out := r.Process(1, segments, stop)
+	if !reflect.DeepEqual(out, segments) {
+		t.Errorf("got %v, want the segments unchanged", cues(out))
+	}
+}
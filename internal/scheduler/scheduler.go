@@ -0,0 +1,199 @@
+// Package scheduler puts a priority queue in front of the transcriber, so
+// batch work like reprocessing and ad-hoc jobs never adds latency to the live
+// stream, and background work like model comparisons never delays either.
+// Every transcription goes through it.
+package scheduler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// Priority of a transcription
+type Priority int
+
+const (
+	// Live is the priority of the chunks of the live stream
+	Live Priority = iota
+	// Batch is the priority of ad-hoc jobs and reprocessed recordings
+	Batch
+	// Background is the priority of work nobody waits for, like model
+	// comparisons. It runs one at a time, only while no other transcription
+	// is waiting or running.
+	Background
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Live:
+		return "live"
+	case Batch:
+		return "batch"
+	default:
+		return "background"
+	}
+}
+
+// Backend transcribes audio. It is implemented by *transcriber.Transcriber.
+type Backend interface {
+	TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error)
+}
+
+// Options of a scheduler
+type Options struct {
+	// Slots bounds how many transcriptions run at once, 0 for no limit,
+	// and BatchSlots how many of them may be batch work
+	Slots      int
+	BatchSlots int
+
+	// BatchSharePercent is the share of the slots batch work gets while live
+	// chunks are waiting for one. At 0 it only runs while no live chunk is
+	// waiting or in transcription; above 0 it may also run next to live
+	// chunks.
+	BatchSharePercent int
+}
+
+// QueueStatus counts the transcriptions of a priority
+type QueueStatus struct {
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+}
+
+// Status counts the transcriptions per priority
+type Status struct {
+	Live       QueueStatus `json:"live"`
+	Batch      QueueStatus `json:"batch"`
+	Background QueueStatus `json:"background"`
+}
+
+// Scheduler dispatches transcriptions by priority. Live chunks are started
+// ahead of any queued batch work; a running transcription isn't
+// interrupted.
+type Scheduler struct {
+	options Options
+
+	mu      sync.Mutex
+	queues  [3][]*waiter // Oldest first
+	running [3]int
+	credit  float64 // Slots batch work is owed while live chunks wait
+}
+
+// waiter is a transcription queued for a slot
+type waiter struct {
+	ready      chan struct{} // Closed once the slot is granted
+	dispatched bool
+}
+
+// New creates a scheduler
+func New(options Options) *Scheduler {
+	options.BatchSlots = max(options.BatchSlots, 1)
+	options.BatchSharePercent = min(max(options.BatchSharePercent, 0), 100)
+	return &Scheduler{options: options}
+}
+
+// Transcribe transcribes audio with backend once a slot of priority is
+// free, waiting until ctx is done
+func (s *Scheduler) Transcribe(ctx context.Context, priority Priority, backend Backend, tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error) {
+	release, err := s.Acquire(ctx, priority)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return backend.TranscribeAudioFallback(tempDir, audioBytes, format, lang, fallback)
+}
+
+// Acquire waits until ctx is done for a slot of priority. The returned
+// function releases the slot.
+func (s *Scheduler) Acquire(ctx context.Context, priority Priority) (func(), error) {
+	w := &waiter{ready: make(chan struct{})}
+
+	s.mu.Lock()
+	s.queues[priority] = append(s.queues[priority], w)
+	s.dispatch()
+	s.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.running[priority]--
+			s.dispatch()
+		})
+	}
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	dispatched := w.dispatched
+	if !dispatched {
+		for i, queued := range s.queues[priority] {
+			if queued == w {
+				s.queues[priority] = append(s.queues[priority][:i:i], s.queues[priority][i+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if dispatched {
+		release()
+	}
+	return nil, ctx.Err()
+}
+
+// dispatch starts queued transcriptions while slots are free; the caller
+// must hold s.mu
+func (s *Scheduler) dispatch() {
+	share := float64(s.options.BatchSharePercent) / 100
+	for s.options.Slots == 0 || s.running[Live]+s.running[Batch]+s.running[Background] < s.options.Slots {
+		live := len(s.queues[Live]) > 0
+		batch := len(s.queues[Batch]) > 0 && s.running[Batch] < s.options.BatchSlots
+		background := len(s.queues[Background]) > 0 && s.running[Background] == 0 &&
+			len(s.queues[Live])+len(s.queues[Batch])+s.running[Live]+s.running[Batch] == 0
+
+		var next Priority
+		switch {
+		case live && batch:
+			// Batch work is owed share of the slots freed while both wait
+			s.credit += share
+			next = Live
+			if s.credit >= 1 {
+				s.credit--
+				next = Batch
+			}
+		case live:
+			next = Live
+		case batch && (s.running[Live] == 0 || share > 0):
+			next = Batch
+		case background:
+			next = Background
+		default:
+			return
+		}
+
+		w := s.queues[next][0]
+		s.queues[next] = s.queues[next][1:]
+		s.running[next]++
+		w.dispatched = true
+		close(w.ready)
+	}
+}
+
+// Status returns the number of queued and running transcriptions per
+// priority
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{
+		Live:       QueueStatus{Queued: len(s.queues[Live]), Running: s.running[Live]},
+		Batch:      QueueStatus{Queued: len(s.queues[Batch]), Running: s.running[Batch]},
+		Background: QueueStatus{Queued: len(s.queues[Background]), Running: s.running[Background]},
+	}
+}
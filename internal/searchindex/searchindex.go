@@ -0,0 +1,198 @@
+// Package searchindex keeps the segments of every session in a SQLite
+// database with a full-text index, so transcripts can be searched across
+// sessions without reading their files. The database is written through the
+// pure-Go driver, so it needs no cgo.
+package searchindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the segments table and its full-text index, which the
+// writes keep in step within the same transaction
+const schema = `
+CREATE TABLE IF NOT EXISTS segments (
+	id          INTEGER PRIMARY KEY,
+	session     TEXT NOT NULL,
+	chunk       INTEGER NOT NULL,
+	start       REAL NOT NULL,
+	end         REAL NOT NULL,
+	at          INTEGER NOT NULL,
+	lang        TEXT NOT NULL,
+	text        TEXT NOT NULL,
+	translation TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS segments_session ON segments (session);
+CREATE INDEX IF NOT EXISTS segments_at ON segments (at);
+CREATE VIRTUAL TABLE IF NOT EXISTS segments_fts USING fts5 (
+	text, translation,
+	content = 'segments', content_rowid = 'id',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+`
+
+// ErrEmptyQuery is returned by Search for a query without any words
+var ErrEmptyQuery = errors.New("empty search query")
+
+// DefaultLimit is how many matches Search returns without a limit
+const DefaultLimit = 50
+
+// Segment is a segment of a session. Start and End are relative to the start
+// of the stream, At is when the segment started.
+type Segment struct {
+	Session     string    `json:"session"`
+	Chunk       int       `json:"chunk"`
+	Start       float64   `json:"start"`
+	End         float64   `json:"end"`
+	At          time.Time `json:"at"`
+	Lang        string    `json:"lang"` // Language of the captions
+	Text        string    `json:"text"` // Text as transcribed
+	Translation string    `json:"translation,omitempty"`
+}
+
+// Query selects the segments to search. From and To limit when the segments
+// started, either may be zero.
+type Query struct {
+	Text  string
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// Index is the search index
+type Index struct {
+	db *sql.DB
+}
+
+// Open opens the index at path, creating it if needed
+func Open(path string) (*Index, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcript index: %w", err)
+	}
+	// Writes are serialized anyway, and one connection avoids "database is
+	// locked" errors between them
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA journal_mode = WAL; PRAGMA busy_timeout = 5000;" + schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create transcript index: %w", err)
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the index
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+// Add adds segments in one transaction, which is what makes indexing a whole
+// chunk at once cheap
+func (i *Index) Add(segments []Segment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to index segments: %w", err)
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO segments (session, chunk, start, end, at, lang, text, translation) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to index segments: %w", err)
+	}
+	defer insert.Close()
+	insertText, err := tx.Prepare(`INSERT INTO segments_fts (rowid, text, translation) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to index segments: %w", err)
+	}
+	defer insertText.Close()
+
+	for _, segment := range segments {
+		result, err := insert.Exec(segment.Session, segment.Chunk, segment.Start, segment.End, segment.At.UnixMilli(), segment.Lang, segment.Text, segment.Translation)
+		if err != nil {
+			return fmt.Errorf("failed to index segment: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to index segment: %w", err)
+		}
+		if _, err := insertText.Exec(id, segment.Text, segment.Translation); err != nil {
+			return fmt.Errorf("failed to index segment text: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to index segments: %w", err)
+	}
+	return nil
+}
+
+// Search returns the segments matching all words of the query, in its text
+// or translation, best matches first
+func (i *Index) Search(ctx context.Context, query Query) ([]Segment, error) {
+	match := matchExpression(query.Text)
+	if match == "" {
+		return nil, ErrEmptyQuery
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	sqlQuery := `SELECT s.session, s.chunk, s.start, s.end, s.at, s.lang, s.text, s.translation
+		FROM segments_fts JOIN segments s ON s.id = segments_fts.rowid
+		WHERE segments_fts MATCH ?`
+	args := []any{match}
+	if !query.From.IsZero() {
+		sqlQuery += ` AND s.at >= ?`
+		args = append(args, query.From.UnixMilli())
+	}
+	if !query.To.IsZero() {
+		sqlQuery += ` AND s.at < ?`
+		args = append(args, query.To.UnixMilli())
+	}
+	sqlQuery += ` ORDER BY rank LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := i.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search transcripts: %w", err)
+	}
+	defer rows.Close()
+
+	segments := []Segment{}
+	for rows.Next() {
+		var segment Segment
+		var at int64
+		if err := rows.Scan(&segment.Session, &segment.Chunk, &segment.Start, &segment.End, &at, &segment.Lang, &segment.Text, &segment.Translation); err != nil {
+			return nil, fmt.Errorf("failed to read search result: %w", err)
+		}
+		segment.At = time.UnixMilli(at).UTC()
+		segments = append(segments, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search transcripts: %w", err)
+	}
+	return segments, nil
+}
+
+// matchExpression turns the words of a query into an FTS5 expression
+// matching all of them. Every word is quoted, so nothing in a query is taken
+// for FTS5 syntax.
+func matchExpression(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
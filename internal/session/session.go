@@ -0,0 +1,477 @@
+// Package session manages the output directory and summary of a single
+// stream session. Every session gets its own directory,
+// OutputDir/<stream-key>/<start-timestamp>/, holding all of its deliverables.
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/procs"
+	"github.com/ben/transcription-proxy/internal/version"
+)
+
+// ErrNotFound is returned when no session matches the requested id
+var ErrNotFound = errors.New("session not found")
+
+// SummaryFile is the name of the session summary inside the session directory
+const SummaryFile = "session.json"
+
+// RecordingFile is the name of the recording of the incoming stream
+const RecordingFile = "recording.flv"
+
+// FinalFile is the name of the recording remuxed with the session subtitles
+const FinalFile = "final.mp4"
+
+// timestampLayout formats session start times in directory and file names
+const timestampLayout = "20060102-150405"
+
+// unsafeKeyChars matches characters not allowed in stream key directory names
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Summary is the machine-readable record of a session, written to SummaryFile
+type Summary struct {
+	ID         string     `json:"id"`
+	StreamKey  string     `json:"stream_key"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	Mode       string     `json:"mode"`
+	SourceLang string     `json:"source_lang"`
+	TargetLang string     `json:"target_lang"`
+	Files      []string   `json:"files"`
+
+	// SubtitleTracks names the subtitle file of each caption language, if
+	// the captions were translated into several
+	SubtitleTracks map[string]string `json:"subtitle_tracks,omitempty"`
+
+	// Build is the build of the proxy that ran the session and the versions
+	// of its tools
+	Build *version.Info `json:"build,omitempty"`
+
+	// LanguageChanges records languages switched while the session ran
+	LanguageChanges []LanguageChange `json:"language_changes,omitempty"`
+
+	// TranslationDegraded is set when translation was given up on after
+	// repeated failures
+	TranslationDegraded bool `json:"translation_degraded"`
+
+	// Codecs are the codecs of the incoming stream, once detected
+	Codecs Codecs `json:"codecs"`
+
+	// AudioTrack is the audio track of the stream that was transcribed
+	AudioTrack int `json:"audio_track"`
+
+	// Publisher describes the client that published the stream
+	Publisher *Publisher `json:"publisher,omitempty"`
+
+	// EndReason is set when the proxy ended the stream rather than the
+	// publisher, e.g. EndIdle
+	EndReason string `json:"end_reason,omitempty"`
+
+	// FinalMux reports the post-session remux into FinalFile, if any
+	FinalMux *MuxStatus `json:"final_mux,omitempty"`
+
+	// Reprocessed lists the reruns of the recording with different settings
+	Reprocessed []Reprocess `json:"reprocessed,omitempty"`
+
+	// FailedChunks lists the directories, relative to the session
+	// directory, holding the chunks that failed transcription or embedding
+	FailedChunks []string `json:"failed_chunks,omitempty"`
+
+	// Processes lists the child processes that ran during the session, as
+	// far as the process registry still knew them when it ended
+	Processes []procs.Info `json:"processes,omitempty"`
+
+	// Upload reports the upload of the session files to object storage, if
+	// enabled
+	Upload *UploadStatus `json:"upload,omitempty"`
+}
+
+// Publisher is the client that published a stream and what it announced
+type Publisher struct {
+	Address     string    `json:"address,omitempty"` // Empty if it couldn't be determined
+	ConnectedAt time.Time `json:"connected_at"`
+
+	// Reconnects counts how often the publisher disconnected and came back
+	// within SESSION_RESUME_WINDOW, continuing the session
+	Reconnects int `json:"reconnects"`
+
+	// Metadata holds the onMetaData properties of the stream, such as
+	// width, framerate, and encoder
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// Reasons the proxy ends a stream
+const (
+	EndMaxDuration = "max_duration" // The stream ran longer than allowed
+	EndIdle        = "idle"         // The stream was silent with a frozen picture
+	EndFailed      = "failed"       // Processing the stream failed, e.g. a task panicked
+)
+
+// Post-session remux states
+const (
+	MuxRunning = "running"
+	MuxDone    = "done"
+	MuxFailed  = "failed"
+)
+
+// MuxStatus is the progress of the post-session remux
+type MuxStatus struct {
+	Status     string     `json:"status"`
+	Progress   float64    `json:"progress_seconds"` // Media time written so far
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Upload states. A pending upload is finished by the upload command.
+const (
+	UploadRunning = "running"
+	UploadDone    = "done"
+	UploadPending = "pending"
+)
+
+// UploadStatus is the upload of the session files once the session ended
+type UploadStatus struct {
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Manifest   string     `json:"manifest,omitempty"` // Key of the manifest object
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
+	// LocalDeleted is set once the uploaded files were deleted locally
+	LocalDeleted bool `json:"local_deleted,omitempty"`
+}
+
+// Reprocess states
+const (
+	ReprocessQueued  = "queued"
+	ReprocessRunning = "running"
+	ReprocessDone    = "done"
+	ReprocessFailed  = "failed"
+)
+
+// ReprocessOptions override the settings a session is reprocessed with.
+// Empty fields keep the settings of the session or the server.
+type ReprocessOptions struct {
+	ModelSize      string `json:"model_size,omitempty"`
+	SourceLang     string `json:"source_lang,omitempty"`
+	TargetLang     string `json:"target_lang,omitempty"`
+	SubtitleFormat string `json:"subtitle_format,omitempty"` // srt or vtt
+	MaxColumns     int    `json:"max_columns,omitempty"`     // Caption line width
+	AudioTrack     *int   `json:"audio_track,omitempty"`     // Audio track of the recording, counting from 0
+}
+
+// Reprocess is a rerun of the offline pipeline over the session recording.
+// Its files are written to the subdirectory named by ID.
+type Reprocess struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Options    ReprocessOptions `json:"options"`
+	Progress   float64          `json:"progress_seconds"` // Recording time processed so far
+	Duration   float64          `json:"duration_seconds"` // Of the recording, zero if unknown
+	ETA        float64          `json:"eta_seconds,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Files      []string         `json:"files"`
+	QueuedAt   time.Time        `json:"queued_at"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+
+	// TranslationFailed is set when some captions were left untranslated
+	TranslationFailed bool `json:"translation_failed,omitempty"`
+}
+
+// Codecs describes the codecs of the incoming stream
+type Codecs struct {
+	Video string `json:"video,omitempty"` // Empty for audio-only streams
+	Audio string `json:"audio,omitempty"`
+	// Transcoded is set when the video is transcoded to H.264 because a
+	// target doesn't accept the incoming codec
+	Transcoded bool `json:"transcoded"`
+}
+
+// LanguageChange is a switch of the source or target language mid-session
+type LanguageChange struct {
+	At         time.Time `json:"at"`
+	SourceLang string    `json:"source_lang"`
+	TargetLang string    `json:"target_lang"`
+	ExtraLangs []string  `json:"extra_langs,omitempty"`
+}
+
+// Session is an active stream session
+type Session struct {
+	mu      sync.Mutex
+	dir     string
+	summary Summary
+}
+
+// New creates the directory for a session of streamKey starting at startedAt.
+// An empty outputDir keeps the session in memory only, for when artifacts
+// are disabled.
+func New(outputDir, streamKey string, startedAt time.Time) (*Session, error) {
+	key := SanitizeKey(streamKey)
+	timestamp := startedAt.Format(timestampLayout)
+
+	var dir string
+	if outputDir != "" {
+		dir = filepath.Join(outputDir, key, timestamp)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create session directory: %w", err)
+		}
+	}
+
+	return &Session{
+		dir: dir,
+		summary: Summary{
+			ID:        key + "-" + timestamp,
+			StreamKey: key,
+			StartedAt: startedAt,
+			Files:     []string{},
+		},
+	}, nil
+}
+
+// Open returns the session of an entry found on disk, to update its summary
+func Open(entry Entry) *Session {
+	return &Session{dir: entry.Dir, summary: entry.Summary}
+}
+
+// SanitizeKey makes a stream key safe to use as a directory name. Leading
+// dots are stripped so keys can never name hidden directories such as the
+// temp root.
+func SanitizeKey(key string) string {
+	key = strings.TrimLeft(unsafeKeyChars.ReplaceAllString(key, "_"), ".")
+	if key == "" {
+		return "stream"
+	}
+	return key
+}
+
+// ID returns the session identifier
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.summary.ID
+}
+
+// Dir returns the session directory, empty for a session kept in memory
+func (s *Session) Dir() string {
+	return s.dir
+}
+
+// FileName expands a filename template for this session. The placeholders
+// {key}, {date}, and {lang} are replaced with the stream key, the session
+// start timestamp, and lang.
+func (s *Session) FileName(template, lang string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replacer := strings.NewReplacer(
+		"{key}", s.summary.StreamKey,
+		"{date}", s.summary.StartedAt.Format(timestampLayout),
+		"{lang}", lang,
+	)
+	return SanitizeKey(replacer.Replace(template))
+}
+
+// AddFile records a file in the session directory as a session deliverable
+func (s *Session) AddFile(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary.Files = append(s.summary.Files, name)
+}
+
+// Update changes the summary under the session lock
+func (s *Session) Update(fn func(*Summary)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.summary)
+}
+
+// Summary returns a copy of the current summary
+func (s *Session) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := s.summary
+	summary.Files = append([]string(nil), s.summary.Files...)
+	summary.LanguageChanges = append([]LanguageChange(nil), s.summary.LanguageChanges...)
+	summary.FailedChunks = append([]string(nil), s.summary.FailedChunks...)
+	if s.summary.FinalMux != nil {
+		finalMux := *s.summary.FinalMux
+		summary.FinalMux = &finalMux
+	}
+	if s.summary.Publisher != nil {
+		// Metadata is replaced rather than modified, so it can be shared
+		publisher := *s.summary.Publisher
+		summary.Publisher = &publisher
+	}
+	summary.Reprocessed = make([]Reprocess, 0, len(s.summary.Reprocessed))
+	for _, reprocess := range s.summary.Reprocessed {
+		reprocess.Files = append([]string(nil), reprocess.Files...)
+		summary.Reprocessed = append(summary.Reprocessed, reprocess)
+	}
+	if len(summary.Reprocessed) == 0 {
+		summary.Reprocessed = nil
+	}
+	return summary
+}
+
+// AddReprocess creates the directory for a rerun of the session and records
+// it as queued. The directory is named after the current time.
+func (s *Session) AddReprocess(options ReprocessOptions) (Reprocess, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	base := "reprocess-" + now.Format(timestampLayout)
+	id, dir := base, filepath.Join(s.dir, base)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return Reprocess{}, "", fmt.Errorf("failed to create reprocess directory: %w", err)
+		}
+		// Reruns started within the same second get a suffix
+		id = fmt.Sprintf("%s-%d", base, n)
+		dir = filepath.Join(s.dir, id)
+	}
+
+	reprocess := Reprocess{
+		ID:       id,
+		Status:   ReprocessQueued,
+		Options:  options,
+		Files:    []string{},
+		QueuedAt: now,
+	}
+	s.summary.Reprocessed = append(s.summary.Reprocessed, reprocess)
+	return reprocess, dir, nil
+}
+
+// UpdateReprocess changes the rerun with the given id under the session lock
+func (s *Session) UpdateReprocess(id string, fn func(*Reprocess)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.summary.Reprocessed {
+		if s.summary.Reprocessed[i].ID == id {
+			fn(&s.summary.Reprocessed[i])
+			return
+		}
+	}
+}
+
+// WriteSummary atomically writes the summary to SummaryFile. It does nothing
+// for a session kept in memory.
+func (s *Session) WriteSummary() error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.Summary(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session summary: %w", err)
+	}
+
+	path := filepath.Join(s.dir, SummaryFile)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session summary: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write session summary: %w", err)
+	}
+
+	return nil
+}
+
+// End marks the session as ended and writes the final summary
+func (s *Session) End(endedAt time.Time) error {
+	s.Update(func(summary *Summary) {
+		summary.EndedAt = &endedAt
+	})
+	return s.WriteSummary()
+}
+
+// Entry is a session found on disk
+type Entry struct {
+	Summary
+	Dir string `json:"-"`
+}
+
+// File returns the path of the first session file with the given extension
+func (e Entry) File(ext string) (string, bool) {
+	for _, name := range e.Files {
+		// Only plain file names inside the session directory are served
+		if filepath.Base(name) != name || filepath.Ext(name) != ext {
+			continue
+		}
+		return filepath.Join(e.Dir, name), true
+	}
+	return "", false
+}
+
+// Track returns the path of the subtitle track of the session in lang, if
+// it has one with the given extension
+func (e Entry) Track(lang, ext string) (string, bool) {
+	name, ok := e.SubtitleTracks[strings.ToLower(lang)]
+	if !ok || filepath.Base(name) != name || filepath.Ext(name) != ext {
+		return "", false
+	}
+	return filepath.Join(e.Dir, name), true
+}
+
+// List returns every session below outputDir, newest first
+func List(outputDir string) ([]Entry, error) {
+	matches, err := filepath.Glob(filepath.Join(outputDir, "*", "*", SummaryFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(matches))
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var summary Summary
+		if err := json.Unmarshal(data, &summary); err != nil || summary.ID == "" {
+			continue
+		}
+
+		entries = append(entries, Entry{Summary: summary, Dir: filepath.Dir(path)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartedAt.After(entries[j].StartedAt)
+	})
+
+	return entries, nil
+}
+
+// Find returns the session with the given id. The id is only ever compared
+// against the index, never used to build a path.
+func Find(outputDir, id string) (Entry, error) {
+	entries, err := List(outputDir)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+
+	return Entry{}, ErrNotFound
+}
@@ -0,0 +1,178 @@
+// Package sessionlog copies the log lines of one session into a file in its
+// directory, so a streamer can be handed their own log without grepping the
+// shared output.
+package sessionlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ben/transcription-proxy/internal/logdedup"
+	"github.com/sirupsen/logrus"
+)
+
+// FileName is the name of the log file in the session directory
+const FileName = "session.log"
+
+// hooksMu serializes attaching and detaching hooks, which replace the hooks
+// of a logger shared by all sessions
+var hooksMu sync.Mutex
+
+// Hook is a logrus hook writing the entries whose field matches a session to
+// that session's log file. Once the file grows beyond the maximum size it is
+// rotated to session.log.1, session.log.2 and so on, keeping at most
+// maxFiles of them.
+type Hook struct {
+	field     string
+	value     string
+	formatter logrus.Formatter
+	path      string
+	maxSize   int64
+	maxFiles  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open creates the log file in dir for the entries with field set to value,
+// formatted by formatter. A maxSize of zero never rotates the file.
+func Open(dir, field, value string, formatter logrus.Formatter, maxSize int64, maxFiles int) (*Hook, error) {
+	h := &Hook{
+		field:     field,
+		value:     value,
+		formatter: formatter,
+		path:      filepath.Join(dir, FileName),
+		maxSize:   maxSize,
+		maxFiles:  maxFiles,
+	}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open opens the log file for appending
+func (h *Hook) open() error {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open session log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat session log: %w", err)
+	}
+	h.file = file
+	h.size = info.Size()
+	return nil
+}
+
+// Levels returns all levels, the logger's level already filters entries
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire writes entry to the log file if it belongs to the session
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	if value, ok := entry.Data[h.field]; !ok || fmt.Sprint(value) != h.value {
+		return nil
+	}
+	// The file already has every entry the summary stands for
+	if _, ok := entry.Data[logdedup.RepeatedKey]; ok {
+		return nil
+	}
+
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return fmt.Errorf("failed to format session log entry: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	if h.maxSize > 0 && h.size > 0 && h.size+int64(len(line)) > h.maxSize {
+		if err := h.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := h.file.Write(line)
+	h.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write session log: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, moves the
+// log file to session.log.1 and starts a new one
+func (h *Hook) rotate() error {
+	if err := h.file.Close(); err != nil {
+		return fmt.Errorf("failed to close session log: %w", err)
+	}
+	h.file = nil
+
+	if h.maxFiles <= 0 {
+		if err := os.Remove(h.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove session log: %w", err)
+		}
+		return h.open()
+	}
+
+	os.Remove(rotatedPath(h.path, h.maxFiles))
+	for i := h.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(h.path, i), rotatedPath(h.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate session log: %w", err)
+		}
+	}
+	if err := os.Rename(h.path, rotatedPath(h.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate session log: %w", err)
+	}
+	return h.open()
+}
+
+// rotatedPath returns the path of the n-th rotated file
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Attach adds the hook to logger
+func (h *Hook) Attach(logger *logrus.Logger) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	logger.AddHook(h)
+}
+
+// Detach removes the hook from logger and closes the log file. Entries
+// logged concurrently may still reach the hook and are dropped.
+func (h *Hook) Detach(logger *logrus.Logger) error {
+	hooksMu.Lock()
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range logger.Hooks {
+		for _, hook := range levelHooks {
+			if hook != logrus.Hook(h) {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	logger.ReplaceHooks(hooks)
+	hooksMu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close session log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+// Package speaker tells apart who is speaking from the sound of their voice,
+// to label the segments of a stream S1, S2, ... and mark where the speaker
+// changes. It is a lightweight heuristic rather than diarization: every
+// segment is compared with the voice of the current speaker, so it works best
+// for a few people taking turns who sound clearly different.
+package speaker
+
+import (
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// Detector computes voice prints of audio. Spectral is the built-in one; a
+// speaker embedding model can take its place.
+type Detector interface {
+	// Embed returns the voice print of mono samples in [-1, 1], or false if
+	// they hold too little speech to tell
+	Embed(samples []float64, sampleRate int) ([]float64, bool)
+	// Distance returns how different two voice prints sound. The threshold
+	// of a Tracker is in its units.
+	Distance(a, b []float64) float64
+}
+
+// Options configure a Tracker
+type Options struct {
+	// Threshold is the distance from the voice of the current speaker above
+	// which a segment is taken to be spoken by someone else
+	Threshold float64
+	// MaxSpeakers bounds the number of labels; once every label is taken,
+	// a change goes to the speaker who sounds closest
+	MaxSpeakers int
+	// Prefix is put in front of the captions where the speaker changes,
+	// followed by a space, with {speaker} standing for the label. Empty
+	// keeps the labels out of the captions.
+	Prefix string
+}
+
+// profileWeight is how much a new segment moves the voice profile of its
+// speaker
+const profileWeight = 0.3
+
+// Tracker labels the speakers of the segments of consecutive chunks
+type Tracker struct {
+	detector Detector
+	options  Options
+
+	mu       sync.Mutex
+	turns    map[int]chan struct{}
+	profiles [][]float64 // Voice of each speaker, S1 first
+	current  int         // Index of the current speaker, -1 before the first
+}
+
+// NewTracker creates a tracker comparing voices with detector, Spectral if
+// nil
+func NewTracker(detector Detector, options Options) *Tracker {
+	if detector == nil {
+		detector = Spectral{}
+	}
+	options.MaxSpeakers = max(options.MaxSpeakers, 1)
+	t := &Tracker{
+		detector: detector,
+		options:  options,
+		turns:    make(map[int]chan struct{}),
+		current:  -1,
+	}
+	close(t.turn(0))
+	return t
+}
+
+// Label labels the stream-relative segments of chunk index from pcm, the
+// 16-bit audio of the chunk, which starts offset seconds into the stream.
+// Chunks may be labeled concurrently: it blocks until all earlier chunks have
+// been labeled, or until stop is closed, in which case segments are returned
+// unlabeled. Every chunk index must be labeled exactly once, with nil
+// segments for chunks that produced none.
+func (t *Tracker) Label(index int, segments []transcriber.Segment, pcm []byte, format audio.Format, offset float64, stop <-chan struct{}) []transcriber.Segment {
+	select {
+	case <-t.turn(index):
+	case <-stop:
+		return segments
+	}
+
+	// Voice prints don't depend on earlier chunks, so they are computed
+	// before taking the lock
+	voices := make([][]float64, len(segments))
+	for i, segment := range segments {
+		samples := segmentSamples(pcm, format, segment.Start-offset, segment.End-offset)
+		if voice, ok := t.detector.Embed(samples, format.SampleRate); ok {
+			voices[i] = voice
+		}
+	}
+
+	t.mu.Lock()
+	labeled := make([]transcriber.Segment, len(segments))
+	for i, segment := range segments {
+		labeled[i] = t.label(segment, voices[i])
+	}
+	delete(t.turns, index)
+	close(t.turnLocked(index + 1))
+	t.mu.Unlock()
+
+	return labeled
+}
+
+// label labels a segment with its voice print, nil if it couldn't be
+// computed. It expects t.mu to be held.
+func (t *Tracker) label(segment transcriber.Segment, voice []float64) transcriber.Segment {
+	previous := t.current
+	switch {
+	case voice == nil && t.current < 0:
+		// Too little speech to tell, so the first speaker it is
+		t.current = 0
+		t.profiles = append(t.profiles, nil)
+	case voice == nil:
+		// Too little speech to tell, so the speaker is taken to go on
+	case t.current < 0:
+		t.current = 0
+		t.profiles = append(t.profiles, voice)
+	case t.profiles[t.current] == nil || t.detector.Distance(t.profiles[t.current], voice) <= t.options.Threshold:
+		t.update(t.current, voice)
+	default:
+		t.current = t.speakerOf(voice)
+		t.update(t.current, voice)
+	}
+
+	segment.Speaker = Label(t.current)
+	segment.SpeakerPrefix = ""
+	if previous >= 0 && t.current != previous && t.options.Prefix != "" {
+		segment.SpeakerPrefix = strings.ReplaceAll(t.options.Prefix, "{speaker}", segment.Speaker) + " "
+	}
+	return segment
+}
+
+// speakerOf returns the index of the speaker other than the current one
+// who sounds like voice: the closest known one within the threshold, a new
+// one while labels are left, or else the closest one
+func (t *Tracker) speakerOf(voice []float64) int {
+	closest, closestDistance := -1, math.Inf(1)
+	for i, profile := range t.profiles {
+		if i == t.current || profile == nil {
+			continue
+		}
+		if distance := t.detector.Distance(profile, voice); distance < closestDistance {
+			closest, closestDistance = i, distance
+		}
+	}
+
+	if closestDistance <= t.options.Threshold {
+		return closest
+	}
+	if len(t.profiles) < t.options.MaxSpeakers {
+		t.profiles = append(t.profiles, nil)
+		return len(t.profiles) - 1
+	}
+	if closest < 0 {
+		// A single label, or no other speaker heard yet
+		return t.current
+	}
+	return closest
+}
+
+// update moves the voice profile of speaker towards voice
+func (t *Tracker) update(speaker int, voice []float64) {
+	if voice == nil {
+		return
+	}
+	profile := t.profiles[speaker]
+	if profile == nil {
+		t.profiles[speaker] = voice
+		return
+	}
+	for i := range profile {
+		profile[i] += profileWeight * (voice[i] - profile[i])
+	}
+}
+
+// turn returns the channel closed once chunk index may be labeled
+func (t *Tracker) turn(index int) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.turnLocked(index)
+}
+
+// turnLocked is turn for callers holding t.mu
+func (t *Tracker) turnLocked(index int) chan struct{} {
+	ch, ok := t.turns[index]
+	if !ok {
+		ch = make(chan struct{})
+		t.turns[index] = ch
+	}
+	return ch
+}
+
+// Label returns the label of the speaker with index i, S1 for the first
+func Label(i int) string {
+	return "S" + strconv.Itoa(i+1)
+}
+
+// Prefixed returns the segments with their speaker prefixes put in front of
+// their text
+func Prefixed(segments []transcriber.Segment) []transcriber.Segment {
+	prefixed := make([]transcriber.Segment, len(segments))
+	for i, segment := range segments {
+		prefixed[i] = segment
+		prefixed[i].Text = segment.SpeakerPrefix + segment.Text
+	}
+	return prefixed
+}
+
+// segmentSamples returns the mono samples of pcm between start and end
+// seconds, mixing down the channels
+func segmentSamples(pcm []byte, format audio.Format, start, end float64) []float64 {
+	frameSize := format.FrameSize()
+	if frameSize == 0 || format.BitsPerSample != 16 {
+		return nil
+	}
+	frames := len(pcm) / frameSize
+	from := min(max(int(start*float64(format.SampleRate)), 0), frames)
+	to := min(max(int(end*float64(format.SampleRate)), from), frames)
+
+	samples := make([]float64, to-from)
+	for i := range samples {
+		frame := pcm[(from+i)*frameSize:]
+		var sum float64
+		for c := 0; c < format.Channels; c++ {
+			sum += float64(int16(binary.LittleEndian.Uint16(frame[2*c:])))
+		}
+		samples[i] = sum / float64(format.Channels) / math.MaxInt16
+	}
+	return samples
+}
+
+// Parameters of Spectral
+const (
+	frameMillis     = 32
+	spectralBands   = 16
+	minBandHz       = 100
+	maxBandHz       = 7000
+	voicedDB        = -50 // Frames quieter than this are skipped
+	minVoicedFrames = 20  // About a third of a second of speech
+	loudnessWeight  = 0.25
+)
+
+// Spectral is a Detector comparing the average spectral envelope of the
+// speech, in decibels per band relative to its overall level, and its
+// loudness. The distance is the RMS difference of the bands in dB plus a
+// quarter of the difference in loudness, since loudness changes with the
+// microphone as much as with the speaker.
+type Spectral struct{}
+
+// Embed returns the band levels of the envelope followed by the loudness
+func (Spectral) Embed(samples []float64, sampleRate int) ([]float64, bool) {
+	if sampleRate <= 0 {
+		return nil, false
+	}
+	size := 1
+	for size < sampleRate*frameMillis/1000 {
+		size *= 2
+	}
+	hop := size / 2
+	edges := bandEdges(size, sampleRate)
+
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size-1))
+	}
+
+	voice := make([]float64, spectralBands+1)
+	bands := make([]float64, spectralBands)
+	spectrum := make([]complex128, size)
+	voiced := 0
+	for start := 0; start+size <= len(samples); start += hop {
+		frame := samples[start : start+size]
+
+		var energy float64
+		for _, sample := range frame {
+			energy += sample * sample
+		}
+		level := 10 * math.Log10(energy/float64(size)+1e-12)
+		if level < voicedDB {
+			continue
+		}
+
+		for i, sample := range frame {
+			spectrum[i] = complex(sample*window[i], 0)
+		}
+		fft(spectrum)
+
+		var mean float64
+		for b := range bands {
+			var power float64
+			for k := edges[b]; k < edges[b+1]; k++ {
+				power += real(spectrum[k])*real(spectrum[k]) + imag(spectrum[k])*imag(spectrum[k])
+			}
+			bands[b] = 10 * math.Log10(power/float64(max(edges[b+1]-edges[b], 1))+1e-12)
+			mean += bands[b]
+		}
+		mean /= spectralBands
+
+		for b := range bands {
+			voice[b] += bands[b] - mean
+		}
+		voice[spectralBands] += level
+		voiced++
+	}
+
+	if voiced < minVoicedFrames {
+		return nil, false
+	}
+	for i := range voice {
+		voice[i] /= float64(voiced)
+	}
+	return voice, true
+}
+
+// Distance returns the RMS difference of the bands in dB plus a share of the
+// difference in loudness
+func (Spectral) Distance(a, b []float64) float64 {
+	if len(a) != spectralBands+1 || len(b) != spectralBands+1 {
+		return math.Inf(1)
+	}
+	var sum float64
+	for i := 0; i < spectralBands; i++ {
+		sum += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return math.Sqrt(sum/spectralBands) + loudnessWeight*math.Abs(a[spectralBands]-b[spectralBands])
+}
+
+// bandEdges returns the first FFT bin of each band and the end of the last,
+// spaced logarithmically between minBandHz and maxBandHz, or the Nyquist
+// frequency if lower. Bands get at least one bin below the Nyquist frequency.
+func bandEdges(size, sampleRate int) []int {
+	binHz := float64(sampleRate) / float64(size)
+	high := min(float64(maxBandHz), float64(sampleRate)/2)
+	edges := make([]int, spectralBands+1)
+	for b := range edges {
+		hz := minBandHz * math.Pow(high/minBandHz, float64(b)/spectralBands)
+		edges[b] = int(hz / binHz)
+		if b > 0 && edges[b] <= edges[b-1] {
+			edges[b] = edges[b-1] + 1
+		}
+		edges[b] = min(edges[b], size/2)
+	}
+	return edges
+}
+
+// fft transforms x in place; its length must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for length := 2; length <= n; length <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(length)))
+		for start := 0; start < n; start += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				even, odd := x[start+k], x[start+k+length/2]*w
+				x[start+k] = even + odd
+				x[start+k+length/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package spool holds queued chunk data in memory up to a threshold and
+// spills the rest to numbered files, so a stalled pipeline doesn't exhaust
+// memory. Spilled data is read back when the chunk is taken off the queue.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrDropped is returned when taking a chunk that was dropped to keep the
+// spool within its size cap
+var ErrDropped = errors.New("spooled chunk dropped")
+
+// Spooled files are written under partExt and renamed to chunkExt once
+// complete, so a crash never leaves a partial file that looks complete
+const (
+	chunkExt = ".chunk"
+	partExt  = ".part"
+)
+
+// Stats counts the chunks queued in memory and on disk
+type Stats struct {
+	MemoryChunks int    `json:"memory_chunks"`
+	MemoryBytes  int64  `json:"memory_bytes"`
+	DiskChunks   int    `json:"disk_chunks"`
+	DiskBytes    int64  `json:"disk_bytes"`
+	Dropped      uint64 `json:"dropped"` // Chunks dropped to stay within the size cap
+}
+
+// Spool tracks the data of queued chunks
+type Spool struct {
+	dir         string
+	memoryLimit int64 // Zero holds everything in memory
+	diskLimit   int64 // Zero never drops
+	logger      *logrus.Entry
+
+	mu       sync.Mutex
+	seq      uint64
+	onDisk   []*Chunk // Oldest first
+	stats    Stats
+	spilling bool // Whether the last chunk went to disk, to log transitions
+}
+
+// Chunk is the data of a queued chunk, in memory or in a spool file
+type Chunk struct {
+	spool *Spool
+	seq   uint64
+	size  int64
+
+	// Guarded by spool.mu
+	data    []byte
+	path    string
+	taken   bool
+	dropped bool
+}
+
+// New creates a spool writing to dir, which is created and cleared of files
+// left by an earlier run. Once memoryLimit bytes are queued in memory, further
+// chunks go to disk; once diskLimit bytes are on disk, the oldest spooled
+// chunks are dropped.
+func New(dir string, memoryLimit, diskLimit int64, logger *logrus.Entry) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	for _, pattern := range []string{"*" + chunkExt, "*" + partExt} {
+		leftovers, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range leftovers {
+			os.Remove(path)
+		}
+	}
+
+	return &Spool{dir: dir, memoryLimit: memoryLimit, diskLimit: diskLimit, logger: logger}, nil
+}
+
+// Put queues data, spilling it to disk if the memory threshold is reached.
+// If it can't be written it is kept in memory.
+func (s *Spool) Put(data []byte) *Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	c := &Chunk{spool: s, seq: s.seq, size: int64(len(data)), data: data}
+
+	spill := s.memoryLimit > 0 && c.size > 0 && s.stats.MemoryBytes+c.size > s.memoryLimit
+	if spill != s.spilling {
+		s.spilling = spill
+		if spill {
+			s.logger.WithField("memory_bytes", s.stats.MemoryBytes).Warn("Chunk queue over the memory threshold, spooling to disk")
+		} else {
+			s.logger.Info("Chunk queue back under the memory threshold")
+		}
+	}
+
+	if spill {
+		if err := s.write(c); err != nil {
+			s.logger.WithError(err).Error("Failed to spool chunk, keeping it in memory")
+		} else {
+			return c
+		}
+	}
+
+	s.stats.MemoryChunks++
+	s.stats.MemoryBytes += c.size
+	return c
+}
+
+// write moves the data of c to a spool file, dropping the oldest spooled
+// chunks if the disk cap would be exceeded. It expects s.mu to be held.
+func (s *Spool) write(c *Chunk) error {
+	for s.diskLimit > 0 && len(s.onDisk) > 0 && s.stats.DiskBytes+c.size > s.diskLimit {
+		oldest := s.onDisk[0]
+		s.onDisk = s.onDisk[1:]
+		os.Remove(oldest.path)
+		oldest.path = ""
+		oldest.dropped = true
+		s.stats.DiskChunks--
+		s.stats.DiskBytes -= oldest.size
+		s.stats.Dropped++
+		s.logger.WithField("bytes", oldest.size).Warn("Spool full, dropped the oldest spooled chunk")
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%012d%s", c.seq, chunkExt))
+	part := filepath.Join(s.dir, fmt.Sprintf("%012d%s", c.seq, partExt))
+	if err := os.WriteFile(part, c.data, 0644); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	c.data, c.path = nil, path
+	s.onDisk = append(s.onDisk, c)
+	s.stats.DiskChunks++
+	s.stats.DiskBytes += c.size
+	return nil
+}
+
+// Len returns the size of the chunk data
+func (c *Chunk) Len() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.size)
+}
+
+// Take returns the data of the chunk and removes it from the spool. A chunk
+// can only be taken once; a nil chunk has no data.
+func (c *Chunk) Take() ([]byte, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	s := c.spool
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case c.dropped:
+		return nil, ErrDropped
+	case c.taken:
+		return nil, errors.New("spooled chunk already taken")
+	}
+	c.taken = true
+
+	if c.path == "" {
+		data := c.data
+		c.data = nil
+		s.stats.MemoryChunks--
+		s.stats.MemoryBytes -= c.size
+		return data, nil
+	}
+
+	for i, spooled := range s.onDisk {
+		if spooled == c {
+			s.onDisk = append(s.onDisk[:i], s.onDisk[i+1:]...)
+			break
+		}
+	}
+	s.stats.DiskChunks--
+	s.stats.DiskBytes -= c.size
+
+	data, err := os.ReadFile(c.path)
+	os.Remove(c.path)
+	c.path = ""
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spooled chunk: %w", err)
+	}
+	return data, nil
+}
+
+// Stats returns the current queue counts
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close removes the spool directory with any chunks still in it
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onDisk = nil
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,185 @@
+// Package statusfile keeps a small JSON file telling external tools, like
+// overlay scripts polling it, whether the proxy has a live publisher. The
+// file is replaced atomically, so readers never see it half-written, and
+// changes in quick succession are written once.
+package statusfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// States of the proxy
+const (
+	StateOffline  = "offline"  // Not accepting streams
+	StateWaiting  = "waiting"  // Waiting for a publisher
+	StateLive     = "live"     // A publisher is streaming
+	StateDegraded = "degraded" // Live, but something is failing, see Degraded
+)
+
+// Reasons the stream is degraded
+const (
+	ReasonTranscriptionFailing = "transcription_failing"
+	ReasonTranslationDegraded  = "translation_degraded"
+	ReasonPipelineDegraded     = "pipeline_degraded" // The ingest is probably broken
+)
+
+// coalesceDelay is how long a change waits for further ones before the file
+// is written
+const coalesceDelay = 100 * time.Millisecond
+
+// Status is the content of the status file
+type Status struct {
+	State      string     `json:"state"`
+	StreamKey  string     `json:"stream_key,omitempty"`
+	Session    string     `json:"session,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	SourceLang string     `json:"source_lang,omitempty"`
+	TargetLang string     `json:"target_lang,omitempty"`
+	ExtraLangs []string   `json:"extra_langs,omitempty"`
+	Degraded   []string   `json:"degraded,omitempty"`
+}
+
+// SetDegraded adds or removes reason from the reasons the stream is
+// degraded, switching a live stream between StateLive and StateDegraded
+func (s *Status) SetDegraded(reason string, degraded bool) {
+	i := slices.Index(s.Degraded, reason)
+	switch {
+	case degraded && i < 0:
+		s.Degraded = append(slices.Clip(s.Degraded), reason)
+	case !degraded && i >= 0:
+		s.Degraded = slices.Delete(slices.Clone(s.Degraded), i, i+1)
+	}
+
+	if s.State == StateLive || s.State == StateDegraded {
+		s.State = StateLive
+		if len(s.Degraded) > 0 {
+			s.State = StateDegraded
+		}
+	}
+}
+
+// Writer writes the status file
+type Writer struct {
+	path   string
+	logger *logrus.Entry
+
+	mu      sync.Mutex
+	status  Status
+	pending *time.Timer // Write waiting for further changes, nil if none
+	closed  bool
+
+	// writeMu orders the writes, and written is the last content written
+	writeMu sync.Mutex
+	written []byte
+}
+
+// New creates a writer of the status file at path, which starts offline.
+// Nothing is written before the first change.
+func New(path string, logger *logrus.Entry) *Writer {
+	return &Writer{
+		path:   path,
+		logger: logger.WithField("status_file", path),
+		status: Status{State: StateOffline},
+	}
+}
+
+// Update changes the status with fn. The file is written shortly after,
+// along with whatever else changed in the meantime.
+func (w *Writer) Update(fn func(*Status)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	fn(&w.status)
+	if w.pending == nil {
+		w.pending = time.AfterFunc(coalesceDelay, w.flush)
+	}
+}
+
+// Close writes the offline status at once. Later changes are ignored.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.pending != nil {
+		w.pending.Stop()
+		w.pending = nil
+	}
+	w.closed = true
+	w.status = Status{State: StateOffline}
+	data, err := encode(w.status)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.write(data)
+}
+
+// flush writes the status after changes were coalesced
+func (w *Writer) flush() {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	w.pending = nil
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	data, err := encode(w.status)
+	w.mu.Unlock()
+
+	if err == nil && !bytes.Equal(data, w.written) {
+		err = w.write(data)
+	}
+	if err != nil {
+		w.logger.WithError(err).Error("Failed to write status file")
+	}
+}
+
+// write replaces the file with data through a temporary file in the same
+// directory. It expects w.writeMu to be held.
+func (w *Writer) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), "."+filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create status file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+
+	w.written = data
+	return nil
+}
+
+// encode returns the content of the file for status
+func encode(status Status) ([]byte, error) {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode status: %w", err)
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,242 @@
+package statusfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// newWriter returns a writer of a status file in a directory of its own
+func newWriter(t *testing.T) (*Writer, string) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	path := filepath.Join(t.TempDir(), "status.json")
+	return New(path, logrus.NewEntry(logger)), path
+}
+
+// readStatus returns the status in the file at path, and false if there is
+// no file yet
+func readStatus(t *testing.T, path string) (Status, bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Status{}, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("status file is not valid JSON: %v\n%s", err, data)
+	}
+	return status, true
+}
+
+// waitForState waits until the file at path has state
+func waitForState(t *testing.T, path, state string) Status {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*coalesceDelay)
+	defer cancel()
+	var status Status
+	testutil.WaitFor(ctx, coalesceDelay/10, func() bool {
+		status, _ = readStatus(t, path)
+		return status.State == state
+	})
+	if status.State != state {
+		t.Fatalf("status file has state %q, want %q", status.State, state)
+	}
+	return status
+}
+
+func TestSetDegraded(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   Status
+		reason   string
+		degraded bool
+		want     Status
+	}{
+		{
+			"live degrades",
+			Status{State: StateLive},
+			ReasonTranscriptionFailing, true,
+			Status{State: StateDegraded, Degraded: []string{ReasonTranscriptionFailing}},
+		},
+		{
+			"reasons added once",
+			Status{State: StateDegraded, Degraded: []string{ReasonTranscriptionFailing}},
+			ReasonTranscriptionFailing, true,
+			Status{State: StateDegraded, Degraded: []string{ReasonTranscriptionFailing}},
+		},
+		{
+			"still degraded for another reason",
+			Status{State: StateDegraded, Degraded: []string{ReasonTranscriptionFailing, ReasonPipelineDegraded}},
+			ReasonTranscriptionFailing, false,
+			Status{State: StateDegraded, Degraded: []string{ReasonPipelineDegraded}},
+		},
+		{
+			"live again",
+			Status{State: StateDegraded, Degraded: []string{ReasonTranslationDegraded}},
+			ReasonTranslationDegraded, false,
+			Status{State: StateLive, Degraded: []string{}},
+		},
+		{
+			// The reason is kept for when the stream goes live
+			"waiting stays waiting",
+			Status{State: StateWaiting},
+			ReasonPipelineDegraded, true,
+			Status{State: StateWaiting, Degraded: []string{ReasonPipelineDegraded}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			status.SetDegraded(tt.reason, tt.degraded)
+			if !reflect.DeepEqual(status, tt.want) {
+				t.Errorf("status = %+v, want %+v", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriterCoalesces(t *testing.T) {
+	w, path := newWriter(t)
+	defer w.Close()
+
+	started := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	w.Update(func(s *Status) { s.State = StateWaiting })
+	w.Update(func(s *Status) {
+		s.State = StateLive
+		s.StreamKey = "stream"
+		s.StartedAt = &started
+		s.SourceLang, s.TargetLang = "en", "de"
+	})
+	w.Update(func(s *Status) { s.SetDegraded(ReasonTranscriptionFailing, true) })
+
+	// Nothing is written while changes are still coming in
+	if _, ok := readStatus(t, path); ok {
+		t.Fatal("status file written before the changes were coalesced")
+	}
+	status := waitForState(t, path, StateDegraded)
+	want := Status{
+		State:      StateDegraded,
+		StreamKey:  "stream",
+		StartedAt:  &started,
+		SourceLang: "en",
+		TargetLang: "de",
+		Degraded:   []string{ReasonTranscriptionFailing},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("status = %+v, want %+v", status, want)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	w, path := newWriter(t)
+	w.Update(func(s *Status) { s.State = StateLive })
+	waitForState(t, path, StateLive)
+
+	// A change pending when the writer closes is dropped for offline, and
+	// later ones are ignored
+	w.Update(func(s *Status) { s.State = StateWaiting })
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := readStatus(t, path); status.State != StateOffline {
+		t.Fatalf("state after Close = %q, want %q", status.State, StateOffline)
+	}
+	w.Update(func(s *Status) { s.State = StateLive })
+	time.Sleep(2 * coalesceDelay)
+	if status, _ := readStatus(t, path); status.State != StateOffline {
+		t.Errorf("state after an update of the closed writer = %q, want %q", status.State, StateOffline)
+	}
+}
+
+func TestWriterReplacesAtomically(t *testing.T) {
+	w, path := newWriter(t)
+
+	// Readers polling the file while it is rewritten over and over always
+	// find it complete
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				data, err := os.ReadFile(path)
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				var status Status
+				if err == nil {
+					err = json.Unmarshal(data, &status)
+				}
+				if err != nil {
+					t.Errorf("read a partial status file: %v\n%s", err, data)
+					return
+				}
+			}
+		}()
+	}
+
+	// Writes of different sizes, so a partial one couldn't pass for another
+	for i := 0; i < 50; i++ {
+		langs := make([]string, i%7*20)
+		for j := range langs {
+			langs[j] = "lang-" + strconv.Itoa(j)
+		}
+		w.mu.Lock()
+		w.status = Status{State: StateLive, StreamKey: "stream-" + strconv.Itoa(i), ExtraLangs: langs}
+		w.mu.Unlock()
+		w.flush()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	wg.Wait()
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(path) {
+		t.Errorf("directory has %v, want only the status file", entries)
+	}
+}
+
+func TestWriterFailure(t *testing.T) {
+	w, path := newWriter(t)
+	if err := os.Remove(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write is logged and leaves nothing behind
+	w.Update(func(s *Status) { s.State = StateLive })
+	time.Sleep(2 * coalesceDelay)
+	if err := w.Close(); err == nil {
+		t.Error("Close() succeeded without a directory")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("status file exists: %v", err)
+	}
+}
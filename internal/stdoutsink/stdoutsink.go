@@ -0,0 +1,113 @@
+// Package stdoutsink writes finalized captions to standard output, one JSON
+// event per line or as SRT or WebVTT cues, for piping into other tools. Logs go to
+// standard error, so stdout carries nothing but captions.
+package stdoutsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/ben/transcription-proxy/internal/events"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the captions
+const (
+	FormatJSON = "json"
+	FormatSRT  = "srt"
+	FormatVTT  = "vtt"
+)
+
+// Sink writes captions to a writer, normally os.Stdout
+type Sink struct {
+	out    io.Writer
+	format string
+	lang   string // Language of the captions written, all of them if empty
+	vtt    subtitles.VTTOptions
+	logger *logrus.Entry
+
+	index  int  // Number of the last cue of the session
+	header bool // WebVTT header written
+}
+
+// New creates a sink writing captions to out in format, WebVTT cues with the
+// vtt options. With lang, which is a language code or events.LangOriginal,
+// only the captions in that language are written, without their other
+// languages.
+func New(out io.Writer, format, lang string, vtt subtitles.VTTOptions, logger *logrus.Logger) (*Sink, error) {
+	if format != FormatJSON && format != FormatSRT && format != FormatVTT {
+		return nil, fmt.Errorf("captions format must be %s, %s, or %s, got %q", FormatJSON, FormatSRT, FormatVTT, format)
+	}
+	return &Sink{out: out, format: format, lang: lang, vtt: vtt, logger: logger.WithField("publisher", "stdout")}, nil
+}
+
+// Run writes the captions received on sub until it is closed. Once the
+// reader of the output goes away the sink stops with a warning and closes
+// sub; other write errors drop the caption concerned.
+func (s *Sink) Run(sub *events.Subscription) {
+	for event := range sub.C {
+		if event.Kind == events.KindStreamStarted {
+			// Cue numbers and times start again with every stream
+			s.index = 0
+		}
+		if event.Kind != events.KindCaption || event.Caption == nil {
+			continue
+		}
+		if s.lang != "" {
+			var ok bool
+			if event.Caption, ok = event.Caption.Only(s.lang); !ok {
+				continue
+			}
+		}
+
+		err := s.write(event)
+		if errors.Is(err, syscall.EPIPE) {
+			s.logger.Warn("Standard output was closed, no longer writing captions to it")
+			sub.Close()
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to write caption to standard output")
+		}
+	}
+
+	if dropped := sub.Dropped(); dropped > 0 {
+		s.logger.WithField("dropped", dropped).Warn("Captions were dropped because standard output fell behind")
+	}
+}
+
+// write writes the caption of event in the format of the sink
+func (s *Sink) write(event events.Event) error {
+	segment := transcriber.Segment{
+		Start: event.Caption.Start,
+		End:   event.Caption.End,
+		Text:  event.Caption.Text,
+	}
+	switch s.format {
+	case FormatSRT:
+		s.index++
+		return subtitles.WriteCue(s.out, subtitles.FormatSRT, s.index, segment)
+	case FormatVTT:
+		// The output is a single document, whose header comes only once
+		if !s.header {
+			if err := subtitles.WriteVTTHeader(s.out, s.vtt); err != nil {
+				return err
+			}
+			s.header = true
+		}
+		s.index++
+		return subtitles.WriteVTTCue(s.out, s.index, segment, s.vtt)
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode caption: %w", err)
+	}
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
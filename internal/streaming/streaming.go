@@ -2,14 +2,67 @@ package streaming
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/flv"
+	"github.com/ben/transcription-proxy/internal/procs"
+)
+
+// Errors classified from the output of the FFmpeg process of a target
+var (
+	// ErrTargetUnreachable means the target could not be connected to
+	ErrTargetUnreachable = errors.New("target unreachable")
+	// ErrAuthRejected means the target rejected the stream key or credentials;
+	// retrying will not help
+	ErrAuthRejected = errors.New("target rejected authentication")
+	// ErrUnsupportedCodec means the target doesn't accept the codec of the
+	// incoming stream
+	ErrUnsupportedCodec = errors.New("codec not supported by target")
+	// ErrUnknownTarget means no target has the given ID
+	ErrUnknownTarget = errors.New("unknown target")
+	// ErrDuplicateTarget means a target publishing to the same URL exists
+	ErrDuplicateTarget = errors.New("target already exists")
+)
+
+// stderrTailSize is how much recent FFmpeg output is kept per target to
+// classify failures
+const stderrTailSize = 4096
+
+// authRejectedPatterns and unreachablePatterns are substrings of FFmpeg
+// output that identify why publishing to a target failed
+var (
+	authRejectedPatterns = []string{
+		"401 Unauthorized",
+		"403 Forbidden",
+		"NetStream.Publish.BadName",
+		"NetStream.Publish.Rejected",
+		"NetConnection.Connect.Rejected",
+		"Authentication failed",
+		"authentication failed",
+	}
+	unreachablePatterns = []string{
+		"Connection refused",
+		"Connection timed out",
+		"No route to host",
+		"Network is unreachable",
+		"Name or service not known",
+		"Failed to resolve hostname",
+		"Cannot open connection",
+	}
 )
 
 type StreamType string
@@ -18,21 +71,425 @@ const (
 	StreamTypeTwitch  StreamType = "twitch"
 	StreamTypeYouTube StreamType = "youtube"
 	StreamTypeCustom  StreamType = "custom"
+	StreamTypeFile    StreamType = "file"
 )
 
+// fileTimestampPlaceholder is replaced in the path of a file target with the
+// time each file is opened, in fileTimestampLayout
+const (
+	fileTimestampPlaceholder = "{timestamp}"
+	fileTimestampLayout      = "20060102-150405"
+	fileTimestampStrftime    = "%Y%m%d-%H%M%S" // The same for FFmpeg's segment muxer
+)
+
+// defaultVideoCodecs are the video codecs each type of target accepts unless
+// the target URL lists them in its codecs parameter
+var defaultVideoCodecs = map[StreamType][]string{
+	StreamTypeTwitch:  {"h264"},
+	StreamTypeYouTube: {"h264", "hevc", "av1"},
+	StreamTypeCustom:  {"h264"},
+	StreamTypeFile:    {"h264", "hevc", "av1", "vp9"}, // Written as received
+}
+
 type StreamTarget struct {
 	URL       string
 	Type      StreamType
 	StreamKey string
-	AuthToken string
+	AuthToken string // Sent as the auth query parameter of custom targets
+	// Query holds the query parameters of a custom target URL that the proxy
+	// doesn't interpret, passed on exactly as written
+	Query       string
+	VideoCodecs []string // Video codecs the target accepts, as FFmpeg names them
+	ProfileName string   // Encoding profile selected with ?profile=, empty to copy the video
+	Profile     *Profile // Set by ResolveProfiles
+
+	// SubtitleFormat is the subtitle format selected with ?subtitles=, empty
+	// for the configured one
+	SubtitleFormat string
+
+	// Path is where a file target writes, possibly with a {timestamp}
+	// placeholder. It starts a new file once the current one holds
+	// RotateSize bytes or RotateDuration of the stream, if set.
+	Path           string
+	RotateSize     int64
+	RotateDuration time.Duration
+
+	// resolved are the secret values put in place of ${NAME} placeholders,
+	// hidden wherever the target is shown
+	resolved []string
+}
+
+// Profile is a named encoding profile for targets that get transcoded video
+// instead of a copy of the incoming stream
+type Profile struct {
+	Name             string
+	Codec            string        // h264 or hevc
+	Width, Height    int           // 0 keeps the source size
+	FPS              int           // 0 keeps the source frame rate
+	BitrateKbps      int           // 0 leaves the rate to the encoder
+	Preset           string        // Encoder preset, empty for the encoder default
+	KeyframeInterval time.Duration // 0 leaves keyframes to the encoder
+	Encoder          string        // FFmpeg encoder
+}
+
+// profileEncoders are the FFmpeg encoders of each profile codec, on the CPU
+// and on the GPU
+var profileEncoders = map[string][2]string{
+	"h264": {"libx264", "h264_nvenc"},
+	"hevc": {"libx265", "hevc_nvenc"},
+}
+
+// encoderPresets are the presets each encoder accepts
+var encoderPresets = map[string][]string{
+	"libx264":    {"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"},
+	"libx265":    {"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"},
+	"h264_nvenc": {"p1", "p2", "p3", "p4", "p5", "p6", "p7"},
+	"hevc_nvenc": {"p1", "p2", "p3", "p4", "p5", "p6", "p7"},
+}
+
+// bitratePattern matches bitrates like 3000k, 3M, or 3000000
+var bitratePattern = regexp.MustCompile(`^(\d+)([kKmM]?)$`)
+
+// sizePattern matches file sizes like 500M, 2G, or 1048576
+var sizePattern = regexp.MustCompile(`^(\d+)([kKmMgG]?)$`)
+
+// ParseProfiles parses profile definitions of the form
+// name:key=value,...;name:key=value,... with the keys codec, size, fps,
+// bitrate, preset, keyint, and encoder. Without an explicit encoder, profiles
+// use NVENC if gpu is set.
+func ParseProfiles(spec string, gpu bool) (map[string]*Profile, error) {
+	profiles := make(map[string]*Profile)
+
+	for _, definition := range strings.Split(spec, ";") {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+
+		name, options, ok := strings.Cut(definition, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("profile %q: expected name:key=value,...", definition)
+		}
+		if _, exists := profiles[name]; exists {
+			return nil, fmt.Errorf("profile %q defined twice", name)
+		}
+
+		profile, err := parseProfile(name, options, gpu)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		profiles[name] = profile
+	}
+
+	return profiles, nil
+}
+
+// parseProfile parses the comma-separated options of a single profile
+func parseProfile(name, options string, gpu bool) (*Profile, error) {
+	profile := &Profile{Name: name, Codec: "h264"}
+
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return nil, fmt.Errorf("option %q: expected key=value", option)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "codec":
+			profile.Codec = strings.ToLower(value)
+		case "size":
+			w, h, found := strings.Cut(strings.ToLower(value), "x")
+			if !found {
+				return nil, fmt.Errorf("size %q: expected WIDTHxHEIGHT", value)
+			}
+			if profile.Width, err = strconv.Atoi(w); err != nil || profile.Width <= 0 || profile.Width%2 != 0 {
+				return nil, fmt.Errorf("size %q: width must be a positive even number", value)
+			}
+			if profile.Height, err = strconv.Atoi(h); err != nil || profile.Height <= 0 || profile.Height%2 != 0 {
+				return nil, fmt.Errorf("size %q: height must be a positive even number", value)
+			}
+		case "fps":
+			if profile.FPS, err = strconv.Atoi(value); err != nil || profile.FPS <= 0 || profile.FPS > 240 {
+				return nil, fmt.Errorf("fps %q: expected 1 to 240", value)
+			}
+		case "bitrate":
+			if profile.BitrateKbps, err = parseBitrate(value); err != nil {
+				return nil, err
+			}
+		case "preset":
+			profile.Preset = value
+		case "keyint":
+			if profile.KeyframeInterval, err = time.ParseDuration(value); err != nil || profile.KeyframeInterval <= 0 {
+				return nil, fmt.Errorf("keyint %q: expected a positive duration like 2s", value)
+			}
+		case "encoder":
+			profile.Encoder = value
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	encoders, ok := profileEncoders[profile.Codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q, expected h264 or hevc", profile.Codec)
+	}
+	if profile.Encoder == "" {
+		profile.Encoder = encoders[0]
+		if gpu {
+			profile.Encoder = encoders[1]
+		}
+	}
+	if profile.Encoder != encoders[0] && profile.Encoder != encoders[1] {
+		return nil, fmt.Errorf("encoder %q doesn't produce %s", profile.Encoder, profile.Codec)
+	}
+	if profile.Preset != "" && !contains(encoderPresets[profile.Encoder], profile.Preset) {
+		return nil, fmt.Errorf("preset %q not supported by %s, expected one of %s",
+			profile.Preset, profile.Encoder, strings.Join(encoderPresets[profile.Encoder], ", "))
+	}
+
+	return profile, nil
 }
 
-func ParseStreamURL(inputURL string) (*StreamTarget, error) {
+// parseBitrate parses a bitrate like 3000k, 3M, or 3000000 into kbit/s
+func parseBitrate(value string) (int, error) {
+	match := bitratePattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("bitrate %q: expected a number with an optional k or M suffix", value)
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("bitrate %q: %w", value, err)
+	}
+	switch strings.ToLower(match[2]) {
+	case "":
+		n /= 1000
+	case "m":
+		n *= 1000
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("bitrate %q: must be at least 1k", value)
+	}
+	return n, nil
+}
+
+// videoArgs returns the FFmpeg arguments that encode the video of a target
+// with the profile
+func (p *Profile) videoArgs() []string {
+	args := []string{"-c:v", p.Encoder, "-pix_fmt", "yuv420p"}
+
+	var filters []string
+	if p.Width > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", p.Width, p.Height))
+	}
+	if p.FPS > 0 {
+		filters = append(filters, fmt.Sprintf("fps=%d", p.FPS))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+	if p.BitrateKbps > 0 {
+		args = append(args,
+			"-b:v", fmt.Sprintf("%dk", p.BitrateKbps),
+			"-maxrate", fmt.Sprintf("%dk", p.BitrateKbps),
+			"-bufsize", fmt.Sprintf("%dk", 2*p.BitrateKbps),
+		)
+	}
+	if p.KeyframeInterval > 0 {
+		// Independent of the frame rate, which may be the unknown source rate
+		args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%g)", p.KeyframeInterval.Seconds()))
+	}
+
+	return args
+}
+
+// ResolveProfiles looks up the profiles the targets select
+func ResolveProfiles(targets []*StreamTarget, profiles map[string]*Profile) error {
+	for _, target := range targets {
+		if target.ProfileName == "" {
+			continue
+		}
+		profile, ok := profiles[target.ProfileName]
+		if !ok {
+			return fmt.Errorf("target %s: unknown profile %q", target.RedactedURL(), target.ProfileName)
+		}
+		target.Profile = profile
+	}
+	return nil
+}
+
+// Ingests are the ingest endpoints Twitch and YouTube targets publish to, the
+// stream key is appended to their path. Empty ones are the defaults.
+type Ingests struct {
+	Twitch  string
+	YouTube string
+}
+
+// DefaultIngests are the global ingest endpoints of Twitch and YouTube
+var DefaultIngests = Ingests{
+	Twitch:  "rtmp://ingest.global-contribute.live-video.net/app",
+	YouTube: "rtmp://a.rtmp.youtube.com/live2",
+}
+
+// twitchRegionalIngest is the host of the regional Twitch ingest a target
+// selects with ?ingest=, e.g. fra05
+const twitchRegionalIngest = "%s.contribute.live-video.net"
+
+var ingestRegionPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// url returns the URL publishing key to the ingest of streamType. A region
+// selects a regional Twitch ingest, and an rtmps scheme switches an rtmp
+// ingest to its rtmps variant.
+func (i Ingests) url(streamType StreamType, scheme, region, key string) (string, error) {
+	ingest, fallback := i.Twitch, DefaultIngests.Twitch
+	if streamType == StreamTypeYouTube {
+		ingest, fallback = i.YouTube, DefaultIngests.YouTube
+	}
+	if ingest == "" {
+		ingest = fallback
+	}
+
+	u, err := url.Parse(ingest)
+	if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" {
+		return "", fmt.Errorf("invalid %s ingest %q, expected e.g. %s", streamType, ingest, fallback)
+	}
+
+	if region != "" {
+		if streamType != StreamTypeTwitch {
+			return "", errors.New("ingest is only supported for Twitch targets")
+		}
+		if !ingestRegionPattern.MatchString(region) {
+			return "", fmt.Errorf("invalid ingest %q, expected a Twitch ingest name like fra05", region)
+		}
+		u.Host = fmt.Sprintf(twitchRegionalIngest, region)
+	}
+
+	if scheme == "rtmps" && u.Scheme == "rtmp" {
+		u.Scheme = "rtmps"
+		// FFmpeg connects to 443 for rtmps; YouTube serves it on its own hosts
+		u.Host = u.Hostname()
+		if streamType == StreamTypeYouTube {
+			u.Host = strings.Replace(u.Host, ".rtmp.", ".rtmps.", 1)
+		}
+	}
+
+	return strings.TrimSuffix(u.String(), "/") + "/" + key, nil
+}
+
+// secretNamePattern matches the names of secrets referenced as ${NAME}
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ExpandSecrets replaces the ${NAME} placeholders in s with the secret NAME,
+// read from the file NAME in dir, where Docker and Kubernetes mount secrets,
+// or else from the environment variable NAME. It also returns the values put
+// in, which must not be shown. Values aren't expanded again, and placeholders
+// can't be nested.
+func ExpandSecrets(s, dir string) (string, []string, error) {
+	var b strings.Builder
+	var resolved []string
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), resolved, nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", nil, errors.New("unterminated ${ placeholder")
+		}
+		name := s[start+2 : start+end]
+		if strings.Contains(name, "${") {
+			return "", nil, errors.New("nested ${ placeholders are not supported")
+		}
+		if !secretNamePattern.MatchString(name) {
+			return "", nil, fmt.Errorf("invalid secret name %q", name)
+		}
+
+		value, err := readSecret(name, dir)
+		if err != nil {
+			return "", nil, err
+		}
+		b.WriteString(s[:start])
+		b.WriteString(value)
+		resolved = append(resolved, value)
+		s = s[start+end+1:]
+	}
+}
+
+// readSecret returns the secret name from its file in dir, or else from the
+// environment
+func readSecret(name, dir string) (string, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		switch {
+		case err == nil:
+			// Secret files usually end with a newline
+			value := strings.TrimRight(string(data), "\r\n")
+			if value == "" {
+				return "", fmt.Errorf("secret %s is empty", name)
+			}
+			return value, nil
+		case !errors.Is(err, fs.ErrNotExist):
+			return "", fmt.Errorf("failed to read secret %s: %w", name, err)
+		}
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		if dir == "" {
+			return "", fmt.Errorf("secret %s is not set in the environment", name)
+		}
+		return "", fmt.Errorf("secret %s not found in %s or the environment", name, dir)
+	}
+	if value == "" {
+		return "", fmt.Errorf("secret %s is empty", name)
+	}
+	return value, nil
+}
+
+// ParseStreamURL parses a target URL. Twitch and YouTube targets are given as
+// rtmp://host/twitch/KEY or rtmp://host/youtube/KEY and published to their
+// ingest in ingests, over rtmps if the URL uses it. ${NAME} placeholders are
+// replaced with secrets from secretsDir or the environment first.
+func ParseStreamURL(inputURL string, ingests Ingests, secretsDir string) (*StreamTarget, error) {
+	expanded, resolved, err := ExpandSecrets(inputURL, secretsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := parseStreamURL(expanded, ingests)
+	if err != nil {
+		// Errors may echo the URL with the secrets in it
+		return nil, errors.New(procs.Redact(err.Error(), resolved))
+	}
+	target.resolved = resolved
+	return target, nil
+}
+
+// parseStreamURL parses a target URL with its secrets in place
+func parseStreamURL(inputURL string, ingests Ingests) (*StreamTarget, error) {
 	parsedURL, err := url.Parse(inputURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
+	if parsedURL.Scheme == "file" {
+		return parseFileURL(parsedURL)
+	}
+
 	path := strings.TrimPrefix(parsedURL.Path, "/")
 	pathParts := strings.Split(path, "/")
 
@@ -46,25 +503,227 @@ func ParseStreamURL(inputURL string) (*StreamTarget, error) {
 	query := parsedURL.Query()
 	authToken := query.Get("auth")
 
-	var targetURL string
+	videoCodecs := defaultVideoCodecs[streamType]
+	if list := query.Get("codecs"); list != "" {
+		videoCodecs = nil
+		for _, codec := range strings.Split(list, ",") {
+			if codec = strings.ToLower(strings.TrimSpace(codec)); codec != "" {
+				videoCodecs = append(videoCodecs, codec)
+			}
+		}
+	}
+
+	var targetURL, passthrough string
 
 	switch streamType {
-	case StreamTypeTwitch:
-		targetURL = fmt.Sprintf("rtmp://live.twitch.tv/app/%s", streamKey)
-	case StreamTypeYouTube:
-		targetURL = fmt.Sprintf("rtmp://a.rtmp.youtube.com/live2/%s", streamKey)
+	case StreamTypeTwitch, StreamTypeYouTube:
+		// Both take the stream key in the path and reject anything else
+		if authToken != "" {
+			return nil, fmt.Errorf("%s targets take the stream key in the path, not ?auth=", streamType)
+		}
+		targetURL, err = ingests.url(streamType, parsedURL.Scheme, query.Get("ingest"), streamKey)
+		if err != nil {
+			return nil, err
+		}
 	case StreamTypeCustom:
-		targetURL = fmt.Sprintf("%s://%s%s", parsedURL.Scheme, parsedURL.Host, parsedURL.Path)
+		targetURL = fmt.Sprintf("%s://%s%s", parsedURL.Scheme, parsedURL.Host, parsedURL.EscapedPath())
+		passthrough = passthroughQuery(parsedURL.RawQuery)
 	}
 
 	return &StreamTarget{
-		URL:       targetURL,
-		Type:      streamType,
-		StreamKey: streamKey,
-		AuthToken: authToken,
+		URL:            targetURL,
+		Type:           streamType,
+		StreamKey:      streamKey,
+		AuthToken:      authToken,
+		Query:          passthrough,
+		VideoCodecs:    videoCodecs,
+		ProfileName:    query.Get("profile"),
+		SubtitleFormat: query.Get("subtitles"),
 	}, nil
 }
 
+// proxyParams are the query parameters of target URLs the proxy interprets
+// itself; custom targets get any others
+var proxyParams = map[string]bool{
+	"auth":      true,
+	"codecs":    true,
+	"profile":   true,
+	"subtitles": true,
+}
+
+// passthroughQuery returns the parameters of rawQuery that aren't in
+// proxyParams, keeping their encoding and order
+func passthroughQuery(rawQuery string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && proxyParams[name] {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// parseFileURL parses the URL of a file target, e.g.
+// file:///data/out-{timestamp}.flv?rotate_duration=1h
+func parseFileURL(parsedURL *url.URL) (*StreamTarget, error) {
+	// The placeholder's braces are escaped in a URL
+	path, err := url.PathUnescape(parsedURL.EscapedPath())
+	if err != nil || path == "" || !filepath.IsAbs(path) {
+		return nil, errors.New("file URL must have an absolute path, e.g. file:///data/out.flv")
+	}
+	if parsedURL.Host != "" && parsedURL.Host != "localhost" {
+		return nil, fmt.Errorf("file URL must not name a host, got %q", parsedURL.Host)
+	}
+
+	query := parsedURL.Query()
+	target := &StreamTarget{
+		URL:            "file://" + path,
+		Type:           StreamTypeFile,
+		VideoCodecs:    defaultVideoCodecs[StreamTypeFile],
+		ProfileName:    query.Get("profile"),
+		SubtitleFormat: query.Get("subtitles"),
+		Path:           path,
+	}
+
+	if value := query.Get("rotate_size"); value != "" {
+		target.RotateSize, err = parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotate_size: %w", err)
+		}
+	}
+	if value := query.Get("rotate_duration"); value != "" {
+		target.RotateDuration, err = time.ParseDuration(value)
+		if err != nil || target.RotateDuration <= 0 {
+			return nil, fmt.Errorf("invalid rotate_duration %q, e.g. 1h", value)
+		}
+	}
+
+	rotates := target.RotateSize > 0 || target.RotateDuration > 0
+	if rotates && !strings.Contains(path, fileTimestampPlaceholder) {
+		return nil, fmt.Errorf("rotating file targets need %s in the file name", fileTimestampPlaceholder)
+	}
+	// Transcoded files are written by FFmpeg's segment muxer, which can only
+	// rotate by time
+	if target.ProfileName != "" && target.RotateSize > 0 {
+		return nil, errors.New("rotate_size is not supported with a profile, use rotate_duration")
+	}
+
+	return target, nil
+}
+
+// parseSize parses a size in bytes with an optional binary k, M, or G suffix
+func parseSize(value string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("size %q: expected a number with an optional k, M, or G suffix", value)
+	}
+
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("size %q: %w", value, err)
+	}
+	switch strings.ToLower(match[2]) {
+	case "k":
+		n <<= 10
+	case "m":
+		n <<= 20
+	case "g":
+		n <<= 30
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size %q: must be positive", value)
+	}
+	return n, nil
+}
+
+// ParseStreamURLs parses a comma-separated list of target URLs
+func ParseStreamURLs(targetURLs string, ingests Ingests, secretsDir string) ([]*StreamTarget, error) {
+	urls := strings.Split(targetURLs, ",")
+	targets := make([]*StreamTarget, 0, len(urls))
+
+	for _, urlStr := range urls {
+		urlStr = strings.TrimSpace(urlStr)
+		if urlStr == "" {
+			continue
+		}
+
+		target, err := ParseStreamURL(urlStr, ingests, secretsDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL %q: %w", urlStr, err)
+		}
+
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no valid target URLs provided")
+	}
+
+	return targets, nil
+}
+
+// OutputURL returns the URL FFmpeg publishes to, including authentication
+// and the query parameters passed through to custom targets
+func (t *StreamTarget) OutputURL() string {
+	var params []string
+	if t.Query != "" {
+		params = append(params, t.Query)
+	}
+	if t.AuthToken != "" && t.Type == StreamTypeCustom {
+		params = append(params, "auth="+escapeQueryValue(t.AuthToken))
+	}
+	if len(params) == 0 {
+		return t.URL
+	}
+	return t.URL + "?" + strings.Join(params, "&")
+}
+
+// secrets returns what must not show up in the recorded arguments of the
+// target's FFmpeg process: the stream key, the auth token as given and as
+// sent, the passed-through parameters, which may hold credentials too, and
+// the secrets put in its URL
+func (t *StreamTarget) secrets() []string {
+	return append([]string{t.StreamKey, t.AuthToken, escapeQueryValue(t.AuthToken), t.Query}, t.resolved...)
+}
+
+// escapeQueryValue escapes a query parameter value, with spaces as %20
+// rather than +, which not every RTMP server decodes
+func escapeQueryValue(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// SupportsVideoCodec reports whether the target accepts video in codec.
+// Targets with an encoding profile accept any codec FFmpeg can decode.
+func (t *StreamTarget) SupportsVideoCodec(codec string) bool {
+	return t.Profile != nil || contains(t.VideoCodecs, codec)
+}
+
+// contains reports whether values contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactedURL returns the target URL with the stream key and secrets hidden,
+// for logs and reports
+func (t *StreamTarget) RedactedURL() string {
+	return t.redact(t.URL)
+}
+
+// redact hides the stream key and the secrets of the target in s
+func (t *StreamTarget) redact(s string) string {
+	return procs.Redact(s, append([]string{t.StreamKey}, t.resolved...))
+}
+
 func getStreamType(typeStr string) StreamType {
 	switch strings.ToLower(typeStr) {
 	case "twitch":
@@ -78,25 +737,172 @@ func getStreamType(typeStr string) StreamType {
 
 type Streamer struct {
 	targets              []*StreamTarget
-	persistentCmds       map[*StreamTarget]*exec.Cmd
+	persistentCmds       map[*StreamTarget]*procs.Process
 	persistentStdinPipes map[*StreamTarget]io.WriteCloser
-	mu                   sync.Mutex // Mutex to protect the maps
+	stderrTails          map[*StreamTarget]*procs.TailBuffer
+	failedTargets        map[*StreamTarget]error    // Targets that are never retried
+	breakers             map[*StreamTarget]*breaker // Targets that failed to start
+	breakerOptions       BreakerOptions
+	onBreakerOpen        func(TargetStatus)
+	preamble             []byte                     // Sent to every target process first
+	joining              map[*StreamTarget]struct{} // Started targets waiting for a keyframe
+	tee                  Tee                        // Gets a copy of the stream, nil for none
+	mu                   sync.Mutex                 // Mutex to protect the maps
 	initialized          bool
 }
 
 func New(targets []*StreamTarget) *Streamer {
 	return &Streamer{
 		targets:              targets,
-		persistentCmds:       make(map[*StreamTarget]*exec.Cmd),
+		persistentCmds:       make(map[*StreamTarget]*procs.Process),
 		persistentStdinPipes: make(map[*StreamTarget]io.WriteCloser),
+		stderrTails:          make(map[*StreamTarget]*procs.TailBuffer),
+		failedTargets:        make(map[*StreamTarget]error),
+		breakers:             make(map[*StreamTarget]*breaker),
+		joining:              make(map[*StreamTarget]struct{}),
 	}
 }
 
+// BreakerOptions configure the circuit breaker that stops a streamer from
+// restarting a target that keeps failing, like one with a wrong stream key
+type BreakerOptions struct {
+	// Failures is how many failed starts in a row open the breaker, 0 to
+	// never open it on failures alone. Failures further apart than Window
+	// start the count again, and a target that streams for Window closes its
+	// breaker; with no Window only a reset does.
+	Failures int
+	Window   time.Duration
+	// Cooldown is how long an open breaker stops retries, 0 until the target
+	// is reset
+	Cooldown time.Duration
+}
+
+// Breaker states
+const (
+	BreakerClosed = "closed"
+	BreakerOpen   = "open"
+	// BreakerHalfOpen is a breaker whose cooldown has elapsed: the target is
+	// started again, and a failure opens it right away
+	BreakerHalfOpen = "half_open"
+)
+
+// breaker counts the failed starts of a target
+type breaker struct {
+	failures    int
+	lastFailure time.Time
+	lastErr     error
+	startedAt   time.Time // When the target process was last started
+	openedAt    time.Time // Zero while closed
+}
+
+// SetBreaker sets the circuit breaker of every target. onOpen, if set, is
+// called with the status of a target whenever its breaker opens, with the
+// streamer's lock held, so it must not call the streamer.
+func (s *Streamer) SetBreaker(options BreakerOptions, onOpen func(TargetStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breakerOptions = options
+	s.onBreakerOpen = onOpen
+}
+
+// ResetTarget closes the breaker of the target with id, its index in the
+// target list, so the next data streamed starts it again
+func (s *Streamer) ResetTarget(id int) (TargetStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 0 || id >= len(s.targets) {
+		return TargetStatus{}, fmt.Errorf("%w: %d", ErrUnknownTarget, id)
+	}
+	target := s.targets[id]
+	delete(s.breakers, target)
+	return s.targetStatus(id, target), nil
+}
+
+// breakerState returns the state of the breaker of target; the caller must
+// hold s.mu
+func (s *Streamer) breakerState(target *StreamTarget) string {
+	b, ok := s.breakers[target]
+	switch {
+	case !ok || b.openedAt.IsZero():
+		return BreakerClosed
+	case s.breakerOptions.Cooldown > 0 && time.Since(b.openedAt) >= s.breakerOptions.Cooldown:
+		return BreakerHalfOpen
+	default:
+		return BreakerOpen
+	}
+}
+
+// recordStarted notes that the process of target was started; the caller
+// must hold s.mu
+func (s *Streamer) recordStarted(target *StreamTarget) {
+	if b, ok := s.breakers[target]; ok {
+		b.startedAt = time.Now()
+	}
+}
+
+// recordStreaming closes the breaker of a target that has been streaming
+// for the breaker window without failing; the caller must hold s.mu
+func (s *Streamer) recordStreaming(target *StreamTarget) {
+	if b, ok := s.breakers[target]; ok && s.breakerOptions.Window > 0 && time.Since(b.startedAt) >= s.breakerOptions.Window {
+		delete(s.breakers, target)
+	}
+}
+
+// recordFailure counts a failed start of target and reports whether its
+// breaker is open now. An authentication error opens it right away, since
+// retrying won't help. The caller must hold s.mu.
+func (s *Streamer) recordFailure(target *StreamTarget, err error) bool {
+	now := time.Now()
+	b, ok := s.breakers[target]
+	if !ok {
+		b = &breaker{}
+		s.breakers[target] = b
+	}
+	if s.breakerOptions.Window > 0 && now.Sub(b.lastFailure) > s.breakerOptions.Window {
+		b.failures = 0
+	}
+	b.failures++
+	b.lastFailure = now
+	b.lastErr = err
+
+	state := s.breakerState(target)
+	if state == BreakerOpen {
+		return true
+	}
+	if state == BreakerClosed && !errors.Is(err, ErrAuthRejected) &&
+		(s.breakerOptions.Failures <= 0 || b.failures < s.breakerOptions.Failures) {
+		return false
+	}
+
+	// Closed with too many failures, or a failed retry after the cooldown
+	b.openedAt = now
+	if s.onBreakerOpen != nil {
+		id := slices.Index(s.targets, target)
+		s.onBreakerOpen(s.targetStatus(id, target))
+	}
+	return true
+}
+
+// startable reports whether target may be started, that is it hasn't failed
+// permanently and its breaker isn't open; the caller must hold s.mu
+func (s *Streamer) startable(target *StreamTarget) bool {
+	if _, failed := s.failedTargets[target]; failed {
+		return false
+	}
+	return s.breakerState(target) != BreakerOpen
+}
+
 // Initialize sets up persistent FFmpeg processes for all targets
 func (s *Streamer) Initialize() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	return s.initialize()
+}
+
+// initialize does the work of Initialize; the caller must hold s.mu
+func (s *Streamer) initialize() error {
 	if s.initialized {
 		return nil // Already initialized
 	}
@@ -105,18 +911,22 @@ func (s *Streamer) Initialize() error {
 		return errors.New("no streaming targets specified")
 	}
 
-	var initErrors []string
+	var initErrors []error
 
 	for _, target := range s.targets {
+		if !s.startable(target) {
+			continue
+		}
 		if err := s.initializeTarget(target); err != nil {
-			initErrors = append(initErrors, fmt.Sprintf("%s: %v", target.Type, err))
+			s.recordFailure(target, err)
+			initErrors = append(initErrors, fmt.Errorf("%s: %w", target.Type, err))
 		}
 	}
 
 	if len(initErrors) > 0 {
 		// Clean up any successful initializations
-		s.Cleanup()
-		return fmt.Errorf("initialization errors: %s", strings.Join(initErrors, "; "))
+		s.cleanup()
+		return fmt.Errorf("initialization errors: %w", errors.Join(initErrors...))
 	}
 
 	s.initialized = true
@@ -124,28 +934,61 @@ func (s *Streamer) Initialize() error {
 }
 
 func (s *Streamer) initializeTarget(target *StreamTarget) error {
+	// Files that get the stream as is are written without FFmpeg
+	if target.Type == StreamTypeFile && target.Profile == nil {
+		file := &fileTarget{target: target, preamble: func() []byte { return s.preamble }}
+		if err := file.open(); err != nil {
+			return err
+		}
+		s.persistentStdinPipes[target] = file
+		s.joining[target] = struct{}{}
+		s.recordStarted(target)
+		return nil
+	}
+
 	// Construct FFmpeg command to stream to the target in a persistent mode
 	args := []string{
 		"-fflags", "nobuffer", // Reduce latency
 		"-re",          // Read input at native frame rate
 		"-i", "pipe:0", // Read from stdin without specifying format
-		"-c:v", "copy", // Copy video codec
+	}
+
+	// Copy the video unless the target's profile asks for transcoding
+	if target.Profile != nil {
+		args = append(args, target.Profile.videoArgs()...)
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+
+	args = append(args,
 		"-c:a", "copy", // Copy audio codec
 		"-c:s", "copy", // Copy subtitles
 		"-f", "flv", // Output format (FLV for RTMP)
-	}
+	)
 
-	// Add authentication if provided
-	outputURL := target.URL
-	if target.AuthToken != "" {
-		switch target.Type {
-		case StreamTypeTwitch, StreamTypeYouTube:
-			outputURL = fmt.Sprintf("%s?auth=%s", target.URL, target.AuthToken)
+	if target.Type == StreamTypeFile {
+		output, err := target.filePath(time.Now())
+		if err != nil {
+			return err
 		}
+		if target.RotateDuration > 0 {
+			// The segment muxer names every file by when it starts
+			output = strings.ReplaceAll(target.Path, fileTimestampPlaceholder, fileTimestampStrftime)
+			args = args[:len(args)-2]
+			args = append(args,
+				"-f", "segment",
+				"-segment_format", "flv",
+				"-segment_time", strconv.FormatFloat(target.RotateDuration.Seconds(), 'f', -1, 64),
+				"-strftime", "1",
+			)
+		}
+		args = append(args, output)
+	} else {
+		// Add authentication if provided
+		args = append(args, target.OutputURL())
 	}
-	args = append(args, outputURL)
 
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := procs.FFmpeg(args...)
 
 	// Create stdin pipe to send video data
 	stdin, err := cmd.StdinPipe()
@@ -153,98 +996,454 @@ func (s *Streamer) initializeTarget(target *StreamTarget) error {
 		return fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 
-	// Redirect stderr to a file or logger rather than buffering it all in memory
-	cmd.Stderr = os.Stderr
+	// Pass stderr through, keeping only its tail to classify failures
+	tail := procs.NewTailBuffer(stderrTailSize)
+	cmd.Stderr = io.MultiWriter(os.Stderr, tail)
 
 	// Start the command
-	if err := cmd.Start(); err != nil {
+	proc, err := procs.Start(cmd, procs.Options{
+		Role:    procs.RoleTarget,
+		Secrets: target.secrets(),
+		Stderr:  true,
+	})
+	if err != nil {
 		stdin.Close()
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
 	// Store the command and stdin pipe for this target
-	s.persistentCmds[target] = cmd
+	s.persistentCmds[target] = proc
 	s.persistentStdinPipes[target] = stdin
+	s.stderrTails[target] = tail
 
+	// A new process needs the stream header before any data, and can only
+	// decode from the next keyframe on
+	if len(s.preamble) > 0 {
+		if _, err := stdin.Write(s.preamble); err != nil {
+			s.cleanupTarget(target)
+			return fmt.Errorf("failed to write stream preamble: %w", err)
+		}
+	}
+	s.joining[target] = struct{}{}
+
+	s.recordStarted(target)
 	return nil
 }
 
-// Stream sends a chunk of video data to all initialized streaming targets
+// Targets returns the targets of the streamer
+func (s *Streamer) Targets() []*StreamTarget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.targets)
+}
+
+// AddTarget adds target to the streamer and returns its status. It is
+// started with the next data streamed and joins at the next keyframe.
+func (s *Streamer) AddTarget(target *StreamTarget) (TargetStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.targets {
+		if existing.OutputURL() == target.OutputURL() {
+			return TargetStatus{}, fmt.Errorf("%w: %s", ErrDuplicateTarget, target.RedactedURL())
+		}
+	}
+	s.targets = append(s.targets, target)
+	return s.targetStatus(len(s.targets)-1, target), nil
+}
+
+// Disable stops streaming to target for the rest of the session, reporting
+// err as the reason
+func (s *Streamer) Disable(target *StreamTarget, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proc, ok := s.persistentCmds[target]; ok {
+		proc.ExpectExit()
+	}
+	s.cleanupTarget(target)
+	s.failedTargets[target] = err
+}
+
+// Tee receives a copy of what is streamed to the targets, like a local
+// preview. Its methods are called with the streamer locked and must not
+// block.
+type Tee interface {
+	SetPreamble(preamble []byte)
+	Write(data []byte)
+	// End is called once the streamer is cleaned up
+	End()
+}
+
+// SetTee sets what gets a copy of the stream, whether or not the targets
+// take it
+func (s *Streamer) SetTee(tee Tee) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tee = tee
+}
+
+// SetPreamble sets the data written to every target process when it starts,
+// before any streamed data, such as the FLV header and sequence headers
+func (s *Streamer) SetPreamble(preamble []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.preamble = append([]byte(nil), preamble...)
+	if s.tee != nil {
+		s.tee.SetPreamble(preamble)
+	}
+}
+
+// Stream sends a chunk of video data to all initialized streaming targets.
+// The chunk must start at a keyframe, like the chunks of the pipeline do.
 func (s *Streamer) Stream(data []byte) error {
+	return s.stream(data, true)
+}
+
+// StreamPart sends data that continues what was streamed before, such as a
+// single tag of a relayed stream. Targets started since the last keyframe
+// skip it, they couldn't decode it.
+func (s *Streamer) StreamPart(data []byte) error {
+	return s.stream(data, false)
+}
+
+// stream does the work of Stream and StreamPart
+func (s *Streamer) stream(data []byte, keyframe bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.tee != nil {
+		s.tee.Write(data)
+	}
+
 	if !s.initialized {
-		if err := s.Initialize(); err != nil {
+		if err := s.initialize(); err != nil {
 			return fmt.Errorf("failed to initialize streaming: %w", err)
 		}
 	}
 
-	var streamErrors []string
+	var streamErrors []error
 
 	// Send data to all targets concurrently
 	var wg sync.WaitGroup
-	errCh := make(chan error, len(s.targets))
+	errCh := make(chan error, 2*len(s.targets)) // A write and a reinitialize error per target
+	failedCh := make(chan failedWrite, len(s.targets))
+
+	// Targets whose breaker was reset or whose cooldown has elapsed are
+	// started again
+	for _, target := range s.targets {
+		if _, ok := s.persistentStdinPipes[target]; ok || !s.startable(target) {
+			continue
+		}
+		if err := s.initializeTarget(target); err != nil {
+			errCh <- fmt.Errorf("failed to restart target %s: %w", target.Type, err)
+			s.recordFailure(target, err)
+		}
+	}
 
 	for _, target := range s.targets {
+		pipe, ok := s.persistentStdinPipes[target]
+		if !ok {
+			continue
+		}
+		if _, ok := s.joining[target]; ok {
+			if !keyframe {
+				continue
+			}
+			delete(s.joining, target)
+		}
+		if file, ok := pipe.(*fileTarget); ok {
+			file.keyframe = keyframe
+		}
+
 		wg.Add(1)
 
-		go func(target *StreamTarget) {
+		go func(target *StreamTarget, pipe io.Writer) {
 			defer wg.Done()
 
-			pipe, ok := s.persistentStdinPipes[target]
-			if !ok {
-				errCh <- fmt.Errorf("no stdin pipe for target %s", target.Type)
-				return
-			}
-
 			if _, err := pipe.Write(data); err != nil {
-				errCh <- fmt.Errorf("error writing to target %s: %w", target.Type, err)
-
-				// Try to reinitialize this target
-				s.mu.Lock()
-				s.cleanupTarget(target)
-				if err := s.initializeTarget(target); err != nil {
-					errCh <- fmt.Errorf("failed to reinitialize target %s: %w", target.Type, err)
-				}
-				s.mu.Unlock()
+				failedCh <- failedWrite{target: target, err: err}
 			}
-		}(target)
+		}(target, pipe)
 	}
 
 	// Wait for all writing goroutines to complete
 	wg.Wait()
+	close(failedCh)
+
+	var failedWrites []failedWrite
+	for failed := range failedCh {
+		failedWrites = append(failedWrites, failed)
+	}
+	for target := range s.persistentStdinPipes {
+		if !slices.ContainsFunc(failedWrites, func(failed failedWrite) bool { return failed.target == target }) {
+			s.recordStreaming(target)
+		}
+	}
+
+	// Try to reinitialize the targets whose write failed, unless that opens
+	// their breaker
+	for _, failed := range failedWrites {
+		target := failed.target
+
+		// Read the output only once FFmpeg has exited and written all of it
+		tail := s.stderrTails[target]
+		s.cleanupTarget(target)
+
+		// Files written without FFmpeg report the write error itself
+		err := failed.err
+		if tail != nil {
+			err = classifyFFmpegError(tail.String())
+		}
+		errCh <- fmt.Errorf("error writing to target %s: %w", target.Type, err)
+
+		if s.recordFailure(target, err) {
+			continue
+		}
+
+		if err := s.initializeTarget(target); err != nil {
+			errCh <- fmt.Errorf("failed to reinitialize target %s: %w", target.Type, err)
+			s.recordFailure(target, err)
+		}
+	}
 	close(errCh)
 
 	// Collect any errors
 	for err := range errCh {
-		streamErrors = append(streamErrors, err.Error())
+		streamErrors = append(streamErrors, err)
+	}
+
+	if len(s.failedTargets) == len(s.targets) {
+		causes := make([]error, 0, len(s.failedTargets))
+		for _, err := range s.failedTargets {
+			causes = append(causes, err)
+		}
+		streamErrors = append(streamErrors, fmt.Errorf("all targets failed permanently: %w", errors.Join(causes...)))
 	}
 
 	if len(streamErrors) > 0 {
-		return fmt.Errorf("streaming errors: %s", strings.Join(streamErrors, "; "))
+		return fmt.Errorf("streaming errors: %w", errors.Join(streamErrors...))
+	}
+
+	return nil
+}
+
+// failedWrite is a target a write of Stream failed for
+type failedWrite struct {
+	target *StreamTarget
+	err    error
+}
+
+// filePath returns the path of the file a file target opens at now
+func (t *StreamTarget) filePath(now time.Time) (string, error) {
+	path := strings.ReplaceAll(t.Path, fileTimestampPlaceholder, now.Format(fileTimestampLayout))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// fileTarget writes the stream of a file target directly. It takes the
+// place of the stdin pipe of an FFmpeg process, so it is only used with the
+// streamer's lock held.
+type fileTarget struct {
+	target   *StreamTarget
+	preamble func() []byte // The streamer's current preamble
+
+	file     *os.File
+	written  int64     // Bytes written to the current file
+	openedAt time.Time // When the current file was opened
+	keyframe bool      // Whether the next write starts at a keyframe
+}
+
+// open opens the next file and writes the preamble to it. An existing file is
+// appended to, without a second FLV file header.
+func (f *fileTarget) open() error {
+	now := time.Now()
+	path, err := f.target.filePath(now)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open %s: %w", path, err)
 	}
 
+	preamble := f.preamble()
+	if info.Size() > 0 && len(preamble) >= flv.FileHeaderSize {
+		preamble = preamble[flv.FileHeaderSize:]
+	}
+	if _, err := file.Write(preamble); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write stream preamble: %w", err)
+	}
+
+	f.file, f.written, f.openedAt = file, int64(len(preamble)), now
 	return nil
 }
 
-// Cleanup closes all persistent FFmpeg processes
+// Write writes data to the current file, first starting a new one if the
+// current one is due for rotation. Files are only cut where the data starts
+// at a keyframe, so every file can be played on its own. Without a preamble
+// files aren't rotated.
+func (f *fileTarget) Write(data []byte) (int, error) {
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := (f.target.RotateSize > 0 && f.written+int64(len(data)) > f.target.RotateSize) ||
+		(f.target.RotateDuration > 0 && time.Since(f.openedAt) >= f.target.RotateDuration)
+	if full && f.keyframe && len(f.preamble()) > 0 && f.written > int64(len(f.preamble())) {
+		if err := f.Close(); err != nil {
+			return 0, err
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.written += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (f *fileTarget) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// TargetStatus describes the health of a streaming target
+type TargetStatus struct {
+	ID      int    `json:"id"` // Index in the target list
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+
+	Breaker         string     `json:"breaker"`                     // BreakerClosed, BreakerOpen, or BreakerHalfOpen
+	Failures        int        `json:"failures"`                    // Failed starts in a row
+	LastError       string     `json:"last_error,omitempty"`        // Of the last failed start
+	BreakerOpenedAt *time.Time `json:"breaker_opened_at,omitempty"` // Set while not closed
+	BreakerRetryAt  *time.Time `json:"breaker_retry_at,omitempty"`  // When an open breaker lets the target be started again
+}
+
+// TargetStatuses reports the health of every target. Targets that failed
+// permanently or whose breaker is open are unhealthy.
+func (s *Streamer) TargetStatuses() []TargetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]TargetStatus, 0, len(s.targets))
+	for id, target := range s.targets {
+		statuses = append(statuses, s.targetStatus(id, target))
+	}
+	return statuses
+}
+
+// targetStatus returns the status of target; the caller must hold s.mu
+func (s *Streamer) targetStatus(id int, target *StreamTarget) TargetStatus {
+	status := TargetStatus{ID: id, Target: target.RedactedURL(), Healthy: true, Breaker: s.breakerState(target)}
+	if b, ok := s.breakers[target]; ok {
+		status.Failures = b.failures
+		if b.lastErr != nil {
+			status.LastError = target.redact(b.lastErr.Error())
+		}
+		if !b.openedAt.IsZero() {
+			openedAt := b.openedAt
+			status.BreakerOpenedAt = &openedAt
+			if s.breakerOptions.Cooldown > 0 {
+				retryAt := openedAt.Add(s.breakerOptions.Cooldown)
+				status.BreakerRetryAt = &retryAt
+			}
+		}
+	}
+	if status.Breaker == BreakerOpen {
+		status.Healthy = false
+		status.Error = "circuit breaker open: " + status.LastError
+	}
+	if err, failed := s.failedTargets[target]; failed {
+		status.Healthy = false
+		status.Error = target.redact(err.Error())
+	}
+	return status
+}
+
+// classifyFFmpegError derives the cause of a failed target from the tail of
+// its FFmpeg output
+func classifyFFmpegError(stderr string) error {
+	detail := lastLine(stderr)
+
+	for _, pattern := range authRejectedPatterns {
+		if strings.Contains(stderr, pattern) {
+			return fmt.Errorf("%w: %s", ErrAuthRejected, detail)
+		}
+	}
+	for _, pattern := range unreachablePatterns {
+		if strings.Contains(stderr, pattern) {
+			return fmt.Errorf("%w: %s", ErrTargetUnreachable, detail)
+		}
+	}
+
+	if detail == "" {
+		return errors.New("ffmpeg exited")
+	}
+	return fmt.Errorf("ffmpeg exited: %s", detail)
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Cleanup closes all persistent FFmpeg processes and ends the tee
 func (s *Streamer) Cleanup() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.cleanup()
+	if s.tee != nil {
+		s.tee.End()
+	}
+}
+
+// cleanup does the work of Cleanup; the caller must hold s.mu
+func (s *Streamer) cleanup() {
+	// Closing stdin first lets every FFmpeg process flush what it has
+	// buffered to its target before it exits
+	for _, proc := range s.persistentCmds {
+		proc.ExpectExit()
+	}
 	for target, pipe := range s.persistentStdinPipes {
 		pipe.Close()
 		delete(s.persistentStdinPipes, target)
 	}
 
-	for target, cmd := range s.persistentCmds {
-		if cmd.Process != nil {
-			cmd.Process.Signal(os.Interrupt)
-			cmd.Wait() // Wait for the process to exit
-		}
+	var wg sync.WaitGroup
+	for target, proc := range s.persistentCmds {
+		wg.Add(1)
+		go func(proc *procs.Process) {
+			defer wg.Done()
+			stopProcess(proc)
+		}(proc)
 		delete(s.persistentCmds, target)
 	}
+	wg.Wait()
+
+	for target := range s.stderrTails {
+		delete(s.stderrTails, target)
+	}
+	clear(s.joining)
 
 	s.initialized = false
 }
@@ -255,13 +1454,37 @@ func (s *Streamer) cleanupTarget(target *StreamTarget) {
 		delete(s.persistentStdinPipes, target)
 	}
 
-	if cmd, ok := s.persistentCmds[target]; ok {
-		if cmd.Process != nil {
-			cmd.Process.Signal(os.Interrupt)
-			cmd.Wait() // Wait for the process to exit
-		}
+	if proc, ok := s.persistentCmds[target]; ok {
+		stopProcess(proc)
 		delete(s.persistentCmds, target)
 	}
+
+	delete(s.stderrTails, target)
+	delete(s.joining, target)
+}
+
+// flushTimeout is how long a target FFmpeg process gets to flush and exit on
+// its own after its stdin is closed, and again after being interrupted
+const flushTimeout = 5 * time.Second
+
+// stopProcess waits for an FFmpeg process whose stdin has been closed to exit,
+// escalating to an interrupt and finally a kill if it doesn't
+func stopProcess(proc *procs.Process) {
+	exited := proc.Done()
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(flushTimeout):
+	}
+
+	proc.Signal(os.Interrupt)
+	select {
+	case <-exited:
+	case <-time.After(flushTimeout):
+		proc.Kill()
+		<-exited
+	}
 }
 
 // streamToTarget is kept for backward compatibility but is deprecated
@@ -277,23 +1500,9 @@ func (s *Streamer) streamToTarget(data []byte, target *StreamTarget) error {
 		"-f", "flv", // Output format (FLV for RTMP)
 	}
 
-	// Add authentication if provided
-	if target.AuthToken != "" {
-		switch target.Type {
-		case StreamTypeTwitch:
-			// For Twitch, the auth token is typically included in the URL
-			args = append(args, fmt.Sprintf("%s?auth=%s", target.URL, target.AuthToken))
-		case StreamTypeYouTube:
-			// For YouTube, the auth token might be handled differently
-			args = append(args, fmt.Sprintf("%s?auth=%s", target.URL, target.AuthToken))
-		default:
-			args = append(args, target.URL)
-		}
-	} else {
-		args = append(args, target.URL)
-	}
+	args = append(args, target.OutputURL())
 
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := procs.FFmpeg(args...)
 
 	// Create stdin pipe to send video data
 	stdin, err := cmd.StdinPipe()
@@ -306,7 +1515,7 @@ func (s *Streamer) streamToTarget(data []byte, target *StreamTarget) error {
 	cmd.Stderr = &stderr
 
 	// Start the command
-	if err := cmd.Start(); err != nil {
+	if err := procs.Launch(cmd, procs.RoleTarget); err != nil {
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
@@ -320,9 +1529,161 @@ func (s *Streamer) streamToTarget(data []byte, target *StreamTarget) error {
 	}()
 
 	// Wait for the command to complete
-	if err := cmd.Wait(); err != nil {
+	if err := procs.Wait(cmd); err != nil {
 		return fmt.Errorf("ffmpeg streaming failed: %w, output: %s", err, stderr.String())
 	}
 
 	return nil
 }
+
+// Target check results reported by ValidateTargets
+const (
+	CheckOK          = "ok"
+	CheckDNSFail     = "dns-fail"
+	CheckConnectFail = "connect-fail"
+	CheckPublishFail = "publish-fail"
+	CheckWriteFail   = "write-fail" // File targets
+)
+
+// testPublishDuration is the length of the clip published by a test publish
+const testPublishDuration = 2 * time.Second
+
+// validateTimeout bounds each network step of a target check
+const validateTimeout = 5 * time.Second
+
+// TargetCheck is the result of validating a single target
+type TargetCheck struct {
+	Target    string `json:"target"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	Published bool   `json:"published"`
+}
+
+// ValidateTargets checks all targets concurrently. Each target's host is
+// resolved and, for TCP-based protocols, connected to. With testPublish a
+// short color-bars clip is published to the target, which goes live on the
+// target platform.
+func ValidateTargets(ctx context.Context, targets []*StreamTarget, testPublish bool) []TargetCheck {
+	checks := make([]TargetCheck, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target *StreamTarget) {
+			defer wg.Done()
+			checks[i] = validateTarget(ctx, target, testPublish)
+		}(i, target)
+	}
+	wg.Wait()
+
+	return checks
+}
+
+// validateTarget runs the checks for a single target, stopping at the first
+// failing step
+func validateTarget(ctx context.Context, target *StreamTarget, testPublish bool) TargetCheck {
+	check := TargetCheck{Target: target.RedactedURL(), Result: CheckOK}
+
+	fail := func(result string, err error) TargetCheck {
+		check.Result = result
+		// Errors may echo the URL, which contains the stream key
+		check.Error = target.redact(err.Error())
+		return check
+	}
+
+	// A file target only needs a directory it can write to
+	if target.Type == StreamTypeFile {
+		path, err := target.filePath(time.Now())
+		if err != nil {
+			return fail(CheckWriteFail, err)
+		}
+		probe, err := os.CreateTemp(filepath.Dir(path), ".write-check-*")
+		if err != nil {
+			return fail(CheckWriteFail, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		return check
+	}
+
+	parsedURL, err := url.Parse(target.URL)
+	if err != nil {
+		return fail(CheckDNSFail, err)
+	}
+
+	host := parsedURL.Hostname()
+	port := parsedURL.Port()
+	if port == "" {
+		port = defaultPort(parsedURL.Scheme)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(lookupCtx, host); err != nil {
+		return fail(CheckDNSFail, err)
+	}
+
+	// SRT runs over UDP, where there is no connection to test
+	if parsedURL.Scheme != "srt" {
+		dialer := net.Dialer{Timeout: validateTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return fail(CheckConnectFail, err)
+		}
+		conn.Close()
+	}
+
+	if testPublish {
+		if err := publishTestClip(ctx, target); err != nil {
+			return fail(CheckPublishFail, err)
+		}
+		check.Published = true
+	}
+
+	return check
+}
+
+// defaultPort returns the default port of a streaming URL scheme
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "rtmps":
+		return "443"
+	case "srt":
+		return "9000"
+	default:
+		return "1935"
+	}
+}
+
+// publishTestClip publishes a short generated color-bars clip to the target
+func publishTestClip(ctx context.Context, target *StreamTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, testPublishDuration+3*validateTimeout)
+	defer cancel()
+
+	seconds := fmt.Sprintf("%.0f", testPublishDuration.Seconds())
+	args := []string{
+		"-loglevel", "error",
+		"-re",
+		"-f", "lavfi", "-i", "smptebars=size=1280x720:rate=30",
+		"-f", "lavfi", "-i", "sine=frequency=1000:sample_rate=44100",
+		"-t", seconds,
+		"-c:v", "libx264", "-preset", "ultrafast", "-pix_fmt", "yuv420p", "-g", "30",
+		"-c:a", "aac",
+		"-f", "flv",
+	}
+
+	if strings.HasPrefix(target.URL, "srt://") {
+		args[len(args)-1] = "mpegts"
+	}
+	args = append(args, target.OutputURL())
+
+	cmd := procs.FFmpegContext(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := procs.Run(cmd, procs.RoleTarget); err != nil {
+		return fmt.Errorf("test publish failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package streaming
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ben/transcription-proxy/internal/procs"
+)
+
+func TestClassifyFFmpegError(t *testing.T) {
+	tests := []struct {
+		sample string // Captured output in testdata/stderr
+		want   error  // nil if the error stays unclassified
+		detail string // Expected in the message
+	}{
+		{"auth_failed.txt", ErrAuthRejected, "Error opening output file"},
+		{"publish_badname.txt", ErrAuthRejected, "Input/output error"},
+		{"connection_refused.txt", ErrTargetUnreachable, "Connection refused"},
+		{"unresolved_host.txt", ErrTargetUnreachable, "rtmp.example.invalid"},
+		{"broken_pipe.txt", nil, "Error writing trailer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			stderr, err := os.ReadFile(filepath.Join("testdata", "stderr", tt.sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := classifyFFmpegError(string(stderr))
+			for _, sentinel := range []error{ErrAuthRejected, ErrTargetUnreachable} {
+				if errors.Is(got, sentinel) != (sentinel == tt.want) {
+					t.Errorf("classifyFFmpegError() = %v, errors.Is(%v) = %v", got, sentinel, !(sentinel == tt.want))
+				}
+			}
+			if !strings.Contains(got.Error(), tt.detail) {
+				t.Errorf("classifyFFmpegError() = %q, want the last line of the output in it", got)
+			}
+		})
+	}
+}
+
+func TestClassifyFFmpegErrorWithoutOutput(t *testing.T) {
+	if got := classifyFFmpegError(""); got == nil || got.Error() != "ffmpeg exited" {
+		t.Errorf("classifyFFmpegError(\"\") = %v", got)
+	}
+}
+
+func TestCustomTargetOutputURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		auth  string // AuthToken as decoded
+		want  string
+	}{
+		{"no query", "rtmp://media.example.com/live/key", "", "rtmp://media.example.com/live/key"},
+		{"auth token", "rtmp://media.example.com/live/key?auth=s3cret", "s3cret", "rtmp://media.example.com/live/key?auth=s3cret"},
+		{"encoded token", "rtmp://media.example.com/live/key?auth=a%2Bb%26c%3Dd", "a+b&c=d", "rtmp://media.example.com/live/key?auth=a%2Bb%26c%3Dd"},
+		{"token with a space", "rtmp://media.example.com/live/key?auth=two+words", "two words", "rtmp://media.example.com/live/key?auth=two%20words"},
+		{"token with a slash", "rtmp://media.example.com/live/key?auth=a%2Fb", "a/b", "rtmp://media.example.com/live/key?auth=a%2Fb"},
+		{"unicode token", "rtmp://media.example.com/live/key?auth=%C3%BCber", "über", "rtmp://media.example.com/live/key?auth=%C3%BCber"},
+		{"extra parameters kept as given", "rtmp://media.example.com/live/key?token=x%3Dy&app=a+b", "", "rtmp://media.example.com/live/key?token=x%3Dy&app=a+b"},
+		{"extra parameters before auth", "rtmp://media.example.com/live/key?auth=s3cret&sig=abc%2F123", "s3cret", "rtmp://media.example.com/live/key?sig=abc%2F123&auth=s3cret"},
+		{"proxy parameters dropped", "rtmp://media.example.com/live/key?codecs=h264&profile=720p&subtitles=none&token=t", "", "rtmp://media.example.com/live/key?token=t"},
+		{"escaped path kept", "rtmp://media.example.com:1936/live%20app/key", "", "rtmp://media.example.com:1936/live%20app/key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := ParseStreamURL(tt.input, Ingests{}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.Type != StreamTypeCustom {
+				t.Fatalf("type = %v, want custom", target.Type)
+			}
+			if target.AuthToken != tt.auth {
+				t.Errorf("AuthToken = %q, want %q", target.AuthToken, tt.auth)
+			}
+			if got := target.OutputURL(); got != tt.want {
+				t.Errorf("OutputURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomTargetSecretsRedacted(t *testing.T) {
+	target, err := ParseStreamURL("rtmp://media.example.com/live/key?auth=a%2Bb&sig=private", Ingests{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither the token as given nor as sent shows in what is logged of the
+	// arguments
+	args := procs.Redact(target.OutputURL(), target.secrets())
+	for _, secret := range []string{"a+b", "a%2Bb", "private"} {
+		if strings.Contains(args, secret) {
+			t.Errorf("redacted output URL %q shows %q", args, secret)
+		}
+	}
+}
+
+func TestPlatformTargetsRejectAuth(t *testing.T) {
+	for _, input := range []string{"rtmp://localhost/twitch/key?auth=x", "rtmp://localhost/youtube/key?auth=x"} {
+		if _, err := ParseStreamURL(input, Ingests{}, ""); err == nil {
+			t.Errorf("ParseStreamURL(%q) accepted ?auth=", input)
+		}
+	}
+}
+
+func TestParseStreamURLSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "STREAM_KEY"), []byte("file-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "EMPTY"), []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STREAM_KEY", "env-key")
+	t.Setenv("ENV_TOKEN", "env-token")
+	t.Setenv("ENV_PLACEHOLDER", "${STREAM_KEY}")
+
+	tests := []struct {
+		name   string
+		url    string
+		dir    string
+		output string // Expected OutputURL, empty if parsing fails
+		err    string // Expected in the error
+	}{
+		{"secret from the directory", "rtmp://host/live/${STREAM_KEY}", dir, "rtmp://host/live/file-key", ""},
+		{"secret from the environment", "rtmp://host/live/${STREAM_KEY}", "", "rtmp://host/live/env-key", ""},
+		{"environment without the file", "rtmp://host/live/key?auth=${ENV_TOKEN}", dir, "rtmp://host/live/key?auth=env-token", ""},
+		{"values not expanded again", "rtmp://host/live/key?auth=${ENV_PLACEHOLDER}", "", "rtmp://host/live/key?auth=%24%7BSTREAM_KEY%7D", ""},
+		{"missing secret", "rtmp://host/live/${NOPE}", dir, "", "secret NOPE not found"},
+		{"missing secret without a directory", "rtmp://host/live/${NOPE}", "", "", "secret NOPE is not set"},
+		{"empty secret", "rtmp://host/live/${EMPTY}", dir, "", "secret EMPTY is empty"},
+		{"nested placeholder", "rtmp://host/live/${A${STREAM_KEY}}", dir, "", "nested"},
+		{"unterminated placeholder", "rtmp://host/live/${STREAM_KEY", dir, "", "unterminated"},
+		{"invalid name", "rtmp://host/live/${../etc/passwd}", dir, "", "invalid secret name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := ParseStreamURL(tt.url, Ingests{}, tt.dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseStreamURL() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := target.OutputURL(); got != tt.output {
+				t.Errorf("OutputURL() = %q, want %q", got, tt.output)
+			}
+			// The resolved secrets never show
+			for _, secret := range []string{"file-key", "env-key", "env-token"} {
+				if strings.Contains(target.RedactedURL(), secret) {
+					t.Errorf("RedactedURL() = %q shows %q", target.RedactedURL(), secret)
+				}
+			}
+		})
+	}
+}
+
+func TestAddTarget(t *testing.T) {
+	t.Setenv("ADDED_KEY", "added-key")
+	parse := func(url string) *StreamTarget {
+		target, err := ParseStreamURL(url, Ingests{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return target
+	}
+	s := New([]*StreamTarget{parse("rtmp://host/live/first")})
+
+	status, err := s.AddTarget(parse("rtmp://other/live/${ADDED_KEY}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != 1 || !status.Healthy || strings.Contains(status.Target, "added-key") {
+		t.Errorf("status = %+v, want a healthy target 1 with its key hidden", status)
+	}
+	if statuses := s.TargetStatuses(); len(statuses) != 2 || statuses[1].Target != status.Target {
+		t.Errorf("TargetStatuses() = %+v, want the added target last", statuses)
+	}
+
+	// The same output twice would publish the stream twice
+	if _, err := s.AddTarget(parse("rtmp://host/live/first")); !errors.Is(err, ErrDuplicateTarget) {
+		t.Errorf("AddTarget() of an existing target = %v, want %v", err, ErrDuplicateTarget)
+	}
+	if _, err := s.AddTarget(parse("rtmp://host/live/other")); err != nil {
+		t.Errorf("AddTarget() of another key = %v", err)
+	}
+	if targets := s.Targets(); len(targets) != 3 {
+		t.Errorf("got %d targets, want 3", len(targets))
+	}
+}
@@ -2,39 +2,182 @@ package subtitles
 
 import (
 	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/ben/transcription-proxy/internal/bufpool"
+	"github.com/ben/transcription-proxy/internal/procs"
 	"github.com/ben/transcription-proxy/internal/transcriber"
 )
 
 type SubtitleFormat string
 
 const (
-	FormatSRT  SubtitleFormat = "srt"
-	FormatVTT  SubtitleFormat = "vtt"
-	FormatNone SubtitleFormat = "none"
+	FormatSRT SubtitleFormat = "srt"
+	FormatVTT SubtitleFormat = "vtt"
+	FormatASS SubtitleFormat = "ass"
+	// FormatBurned renders the captions into the picture instead of adding
+	// a subtitle track, which re-encodes the video
+	FormatBurned SubtitleFormat = "burned"
+	FormatNone   SubtitleFormat = "none"
 )
 
+// ParseFormat parses the name of a subtitle format as configured
+func ParseFormat(name string) (SubtitleFormat, error) {
+	switch format := SubtitleFormat(strings.ToLower(strings.TrimSpace(name))); format {
+	case FormatSRT, FormatVTT, FormatASS, FormatBurned, FormatNone:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown subtitle format %q, expected srt, vtt, ass, burned, or none", name)
+	}
+}
+
+// Container is the format of the video the captions are embedded into, named
+// like the FFmpeg muxer
+type Container string
+
+const (
+	ContainerFLV      Container = "flv"
+	ContainerMP4      Container = "mp4"
+	ContainerMOV      Container = "mov"
+	ContainerMatroska Container = "matroska"
+	ContainerMPEGTS   Container = "mpegts"
+)
+
+// ErrUnsupportedSubtitles means a container can't carry a subtitle track in
+// the format
+var ErrUnsupportedSubtitles = errors.New("container can't carry the subtitle format")
+
+// containerSpec describes how a container is written to a pipe, and the codec
+// of a subtitle track for every subtitle format it can carry
+type containerSpec struct {
+	muxer  []string
+	codecs map[SubtitleFormat]string
+}
+
+// containers maps every container to its spec. FLV has no subtitle codec
+// players understand, and MPEG-TS only carries bitmap subtitles, which
+// FFmpeg can't encode text to, so neither carries a track.
+var containers = map[Container]containerSpec{
+	ContainerFLV: {muxer: []string{"-f", "flv"}},
+	ContainerMP4: {
+		// Fragmented, as the output can't be seeked back to
+		muxer:  []string{"-f", "mp4", "-movflags", "frag_keyframe+empty_moov"},
+		codecs: map[SubtitleFormat]string{FormatSRT: "mov_text", FormatVTT: "mov_text", FormatASS: "mov_text"},
+	},
+	ContainerMOV: {
+		muxer:  []string{"-f", "mov", "-movflags", "frag_keyframe+empty_moov"},
+		codecs: map[SubtitleFormat]string{FormatSRT: "mov_text", FormatVTT: "mov_text", FormatASS: "mov_text"},
+	},
+	ContainerMatroska: {
+		muxer:  []string{"-f", "matroska"},
+		codecs: map[SubtitleFormat]string{FormatSRT: "srt", FormatVTT: "webvtt", FormatASS: "ass"},
+	},
+	ContainerMPEGTS: {muxer: []string{"-f", "mpegts"}},
+}
+
+// SubtitleCodec returns the FFmpeg codec of a subtitle track in format for
+// container, empty for the formats without a track, burned and none. It
+// fails with ErrUnsupportedSubtitles if the container can't carry the track.
+func SubtitleCodec(format SubtitleFormat, container Container) (string, error) {
+	spec, ok := containers[container]
+	if !ok {
+		return "", fmt.Errorf("unknown container %q", container)
+	}
+	if format == FormatBurned || format == FormatNone {
+		return "", nil
+	}
+	codec, ok := spec.codecs[format]
+	if !ok {
+		return "", fmt.Errorf("%w: %s subtitles in %s", ErrUnsupportedSubtitles, format, container)
+	}
+	return codec, nil
+}
+
+// SubtitleEmbedder embeds captions into video fragments, writing them in its
+// container. As a subtitle sink of the pipeline, it keeps the captions
+// written for a chunk until the video of the chunk is embedded.
 type SubtitleEmbedder struct {
-	format SubtitleFormat
+	format    SubtitleFormat
+	container Container
+	codec     string // Codec of the subtitle track, empty without one
+
+	// cues holds the stream-relative captions written for the chunks whose
+	// video isn't embedded yet, by the stream time of the chunk
+	mu   sync.Mutex
+	cues map[time.Duration][]transcriber.Segment
 }
 
-func New(format SubtitleFormat) *SubtitleEmbedder {
+// New creates an embedder writing captions in format into container. A
+// subtitle track the container can't carry is refused here rather than by
+// FFmpeg for every chunk.
+func New(format SubtitleFormat, container Container) (*SubtitleEmbedder, error) {
+	codec, err := SubtitleCodec(format, container)
+	if err != nil {
+		return nil, err
+	}
 	return &SubtitleEmbedder{
-		format: format,
+		format:    format,
+		container: container,
+		codec:     codec,
+	}, nil
+}
+
+// WriteCues keeps the stream-relative captions of the chunk starting
+// streamTime until its video is embedded
+func (e *SubtitleEmbedder) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cues == nil {
+		e.cues = make(map[time.Duration][]transcriber.Segment)
 	}
+	e.cues[streamTime] = segments
+	return nil
+}
+
+// Embed embeds the captions written for the chunk starting streamTime into
+// its video, which starts videoStart into the stream. It takes the captions
+// whether or not it succeeds, so they are written again for another attempt.
+func (e *SubtitleEmbedder) Embed(videoData []byte, streamTime, videoStart time.Duration) ([]byte, error) {
+	e.mu.Lock()
+	segments := e.cues[streamTime]
+	delete(e.cues, streamTime)
+	e.mu.Unlock()
+
+	return e.EmbedSubtitles(videoData, ChunkRelative(segments, videoStart))
+}
+
+// Close drops the captions of the chunks whose video was never embedded
+func (e *SubtitleEmbedder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cues = nil
+	return nil
 }
 
+// EmbedSubtitles embeds segments, relative to the start of the video, into
+// the video fragment
 func (e *SubtitleEmbedder) EmbedSubtitles(videoData []byte, segments []transcriber.Segment) ([]byte, error) {
 	if e.format == FormatNone || len(segments) == 0 {
 		return videoData, nil
 	}
+	if e.format == FormatBurned {
+		return burnSubtitles(videoData, segments, e.container)
+	}
 
-	subtitleBytes, err := e.generateSubtitleData(segments)
+	subtitleBytes, err := Generate(e.format, segments)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate subtitles: %w", err)
 	}
@@ -42,36 +185,245 @@ func (e *SubtitleEmbedder) EmbedSubtitles(videoData []byte, segments []transcrib
 	return e.embedSubtitleDataIntoVideo(videoData, subtitleBytes)
 }
 
-func (e *SubtitleEmbedder) generateSubtitleData(segments []transcriber.Segment) ([]byte, error) {
+// MinCaptionDisplay is the shortest time a caption carried over into the
+// video of a later chunk is shown
+const MinCaptionDisplay = time.Second
+
+// ChunkRelative returns copies of stream-relative captions on the timeline of
+// a chunk of video starting start into the stream. Captions carried over from
+// before the chunk are clamped to its start and shown for at least
+// MinCaptionDisplay.
+func ChunkRelative(segments []transcriber.Segment, start time.Duration) []transcriber.Segment {
+	relative := make([]transcriber.Segment, len(segments))
+	for i, segment := range segments {
+		segment.Start = max(segment.Start-start.Seconds(), 0)
+		segment.End -= start.Seconds()
+		if minEnd := segment.Start + MinCaptionDisplay.Seconds(); segment.End < minEnd {
+			segment.End = minEnd
+		}
+		relative[i] = segment
+	}
+	return relative
+}
+
+// Generate returns the segments as a complete subtitle file in format
+func Generate(format SubtitleFormat, segments []transcriber.Segment) ([]byte, error) {
 	var buf bytes.Buffer
+	if err := GenerateTo(&buf, format, segments); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	switch e.format {
+// GenerateTo writes the segments to w as a complete subtitle file in format,
+// numbering the cues from 1
+func GenerateTo(w io.Writer, format SubtitleFormat, segments []transcriber.Segment) error {
+	if err := WriteHeader(w, format); err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		if err := WriteCue(w, format, i+1, segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteHeader writes what a subtitle file in format starts with, which is
+// nothing for SRT
+func WriteHeader(w io.Writer, format SubtitleFormat) error {
+	switch format {
 	case FormatSRT:
-		for i, segment := range segments {
-			startTime := formatSRTTime(segment.Start)
-			endTime := formatSRTTime(segment.End)
+		return nil
+	case FormatVTT:
+		return WriteVTTHeader(w, VTTOptions{})
+	case FormatASS:
+		_, err := fmt.Fprint(w, assHeader)
+		return err
+	default:
+		return fmt.Errorf("unsupported subtitle format: %s", format)
+	}
+}
+
+// WriteCue writes a single numbered cue for the segment in the given format
+func WriteCue(w io.Writer, format SubtitleFormat, index int, segment transcriber.Segment) error {
+	var startTime, endTime string
+
+	switch format {
+	case FormatSRT:
+		startTime = formatSRTTime(segment.Start)
+		endTime = formatSRTTime(segment.End)
+	case FormatVTT:
+		return WriteVTTCue(w, index, segment, VTTOptions{})
+	case FormatASS:
+		// ASS events aren't numbered, and mark line breaks with \N
+		text := strings.ReplaceAll(sanitizeCueText(segment.Text, format), "\n", `\N`)
+		_, err := fmt.Fprintf(w, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n", formatASSTime(segment.Start), formatASSTime(segment.End), text)
+		return err
+	default:
+		return fmt.Errorf("unsupported subtitle format: %s", format)
+	}
+
+	text := sanitizeCueText(segment.Text, format)
+	_, err := fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", index, startTime, endTime, text)
+	return err
+}
 
-			fmt.Fprintf(&buf, "%d\n", i+1)
-			fmt.Fprintf(&buf, "%s --> %s\n", startTime, endTime)
-			fmt.Fprintf(&buf, "%s\n\n", segment.Text)
+// VTTOptions are the optional parts of WebVTT files
+type VTTOptions struct {
+	// CueSettings follow the timing of every cue to place it, such as
+	// "line:85% align:center"
+	CueSettings string
+	// MPEGTS, if set, is the MPEG-TS timestamp in 90 kHz ticks that cue time
+	// 0 maps to, written as an X-TIMESTAMP-MAP header so HLS players align
+	// the cues with the video segments
+	MPEGTS int64
+}
+
+// vttCueSettings are the names of the WebVTT cue settings
+var vttCueSettings = []string{"vertical", "line", "position", "size", "align", "region"}
+
+// Validate checks that the cue settings are WebVTT cue settings, each set
+// once, and the timestamp map isn't negative
+func (o VTTOptions) Validate() error {
+	seen := make(map[string]bool)
+	for _, setting := range strings.Fields(o.CueSettings) {
+		name, value, ok := strings.Cut(setting, ":")
+		if !ok || value == "" || strings.Contains(value, "-->") {
+			return fmt.Errorf("invalid cue setting %q, expected name:value", setting)
+		}
+		if !slices.Contains(vttCueSettings, name) {
+			return fmt.Errorf("unknown cue setting %q, expected one of %s", name, strings.Join(vttCueSettings, ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("cue setting %q is set twice", name)
 		}
+		seen[name] = true
+	}
+	if o.MPEGTS < 0 {
+		return fmt.Errorf("negative MPEG-TS timestamp %d", o.MPEGTS)
+	}
+	return nil
+}
+
+// WriteVTTHeader writes what a WebVTT file starts with: the signature, the
+// timestamp map if there is one, and the blank line ending the header
+func WriteVTTHeader(w io.Writer, opts VTTOptions) error {
+	header := "WEBVTT\n"
+	if opts.MPEGTS > 0 {
+		header += fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", opts.MPEGTS)
+	}
+	_, err := fmt.Fprint(w, header+"\n")
+	return err
+}
+
+// WriteVTTCue writes a single numbered WebVTT cue for the segment, followed
+// by the blank line that ends it
+func WriteVTTCue(w io.Writer, index int, segment transcriber.Segment, opts VTTOptions) error {
+	timing := formatVTTTime(segment.Start) + " --> " + formatVTTTime(segment.End)
+	if settings := strings.Join(strings.Fields(opts.CueSettings), " "); settings != "" {
+		timing += " " + settings
+	}
+	_, err := fmt.Fprintf(w, "%d\n%s\n%s\n\n", index, timing, sanitizeCueText(segment.Text, FormatVTT))
+	return err
+}
+
+// maxCueBytes bounds the text of a single cue
+const maxCueBytes = 1024
+
+var (
+	// timingArrow matches sequences that would read as a cue timing line
+	timingArrow = regexp.MustCompile(`-{2,}>`)
+	// assOverride matches ASS override blocks, which players rendering SRT
+	// through libass interpret
+	assOverride = regexp.MustCompile(`\{\\[^}]*\}?`)
+	// markupTag matches HTML-like tags, which SRT players render as markup
+	markupTag = regexp.MustCompile(`</?[a-zA-Z][^<>]*>`)
+	// controlRun matches runs of control characters other than newlines
+	controlRun = regexp.MustCompile(`[\x00-\x09\x0B-\x1F\x7F-\x9F]+`)
+)
+
+// vttEscaper escapes the characters WebVTT cue text reserves for markup
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// assEscaper replaces the characters ASS reserves for override blocks and
+// escape sequences, which it has no way to escape, with lookalikes
+var assEscaper = strings.NewReplacer("{", "(", "}", ")", `\`, "＼")
+
+// assHeader starts an ASS file with a single style for the captions, white
+// text with a black outline at the bottom center
+const assHeader = `[Script Info]
+ScriptType: v4.00+
+PlayResX: 384
+PlayResY: 288
+WrapStyle: 2
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,Arial,16,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,0,0,0,0,100,100,0,0,1,1,0,2,10,10,10,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// sanitizeCueText makes caption text safe to write as a cue in format: invalid
+// UTF-8 is replaced, line endings are normalized, control characters collapsed
+// to spaces, blank lines removed so the cue can't end early, timing arrows
+// broken up, and markup and ASS override tags stripped or escaped. The result
+// is at most maxCueBytes.
+func sanitizeCueText(text string, format SubtitleFormat) string {
+	text = strings.ToValidUTF8(text, "\uFFFD")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = controlRun.ReplaceAllString(text, " ")
+
+	// Removing one sequence can join the text around it into another, so
+	// strip until nothing changes
+	for {
+		stripped := assOverride.ReplaceAllString(text, "")
+		if format != FormatVTT {
+			stripped = markupTag.ReplaceAllString(stripped, "")
+		}
+		stripped = timingArrow.ReplaceAllString(stripped, "->")
+		if stripped == text {
+			break
+		}
+		text = stripped
+	}
+	switch format {
 	case FormatVTT:
-		fmt.Fprintln(&buf, "WEBVTT")
-		fmt.Fprintln(&buf, "")
+		text = vttEscaper.Replace(text)
+	case FormatASS:
+		text = assEscaper.Replace(text)
+	}
 
-		for i, segment := range segments {
-			startTime := formatVTTTime(segment.Start)
-			endTime := formatVTTTime(segment.End)
+	// Drop blank lines, which would end the cue
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	text = strings.Join(kept, "\n")
+
+	if len(text) > maxCueBytes {
+		text = truncateUTF8(text, maxCueBytes)
 
-			fmt.Fprintf(&buf, "%d\n", i+1)
-			fmt.Fprintf(&buf, "%s --> %s\n", startTime, endTime)
-			fmt.Fprintf(&buf, "%s\n\n", segment.Text)
+		// Don't leave half an escaped character behind
+		if amp := strings.LastIndexByte(text, '&'); format == FormatVTT && amp > strings.LastIndexByte(text, ';') {
+			text = strings.TrimSpace(text[:amp])
 		}
-	default:
-		return nil, fmt.Errorf("unsupported subtitle format: %s", e.format)
 	}
+	return text
+}
 
-	return buf.Bytes(), nil
+// truncateUTF8 shortens text to at most n bytes without splitting a character
+func truncateUTF8(text string, n int) string {
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return strings.TrimSpace(text[:n])
 }
 
 func (e *SubtitleEmbedder) embedSubtitleDataIntoVideo(videoData, subtitleData []byte) ([]byte, error) {
@@ -83,14 +435,14 @@ func (e *SubtitleEmbedder) embedSubtitleDataIntoVideo(videoData, subtitleData []
 		"-i", "pipe:3", // Read subtitles from file descriptor 3
 		"-c:v", "copy", // Copy video codec
 		"-c:a", "copy", // Copy audio codec
-		"-c:s", "mov_text", // Use mov_text codec for subtitles
+		"-c:s", e.codec, // Subtitle codec of the container
 		"-metadata:s:s:0", "language=eng", // Set subtitle language to English
-		"-y",        // Overwrite output file if it exists
-		"-f", "flv", // Specify FLV output format (better for streaming)
-		"pipe:1", // Output to stdout
+		"-y", // Overwrite output file if it exists
 	}
+	args = append(args, containers[e.container].muxer...)
+	args = append(args, "pipe:1") // Output to stdout
 
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := procs.FFmpeg(args...)
 
 	// Setup the stdin pipe for video data
 	stdin, err := cmd.StdinPipe()
@@ -98,17 +450,13 @@ func (e *SubtitleEmbedder) embedSubtitleDataIntoVideo(videoData, subtitleData []
 		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 
-	// Setup stdout pipe to capture the processed video
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
-	}
-
-	// Setup stderr pipe to capture any error messages
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create stderr pipe: %w", err)
-	}
+	// Capture the processed video and any error messages. The registry waits
+	// for the process right away, so these can't be pipes read afterwards.
+	// The video comes out about as large as it went in.
+	output := bytes.NewBuffer(bufpool.Video.Get(len(videoData))[:0])
+	var stderrOutput bytes.Buffer
+	cmd.Stdout = output
+	cmd.Stderr = &stderrOutput
 
 	// Create a pipe for subtitle data
 	subtitleRead, subtitleWrite, err := os.Pipe()
@@ -122,7 +470,8 @@ func (e *SubtitleEmbedder) embedSubtitleDataIntoVideo(videoData, subtitleData []
 	cmd.ExtraFiles = []*os.File{subtitleRead}
 
 	// Start the command
-	if err := cmd.Start(); err != nil {
+	proc, err := procs.Start(cmd, procs.Options{Role: procs.RoleEmbedder, Stderr: true})
+	if err != nil {
 		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
@@ -144,22 +493,10 @@ func (e *SubtitleEmbedder) embedSubtitleDataIntoVideo(videoData, subtitleData []
 		}
 	}()
 
-	// Read processed video from stdout
-	var output bytes.Buffer
-	if _, err := io.Copy(&output, stdout); err != nil {
-		return nil, fmt.Errorf("failed to read processed video: %w", err)
-	}
-
-	// Read stderr for error messages
-	var stderrOutput bytes.Buffer
-	if _, err := io.Copy(&stderrOutput, stderr); err != nil {
-		return nil, fmt.Errorf("failed to read stderr: %w", err)
-	}
-
 	// Wait for the command to complete
-	err = cmd.Wait()
-	if err != nil {
-		return nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, stderrOutput.String())
+	if err := proc.Wait(); err != nil {
+		inputs := map[string][]byte{"subtitles." + subtitleFormatToFFmpegFormat(e.format): subtitleData}
+		return nil, procs.CommandFailed(cmd, stderrOutput.String(), inputs, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, stderrOutput.String()))
 	}
 
 	return output.Bytes(), nil
@@ -172,27 +509,464 @@ func subtitleFormatToFFmpegFormat(format SubtitleFormat) string {
 		return "srt"
 	case FormatVTT:
 		return "webvtt"
+	case FormatASS:
+		return "ass"
 	default:
 		return "srt"
 	}
 }
 
-func formatSRTTime(seconds float64) string {
-	duration := time.Duration(seconds * float64(time.Second))
-	h := int(duration.Hours())
-	m := int(duration.Minutes()) % 60
-	s := int(duration.Seconds()) % 60
-	ms := int(duration.Milliseconds()) % 1000
+// burnSubtitles renders the segments into the picture of a fragment,
+// re-encoding its video to H.264 and writing it in container
+func burnSubtitles(videoData []byte, segments []transcriber.Segment, container Container) ([]byte, error) {
+	// The subtitles filter only reads files
+	subtitleFile, err := os.CreateTemp("", "captions-*.ass")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subtitle file: %w", err)
+	}
+	defer os.Remove(subtitleFile.Name())
 
-	return fmt.Sprintf("%02d:%02d:%02d,%03d", h, m, s, ms)
+	subtitleData, err := Generate(FormatASS, segments)
+	if err == nil {
+		_, err = subtitleFile.Write(subtitleData)
+	}
+	if closeErr := subtitleFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write subtitle file: %w", err)
+	}
+
+	args := []string{
+		"-loglevel", "error",
+		"-i", "pipe:0",
+		"-vf", "subtitles=" + filterEscaper.Replace(subtitleFile.Name()),
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "copy",
+	}
+	args = append(args, containers[container].muxer...)
+	cmd := procs.FFmpeg(append(args, "pipe:1")...)
+	cmd.Stdin = bytes.NewReader(videoData)
+
+	stdout := bytes.NewBuffer(bufpool.Video.Get(len(videoData))[:0])
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	proc, err := procs.Start(cmd, procs.Options{Role: procs.RoleEmbedder, Stderr: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	if err := proc.Wait(); err != nil {
+		inputs := map[string][]byte{filepath.Base(subtitleFile.Name()): subtitleData}
+		return nil, procs.CommandFailed(cmd, stderr.String(), inputs, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String())))
+	}
+	return stdout.Bytes(), nil
+}
+
+// filterEscaper escapes a file name for use as a filter option value
+var filterEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`, "'", `\'`, ",", `\,`, "[", `\[`, "]", `\]`, ";", `\;`)
+
+// formatASSTime formats seconds as an ASS timestamp, e.g. 1:02:03.04, rounded
+// to the centisecond and clamped like formatTimestamp
+func formatASSTime(seconds float64) string {
+	cs := math.Round(seconds * 100)
+	switch {
+	case math.IsNaN(cs) || cs < 0:
+		cs = 0
+	case cs > float64(maxASSTimestamp.Milliseconds()/10):
+		cs = float64(maxASSTimestamp.Milliseconds() / 10)
+	}
+
+	total := int64(cs)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", total/360000, total/6000%60, total/100%60, total%100)
+}
+
+// maxASSTimestamp is the latest time an ASS timestamp can show, with its
+// single-digit hours
+const maxASSTimestamp = 10*time.Hour - 10*time.Millisecond
+
+// maxTimestamp is the latest time a cue timestamp can show, since players
+// expect two-digit hours
+const maxTimestamp = 100*time.Hour - time.Millisecond
+
+// formatSRTTime formats seconds as an SRT timestamp, e.g. 01:02:03,004
+func formatSRTTime(seconds float64) string {
+	return formatTimestamp(seconds, ',')
 }
 
+// formatVTTTime formats seconds as a WebVTT timestamp, e.g. 01:02:03.004,
+// leaving out the hours, which are optional, while they are 0, e.g. 02:03.004
 func formatVTTTime(seconds float64) string {
-	duration := time.Duration(seconds * float64(time.Second))
-	h := int(duration.Hours())
-	m := int(duration.Minutes()) % 60
-	s := int(duration.Seconds()) % 60
-	ms := int(duration.Milliseconds()) % 1000
+	return strings.TrimPrefix(formatTimestamp(seconds, '.'), "00:")
+}
+
+// formatTimestamp formats seconds rounded to the millisecond, with hours that
+// don't roll over at a day. Negative and NaN times are clamped to zero, and
+// times beyond maxTimestamp to it.
+func formatTimestamp(seconds float64, msSeparator byte) string {
+	ms := math.Round(seconds * 1000)
+	switch {
+	case math.IsNaN(ms) || ms < 0:
+		ms = 0
+	case ms > float64(maxTimestamp.Milliseconds()):
+		ms = float64(maxTimestamp.Milliseconds())
+	}
+
+	total := int64(ms)
+	h := total / 3600000
+	m := total / 60000 % 60
+	s := total / 1000 % 60
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", h, m, s, msSeparator, total%1000)
+}
+
+// minCueDuration is the shortest cue kept by NormalizeTiming, the resolution
+// of the subtitle timestamps
+const minCueDuration = 0.001
+
+// TimingOptions select how NormalizeTiming resolves overlapping segments
+type TimingOptions struct {
+	// MaxOverlap is how many seconds a cue may still be shown once the next
+	// one started
+	MaxOverlap float64
+	// Merge joins overlapping segments into one instead of ending the
+	// earlier one where the next starts
+	Merge bool
+}
+
+// TimingCorrections counts the corrections made by NormalizeTiming
+type TimingCorrections struct {
+	Clamped   int `json:"clamped"`   // Negative times moved to zero
+	Swapped   int `json:"swapped"`   // Ends before their start swapped
+	Reordered int `json:"reordered"` // Segments sorted by their start
+	Trimmed   int `json:"trimmed"`   // Segments ended earlier for the next
+	Merged    int `json:"merged"`    // Segments merged into the one before
+	Dropped   int `json:"dropped"`   // Segments without duration or valid times
+}
+
+// Any reports whether anything was corrected
+func (c TimingCorrections) Any() bool {
+	return c != TimingCorrections{}
+}
+
+// NormalizeTiming returns copies of segments whose times can be embedded:
+// none are negative, every segment ends after it starts, they are sorted by
+// their start, and none is shown longer than opts.MaxOverlap once the next
+// one started. Segments with times that aren't numbers or without duration
+// are dropped.
+func NormalizeTiming(segments []transcriber.Segment, opts TimingOptions) ([]transcriber.Segment, TimingCorrections) {
+	var corrections TimingCorrections
+	maxOverlap := max(opts.MaxOverlap, 0)
+
+	valid := make([]transcriber.Segment, 0, len(segments))
+	for _, segment := range segments {
+		if math.IsNaN(segment.Start) || math.IsNaN(segment.End) || math.IsInf(segment.Start, 0) || math.IsInf(segment.End, 0) {
+			corrections.Dropped++
+			continue
+		}
+		if segment.Start < 0 || segment.End < 0 {
+			segment.Start = max(segment.Start, 0)
+			segment.End = max(segment.End, 0)
+			corrections.Clamped++
+		}
+		if segment.End < segment.Start {
+			segment.Start, segment.End = segment.End, segment.Start
+			corrections.Swapped++
+		}
+		if segment.End-segment.Start < minCueDuration {
+			corrections.Dropped++
+			continue
+		}
+		valid = append(valid, segment)
+	}
+
+	if !slices.IsSortedFunc(valid, compareStart) {
+		slices.SortStableFunc(valid, compareStart)
+		corrections.Reordered++
+	}
+
+	normalized := make([]transcriber.Segment, 0, len(valid))
+	for _, segment := range valid {
+		if len(normalized) == 0 {
+			normalized = append(normalized, segment)
+			continue
+		}
+		prev := &normalized[len(normalized)-1]
+		if segment.Start >= prev.End-maxOverlap {
+			normalized = append(normalized, segment)
+			continue
+		}
+
+		// Ending the earlier segment where the next starts would leave it
+		// without duration if both start together
+		if trimmed := segment.Start + maxOverlap; !opts.Merge && trimmed-prev.Start >= minCueDuration {
+			prev.End = trimmed
+			corrections.Trimmed++
+			normalized = append(normalized, segment)
+			continue
+		}
+		prev.End = max(prev.End, segment.End)
+		prev.Text = strings.TrimSpace(prev.Text + " " + segment.Text)
+		corrections.Merged++
+	}
+	return normalized, corrections
+}
+
+// compareStart orders segments by their start
+func compareStart(a, b transcriber.Segment) int {
+	return cmp.Compare(a.Start, b.Start)
+}
+
+// Break opportunities between two characters of caption text
+const (
+	breakNone = iota
+	breakAllowed
+	breakPreferred
+)
+
+// noBreakBefore are characters a line must not start with: closing brackets,
+// punctuation, small kana, and the prolonged sound mark
+const noBreakBefore = ",.!?;:)]}、。，．！？；：）」』】〕〉》”’ー々ゝゞぁぃぅぇぉっゃゅょゎァィゥェォッャュョヮヵヶ・…"
+
+// noBreakAfter are characters a line must not end with: opening brackets
+const noBreakAfter = "([{（「『【〔〈《“‘"
+
+// breakAfter is punctuation after which a line break reads naturally
+const breakAfter = ",.!?;:、。，．！？；：」』）…"
+
+// particles are the grammatical particles of languages written without spaces
+// after which a line break reads naturally
+var particles = map[string]string{
+	"ja": "はがをにでともへやのかねよ",
+	"zh": "的了着过吗呢吧和与",
+}
+
+// Wrapper breaks caption text into lines that fit a number of display
+// columns, in which East Asian wide characters count as two. Spaced scripts
+// are broken at spaces only; Chinese and Japanese text is broken after
+// punctuation and particles where possible and between any two characters
+// otherwise.
+type Wrapper struct {
+	maxColumns  int
+	langColumns map[string]int
+}
+
+// NewWrapper creates a wrapper for lines of at most maxColumns, or of
+// langColumns[lang] for the languages listed there. A width of 0 disables
+// wrapping.
+func NewWrapper(maxColumns int, langColumns map[string]int) *Wrapper {
+	return &Wrapper{
+		maxColumns:  maxColumns,
+		langColumns: langColumns,
+	}
+}
+
+// Columns returns the line width for lang
+func (w *Wrapper) Columns(lang string) int {
+	if columns, ok := w.langColumns[baseLang(lang)]; ok {
+		return columns
+	}
+	return w.maxColumns
+}
+
+// WrapSegments returns copies of segments with their text wrapped for lang
+func (w *Wrapper) WrapSegments(segments []transcriber.Segment, lang string) []transcriber.Segment {
+	wrapped := make([]transcriber.Segment, len(segments))
+	for i, segment := range segments {
+		wrapped[i] = segment
+		wrapped[i].Text = w.Wrap(segment.Text, lang)
+	}
+	return wrapped
+}
+
+// Wrap breaks text in language lang into lines separated by newlines. Words
+// of spaced scripts longer than a line are not split. The lines of
+// right-to-left languages are marked with MarkRTL.
+func (w *Wrapper) Wrap(text, lang string) string {
+	wrapped := w.wrapLines(text, lang)
+	if IsRTL(lang) {
+		wrapped = MarkRTL(wrapped)
+	}
+	return wrapped
+}
+
+// wrapLines breaks text into lines of at most the width for lang
+func (w *Wrapper) wrapLines(text, lang string) string {
+	columns := w.Columns(lang)
+	if columns <= 0 {
+		return text
+	}
+
+	runes := []rune(strings.TrimSpace(Unwrap(text)))
+	langParticles := particles[baseLang(lang)]
+
+	// offsets[i] is the display width of runes[:i]
+	offsets := make([]int, len(runes)+1)
+	for i, r := range runes {
+		offsets[i+1] = offsets[i] + runeWidth(r)
+	}
+
+	var lines []string
+	start := 0
+	preferred, allowed := -1, -1
+	for i := range runes {
+		if i > start {
+			switch breakBefore(runes[i-1], runes[i], langParticles) {
+			case breakPreferred:
+				preferred, allowed = i, i
+			case breakAllowed:
+				allowed = i
+			}
+		}
+
+		for offsets[i+1]-offsets[start] > columns && allowed > start {
+			// Prefer a natural break unless it leaves the line less than a
+			// third full
+			cut := allowed
+			if preferred > start && offsets[preferred]-offsets[start] >= columns/3 {
+				cut = preferred
+			}
+
+			lines = append(lines, strings.TrimRightFunc(string(runes[start:cut]), unicode.IsSpace))
+			start = cut
+		}
+	}
+	lines = append(lines, string(runes[start:]))
+
+	return strings.Join(lines, "\n")
+}
+
+// Unwrap joins the lines of wrapped caption text, with a space between lines
+// unless either side is a wide character, and removes directional marks
+func Unwrap(text string) string {
+	lines := strings.Split(stripDirectionalMarks(text), "\n")
+
+	var b strings.Builder
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			last, _ := utf8.DecodeLastRuneInString(b.String())
+			first, _ := utf8.DecodeRuneInString(line)
+			if !isWide(last) && !isWide(first) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// Directional formatting characters
+const (
+	rightToLeftEmbedding     = "\u202B"
+	popDirectionalFormatting = "\u202C"
+)
+
+// directionalMarks removes the directional formatting added by MarkRTL
+var directionalMarks = strings.NewReplacer(rightToLeftEmbedding, "", popDirectionalFormatting, "")
+
+// rtlLangs are the languages written right to left
+var rtlLangs = map[string]bool{
+	"ar":  true, // Arabic
+	"ckb": true, // Central Kurdish
+	"dv":  true, // Divehi
+	"fa":  true, // Persian
+	"he":  true, // Hebrew
+	"iw":  true, // Hebrew, legacy code
+	"ps":  true, // Pashto
+	"sd":  true, // Sindhi
+	"ug":  true, // Uyghur
+	"ur":  true, // Urdu
+	"yi":  true, // Yiddish
+}
+
+// IsRTL reports whether lang is written right to left
+func IsRTL(lang string) bool {
+	return rtlLangs[baseLang(lang)]
+}
+
+// MarkRTL wraps every line of text in a right-to-left embedding. Players
+// otherwise lay cues out left to right, which moves punctuation at the ends
+// of lines to the wrong side and reorders numbers and Latin words embedded in
+// the text relative to it.
+func MarkRTL(text string) string {
+	lines := strings.Split(stripDirectionalMarks(text), "\n")
+	for i, line := range lines {
+		lines[i] = rightToLeftEmbedding + line + popDirectionalFormatting
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stripDirectionalMarks removes the marks added by MarkRTL
+func stripDirectionalMarks(text string) string {
+	return directionalMarks.Replace(text)
+}
+
+// breakBefore classifies the break opportunity between prev and next
+func breakBefore(prev, next rune, langParticles string) int {
+	switch {
+	case unicode.IsSpace(next):
+		// Break after the spaces instead
+		return breakNone
+	case unicode.IsSpace(prev):
+		return breakPreferred
+	case !isWide(prev) && !isWide(next):
+		// Inside a word of a spaced script
+		return breakNone
+	case strings.ContainsRune(noBreakBefore, next) || strings.ContainsRune(noBreakAfter, prev):
+		return breakNone
+	case strings.ContainsRune(breakAfter, prev):
+		return breakPreferred
+	case strings.ContainsRune(langParticles, prev) && !isHiragana(next):
+		// A particle followed by hiragana is more likely part of a word
+		return breakPreferred
+	default:
+		return breakAllowed
+	}
+}
+
+// runeWidth returns the number of display columns r takes
+func runeWidth(r rune) int {
+	switch {
+	case unicode.Is(unicode.Mn, r):
+		return 0
+	case isWide(r):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// isWide reports whether r is an East Asian wide or fullwidth character
+func isWide(r rune) bool {
+	switch {
+	case r >= 0x1100 && r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0x303E, // CJK radicals, symbols, and punctuation
+		r >= 0x3041 && r <= 0x33FF, // Kana and CJK compatibility
+		r >= 0x3400 && r <= 0x4DBF, // CJK extension A
+		r >= 0x4E00 && r <= 0x9FFF, // CJK unified ideographs
+		r >= 0xA000 && r <= 0xA4CF, // Yi
+		r >= 0xAC00 && r <= 0xD7A3, // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF, // CJK compatibility ideographs
+		r >= 0xFE30 && r <= 0xFE4F, // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60, // Fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x20000 && r <= 0x3FFFD: // CJK extensions B and later
+		return true
+	default:
+		return false
+	}
+}
+
+// isHiragana reports whether r is a hiragana character
+func isHiragana(r rune) bool {
+	return unicode.Is(unicode.Hiragana, r)
+}
 
-	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+// baseLang returns the primary language subtag of lang, e.g. zh for zh-TW
+func baseLang(lang string) string {
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	return base
 }
@@ -0,0 +1,710 @@
+package subtitles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/name, or rewrites the file with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// columns returns the display width of a line
+func columns(line string) int {
+	width := 0
+	for _, r := range line {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		lang    string
+		columns int
+		want    string
+	}{
+		{
+			name:    "Japanese breaks after particles",
+			text:    "今日は天気がとても良いので公園に行きました",
+			lang:    "ja",
+			columns: 16,
+			want:    "今日は\n天気がとても\n良いので公園に\n行きました",
+		},
+		{
+			name:    "Japanese keeps brackets and punctuation attached",
+			text:    "「こんにちは」と彼は言った",
+			lang:    "ja",
+			columns: 16,
+			want:    "「こんにちは」と\n彼は言った",
+		},
+		{
+			name:    "Chinese breaks after punctuation",
+			text:    "我们今天去了公园，天气很好，大家都很开心",
+			lang:    "zh-CN",
+			columns: 20,
+			want:    "我们今天去了公园，\n天气很好，\n大家都很开心",
+		},
+		{
+			name:    "Latin word inside Chinese text is not split",
+			text:    "我们在Google的办公室里开会讨论了新的项目计划",
+			lang:    "zh",
+			columns: 20,
+			want:    "我们在Google的\n办公室里开会讨论了\n新的项目计划",
+		},
+		{
+			name:    "English breaks at spaces",
+			text:    "The quick brown fox jumps over the lazy dog",
+			lang:    "en",
+			columns: 20,
+			want:    "The quick brown fox\njumps over the lazy\ndog",
+		},
+		{
+			name:    "word longer than a line stays whole",
+			text:    "Supercalifragilisticexpialidocious is long",
+			lang:    "en",
+			columns: 20,
+			want:    "Supercalifragilisticexpialidocious\nis long",
+		},
+		{
+			name:    "already wrapped text is rewrapped",
+			text:    "The quick\nbrown fox",
+			lang:    "en",
+			columns: 40,
+			want:    "The quick brown fox",
+		},
+		{
+			name:    "wrapping disabled",
+			text:    "今日は天気がとても良いので公園に行きました",
+			lang:    "ja",
+			columns: 0,
+			want:    "今日は天気がとても良いので公園に行きました",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWrapper(tt.columns, nil)
+			got := w.Wrap(tt.text, tt.lang)
+			if got != tt.want {
+				t.Errorf("Wrap() = %q, want %q", got, tt.want)
+			}
+			if unwrapped := Unwrap(got); unwrapped != Unwrap(tt.text) {
+				t.Errorf("Unwrap(Wrap()) = %q, want %q", unwrapped, Unwrap(tt.text))
+			}
+		})
+	}
+}
+
+func TestWrapFitsColumns(t *testing.T) {
+	texts := map[string]string{
+		"ja": "東京タワーの近くでラーメンを食べました。明日は京都へ行く予定です。",
+		"zh": "这是一个没有任何标点符号的很长的中文句子用来测试换行是否正确",
+		"ko": "오늘은 날씨가 정말 좋아서 공원에 산책하러 갔습니다",
+	}
+	for lang, text := range texts {
+		for _, width := range []int{8, 12, 20, 32} {
+			for _, line := range strings.Split(NewWrapper(width, nil).Wrap(text, lang), "\n") {
+				if columns(line) > width {
+					t.Errorf("%s at %d columns: line %q is %d columns wide", lang, width, line, columns(line))
+				}
+				if first := []rune(line)[0]; strings.ContainsRune(noBreakBefore, first) {
+					t.Errorf("%s at %d columns: line %q starts with %q", lang, width, line, first)
+				}
+			}
+		}
+	}
+}
+
+func TestWrapperColumnsByLanguage(t *testing.T) {
+	w := NewWrapper(42, map[string]int{"ja": 26, "zh": 28})
+	tests := map[string]int{"ja": 26, "ja-JP": 26, "zh-TW": 28, "en": 42, "": 42}
+	for lang, want := range tests {
+		if got := w.Columns(lang); got != want {
+			t.Errorf("Columns(%q) = %d, want %d", lang, got, want)
+		}
+	}
+}
+
+func TestRTLGolden(t *testing.T) {
+	// Punctuation at the ends of lines, a number and a Latin name are what
+	// players lay out wrong without the embedding
+	segments := NewWrapper(24, nil).WrapSegments([]transcriber.Segment{
+		{Start: 1, End: 4.5, Text: "مرحبا بكم في البث المباشر رقم 42 مع Google اليوم!"},
+		{Start: 5, End: 7, Text: "هل أنتم مستعدون؟"},
+	}, "ar")
+
+	for _, format := range []SubtitleFormat{FormatSRT, FormatVTT, FormatASS} {
+		t.Run(string(format), func(t *testing.T) {
+			got, err := Generate(format, segments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "rtl_arabic."+string(format), got)
+		})
+	}
+}
+
+func TestMarkRTL(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"single line", "مرحبا!", "\u202Bمرحبا!\u202C"},
+		{"every line", "سطر أول\nسطر ثان", "\u202Bسطر أول\u202C\n\u202Bسطر ثان\u202C"},
+		{"marked twice", MarkRTL("شالوم 2024"), "\u202Bشالوم 2024\u202C"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MarkRTL(tt.text)
+			if got != tt.want {
+				t.Errorf("MarkRTL() = %q, want %q", got, tt.want)
+			}
+			if unwrapped := Unwrap(got); strings.ContainsAny(unwrapped, "\u202B\u202C") {
+				t.Errorf("Unwrap() = %q kept the directional marks", unwrapped)
+			}
+		})
+	}
+}
+
+func TestIsRTL(t *testing.T) {
+	for lang, want := range map[string]bool{"ar": true, "ar-EG": true, "he": true, "FA": true, "en": false, "ja": false, "": false} {
+		if got := IsRTL(lang); got != want {
+			t.Errorf("IsRTL(%q) = %v, want %v", lang, got, want)
+		}
+	}
+}
+
+// timingLine matches the timing line of an SRT or WebVTT cue
+var timingLine = map[SubtitleFormat]*regexp.Regexp{
+	FormatSRT: regexp.MustCompile(`^\d{2}:\d{2}:\d{2},\d{3} --> \d{2}:\d{2}:\d{2},\d{3}$`),
+	FormatVTT: regexp.MustCompile(`^(\d{2}:)?\d{2}:\d{2}\.\d{3} --> (\d{2}:)?\d{2}:\d{2}\.\d{3}$`),
+}
+
+// validateCues parses an SRT or WebVTT file the way players split it, into
+// blocks separated by blank lines, and checks that it holds the n numbered
+// cues written and nothing else
+func validateCues(data []byte, format SubtitleFormat, n int) error {
+	if !utf8.Valid(data) {
+		return fmt.Errorf("invalid UTF-8")
+	}
+	text := string(data)
+	if format == FormatVTT {
+		var ok bool
+		if text, ok = strings.CutPrefix(text, "WEBVTT\n\n"); !ok {
+			return fmt.Errorf("missing WEBVTT header")
+		}
+	}
+
+	cues := 0
+	for _, block := range strings.Split(text, "\n\n") {
+		if strings.Trim(block, "\n") == "" {
+			continue
+		}
+		cues++
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if lines[0] != strconv.Itoa(cues) {
+			return fmt.Errorf("cue %d is numbered %q", cues, lines[0])
+		}
+		if len(lines) < 2 || !timingLine[format].MatchString(lines[1]) {
+			return fmt.Errorf("cue %d has no timing line: %q", cues, block)
+		}
+		body := strings.Join(lines[2:], "\n")
+		if len(body) > maxCueBytes {
+			return fmt.Errorf("cue %d has %d bytes of text", cues, len(body))
+		}
+		if strings.Contains(body, "-->") {
+			return fmt.Errorf("cue %d text has a timing arrow: %q", cues, body)
+		}
+		if strings.Contains(body, `{\`) {
+			return fmt.Errorf("cue %d text has an ASS override: %q", cues, body)
+		}
+		if format == FormatVTT && strings.ContainsAny(body, "<>") {
+			return fmt.Errorf("cue %d text has unescaped markup: %q", cues, body)
+		}
+		if strings.ContainsFunc(body, func(r rune) bool { return r != '\n' && unicode.IsControl(r) }) {
+			return fmt.Errorf("cue %d text has control characters: %q", cues, body)
+		}
+	}
+	if cues != n {
+		return fmt.Errorf("got %d cues, want %d", cues, n)
+	}
+	return nil
+}
+
+// fuzzSeeds are texts that break cue structure without sanitizing
+var fuzzSeeds = []string{
+	"",
+	"plain text",
+	"first\n\nsecond",
+	"line\r\n\r\nbreak\rcarriage",
+	"00:00:01,000 --> 00:00:02,000",
+	"a ---> b --> c",
+	"-{\\b1}->",
+	`{\an8}{\pos(10,10)}moved`,
+	"<b>bold</b> <script>alert(1)</script> <c.red>",
+	"&amp; < > &",
+	"bell\a tab\t nul\x00 del\x7f",
+	"\u0085next line",
+	"invalid \xff\xfe UTF-8",
+	"2\n00:00:05,000 --> 00:00:06,000\ninjected cue",
+	strings.Repeat("é", maxCueBytes),
+	strings.Repeat("&", maxCueBytes),
+}
+
+func fuzzGenerate(f *testing.F, format SubtitleFormat) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed, 1.5)
+	}
+	f.Fuzz(func(t *testing.T, text string, start float64) {
+		segments := []transcriber.Segment{
+			{Start: start, End: start + 1, Text: text},
+			{Start: start + 2, End: start + 3, Text: text},
+		}
+		data, err := Generate(format, segments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateCues(data, format, len(segments)); err != nil {
+			t.Errorf("%v in\n%s", err, data)
+		}
+	})
+}
+
+func FuzzGenerateSRT(f *testing.F) {
+	fuzzGenerate(f, FormatSRT)
+}
+
+func FuzzGenerateVTT(f *testing.F) {
+	fuzzGenerate(f, FormatVTT)
+}
+
+func TestGenerateGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []transcriber.Segment
+	}{
+		{"empty", nil},
+		{"multiline", []transcriber.Segment{
+			{Start: 0, End: 2.5, Text: "First line\nsecond line"},
+			{Start: 3, End: 4, Text: "Blank lines\n\n\nare dropped"},
+		}},
+		{"timestamps", []transcriber.Segment{
+			// Fractional milliseconds are rounded
+			{Start: 1.0004, End: 1.0006, Text: "rounded"},
+			// Hours are only written in WebVTT once they aren't 0
+			{Start: 3599.5, End: 3600.25, Text: "past an hour"},
+			// Hours don't roll over at a day
+			{Start: 90000, End: 90001.5, Text: "past a day"},
+			// Clamped to the latest time with two-digit hours
+			{Start: 360000, End: 400000, Text: "past 99 hours"},
+			// Offsetting can produce negative and NaN times
+			{Start: -3, End: math.NaN(), Text: "clamped to zero"},
+		}},
+		{"unicode", []transcriber.Segment{
+			{Start: 0, End: 1, Text: "Grüße aus Köln 👋"},
+			{Start: 1, End: 2, Text: "東京タワーの近くで"},
+			{Start: 2, End: 3, Text: "<i>markup</i> & --> arrows"},
+		}},
+	}
+	for _, tt := range tests {
+		for _, format := range []SubtitleFormat{FormatSRT, FormatVTT} {
+			t.Run(tt.name+"."+string(format), func(t *testing.T) {
+				got, err := Generate(format, tt.segments)
+				if err != nil {
+					t.Fatal(err)
+				}
+				golden(t, tt.name+"."+string(format), got)
+
+				// GenerateTo writes the same
+				var buf bytes.Buffer
+				if err := GenerateTo(&buf, format, tt.segments); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf.Bytes(), got) {
+					t.Error("GenerateTo() differs from Generate()")
+				}
+			})
+		}
+	}
+}
+
+func TestVTTOptionsGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		opts VTTOptions
+	}{
+		{"vtt_cue_settings", VTTOptions{CueSettings: "line:85%  align:center\tposition:50%"}},
+		{"vtt_timestamp_map", VTTOptions{MPEGTS: 900000}},
+	}
+	segments := []transcriber.Segment{
+		{Start: 0, End: 1.5, Text: "First cue"},
+		{Start: 3599, End: 3601, Text: "Across the hour\n\nwith a blank line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteVTTHeader(&buf, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			for i, segment := range segments {
+				if err := WriteVTTCue(&buf, i+1, segment, tt.opts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden(t, tt.name+".vtt", buf.Bytes())
+			// A blank line ends the header and every cue, and only them
+			if blank := strings.Count(buf.String(), "\n\n"); blank != len(segments)+1 {
+				t.Errorf("%d blank lines, want one after the header and each cue", blank)
+			}
+		})
+	}
+}
+
+func TestVTTOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    VTTOptions
+		wantErr bool
+	}{
+		{"none", VTTOptions{}, false},
+		{"settings", VTTOptions{CueSettings: "line:85% position:50% align:center size:80%"}, false},
+		{"vertical and region", VTTOptions{CueSettings: "vertical:rl region:top"}, false},
+		{"timestamp map", VTTOptions{MPEGTS: 900000}, false},
+		{"no value", VTTOptions{CueSettings: "line:"}, true},
+		{"no colon", VTTOptions{CueSettings: "line"}, true},
+		{"timing arrow", VTTOptions{CueSettings: "line:-->"}, true},
+		{"unknown setting", VTTOptions{CueSettings: "color:red"}, true},
+		{"set twice", VTTOptions{CueSettings: "line:10% line:90%"}, true},
+		{"negative timestamp map", VTTOptions{MPEGTS: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		seconds  float64
+		srt, vtt string
+	}{
+		{0, "00:00:00,000", "00:00.000"},
+		{61.5, "00:01:01,500", "01:01.500"},
+		{0.0005, "00:00:00,001", "00:00.001"},
+		{3600, "01:00:00,000", "01:00:00.000"},
+		{86400 + 0.25, "24:00:00,250", "24:00:00.250"},
+		{359999.999, "99:59:59,999", "99:59:59.999"},
+		{360000, "99:59:59,999", "99:59:59.999"},
+		{math.Inf(1), "99:59:59,999", "99:59:59.999"},
+		{-0.5, "00:00:00,000", "00:00.000"},
+		{math.NaN(), "00:00:00,000", "00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := formatSRTTime(tt.seconds); got != tt.srt {
+			t.Errorf("formatSRTTime(%g) = %q, want %q", tt.seconds, got, tt.srt)
+		}
+		if got := formatVTTTime(tt.seconds); got != tt.vtt {
+			t.Errorf("formatVTTTime(%g) = %q, want %q", tt.seconds, got, tt.vtt)
+		}
+	}
+}
+
+func TestSanitizeCueText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		format SubtitleFormat
+		want   string
+	}{
+		{"plain", "Hello there", FormatSRT, "Hello there"},
+		{"line endings", "one\r\ntwo\rthree", FormatSRT, "one\ntwo\nthree"},
+		{"blank lines", "one\n\n \ntwo", FormatSRT, "one\ntwo"},
+		{"control characters", "bell\a\x00tab\there", FormatSRT, "bell tab here"},
+		{"timing arrow", "a --> b ---> c", FormatSRT, "a -> b -> c"},
+		{"arrow joined by stripping", "-<b>-</b>>", FormatSRT, "->"},
+		{"ASS override in SRT", `{\an8}top`, FormatSRT, "top"},
+		{"markup in SRT", "<font color=red>red</font>", FormatSRT, "red"},
+		{"markup in WebVTT", "<b>bold</b> & co", FormatVTT, "&lt;b&gt;bold&lt;/b&gt; &amp; co"},
+		{"braces in ASS", `{not} a \N tag`, FormatASS, "(not) a ＼N tag"},
+		{"too long", strings.Repeat("a", maxCueBytes+10), FormatSRT, strings.Repeat("a", maxCueBytes)},
+		{"not split in a character", "a" + strings.Repeat("é", maxCueBytes/2), FormatSRT, "a" + strings.Repeat("é", maxCueBytes/2-1)},
+		{"not split in an escape", strings.Repeat("a", maxCueBytes-2) + "&", FormatVTT, strings.Repeat("a", maxCueBytes-2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeCueText(tt.text, tt.format); got != tt.want {
+				t.Errorf("sanitizeCueText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTiming(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TimingOptions
+		segments []transcriber.Segment
+		want     []transcriber.Segment
+		fixed    TimingCorrections
+	}{
+		{
+			"valid left alone",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 0, End: 1, Text: "a"}, {Start: 1, End: 2, Text: "b"}},
+			[]transcriber.Segment{{Start: 0, End: 1, Text: "a"}, {Start: 1, End: 2, Text: "b"}},
+			TimingCorrections{},
+		},
+		{
+			"negative clamped",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: -0.5, End: 1, Text: "a"}},
+			[]transcriber.Segment{{Start: 0, End: 1, Text: "a"}},
+			TimingCorrections{Clamped: 1},
+		},
+		{
+			"inverted swapped",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 2, End: 1, Text: "a"}},
+			[]transcriber.Segment{{Start: 1, End: 2, Text: "a"}},
+			TimingCorrections{Swapped: 1},
+		},
+		{
+			"sorted by start",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 2, End: 3, Text: "b"}, {Start: 0, End: 1, Text: "a"}},
+			[]transcriber.Segment{{Start: 0, End: 1, Text: "a"}, {Start: 2, End: 3, Text: "b"}},
+			TimingCorrections{Reordered: 1},
+		},
+		{
+			"overlap trimmed",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 0, End: 2, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			[]transcriber.Segment{{Start: 0, End: 1, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			TimingCorrections{Trimmed: 1},
+		},
+		{
+			"overlap within the limit",
+			TimingOptions{MaxOverlap: 0.5},
+			[]transcriber.Segment{{Start: 0, End: 1.25, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			[]transcriber.Segment{{Start: 0, End: 1.25, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			TimingCorrections{},
+		},
+		{
+			"overlap trimmed to the limit",
+			TimingOptions{MaxOverlap: 0.5},
+			[]transcriber.Segment{{Start: 0, End: 2, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			[]transcriber.Segment{{Start: 0, End: 1.5, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			TimingCorrections{Trimmed: 1},
+		},
+		{
+			"overlap merged",
+			TimingOptions{Merge: true},
+			[]transcriber.Segment{{Start: 0, End: 2, Text: "a"}, {Start: 1, End: 3, Text: "b"}},
+			[]transcriber.Segment{{Start: 0, End: 3, Text: "a b"}},
+			TimingCorrections{Merged: 1},
+		},
+		{
+			// Trimming would leave the first without duration
+			"same start merged",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 1, End: 2, Text: "a"}, {Start: 1, End: 1.5, Text: "b"}},
+			[]transcriber.Segment{{Start: 1, End: 2, Text: "a b"}},
+			TimingCorrections{Merged: 1},
+		},
+		{
+			"no duration dropped",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: 1, End: 1, Text: "a"}, {Start: 1, End: 2, Text: "b"}},
+			[]transcriber.Segment{{Start: 1, End: 2, Text: "b"}},
+			TimingCorrections{Dropped: 1},
+		},
+		{
+			"invalid times dropped",
+			TimingOptions{},
+			[]transcriber.Segment{{Start: math.NaN(), End: 1, Text: "a"}, {Start: 0, End: math.Inf(1), Text: "b"}},
+			[]transcriber.Segment{},
+			TimingCorrections{Dropped: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fixed := NormalizeTiming(tt.segments, tt.opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeTiming() = %+v, want %+v", got, tt.want)
+			}
+			if fixed != tt.fixed {
+				t.Errorf("corrections = %+v, want %+v", fixed, tt.fixed)
+			}
+			if fixed.Any() != (tt.fixed != TimingCorrections{}) {
+				t.Errorf("Any() = %v for %+v", fixed.Any(), fixed)
+			}
+		})
+	}
+}
+
+// FuzzNormalizeTiming checks that NormalizeTiming yields segments satisfying
+// its invariants for any times, NaN and infinities included. Every 16 bytes
+// of data are the start and end of a segment.
+func FuzzNormalizeTiming(f *testing.F) {
+	f.Add([]byte{}, 0.0, false)
+	f.Add(timingSeed(0, 1, 0.5, 2, -1, 3, 3, 2), 0.0, false)
+	f.Add(timingSeed(0, 1, 0.5, 2, -1, 3, 3, 2), 0.25, true)
+	f.Add(timingSeed(1, 1, math.NaN(), 1, 0, math.Inf(1), math.Inf(-1), -2), 0.1, false)
+	f.Add(timingSeed(5, 6, 1, 2, 1, 2, 1.0005, 1.0001), -1.0, false)
+	f.Fuzz(func(t *testing.T, data []byte, maxOverlap float64, merge bool) {
+		var segments []transcriber.Segment
+		for ; len(data) >= 16; data = data[16:] {
+			segments = append(segments, transcriber.Segment{
+				Start: math.Float64frombits(binary.LittleEndian.Uint64(data)),
+				End:   math.Float64frombits(binary.LittleEndian.Uint64(data[8:])),
+				Text:  strconv.Itoa(len(segments)),
+			})
+		}
+		if math.IsNaN(maxOverlap) || math.IsInf(maxOverlap, 0) {
+			return
+		}
+
+		got, _ := NormalizeTiming(segments, TimingOptions{MaxOverlap: maxOverlap, Merge: merge})
+		if len(got) > len(segments) {
+			t.Fatalf("NormalizeTiming() returned %d segments for %d", len(got), len(segments))
+		}
+		for i, segment := range got {
+			if math.IsNaN(segment.Start) || math.IsNaN(segment.End) || math.IsInf(segment.End, 0) {
+				t.Fatalf("segment %d has invalid times: %+v", i, segment)
+			}
+			if segment.Start < 0 || segment.End-segment.Start < minCueDuration {
+				t.Fatalf("segment %d is negative or too short: %+v", i, segment)
+			}
+			if i == 0 {
+				continue
+			}
+			prev := got[i-1]
+			if segment.Start < prev.Start {
+				t.Fatalf("segment %d starts before the one before: %+v after %+v", i, segment, prev)
+			}
+			// Allow for the rounding of the trimmed end
+			if overlap := prev.End - segment.Start; overlap > max(maxOverlap, 0)+1e-9*max(1, math.Abs(segment.Start)) {
+				t.Fatalf("segment %d overlaps the one before by %gs: %+v after %+v", i, overlap, segment, prev)
+			}
+		}
+	})
+}
+
+// timingSeed encodes times as the data of FuzzNormalizeTiming
+func timingSeed(times ...float64) []byte {
+	data := make([]byte, 8*len(times))
+	for i, seconds := range times {
+		binary.LittleEndian.PutUint64(data[8*i:], math.Float64bits(seconds))
+	}
+	return data
+}
+
+func TestSubtitleCodec(t *testing.T) {
+	tests := []struct {
+		format    SubtitleFormat
+		container Container
+		want      string
+		err       error
+	}{
+		// No track to carry
+		{FormatNone, ContainerFLV, "", nil},
+		{FormatBurned, ContainerFLV, "", nil},
+		{FormatBurned, ContainerMPEGTS, "", nil},
+		{FormatSRT, ContainerFLV, "", ErrUnsupportedSubtitles},
+		{FormatVTT, ContainerFLV, "", ErrUnsupportedSubtitles},
+		{FormatASS, ContainerFLV, "", ErrUnsupportedSubtitles},
+		{FormatSRT, ContainerMP4, "mov_text", nil},
+		{FormatVTT, ContainerMP4, "mov_text", nil},
+		{FormatASS, ContainerMP4, "mov_text", nil},
+		{FormatSRT, ContainerMOV, "mov_text", nil},
+		{FormatASS, ContainerMOV, "mov_text", nil},
+		{FormatSRT, ContainerMatroska, "srt", nil},
+		{FormatVTT, ContainerMatroska, "webvtt", nil},
+		{FormatASS, ContainerMatroska, "ass", nil},
+		// Bitmap subtitles only, which text can't be encoded to
+		{FormatSRT, ContainerMPEGTS, "", ErrUnsupportedSubtitles},
+		{FormatVTT, ContainerMPEGTS, "", ErrUnsupportedSubtitles},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format)+" in "+string(tt.container), func(t *testing.T) {
+			got, err := SubtitleCodec(tt.format, tt.container)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("SubtitleCodec() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	if _, err := SubtitleCodec(FormatSRT, "avi"); err == nil || errors.Is(err, ErrUnsupportedSubtitles) {
+		t.Errorf("SubtitleCodec() of an unknown container = %v, want it refused as unknown", err)
+	}
+}
+
+func TestContainerMuxers(t *testing.T) {
+	// Every container is written by the FFmpeg muxer it is named like
+	for container, spec := range containers {
+		if len(spec.muxer) < 2 || spec.muxer[0] != "-f" || spec.muxer[1] != string(container) {
+			t.Errorf("%s is muxed with %q, want -f %s", container, spec.muxer, container)
+		}
+	}
+}
+
+func TestNewRefusesUnsupported(t *testing.T) {
+	tests := []struct {
+		format    SubtitleFormat
+		container Container
+		err       error
+	}{
+		{FormatSRT, ContainerMatroska, nil},
+		{FormatNone, ContainerFLV, nil},
+		{FormatBurned, ContainerFLV, nil},
+		{FormatSRT, ContainerFLV, ErrUnsupportedSubtitles},
+		{FormatASS, ContainerMPEGTS, ErrUnsupportedSubtitles},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format)+" in "+string(tt.container), func(t *testing.T) {
+			e, err := New(tt.format, tt.container)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("New() = %v, want %v", err, tt.err)
+			}
+			if (e == nil) != (tt.err != nil) {
+				t.Errorf("New() = %v, want an embedder only if it has no error", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Package supervisor runs the goroutines of a session as named tasks. The
+// first task to fail stops the others through their context, and a task that
+// panics is logged with its stack trace and fails with ErrPanic instead of
+// crashing the whole process. Wait returns once every task has returned, so
+// nothing of the session outlives it.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrPanic is returned by Wait when a task panicked
+var ErrPanic = errors.New("task panicked")
+
+// Supervisor owns the tasks of a session
+type Supervisor struct {
+	group  *errgroup.Group
+	logger *logrus.Entry
+}
+
+// New creates a supervisor whose tasks run until ctx is done. The returned
+// context is done once ctx is, a task fails, or Wait returns; tasks are
+// expected to stop when it is.
+func New(ctx context.Context, logger *logrus.Entry) (*Supervisor, context.Context) {
+	group, ctx := errgroup.WithContext(ctx)
+	return &Supervisor{group: group, logger: logger}, ctx
+}
+
+// Go runs task in a new goroutine. If it returns an error or panics, the
+// context of the supervisor is canceled and Wait returns the error, prefixed
+// with name.
+func (s *Supervisor) Go(name string, task func() error) {
+	s.group.Go(func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				s.logger.WithFields(logrus.Fields{
+					"task":  name,
+					"panic": fmt.Sprint(r),
+					"stack": string(debug.Stack()),
+				}).Error("Task panicked, stopping the session")
+				err = fmt.Errorf("%s: %w: %v", name, ErrPanic, r)
+			}
+		}()
+
+		if err := task(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// Wait waits for every task to return and returns the first error, if any
+func (s *Supervisor) Wait() error {
+	return s.group.Wait()
+}
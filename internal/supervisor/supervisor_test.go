@@ -0,0 +1,118 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+var errFailed = errors.New("failed")
+
+// newLogger returns a logger writing JSON entries to the returned buffer,
+// which may only be read once the tasks are done
+func newLogger() (*logrus.Entry, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	return logrus.NewEntry(logger), &buf
+}
+
+// untilDone returns a task that blocks until ctx is done and then succeeds,
+// like one reading a stream until the session stops
+func untilDone(ctx context.Context) func() error {
+	return func() error {
+		<-ctx.Done()
+		return nil
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	tests := []struct {
+		name string
+		// task is the task run next to one that waits for the context
+		task func() error
+		// cancel cancels the parent context once the tasks run
+		cancel bool
+		err    error
+		prefix string
+	}{
+		{"stopped by the parent", func() error { return nil }, true, nil, ""},
+		{"failure stops the others", func() error { return errFailed }, false, errFailed, "reader: "},
+		{"panic stops the others", func() error { panic("boom") }, false, ErrPanic, "reader: "},
+		{"runtime error", func() error {
+			var m map[string]int
+			m["chunk"]++
+			return nil
+		}, false, ErrPanic, "reader: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.CheckGoroutines(t)
+			parent, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			logger, _ := newLogger()
+			tasks, ctx := New(parent, logger)
+
+			tasks.Go("writer", untilDone(ctx))
+			tasks.Go("reader", tt.task)
+			if tt.cancel {
+				cancel()
+			}
+
+			err := tasks.Wait()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Wait() = %v, want %v", err, tt.err)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), tt.prefix) {
+				t.Errorf("Wait() = %q, want it prefixed with the task name %q", err, tt.prefix)
+			}
+			// Every task has returned, and their context is done
+			if ctx.Err() == nil {
+				t.Error("context of the tasks still running after Wait")
+			}
+		})
+	}
+}
+
+func TestSupervisorLogsPanic(t *testing.T) {
+	logger, buf := newLogger()
+	tasks, _ := New(context.Background(), logger)
+	tasks.Go("embedder", func() error { panic("boom") })
+	if err := tasks.Wait(); !errors.Is(err, ErrPanic) || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Wait() = %v, want the panic", err)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("logged %q: %v", buf, err)
+	}
+	if entry["level"] != "error" || entry["task"] != "embedder" || entry["panic"] != "boom" {
+		t.Errorf("logged %v, want an error naming the task and the panic", entry)
+	}
+	// The stack trace leads to the panicking task
+	if stack, _ := entry["stack"].(string); !strings.Contains(stack, "TestSupervisorLogsPanic") {
+		t.Errorf("stack trace doesn't lead to the task:\n%s", stack)
+	}
+}
+
+func TestSupervisorReturnsFirstError(t *testing.T) {
+	logger, _ := newLogger()
+	tasks, ctx := New(context.Background(), logger)
+	tasks.Go("first", func() error { return errFailed })
+	// Fails only after the first task stopped it
+	tasks.Go("second", func() error {
+		<-ctx.Done()
+		return errors.New("stopped")
+	})
+
+	if err := tasks.Wait(); !errors.Is(err, errFailed) || !strings.HasPrefix(err.Error(), "first: ") {
+		t.Errorf("Wait() = %v, want the error of the first task", err)
+	}
+}
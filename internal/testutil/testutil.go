@@ -0,0 +1,444 @@
+// Package testutil provides the pieces of end-to-end tests that run the proxy
+// against real FFmpeg processes: a synthetic clip and publisher, an ffprobe
+// wrapper to inspect what targets received, free ports, a fake transcriber
+// returning canned segments, fake whisper-ctranslate2 and argos-translate
+// binaries and translation worker, a fake FFmpeg listener, and read-only
+// directories. Tests using FFmpeg only run with TEST_FFMPEG=1.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// ffmpegEnv is the environment variable enabling tests that run FFmpeg
+const ffmpegEnv = "TEST_FFMPEG"
+
+// SkipUnlessFFmpeg skips the test unless TEST_FFMPEG=1 is set and ffmpeg
+// and ffprobe are installed
+func SkipUnlessFFmpeg(tb testing.TB) {
+	tb.Helper()
+
+	if os.Getenv(ffmpegEnv) != "1" {
+		tb.Skipf("set %s=1 to run tests using FFmpeg", ffmpegEnv)
+	}
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			tb.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+// FreePort returns a TCP port that was free a moment ago, for listeners
+// that only take a port number
+func FreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// WaitForPort waits until something accepts connections on port, e.g. the
+// FFmpeg listener
+func WaitForPort(ctx context.Context, port int) error {
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return WaitFor(ctx, 50*time.Millisecond, func() bool {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+// WaitFor polls done every interval until it returns true or ctx is done
+func WaitFor(ctx context.Context, interval time.Duration, done func() bool) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// goroutineTimeout bounds how long CheckGoroutines waits for goroutines to
+// return
+const goroutineTimeout = 5 * time.Second
+
+// CheckGoroutines fails the test if, once it and its cleanups are done, more
+// goroutines run than when it was called, e.g. because a session wasn't torn
+// down completely. Goroutines get a few seconds to return.
+func CheckGoroutines(tb testing.TB) {
+	tb.Helper()
+	baseline := runtime.NumGoroutine()
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), goroutineTimeout)
+		defer cancel()
+		if WaitFor(ctx, 10*time.Millisecond, func() bool { return runtime.NumGoroutine() <= baseline }) == nil {
+			return
+		}
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		tb.Errorf("%d goroutines still running, %d before the test:\n%s", runtime.NumGoroutine(), baseline, stacks)
+	})
+}
+
+// GenerateClip writes an FLV clip of duration to path, with a test pattern
+// as H.264 video and a sine tone as AAC audio, keyframes every second
+func GenerateClip(ctx context.Context, path string, duration time.Duration) error {
+	seconds := strconv.FormatFloat(duration.Seconds(), 'f', -1, 64)
+	return runFFmpeg(ctx,
+		"-f", "lavfi", "-i", "testsrc=size=320x240:rate=25",
+		"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100",
+		"-t", seconds,
+		"-c:v", "libx264", "-preset", "ultrafast", "-pix_fmt", "yuv420p", "-g", "25",
+		"-c:a", "aac",
+		"-f", "flv", "-y", path,
+	)
+}
+
+// Publish publishes the clip at path to an RTMP URL in real time and returns
+// once all of it was sent
+func Publish(ctx context.Context, path, rtmpURL string) error {
+	return runFFmpeg(ctx, "-re", "-i", path, "-c", "copy", "-f", "flv", rtmpURL)
+}
+
+// runFFmpeg runs FFmpeg with args, reporting its output if it fails
+func runFFmpeg(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-loglevel", "error"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Probe is what ffprobe reports about a media file
+type Probe struct {
+	Format  ProbeFormat   `json:"format"`
+	Streams []ProbeStream `json:"streams"`
+}
+
+// ProbeFormat describes the container of a probed file
+type ProbeFormat struct {
+	Name     string `json:"format_name"`
+	Duration string `json:"duration"` // Seconds
+}
+
+// ProbeStream describes one stream of a probed file
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"` // video, audio, or subtitle
+	CodecName string `json:"codec_name"`
+}
+
+// ProbeFile runs ffprobe on the file at path
+func ProbeFile(ctx context.Context, path string) (Probe, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-loglevel", "error",
+		"-show_format", "-show_streams",
+		"-of", "json",
+		path,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return Probe{}, fmt.Errorf("ffprobe failed: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var probe Probe
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return Probe{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return probe, nil
+}
+
+// Duration returns the duration of the probed file
+func (p Probe) Duration() (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", p.Format.Duration, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Stream returns the first stream of codecType, and false if there is none
+func (p Probe) Stream(codecType string) (ProbeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return ProbeStream{}, false
+}
+
+// FakeTranscriber returns canned segments for every chunk instead of running
+// Whisper. Segment times are relative to the chunk, like Whisper's.
+type FakeTranscriber struct {
+	Segments []transcriber.Segment
+	Err      error // Returned instead of the segments if set
+
+	mu    sync.Mutex
+	calls int
+}
+
+// TranscribeAudio returns the canned segments
+func (f *FakeTranscriber) TranscribeAudio(tempDir string, audioBytes []byte, format audio.Format, lang string) ([]transcriber.Segment, error) {
+	return f.TranscribeAudioFallback(tempDir, audioBytes, format, lang, transcriber.FallbackNone)
+}
+
+// TranscribeAudioFallback returns the canned segments, whatever the fallback
+func (f *FakeTranscriber) TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback transcriber.Fallback) ([]transcriber.Segment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if len(audioBytes) == 0 {
+		return nil, errors.New("no audio")
+	}
+	return append([]transcriber.Segment(nil), f.Segments...), nil
+}
+
+// CheckDecodingOptions accepts any options
+func (f *FakeTranscriber) CheckDecodingOptions() error {
+	return nil
+}
+
+// VerifyModel reports the model as present
+func (f *FakeTranscriber) VerifyModel() error {
+	return nil
+}
+
+// ModelDir returns a placeholder, there is no model
+func (f *FakeTranscriber) ModelDir() string {
+	return "fake"
+}
+
+// Calls returns how many chunks were transcribed
+func (f *FakeTranscriber) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// fakeWhisperScript stands in for whisper-ctranslate2: it copies the canned
+// output next to it to where whisper writes the JSON for the audio file,
+// which is the last argument
+const fakeWhisperScript = `#!/bin/sh
+out=.
+while [ $# -gt 1 ]; do
+	[ "$1" = --output_dir ] && out=$2
+	shift
+done
+cp "$(dirname "$0")/whisper-output.json" "$out/$(basename "$1" .wav).json"
+`
+
+// fakeArgosScript stands in for argos-translate: it prefixes the text read
+// from stdin with the target language in brackets
+const fakeArgosScript = `#!/bin/sh
+to=
+while [ $# -gt 0 ]; do
+	[ "$1" = --to ] && to=$2
+	shift
+done
+printf '[%s] %s' "$to" "$(cat)"
+`
+
+// FakeWhisper puts a whisper-ctranslate2 returning segments for every chunk
+// first on the PATH for the rest of the test, and returns a model directory
+// that passes the model check. Segment times are relative to the chunk.
+func FakeWhisper(tb testing.TB, lang string, segments []transcriber.Segment) string {
+	tb.Helper()
+
+	type outputSegment struct {
+		ID    int     `json:"id"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Text  string  `json:"text"`
+	}
+	output := struct {
+		Language string          `json:"language"`
+		Segments []outputSegment `json:"segments"`
+	}{Language: lang, Segments: []outputSegment{}}
+	for i, segment := range segments {
+		output.Segments = append(output.Segments, outputSegment{ID: i, Start: segment.Start, End: segment.End, Text: segment.Text})
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	bin := fakeBin(tb)
+	writeFile(tb, filepath.Join(bin, "whisper-output.json"), data, 0o644)
+	writeFile(tb, filepath.Join(bin, "whisper-ctranslate2"), []byte(fakeWhisperScript), 0o755)
+
+	modelDir := tb.TempDir()
+	writeFile(tb, filepath.Join(modelDir, "model.bin"), nil, 0o644)
+	return modelDir
+}
+
+// FakeArgos puts an argos-translate that prefixes text with the target
+// language, e.g. "[de] hello", and an argospm listing pairs, e.g. "en_de",
+// first on the PATH for the rest of the test
+func FakeArgos(tb testing.TB, pairs ...string) {
+	tb.Helper()
+
+	var list strings.Builder
+	list.WriteString("#!/bin/sh\n")
+	for _, pair := range pairs {
+		fmt.Fprintf(&list, "echo translate-%s\n", pair)
+	}
+
+	bin := fakeBin(tb)
+	writeFile(tb, filepath.Join(bin, "argos-translate"), []byte(fakeArgosScript), 0o755)
+	writeFile(tb, filepath.Join(bin, "argospm"), []byte(list.String()), 0o755)
+}
+
+// fakeArgosWorkerScript stands in for the Python interpreter running the
+// translation worker: it signals it is ready, then answers every request
+// line like fakeArgosScript. Text with quotes or escapes isn't supported.
+const fakeArgosWorkerScript = `#!/bin/sh
+echo '{"ready":true}'
+while IFS= read -r line; do
+	id=$(printf '%s' "$line" | sed 's/.*"id":\([0-9]*\).*/\1/')
+	text=$(printf '%s' "$line" | sed 's/.*"text":"\([^"]*\)".*/\1/')
+	to=$(printf '%s' "$line" | sed 's/.*"to":"\([^"]*\)".*/\1/')
+	printf '{"id":%s,"text":"[%s] %s"}\n' "$id" "$to" "$text"
+done
+`
+
+// FakeArgosWorker puts a python3 running a fake of the translation worker,
+// which translates like FakeArgos, first on the PATH for the rest of the test
+func FakeArgosWorker(tb testing.TB) {
+	tb.Helper()
+	writeFile(tb, filepath.Join(fakeBin(tb), "python3"), []byte(fakeArgosWorkerScript), 0o755)
+}
+
+// fakeFFmpegEnv makes the test binary run as the fake FFmpeg
+const fakeFFmpegEnv = "FAKE_FFMPEG"
+
+// FakeFFmpeg puts an ffmpeg first on the PATH for the rest of the test that
+// runs the test binary as FFmpeg's RTMP listener: it listens on the address
+// of the -listen input until interrupted, without ever producing output.
+// The package's TestMain has to call FakeFFmpegMain first.
+func FakeFFmpeg(tb testing.TB) {
+	tb.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s=1 exec '%s' \"$@\"\n", fakeFFmpegEnv, exe)
+	writeFile(tb, filepath.Join(fakeBin(tb), "ffmpeg"), []byte(script), 0o755)
+}
+
+// FakeFFmpegMain runs the test binary as the fake FFmpeg if FakeFFmpeg
+// started it, and returns otherwise. Anything but a listener fails.
+func FakeFFmpegMain() {
+	if os.Getenv(fakeFFmpegEnv) != "1" {
+		return
+	}
+	args := os.Args[1:]
+	var listen bool
+	var input string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-listen":
+			listen = args[i+1] == "1"
+		case "-i":
+			input = args[i+1]
+		}
+	}
+	u, err := url.Parse(input)
+	if !listen || err != nil || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "fake ffmpeg: only listening is supported, got %q\n", args)
+		os.Exit(1)
+	}
+
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fake ffmpeg: %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// FFmpeg stops cleanly when interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	ln.Close()
+	os.Exit(0)
+}
+
+// fakeBin creates a directory first on the PATH for the rest of the test
+func fakeBin(tb testing.TB) string {
+	tb.Helper()
+	bin := tb.TempDir()
+	tb.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return bin
+}
+
+// writeFile writes a file of a fake, failing the test if it can't
+func writeFile(tb testing.TB, path string, data []byte, perm os.FileMode) {
+	tb.Helper()
+	if err := os.WriteFile(path, data, perm); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// ReadOnlyDir returns a directory nothing can be written to, by its
+// permissions. The test is skipped when run as root, which they don't stop.
+func ReadOnlyDir(tb testing.TB) string {
+	tb.Helper()
+	if os.Geteuid() == 0 {
+		tb.Skip("root ignores directory permissions")
+	}
+	dir := tb.TempDir()
+	if err := os.Chmod(dir, 0o555); err != nil {
+		tb.Fatal(err)
+	}
+	// The temp directory is only removed once it is writable again
+	tb.Cleanup(func() { os.Chmod(dir, 0o755) })
+	return dir
+}
@@ -0,0 +1,84 @@
+package testutil
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/ben/transcription-proxy/internal/translator"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFakeWhisper(t *testing.T) {
+	segments := []transcriber.Segment{
+		{Start: 0, End: 2.5, Text: "Hello from the fake whisper."},
+		{Start: 3, End: 5, Text: "Second segment."},
+	}
+	modelDir := FakeWhisper(t, "en", segments)
+
+	cfg := &config.Config{WhisperModelDir: modelDir}
+	if err := transcriber.New(cfg).VerifyModel(); err != nil {
+		t.Errorf("VerifyModel() = %v", err)
+	}
+
+	// Called like the transcriber calls whisper-ctranslate2
+	dir := t.TempDir()
+	cmd := exec.Command("whisper-ctranslate2", "--model_directory", modelDir, "--language", "en",
+		"--output_format", "json", "--output_dir", dir, "--beam_size", "5", filepath.Join(dir, "audio-1.wav"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("fake whisper failed: %v, output: %s", err, output)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "audio-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output struct {
+		Language string
+		Segments []struct {
+			Start, End float64
+			Text       string
+		}
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Language != "en" || len(output.Segments) != len(segments) {
+		t.Fatalf("got %s", data)
+	}
+	for i, segment := range output.Segments {
+		if segment.Start != segments[i].Start || segment.End != segments[i].End || segment.Text != segments[i].Text {
+			t.Errorf("segment %d = %+v, want %+v", i, segment, segments[i])
+		}
+	}
+}
+
+func TestFakeArgos(t *testing.T) {
+	FakeArgos(t, "en_de", "de_en")
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	tr := translator.New(&config.Config{EnableTranslation: true}, logger)
+
+	pairs, err := tr.AvailablePairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []translator.LangPair{{Source: "de", Target: "en"}, {Source: "en", Target: "de"}}; !reflect.DeepEqual(pairs, want) {
+		t.Errorf("AvailablePairs() = %v, want %v", pairs, want)
+	}
+
+	translated, err := tr.TranslateSegments([]transcriber.Segment{{Text: "hello"}}, "en", "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(translated) != 1 || translated[0].Text != "[de] hello" {
+		t.Errorf("TranslateSegments() = %+v", translated)
+	}
+}
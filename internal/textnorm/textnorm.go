@@ -0,0 +1,222 @@
+// Package textnorm cleans up the Unicode whisper occasionally emits before it
+// is translated or turned into subtitles: decomposed accents, emoji the
+// mov_text encoder and the fonts of burned-in captions can't show, zero-width
+// and control characters, and typographic quotes. Every step can be turned
+// off on its own.
+package textnorm
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"golang.org/x/text/unicode/norm"
+)
+
+// How emoji are handled
+const (
+	EmojiKeep      = "keep"
+	EmojiStrip     = "strip"
+	EmojiShortcode = "shortcode" // Replaced with :name:, unknown ones are stripped
+)
+
+// Options selects the normalization steps
+type Options struct {
+	NFC              bool   // Compose characters into their NFC form
+	Emoji            string // EmojiKeep, EmojiStrip or EmojiShortcode
+	StripInvisible   bool   // Remove zero-width and control characters
+	StraightenQuotes bool   // Replace typographic quotes with ASCII ones
+}
+
+// emoji covers the emoji blocks and the symbols commonly shown as emoji. The
+// music notes whisper marks songs with are left out.
+var emoji = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x203c, Hi: 0x203c, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x231a, Hi: 0x23ff, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x24c2, Stride: 1},
+		{Lo: 0x2600, Hi: 0x2668, Stride: 1},
+		{Lo: 0x2670, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b05, Hi: 0x2b55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303d, Hi: 0x303d, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1},
+	},
+}
+
+// emojiModifiers only change the emoji before them: variation selectors,
+// the keycap, skin tones and tags
+var emojiModifiers = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x20e3, Hi: 0x20e3, Stride: 1},
+		{Lo: 0xfe00, Hi: 0xfe0f, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f3fb, Hi: 0x1f3ff, Stride: 1},
+		{Lo: 0xe0020, Hi: 0xe007f, Stride: 1},
+	},
+}
+
+// zeroWidthJoiner joins emoji into one, like a family from its members
+const zeroWidthJoiner = '\u200d'
+
+// softHyphen is only shown where a line breaks, which players decide
+// differently
+const softHyphen = '\u00ad'
+
+// zeroWidth are the invisible characters removed with StripInvisible. The
+// zero-width non-joiner is kept, Persian and Indic scripts need it.
+var zeroWidth = map[rune]bool{
+	'\u200b':        true, // Zero-width space
+	zeroWidthJoiner: true,
+	'\u2060':        true, // Word joiner
+	'\ufeff':        true, // Byte order mark
+	softHyphen:      true,
+}
+
+// quotes maps typographic quotes to ASCII ones. Guillemets and CJK brackets
+// are proper punctuation and stay.
+var quotes = map[rune]rune{
+	'‘': '\'', '’': '\'', '‚': '\'', '‛': '\'', '′': '\'',
+	'“': '"', '”': '"', '„': '"', '‟': '"', '″': '"',
+}
+
+// shortcodes names the emoji most likely in speech
+var shortcodes = map[rune]string{
+	'😀': "grinning", '😃': "smiley", '😄': "smile", '😁': "grin", '😆': "laughing",
+	'😅': "sweat_smile", '😂': "joy", '🤣': "rofl", '🙂': "slightly_smiling_face", '😉': "wink",
+	'😊': "blush", '😍': "heart_eyes", '😘': "kissing_heart", '😎': "sunglasses", '🤔': "thinking",
+	'😐': "neutral_face", '🙄': "roll_eyes", '😏': "smirk", '😢': "cry", '😭': "sob",
+	'😡': "rage", '😱': "scream", '😮': "open_mouth", '😴': "sleeping", '🤯': "exploding_head",
+	'🥳': "partying_face", '🥺': "pleading_face", '😬': "grimacing", '🤷': "shrug", '🙈': "see_no_evil",
+	'👍': "thumbsup", '👎': "thumbsdown", '👏': "clap", '🙏': "pray", '👋': "wave",
+	'💪': "muscle", '👀': "eyes", '🤝': "handshake", '✌': "v", '👌': "ok_hand",
+	'❤': "heart", '💔': "broken_heart", '💯': "100", '🔥': "fire", '✨': "sparkles",
+	'⭐': "star", '🎉': "tada", '🎵': "musical_note", '🎶': "notes", '💀': "skull",
+	'☀': "sunny", '🌧': "cloud_with_rain", '❄': "snowflake", '⚡': "zap", '🌈': "rainbow",
+	'✅': "white_check_mark", '❌': "x", '⚠': "warning", '❓': "question", '❗': "exclamation",
+	'🚀': "rocket", '💰': "moneybag", '🎮': "video_game", '🏆': "trophy", '⚽': "soccer",
+}
+
+// Normalizer cleans up caption text
+type Normalizer struct {
+	opts Options
+}
+
+// New creates a normalizer running the steps selected in opts
+func New(opts Options) *Normalizer {
+	return &Normalizer{opts: opts}
+}
+
+// NormalizeSegments returns segments with their text normalized, copied if
+// any changed
+func (n *Normalizer) NormalizeSegments(segments []transcriber.Segment) []transcriber.Segment {
+	normalized := make([]transcriber.Segment, len(segments))
+	anyChanged := false
+	for i, segment := range segments {
+		normalized[i] = segment
+		if text := n.Normalize(segment.Text); text != segment.Text {
+			normalized[i].Text = text
+			anyChanged = true
+		}
+	}
+	if !anyChanged {
+		return segments
+	}
+	return normalized
+}
+
+// Normalize returns text normalized. The result is always valid UTF-8.
+func (n *Normalizer) Normalize(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	if n.opts.NFC {
+		text = compose(text)
+	}
+
+	var b strings.Builder
+	removed := false
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+
+		switch {
+		case n.opts.Emoji != "" && n.opts.Emoji != EmojiKeep && unicode.Is(emoji, r):
+			// The modifiers and joined emoji belong to this one
+			end := i + emojiSequenceLen(text[i:])
+			if name, ok := shortcodes[r]; ok && n.opts.Emoji == EmojiShortcode {
+				b.WriteString(":" + name + ":")
+			} else {
+				removed = true
+			}
+			i = end
+			continue
+		case n.opts.StripInvisible && zeroWidth[r]:
+			removed = true
+		case n.opts.StripInvisible && unicode.IsControl(r):
+			if unicode.IsSpace(r) {
+				b.WriteRune(' ')
+			} else {
+				removed = true
+			}
+		case n.opts.StraightenQuotes && quotes[r] != 0:
+			b.WriteRune(quotes[r])
+		default:
+			b.WriteString(text[i : i+size])
+		}
+		i += size
+	}
+
+	result := b.String()
+	if removed {
+		// What was around removed characters shouldn't end up doubled
+		result = strings.Join(strings.Fields(result), " ")
+	}
+	return result
+}
+
+// compose returns text in NFC, except for the characters NFC decomposes,
+// like U+0958, which are kept as they are: composing shouldn't make a
+// caption longer
+func compose(text string) string {
+	var b strings.Builder
+	for text != "" {
+		n := norm.NFC.NextBoundaryInString(text, true)
+		if n <= 0 {
+			n = len(text)
+		}
+		segment := text[:n]
+		if composed := norm.NFC.String(segment); utf8.RuneCountInString(composed) <= utf8.RuneCountInString(segment) {
+			segment = composed
+		}
+		b.WriteString(segment)
+		text = text[n:]
+	}
+	return b.String()
+}
+
+// emojiSequenceLen returns the length in bytes of the emoji at the start of
+// text with its modifiers and the emoji joined to it
+func emojiSequenceLen(text string) int {
+	_, end := utf8.DecodeRuneInString(text)
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		switch {
+		case unicode.Is(emojiModifiers, r):
+			end += size
+		case r == zeroWidthJoiner && end+size < len(text):
+			next, nextSize := utf8.DecodeRuneInString(text[end+size:])
+			if !unicode.Is(emoji, next) {
+				return end
+			}
+			end += size + nextSize
+		default:
+			return end
+		}
+	}
+	return end
+}
@@ -0,0 +1,127 @@
+package textnorm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// all runs every step, emoji stripped
+var all = Options{NFC: true, Emoji: EmojiStrip, StripInvisible: true, StraightenQuotes: true}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		text string
+		want string
+	}{
+		{"nothing to do", all, "Hello, world.", "Hello, world."},
+		{"no steps", Options{}, "“Hi” 👋\u200b", "“Hi” 👋\u200b"},
+		{"accents composed", Options{NFC: true}, "Cafe\u0301 cre\u0300me", "Café crème"},
+		{"accents left", Options{}, "Cafe\u0301", "Cafe\u0301"},
+		{"emoji kept", Options{Emoji: EmojiKeep}, "Nice 👍", "Nice 👍"},
+		{"emoji stripped", Options{Emoji: EmojiStrip}, "Nice 👍 work 🔥!", "Nice work !"},
+		{"emoji with modifiers stripped", Options{Emoji: EmojiStrip}, "Hi 👋🏽 and ❤\ufe0f bye", "Hi and bye"},
+		{"joined emoji stripped", Options{Emoji: EmojiStrip}, "Family 👨\u200d👩\u200d👧 here", "Family here"},
+		{"shortcodes", Options{Emoji: EmojiShortcode}, "Nice 👍 work 🔥", "Nice :thumbsup: work :fire:"},
+		{"unknown emoji without shortcode", Options{Emoji: EmojiShortcode}, "Odd 🦑 one", "Odd one"},
+		{"shortcode of emoji with modifier", Options{Emoji: EmojiShortcode}, "Hi 👋🏽", "Hi :wave:"},
+		{"music notes kept", Options{Emoji: EmojiStrip}, "♪ la la ♪", "♪ la la ♪"},
+		{"zero-width removed", Options{StripInvisible: true}, "zero\u200bwidth\ufeff join\u2060er soft\u00adhyphen", "zerowidth joiner softhyphen"},
+		{"non-joiner kept", Options{StripInvisible: true}, "می\u200cخواهم", "می\u200cخواهم"},
+		{"control characters removed", Options{StripInvisible: true}, "bell\a and nul\x00 gone", "bell and nul gone"},
+		{"line breaks become spaces", Options{StripInvisible: true}, "two\nlines\ttabbed", "two lines tabbed"},
+		{"quotes straightened", Options{StraightenQuotes: true}, "“Don’t,” she said, „bitte‟", `"Don't," she said, "bitte"`},
+		{"guillemets kept", Options{StraightenQuotes: true}, "«Bonjour» 「こんにちは」", "«Bonjour» 「こんにちは」"},
+		{"invalid UTF-8 dropped", Options{}, "bad \xff\xfebytes", "bad bytes"},
+		{"spaces collapsed around removals", all, "  a 😀  b\u200b ", "a b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(tt.opts).Normalize(tt.text); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeSegments(t *testing.T) {
+	n := New(all)
+	clean := []transcriber.Segment{{Start: 0, End: 1, Text: "clean"}, {Start: 1, End: 2, Text: "text"}}
+	if got := n.NormalizeSegments(clean); &got[0] != &clean[0] {
+		t.Error("segments copied though nothing changed")
+	}
+
+	segments := []transcriber.Segment{{Start: 0, End: 1, Text: "clean"}, {Start: 1, End: 2, Text: "“quoted” 🔥"}}
+	got := n.NormalizeSegments(segments)
+	want := []transcriber.Segment{{Start: 0, End: 1, Text: "clean"}, {Start: 1, End: 2, Text: `"quoted"`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeSegments() = %+v, want %+v", got, want)
+	}
+	if segments[1].Text != "“quoted” 🔥" {
+		t.Error("segments changed in place")
+	}
+}
+
+// fuzzSeeds are texts with whatever whisper may emit
+var fuzzSeeds = []string{
+	"",
+	"plain text",
+	"Café Å Ω",
+	// Decompose under NFC, which would make them longer
+	"\u0344 \u0958 \ufb2c \u0f73",
+	"👨\u200d👩\u200d👧 👋🏽 ❤\ufe0f 1\ufe0f\u20e3 🏴\U000e0067\U000e0062\U000e007f",
+	"\u200d👍\u200d",
+	"zero\u200bwidth\ufeff\u00ad\u2060",
+	"“quotes” ‘single’ „low‟ ′prime″",
+	"bell\a nul\x00 del\x7f \u0085 \r\n\t",
+	"invalid \xff\xfe UTF-8 \xed\xa0\x80",
+	"🙂🙂🙂🙂 🔥",
+}
+
+// FuzzNormalize checks that every combination of steps yields valid UTF-8
+// with no more runes than the input. Shortcodes count as one rune, as the
+// emoji they replace.
+func FuzzNormalize(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		for _, nfc := range []bool{false, true} {
+			for _, emoji := range []string{EmojiKeep, EmojiStrip, EmojiShortcode} {
+				for _, invisible := range []bool{false, true} {
+					for _, quotes := range []bool{false, true} {
+						opts := Options{NFC: nfc, Emoji: emoji, StripInvisible: invisible, StraightenQuotes: quotes}
+						got := New(opts).Normalize(text)
+						if !utf8.ValidString(got) {
+							t.Fatalf("%+v: Normalize(%q) = %q, not valid UTF-8", opts, text, got)
+						}
+
+						runes := utf8.RuneCountInString(got)
+						if emoji == EmojiShortcode {
+							if strings.Contains(text, ":") {
+								continue
+							}
+							// Without colons in the text, every other part
+							// between them is the name of a shortcode
+							runes = 0
+							for i, part := range strings.Split(got, ":") {
+								if i%2 == 1 {
+									part = "x"
+								}
+								runes += utf8.RuneCountInString(part)
+							}
+						}
+						if runes > utf8.RuneCountInString(text) {
+							t.Fatalf("%+v: Normalize(%q) = %q, longer than the input", opts, text, got)
+						}
+					}
+				}
+			}
+		}
+	})
+}
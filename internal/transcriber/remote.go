@@ -0,0 +1,147 @@
+package transcriber
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+)
+
+// minUploadDuration is the shortest chunk worth uploading; the pipeline cuts
+// chunks of seconds, so anything shorter was cut off
+const minUploadDuration = 100 * time.Millisecond
+
+// maxErrorBody bounds how much of an error response is kept in the error
+const maxErrorBody = 512
+
+// remoteBackend transcribes chunks with an OpenAI-compatible transcription
+// endpoint, such as faster-whisper-server or the whisper.cpp server
+type remoteBackend struct {
+	url      string
+	apiKey   string
+	model    string
+	encoding audio.Encoding
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// newRemoteBackend returns the backend configured in cfg, nil if chunks are
+// transcribed locally. The encoding is negotiated from the content types the
+// endpoint takes.
+func newRemoteBackend(cfg *config.Config) (*remoteBackend, error) {
+	if cfg.WhisperURL == "" {
+		return nil, nil
+	}
+	encoding, err := audio.NegotiateEncoding(cfg.WhisperAccept, cfg.WhisperCompress)
+	if err != nil {
+		return nil, fmt.Errorf("WHISPER_ACCEPT: %w", err)
+	}
+	return &remoteBackend{
+		url:      cfg.WhisperURL,
+		apiKey:   cfg.WhisperAPIKey,
+		model:    cfg.WhisperModelSize,
+		encoding: encoding,
+		timeout:  cfg.WhisperTimeout,
+		client:   &http.Client{},
+	}, nil
+}
+
+// transcribe uploads pcm in format and returns the segments the endpoint
+// transcribed in lang. Truncated chunks are rejected before they are
+// uploaded.
+func (b *remoteBackend) transcribe(pcm []byte, format audio.Format, lang string, decoding DecodingOptions) ([]Segment, error) {
+	if err := audio.CheckChunk(pcm, format, minUploadDuration); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptAudio, err)
+	}
+
+	ctx := context.Background()
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	data, err := audio.Encode(ctx, pcm, format, b.encoding)
+	if err != nil {
+		return nil, err
+	}
+	body, contentType, err := b.form(data, lang, decoding)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transcription request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if b.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("transcription request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		err := fmt.Errorf("transcription endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(excerpt)))
+		if resp.StatusCode == http.StatusUnsupportedMediaType || resp.StatusCode == http.StatusUnprocessableEntity {
+			// Sending the chunk again won't change the endpoint's mind
+			return nil, fmt.Errorf("%w: %w", ErrCorruptAudio, err)
+		}
+		return nil, err
+	}
+
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcription response: %w", err)
+	}
+	return parseJSONOutput(string(output))
+}
+
+// form returns the multipart form uploading data, and its content type
+func (b *remoteBackend) form(data []byte, lang string, decoding DecodingOptions) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="chunk.%s"`, b.encoding))
+	header.Set("Content-Type", b.encoding.ContentType())
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create transcription request: %w", err)
+	}
+	part.Write(data)
+
+	fields := [][2]string{
+		{"model", b.model},
+		{"response_format", "verbose_json"},
+	}
+	if lang != "" {
+		fields = append(fields, [2]string{"language", lang})
+	}
+	if decoding.Temperature != nil {
+		fields = append(fields, [2]string{"temperature", strconv.FormatFloat(*decoding.Temperature, 'f', -1, 64)})
+	}
+	for _, field := range fields {
+		if err := w.WriteField(field[0], field[1]); err != nil {
+			return nil, "", fmt.Errorf("failed to create transcription request: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to create transcription request: %w", err)
+	}
+	return &buf, w.FormDataContentType(), nil
+}
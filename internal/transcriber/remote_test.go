@@ -0,0 +1,163 @@
+package transcriber
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+)
+
+// upload is what the fake endpoint received
+type upload struct {
+	authorization string
+	contentType   string
+	fields        map[string]string
+	file          []byte
+}
+
+// fakeEndpoint starts an OpenAI-compatible transcription endpoint answering
+// with status and body, and returns the transcriber uploading to it and the
+// number of requests so far. The last upload is sent to uploads.
+func fakeEndpoint(t *testing.T, cfg *config.Config, status int, body []byte, uploads chan<- upload) (*Transcriber, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got := upload{authorization: r.Header.Get("Authorization"), fields: map[string]string{}}
+		for name, values := range r.MultipartForm.Value {
+			got.fields[name] = values[0]
+		}
+		if files := r.MultipartForm.File["file"]; len(files) == 1 {
+			got.contentType = files[0].Header.Get("Content-Type")
+			file, err := files[0].Open()
+			if err == nil {
+				got.file, _ = io.ReadAll(file)
+				file.Close()
+			}
+		}
+		if uploads != nil {
+			uploads <- got
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg.WhisperURL = server.URL
+	return New(cfg), &requests
+}
+
+func TestRemoteTranscribe(t *testing.T) {
+	cfg := config.New()
+	cfg.WhisperAPIKey = "s3cret"
+	cfg.WhisperModelSize = "large-v3"
+	cfg.WhisperTemperature = "0.2"
+	uploads := make(chan upload, 1)
+	tr, _ := fakeEndpoint(t, cfg, http.StatusOK, whisperJSON(t, "remote", "segments"), uploads)
+	if err := tr.VerifyModel(); err != nil {
+		t.Fatalf("VerifyModel() = %v, want no local model needed", err)
+	}
+
+	pcm := make([]byte, audio.Expected.BytesPerSecond())
+	segments, err := tr.TranscribeAudio(t.TempDir(), pcm, audio.Expected, "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(segments); !reflect.DeepEqual(got, []string{"remote", "segments"}) {
+		t.Errorf("segments = %q, want those of the endpoint", got)
+	}
+
+	got := <-uploads
+	if got.authorization != "Bearer s3cret" {
+		t.Errorf("Authorization = %q, want the API key", got.authorization)
+	}
+	want := map[string]string{"model": "large-v3", "language": "de", "response_format": "verbose_json", "temperature": "0.2"}
+	if !reflect.DeepEqual(got.fields, want) {
+		t.Errorf("fields = %v, want %v", got.fields, want)
+	}
+	// Without declared content types the chunk goes up as a complete WAV
+	if got.contentType != "audio/wav" {
+		t.Errorf("file uploaded as %q, want audio/wav", got.contentType)
+	}
+	format, duration, err := audio.CheckWAV(got.file)
+	if err != nil || format != audio.Expected || duration != time.Second {
+		t.Errorf("uploaded WAV holds %s of %s (%v), want the second of the chunk", duration, format, err)
+	}
+}
+
+func TestRemoteRejectsTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		pcm  []byte
+	}{
+		{"cut mid-sample", make([]byte, audio.Expected.BytesPerSecond()+1)},
+		{"too short", make([]byte, 2048)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, requests := fakeEndpoint(t, config.New(), http.StatusOK, whisperJSON(t, "never"), nil)
+			_, err := tr.TranscribeAudio(t.TempDir(), tt.pcm, audio.Expected, "en")
+			// Not worth retrying either
+			if !errors.Is(err, audio.ErrTruncated) || !errors.Is(err, ErrCorruptAudio) {
+				t.Errorf("TranscribeAudio() = %v, want the chunk rejected as truncated", err)
+			}
+			if n := requests.Load(); n != 0 {
+				t.Errorf("endpoint got %d requests, want the chunk rejected before upload", n)
+			}
+		})
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		corrupt bool // Not worth retrying
+	}{
+		{"server error", http.StatusInternalServerError, "overloaded", false},
+		{"rate limited", http.StatusTooManyRequests, "slow down", false},
+		{"audio refused", http.StatusUnsupportedMediaType, "unsupported file", true},
+		{"invalid JSON", http.StatusOK, "{", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, _ := fakeEndpoint(t, config.New(), tt.status, []byte(tt.body), nil)
+			_, err := tr.TranscribeAudio(t.TempDir(), make([]byte, 4096), audio.Expected, "en")
+			if err == nil {
+				t.Fatal("TranscribeAudio() succeeded")
+			}
+			if errors.Is(err, ErrCorruptAudio) != tt.corrupt {
+				t.Errorf("TranscribeAudio() = %v, want corrupt audio %v", err, tt.corrupt)
+			}
+		})
+	}
+}
+
+func TestRemoteNegotiation(t *testing.T) {
+	cfg := config.New()
+	cfg.WhisperAccept = []string{"audio/mpeg"}
+	tr, requests := fakeEndpoint(t, cfg, http.StatusOK, whisperJSON(t, "never"), nil)
+
+	// An endpoint taking nothing the proxy sends fails at startup
+	if err := tr.VerifyModel(); !errors.Is(err, audio.ErrUnsupportedFormat) {
+		t.Errorf("VerifyModel() = %v, want %v", err, audio.ErrUnsupportedFormat)
+	}
+	if _, err := tr.TranscribeAudio(t.TempDir(), make([]byte, 4096), audio.Expected, "en"); !errors.Is(err, ErrModelMissing) {
+		t.Errorf("TranscribeAudio() = %v, want %v", err, ErrModelMissing)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("endpoint got %d requests, want none", n)
+	}
+}
@@ -2,20 +2,225 @@ package transcriber
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ben/transcription-proxy/internal/audio"
 	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/procs"
+)
+
+// Errors classified from transcription failures
+var (
+	// ErrModelMissing means the Whisper model is not installed; retrying will
+	// not help
+	ErrModelMissing = errors.New("whisper model missing")
+	// ErrOutOfMemory means the GPU or host ran out of memory; retrying after
+	// a while may succeed
+	ErrOutOfMemory = errors.New("out of memory")
+	// ErrCorruptAudio means the audio of the chunk could not be decoded;
+	// retrying will not help
+	ErrCorruptAudio = errors.New("corrupt audio")
+)
+
+// Output patterns of FFmpeg and whisper-ctranslate2 identifying an error
+var (
+	outOfMemoryPatterns = []string{
+		"out of memory",
+		"CUBLAS_STATUS_ALLOC_FAILED",
+		"std::bad_alloc",
+		"MemoryError",
+	}
+	modelMissingPatterns = []string{
+		"Unable to open file 'model.bin'",
+		"model.bin: No such file or directory",
+	}
+	corruptAudioPatterns = []string{
+		"Invalid data found when processing input",
+		"Failed to load audio",
+		"could not find codec parameters",
+	}
 )
 
 type Transcriber struct {
 	config    *config.Config
 	modelPath string
 	modelName string
+	modelDir  string
+
+	// decoding holds the parsed decoding parameters, or decodingErr why
+	// they are invalid
+	decoding    DecodingOptions
+	decodingErr error
+
+	// remote is the endpoint chunks are uploaded to, nil to run whisper
+	// here, or remoteErr why it can't be used
+	remote    *remoteBackend
+	remoteErr error
+
+	// attempts holds the chunks being transcribed by their ID, closed once
+	// the attempt is done
+	attemptsMu sync.Mutex
+	attempts   map[string]chan struct{}
+}
+
+// DecodingOptions are whisper decoding parameters. Nil fields are left out of
+// the arguments so whisper-ctranslate2 applies its own defaults.
+type DecodingOptions struct {
+	Temperature               *float64
+	BestOf                    *int
+	ConditionOnPreviousText   *bool
+	NoSpeechThreshold         *float64
+	CompressionRatioThreshold *float64
+	VADMinSilence             *time.Duration
+	VADSpeechPad              *time.Duration
+}
+
+// ParseDecodingOptions parses the decoding parameters of cfg and checks their
+// ranges, reporting every invalid one
+func ParseDecodingOptions(cfg *config.Config) (DecodingOptions, error) {
+	var opts DecodingOptions
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(parseOption("WHISPER_TEMPERATURE", cfg.WhisperTemperature, &opts.Temperature, parseFloatRange(0, 1)))
+	check(parseOption("WHISPER_BEST_OF", cfg.WhisperBestOf, &opts.BestOf, parseIntMin(1)))
+	check(parseOption("WHISPER_CONDITION_ON_PREVIOUS_TEXT", cfg.WhisperConditionOnPreviousText, &opts.ConditionOnPreviousText, strconv.ParseBool))
+	check(parseOption("WHISPER_NO_SPEECH_THRESHOLD", cfg.WhisperNoSpeechThreshold, &opts.NoSpeechThreshold, parseFloatRange(0, 1)))
+	check(parseOption("WHISPER_COMPRESSION_RATIO_THRESHOLD", cfg.WhisperCompressionRatioThreshold, &opts.CompressionRatioThreshold, parseFloatAbove(0)))
+	check(parseOption("WHISPER_VAD_MIN_SILENCE", cfg.WhisperVADMinSilence, &opts.VADMinSilence, parseDurationMin(0)))
+	check(parseOption("WHISPER_VAD_SPEECH_PAD", cfg.WhisperVADSpeechPad, &opts.VADSpeechPad, parseDurationMin(0)))
+
+	return opts, errors.Join(errs...)
+}
+
+// parseOption parses value into *dst unless it is empty
+func parseOption[T any](name, value string, dst **T, parse func(string) (T, error)) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	parsed, err := parse(value)
+	if err != nil {
+		return fmt.Errorf("%s=%q: %w", name, value, err)
+	}
+	*dst = &parsed
+	return nil
+}
+
+// parseFloatRange parses a float between min and max inclusive
+func parseFloatRange(min, max float64) func(string) (float64, error) {
+	return func(value string) (float64, error) {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, errors.New("not a number")
+		}
+		if f < min || f > max {
+			return 0, fmt.Errorf("must be between %g and %g", min, max)
+		}
+		return f, nil
+	}
+}
+
+// parseFloatAbove parses a float greater than min
+func parseFloatAbove(min float64) func(string) (float64, error) {
+	return func(value string) (float64, error) {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, errors.New("not a number")
+		}
+		if f <= min {
+			return 0, fmt.Errorf("must be greater than %g", min)
+		}
+		return f, nil
+	}
+}
+
+// parseIntMin parses an integer of at least min
+func parseIntMin(min int) func(string) (int, error) {
+	return func(value string) (int, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, errors.New("not an integer")
+		}
+		if n < min {
+			return 0, fmt.Errorf("must be at least %d", min)
+		}
+		return n, nil
+	}
+}
+
+// parseDurationMin parses a duration of at least min
+func parseDurationMin(min time.Duration) func(string) (time.Duration, error) {
+	return func(value string) (time.Duration, error) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, errors.New("not a duration")
+		}
+		if d < min {
+			return 0, fmt.Errorf("must be at least %s", min)
+		}
+		return d, nil
+	}
+}
+
+// modelInfo describes where a supported model size is published and which
+// directory its CTranslate2 conversion lives in inside WhisperModelPath
+type modelInfo struct {
+	directory  string
+	repository string // Hugging Face repository
+}
+
+// knownModels maps the supported model sizes to their model info
+var knownModels = map[string]modelInfo{
+	"tiny":           {"faster-whisper-tiny", "Systran/faster-whisper-tiny"},
+	"tiny.en":        {"faster-whisper-tiny.en", "Systran/faster-whisper-tiny.en"},
+	"base":           {"faster-whisper-base", "Systran/faster-whisper-base"},
+	"base.en":        {"faster-whisper-base.en", "Systran/faster-whisper-base.en"},
+	"small":          {"faster-whisper-small", "Systran/faster-whisper-small"},
+	"small.en":       {"faster-whisper-small.en", "Systran/faster-whisper-small.en"},
+	"medium":         {"faster-whisper-medium", "Systran/faster-whisper-medium"},
+	"medium.en":      {"faster-whisper-medium.en", "Systran/faster-whisper-medium.en"},
+	"large-v2":       {"faster-whisper-large-v2", "Systran/faster-whisper-large-v2"},
+	"large-v3":       {"faster-whisper-large-v3", "Systran/faster-whisper-large-v3"},
+	"large-v3-turbo": {"faster-whisper-large-v3-turbo-ct2", "deepdml/faster-whisper-large-v3-turbo-ct2"},
+}
+
+// ModelRepository returns the Hugging Face repository publishing the
+// CTranslate2 conversion of the given model size
+func ModelRepository(size string) (string, bool) {
+	info, ok := knownModels[size]
+	return info.repository, ok
+}
+
+// ResolveModelDir returns the directory of the Whisper model to run, either
+// the explicit WhisperModelDir or the directory for WhisperModelSize
+func ResolveModelDir(cfg *config.Config) (string, error) {
+	if cfg.WhisperModelDir != "" {
+		return cfg.WhisperModelDir, nil
+	}
+
+	info, ok := knownModels[cfg.WhisperModelSize]
+	if !ok {
+		return "", fmt.Errorf("unknown whisper model size %q, set WHISPER_MODEL_DIR to use a custom model", cfg.WhisperModelSize)
+	}
+
+	return filepath.Join(cfg.WhisperModelPath, info.directory), nil
 }
 
 type Segment struct {
@@ -24,57 +229,164 @@ type Segment struct {
 	End       float64
 	Text      string
 	Timestamp string
+
+	// Confidence metadata reported by Whisper, zero if unavailable
+	AvgLogProb       float64
+	NoSpeechProb     float64
+	DetectedLanguage string
+
+	// Decoding details reported by Whisper: the offset of the decoding window
+	// in frames of SeekFramesPerSecond, and the temperature and compression
+	// ratio of the result
+	Seek             int
+	Temperature      float64
+	CompressionRatio float64
+
+	// Speaker labels who is speaking, e.g. S1, if speaker changes are
+	// detected, and SpeakerPrefix is put in front of the caption where the
+	// speaker changes
+	Speaker       string
+	SpeakerPrefix string
+
+	// Set once the segment is captioned: Lang is the language of Text,
+	// Source the text before it was translated, in SourceLang, and
+	// Translations its text in the languages of the subtitle tracks
+	Lang         string
+	Source       string
+	SourceLang   string
+	Translations map[string]string
+}
+
+// SeekFramesPerSecond is the frame rate of Whisper's seek offsets
+const SeekFramesPerSecond = 100
+
+// OtherLanguage reports whether the segment was detected in a language other
+// than lang. Segments without a detected language are taken to be in lang.
+func (s Segment) OtherLanguage(lang string) bool {
+	return s.DetectedLanguage != "" && lang != "" && !strings.EqualFold(s.DetectedLanguage, lang)
 }
 
 func New(cfg *config.Config) *Transcriber {
+	// An unknown size leaves modelDir empty, which VerifyModel reports
+	modelDir, _ := ResolveModelDir(cfg)
+
+	// Invalid decoding parameters are reported by CheckDecodingOptions
+	decoding, decodingErr := ParseDecodingOptions(cfg)
+
+	// An endpoint taking none of the encodings is reported by VerifyModel
+	remote, remoteErr := newRemoteBackend(cfg)
+
 	return &Transcriber{
-		config:    cfg,
-		modelPath: cfg.WhisperModelPath,
-		modelName: cfg.WhisperModelSize,
+		config:      cfg,
+		modelPath:   cfg.WhisperModelPath,
+		modelName:   cfg.WhisperModelSize,
+		modelDir:    modelDir,
+		decoding:    decoding,
+		decodingErr: decodingErr,
+		remote:      remote,
+		remoteErr:   remoteErr,
+		attempts:    make(map[string]chan struct{}),
 	}
 }
 
-// TranscribeAudio transcribes audio bytes to text segments
-func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment, error) {
-	// Use a shared temporary directory instead of creating one for each chunk
-	tempDir := filepath.Join(t.config.OutputDir, "transcription_temp")
+// CheckDecodingOptions reports invalid decoding parameters
+func (t *Transcriber) CheckDecodingOptions() error {
+	return t.decodingErr
+}
 
-	// Create shared directory if it doesn't exist yet
-	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(tempDir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create temp directory: %w", err)
-		}
+// ModelDir returns the directory of the model used for transcription
+func (t *Transcriber) ModelDir() string {
+	return t.modelDir
+}
+
+// VerifyModel checks that the resolved model directory holds a CTranslate2
+// model. With a remote endpoint there is no model here, only the encoding
+// of the uploads to check.
+func (t *Transcriber) VerifyModel() error {
+	if t.remote != nil || t.remoteErr != nil {
+		return t.remoteErr
+	}
+	if _, err := ResolveModelDir(t.config); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(t.modelDir)
+	if err != nil {
+		return fmt.Errorf("%w: %q not found at %s: %v", ErrModelMissing, t.modelName, t.modelDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: model path %s is not a directory", ErrModelMissing, t.modelDir)
+	}
+
+	if _, err := os.Stat(filepath.Join(t.modelDir, "model.bin")); err != nil {
+		return fmt.Errorf("%w: model directory %s does not contain model.bin: %v", ErrModelMissing, t.modelDir, err)
+	}
+
+	return nil
+}
+
+// TranscribeAudio transcribes raw PCM audio in the given format to text
+// segments. Intermediate files are written to tempDir, which is owned by the
+// caller's stream session.
+func (t *Transcriber) TranscribeAudio(tempDir string, audioBytes []byte, format audio.Format, lang string) ([]Segment, error) {
+	return t.TranscribeAudioFallback(tempDir, audioBytes, format, lang, FallbackNone)
+}
+
+// TranscribeAudioFallback is like TranscribeAudio with the cheaper settings
+// of fallback applied
+func (t *Transcriber) TranscribeAudioFallback(tempDir string, audioBytes []byte, format audio.Format, lang string, fallback Fallback) ([]Segment, error) {
+	if t.remoteErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrModelMissing, t.remoteErr)
+	}
+	if t.remote != nil {
+		// The fallbacks only lighten local transcription
+		return t.remote.transcribe(audioBytes, format, lang, t.decoding)
+	}
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
 	// Verify we have enough audio data to process
 	if len(audioBytes) < 1024 {
-		return nil, fmt.Errorf("audio data too small to process (%d bytes)", len(audioBytes))
+		return nil, fmt.Errorf("%w: audio data too small to process (%d bytes)", ErrCorruptAudio, len(audioBytes))
 	}
 
-	// Use timestamp to create unique filenames within the shared directory
-	timestamp := time.Now().UnixNano()
-	inputPath := filepath.Join(tempDir, fmt.Sprintf("input-%d.bin", timestamp))
-	audioPath := filepath.Join(tempDir, fmt.Sprintf("audio-%d.wav", timestamp))
-	outputPath := filepath.Join(tempDir, fmt.Sprintf("transcript-%d.json", timestamp))
+	// The files are named by the chunk ID, so a retry finds the output of an
+	// attempt that completed after it was given up on. Attempts for the same
+	// chunk take turns, they would write the same files.
+	id := ChunkID(audioBytes, format, lang)
+	defer t.beginAttempt(id)()
+	inputPath := filepath.Join(tempDir, "input-"+id+".bin")
+	audioPath := filepath.Join(tempDir, "audio-"+id+".wav")
+	outputPath := filepath.Join(tempDir, "audio-"+id+".json") // Named by whisper after the audio file
+
+	if segments, ok := completedOutput(outputPath); ok {
+		os.Remove(outputPath)
+		return segments, nil
+	}
 
 	// Save input data to a temporary file
 	if err := os.WriteFile(inputPath, audioBytes, 0644); err != nil {
 		return nil, fmt.Errorf("failed to write input data to file: %w", err)
 	}
 
-	// Clean up temporary files when done
+	// Clean up temporary files when done. The output is only removed once it
+	// was read, a whisper that outlives a failed attempt may still write it.
+	outputRead := false
 	defer func() {
 		os.Remove(inputPath)
 		os.Remove(audioPath)
-		os.Remove(outputPath)
+		if outputRead {
+			os.Remove(outputPath)
+		}
 	}()
 
-	// Convert to WAV format using a file-based approach - explicitly specify input format as wav or raw pcm
-	cmd := exec.Command("ffmpeg",
-		"-loglevel", "info", // More verbose logging for debugging
-		"-f", "s16le", // Explicitly specifying input format as signed 16-bit PCM
-		"-ar", "16000", // Input sample rate to match expected
-		"-ac", "1", // Input channels to match expected
+	// Convert to 16kHz mono WAV using a file-based approach - the input is
+	// headerless PCM, so its format must be given explicitly
+	convertArgs := []string{"-loglevel", "info"} // More verbose logging for debugging
+	convertArgs = append(convertArgs, format.FFmpegArgs()...)
+	cmd := procs.FFmpeg(append(convertArgs,
 		"-i", inputPath, // Read from the temporary file
 		"-vn",                  // Skip video
 		"-acodec", "pcm_s16le", // Use PCM 16-bit audio codec
@@ -82,15 +394,15 @@ func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment
 		"-ac", "1", // Convert to mono
 		"-y",        // Overwrite output if exists
 		"-f", "wav", // Output format
-		audioPath) // Output to file
+		audioPath)...) // Output to file
 
 	// Create buffer for stderr output
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	// Run the ffmpeg process
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", err, stderr.String())
+	if err := procs.Run(cmd, procs.RoleTranscriber); err != nil {
+		return nil, procs.CommandFailed(cmd, stderr.String(), nil, fmt.Errorf("ffmpeg failed: %w, stderr: %s", classifyError(err, stderr.String()), stderr.String()))
 	}
 
 	// Check if audio file was created successfully and has content
@@ -103,52 +415,18 @@ func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment
 		return nil, fmt.Errorf("ffmpeg created empty output file, stderr: %s", stderr.String())
 	}
 
-	// Determine device type based on configuration
-	deviceType := "cpu"
-	if t.config.CUDAEnabled {
-		deviceType = "cuda"
-	}
-
-	// Use whisper-ctranslate2 to transcribe the audio
-	args := []string{
-		"--model_directory", filepath.Join(t.modelPath, "faster-whisper-large-v3-turbo-ct2"),
-		"--device", deviceType,
-		"--language", lang,
-		"--output_format", "json",
-		"--output_dir", tempDir,
-		"--threads", fmt.Sprintf("%d", t.config.GPUThreads),
-		"--word_timestamps", "True", // Get word-level timestamps
-	}
-
-	// Add VAD filter to improve audio processing
-	args = append(args, "--vad_filter", "True")
-
-	// Set compute type based on configuration
-	args = append(args, "--compute_type", t.config.ComputePrecision)
-
-	// Add batch processing if using GPU
-	if t.config.CUDAEnabled && t.config.BatchSize > 1 {
-		args = append(args, "--batched", "True")
-		args = append(args, "--batch_size", fmt.Sprintf("%d", t.config.BatchSize))
-	}
-
-	// Set beam size for better accuracy
-	args = append(args, "--beam_size", fmt.Sprintf("%d", t.config.BeamSize))
-
-	// Add the audio file path as the final argument
-	args = append(args, audioPath)
-
 	// Create pipes for stdout and stderr
-	cmd = exec.Command("whisper-ctranslate2", args...)
+	cfg := fallback.Apply(*t.config)
+	cmd = exec.Command("whisper-ctranslate2", whisperArgs(&cfg, t.decoding, t.modelDir, lang, tempDir, audioPath)...)
 	var stdout bytes.Buffer
 	stderr.Reset()
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	// Run transcription
-	err = cmd.Run()
+	err = procs.Run(cmd, procs.RoleTranscriber)
 	if err != nil {
-		return nil, fmt.Errorf("transcription failed: %w, stderr: %s", err, stderr.String())
+		return nil, procs.CommandFailed(cmd, stderr.String(), nil, fmt.Errorf("transcription failed: %w, stderr: %s", classifyError(err, stderr.String()), stderr.String()))
 	}
 
 	// Check for generated JSON output file
@@ -163,6 +441,7 @@ func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment
 		if err != nil {
 			return nil, fmt.Errorf("failed to read transcript JSON file: %w", err)
 		}
+		outputRead = true
 	} else {
 		// Save the stdout output as a fallback
 		transcriptBytes = stdout.Bytes()
@@ -171,21 +450,6 @@ func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment
 		return parseTranscript(string(transcriptBytes)), nil
 	}
 
-	// Save to output directory with timestamp if enabled
-	if t.config.OutputDir != "" && len(transcriptBytes) > 0 {
-		timeStr := time.Now().Format("20060102-150405")
-		outputFilename := filepath.Join(t.config.OutputDir, fmt.Sprintf("transcript-%s.txt", timeStr))
-
-		// Ensure directory exists (should already exist but double-check)
-		if err := os.MkdirAll(t.config.OutputDir, 0755); err != nil {
-			// Just log error and continue, this is not critical
-			fmt.Fprintf(os.Stderr, "failed to create output directory: %v\n", err)
-		} else {
-			// Try to save the transcript, but don't fail if it doesn't work
-			_ = os.WriteFile(outputFilename, transcriptBytes, 0644)
-		}
-	}
-
 	// Parse segments from the JSON output
 	segments, err := parseJSONOutput(string(transcriptBytes))
 	if err != nil {
@@ -196,14 +460,270 @@ func (t *Transcriber) TranscribeAudio(audioBytes []byte, lang string) ([]Segment
 	return segments, nil
 }
 
+// ChunkID identifies the audio of a chunk transcribed in lang. It only
+// depends on them, so every attempt at transcribing a chunk has the same ID.
+func ChunkID(audioBytes []byte, format audio.Format, lang string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00", strings.Join(format.FFmpegArgs(), " "), lang)
+	hash.Write(audioBytes)
+	return hex.EncodeToString(hash.Sum(nil)[:12])
+}
+
+// beginAttempt waits for other attempts at the chunk with the ID to finish
+// and returns the function ending this one
+func (t *Transcriber) beginAttempt(id string) func() {
+	t.attemptsMu.Lock()
+	for {
+		running, ok := t.attempts[id]
+		if !ok {
+			break
+		}
+		t.attemptsMu.Unlock()
+		<-running
+		t.attemptsMu.Lock()
+	}
+	done := make(chan struct{})
+	t.attempts[id] = done
+	t.attemptsMu.Unlock()
+
+	return func() {
+		t.attemptsMu.Lock()
+		delete(t.attempts, id)
+		t.attemptsMu.Unlock()
+		close(done)
+	}
+}
+
+// completedOutput returns the segments of the whisper output at path if an
+// earlier attempt completed it
+func completedOutput(path string) ([]Segment, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	// Whisper writes the file at the end, one cut short doesn't parse
+	segments, err := parseJSONOutput(string(data))
+	if err != nil {
+		return nil, false
+	}
+	return segments, true
+}
+
+// Fallback is a step down to cheaper transcription settings after the GPU
+// ran out of memory. Every step includes the ones before it.
+type Fallback int
+
+const (
+	FallbackNone      Fallback = iota // The configured settings
+	FallbackHalfBatch                 // Half the batch size
+	FallbackInt8                      // int8_float16 compute
+	FallbackCPU                       // Transcribe on the CPU
+)
+
+// fallbackComputeType is the cheaper GPU compute type of FallbackInt8
+const fallbackComputeType = "int8_float16"
+
+// fallbackCPUComputeType is the compute type of FallbackCPU, since CPUs
+// don't support float16
+const fallbackCPUComputeType = "int8"
+
+func (f Fallback) String() string {
+	switch f {
+	case FallbackNone:
+		return "none"
+	case FallbackHalfBatch:
+		return "half-batch"
+	case FallbackInt8:
+		return "int8"
+	case FallbackCPU:
+		return "cpu"
+	default:
+		return fmt.Sprintf("fallback(%d)", int(f))
+	}
+}
+
+// Apply returns cfg with the settings of the fallback applied
+func (f Fallback) Apply(cfg config.Config) config.Config {
+	if f >= FallbackHalfBatch {
+		cfg.BatchSize = max(cfg.BatchSize/2, 1)
+	}
+	if f >= FallbackInt8 {
+		cfg.ComputePrecision = fallbackComputeType
+	}
+	if f >= FallbackCPU {
+		cfg.CUDAEnabled = false
+		cfg.ComputePrecision = fallbackCPUComputeType
+	}
+	return cfg
+}
+
+// Next returns the next fallback that changes the settings of cfg, or false if
+// there is none. Without CUDA there is nothing to fall back from.
+func (f Fallback) Next(cfg *config.Config) (Fallback, bool) {
+	if !cfg.CUDAEnabled {
+		return f, false
+	}
+
+	current := f.Apply(*cfg)
+	for next := f + 1; next <= FallbackCPU; next++ {
+		if degraded := next.Apply(*cfg); degraded.BatchSize != current.BatchSize ||
+			degraded.ComputePrecision != current.ComputePrecision ||
+			degraded.CUDAEnabled != current.CUDAEnabled {
+			return next, true
+		}
+	}
+	return f, false
+}
+
+// whisperArgs builds the whisper-ctranslate2 arguments to transcribe
+// audioPath in lang, writing the JSON output to outputDir. Decoding
+// parameters are only passed when set.
+func whisperArgs(cfg *config.Config, decoding DecodingOptions, modelDir, lang, outputDir, audioPath string) []string {
+	// Determine device type based on configuration
+	deviceType := "cpu"
+	if cfg.CUDAEnabled {
+		deviceType = "cuda"
+	}
+
+	args := []string{
+		"--model_directory", modelDir,
+		"--device", deviceType,
+		"--language", lang,
+		"--output_format", "json",
+		"--output_dir", outputDir,
+		"--threads", strconv.Itoa(cfg.GPUThreads),
+		"--word_timestamps", "True", // Get word-level timestamps
+	}
+
+	// Add VAD filter to improve audio processing
+	args = append(args, "--vad_filter", "True")
+
+	// Set compute type based on configuration
+	args = append(args, "--compute_type", cfg.ComputePrecision)
+
+	// Add batch processing if using GPU
+	if cfg.CUDAEnabled && cfg.BatchSize > 1 {
+		args = append(args, "--batched", "True")
+		args = append(args, "--batch_size", strconv.Itoa(cfg.BatchSize))
+	}
+
+	// Set beam size for better accuracy
+	args = append(args, "--beam_size", strconv.Itoa(cfg.BeamSize))
+
+	if decoding.Temperature != nil {
+		args = append(args, "--temperature", strconv.FormatFloat(*decoding.Temperature, 'f', -1, 64))
+	}
+	if decoding.BestOf != nil {
+		args = append(args, "--best_of", strconv.Itoa(*decoding.BestOf))
+	}
+	if decoding.ConditionOnPreviousText != nil {
+		args = append(args, "--condition_on_previous_text", pythonBool(*decoding.ConditionOnPreviousText))
+	}
+	if decoding.NoSpeechThreshold != nil {
+		args = append(args, "--no_speech_threshold", strconv.FormatFloat(*decoding.NoSpeechThreshold, 'f', -1, 64))
+	}
+	if decoding.CompressionRatioThreshold != nil {
+		args = append(args, "--compression_ratio_threshold", strconv.FormatFloat(*decoding.CompressionRatioThreshold, 'f', -1, 64))
+	}
+	if decoding.VADMinSilence != nil {
+		args = append(args, "--vad_min_silence_duration_ms", strconv.FormatInt(decoding.VADMinSilence.Milliseconds(), 10))
+	}
+	if decoding.VADSpeechPad != nil {
+		args = append(args, "--vad_speech_pad_ms", strconv.FormatInt(decoding.VADSpeechPad.Milliseconds(), 10))
+	}
+
+	// Add the audio file path as the final argument
+	return append(args, audioPath)
+}
+
+// pythonBool formats a boolean the way whisper-ctranslate2 parses it
+func pythonBool(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+// classifyError wraps err with the sentinel error matching the process
+// output, if any
+func classifyError(err error, stderr string) error {
+	for _, class := range []struct {
+		sentinel error
+		patterns []string
+	}{
+		{ErrOutOfMemory, outOfMemoryPatterns},
+		{ErrModelMissing, modelMissingPatterns},
+		{ErrCorruptAudio, corruptAudioPatterns},
+	} {
+		for _, pattern := range class.patterns {
+			if strings.Contains(stderr, pattern) {
+				return fmt.Errorf("%w: %w", class.sentinel, err)
+			}
+		}
+	}
+	return err
+}
+
+// whisperOutput is the JSON document written by whisper-ctranslate2. The
+// language of a segment is only there if the backend detects it per segment;
+// otherwise the segments are in the language of the document.
+type whisperOutput struct {
+	Language string `json:"language"`
+	Segments []struct {
+		ID               int     `json:"id"`
+		Language         string  `json:"language"`
+		Seek             int     `json:"seek"`
+		Start            float64 `json:"start"`
+		End              float64 `json:"end"`
+		Text             string  `json:"text"`
+		Temperature      float64 `json:"temperature"`
+		AvgLogProb       float64 `json:"avg_logprob"`
+		CompressionRatio float64 `json:"compression_ratio"`
+		NoSpeechProb     float64 `json:"no_speech_prob"`
+	} `json:"segments"`
+}
+
 // parseJSONOutput parses the JSON output from whisper-ctranslate2
-// This is a simplified version for illustration - in a real implementation,
-// you'd use proper JSON parsing with the json package
 func parseJSONOutput(jsonStr string) ([]Segment, error) {
-	// Simplified implementation - in production, use proper JSON parsing
-	// This function should extract segments from the JSON format
-	// For now, fall back to the basic parsing
-	return parseTranscript(jsonStr), nil
+	var output whisperOutput
+	if err := json.Unmarshal([]byte(jsonStr), &output); err != nil {
+		return nil, fmt.Errorf("failed to parse whisper JSON output: %w", err)
+	}
+
+	segments := make([]Segment, 0, len(output.Segments))
+	for _, s := range output.Segments {
+		text := strings.TrimSpace(s.Text)
+		if text == "" {
+			continue
+		}
+		language := s.Language
+		if language == "" {
+			language = output.Language
+		}
+
+		segments = append(segments, Segment{
+			ID:               s.ID,
+			Start:            s.Start,
+			End:              s.End,
+			Text:             text,
+			Timestamp:        fmt.Sprintf("%s --> %s", formatTimestamp(s.Start), formatTimestamp(s.End)),
+			AvgLogProb:       s.AvgLogProb,
+			NoSpeechProb:     s.NoSpeechProb,
+			DetectedLanguage: language,
+			Seek:             s.Seek,
+			Temperature:      s.Temperature,
+			CompressionRatio: s.CompressionRatio,
+		})
+	}
+
+	return segments, nil
+}
+
+// formatTimestamp formats seconds in the HH:MM:SS.mmm form of the text output
+func formatTimestamp(seconds float64) string {
+	hours := int(seconds / 3600)
+	minutes := int(seconds/60) % 60
+	return fmt.Sprintf("%02d:%02d:%06.3f", hours, minutes, math.Mod(seconds, 60))
 }
 
 func parseTranscript(transcript string) []Segment {
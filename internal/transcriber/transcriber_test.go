@@ -0,0 +1,348 @@
+package transcriber
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/audio"
+	"github.com/ben/transcription-proxy/internal/config"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		sample string // Captured output in testdata/stderr
+		want   error  // nil if the error stays unclassified
+	}{
+		{"cuda_oom.txt", ErrOutOfMemory},
+		{"cublas_alloc.txt", ErrOutOfMemory},
+		{"model_missing.txt", ErrModelMissing},
+		{"corrupt_audio.txt", ErrCorruptAudio},
+		{"segfault.txt", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			stderr, err := os.ReadFile(filepath.Join("testdata", "stderr", tt.sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitErr := errors.New("exit status 1")
+
+			got := classifyError(exitErr, string(stderr))
+			if !errors.Is(got, exitErr) {
+				t.Errorf("classifyError() = %v, lost the process error", got)
+			}
+			for _, sentinel := range []error{ErrOutOfMemory, ErrModelMissing, ErrCorruptAudio} {
+				if errors.Is(got, sentinel) != (sentinel == tt.want) {
+					t.Errorf("classifyError() = %v, errors.Is(%v) = %v", got, sentinel, !(sentinel == tt.want))
+				}
+			}
+		})
+	}
+}
+
+// flagValue returns the value following flag in args, and whether it is there
+func flagValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func TestWhisperArgs(t *testing.T) {
+	temperature, bestOf, noSpeech, compression := 0.2, 3, 0.45, 2.6
+	condition := false
+	minSilence, speechPad := 500*time.Millisecond, 1500*time.Millisecond
+
+	// Flags only passed when their option is set
+	decodingFlags := []string{
+		"--temperature", "--best_of", "--condition_on_previous_text", "--no_speech_threshold",
+		"--compression_ratio_threshold", "--vad_min_silence_duration_ms", "--vad_speech_pad_ms",
+	}
+
+	tests := []struct {
+		name     string
+		decoding DecodingOptions
+		flag     string
+		want     string
+	}{
+		{"temperature", DecodingOptions{Temperature: &temperature}, "--temperature", "0.2"},
+		{"best of", DecodingOptions{BestOf: &bestOf}, "--best_of", "3"},
+		{"condition on previous text", DecodingOptions{ConditionOnPreviousText: &condition}, "--condition_on_previous_text", "False"},
+		{"no speech threshold", DecodingOptions{NoSpeechThreshold: &noSpeech}, "--no_speech_threshold", "0.45"},
+		{"compression ratio threshold", DecodingOptions{CompressionRatioThreshold: &compression}, "--compression_ratio_threshold", "2.6"},
+		{"VAD min silence", DecodingOptions{VADMinSilence: &minSilence}, "--vad_min_silence_duration_ms", "500"},
+		{"VAD speech pad", DecodingOptions{VADSpeechPad: &speechPad}, "--vad_speech_pad_ms", "1500"},
+	}
+	cfg := &config.Config{GPUThreads: 4, ComputePrecision: "float16", BeamSize: 5}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := whisperArgs(cfg, tt.decoding, "/models/large", "de", "/tmp/out", "/tmp/chunk.wav")
+			if got, ok := flagValue(args, tt.flag); !ok || got != tt.want {
+				t.Errorf("%s = %q, want %q in %v", tt.flag, got, tt.want, args)
+			}
+			for _, flag := range decodingFlags {
+				if _, ok := flagValue(args, flag); ok && flag != tt.flag {
+					t.Errorf("%s passed without being set", flag)
+				}
+			}
+			if last := args[len(args)-1]; last != "/tmp/chunk.wav" {
+				t.Errorf("last argument = %q, want the audio path", last)
+			}
+		})
+	}
+}
+
+func TestWhisperArgsDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		device  string
+		batched bool
+	}{
+		{"CPU", config.Config{BatchSize: 8}, "cpu", false},
+		{"GPU", config.Config{CUDAEnabled: true, BatchSize: 1}, "cuda", false},
+		{"GPU batched", config.Config{CUDAEnabled: true, BatchSize: 8}, "cuda", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := whisperArgs(&tt.cfg, DecodingOptions{}, "/models/large", "en", "/tmp/out", "/tmp/chunk.wav")
+			if device, _ := flagValue(args, "--device"); device != tt.device {
+				t.Errorf("--device = %q, want %q", device, tt.device)
+			}
+			if size, batched := flagValue(args, "--batch_size"); batched != tt.batched || (batched && size != "8") {
+				t.Errorf("--batch_size = %q, batched %v, want %v", size, batched, tt.batched)
+			}
+		})
+	}
+}
+
+func TestParseDecodingOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr []string // Settings named in the error
+	}{
+		{"none set", config.Config{}, nil},
+		{"all valid", config.Config{
+			WhisperTemperature:               "0",
+			WhisperBestOf:                    "5",
+			WhisperConditionOnPreviousText:   "false",
+			WhisperNoSpeechThreshold:         "0.6",
+			WhisperCompressionRatioThreshold: "2.4",
+			WhisperVADMinSilence:             "2s",
+			WhisperVADSpeechPad:              "400ms",
+		}, nil},
+		{"temperature above 1", config.Config{WhisperTemperature: "1.5"}, []string{"WHISPER_TEMPERATURE"}},
+		{"best of zero", config.Config{WhisperBestOf: "0"}, []string{"WHISPER_BEST_OF"}},
+		{"not a bool", config.Config{WhisperConditionOnPreviousText: "sometimes"}, []string{"WHISPER_CONDITION_ON_PREVIOUS_TEXT"}},
+		{"zero compression ratio", config.Config{WhisperCompressionRatioThreshold: "0"}, []string{"WHISPER_COMPRESSION_RATIO_THRESHOLD"}},
+		{"negative duration", config.Config{WhisperVADSpeechPad: "-1s"}, []string{"WHISPER_VAD_SPEECH_PAD"}},
+		{"every invalid one reported", config.Config{WhisperNoSpeechThreshold: "high", WhisperVADMinSilence: "long"},
+			[]string{"WHISPER_NO_SPEECH_THRESHOLD", "WHISPER_VAD_MIN_SILENCE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDecodingOptions(&tt.cfg)
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("ParseDecodingOptions() = %v, want error %v", err, tt.wantErr != nil)
+			}
+			for _, name := range tt.wantErr {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("error %q doesn't name %s", err, name)
+				}
+			}
+		})
+	}
+}
+
+// fakeToolsScripts stand in for FFmpeg, which writes a WAV header to the
+// output file given last, and whisper-ctranslate2, which copies the output
+// next to it to where whisper writes the JSON for the audio file, and counts
+// its runs
+var fakeToolsScripts = map[string]string{
+	"ffmpeg": `#!/bin/sh
+for out; do :; done
+printf RIFF > "$out"
+`,
+	"whisper-ctranslate2": `#!/bin/sh
+echo run >> "$(dirname "$0")/runs"
+out=.
+while [ $# -gt 1 ]; do
+	[ "$1" = --output_dir ] && out=$2
+	shift
+done
+cp "$(dirname "$0")/output.json" "$out/$(basename "$1" .wav).json"
+`,
+}
+
+// whisperJSON returns whisper's JSON output with the texts as segments of a
+// second each
+func whisperJSON(t *testing.T, texts ...string) []byte {
+	t.Helper()
+	type segment struct {
+		ID    int     `json:"id"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Text  string  `json:"text"`
+	}
+	output := struct {
+		Language string    `json:"language"`
+		Segments []segment `json:"segments"`
+	}{Language: "en", Segments: []segment{}}
+	for i, text := range texts {
+		output.Segments = append(output.Segments, segment{ID: i, Start: float64(i), End: float64(i + 1), Text: text})
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// fakeTools puts a fake FFmpeg and whisper-ctranslate2 returning output first
+// on the PATH for the rest of the test, and returns a function counting the
+// runs of whisper so far
+func fakeTools(t *testing.T, output []byte) func() int {
+	t.Helper()
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	for name, script := range fakeToolsScripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(bin, "output.json"), output, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return func() int {
+		runs, _ := os.ReadFile(filepath.Join(bin, "runs"))
+		return strings.Count(string(runs), "run")
+	}
+}
+
+// texts returns the texts of segments
+func texts(segments []Segment) []string {
+	texts := make([]string, len(segments))
+	for i, segment := range segments {
+		texts[i] = segment.Text
+	}
+	return texts
+}
+
+func TestChunkID(t *testing.T) {
+	pcm := make([]byte, 4096)
+	other := make([]byte, 4096)
+	other[100] = 1
+	id := ChunkID(pcm, audio.Expected, "en")
+
+	tests := []struct {
+		name   string
+		pcm    []byte
+		format audio.Format
+		lang   string
+		same   bool
+	}{
+		{"same chunk", make([]byte, 4096), audio.Expected, "en", true},
+		{"other audio", other, audio.Expected, "en", false},
+		{"other language", pcm, audio.Expected, "de", false},
+		{"other format", pcm, audio.Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16}, "en", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChunkID(tt.pcm, tt.format, tt.lang); (got == id) != tt.same {
+				t.Errorf("ChunkID() = %s, first chunk %s, want same %v", got, id, tt.same)
+			}
+		})
+	}
+}
+
+func TestTranscribeRetry(t *testing.T) {
+	pcm := make([]byte, 4096)
+	id := ChunkID(pcm, audio.Expected, "en")
+
+	tests := []struct {
+		name string
+		// file and data are written to the temp directory before the retry,
+		// as a whisper outliving the attempt given up on would have
+		file string
+		data []byte
+		want []string
+		runs int
+	}{
+		{"no earlier output", "", nil, []string{"fresh"}, 1},
+		{"late completion reused", "audio-" + id + ".json", whisperJSON(t, "late", "completion"), []string{"late", "completion"}, 0},
+		{"cut short output discarded", "audio-" + id + ".json", whisperJSON(t, "late")[:20], []string{"fresh"}, 1},
+		{"output of another chunk ignored", "audio-0123456789abcdef01234567.json", whisperJSON(t, "other"), []string{"fresh"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := fakeTools(t, whisperJSON(t, "fresh"))
+			tr := New(config.New())
+			dir := t.TempDir()
+			if tt.file != "" {
+				if err := os.WriteFile(filepath.Join(dir, tt.file), tt.data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			segments, err := tr.TranscribeAudio(dir, pcm, audio.Expected, "en")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := texts(segments); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("segments = %q, want %q", got, tt.want)
+			}
+			if runs() != tt.runs {
+				t.Errorf("whisper ran %d times, want %d", runs(), tt.runs)
+			}
+
+			// The output of the chunk is gone once read, so the next attempt
+			// transcribes again rather than emitting the same segments twice
+			if _, err := os.Stat(filepath.Join(dir, "audio-"+id+".json")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("output of the chunk left behind: %v", err)
+			}
+			segments, err = tr.TranscribeAudio(dir, pcm, audio.Expected, "en")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := texts(segments); !reflect.DeepEqual(got, []string{"fresh"}) {
+				t.Errorf("segments of the next attempt = %q, want only the fresh ones", got)
+			}
+		})
+	}
+}
+
+func TestBeginAttempt(t *testing.T) {
+	tr := New(config.New())
+	end := tr.beginAttempt("chunk")
+
+	// Another attempt at the same chunk waits for the first to end, one at
+	// another chunk doesn't
+	tr.beginAttempt("other")()
+	started := make(chan func())
+	go func() { started <- tr.beginAttempt("chunk") }()
+	select {
+	case <-started:
+		t.Fatal("second attempt started while the first was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	end()
+	select {
+	case endSecond := <-started:
+		endSecond()
+	case <-time.After(time.Second):
+		t.Fatal("second attempt didn't start once the first ended")
+	}
+	if len(tr.attempts) != 0 {
+		t.Errorf("attempts = %v, want none running", tr.attempts)
+	}
+}
@@ -0,0 +1,1041 @@
+// Package transcript continuously persists the finalized segments of a stream
+// session to disk as a plain-text transcript, a JSONL transcript, and a
+// sidecar subtitle file, and assembles a readable full transcript and,
+// optionally, a transcript in Whisper's verbose_json format from them. The
+// sidecar subtitle file is written by a Sidecar, as a subtitle sink of the
+// pipeline.
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/searchindex"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// Record is a single line of the JSONL transcript. Times are relative to the
+// start of the stream. Text is always the unmasked text; Masked marks records
+// whose captions had profanity masked, and Caption holds the masked text.
+// Source is the text before translation, if it was translated. A record with
+// Gap set is no segment but marks where the publisher reconnected, at Start,
+// after being away for Gap seconds.
+type Record struct {
+	Chunk   int     `json:"chunk"`
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Text    string  `json:"text"`
+	Masked  bool    `json:"masked,omitempty"`
+	Caption string  `json:"caption,omitempty"`
+	Source  string  `json:"source,omitempty"`
+
+	AvgLogProb       float64 `json:"avg_logprob"`
+	NoSpeechProb     float64 `json:"no_speech_prob"`
+	DetectedLanguage string  `json:"detected_language,omitempty"`
+
+	Seek             int     `json:"seek,omitempty"`
+	Temperature      float64 `json:"temperature,omitempty"`
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+
+	Speaker string `json:"speaker,omitempty"`
+
+	// Untranslated lists the languages whose subtitle tracks kept the
+	// original text of the segment because its translation failed
+	Untranslated []string `json:"untranslated,omitempty"`
+
+	Gap float64 `json:"gap,omitempty"`
+}
+
+// ErrDuplicateSegments is returned by Append for segments of a chunk that
+// were appended before, which are left out
+var ErrDuplicateSegments = errors.New("duplicate segments")
+
+// segmentKey identifies an appended segment. Segments held back by the
+// reflower are appended with the next chunk, so whisper's segment ID is only
+// unique along with the start of the segment.
+type segmentKey struct {
+	chunk int
+	id    int
+	start float64
+}
+
+// Track is the captions of a chunk in one language of the subtitle tracks
+type Track struct {
+	Lang string
+	// Segments are the captions in Lang, one for each caption of the chunk
+	Segments []transcriber.Segment
+	// Fallback marks the segments that kept the original text because their
+	// translation failed, nil if none did
+	Fallback []bool
+}
+
+// Cue is a finalized segment kept in memory for live captions. IDs increase
+// monotonically within a session and match the cue numbers of the subtitle
+// tracks.
+type Cue struct {
+	ID      int
+	Segment transcriber.Segment
+}
+
+// outputFile is a buffered file written by the store
+type outputFile struct {
+	name string
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Store appends segments of a single session to its transcript files
+type Store struct {
+	mu    sync.Mutex
+	dir   string
+	txt   *outputFile
+	jsonl *outputFile
+	// tracks are the subtitle files per language, if enabled, named after
+	// baseName
+	tracks   map[string]*outputFile
+	baseName string
+	format   subtitles.SubtitleFormat
+	vtt      subtitles.VTTOptions // Used if format is VTT
+	cueIndex int
+	closed   bool
+	// appended holds the segments written so far
+	appended map[segmentKey]bool
+
+	// fullName and sourceName are the full transcripts, rewritten from the
+	// JSONL transcript at fullWritten and on Close. sourceName is empty until
+	// something was translated.
+	fullName    string
+	sourceName  string
+	fullWritten time.Time
+	// verboseName is the verbose_json transcript in verboseLang, written
+	// along with the full transcripts; empty unless enabled
+	verboseName string
+	verboseLang string
+
+	// history holds the last cues of the stream; only those within
+	// historyWindow of the newest cue are served
+	history       *cueRing
+	historyWindow time.Duration
+
+	// index, if set, gets the segments of every chunk as segments of
+	// indexSession, which started at indexStart
+	index        *searchindex.Index
+	indexSession string
+	indexStart   time.Time
+}
+
+// New creates the transcript files named baseName plus an extension inside dir,
+// with subtitle tracks in format, written with the vtt options if it is VTT. The
+// last historySize cues are kept in memory, of which those ending within
+// historyWindow of the newest cue are served as live captions.
+func New(dir, baseName string, format subtitles.SubtitleFormat, vtt subtitles.VTTOptions, historyWindow time.Duration, historySize int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create transcript directory: %w", err)
+	}
+
+	s := &Store{
+		dir:           dir,
+		baseName:      baseName,
+		format:        format,
+		vtt:           vtt,
+		fullName:      baseName + FullSuffix,
+		fullWritten:   time.Now(),
+		history:       newCueRing(historySize),
+		historyWindow: historyWindow,
+		appended:      make(map[segmentKey]bool),
+	}
+	targets := []struct {
+		file **outputFile
+		ext  string
+	}{
+		{&s.txt, ".txt"},
+		{&s.jsonl, ".jsonl"},
+	}
+
+	for _, target := range targets {
+		name := baseName + target.ext
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		*target.file = &outputFile{name: name, file: file, w: bufio.NewWriter(file)}
+	}
+
+	return s, nil
+}
+
+// writeHeader writes the start of a subtitle file in format, with the vtt
+// options if it is VTT
+func writeHeader(w io.Writer, format subtitles.SubtitleFormat, vtt subtitles.VTTOptions) error {
+	if format == subtitles.FormatVTT {
+		return subtitles.WriteVTTHeader(w, vtt)
+	}
+	return subtitles.WriteHeader(w, format)
+}
+
+// writeCue writes a cue to a subtitle file in format, with the vtt options if
+// it is VTT
+func writeCue(w io.Writer, format subtitles.SubtitleFormat, vtt subtitles.VTTOptions, index int, segment transcriber.Segment) error {
+	if format == subtitles.FormatVTT {
+		return subtitles.WriteVTTCue(w, index, segment, vtt)
+	}
+	return subtitles.WriteCue(w, format, index, segment)
+}
+
+// Files returns the names of the files written by the store. The
+// source-language full transcript is only among them once something was
+// translated.
+func (s *Store) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fileNames()
+}
+
+// fileNames does the work of Files; the caller must hold s.mu
+func (s *Store) fileNames() []string {
+	files := []string{s.txt.name, s.jsonl.name, s.fullName}
+	if s.verboseName != "" {
+		files = append(files, s.verboseName)
+	}
+	for _, lang := range s.trackLangs() {
+		files = append(files, s.tracks[lang].name)
+	}
+	// Only found once something was translated, so it comes last
+	if s.sourceName != "" {
+		files = append(files, s.sourceName)
+	}
+	return files
+}
+
+// EnableVerboseJSON makes the store also write the transcript in Whisper's
+// verbose_json format, with language as its language
+func (s *Store) EnableVerboseJSON(language string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.verboseName = strings.TrimSuffix(s.jsonl.name, ".jsonl") + VerboseSuffix
+	s.verboseLang = language
+}
+
+// AddTracks makes the store also write a subtitle file for each of langs
+// it doesn't write one for yet, named after the subtitle file with the
+// language added, e.g. stream.es.srt. Captions appended from then on go into
+// them. If a file can't be created, none of the new ones are written.
+func (s *Store) AddTracks(langs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("transcript store is closed")
+	}
+	added := make(map[string]*outputFile, len(langs))
+	for _, lang := range langs {
+		if _, ok := s.tracks[lang]; ok {
+			continue
+		}
+		name := s.baseName + "." + lang + "." + string(s.format)
+		file, err := os.Create(filepath.Join(s.dir, name))
+		if err == nil {
+			added[lang] = &outputFile{name: name, file: file, w: bufio.NewWriter(file)}
+			err = writeHeader(added[lang].w, s.format, s.vtt)
+		}
+		if err != nil {
+			for _, track := range added {
+				track.file.Close()
+				os.Remove(track.file.Name())
+			}
+			return fmt.Errorf("failed to create %s: %w", name, err)
+		}
+	}
+
+	if s.tracks == nil {
+		s.tracks = make(map[string]*outputFile, len(added))
+	}
+	for lang, track := range added {
+		s.tracks[lang] = track
+	}
+	return nil
+}
+
+// TrackFiles returns the names of the subtitle files per language, nil
+// until tracks are added
+func (s *Store) TrackFiles() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tracks == nil {
+		return nil
+	}
+	names := make(map[string]string, len(s.tracks))
+	for lang, track := range s.tracks {
+		names[lang] = track.name
+	}
+	return names
+}
+
+// IndexInto makes the store also add the segments of every chunk to index,
+// as those of session, which started at startedAt
+func (s *Store) IndexInto(index *searchindex.Index, session string, startedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = index
+	s.indexSession = session
+	s.indexStart = startedAt
+}
+
+// Append writes the segments of a chunk, captioned in lang, into the session.
+// Segment times must be relative to the start of the stream. captions are
+// written to the
+// plain-text transcript, the subtitles, and the live history; originals holds
+// the same segments before profanity masking for the JSONL transcript, or nil
+// if nothing was masked, and sources the same segments before translation, or
+// nil if they weren't translated. Line breaks in captions are only kept in the
+// subtitles and the live history. tracks are the same captions in the
+// languages of the subtitle tracks; those without a track are ignored.
+// Segments of the chunk that were appended before, like those of a retried
+// transcription, are left out and reported with ErrDuplicateSegments.
+func (s *Store) Append(chunk int, lang string, captions, originals, sources []transcriber.Segment, tracks ...Track) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var indexed []searchindex.Segment
+	duplicates := 0
+	for i, segment := range captions {
+		key := segmentKey{chunk: chunk, id: segment.ID, start: segment.Start}
+		if s.appended[key] {
+			duplicates++
+			continue
+		}
+		s.appended[key] = true
+
+		// The speaker prefix is only kept in the captions written out, the
+		// JSONL transcript records the speaker instead
+		caption := subtitles.Unwrap(segment.Text)
+		plain := strings.TrimPrefix(caption, segment.SpeakerPrefix)
+		text := plain
+		if originals != nil {
+			text = subtitles.Unwrap(originals[i].Text)
+		}
+
+		s.cueIndex++
+		s.history.push(Cue{ID: s.cueIndex, Segment: segment})
+
+		// Every track numbers its cues like the subtitles
+		var untranslated []string
+		for _, track := range tracks {
+			out, ok := s.tracks[track.Lang]
+			if !ok || i >= len(track.Segments) {
+				continue
+			}
+			if err := writeCue(out.w, s.format, s.vtt, s.cueIndex, track.Segments[i]); err != nil {
+				return fmt.Errorf("failed to write %s subtitle cue: %w", track.Lang, err)
+			}
+			if track.Fallback != nil && track.Fallback[i] {
+				untranslated = append(untranslated, track.Lang)
+			}
+		}
+
+		record := Record{
+			Chunk:  chunk,
+			Start:  segment.Start,
+			End:    segment.End,
+			Text:   text,
+			Masked: text != plain,
+
+			AvgLogProb:       segment.AvgLogProb,
+			NoSpeechProb:     segment.NoSpeechProb,
+			DetectedLanguage: segment.DetectedLanguage,
+			Seek:             segment.Seek,
+			Temperature:      segment.Temperature,
+			CompressionRatio: segment.CompressionRatio,
+			Speaker:          segment.Speaker,
+			Untranslated:     untranslated,
+		}
+		if record.Masked {
+			record.Caption = plain
+		}
+		if sources != nil {
+			if source := subtitles.Unwrap(sources[i].Text); source != text {
+				record.Source = source
+			}
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode transcript record: %w", err)
+		}
+		if _, err := fmt.Fprintf(s.jsonl.w, "%s\n", line); err != nil {
+			return fmt.Errorf("failed to write transcript record: %w", err)
+		}
+
+		if _, err := fmt.Fprintln(s.txt.w, caption); err != nil {
+			return fmt.Errorf("failed to write transcript line: %w", err)
+		}
+
+		if s.index != nil {
+			entry := searchindex.Segment{
+				Session: s.indexSession,
+				Chunk:   chunk,
+				Start:   segment.Start,
+				End:     segment.End,
+				At:      s.indexStart.Add(time.Duration(segment.Start * float64(time.Second))),
+				Lang:    lang,
+				Text:    text,
+			}
+			if record.Source != "" {
+				entry.Text = record.Source
+				entry.Translation = text
+			}
+			indexed = append(indexed, entry)
+		}
+	}
+
+	// Flush after every chunk so the files are usable while the stream runs
+	for _, f := range s.files() {
+		if err := f.w.Flush(); err != nil {
+			return fmt.Errorf("failed to flush %s: %w", f.name, err)
+		}
+	}
+
+	var err error
+	if time.Since(s.fullWritten) >= fullInterval {
+		err = s.writeFull()
+	}
+
+	// The whole chunk is indexed in one transaction
+	if s.index != nil {
+		if indexErr := s.index.Add(indexed); indexErr != nil && err == nil {
+			err = indexErr
+		}
+	}
+	if duplicates > 0 && err == nil {
+		err = fmt.Errorf("%w: %d of chunk %d", ErrDuplicateSegments, duplicates, chunk)
+	}
+	return err
+}
+
+// MarkGap notes in the plain-text and JSONL transcripts that the publisher
+// reconnected at the stream time at, in seconds, after being away for gap.
+// The stream time goes on where it was when the publisher left, so the gap
+// would otherwise not show.
+func (s *Store) MarkGap(at float64, gap time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("transcript store is closed")
+	}
+	line, err := json.Marshal(Record{Start: at, End: at, Gap: gap.Seconds()})
+	if err != nil {
+		return fmt.Errorf("failed to encode transcript record: %w", err)
+	}
+	if _, err := fmt.Fprintf(s.jsonl.w, "%s\n", line); err != nil {
+		return fmt.Errorf("failed to write transcript record: %w", err)
+	}
+	if _, err := fmt.Fprintln(s.txt.w, gapNote(gap)); err != nil {
+		return fmt.Errorf("failed to write transcript line: %w", err)
+	}
+	for _, f := range []*outputFile{s.jsonl, s.txt} {
+		if err := f.w.Flush(); err != nil {
+			return fmt.Errorf("failed to flush %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// gapNote is the line marking a reconnect of the publisher in transcripts
+func gapNote(gap time.Duration) string {
+	return fmt.Sprintf("(publisher reconnected after %s)", gap.Round(time.Second))
+}
+
+// Flush writes everything appended so far to disk right away, rewrites the
+// full transcripts, and syncs the files, so they are complete up to the last
+// appended chunk while the session goes on. It returns the paths of the
+// files. Flushing a closed store only returns the paths.
+func (s *Store) Flush() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		for _, f := range s.files() {
+			if err := f.w.Flush(); err != nil {
+				return nil, fmt.Errorf("failed to flush %s: %w", f.name, err)
+			}
+			if err := f.file.Sync(); err != nil {
+				return nil, fmt.Errorf("failed to sync %s: %w", f.name, err)
+			}
+		}
+		if err := s.writeFull(); err != nil {
+			return nil, err
+		}
+	}
+
+	names := s.fileNames()
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(s.dir, name)
+	}
+	return paths, nil
+}
+
+// writeFull rewrites the full transcripts, and the verbose_json transcript
+// if enabled, from the JSONL transcript; the caller must hold s.mu and have
+// flushed it
+func (s *Store) writeFull() error {
+	s.fullWritten = time.Now()
+	path := filepath.Join(s.dir, s.jsonl.name)
+	files, err := WriteFull(path)
+	if err != nil {
+		return err
+	}
+	if len(files) > 1 {
+		s.sourceName = files[1]
+	}
+
+	if s.verboseName != "" {
+		if _, err := WriteVerboseJSON(path, s.verboseLang); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cues returns the cues in the history window with an ID greater than since,
+// oldest first
+func (s *Store) Cues(since int) []Cue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cues(since)
+}
+
+// Recent returns up to limit of the newest cues in the history window, oldest
+// first
+func (s *Store) Recent(limit int) []Cue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cues := s.cues(0)
+	if limit >= 0 && len(cues) > limit {
+		cues = cues[len(cues)-limit:]
+	}
+	return cues
+}
+
+// cues does the work of Cues; the caller must hold s.mu
+func (s *Store) cues(since int) []Cue {
+	all := s.history.all()
+	if len(all) == 0 {
+		return nil
+	}
+
+	cutoff := all[len(all)-1].Segment.End - s.historyWindow.Seconds()
+	var cues []Cue
+	for _, cue := range all {
+		if cue.ID > since && cue.Segment.End >= cutoff {
+			cues = append(cues, cue)
+		}
+	}
+	return cues
+}
+
+// cueRing keeps the last cues in a fixed-size buffer, overwriting the oldest
+type cueRing struct {
+	cues  []Cue
+	next  int // Position of the next cue
+	count int
+}
+
+// newCueRing creates a ring holding up to size cues, at least one
+func newCueRing(size int) *cueRing {
+	if size < 1 {
+		size = 1
+	}
+	return &cueRing{cues: make([]Cue, size)}
+}
+
+// push adds a cue, dropping the oldest one if the ring is full
+func (r *cueRing) push(cue Cue) {
+	r.cues[r.next] = cue
+	r.next = (r.next + 1) % len(r.cues)
+	if r.count < len(r.cues) {
+		r.count++
+	}
+}
+
+// all returns a copy of the cues in the ring, oldest first
+func (r *cueRing) all() []Cue {
+	cues := make([]Cue, 0, r.count)
+	start := (r.next - r.count + len(r.cues)) % len(r.cues)
+	for i := 0; i < r.count; i++ {
+		cues = append(cues, r.cues[(start+i)%len(r.cues)])
+	}
+	return cues
+}
+
+// Close flushes and closes the transcript files, and writes the full
+// transcripts a last time
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var firstErr error
+	for _, f := range s.files() {
+		if err := f.w.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Only a store that was created completely has a transcript to read
+	if s.jsonl != nil && firstErr == nil {
+		firstErr = s.writeFull()
+	}
+
+	return firstErr
+}
+
+// files returns the files that have been opened
+func (s *Store) files() []*outputFile {
+	var files []*outputFile
+	for _, f := range []*outputFile{s.txt, s.jsonl} {
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	for _, lang := range s.trackLangs() {
+		files = append(files, s.tracks[lang])
+	}
+	return files
+}
+
+// trackLangs returns the languages of the subtitle tracks in order; the
+// caller must hold s.mu
+func (s *Store) trackLangs() []string {
+	langs := make([]string, 0, len(s.tracks))
+	for lang := range s.tracks {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Sidecar writes the captions of a session to the subtitle file next to its
+// transcripts as the chunks are captioned. It is a subtitle sink of the
+// pipeline. Captions written before, like those of a retried chunk, are left
+// out.
+type Sidecar struct {
+	mu       sync.Mutex
+	dir      string
+	out      *outputFile
+	format   subtitles.SubtitleFormat
+	vtt      subtitles.VTTOptions // Used if format is VTT
+	cueIndex int
+	closed   bool
+	// written holds the captions written so far, by the stream time of
+	// their chunk
+	written map[sidecarKey]bool
+}
+
+// sidecarKey identifies a written caption, like segmentKey
+type sidecarKey struct {
+	chunk time.Duration
+	id    int
+	start float64
+}
+
+// NewSidecar creates the subtitle file named baseName plus the extension of
+// format inside dir, written with the vtt options if it is VTT
+func NewSidecar(dir, baseName string, format subtitles.SubtitleFormat, vtt subtitles.VTTOptions) (*Sidecar, error) {
+	name := baseName + "." + string(format)
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	s := &Sidecar{
+		dir:     dir,
+		out:     &outputFile{name: name, file: file, w: bufio.NewWriter(file)},
+		format:  format,
+		vtt:     vtt,
+		written: make(map[sidecarKey]bool),
+	}
+	if err := writeHeader(s.out.w, format, vtt); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// Name returns the name of the subtitle file
+func (s *Sidecar) Name() string {
+	return s.out.name
+}
+
+// WriteCues writes the stream-relative captions of the chunk starting
+// streamTime as the next cues
+func (s *Sidecar) WriteCues(streamTime time.Duration, segments []transcriber.Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("%s is closed", s.out.name)
+	}
+	for _, segment := range segments {
+		key := sidecarKey{chunk: streamTime, id: segment.ID, start: segment.Start}
+		if s.written[key] {
+			continue
+		}
+		s.written[key] = true
+
+		s.cueIndex++
+		if err := writeCue(s.out.w, s.format, s.vtt, s.cueIndex, segment); err != nil {
+			return fmt.Errorf("failed to write subtitle cue: %w", err)
+		}
+	}
+	// Flush after every chunk so the file is usable while the stream runs
+	if err := s.out.w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", s.out.name, err)
+	}
+	return nil
+}
+
+// Sync writes the cues so far to disk right away and returns the path of the
+// subtitle file
+func (s *Sidecar) Sync() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, s.out.name)
+	if s.closed {
+		return path, nil
+	}
+	if err := s.out.w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to flush %s: %w", s.out.name, err)
+	}
+	if err := s.out.file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync %s: %w", s.out.name, err)
+	}
+	return path, nil
+}
+
+// Close flushes and closes the subtitle file
+func (s *Sidecar) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.out.w.Flush()
+	if closeErr := s.out.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// FullSuffix replaces the .jsonl extension in the name of the full
+// transcript, and SourceSuffix in the name of its source-language version
+const (
+	FullSuffix   = ".full.txt"
+	SourceSuffix = ".full.source.txt"
+)
+
+// VerboseSuffix replaces the .jsonl extension in the name of the
+// verbose_json transcript
+const VerboseSuffix = ".verbose.json"
+
+// ParagraphGap is the pause between segments that starts a new paragraph in
+// the full transcript
+const ParagraphGap = 3 * time.Second
+
+// fullInterval is how often the full transcripts are rewritten while a
+// session runs
+const fullInterval = time.Minute
+
+// WriteFull assembles the JSONL transcript at path into a readable full
+// transcript next to it: paragraphs split on pauses of ParagraphGap or more,
+// each prefixed with its start time. If any record was translated, the text
+// before translation goes into a second file. The files are replaced
+// atomically, and their names are returned, the full transcript first.
+func WriteFull(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcript: %w", err)
+	}
+	records, err := ReadRecords(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks are appended as they finish, which isn't always in order
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	dir := filepath.Dir(path)
+	base := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+
+	// Captions are what viewers saw, masked if they were
+	captionText := func(record Record) string {
+		if record.Caption != "" {
+			return record.Caption
+		}
+		return record.Text
+	}
+	files := []string{base + FullSuffix}
+	if err := writeAtomic(filepath.Join(dir, files[0]), func(w io.Writer) error {
+		return WriteParagraphs(w, records, captionText)
+	}); err != nil {
+		return nil, err
+	}
+
+	translated := false
+	for _, record := range records {
+		if record.Source != "" {
+			translated = true
+			break
+		}
+	}
+	if !translated {
+		return files, nil
+	}
+
+	sourceText := func(record Record) string {
+		if record.Source != "" {
+			return record.Source
+		}
+		return record.Text
+	}
+	files = append(files, base+SourceSuffix)
+	if err := writeAtomic(filepath.Join(dir, files[1]), func(w io.Writer) error {
+		return WriteParagraphs(w, records, sourceText)
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// VerboseJSON is a transcript in the verbose_json format of Whisper and the
+// OpenAI transcription API, without the tokens of the segments
+type VerboseJSON struct {
+	Language string           `json:"language"`
+	Duration float64          `json:"duration"` // Seconds
+	Text     string           `json:"text"`
+	Segments []VerboseSegment `json:"segments"`
+}
+
+// VerboseSegment is a segment of a VerboseJSON transcript
+type VerboseSegment struct {
+	ID               int     `json:"id"`
+	Seek             int     `json:"seek"`
+	Start            float64 `json:"start"`
+	End              float64 `json:"end"`
+	Text             string  `json:"text"`
+	Temperature      float64 `json:"temperature"`
+	AvgLogProb       float64 `json:"avg_logprob"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	NoSpeechProb     float64 `json:"no_speech_prob"`
+}
+
+// ToVerboseJSON converts segments of audio lasting duration seconds to a
+// verbose_json transcript in language. Segments are numbered in order, and
+// the text is their text joined by spaces.
+func ToVerboseJSON(language string, duration float64, segments []transcriber.Segment) VerboseJSON {
+	verbose := VerboseJSON{
+		Language: language,
+		Duration: duration,
+		Segments: make([]VerboseSegment, 0, len(segments)),
+	}
+
+	texts := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		text := subtitles.Unwrap(segment.Text)
+		texts = append(texts, text)
+		verbose.Segments = append(verbose.Segments, VerboseSegment{
+			ID:               i,
+			Seek:             segment.Seek,
+			Start:            segment.Start,
+			End:              segment.End,
+			Text:             text,
+			Temperature:      segment.Temperature,
+			AvgLogProb:       segment.AvgLogProb,
+			CompressionRatio: segment.CompressionRatio,
+			NoSpeechProb:     segment.NoSpeechProb,
+		})
+	}
+	verbose.Text = strings.Join(texts, " ")
+	return verbose
+}
+
+// WriteVerboseJSON converts the JSONL transcript at path to a verbose_json
+// transcript in language next to it, with the captions as they were shown.
+// The file is replaced atomically, and its name is returned.
+func WriteVerboseJSON(path, language string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open transcript: %w", err)
+	}
+	records, err := ReadRecords(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// Chunks are appended as they finish, which isn't always in order
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	segments := make([]transcriber.Segment, 0, len(records))
+	var duration float64
+	for _, record := range records {
+		if record.Gap > 0 {
+			continue
+		}
+		text := record.Text
+		if record.Caption != "" {
+			text = record.Caption
+		}
+		segments = append(segments, transcriber.Segment{
+			Start:            record.Start,
+			End:              record.End,
+			Text:             text,
+			AvgLogProb:       record.AvgLogProb,
+			NoSpeechProb:     record.NoSpeechProb,
+			Seek:             record.Seek,
+			Temperature:      record.Temperature,
+			CompressionRatio: record.CompressionRatio,
+		})
+		duration = max(duration, record.End)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), ".jsonl") + VerboseSuffix
+	verbose := ToVerboseJSON(language, duration, segments)
+	if err := writeAtomic(filepath.Join(filepath.Dir(path), name), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(verbose)
+	}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// ReadRecords reads a JSONL transcript
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid transcript record on line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read transcript: %w", err)
+	}
+	return records, nil
+}
+
+// WriteParagraphs writes the text of records as paragraphs, split on pauses
+// of ParagraphGap or more and prefixed with their start time as [HH:MM:SS].
+// Reconnects of the publisher get a paragraph of their own.
+func WriteParagraphs(w io.Writer, records []Record, text func(Record) string) error {
+	bw := bufio.NewWriter(w)
+	var paragraph []string
+	var start, end float64
+
+	write := func(start float64, text string) error {
+		seconds := int(max(start, 0))
+		_, err := fmt.Fprintf(bw, "[%02d:%02d:%02d] %s\n\n", seconds/3600, seconds/60%60, seconds%60, text)
+		return err
+	}
+	flush := func() error {
+		if len(paragraph) == 0 {
+			return nil
+		}
+		err := write(start, strings.Join(paragraph, " "))
+		paragraph = nil
+		return err
+	}
+
+	for _, record := range records {
+		if record.Gap > 0 {
+			err := flush()
+			if err == nil {
+				err = write(record.Start, gapNote(time.Duration(record.Gap*float64(time.Second))))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write transcript: %w", err)
+			}
+			continue
+		}
+		t := strings.TrimSpace(text(record))
+		if t == "" {
+			continue
+		}
+		if len(paragraph) > 0 && record.Start-end >= ParagraphGap.Seconds() {
+			if err := flush(); err != nil {
+				return fmt.Errorf("failed to write transcript: %w", err)
+			}
+		}
+		if len(paragraph) == 0 {
+			start = record.Start
+		}
+		paragraph = append(paragraph, t)
+		end = record.End
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	return nil
+}
+
+// writeAtomic writes a file through a temporary file in the same directory
+// that replaces it once complete, so a crash never leaves it truncated
+func writeAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
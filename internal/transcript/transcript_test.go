@@ -0,0 +1,369 @@
+package transcript
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+)
+
+// verboseKeys and verboseSegmentKeys are the fields of Whisper's verbose_json
+// output and its segments, tokens left out
+var (
+	verboseKeys        = []string{"duration", "language", "segments", "text"}
+	verboseSegmentKeys = []string{"avg_logprob", "compression_ratio", "end", "id", "no_speech_prob", "seek", "start", "temperature", "text"}
+)
+
+// decodeVerbose checks that data has exactly the fields of the verbose_json
+// schema with the types parsers expect, and returns its segments
+func decodeVerbose(t *testing.T, data []byte) (map[string]any, []map[string]any) {
+	t.Helper()
+	var top map[string]any
+	if err := json.Unmarshal(data, &top); err != nil {
+		t.Fatal(err)
+	}
+	if keys := sortedKeys(top); !slices.Equal(keys, verboseKeys) {
+		t.Fatalf("fields = %v, want %v", keys, verboseKeys)
+	}
+	for key, kind := range map[string]reflect.Kind{"language": reflect.String, "duration": reflect.Float64, "text": reflect.String, "segments": reflect.Slice} {
+		if got := reflect.TypeOf(top[key]); got == nil || got.Kind() != kind {
+			t.Errorf("%s is %v, want %s", key, got, kind)
+		}
+	}
+
+	rawSegments, _ := top["segments"].([]any)
+	segments := make([]map[string]any, 0, len(rawSegments))
+	for i, raw := range rawSegments {
+		segment, ok := raw.(map[string]any)
+		if !ok {
+			t.Fatalf("segment %d is %T, want an object", i, raw)
+		}
+		if keys := sortedKeys(segment); !slices.Equal(keys, verboseSegmentKeys) {
+			t.Errorf("segment %d fields = %v, want %v", i, keys, verboseSegmentKeys)
+		}
+		for key, value := range segment {
+			want := reflect.Float64
+			if key == "text" {
+				want = reflect.String
+			}
+			if got := reflect.TypeOf(value); got == nil || got.Kind() != want {
+				t.Errorf("segment %d %s is %v, want %s", i, key, got, want)
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return top, segments
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestToVerboseJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []transcriber.Segment
+		text     string
+		ids      []float64
+	}{
+		{"no segments", nil, "", []float64{}},
+		{
+			"numbered in order",
+			[]transcriber.Segment{
+				{ID: 7, Start: 0, End: 1.5, Text: "Hello", Temperature: 0.2, AvgLogProb: -0.3, CompressionRatio: 1.4, NoSpeechProb: 0.01},
+				{ID: 3, Start: 1.5, End: 3, Text: "world", Seek: 150},
+			},
+			"Hello world",
+			[]float64{0, 1},
+		},
+		{
+			"line breaks unwrapped",
+			[]transcriber.Segment{{Start: 0, End: 2, Text: "a caption\nover two lines"}},
+			"a caption over two lines",
+			[]float64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(ToVerboseJSON("de", 3, tt.segments))
+			if err != nil {
+				t.Fatal(err)
+			}
+			top, segments := decodeVerbose(t, data)
+
+			if top["language"] != "de" || top["duration"] != 3.0 || top["text"] != tt.text {
+				t.Errorf("language %v, duration %v, text %q, want de, 3, %q", top["language"], top["duration"], top["text"], tt.text)
+			}
+			ids := []float64{}
+			for i, segment := range segments {
+				ids = append(ids, segment["id"].(float64))
+				if strings.Contains(segment["text"].(string), "\n") {
+					t.Errorf("segment %d text %q has a line break", i, segment["text"])
+				}
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("ids = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestToVerboseJSONFields(t *testing.T) {
+	segment := transcriber.Segment{Start: 1.25, End: 2.5, Text: "Hello", Seek: 125, Temperature: 0.2, AvgLogProb: -0.3, CompressionRatio: 1.4, NoSpeechProb: 0.01}
+	data, err := json.Marshal(ToVerboseJSON("en", 2.5, []transcriber.Segment{segment}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, segments := decodeVerbose(t, data)
+
+	want := map[string]any{
+		"id":                0.0,
+		"seek":              125.0,
+		"start":             1.25,
+		"end":               2.5,
+		"text":              "Hello",
+		"temperature":       0.2,
+		"avg_logprob":       -0.3,
+		"compression_ratio": 1.4,
+		"no_speech_prob":    0.01,
+	}
+	if !reflect.DeepEqual(segments[0], want) {
+		t.Errorf("segment = %v, want %v", segments[0], want)
+	}
+}
+
+func TestWriteVerboseJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stream.jsonl")
+	// Chunks finish out of order, a reconnect is marked, and a masked
+	// segment keeps its unmasked text apart from the caption
+	records := []Record{
+		{Chunk: 1, Start: 10, End: 12, Text: "second"},
+		{Start: 12, End: 12, Gap: 30},
+		{Chunk: 0, Start: 1, End: 3, Text: "damn first", Masked: true, Caption: "**** first", AvgLogProb: -0.2},
+	}
+	var jsonl strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonl.Write(append(line, '\n'))
+	}
+	if err := os.WriteFile(path, []byte(jsonl.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := WriteVerboseJSON(path, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "stream"+VerboseSuffix {
+		t.Errorf("name = %q, want %q", name, "stream"+VerboseSuffix)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, segments := decodeVerbose(t, data)
+
+	if top["text"] != "**** first second" || top["duration"] != 12.0 {
+		t.Errorf("text %q, duration %v, want the captions in order lasting 12s", top["text"], top["duration"])
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want the gap left out", len(segments))
+	}
+	if segments[0]["start"] != 1.0 || segments[0]["avg_logprob"] != -0.2 {
+		t.Errorf("first segment = %v, want the one starting at 1s", segments[0])
+	}
+}
+
+// readFile returns the content of the file at path, empty if there is none
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreFlush(t *testing.T) {
+	dir := t.TempDir()
+	store, err := New(dir, "stream", subtitles.FormatSRT, subtitles.VTTOptions{}, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	full := filepath.Join(dir, "stream"+FullSuffix)
+
+	chunks := [][]transcriber.Segment{
+		{{Start: 1, End: 2, Text: "first chunk"}},
+		{{Start: 11, End: 12, Text: "second chunk"}},
+	}
+	for i, captions := range chunks {
+		if err := store.Append(i, "en", captions, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		// The full transcript is only written every so often, or when flushed
+		if text := readFile(t, full); strings.Contains(text, captions[0].Text) {
+			t.Fatalf("full transcript has chunk %d before the flush", i)
+		}
+
+		// Flushing again and again changes nothing
+		for flush := 0; flush < 2; flush++ {
+			paths, err := store.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(paths, full) {
+				t.Errorf("Flush() = %v, want the full transcript among them", paths)
+			}
+
+			// Every file is complete up to the last chunk appended
+			for _, ext := range []string{".txt", ".jsonl", FullSuffix} {
+				text := readFile(t, filepath.Join(dir, "stream"+ext))
+				for _, appended := range chunks[:i+1] {
+					if !strings.Contains(text, appended[0].Text) {
+						t.Errorf("stream%s after flush %d of chunk %d misses %q:\n%s", ext, flush, i, appended[0].Text, text)
+					}
+				}
+			}
+		}
+	}
+
+	// A closed store only reports where its files are
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := store.Flush(); err != nil || len(paths) == 0 {
+		t.Errorf("Flush() after Close = %v, %v, want the paths", paths, err)
+	}
+}
+
+func TestStoreAppendRetried(t *testing.T) {
+	dir := t.TempDir()
+	store, err := New(dir, "stream", subtitles.FormatSRT, subtitles.VTTOptions{}, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	first := []transcriber.Segment{{ID: 0, Start: 1, End: 2, Text: "first"}, {ID: 1, Start: 2, End: 3, Text: "second"}}
+	if err := store.Append(0, "en", first, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		chunk    int
+		segments []transcriber.Segment
+		err      error
+	}{
+		// A late completion and its retry both yield the chunk
+		{"retried chunk", 0, first, ErrDuplicateSegments},
+		{"retry with one more segment", 0, append(slices.Clone(first), transcriber.Segment{ID: 2, Start: 3, End: 4, Text: "third"}), ErrDuplicateSegments},
+		{"same segment in another chunk", 1, []transcriber.Segment{{ID: 0, Start: 11, End: 12, Text: "fourth"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.Append(tt.chunk, "en", tt.segments, nil, nil); !errors.Is(err, tt.err) {
+				t.Fatalf("Append() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// Every segment is written once
+	if _, err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".txt", ".jsonl"} {
+		text := readFile(t, filepath.Join(dir, "stream"+ext))
+		for _, want := range []string{"first", "second", "third", "fourth"} {
+			if n := strings.Count(text, want); n != 1 {
+				t.Errorf("stream%s has %q %d times, want once:\n%s", ext, want, n, text)
+			}
+		}
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	tests := []struct {
+		format subtitles.SubtitleFormat
+		header string // Expected at the start of the file
+		cue    string // Expected with the number of the last cue
+	}{
+		{subtitles.FormatSRT, "1\n", "4\n"},
+		{subtitles.FormatVTT, "WEBVTT\n", "4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			dir := t.TempDir()
+			sidecar, err := NewSidecar(dir, "stream", tt.format, subtitles.VTTOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sidecar.Close()
+			if want := "stream." + string(tt.format); sidecar.Name() != want {
+				t.Errorf("Name() = %q, want %q", sidecar.Name(), want)
+			}
+
+			// A retried chunk only adds what wasn't written yet, and chunks
+			// are told apart by their stream time
+			first := []transcriber.Segment{{ID: 0, Start: 1, End: 2, Text: "first"}, {ID: 1, Start: 2, End: 3, Text: "second"}}
+			writes := []struct {
+				streamTime time.Duration
+				segments   []transcriber.Segment
+			}{
+				{0, first},
+				{0, first},
+				{0, append(slices.Clone(first), transcriber.Segment{ID: 2, Start: 3, End: 4, Text: "third"})},
+				{10 * time.Second, []transcriber.Segment{{ID: 0, Start: 11, End: 12, Text: "fourth"}}},
+			}
+			for _, w := range writes {
+				if err := sidecar.WriteCues(w.streamTime, w.segments); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The cues are on disk as the stream goes on
+			path, err := sidecar.Sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := readFile(t, path)
+			if !strings.HasPrefix(text, tt.header) {
+				t.Errorf("%s starts with %q, want %q", path, text[:min(len(text), 10)], tt.header)
+			}
+			for _, want := range []string{"first", "second", "third", "fourth"} {
+				if n := strings.Count(text, want); n != 1 {
+					t.Errorf("%s has %q %d times, want once:\n%s", path, want, n, text)
+				}
+			}
+			if cues := strings.Count(text, " --> "); cues != 4 || !strings.Contains(text, "\n\n"+tt.cue) {
+				t.Errorf("%s has %d cues, want 4 numbered in order:\n%s", path, cues, text)
+			}
+
+			if err := sidecar.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := sidecar.WriteCues(20*time.Second, first); err == nil {
+				t.Error("WriteCues() after Close succeeded")
+			}
+		})
+	}
+}
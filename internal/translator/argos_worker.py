@@ -0,0 +1,57 @@
+# Persistent Argos Translate worker. Reads one JSON request per line from
+# stdin, {"id": 1, "text": "...", "from": "de", "to": "en"}, and writes one
+# JSON response per line to stdout, {"id": 1, "text": "..."} or
+# {"id": 1, "error": "..."}. A {"ready": true} line is written once the
+# installed packages have been loaded.
+import json
+import sys
+
+from argostranslate import translate
+
+translations = {}
+
+
+def get_translation(source, target):
+    key = (source, target)
+    if key not in translations:
+        languages = {lang.code: lang for lang in translate.get_installed_languages()}
+        if source not in languages or target not in languages:
+            raise ValueError("language pair %s to %s is not installed" % (source, target))
+        translation = languages[source].get_translation(languages[target])
+        if translation is None:
+            raise ValueError("no translation from %s to %s" % (source, target))
+        translations[key] = translation
+    return translations[key]
+
+
+def respond(response):
+    sys.stdout.write(json.dumps(response) + "\n")
+    sys.stdout.flush()
+
+
+def main():
+    translate.get_installed_languages()
+    respond({"ready": True})
+
+    for line in sys.stdin:
+        line = line.strip()
+        if not line:
+            continue
+
+        try:
+            request = json.loads(line)
+        except ValueError:
+            # Without an id there is no one to answer
+            continue
+
+        response = {"id": request.get("id")}
+        try:
+            translation = get_translation(request["from"], request["to"])
+            response["text"] = translation.translate(request["text"])
+        except Exception as e:
+            response["error"] = str(e)
+        respond(response)
+
+
+if __name__ == "__main__":
+    main()
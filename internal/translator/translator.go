@@ -1,77 +1,294 @@
 package translator
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/procs"
 	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
 )
 
+// ErrPairUnavailable is returned when no installed package, direct or via the
+// pivot language, translates between two languages
+var ErrPairUnavailable = errors.New("translation pair not available")
+
+// ErrWarmingUp is returned while the packages of a language pair are being
+// installed; segments keep their original text until they are
+var ErrWarmingUp = errors.New("translation warming up")
+
+// pivotLang is the language Argos Translate pivots through when there is no
+// direct package for a language pair
+const pivotLang = "en"
+
+// ErrDegraded is returned once translation has failed too many times in a
+// row; further attempts are skipped until ResetFailures is called
+var ErrDegraded = errors.New("translation degraded after repeated failures")
+
+// ErrWorkerUnavailable is returned when the translation worker isn't running
+var ErrWorkerUnavailable = errors.New("translation worker unavailable")
+
+// workerScript is the persistent worker run by the Python interpreter
+//
+//go:embed argos_worker.py
+var workerScript string
+
+// workerPython is the interpreter running the worker, the same one
+// argostranslate is installed for
+const workerPython = "python3"
+
+const (
+	// workerStartTimeout bounds how long the worker may take to load the
+	// installed packages
+	workerStartTimeout = 2 * time.Minute
+	// workerRestartDelay is the initial delay before restarting a worker
+	// that died, doubled after each failed attempt up to workerMaxRestartDelay
+	workerRestartDelay    = time.Second
+	workerMaxRestartDelay = 30 * time.Second
+	// maxWorkerResponseSize bounds a single response line
+	maxWorkerResponseSize = 1 << 20
+)
+
+// Installer installs the packages translating from sourceLang to targetLang,
+// giving up once ctx is done
+type Installer func(ctx context.Context, sourceLang, targetLang string) error
+
+// stderrExcerptSize is how much of argos-translate's stderr is kept in errors
+const stderrExcerptSize = 512
+
 // Translator handles text translation using Argos Translate
 type Translator struct {
 	config       *config.Config
 	modelsPath   string
+	logger       *logrus.Logger
 	langPairLock sync.Mutex
 	loadedPairs  map[string]bool
+
+	// worker, if started, translates in a long-lived process instead of
+	// running argos-translate per segment. It is replaced when the proxy
+	// restarts, while translations may be running.
+	worker atomic.Pointer[worker]
+
+	// failMu guards the consecutive failure count and the degraded flag
+	failMu              sync.Mutex
+	consecutiveFailures int
+	degraded            bool
+
+	// installer, if set, installs missing pairs when they are requested.
+	// installMu guards the pairs being installed and those whose installation
+	// failed, which aren't tried again until ResetFailures is called.
+	installer      Installer
+	installTimeout time.Duration
+	installMu      sync.Mutex
+	installing     map[string]bool
+	failedInstalls map[string]bool
 }
 
 // New creates a new Translator instance
-func New(cfg *config.Config) *Translator {
+func New(cfg *config.Config, logger *logrus.Logger) *Translator {
 	return &Translator{
 		config:      cfg,
 		modelsPath:  cfg.ArgosModelsPath,
+		logger:      logger,
 		loadedPairs: make(map[string]bool),
 	}
 }
 
+// SetInstaller makes missing language pairs be installed by installer when
+// they are requested, giving up after timeout. It must be called before any
+// translation.
+func (t *Translator) SetInstaller(installer Installer, timeout time.Duration) {
+	t.installer = installer
+	t.installTimeout = timeout
+	t.installing = make(map[string]bool)
+	t.failedInstalls = make(map[string]bool)
+}
+
+// StartWorker starts the persistent translation worker, which is restarted
+// automatically if it dies. While it isn't running, and if it can't be
+// started at all, text is translated by running argos-translate once per
+// segment. A worker started before is stopped.
+func (t *Translator) StartWorker() error {
+	w := &worker{
+		modelsPath: t.modelsPath,
+		timeout:    t.config.TranslationTimeout,
+		logger:     t.logger,
+		pending:    make(map[uint64]chan workerResponse),
+		done:       make(chan struct{}),
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	if old := t.worker.Swap(w); old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// Close stops the translation worker, if any. Until it is started again,
+// text is translated by running argos-translate once per segment.
+func (t *Translator) Close() {
+	if w := t.worker.Swap(nil); w != nil {
+		w.close()
+	}
+}
+
 // TranslateSegments translates an array of transcript segments to the target language
 func (t *Translator) TranslateSegments(segments []transcriber.Segment, sourceLang, targetLang string) ([]transcriber.Segment, error) {
+	translated, _, err := t.TranslateSegmentsFallback(segments, sourceLang, targetLang)
+	return translated, err
+}
+
+// TranslateSegmentsFallback is TranslateSegments that also reports which
+// segments kept their original text because their translation failed. The
+// report is nil if none did; on error every segment kept it.
+func (t *Translator) TranslateSegmentsFallback(segments []transcriber.Segment, sourceLang, targetLang string) ([]transcriber.Segment, []bool, error) {
 	if !t.config.EnableTranslation {
-		return segments, nil
+		return segments, nil, nil
 	}
 
 	// Skip if source and target languages are the same
 	if sourceLang == targetLang {
-		return segments, nil
+		return segments, nil, nil
 	}
 
 	// Normalize language codes
 	sourceLang = normalizeLanguageCode(sourceLang)
 	targetLang = normalizeLanguageCode(targetLang)
 
-	// Check if we have the required language pair
-	if !t.checkLanguagePair(sourceLang, targetLang) {
-		return segments, fmt.Errorf("translation model for %s to %s not available", sourceLang, targetLang)
+	// Check if we have the required language pair, installing it if possible
+	if err := t.pairReady(sourceLang, targetLang); err != nil {
+		return segments, nil, err
+	}
+
+	if t.Degraded() {
+		return segments, nil, ErrDegraded
 	}
 
 	// Prepare translated segments
 	translatedSegments := make([]transcriber.Segment, len(segments))
+	copy(translatedSegments, segments)
+	var fallback []bool
 	for i, segment := range segments {
-		// Copy segment properties
-		translatedSegments[i] = segment
+		// Segments spoken in the target language need no translation, and
+		// those in a third language are translated from it if possible
+		from := sourceLang
+		if detected := normalizeLanguageCode(segment.DetectedLanguage); detected != "" && detected != sourceLang {
+			if detected == targetLang {
+				continue
+			}
+			if t.pairAvailable(detected, targetLang) {
+				from = detected
+			}
+		}
 
-		// Translate text
-		translatedText, err := t.translateText(segment.Text, sourceLang, targetLang)
+		// Translate text, keeping the original text on error
+		translatedText, err := t.translateText(segment.Text, from, targetLang)
 		if err != nil {
-			// On error, keep original text but log the error (in a real implementation)
-			translatedSegments[i].Text = segment.Text
+			t.logger.WithError(err).WithFields(logrus.Fields{
+				"source_lang":   from,
+				"target_lang":   targetLang,
+				"segment_chars": len([]rune(segment.Text)),
+			}).Warn("Segment translation failed, keeping original text")
+
+			if fallback == nil {
+				fallback = make([]bool, len(segments))
+			}
+			if t.recordFailure() {
+				// The remaining segments keep their original text
+				for j := i; j < len(segments); j++ {
+					fallback[j] = true
+				}
+				break
+			}
+			fallback[i] = true
 			continue
 		}
 
+		t.recordSuccess()
 		translatedSegments[i].Text = translatedText
 	}
 
-	return translatedSegments, nil
+	return translatedSegments, fallback, nil
+}
+
+// Degraded reports whether translation was given up on after repeated
+// failures
+func (t *Translator) Degraded() bool {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+	return t.degraded
+}
+
+// ResetFailures clears the failure count, the degraded flag and the pairs
+// that failed to install, so a new session tries translating again
+func (t *Translator) ResetFailures() {
+	t.failMu.Lock()
+	t.consecutiveFailures = 0
+	t.degraded = false
+	t.failMu.Unlock()
+
+	t.installMu.Lock()
+	clear(t.failedInstalls)
+	t.installMu.Unlock()
+}
+
+// recordFailure counts a failed segment and reports whether translation has
+// now been marked degraded
+func (t *Translator) recordFailure() bool {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+
+	t.consecutiveFailures++
+	threshold := t.config.TranslationMaxFailures
+	if threshold <= 0 || t.consecutiveFailures < threshold || t.degraded {
+		return t.degraded
+	}
+
+	t.degraded = true
+	t.logger.WithField("consecutive_failures", t.consecutiveFailures).Error("Translation degraded, skipping translation until the next session")
+	return true
+}
+
+// recordSuccess resets the consecutive failure count
+func (t *Translator) recordSuccess() {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+	t.consecutiveFailures = 0
 }
 
 // translateText translates a single string from source to target language
 func (t *Translator) translateText(text, sourceLang, targetLang string) (string, error) {
+	if w := t.worker.Load(); w != nil {
+		translated, err := w.translate(text, sourceLang, targetLang)
+		if !errors.Is(err, ErrWorkerUnavailable) {
+			return strings.TrimSpace(translated), err
+		}
+		// The worker is being restarted, so fall back to a one-shot process
+	}
+
+	return t.runArgosTranslate(text, sourceLang, targetLang)
+}
+
+// runArgosTranslate translates a single string with a new argos-translate
+// process
+func (t *Translator) runArgosTranslate(text, sourceLang, targetLang string) (string, error) {
 	// Create command with pipes
 	cmd := exec.Command("argos-translate", "--from", sourceLang, "--to", targetLang, "-")
 	cmd.Env = append(os.Environ(), fmt.Sprintf("ARGOS_PACKAGES_DIR=%s", t.modelsPath))
@@ -93,7 +310,7 @@ func (t *Translator) translateText(text, sourceLang, targetLang string) (string,
 	}
 
 	// Start the command
-	if err := cmd.Start(); err != nil {
+	if err := procs.Launch(cmd, procs.RoleTranslator); err != nil {
 		return "", fmt.Errorf("failed to start argos-translate: %w", err)
 	}
 
@@ -118,15 +335,136 @@ func (t *Translator) translateText(text, sourceLang, targetLang string) (string,
 	}
 
 	// Wait for command to complete
-	err = cmd.Wait()
+	err = procs.Wait(cmd)
 	if err != nil {
-		return "", fmt.Errorf("translation failed: %w, stderr: %s", err, stderrOutput.String())
+		return "", fmt.Errorf("translation failed: %w, stderr: %s", err, stderrExcerpt(stderrOutput.String()))
 	}
 
 	// Return the translated text
 	return strings.TrimSpace(output.String()), nil
 }
 
+// CheckLanguagePair returns an error wrapping ErrPairUnavailable if segments
+// cannot be translated from sourceLang to targetLang
+func (t *Translator) CheckLanguagePair(sourceLang, targetLang string) error {
+	sourceLang = normalizeLanguageCode(sourceLang)
+	targetLang = normalizeLanguageCode(targetLang)
+
+	// An empty target means the captions stay in the source language
+	if targetLang == "" || sourceLang == targetLang {
+		return nil
+	}
+	if !t.config.EnableTranslation {
+		return fmt.Errorf("%w: translation is disabled", ErrPairUnavailable)
+	}
+	if !t.pairAvailable(sourceLang, targetLang) {
+		return fmt.Errorf("%w: %s to %s", ErrPairUnavailable, sourceLang, targetLang)
+	}
+	return nil
+}
+
+// RequestLanguagePair is CheckLanguagePair for a live stream: a missing pair
+// is accepted if it can be installed, which starts in the background. Until
+// it is ready, segments keep their original text.
+func (t *Translator) RequestLanguagePair(sourceLang, targetLang string) error {
+	err := t.CheckLanguagePair(sourceLang, targetLang)
+	if err == nil || !t.config.EnableTranslation {
+		return err
+	}
+
+	err = t.pairReady(normalizeLanguageCode(sourceLang), normalizeLanguageCode(targetLang))
+	if errors.Is(err, ErrWarmingUp) {
+		return nil
+	}
+	return err
+}
+
+// pairReady returns nil if segments can be translated from sourceLang to
+// targetLang, an error wrapping ErrWarmingUp while the pair is being
+// installed, and one wrapping ErrPairUnavailable otherwise. A missing pair
+// starts installing if there is an installer and it didn't fail already.
+func (t *Translator) pairReady(sourceLang, targetLang string) error {
+	if t.pairAvailable(sourceLang, targetLang) {
+		return nil
+	}
+	if t.installer == nil {
+		return fmt.Errorf("%w: %s to %s", ErrPairUnavailable, sourceLang, targetLang)
+	}
+
+	pairKey := fmt.Sprintf("%s-%s", sourceLang, targetLang)
+
+	t.installMu.Lock()
+	defer t.installMu.Unlock()
+
+	switch {
+	case t.failedInstalls[pairKey]:
+		return fmt.Errorf("%w: %s to %s, installation failed", ErrPairUnavailable, sourceLang, targetLang)
+	case t.installing[pairKey]:
+		return fmt.Errorf("%w: installing %s to %s", ErrWarmingUp, sourceLang, targetLang)
+	}
+
+	// The pair may have been installed since it was checked
+	if t.installedSinceCheck(sourceLang, targetLang) {
+		return nil
+	}
+
+	t.installing[pairKey] = true
+	go t.install(sourceLang, targetLang, pairKey)
+	return fmt.Errorf("%w: installing %s to %s", ErrWarmingUp, sourceLang, targetLang)
+}
+
+// install installs the packages of a pair and makes it available, or marks
+// it failed
+func (t *Translator) install(sourceLang, targetLang, pairKey string) {
+	logger := t.logger.WithFields(logrus.Fields{
+		"source_lang": sourceLang,
+		"target_lang": targetLang,
+	})
+	logger.Info("Installing translation pair, captions stay untranslated until it is ready")
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.installTimeout)
+	defer cancel()
+	err := t.installer(ctx, sourceLang, targetLang)
+	if err == nil && !t.installedSinceCheck(sourceLang, targetLang) {
+		err = fmt.Errorf("%w: %s to %s still missing after installation", ErrPairUnavailable, sourceLang, targetLang)
+	}
+
+	t.installMu.Lock()
+	defer t.installMu.Unlock()
+	delete(t.installing, pairKey)
+	if err != nil {
+		t.failedInstalls[pairKey] = true
+		logger.WithError(err).Error("Failed to install translation pair, it stays unavailable for this session")
+		return
+	}
+	logger.Info("Translation pair installed, translating captions")
+}
+
+// installedSinceCheck forgets what is cached about a pair and its pivot legs
+// and checks it again. The worker looks up the installed languages again for
+// pairs it hasn't translated yet, so it needs no restart.
+func (t *Translator) installedSinceCheck(sourceLang, targetLang string) bool {
+	t.langPairLock.Lock()
+	for _, key := range []string{sourceLang + "-" + targetLang, sourceLang + "-" + pivotLang, pivotLang + "-" + targetLang} {
+		delete(t.loadedPairs, key)
+	}
+	t.langPairLock.Unlock()
+
+	return t.pairAvailable(sourceLang, targetLang)
+}
+
+// pairAvailable reports whether a direct package or both legs of a pivot
+// through pivotLang are installed
+func (t *Translator) pairAvailable(sourceLang, targetLang string) bool {
+	if t.checkLanguagePair(sourceLang, targetLang) {
+		return true
+	}
+	if sourceLang == pivotLang || targetLang == pivotLang {
+		return false
+	}
+	return t.checkLanguagePair(sourceLang, pivotLang) && t.checkLanguagePair(pivotLang, targetLang)
+}
+
 // checkLanguagePair verifies if the language pair is available
 func (t *Translator) checkLanguagePair(sourceLang, targetLang string) bool {
 	// Generate a unique key for this language pair
@@ -140,24 +478,323 @@ func (t *Translator) checkLanguagePair(sourceLang, targetLang string) bool {
 		return loaded
 	}
 
-	// Check if the language pair is available by listing installed packages
+	pairs, err := t.AvailablePairs()
+	if err != nil {
+		return false
+	}
+
+	available := slices.Contains(pairs, LangPair{Source: sourceLang, Target: targetLang})
+	t.loadedPairs[pairKey] = available
+	return available
+}
+
+// stderrExcerpt returns the end of stderr, where the error usually is
+func stderrExcerpt(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if len(stderr) > stderrExcerptSize {
+		stderr = "..." + stderr[len(stderr)-stderrExcerptSize:]
+	}
+	return stderr
+}
+
+// LangPair is a direction an installed package translates in
+type LangPair struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+func (p LangPair) String() string {
+	return p.Source + "->" + p.Target
+}
+
+// packageNamePattern matches installed translation packages in argospm
+// output, named translate-<from>_<to> or, by older releases, translate-<from>-to-<to>
+var packageNamePattern = regexp.MustCompile(`\btranslate-([a-zA-Z]+)(?:_|-to-)([a-zA-Z]+)\b`)
+
+// AvailablePairs lists the language pairs of the installed Argos Translate
+// packages. Pairs only reachable by pivoting are not included.
+func (t *Translator) AvailablePairs() ([]LangPair, error) {
 	cmd := exec.Command("argospm", "list")
 	cmd.Env = append(os.Environ(), fmt.Sprintf("ARGOS_PACKAGES_DIR=%s", t.modelsPath))
 
-	output, err := cmd.CombinedOutput()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := procs.Run(cmd, procs.RoleTranslator); err != nil {
+		return nil, fmt.Errorf("failed to list argos packages: %w, output: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return parsePackageList(output.String()), nil
+}
+
+// parsePackageList extracts the language pairs from argospm list output,
+// sorted and without duplicates
+func parsePackageList(output string) []LangPair {
+	pairs := []LangPair{}
+	for _, match := range packageNamePattern.FindAllStringSubmatch(output, -1) {
+		pair := LangPair{
+			Source: normalizeLanguageCode(match[1]),
+			Target: normalizeLanguageCode(match[2]),
+		}
+		if !slices.Contains(pairs, pair) {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	slices.SortFunc(pairs, func(a, b LangPair) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return pairs
+}
+
+// workerRequest is a translation request sent to the worker
+type workerRequest struct {
+	ID   uint64 `json:"id"`
+	Text string `json:"text"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// workerResponse is a line written by the worker: either the ready signal or
+// the answer to the request with the same ID
+type workerResponse struct {
+	ID    uint64 `json:"id"`
+	Ready bool   `json:"ready"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// worker manages the persistent argos_worker.py process. Requests may be sent
+// concurrently; responses are matched to them by ID.
+type worker struct {
+	modelsPath string
+	timeout    time.Duration
+	logger     *logrus.Logger
+
+	// writeMu serializes writes of request lines
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser // nil while the process isn't running
+	nextID  uint64
+	pending map[uint64]chan workerResponse
+	closed  bool
+
+	// done is closed when the worker is closed, ending any restarts
+	done chan struct{}
+}
+
+// start starts the worker process and waits until it is ready
+func (w *worker) start() error {
+	cmd := exec.Command(workerPython, "-u", "-c", workerScript)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ARGOS_PACKAGES_DIR=%s", w.modelsPath))
+
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return false
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
-	// Look for the required package in the output
-	packageName := fmt.Sprintf("translate-%s-to-%s", sourceLang, targetLang)
-	if strings.Contains(string(output), packageName) {
-		t.loadedPairs[pairKey] = true
-		return true
+	// Python only writes to stderr when something goes wrong
+	stderr := w.logger.WithField("component", "translation-worker").WriterLevel(logrus.WarnLevel)
+	cmd.Stderr = stderr
+
+	if err := procs.Launch(cmd, procs.RoleTranslator); err != nil {
+		stderr.Close()
+		return fmt.Errorf("failed to start translation worker: %w", err)
 	}
 
-	t.loadedPairs[pairKey] = false
-	return false
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxWorkerResponseSize)
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- waitReady(scanner)
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(workerStartTimeout):
+		err = fmt.Errorf("translation worker not ready after %s", workerStartTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		procs.Wait(cmd)
+		stderr.Close()
+		return err
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		stdin.Close()
+		procs.Wait(cmd)
+		stderr.Close()
+		return nil
+	}
+	w.stdin = stdin
+	w.mu.Unlock()
+
+	w.logger.WithField("pid", cmd.Process.Pid).Info("Translation worker started")
+
+	go w.readResponses(cmd, scanner, stderr)
+	return nil
+}
+
+// waitReady reads the ready signal the worker writes once it has loaded
+func waitReady(scanner *bufio.Scanner) error {
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		return fmt.Errorf("translation worker exited before it was ready: %w", err)
+	}
+
+	var response workerResponse
+	if err := json.Unmarshal(scanner.Bytes(), &response); err != nil || !response.Ready {
+		return fmt.Errorf("unexpected output from translation worker: %q", scanner.Text())
+	}
+	return nil
+}
+
+// readResponses delivers responses to the waiting requests until the process
+// exits, then fails the requests still pending and restarts the worker
+func (w *worker) readResponses(cmd *exec.Cmd, scanner *bufio.Scanner, stderr io.Closer) {
+	for scanner.Scan() {
+		var response workerResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			w.logger.WithError(err).Warn("Invalid response from translation worker")
+			continue
+		}
+
+		w.mu.Lock()
+		ch, ok := w.pending[response.ID]
+		delete(w.pending, response.ID)
+		w.mu.Unlock()
+
+		// Requests that timed out are no longer pending
+		if ok {
+			ch <- response
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		w.logger.WithError(err).Warn("Failed to read from translation worker, killing it")
+		cmd.Process.Kill()
+	}
+
+	err := procs.Wait(cmd)
+	stderr.Close()
+
+	w.mu.Lock()
+	w.stdin = nil
+	for id, ch := range w.pending {
+		close(ch)
+		delete(w.pending, id)
+	}
+	closed := w.closed
+	w.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	w.logger.WithError(err).Warn("Translation worker exited, restarting it")
+	w.restart()
+}
+
+// restart starts the worker again, backing off while it fails to start
+func (w *worker) restart() {
+	delay := workerRestartDelay
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(delay):
+		}
+
+		if err := w.start(); err != nil {
+			w.logger.WithError(err).WithField("retry_in", delay).Error("Failed to restart translation worker")
+			delay = min(delay*2, workerMaxRestartDelay)
+			continue
+		}
+		return
+	}
+}
+
+// translate sends a request to the worker and waits for its response. It
+// returns an error wrapping ErrWorkerUnavailable if the worker isn't running
+// or exits before responding.
+func (w *worker) translate(text, sourceLang, targetLang string) (string, error) {
+	w.mu.Lock()
+	stdin := w.stdin
+	if stdin == nil {
+		w.mu.Unlock()
+		return "", ErrWorkerUnavailable
+	}
+	w.nextID++
+	id := w.nextID
+	ch := make(chan workerResponse, 1)
+	w.pending[id] = ch
+	w.mu.Unlock()
+
+	line, err := json.Marshal(workerRequest{ID: id, Text: text, From: sourceLang, To: targetLang})
+	if err != nil {
+		w.forget(id)
+		return "", fmt.Errorf("failed to encode translation request: %w", err)
+	}
+
+	w.writeMu.Lock()
+	_, err = stdin.Write(append(line, '\n'))
+	w.writeMu.Unlock()
+	if err != nil {
+		w.forget(id)
+		return "", fmt.Errorf("%w: %v", ErrWorkerUnavailable, err)
+	}
+
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return "", fmt.Errorf("%w: worker exited", ErrWorkerUnavailable)
+		}
+		if response.Error != "" {
+			return "", fmt.Errorf("translation failed: %s", response.Error)
+		}
+		return response.Text, nil
+	case <-timer.C:
+		w.forget(id)
+		return "", fmt.Errorf("translation timed out after %s", w.timeout)
+	}
+}
+
+// forget stops waiting for the response to request id
+func (w *worker) forget(id uint64) {
+	w.mu.Lock()
+	delete(w.pending, id)
+	w.mu.Unlock()
+}
+
+// close stops the worker by closing its stdin, which ends its read loop
+func (w *worker) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.done)
+	stdin := w.stdin
+	w.mu.Unlock()
+
+	if stdin != nil {
+		stdin.Close()
+	}
 }
 
 // normalizeLanguageCode converts language codes to the format used by Argos Translate
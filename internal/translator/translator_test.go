@@ -0,0 +1,137 @@
+package translator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParsePackageList(t *testing.T) {
+	tests := []struct {
+		sample string
+		want   []LangPair
+	}{
+		{"current.txt", []LangPair{{"de", "en"}, {"en", "de"}, {"en", "es"}}},
+		{"legacy.txt", []LangPair{{"en", "fr"}, {"fr", "en"}}},
+		{"duplicates.txt", []LangPair{{"de", "en"}, {"en", "de"}}},
+		{"warnings.txt", []LangPair{{"ja", "en"}}},
+		{"empty.txt", []LangPair{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "argospm", tt.sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := parsePackageList(string(output))
+			// An empty install lists no pairs rather than null in the API
+			if got == nil {
+				t.Fatal("parsePackageList() = nil")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePackageList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testTranslator returns a translator that logs nothing
+func testTranslator() *Translator {
+	cfg := config.New()
+	cfg.TranslationTimeout = 5 * time.Second
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(cfg, logger)
+}
+
+func TestWorkerRestart(t *testing.T) {
+	testutil.CheckGoroutines(t)
+	testutil.FakeArgosWorker(t)
+	tr := testTranslator()
+	defer tr.Close()
+
+	translate := func(text string) {
+		t.Helper()
+		got, err := tr.translateText(text, "en", "de")
+		if err != nil {
+			t.Fatalf("translateText(%q) = %v", text, err)
+		}
+		if want := "[de] " + text; got != want {
+			t.Fatalf("translateText(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	if err := tr.StartWorker(); err != nil {
+		t.Fatal(err)
+	}
+	first := tr.worker.Load()
+	translate("before")
+
+	tr.Close()
+	if tr.worker.Load() != nil {
+		t.Fatal("worker still set after Close")
+	}
+	// Closing again does nothing
+	tr.Close()
+
+	if err := tr.StartWorker(); err != nil {
+		t.Fatal(err)
+	}
+	if w := tr.worker.Load(); w == nil || w == first {
+		t.Fatal("worker not started again")
+	}
+	translate("after")
+}
+
+func TestWorkerRestartWhileTranslating(t *testing.T) {
+	testutil.CheckGoroutines(t)
+	testutil.FakeArgosWorker(t)
+	tr := testTranslator()
+	defer tr.Close()
+	if err := tr.StartWorker(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Translations go on while the worker is stopped and started again.
+	// Those between a stop and the next start fall back to argos-translate,
+	// which may be missing, so only the ones the worker answered are
+	// checked.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				text := fmt.Sprintf("line %d", n)
+				if got, err := tr.translateText(text, "en", "de"); err == nil && got != "[de] "+text {
+					t.Errorf("translateText(%q) = %q", text, got)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		tr.Close()
+		if err := tr.StartWorker(); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
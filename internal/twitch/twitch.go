@@ -0,0 +1,248 @@
+// Package twitch publishes live captions to a Twitch extension through the
+// Extension PubSub endpoint of the Helix API, so viewers see them in the
+// extension's overlay instead of burned into the video.
+package twitch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/subtitles"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenLifetime is how long a signed extension token is valid; tokens are
+	// signed again tokenRefreshMargin before they expire
+	tokenLifetime      = 3 * time.Minute
+	tokenRefreshMargin = 30 * time.Second
+
+	// minSendInterval keeps within the limit of 100 messages per minute per
+	// channel
+	minSendInterval = time.Minute / 100
+
+	// maxMessageBytes is the largest message Twitch accepts
+	maxMessageBytes = 5 * 1024
+
+	// requestTimeout bounds a single request to the endpoint
+	requestTimeout = 10 * time.Second
+)
+
+// Publisher sends captions to a Twitch extension
+type Publisher struct {
+	endpoint      string
+	clientID      string
+	ownerID       string
+	broadcasterID string
+	secret        []byte
+	client        *http.Client
+	logger        *logrus.Entry
+
+	token       string
+	tokenExpiry time.Time
+	nextSend    time.Time
+}
+
+// New creates a publisher from the Twitch extension settings
+func New(cfg *config.Config, logger *logrus.Logger) (*Publisher, error) {
+	secret, err := base64.StdEncoding.DecodeString(cfg.TwitchExtensionSecret)
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New("extension secret must be the base64 secret from the extension settings")
+	}
+	if cfg.TwitchExtensionOwnerID == "" || cfg.TwitchBroadcasterID == "" {
+		return nil, errors.New("extension owner and broadcaster IDs are required")
+	}
+
+	return &Publisher{
+		endpoint:      cfg.TwitchExtensionEndpoint,
+		clientID:      cfg.TwitchExtensionClientID,
+		ownerID:       cfg.TwitchExtensionOwnerID,
+		broadcasterID: cfg.TwitchBroadcasterID,
+		secret:        secret,
+		client:        &http.Client{Timeout: requestTimeout},
+		logger:        logger.WithField("publisher", "twitch"),
+	}, nil
+}
+
+// caption is a caption in the extension message
+type caption struct {
+	Text     string  `json:"text"`
+	Start    float64 `json:"start"`    // Seconds since the start of the stream
+	Duration float64 `json:"duration"` // Seconds to display the caption
+}
+
+// message is the payload the extension receives
+type message struct {
+	Type     string    `json:"type"`
+	Captions []caption `json:"captions"`
+}
+
+// WriteCues publishes the stream-relative captions of a chunk in a single
+// message, once the last one is far enough back. It is a subtitle sink of the
+// pipeline; captions Twitch doesn't take are dropped.
+func (p *Publisher) WriteCues(_ time.Duration, segments []transcriber.Segment) error {
+	batch := make([]caption, 0, len(segments))
+	for _, segment := range segments {
+		batch = append(batch, caption{
+			Text:     subtitles.Unwrap(segment.Text),
+			Start:    segment.Start,
+			Duration: segment.End - segment.Start,
+		})
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	time.Sleep(time.Until(p.nextSend))
+	return p.send(batch)
+}
+
+// Close ends the captions of the stream. The publisher takes those of the
+// next one.
+func (p *Publisher) Close() error {
+	return nil
+}
+
+// send posts a batch of captions, retrying once with a new token if the
+// current one is rejected
+func (p *Publisher) send(batch []caption) error {
+	body, dropped, err := p.encode(batch)
+	if err != nil {
+		return fmt.Errorf("failed to encode captions for the Twitch extension: %w", err)
+	}
+	if dropped > 0 {
+		p.logger.WithField("dropped", dropped).Warn("Captions too long for one Twitch extension message, dropping the oldest")
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		p.nextSend = time.Now().Add(minSendInterval)
+
+		resp, err := p.post(body)
+		if err != nil {
+			return fmt.Errorf("failed to publish captions to the Twitch extension: %w", err)
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			// The token may have been rejected for clock skew; sign a new one
+			p.token = ""
+			continue
+		case resp.StatusCode == http.StatusTooManyRequests:
+			if reset, err := strconv.ParseInt(resp.Header.Get("Ratelimit-Reset"), 10, 64); err == nil {
+				p.nextSend = time.Unix(reset, 0)
+			}
+			return fmt.Errorf("Twitch extension rate limit reached until %s, captions dropped", p.nextSend.Format(time.RFC3339))
+		case resp.StatusCode >= 300:
+			return fmt.Errorf("Twitch extension rejected the captions: %s", resp.Status)
+		}
+		return nil
+	}
+	return errors.New("Twitch extension rejected the new token")
+}
+
+// encode builds the request body for a batch of captions, dropping the oldest
+// captions until the message fits. It returns how many were dropped.
+func (p *Publisher) encode(batch []caption) ([]byte, int, error) {
+	for dropped := 0; dropped < len(batch); dropped++ {
+		msg := message{Type: "captions", Captions: batch[dropped:]}
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(encoded) > maxMessageBytes {
+			continue
+		}
+
+		body, err := json.Marshal(map[string]any{
+			"target":              []string{"broadcast"},
+			"broadcaster_id":      p.broadcasterID,
+			"is_global_broadcast": false,
+			"message":             string(encoded),
+		})
+		return body, dropped, err
+	}
+	return nil, 0, errors.New("caption longer than a Twitch extension message")
+}
+
+// post sends a request body to the extension endpoint
+func (p *Publisher) post(body []byte) (*http.Response, error) {
+	token, err := p.authToken(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Client-Id", p.clientID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Drain the body so the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	return resp, nil
+}
+
+// authToken returns a signed extension token, signing a new one when the
+// current one is about to expire
+func (p *Publisher) authToken(now time.Time) (string, error) {
+	if p.token != "" && now.Add(tokenRefreshMargin).Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	expiry := now.Add(tokenLifetime)
+	token, err := signToken(p.secret, map[string]any{
+		"exp":        expiry.Unix(),
+		"user_id":    p.ownerID,
+		"role":       "external",
+		"channel_id": p.broadcasterID,
+		"pubsub_perms": map[string][]string{
+			"send": {"broadcast"},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign extension token: %w", err)
+	}
+
+	p.token = token
+	p.tokenExpiry = expiry
+	return token, nil
+}
+
+// signToken creates an HS256 JSON Web Token with the given claims
+func signToken(secret []byte, claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,581 @@
+// Package upload copies the files of a session to an S3-compatible bucket
+// once the session ended, and while it runs for long sessions. Requests are
+// signed with AWS Signature Version 4, large files like recordings go up in
+// parts, and a manifest object written last lists what was uploaded.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/session"
+	"github.com/sirupsen/logrus"
+)
+
+// ManifestFile is the name of the manifest object next to the session files
+const ManifestFile = "manifest.json"
+
+const (
+	// partSize is the size of the parts files larger than it are uploaded
+	// in, smaller ones go up in a single request
+	partSize = 16 << 20
+
+	// maxAttempts is how often a request is sent before the upload fails,
+	// waiting retryDelay, doubled every time, in between
+	maxAttempts = 3
+	retryDelay  = time.Second
+
+	// requestTimeout bounds a single request, which carries at most a part
+	requestTimeout = 5 * time.Minute
+)
+
+// Manifest lists the objects uploaded for a session
+type Manifest struct {
+	Session    string    `json:"session"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Final      bool      `json:"final"` // Set once the session ended
+	Objects    []Object  `json:"objects"`
+}
+
+// Object is a session file uploaded to the bucket
+type Object struct {
+	Key    string `json:"key"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// uploadedFile is a file as it was uploaded, to skip it while unchanged
+type uploadedFile struct {
+	size    int64
+	modTime time.Time
+	object  Object
+}
+
+// Uploader uploads session files to a bucket
+type Uploader struct {
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	accessKey   string
+	secretKey   string
+	pathStyle   bool
+	deleteLocal bool
+	client      *http.Client
+	logger      *logrus.Entry
+
+	// mu makes sessions upload one at a time. uploaded holds the files
+	// uploaded from each session directory while the session runs.
+	mu       sync.Mutex
+	uploaded map[string]map[string]uploadedFile
+}
+
+// New creates an uploader from the upload settings
+func New(cfg *config.Config, logger *logrus.Logger) (*Uploader, error) {
+	endpoint, err := url.Parse(cfg.UploadEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload endpoint: %w", err)
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, errors.New("upload endpoint must be an http(s) URL, e.g. https://s3.eu-central-1.amazonaws.com")
+	}
+	if cfg.UploadBucket == "" {
+		return nil, errors.New("upload bucket is not set")
+	}
+	if cfg.UploadAccessKey == "" || cfg.UploadSecretKey == "" {
+		return nil, errors.New("upload credentials are not set")
+	}
+
+	prefix := strings.Trim(cfg.UploadPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &Uploader{
+		endpoint:    endpoint,
+		bucket:      cfg.UploadBucket,
+		prefix:      prefix,
+		region:      cfg.UploadRegion,
+		accessKey:   cfg.UploadAccessKey,
+		secretKey:   cfg.UploadSecretKey,
+		pathStyle:   cfg.UploadPathStyle,
+		deleteLocal: cfg.UploadDeleteLocal,
+		client:      &http.Client{Timeout: requestTimeout},
+		logger:      logger.WithField("component", "upload"),
+		uploaded:    make(map[string]map[string]uploadedFile),
+	}, nil
+}
+
+// Sync uploads the files of a running session that changed since they were
+// last uploaded, and the manifest
+func (u *Uploader) Sync(ctx context.Context, sess *session.Session) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, err := u.upload(ctx, sess, nil)
+	return err
+}
+
+// Finish uploads the files of an ended session and the manifest, records the
+// upload in the session summary, and deletes the uploaded files if
+// configured. A failed upload is recorded as pending, for the upload command
+// to finish.
+func (u *Uploader) Finish(ctx context.Context, sess *session.Session) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	logger := u.logger.WithField("session", sess.ID())
+	setStatus(sess, session.UploadStatus{Status: session.UploadRunning}, logger)
+
+	// The summary uploaded already records the upload as done, the manifest
+	// written after it is what shows the upload completed
+	uploadedAt := time.Now()
+	done := session.UploadStatus{
+		Status:     session.UploadDone,
+		Manifest:   u.sessionKey(sess) + ManifestFile,
+		UploadedAt: &uploadedAt,
+	}
+	manifest, err := u.upload(ctx, sess, &done)
+	if err != nil {
+		setStatus(sess, session.UploadStatus{Status: session.UploadPending, Error: err.Error()}, logger)
+		return err
+	}
+	delete(u.uploaded, sess.Dir())
+
+	if u.deleteLocal {
+		done.LocalDeleted = deleteFiles(sess.Dir(), manifest, logger)
+	}
+	setStatus(sess, done, logger)
+	logger.WithFields(logrus.Fields{
+		"objects":  len(manifest.Objects),
+		"manifest": done.Manifest,
+	}).Info("Session uploaded")
+	return nil
+}
+
+// setStatus records the upload status in the session summary
+func setStatus(sess *session.Session, status session.UploadStatus, logger *logrus.Entry) {
+	sess.Update(func(summary *session.Summary) {
+		summary.Upload = &status
+	})
+	if err := sess.WriteSummary(); err != nil {
+		logger.WithError(err).Warn("Failed to write session summary")
+	}
+}
+
+// upload uploads the session files, the summary with done as its upload
+// status, and the manifest last. Files unchanged since they were uploaded
+// while the session ran are skipped, as are files gone missing.
+func (u *Uploader) upload(ctx context.Context, sess *session.Session, done *session.UploadStatus) (Manifest, error) {
+	dir := sess.Dir()
+	base := u.sessionKey(sess)
+	summary := sess.Summary()
+	manifest := Manifest{Session: summary.ID, Final: done != nil}
+
+	uploaded := u.uploaded[dir]
+	if uploaded == nil {
+		uploaded = make(map[string]uploadedFile)
+		u.uploaded[dir] = uploaded
+	}
+
+	for _, name := range summary.Files {
+		// Only plain file names inside the session directory are uploaded
+		if filepath.Base(name) != name || name == session.SummaryFile {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			u.logger.WithField("file", path).Warn("Session file is missing, not uploading it")
+			continue
+		} else if err != nil {
+			return Manifest{}, fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+
+		previous, ok := uploaded[name]
+		if !ok || previous.size != info.Size() || !previous.modTime.Equal(info.ModTime()) {
+			object, err := u.putFile(ctx, base+name, path)
+			if err != nil {
+				return Manifest{}, fmt.Errorf("failed to upload %s: %w", name, err)
+			}
+			object.File = name
+			previous = uploadedFile{size: info.Size(), modTime: info.ModTime(), object: object}
+			uploaded[name] = previous
+		}
+		manifest.Objects = append(manifest.Objects, previous.object)
+	}
+
+	summary.Upload = done
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to encode session summary: %w", err)
+	}
+	object, err := u.putBytes(ctx, base+session.SummaryFile, data, "application/json")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to upload %s: %w", session.SummaryFile, err)
+	}
+	object.File = session.SummaryFile
+	manifest.Objects = append(manifest.Objects, object)
+
+	manifest.UploadedAt = time.Now()
+	data, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if _, err := u.putBytes(ctx, base+ManifestFile, data, "application/json"); err != nil {
+		return Manifest{}, fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// deleteFiles deletes the uploaded files of the manifest from dir, keeping
+// the summary so the session stays listed. It reports whether all of them
+// were deleted.
+func deleteFiles(dir string, manifest Manifest, logger *logrus.Entry) bool {
+	deleted := true
+	for _, object := range manifest.Objects {
+		if object.File == session.SummaryFile {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, object.File)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.WithError(err).WithField("file", object.File).Warn("Failed to delete uploaded file")
+			deleted = false
+		}
+	}
+	return deleted
+}
+
+// sessionKey returns the key prefix of the objects of a session, which
+// mirrors the session directory below the output directory
+func (u *Uploader) sessionKey(sess *session.Session) string {
+	dir := sess.Dir()
+	return u.prefix + filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir) + "/"
+}
+
+// putBytes uploads data as the object key in a single request
+func (u *Uploader) putBytes(ctx context.Context, key string, data []byte, contentType string) (Object, error) {
+	sum := sha256.Sum256(data)
+	header := http.Header{"Content-Type": {contentType}}
+	if _, err := u.do(ctx, http.MethodPut, key, nil, data, header); err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// putFile uploads the file at path as the object key, in parts if it is
+// larger than partSize
+func (u *Uploader) putFile(ctx context.Context, key, path string) (Object, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Object{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return Object{}, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	if info.Size() <= partSize {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return Object{}, err
+		}
+		return u.putBytes(ctx, key, data, contentType)
+	}
+	return u.putMultipart(ctx, key, file, contentType)
+}
+
+// completedPart is a part of a multipart upload in its completion request
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads r as the object key in parts of partSize. A failed
+// upload is aborted so the bucket doesn't keep its parts.
+func (u *Uploader) putMultipart(ctx context.Context, key string, r io.Reader, contentType string) (Object, error) {
+	body, err := u.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadID == "" {
+		return Object{}, fmt.Errorf("failed to start multipart upload: no upload ID in response")
+	}
+
+	object, err := u.putParts(ctx, key, initiated.UploadID, r)
+	if err != nil {
+		// Aborted even if the upload was cancelled
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestTimeout)
+		defer cancel()
+		if _, abortErr := u.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr != nil {
+			u.logger.WithError(abortErr).WithField("key", key).Warn("Failed to abort multipart upload")
+		}
+		return Object{}, err
+	}
+	return object, nil
+}
+
+// putParts uploads the parts of a multipart upload and completes it
+func (u *Uploader) putParts(ctx context.Context, key, uploadID string, r io.Reader) (Object, error) {
+	fileHash := sha256.New()
+	buf := make([]byte, partSize)
+	var parts []completedPart
+	var size int64
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return Object{}, fmt.Errorf("failed to read part %d: %w", number, err)
+		}
+		part := buf[:n]
+		fileHash.Write(part)
+		size += int64(n)
+
+		etag, err := u.putPart(ctx, key, uploadID, number, part)
+		if err != nil {
+			return Object{}, fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+		if n < partSize {
+			break
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to encode multipart completion: %w", err)
+	}
+	body, err := u.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, complete, http.Header{"Content-Type": {"application/xml"}})
+	if err != nil {
+		return Object{}, fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	// Completion fails with a 200 status and an error in the body
+	if err := responseError(body); err != nil {
+		return Object{}, fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return Object{Key: key, Size: size, SHA256: hex.EncodeToString(fileHash.Sum(nil))}, nil
+}
+
+// putPart uploads a part of a multipart upload and returns its ETag
+func (u *Uploader) putPart(ctx context.Context, key, uploadID string, number int, part []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	var etag string
+	_, err := u.doHeader(ctx, http.MethodPut, key, query, part, nil, func(header http.Header) {
+		etag = header.Get("ETag")
+	})
+	if err != nil {
+		return "", err
+	}
+	if etag == "" {
+		return "", errors.New("no ETag in response")
+	}
+	return etag, nil
+}
+
+// do sends a signed request for the object key, retrying failures that may
+// pass, and returns the response body
+func (u *Uploader) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	return u.doHeader(ctx, method, key, query, body, header, nil)
+}
+
+// doHeader is like do, passing the response header of a successful request
+// to onHeader if set
+func (u *Uploader) doHeader(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header, onHeader func(http.Header)) ([]byte, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		status, respHeader, respBody, err := u.send(ctx, method, key, query, body, header)
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if err == nil && status >= 300 {
+			err = statusError(status, respBody)
+		}
+		if err == nil {
+			if onHeader != nil {
+				onHeader(respHeader)
+			}
+			return respBody, nil
+		}
+		if !retry || attempt == maxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+
+		u.logger.WithError(err).WithFields(logrus.Fields{"key": key, "attempt": attempt}).Warn("Upload request failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// send sends a single signed request and reads its response
+func (u *Uploader) send(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (int, http.Header, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	u.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp.StatusCode, resp.Header, respBody, nil
+}
+
+// objectURL returns the URL of the object key, with the bucket in the path
+// or in the host name
+func (u *Uploader) objectURL(key string, query url.Values) string {
+	target := *u.endpoint
+	path := strings.TrimSuffix(target.Path, "/") + "/" + key
+	if u.pathStyle {
+		path = strings.TrimSuffix(target.Path, "/") + "/" + u.bucket + "/" + key
+	} else {
+		target.Host = u.bucket + "." + target.Host
+	}
+	target.Path = path
+	target.RawPath = escapePath(path)
+	target.RawQuery = canonicalQuery(query)
+	return target.String()
+}
+
+// sign adds the Signature Version 4 authorization of req, whose payload has
+// the SHA-256 payloadHash, at now
+func (u *Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// The host, the content type, and the x-amz headers are signed
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+u.secretKey), date)
+	for _, part := range []string{u.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", u.accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapePath percent-encodes everything in path but the unreserved
+// characters and slashes, as the signature expects
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, with spaces as %20
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// statusError describes a response with a failure status
+func statusError(status int, body []byte) error {
+	if err := responseError(body); err != nil {
+		return fmt.Errorf("status %d: %w", status, err)
+	}
+	return fmt.Errorf("status %d", status)
+}
+
+// responseError returns the error in an S3 error response body, nil if it
+// holds none
+func responseError(body []byte) error {
+	var response struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &response) != nil || response.XMLName.Local != "Error" {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", response.Code, response.Message)
+}
@@ -0,0 +1,194 @@
+// Package version reports which build of the proxy is running and the
+// versions of the external tools it runs. The build is set at link time:
+//
+//	go build -ldflags "-X github.com/ben/transcription-proxy/internal/version.Version=v1.2.0
+//	  -X github.com/ben/transcription-proxy/internal/version.Commit=$(git rev-parse HEAD)
+//	  -X github.com/ben/transcription-proxy/internal/version.BuildDate=$(date -u +%FT%TZ)" ./cmd
+//
+// Without it the commit recorded by the Go toolchain is used, if any.
+package version
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set with -ldflags -X
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// probeTimeout bounds how long a tool gets to print its version
+const probeTimeout = 10 * time.Second
+
+// Tool is an external tool and its version, or why it couldn't be found
+type Tool struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Tools     []Tool `json:"tools,omitempty"`
+}
+
+// probe is a tool and the commands that print its version, tried in order
+type probe struct {
+	name     string
+	commands [][]string
+}
+
+// probes are the tools whose versions are reported. The Python tools fall
+// back to their package metadata, since not every release has --version.
+var probes = []probe{
+	{"ffmpeg", [][]string{{"ffmpeg", "-version"}}},
+	{"whisper-ctranslate2", [][]string{
+		{"whisper-ctranslate2", "--version"},
+		{"python3", "-c", "from importlib.metadata import version; print(version('whisper-ctranslate2'))"},
+	}},
+	{"argos-translate", [][]string{
+		{"argos-translate", "--version"},
+		{"python3", "-c", "from importlib.metadata import version; print(version('argostranslate'))"},
+	}},
+}
+
+// versionPattern matches a version number in the output of a tool
+var versionPattern = regexp.MustCompile(`\d+\.\d+[\w.+~-]*`)
+
+var (
+	toolsOnce sync.Once
+	tools     []Tool
+)
+
+// Build returns the running build without the tool versions
+func Build() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.modified" && setting.Value == "true" && Commit == "":
+				info.Commit += "-dirty"
+			}
+		}
+	}
+	return info
+}
+
+// Get returns the running build with the tool versions
+func Get() Info {
+	info := Build()
+	info.Tools = Tools()
+	return info
+}
+
+// Tools returns the versions of the external tools. They are probed on the
+// first call, concurrently, and cached; a tool that is missing or fails is
+// reported with its error.
+func Tools() []Tool {
+	toolsOnce.Do(func() {
+		tools = make([]Tool, len(probes))
+		var wg sync.WaitGroup
+		for i, probe := range probes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tools[i] = probe.run()
+			}()
+		}
+		wg.Wait()
+	})
+	return tools
+}
+
+// run runs the commands of the probe until one prints a version
+func (p probe) run() Tool {
+	tool := Tool{Name: p.name}
+	var errs []string
+	for _, command := range p.commands {
+		version, err := runVersion(command)
+		if err == nil {
+			tool.Version = version
+			return tool
+		}
+		errs = append(errs, err.Error())
+	}
+	tool.Error = strings.Join(errs, "; ")
+	return tool
+}
+
+// runVersion runs command and parses the version from its output
+func runVersion(command []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", command[0], err)
+	}
+	version := parseVersion(string(output))
+	if version == "" {
+		return "", fmt.Errorf("%s: no version in output", command[0])
+	}
+	return version, nil
+}
+
+// parseVersion returns the version in the first line of the output of a
+// tool: the word after "version", e.g. "ffmpeg version 6.1.1-3ubuntu5
+// Copyright ...", or else the first version number
+func parseVersion(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for i, field := range fields[:len(fields)-1] {
+			if strings.EqualFold(field, "version") {
+				return fields[i+1]
+			}
+		}
+		return versionPattern.FindString(line)
+	}
+	return ""
+}
+
+// String returns a one-line description of the build, e.g.
+// "v1.2.0 (commit 1a2b3c4, built 2024-05-01T12:00:00Z, go1.22.0)"
+func (i Info) String() string {
+	details := []string{}
+	if i.Commit != "" {
+		commit, dirty := strings.CutSuffix(i.Commit, "-dirty")
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if dirty {
+			commit += "-dirty"
+		}
+		details = append(details, "commit "+commit)
+	}
+	if i.BuildDate != "" {
+		details = append(details, "built "+i.BuildDate)
+	}
+	details = append(details, i.GoVersion)
+	return fmt.Sprintf("%s (%s)", i.Version, strings.Join(details, ", "))
+}
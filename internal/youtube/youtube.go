@@ -0,0 +1,195 @@
+// Package youtube publishes live captions to the caption ingestion URL of a
+// YouTube live stream, so viewers get YouTube's own captions instead of a
+// track embedded in the video. Every request carries a sequence number and
+// each caption the UTC time it belongs at in the video.
+package youtube
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ben/transcription-proxy/internal/config"
+	"github.com/ben/transcription-proxy/internal/transcriber"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minSendInterval paces the requests
+	minSendInterval = time.Second
+
+	// maxAttempts is how often a batch is sent before it is dropped, waiting
+	// retryDelay, doubled every time, in between
+	maxAttempts = 3
+	retryDelay  = time.Second
+
+	// requestTimeout bounds a single request to the ingestion URL
+	requestTimeout = 10 * time.Second
+
+	// timestampLayout is the UTC timestamp YouTube expects before every
+	// caption
+	timestampLayout = "2006-01-02T15:04:05.000"
+)
+
+// Publisher posts captions to a YouTube caption ingestion URL
+type Publisher struct {
+	ingestURL *url.URL
+	offset    time.Duration
+	client    *http.Client
+	logger    *logrus.Entry
+
+	seq         int       // Sequence number of the last request
+	streamStart time.Time // When the stream the captions belong to started
+	nextSend    time.Time
+}
+
+// New creates a publisher from the YouTube caption settings
+func New(cfg *config.Config, logger *logrus.Logger) (*Publisher, error) {
+	ingestURL, err := url.Parse(cfg.YouTubeCaptionsURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caption ingestion URL: %w", err)
+	}
+	if (ingestURL.Scheme != "http" && ingestURL.Scheme != "https") || ingestURL.Query().Get("cid") == "" {
+		return nil, errors.New("caption ingestion URL must be the http(s) URL with cid= from YouTube Studio")
+	}
+
+	return &Publisher{
+		ingestURL: ingestURL,
+		offset:    cfg.YouTubeCaptionsOffset,
+		client:    &http.Client{Timeout: requestTimeout},
+		logger:    logger.WithField("publisher", "youtube"),
+	}, nil
+}
+
+// cue is a caption placed at the time it is shown in the video
+type cue struct {
+	at   time.Time
+	text string
+}
+
+// StartStream makes the captions written from now on count from at, when the
+// stream they belong to starts in the video
+func (p *Publisher) StartStream(at time.Time) {
+	p.logger.WithField("offset", p.offset).Info("Publishing captions to YouTube")
+	p.streamStart = at
+}
+
+// WriteCues publishes the stream-relative captions of a chunk in a single
+// request, once the last one is far enough back. It is a subtitle sink of the
+// pipeline, which never waits for YouTube. A request that fails is retried,
+// and its captions are dropped if it still fails.
+func (p *Publisher) WriteCues(_ time.Duration, segments []transcriber.Segment) error {
+	var batch []cue
+	for _, segment := range segments {
+		if strings.TrimSpace(segment.Text) == "" {
+			continue
+		}
+		start := p.streamStart
+		if start.IsZero() {
+			// No stream was started, the caption is live
+			start = time.Now().Add(-time.Duration(segment.End * float64(time.Second)))
+		}
+		at := start.Add(time.Duration(segment.Start*float64(time.Second)) + p.offset)
+		batch = append(batch, cue{at: at, text: segment.Text})
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	time.Sleep(time.Until(p.nextSend))
+	return p.send(batch)
+}
+
+// Close ends the captions of the stream. The publisher takes those of the
+// next one once it is started.
+func (p *Publisher) Close() error {
+	p.streamStart = time.Time{}
+	return nil
+}
+
+// send posts a batch of captions, retrying failures that may pass
+func (p *Publisher) send(batch []cue) error {
+	body := encode(batch)
+	p.seq++
+	target := p.requestURL(p.seq)
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		p.nextSend = time.Now().Add(minSendInterval)
+
+		status, err := p.post(target, body)
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		switch {
+		case err != nil:
+			p.logger.WithError(err).WithField("attempt", attempt).Warn("Failed to publish captions to YouTube")
+		case retry:
+			p.logger.WithFields(logrus.Fields{"status": status, "attempt": attempt}).Warn("YouTube failed to take the captions")
+		case status >= 300:
+			return fmt.Errorf("YouTube rejected the captions with status %d", status)
+		}
+		if !retry {
+			return nil
+		}
+		if attempt == maxAttempts {
+			return fmt.Errorf("gave up publishing %d captions to YouTube after %d attempts", len(batch), attempt)
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// encode builds the request body, every caption preceded by its timestamp
+func encode(batch []cue) []byte {
+	var b bytes.Buffer
+	for _, c := range batch {
+		b.WriteString(c.at.UTC().Format(timestampLayout))
+		b.WriteByte('\n')
+		// A caption is a single line of the body
+		b.WriteString(strings.Join(strings.Fields(c.text), " "))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// requestURL returns the ingestion URL with the sequence number of a request
+func (p *Publisher) requestURL(seq int) string {
+	u := *p.ingestURL
+	query := u.Query()
+	query.Set("seq", strconv.Itoa(seq))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// post sends a request body to the ingestion URL, returning the status code
+func (p *Publisher) post(target string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// The URL holds the stream's caption key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -1,16 +1,34 @@
 #!/bin/bash
-# Script to download the deepdml/faster-whisper-large-v3-turbo-ct2 model from Hugging Face
+# Script to download a faster-whisper CTranslate2 model from Hugging Face
 
 set -e
 
-MODEL_NAME="deepdml/faster-whisper-large-v3-turbo-ct2"
-MODEL_DIR=${1:-/app/models/whisper}
-COMPUTE_TYPE=${2:-float16}
-USE_CUDA=${3:-true}
+MODEL_SIZE=${1:-large-v3-turbo}
+MODEL_DIR=${2:-/app/models/whisper}
+COMPUTE_TYPE=${3:-float16}
+USE_CUDA=${4:-true}
+
+# Map the model size to its Hugging Face repository and local directory name.
+# The directory names must match the ones the proxy resolves WHISPER_MODEL_SIZE to.
+case "$MODEL_SIZE" in
+  "large-v3-turbo")
+    MODEL_NAME="deepdml/faster-whisper-large-v3-turbo-ct2"
+    LOCAL_NAME="faster-whisper-large-v3-turbo-ct2"
+    ;;
+  "tiny"|"tiny.en"|"base"|"base.en"|"small"|"small.en"|"medium"|"medium.en"|"large-v2"|"large-v3")
+    MODEL_NAME="Systran/faster-whisper-$MODEL_SIZE"
+    LOCAL_NAME="faster-whisper-$MODEL_SIZE"
+    ;;
+  *)
+    echo "Unknown model size: $MODEL_SIZE"
+    echo "Supported sizes: tiny, base, small, medium (optionally .en), large-v2, large-v3, large-v3-turbo"
+    exit 1
+    ;;
+esac
 
 echo "Downloading $MODEL_NAME from Hugging Face..."
 echo "Using compute type: $COMPUTE_TYPE"
-echo "Model directory: $MODEL_DIR"
+echo "Model directory: $MODEL_DIR/$LOCAL_NAME"
 echo "Using CUDA: $USE_CUDA"
 
 # Create model directory if it doesn't exist
@@ -24,6 +42,7 @@ import sys
 # Parameters
 model_name = '$MODEL_NAME'
 model_dir = '$MODEL_DIR'
+local_name = '$LOCAL_NAME'
 compute_type = '$COMPUTE_TYPE'
 use_cuda = '$USE_CUDA'.lower() == 'true'
 
@@ -45,7 +64,7 @@ try:
     # Download the model from Hugging Face
     model_path = snapshot_download(
         repo_id=model_name,
-        local_dir=os.path.join(model_dir, 'faster-whisper-large-v3-turbo-ct2'),
+        local_dir=os.path.join(model_dir, local_name),
         local_dir_use_symlinks=False
     )
     
@@ -55,4 +74,4 @@ except Exception as e:
     sys.exit(1)
 "
 
-echo "Model download completed!"
\ No newline at end of file
+echo "Model download completed!"